@@ -0,0 +1,265 @@
+// Package acl provides role-based access control to zenodb's tables. Principals
+// authenticate with a password or an API token and are granted roles either on
+// all tables or on specific tables (or, for inserts, streams).
+package acl
+
+import (
+	"crypto/subtle"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/sql"
+)
+
+var (
+	log = golog.LoggerFor("zenodb.acl")
+
+	// ErrNotAuthenticated indicates that the provided credentials didn't match
+	// any principal.
+	ErrNotAuthenticated = errors.New("not authenticated")
+)
+
+// Role is a set of permissions. Each role includes the permissions of the
+// roles before it.
+type Role string
+
+const (
+	// Reader may query tables.
+	Reader Role = "reader"
+	// Writer may also insert into streams.
+	Writer Role = "writer"
+	// Admin may also follow and replicate streams, back up and restore the
+	// database, cancel queries and manage followers.
+	Admin Role = "admin"
+
+	// AllTables is the name used to grant a role on all tables.
+	AllTables = "*"
+)
+
+var roleLevels = map[Role]int{
+	Reader: 1,
+	Writer: 2,
+	Admin:  3,
+}
+
+// includes indicates whether r includes the permissions of other.
+func (r Role) includes(other Role) bool {
+	return roleLevels[r] >= roleLevels[other]
+}
+
+// PrincipalConfig configures a principal.
+type PrincipalConfig struct {
+	// Password is what the principal authenticates with
+	Password string
+	// Role, if specified, is granted on all tables
+	Role Role
+	// Grants grants roles on specific tables or streams, keyed by name. The
+	// name * grants the role on all tables.
+	Grants map[string]Role
+}
+
+// Config configures principals, keyed by name.
+type Config map[string]*PrincipalConfig
+
+// Principal is an authenticated user or program.
+type Principal struct {
+	Name   string
+	grants map[string]Role
+}
+
+// Root is a principal that may do anything. It's used for clients that
+// authenticate with the shared password rather than as a principal from the
+// ACL.
+var Root = &Principal{Name: "root", grants: map[string]Role{AllTables: Admin}}
+
+// Can indicates whether the principal has the given role on the named table
+// (or stream). A nil Principal, which represents an unauthenticated client
+// when authentication is disabled, can do anything. Roles on a table extend to
+// its copies in attached backups, named table@backup.
+func (p *Principal) Can(role Role, table string) bool {
+	if p == nil {
+		return true
+	}
+	table = strings.ToLower(table)
+	if i := strings.LastIndex(table, "@"); i > 0 {
+		table = table[:i]
+	}
+	granted, found := p.grants[table]
+	if found && granted.includes(role) {
+		return true
+	}
+	granted, found = p.grants[AllTables]
+	return found && granted.includes(role)
+}
+
+// Check returns an error unless the principal has the given role on all of
+// the named tables.
+func (p *Principal) Check(role Role, tables ...string) error {
+	for _, table := range tables {
+		if !p.Can(role, table) {
+			return errors.New("%v does not have the %v role on %v", p, role, table)
+		}
+	}
+	return nil
+}
+
+// CheckQuery returns an error unless the principal may run the given query,
+// which requires the reader role on every table that the query reads. SHOW
+// SETTINGS requires the admin role. SHOW TABLES lists every table, so it
+// requires the reader role on all tables, whereas DESCRIBE requires the reader
+// role on the described table.
+func (p *Principal) CheckQuery(sqlString string) error {
+	if p == nil {
+		return nil
+	}
+	if _, showSettings, _ := sql.ShowSettings(sqlString); showSettings {
+		return p.Check(Admin, AllTables)
+	}
+	if showTables, _ := sql.ShowTables(sqlString); showTables {
+		return p.Check(Reader, AllTables)
+	}
+	if table, describe, _ := sql.Describe(sqlString); describe {
+		return p.Check(Reader, table)
+	}
+	q, err := sql.Parse(sqlString)
+	if err != nil {
+		return err
+	}
+	tables, err := q.Tables()
+	if err != nil {
+		return err
+	}
+	return p.Check(Reader, tables...)
+}
+
+// String returns the principal's name, or "" for a nil Principal.
+func (p *Principal) String() string {
+	if p == nil {
+		return ""
+	}
+	return p.Name
+}
+
+// ACL authenticates principals.
+type ACL struct {
+	filename   string
+	principals []*principal
+	mx         sync.RWMutex
+}
+
+type principal struct {
+	*Principal
+	password []byte
+}
+
+// New builds an ACL from the given Config.
+func New(cfg Config) (*ACL, error) {
+	a := &ACL{}
+	if err := a.apply(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Load builds an ACL from the YAML Config in the given file. Call Reload to pick
+// up changes to the file.
+func Load(filename string) (*ACL, error) {
+	a := &ACL{filename: filename}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reloads the ACL from the file from which it was loaded. If the file
+// is invalid, the ACL keeps its current configuration.
+func (a *ACL) Reload() error {
+	if a.filename == "" {
+		return errors.New("ACL wasn't loaded from a file")
+	}
+	b, err := ioutil.ReadFile(a.filename)
+	if err != nil {
+		return errors.New("Unable to read ACL from %v: %v", a.filename, err)
+	}
+	var cfg Config
+	err = yaml.Unmarshal(b, &cfg)
+	if err != nil {
+		return errors.New("Unable to parse ACL from %v: %v", a.filename, err)
+	}
+	err = a.apply(cfg)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Loaded ACL from %v", a.filename)
+	return nil
+}
+
+func (a *ACL) apply(cfg Config) error {
+	principals := make([]*principal, 0, len(cfg))
+	for name, pc := range cfg {
+		if pc == nil || pc.Password == "" {
+			return errors.New("Principal %v has no password", name)
+		}
+		grants := make(map[string]Role, len(pc.Grants)+1)
+		if pc.Role != "" {
+			grants[AllTables] = pc.Role
+		}
+		for table, role := range pc.Grants {
+			grants[strings.ToLower(table)] = role
+		}
+		for table, role := range grants {
+			if _, valid := roleLevels[role]; !valid {
+				return errors.New("Principal %v has unknown role %v on %v", name, role, table)
+			}
+		}
+		principals = append(principals, &principal{
+			Principal: &Principal{Name: name, grants: grants},
+			password:  []byte(pc.Password),
+		})
+	}
+
+	a.mx.Lock()
+	a.principals = principals
+	a.mx.Unlock()
+	return nil
+}
+
+// Authenticate returns the principal with the given password.
+func (a *ACL) Authenticate(password string) (*Principal, error) {
+	if password == "" {
+		return nil, ErrNotAuthenticated
+	}
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	var result *Principal
+	for _, p := range a.principals {
+		// Compare against every principal to avoid leaking timing information
+		if subtle.ConstantTimeCompare(p.password, []byte(password)) == 1 {
+			result = p.Principal
+		}
+	}
+	if result == nil {
+		return nil, ErrNotAuthenticated
+	}
+	return result, nil
+}
+
+// Describe lists the grants of every principal, without their passwords, for
+// display to admins.
+func (a *ACL) Describe() map[string]map[string]Role {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	result := make(map[string]map[string]Role, len(a.principals))
+	for _, p := range a.principals {
+		grants := make(map[string]Role, len(p.grants))
+		for table, role := range p.grants {
+			grants[table] = role
+		}
+		result[p.Name] = grants
+	}
+	return result
+}
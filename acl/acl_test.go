@@ -0,0 +1,100 @@
+package acl
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACL(t *testing.T) {
+	file, err := ioutil.TempFile("", "acl")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(`
+alice:
+  password: alicepass
+  role: reader
+  grants:
+    Inbound: writer
+bob:
+  password: bobpass
+  grants:
+    table_a: reader
+carol:
+  password: carolpass
+  role: admin
+`)
+	file.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	a, err := Load(file.Name())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = a.Authenticate("")
+	assert.Equal(t, ErrNotAuthenticated, err)
+	_, err = a.Authenticate("wrong")
+	assert.Equal(t, ErrNotAuthenticated, err)
+
+	alice, err := a.Authenticate("alicepass")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "alice", alice.String())
+	assert.True(t, alice.Can(Reader, "table_b"))
+	assert.False(t, alice.Can(Writer, "table_b"))
+	assert.True(t, alice.Can(Reader, "table_b@backup-1"), "roles should extend to attached backups")
+	assert.False(t, alice.Can(Writer, "table_b@backup-1"))
+	assert.True(t, alice.Can(Writer, "inbound"))
+	assert.False(t, alice.Can(Admin, "inbound"))
+
+	bob, _ := a.Authenticate("bobpass")
+	assert.NoError(t, bob.CheckQuery("SELECT * FROM table_a"))
+	assert.Error(t, bob.CheckQuery("SELECT * FROM table_b"))
+	assert.Error(t, bob.CheckQuery("SELECT * FROM table_a WHERE x IN (SELECT x FROM table_b)"), "subquery should require access to its table")
+	assert.Error(t, bob.CheckQuery("SHOW SETTINGS"))
+	assert.Error(t, bob.CheckQuery("SHOW TABLES"), "listing tables should require access to all tables")
+	assert.NoError(t, bob.CheckQuery("DESCRIBE table_a"))
+	assert.Error(t, bob.CheckQuery("DESCRIBE table_b"))
+	assert.Error(t, bob.Check(Writer, "table_a"))
+
+	carol, _ := a.Authenticate("carolpass")
+	assert.NoError(t, carol.CheckQuery("SHOW SETTINGS"))
+	assert.NoError(t, carol.CheckQuery("SHOW TABLES"))
+	assert.NoError(t, carol.Check(Admin, "anything"))
+
+	var unrestricted *Principal
+	assert.NoError(t, unrestricted.Check(Admin, AllTables))
+	assert.NoError(t, Root.CheckQuery("SHOW SETTINGS"))
+
+	assert.Equal(t, map[string]map[string]Role{
+		"alice": {AllTables: Reader, "inbound": Writer},
+		"bob":   {"table_a": Reader},
+		"carol": {AllTables: Admin},
+	}, a.Describe())
+
+	// Invalid config keeps existing config
+	ioutil.WriteFile(file.Name(), []byte("dave:\n  password: davepass\n  role: superuser\n"), 0644)
+	assert.Error(t, a.Reload())
+	_, err = a.Authenticate("alicepass")
+	assert.NoError(t, err)
+
+	ioutil.WriteFile(file.Name(), []byte("dave:\n  password: davepass\n  role: writer\n"), 0644)
+	assert.NoError(t, a.Reload())
+	_, err = a.Authenticate("alicepass")
+	assert.Equal(t, ErrNotAuthenticated, err)
+	dave, err := a.Authenticate("davepass")
+	if assert.NoError(t, err) {
+		assert.True(t, dave.Can(Writer, "inbound"))
+	}
+
+	_, err = New(Config{"eve": {Role: Reader}})
+	assert.Error(t, err, "principal without password should be rejected")
+}
@@ -0,0 +1,217 @@
+package acl
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	tokenIDLength     = 8
+	tokenSecretLength = 32
+)
+
+// Token describes an API token. API tokens let scripts and dashboards
+// authenticate with a long-lived secret that can be revoked without affecting
+// other clients. The secret itself is only available when the token is
+// created, the TokenStore only keeps a hash of it.
+type Token struct {
+	ID   string
+	Name string
+	// Role is granted on Tables, or on all tables if no Tables are specified
+	Role    Role
+	Tables  []string `json:",omitempty"`
+	Created time.Time
+	// Hash is the SHA-256 hash of the token's secret
+	Hash string `json:",omitempty"`
+}
+
+// principal returns the Principal as which this token authenticates.
+func (t *Token) principal() *Principal {
+	grants := make(map[string]Role, len(t.Tables)+1)
+	if len(t.Tables) == 0 {
+		grants[AllTables] = t.Role
+	}
+	for _, table := range t.Tables {
+		grants[strings.ToLower(table)] = t.Role
+	}
+	return &Principal{Name: "token:" + t.Name, grants: grants}
+}
+
+// TokenStore stores API tokens in a file.
+type TokenStore struct {
+	filename string
+	tokens   map[string]*Token
+	mx       sync.RWMutex
+}
+
+// OpenTokenStore opens the TokenStore persisted in the given file, which is
+// created when the first token is created.
+func OpenTokenStore(filename string) (*TokenStore, error) {
+	s := &TokenStore{filename: filename, tokens: make(map[string]*Token)}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, errors.New("Unable to read API tokens from %v: %v", filename, err)
+	}
+	var tokens []*Token
+	err = json.Unmarshal(b, &tokens)
+	if err != nil {
+		return nil, errors.New("Unable to parse API tokens from %v: %v", filename, err)
+	}
+	for _, token := range tokens {
+		s.tokens[token.ID] = token
+	}
+	return s, nil
+}
+
+// Create creates a new token with the given name that grants the given role
+// on the given tables, or on all tables if none are specified. It returns the
+// secret with which to authenticate, which can't be retrieved later.
+func (s *TokenStore) Create(name string, role Role, tables ...string) (string, *Token, error) {
+	if name == "" {
+		return "", nil, errors.New("Please specify a name for the token")
+	}
+	if _, valid := roleLevels[role]; !valid {
+		return "", nil, errors.New("Unknown role %v", role)
+	}
+	id, err := randomHex(tokenIDLength)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomHex(tokenSecretLength)
+	if err != nil {
+		return "", nil, err
+	}
+	secret = id + "." + secret
+	token := &Token{
+		ID:      id,
+		Name:    name,
+		Role:    role,
+		Tables:  tables,
+		Created: time.Now(),
+		Hash:    hashSecret(secret),
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.tokens[id] = token
+	err = s.save()
+	if err != nil {
+		delete(s.tokens, id)
+		return "", nil, err
+	}
+	log.Debugf("Created API token %v (%v) with role %v", id, name, role)
+	return secret, token.describe(), nil
+}
+
+// Revoke revokes the token with the given ID, so that it can no longer be used
+// to authenticate.
+func (s *TokenStore) Revoke(id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	token, found := s.tokens[id]
+	if !found {
+		return errors.New("Unknown API token %v", id)
+	}
+	delete(s.tokens, id)
+	err := s.save()
+	if err != nil {
+		s.tokens[id] = token
+		return err
+	}
+	log.Debugf("Revoked API token %v (%v)", id, token.Name)
+	return nil
+}
+
+// List lists all tokens, without their hashes, ordered by name.
+func (s *TokenStore) List() []*Token {
+	s.mx.RLock()
+	result := make([]*Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		result = append(result, token.describe())
+	}
+	s.mx.RUnlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name == result[j].Name {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Authenticate returns the principal for the token with the given secret.
+func (s *TokenStore) Authenticate(secret string) (*Principal, error) {
+	id := strings.SplitN(secret, ".", 2)[0]
+	s.mx.RLock()
+	token, found := s.tokens[id]
+	s.mx.RUnlock()
+	if !found || subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrNotAuthenticated
+	}
+	return token.principal(), nil
+}
+
+// describe returns a copy of the token without its hash.
+func (t *Token) describe() *Token {
+	result := *t
+	result.Hash = ""
+	return &result
+}
+
+// save persists the tokens. Must be called while holding mx.
+func (s *TokenStore) save() error {
+	tokens := make([]*Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+	b, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return errors.New("Unable to marshal API tokens: %v", err)
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.filename), filepath.Base(s.filename))
+	if err != nil {
+		return errors.New("Unable to save API tokens: %v", err)
+	}
+	_, err = tmpFile.Write(b)
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), s.filename)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.New("Unable to save API tokens: %v", err)
+	}
+	return nil
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func randomHex(length int) (string, error) {
+	b := make([]byte, length)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.New("Unable to generate random token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
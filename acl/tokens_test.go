@@ -0,0 +1,76 @@
+package acl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokens(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tokens")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "api_tokens")
+
+	s, err := OpenTokenStore(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _, err = s.Create("dashboards", "superuser")
+	assert.Error(t, err, "unknown role should be rejected")
+
+	dashboardsSecret, dashboards, err := s.Create("dashboards", Reader, "Table_A")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, dashboards.Hash, "hash shouldn't be exposed")
+	scriptsSecret, scripts, err := s.Create("scripts", Writer)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Reopen to make sure tokens were persisted
+	s, err = OpenTokenStore(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tokens := s.List()
+	if assert.Len(t, tokens, 2) {
+		assert.Equal(t, dashboards.ID, tokens[0].ID)
+		assert.Equal(t, scripts.ID, tokens[1].ID)
+		assert.Empty(t, tokens[0].Hash)
+	}
+	b, _ := ioutil.ReadFile(filename)
+	assert.NotContains(t, string(b), dashboardsSecret, "secrets shouldn't be stored")
+
+	p, err := s.Authenticate(dashboardsSecret)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "token:dashboards", p.Name)
+		assert.True(t, p.Can(Reader, "table_a"))
+		assert.False(t, p.Can(Reader, "table_b"))
+		assert.False(t, p.Can(Writer, "table_a"))
+	}
+	p, err = s.Authenticate(scriptsSecret)
+	if assert.NoError(t, err) {
+		assert.True(t, p.Can(Writer, "inbound"))
+		assert.False(t, p.Can(Admin, "inbound"))
+	}
+	_, err = s.Authenticate(dashboards.ID + ".wrong")
+	assert.Equal(t, ErrNotAuthenticated, err)
+	_, err = s.Authenticate("")
+	assert.Equal(t, ErrNotAuthenticated, err)
+
+	assert.NoError(t, s.Revoke(scripts.ID))
+	assert.Error(t, s.Revoke(scripts.ID), "revoking twice should fail")
+	_, err = s.Authenticate(scriptsSecret)
+	assert.Equal(t, ErrNotAuthenticated, err, "revoked token shouldn't authenticate")
+	s, err = OpenTokenStore(filename)
+	if assert.NoError(t, err) {
+		assert.Len(t, s.List(), 1, "revocation should be persisted")
+	}
+}
@@ -0,0 +1,142 @@
+package zenodb
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	annotationsFilename = "annotations"
+)
+
+// Annotation is an event like a deploy, an incident or a config change that
+// can be overlaid onto query results in order to correlate it with changes in
+// the data.
+type Annotation struct {
+	TS       time.Time
+	Category string
+	Text     string
+	Tags     map[string]string `json:",omitempty"`
+}
+
+// Annotate records the given annotation. If it doesn't have a timestamp, the
+// current time is used.
+func (db *DB) Annotate(annotation *Annotation) error {
+	if annotation.Category == "" {
+		return errors.New("Please specify a category for the annotation")
+	}
+	if db.opts.ReadOnly {
+		return errors.New("Can't annotate a read-only database")
+	}
+	if annotation.TS.IsZero() {
+		annotation.TS = db.clock.Now()
+	}
+	annotation.Category = strings.ToLower(annotation.Category)
+
+	db.annotationsMx.Lock()
+	defer db.annotationsMx.Unlock()
+	err := db.saveAnnotation(annotation)
+	if err != nil {
+		return err
+	}
+	// Annotations usually arrive in order, so this is normally just an append
+	i := sort.Search(len(db.annotations), func(i int) bool {
+		return db.annotations[i].TS.After(annotation.TS)
+	})
+	db.annotations = append(db.annotations, nil)
+	copy(db.annotations[i+1:], db.annotations[i:])
+	db.annotations[i] = annotation
+	log.Debugf("Recorded %v annotation at %v", annotation.Category, annotation.TS)
+	return nil
+}
+
+// Annotations returns the annotations from asOf up to and including until,
+// ordered by time. If categories are specified, only annotations in those
+// categories are returned. A zero until means no upper bound.
+func (db *DB) Annotations(asOf time.Time, until time.Time, categories ...string) []*Annotation {
+	included := make(map[string]bool, len(categories))
+	for _, category := range categories {
+		included[strings.ToLower(category)] = true
+	}
+
+	db.annotationsMx.RLock()
+	defer db.annotationsMx.RUnlock()
+	i := sort.Search(len(db.annotations), func(i int) bool {
+		return !db.annotations[i].TS.Before(asOf)
+	})
+	var result []*Annotation
+	for ; i < len(db.annotations); i++ {
+		annotation := db.annotations[i]
+		if !until.IsZero() && annotation.TS.After(until) {
+			break
+		}
+		if len(included) == 0 || included[annotation.Category] {
+			result = append(result, annotation)
+		}
+	}
+	return result
+}
+
+// saveAnnotation appends the given annotation to the annotations file as a
+// line of JSON. Must be called while holding annotationsMx.
+func (db *DB) saveAnnotation(annotation *Annotation) error {
+	b, err := json.Marshal(annotation)
+	if err != nil {
+		return errors.New("Unable to encode annotation: %v", err)
+	}
+	file, err := os.OpenFile(filepath.Join(db.opts.Dir, annotationsFilename), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.New("Unable to open annotations file: %v", err)
+	}
+	_, err = file.Write(append(b, '\n'))
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.New("Unable to save annotation: %v", err)
+	}
+	return nil
+}
+
+func (db *DB) loadAnnotations() {
+	file, err := os.Open(filepath.Join(db.opts.Dir, annotationsFilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Unable to read annotations: %v", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 65536), 10*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		annotation := &Annotation{}
+		err = json.Unmarshal(line, annotation)
+		if err != nil {
+			// Probably a partially written line from a crash, skip it
+			log.Errorf("Skipping invalid annotation %v: %v", string(line), err)
+			continue
+		}
+		db.annotations = append(db.annotations, annotation)
+	}
+	if err = scanner.Err(); err != nil {
+		log.Errorf("Unable to read all annotations: %v", err)
+	}
+	sort.SliceStable(db.annotations, func(i, j int) bool {
+		return db.annotations[i].TS.Before(db.annotations[j].TS)
+	})
+	log.Debugf("Loaded %d annotations", len(db.annotations))
+}
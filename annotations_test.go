@@ -0,0 +1,63 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnotations(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{Dir: tmpDir})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Error(t, db.Annotate(&Annotation{TS: epoch, Text: "no category"}))
+	assert.NoError(t, db.Annotate(&Annotation{TS: epoch.Add(2 * time.Minute), Category: "Incident", Text: "outage"}))
+	assert.NoError(t, db.Annotate(&Annotation{TS: epoch, Category: "deploy", Text: "v1", Tags: map[string]string{"service": "api"}}))
+	assert.NoError(t, db.Annotate(&Annotation{TS: epoch.Add(time.Minute), Category: "deploy", Text: "v2"}))
+
+	texts := func(annotations []*Annotation) []string {
+		var result []string
+		for _, annotation := range annotations {
+			result = append(result, annotation.Text)
+		}
+		return result
+	}
+	assert.Equal(t, []string{"v1", "v2", "outage"}, texts(db.Annotations(time.Time{}, time.Time{})), "Should be ordered by time")
+	assert.Equal(t, []string{"v2", "outage"}, texts(db.Annotations(epoch.Add(time.Minute), epoch.Add(2*time.Minute))))
+	assert.Equal(t, []string{"v1", "v2"}, texts(db.Annotations(time.Time{}, time.Time{}, "DEPLOY")))
+	assert.Equal(t, []string{"outage"}, texts(db.Annotations(time.Time{}, time.Time{}, "incident")))
+
+	// Partially written line from a crash
+	file, err := os.OpenFile(filepath.Join(tmpDir, annotationsFilename), os.O_WRONLY|os.O_APPEND, 0644)
+	if assert.NoError(t, err) {
+		file.WriteString("{\"TS\":\n")
+		file.Close()
+	}
+
+	db2, err := NewDB(&DBOpts{Dir: tmpDir})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db2.Close()
+	reloaded := db2.Annotations(time.Time{}, time.Time{})
+	assert.Equal(t, []string{"v1", "v2", "outage"}, texts(reloaded), "Should reload annotations")
+	if assert.Len(t, reloaded, 3) {
+		assert.True(t, epoch.Equal(reloaded[0].TS))
+		assert.Equal(t, "api", reloaded[0].Tags["service"])
+		assert.Equal(t, "incident", reloaded[2].Category)
+	}
+}
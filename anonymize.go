@@ -0,0 +1,226 @@
+package zenodb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	defaultHashLength = 16
+)
+
+// DimAnonymization describes how the values of a dimension are anonymized
+// before they're written to the WAL, so that sensitive identifiers like IP
+// addresses are never persisted while values can still be grouped by.
+type DimAnonymization struct {
+	// IPv4PrefixLength truncates IPv4 addresses to the given number of leading
+	// bits, e.g. 24 turns 203.0.113.57 into 203.0.113.0.
+	IPv4PrefixLength int
+	// IPv6PrefixLength truncates IPv6 addresses to the given number of leading
+	// bits, e.g. 48 turns 2001:db8:85a3::8a2e:370:7334 into 2001:db8:85a3::.
+	IPv6PrefixLength int
+	// Truncate keeps only the first Truncate characters of values that aren't
+	// truncated as IP addresses.
+	Truncate int
+	// Hash replaces values (after any truncation) with the hex-encoded
+	// HMAC-SHA256 of them, keyed with HashKey or the contents of HashKeyFile.
+	// Non-string values are hashed as their string representation.
+	Hash        bool
+	HashKey     string
+	HashKeyFile string
+	// HashLength is the number of hex characters of the hash to keep, defaults
+	// to 16.
+	HashLength int
+}
+
+// dimAnonymizer is a compiled DimAnonymization
+type dimAnonymizer struct {
+	ipv4Mask   net.IPMask
+	ipv6Mask   net.IPMask
+	truncate   int
+	hashKey    []byte
+	hashLength int
+}
+
+func (a *dimAnonymizer) anonymize(value interface{}) interface{} {
+	if s, ok := value.(string); ok {
+		value = a.truncateString(s)
+	}
+	if a.hashKey == nil {
+		return value
+	}
+	s, ok := value.(string)
+	if !ok {
+		s = fmt.Sprint(value)
+	}
+	mac := hmac.New(sha256.New, a.hashKey)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))[:a.hashLength]
+}
+
+func (a *dimAnonymizer) truncateString(value string) string {
+	if a.ipv4Mask != nil || a.ipv6Mask != nil {
+		if ip := net.ParseIP(value); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				if a.ipv4Mask != nil {
+					return ip4.Mask(a.ipv4Mask).String()
+				}
+				return value
+			}
+			if a.ipv6Mask != nil {
+				return ip.Mask(a.ipv6Mask).String()
+			}
+			return value
+		}
+	}
+	if a.truncate > 0 {
+		runes := []rune(value)
+		if len(runes) > a.truncate {
+			return string(runes[:a.truncate])
+		}
+	}
+	return value
+}
+
+// buildAnonymizers compiles the anonymizations defined by the tables in the
+// given schema, keyed by stream and then dimension. Tables that read from the
+// same stream have to agree on how to anonymize any given dimension.
+func buildAnonymizers(schema Schema) (map[string]map[string]*dimAnonymizer, error) {
+	type definition struct {
+		table         string
+		anonymization *DimAnonymization
+	}
+	definitions := make(map[string]map[string]*definition)
+	for name, opts := range schema {
+		if opts.View || len(opts.Anonymize) == 0 {
+			continue
+		}
+		stream, err := sql.TableFor(opts.SQL)
+		if err != nil {
+			return nil, errors.New("Unable to determine stream for table %v: %v", name, err)
+		}
+		byDim := definitions[stream]
+		if byDim == nil {
+			byDim = make(map[string]*definition)
+			definitions[stream] = byDim
+		}
+		for dim, anonymization := range opts.Anonymize {
+			if anonymization == nil {
+				continue
+			}
+			existing := byDim[dim]
+			if existing != nil && !reflect.DeepEqual(existing.anonymization, anonymization) {
+				return nil, errors.New("Tables %v and %v anonymize dimension %v of stream %v differently", existing.table, name, dim, stream)
+			}
+			byDim[dim] = &definition{name, anonymization}
+		}
+	}
+
+	anonymizers := make(map[string]map[string]*dimAnonymizer, len(definitions))
+	for stream, byDim := range definitions {
+		anonymizers[stream] = make(map[string]*dimAnonymizer, len(byDim))
+		for dim, def := range byDim {
+			a, err := def.anonymization.compile()
+			if err != nil {
+				return nil, errors.New("Unable to anonymize dimension %v in table %v: %v", dim, def.table, err)
+			}
+			anonymizers[stream][dim] = a
+		}
+	}
+	return anonymizers, nil
+}
+
+func (da *DimAnonymization) compile() (*dimAnonymizer, error) {
+	if da.IPv4PrefixLength == 0 && da.IPv6PrefixLength == 0 && da.Truncate == 0 && !da.Hash {
+		return nil, errors.New("Please specify at least one of ipv4prefixlength, ipv6prefixlength, truncate or hash")
+	}
+	a := &dimAnonymizer{truncate: da.Truncate}
+	if da.IPv4PrefixLength != 0 {
+		if da.IPv4PrefixLength < 0 || da.IPv4PrefixLength > 32 {
+			return nil, errors.New("IPv4PrefixLength %d is not between 0 and 32", da.IPv4PrefixLength)
+		}
+		a.ipv4Mask = net.CIDRMask(da.IPv4PrefixLength, 32)
+	}
+	if da.IPv6PrefixLength != 0 {
+		if da.IPv6PrefixLength < 0 || da.IPv6PrefixLength > 128 {
+			return nil, errors.New("IPv6PrefixLength %d is not between 0 and 128", da.IPv6PrefixLength)
+		}
+		a.ipv6Mask = net.CIDRMask(da.IPv6PrefixLength, 128)
+	}
+	if da.Truncate < 0 {
+		return nil, errors.New("Truncate %d is negative", da.Truncate)
+	}
+	if !da.Hash {
+		return a, nil
+	}
+
+	a.hashLength = da.HashLength
+	if a.hashLength == 0 {
+		a.hashLength = defaultHashLength
+	}
+	if a.hashLength < 0 || a.hashLength > sha256.Size*2 {
+		return nil, errors.New("HashLength %d is not between 0 and %d", da.HashLength, sha256.Size*2)
+	}
+	key := da.HashKey
+	if da.HashKeyFile != "" {
+		b, err := ioutil.ReadFile(da.HashKeyFile)
+		if err != nil {
+			return nil, errors.New("Unable to read hash key file %v: %v", da.HashKeyFile, err)
+		}
+		key = strings.TrimSpace(string(b))
+	}
+	if key == "" {
+		// Unkeyed hashes of values with few possibilities, like IP addresses, are
+		// easily reversed by hashing all of them
+		return nil, errors.New("Please specify a hashkey or hashkeyfile for hashing")
+	}
+	a.hashKey = []byte(key)
+	return a, nil
+}
+
+func (db *DB) applyAnonymizers(anonymizers map[string]map[string]*dimAnonymizer) {
+	db.anonymizersMx.Lock()
+	db.anonymizers = anonymizers
+	db.anonymizersMx.Unlock()
+}
+
+// anonymize applies the anonymizations configured for the given stream to the
+// values of the given dims.
+func (db *DB) anonymize(stream string, dims bytemap.ByteMap) bytemap.ByteMap {
+	db.anonymizersMx.RLock()
+	anonymizers := db.anonymizers[stream]
+	db.anonymizersMx.RUnlock()
+	if len(anonymizers) == 0 {
+		return dims
+	}
+
+	var anonymized map[string]interface{}
+	for dim, a := range anonymizers {
+		value := dims.Get(dim)
+		if value == nil {
+			continue
+		}
+		anonymizedValue := a.anonymize(value)
+		if anonymizedValue == value {
+			continue
+		}
+		if anonymized == nil {
+			anonymized = dims.AsMap()
+		}
+		anonymized[dim] = anonymizedValue
+	}
+	if anonymized == nil {
+		return dims
+	}
+	return bytemap.New(anonymized)
+}
@@ -0,0 +1,135 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnonymize(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "hashkey")
+	err = ioutil.WriteFile(keyFile, []byte("secret\n"), 0600)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var schema Schema
+	err = yaml.Unmarshal([]byte(`
+test_a:
+  retentionperiod: 1h
+  sql: SELECT i FROM inbound GROUP BY *, period(1m)
+  anonymize:
+    ip:
+      ipv4prefixlength: 24
+      ipv6prefixlength: 48
+    email:
+      hash: true
+      hashkeyfile: `+keyFile+`
+    name:
+      truncate: 2
+`), &schema)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	if !assert.NoError(t, db.ApplySchema(schema)) {
+		return
+	}
+
+	now := time.Now()
+	insert := func(ip string, email string, name string) {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"ip": ip, "email": email, "name": name}, map[string]float64{"i": 1}))
+	}
+	insert("203.0.113.57", "a@example.com", "Alice")
+	insert("203.0.113.99", "a@example.com", "Alfred")
+	insert("2001:db8:85a3::8a2e:370:7334", "b@example.com", "Bob")
+	time.Sleep(250 * time.Millisecond)
+
+	totals := func(dim string) map[string]float64 {
+		source, err := db.Query("SELECT i FROM test_a GROUP BY "+dim, false, nil, true)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		result := make(map[string]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result[row.Key.Get(dim).(string)] += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	assert.Equal(t, map[string]float64{"203.0.113.0": 2, "2001:db8:85a3::": 1}, totals("ip"))
+	assert.Equal(t, map[string]float64{"Al": 2, "Bo": 1}, totals("name"))
+	emails := totals("email")
+	assert.Len(t, emails, 2)
+	for email, total := range emails {
+		assert.Len(t, email, defaultHashLength)
+		assert.NotContains(t, email, "@")
+		assert.Contains(t, []float64{1, 2}, total)
+	}
+
+	assert.Error(t, db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+			Anonymize:       map[string]*DimAnonymization{"email": {Hash: true}},
+		},
+	}), "hashing without a key should be rejected")
+	assert.Error(t, db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+			Anonymize:       map[string]*DimAnonymization{"ip": {IPv4PrefixLength: 24}},
+		},
+		"test_b": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY ip, period(1m)",
+			Anonymize:       map[string]*DimAnonymization{"ip": {IPv4PrefixLength: 16}},
+		},
+	}), "conflicting anonymizations should be rejected")
+}
+
+func TestDimAnonymizer(t *testing.T) {
+	a, err := (&DimAnonymization{IPv4PrefixLength: 16, Truncate: 3, Hash: true, HashKey: "secret", HashLength: 8}).compile()
+	if !assert.NoError(t, err) {
+		return
+	}
+	hashed := a.anonymize("10.1.2.3")
+	assert.Len(t, hashed, 8)
+	assert.Equal(t, hashed, a.anonymize("10.1.200.200"), "values should be hashed after truncation")
+	assert.NotEqual(t, hashed, a.anonymize("10.2.2.3"))
+	assert.Equal(t, a.anonymize("abc"), a.anonymize("abcdef"))
+	assert.Equal(t, a.anonymize("5"), a.anonymize(5), "non-string values should be hashed as strings")
+
+	other, err := (&DimAnonymization{Hash: true, HashKey: "other", HashLength: 8}).compile()
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, a.anonymize("abc"), other.anonymize("abc"), "hashes should depend on the key")
+	}
+
+	_, err = (&DimAnonymization{}).compile()
+	assert.Error(t, err, "anonymization without any rules should be rejected")
+	_, err = (&DimAnonymization{IPv4PrefixLength: 33}).compile()
+	assert.Error(t, err)
+}
@@ -0,0 +1,161 @@
+// Package archive provides offsite archiving of data to object stores like S3
+// and GCS (through its S3-compatible XML API), so that a database can be
+// recovered after losing its disk.
+package archive
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+)
+
+const (
+	// DefaultInterval is the default for Opts.Interval
+	DefaultInterval = 1 * time.Hour
+
+	// DefaultEndpoint is the default for Opts.Endpoint
+	DefaultEndpoint = "https://s3.amazonaws.com"
+
+	// DefaultRegion is the default for Opts.Region
+	DefaultRegion = "us-east-1"
+
+	// DefaultKeepFilestores is the default for Opts.KeepFilestores
+	DefaultKeepFilestores = 2
+)
+
+var (
+	log = golog.LoggerFor("zenodb.archive")
+
+	// ErrNotFound indicates that the requested object doesn't exist.
+	ErrNotFound = errors.New("object not found")
+)
+
+// Object describes an object in a Store.
+type Object struct {
+	Key  string
+	Size int64
+}
+
+// Store is an object store.
+type Store interface {
+	// Put stores size bytes read from r as the object at key, replacing any
+	// existing object.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+
+	// Get opens the object at key for reading. It returns ErrNotFound if there
+	// is no such object.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// List lists all objects whose keys start with prefix, ordered by key.
+	List(ctx context.Context, prefix string) ([]*Object, error)
+
+	// Delete deletes the object at key. Deleting an object that doesn't exist
+	// is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Opts configures archiving.
+type Opts struct {
+	// Store, if specified, is the Store to which to archive. Otherwise, data is
+	// archived to the S3-compatible bucket configured below.
+	Store Store
+	// Endpoint is the URL of the S3-compatible API, for example
+	// https://storage.googleapis.com for GCS. Defaults to DefaultEndpoint.
+	Endpoint string
+	// Region is the region in which Bucket lives. Defaults to DefaultRegion.
+	Region string
+	// Bucket is the bucket to which to archive.
+	Bucket string
+	// Prefix, if specified, is prepended to the keys of all archived objects,
+	// which allows multiple databases to share a bucket.
+	Prefix string
+	// AccessKeyID and SecretAccessKey are the credentials with which to access
+	// Bucket. If unspecified, they're read from the AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY environment variables.
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is an optional token for temporary credentials. If
+	// unspecified, it's read from the AWS_SESSION_TOKEN environment variable.
+	SessionToken string
+	// Interval controls how frequently to archive new data. Defaults to
+	// DefaultInterval.
+	Interval time.Duration
+	// KeepFilestores is how many of the latest filestores of each table to keep
+	// in the archive. Older ones are deleted. Defaults to DefaultKeepFilestores.
+	KeepFilestores int
+	// WALRetention, if specified, deletes archived WAL segments once they're
+	// older than this. If unspecified, WAL segments are kept forever.
+	WALRetention time.Duration
+	// HydrateEmptyTables, if true, restores tables and WALs that have no data
+	// on disk from the archive when they're opened.
+	HydrateEmptyTables bool
+}
+
+// NewStore returns the Store configured by these Opts, with Prefix applied.
+func (opts *Opts) NewStore() (Store, error) {
+	store := opts.Store
+	if store == nil {
+		if opts.Bucket == "" {
+			return nil, errors.New("Please specify a bucket to which to archive")
+		}
+		s3Opts := &S3Opts{
+			Endpoint:        opts.Endpoint,
+			Region:          opts.Region,
+			Bucket:          opts.Bucket,
+			AccessKeyID:     opts.AccessKeyID,
+			SecretAccessKey: opts.SecretAccessKey,
+			SessionToken:    opts.SessionToken,
+		}
+		if s3Opts.AccessKeyID == "" {
+			s3Opts.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+			s3Opts.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+		if s3Opts.SessionToken == "" {
+			s3Opts.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+		var err error
+		store, err = NewS3(s3Opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	prefix := strings.Trim(opts.Prefix, "/")
+	if prefix == "" {
+		return store, nil
+	}
+	return &prefixedStore{store, prefix + "/"}, nil
+}
+
+// prefixedStore is a Store that prepends a prefix to all keys.
+type prefixedStore struct {
+	Store
+	prefix string
+}
+
+func (s *prefixedStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	return s.Store.Put(ctx, s.prefix+key, r, size)
+}
+
+func (s *prefixedStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.Store.Get(ctx, s.prefix+key)
+}
+
+func (s *prefixedStore) Delete(ctx context.Context, key string) error {
+	return s.Store.Delete(ctx, s.prefix+key)
+}
+
+func (s *prefixedStore) List(ctx context.Context, prefix string) ([]*Object, error) {
+	objects, err := s.Store.List(ctx, s.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		object.Key = strings.TrimPrefix(object.Key, s.prefix)
+	}
+	return objects, nil
+}
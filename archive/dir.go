@@ -0,0 +1,122 @@
+package archive
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+type dirStore struct {
+	dir string
+}
+
+// NewDir creates a Store that stores objects as files in a local directory,
+// which is useful for archiving to network filesystems or buckets mounted
+// with tools like gcsfuse.
+func NewDir(dir string) (Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.New("Unable to create archive dir %v: %v", dir, err)
+	}
+	return &dirStore{dir}, nil
+}
+
+func (s *dirStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	filename, err := s.filename(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return errors.New("Unable to create directory for %v: %v", key, err)
+	}
+	out, err := ioutil.TempFile(filepath.Dir(filename), ".archiving")
+	if err != nil {
+		return errors.New("Unable to create file for %v: %v", key, err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	n, err := io.Copy(out, r)
+	if err == nil && n != size {
+		err = errors.New("expected %d bytes, got %d", size, n)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), filename)
+	}
+	if err != nil {
+		return errors.New("Unable to put %v: %v", key, err)
+	}
+	return nil
+}
+
+func (s *dirStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	filename, err := s.filename(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.New("Unable to get %v: %v", key, err)
+	}
+	return file, nil
+}
+
+func (s *dirStore) List(ctx context.Context, prefix string) ([]*Object, error) {
+	var objects []*Object
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".archiving") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, &Object{Key: key, Size: info.Size()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("Unable to list %v: %v", prefix, err)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (s *dirStore) Delete(ctx context.Context, key string) error {
+	filename, err := s.filename(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("Unable to delete %v: %v", key, err)
+	}
+	return nil
+}
+
+func (s *dirStore) filename(key string) (string, error) {
+	name := filepath.Clean(filepath.FromSlash(key))
+	if key == "" || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", errors.New("Invalid key %v", key)
+	}
+	return filepath.Join(s.dir, name), nil
+}
@@ -0,0 +1,382 @@
+package zenodb
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/archive"
+)
+
+const (
+	archiveTablesPrefix  = "tables/"
+	archiveWALPrefix     = "wal/"
+	walCompressedSuffix  = ".snappy"
+	archiveCopyBufferLen = 65536
+)
+
+// initArchive sets up offsite archiving if it's configured.
+func (db *DB) initArchive() error {
+	if db.opts.Archive == nil {
+		return nil
+	}
+	if db.opts.Archive.Interval <= 0 {
+		db.opts.Archive.Interval = archive.DefaultInterval
+	}
+	if db.opts.Archive.KeepFilestores <= 0 {
+		db.opts.Archive.KeepFilestores = archive.DefaultKeepFilestores
+	}
+	store, err := db.opts.Archive.NewStore()
+	if err != nil {
+		return errors.New("Unable to initialize archive: %v", err)
+	}
+	db.archive = store
+	if db.opts.Archive.HydrateEmptyTables && !db.opts.ReadOnly {
+		db.hydrateWALs()
+	}
+	return nil
+}
+
+func (db *DB) archivePeriodically() {
+	for {
+		time.Sleep(db.opts.Archive.Interval)
+		err := db.archiveOnce(context.Background())
+		if err != nil {
+			log.Errorf("Unable to archive: %v", err)
+		}
+	}
+}
+
+// archiveOnce uploads the current filestore of every table and all sealed WAL
+// segments that haven't been archived yet, and then prunes archived files that
+// are no longer retained. Filestores are archived as-is, so restoring encrypted
+// data from the archive requires the same keys.
+func (db *DB) archiveOnce(ctx context.Context) error {
+	db.archiveMx.Lock()
+	defer db.archiveMx.Unlock()
+
+	start := time.Now()
+	uploaded := 0
+	pruned := 0
+
+	db.tablesMutex.RLock()
+	filenames := make(map[string]string, len(db.tables))
+	for name, t := range db.tables {
+		if t.rowStore == nil {
+			continue
+		}
+		t.rowStore.mx.RLock()
+		filename := t.rowStore.fileStore.filename
+		t.rowStore.mx.RUnlock()
+		if filename != "" {
+			filenames[name] = filename
+		}
+	}
+	streams := make([]string, 0, len(db.streams))
+	for stream := range db.streams {
+		streams = append(streams, stream)
+	}
+	db.tablesMutex.RUnlock()
+
+	for name, filename := range filenames {
+		prefix := archiveTablesPrefix + name + "/"
+		archived, err := db.archivedKeys(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		key := prefix + filepath.Base(filename)
+		if !archived[key] {
+			err = db.archiveFile(ctx, key, filename)
+			if err != nil {
+				return err
+			}
+			archived[key] = true
+			uploaded++
+		}
+		n, err := db.pruneArchivedFilestores(ctx, archived)
+		if err != nil {
+			return err
+		}
+		pruned += n
+	}
+
+	for _, stream := range streams {
+		prefix := archiveWALPrefix + stream + "/"
+		archived, err := db.archivedKeys(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		walDir := filepath.Join(db.opts.Dir, "_wal", stream)
+		files, err := ioutil.ReadDir(walDir)
+		if err != nil {
+			return errors.New("Unable to list WAL segments for %v: %v", stream, err)
+		}
+		// The last segment is still being written to
+		for i := 0; i < len(files)-1; i++ {
+			segment := files[i].Name()
+			sequence := strings.TrimSuffix(segment, walCompressedSuffix)
+			if archived[prefix+sequence] || archived[prefix+sequence+walCompressedSuffix] {
+				continue
+			}
+			err = db.archiveFile(ctx, prefix+segment, filepath.Join(walDir, segment))
+			if os.IsNotExist(err) {
+				// Segment was compressed or truncated in the meantime, we'll pick up
+				// the compressed version next time if it's still around.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			archived[prefix+segment] = true
+			uploaded++
+		}
+		n, err := db.pruneArchivedWAL(ctx, archived)
+		if err != nil {
+			return err
+		}
+		pruned += n
+	}
+
+	log.Debugf("Archived %d files and pruned %d in %v", uploaded, pruned, time.Now().Sub(start))
+	return nil
+}
+
+// archivedKeys returns the keys of the archived objects with the given prefix.
+// The archive is only listed the first time, after which we keep track of what
+// we've archived and pruned ourselves.
+func (db *DB) archivedKeys(ctx context.Context, prefix string) (map[string]bool, error) {
+	if keys := db.archivedKeysByPrefix[prefix]; keys != nil {
+		return keys, nil
+	}
+	objects, err := db.archive.List(ctx, prefix)
+	if err != nil {
+		return nil, errors.New("Unable to list archived files: %v", err)
+	}
+	keys := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		keys[object.Key] = true
+	}
+	if db.archivedKeysByPrefix == nil {
+		db.archivedKeysByPrefix = make(map[string]map[string]bool)
+	}
+	db.archivedKeysByPrefix[prefix] = keys
+	return keys, nil
+}
+
+// pruneArchivedFilestores deletes all but the latest KeepFilestores of the
+// given archived filestores of a table.
+func (db *DB) pruneArchivedFilestores(ctx context.Context, archived map[string]bool) (int, error) {
+	var filestores []string
+	for key := range archived {
+		if strings.HasPrefix(path.Base(key), "filestore_") {
+			filestores = append(filestores, key)
+		}
+	}
+	keep := db.archiveOpts().KeepFilestores
+	if keep <= 0 {
+		keep = archive.DefaultKeepFilestores
+	}
+	if len(filestores) <= keep {
+		return 0, nil
+	}
+	// Filestore names start with a timestamp, so the oldest sort first
+	sort.Strings(filestores)
+	return db.deleteArchived(ctx, archived, filestores[:len(filestores)-keep])
+}
+
+// pruneArchivedWAL deletes the given archived WAL segments of a stream once
+// they're older than WALRetention.
+func (db *DB) pruneArchivedWAL(ctx context.Context, archived map[string]bool) (int, error) {
+	retention := db.archiveOpts().WALRetention
+	if retention <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-1 * retention)
+	var expired []string
+	for key := range archived {
+		// Segments are named for the time (in microseconds) at which they started
+		sequence, err := strconv.ParseInt(strings.TrimSuffix(path.Base(key), walCompressedSuffix), 10, 64)
+		if err == nil && time.Unix(0, sequence*1000).Before(cutoff) {
+			expired = append(expired, key)
+		}
+	}
+	return db.deleteArchived(ctx, archived, expired)
+}
+
+func (db *DB) deleteArchived(ctx context.Context, archived map[string]bool, keys []string) (int, error) {
+	for i, key := range keys {
+		log.Debugf("Pruning %v from archive", key)
+		err := db.archive.Delete(ctx, key)
+		if err != nil {
+			return i, errors.New("Unable to prune archived files: %v", err)
+		}
+		delete(archived, key)
+	}
+	return len(keys), nil
+}
+
+func (db *DB) archiveOpts() *archive.Opts {
+	if db.opts.Archive == nil {
+		return &archive.Opts{}
+	}
+	return db.opts.Archive
+}
+
+// archiveFile uploads the given file. If the file doesn't exist, it returns an
+// error satisfying os.IsNotExist.
+func (db *DB) archiveFile(ctx context.Context, key string, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return errors.New("Unable to stat %v for archiving: %v", filename, err)
+	}
+	log.Debugf("Archiving %v to %v", filename, key)
+	return db.archive.Put(ctx, key, file, fi.Size())
+}
+
+// hydrate restores a table that has no data on disk from the latest filestore
+// in the archive.
+func (t *table) hydrate(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		t.log.Errorf("Unable to read contents of directory, not hydrating: %v", err)
+		return
+	}
+	if len(files) > 0 {
+		// Already have data
+		return
+	}
+
+	ctx := context.Background()
+	objects, err := t.db.archive.List(ctx, archiveTablesPrefix+t.Name+"/")
+	if err != nil {
+		t.log.Errorf("Unable to list archived filestores, not hydrating: %v", err)
+		return
+	}
+	// Filestore names start with a timestamp, so the last one is the latest
+	key := ""
+	for _, object := range objects {
+		if strings.HasPrefix(path.Base(object.Key), "filestore_") {
+			key = object.Key
+		}
+	}
+	if key == "" {
+		return
+	}
+	filename := filepath.Join(dir, path.Base(key))
+	err = t.db.downloadArchived(ctx, key, filename)
+	if err != nil {
+		t.log.Errorf("Unable to hydrate from archive: %v", err)
+		return
+	}
+	offset, _, err := readWALOffset(t.keyring(), filename)
+	if err != nil {
+		t.log.Errorf("Archived filestore %v appears to be corrupt, removing: %v", key, err)
+		os.Remove(filename)
+		return
+	}
+	t.log.Debugf("Hydrated from archived filestore %v, will resume from %v", key, offset)
+}
+
+// hydrateWALs restores the WALs of streams that have no data on disk from the
+// archive. Only the most recent segments up to MaxWALSize are restored, since
+// anything beyond that would be truncated anyway.
+func (db *DB) hydrateWALs() {
+	ctx := context.Background()
+	objects, err := db.archive.List(ctx, archiveWALPrefix)
+	if err != nil {
+		log.Errorf("Unable to list archived WAL segments, not hydrating: %v", err)
+		return
+	}
+	segmentsByStream := make(map[string][]*archive.Object)
+	for _, object := range objects {
+		parts := strings.Split(strings.TrimPrefix(object.Key, archiveWALPrefix), "/")
+		if len(parts) != 2 || parts[0] == "" || strings.HasPrefix(parts[0], ".") || parts[1] == "" || strings.HasPrefix(parts[1], ".") {
+			continue
+		}
+		segmentsByStream[parts[0]] = append(segmentsByStream[parts[0]], object)
+	}
+
+	for stream, segments := range segmentsByStream {
+		walDir := filepath.Join(db.opts.Dir, "_wal", stream)
+		files, err := ioutil.ReadDir(walDir)
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Unable to read contents of WAL directory for %v, not hydrating: %v", stream, err)
+			continue
+		}
+		if len(files) > 0 {
+			// Already have data
+			continue
+		}
+
+		sort.Slice(segments, func(i, j int) bool {
+			return segments[i].Key > segments[j].Key
+		})
+		var size int64
+		restored := make(map[string]bool)
+		for _, segment := range segments {
+			name := path.Base(segment.Key)
+			sequence := strings.TrimSuffix(name, walCompressedSuffix)
+			if restored[sequence] {
+				// Have both a compressed and an uncompressed version
+				continue
+			}
+			if size > 0 && size+segment.Size > int64(db.opts.MaxWALSize) {
+				break
+			}
+			err = db.downloadArchived(ctx, segment.Key, filepath.Join(walDir, name))
+			if err != nil {
+				log.Errorf("Unable to hydrate WAL for %v: %v", stream, err)
+				break
+			}
+			restored[sequence] = true
+			size += segment.Size
+		}
+		log.Debugf("Hydrated %d WAL segments for %v from archive", len(restored), stream)
+	}
+}
+
+// downloadArchived downloads the archived object at key to filename, only
+// creating filename once the download has completed.
+func (db *DB) downloadArchived(ctx context.Context, key string, filename string) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return errors.New("Unable to create directory for %v: %v", filename, err)
+	}
+	r, err := db.archive.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	// Download outside of the destination directory so that incomplete downloads
+	// are never mistaken for data
+	out, err := ioutil.TempFile(db.opts.Dir, ".hydrating")
+	if err != nil {
+		return errors.New("Unable to create file for %v: %v", key, err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	_, err = io.CopyBuffer(out, r, make([]byte, archiveCopyBufferLen))
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), filename)
+	}
+	if err != nil {
+		return errors.New("Unable to download %v: %v", key, err)
+	}
+	return nil
+}
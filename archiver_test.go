@@ -0,0 +1,132 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb/archive"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store, err := archive.NewDir(filepath.Join(tmpDir, "archive"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	archivedKeys := func() []string {
+		objects, listErr := store.List(context.Background(), "")
+		assert.NoError(t, listErr)
+		var keys []string
+		for _, object := range objects {
+			keys = append(keys, object.Key)
+		}
+		return keys
+	}
+
+	newDB := func(name string) *DB {
+		return &DB{
+			opts:    &DBOpts{Dir: filepath.Join(tmpDir, name), MaxWALSize: 15},
+			tables:  make(map[string]*table),
+			streams: make(map[string]*wal.WAL),
+			archive: store,
+		}
+	}
+	newTable := func(db *DB) *table {
+		t := &table{TableOpts: &TableOpts{Name: "tbl"}, db: db, log: golog.LoggerFor("archivetest")}
+		t.rowStore = &rowStore{t: t, fileStore: &fileStore{t: t}}
+		db.tables["tbl"] = t
+		return t
+	}
+
+	// Set up a database with a flushed filestore and a few WAL segments
+	source := newDB("source")
+	sourceTable := newTable(source)
+	tableDir := filepath.Join(source.opts.Dir, "tbl")
+	walDir := filepath.Join(source.opts.Dir, "_wal", "inbound")
+	for _, dir := range []string{tableDir, walDir} {
+		if !assert.NoError(t, os.MkdirAll(dir, 0755)) {
+			return
+		}
+	}
+	offset := wal.NewOffsetForTS(time.Now())
+	sourceFile := filepath.Join(tableDir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), CurrentFileVersion))
+	out, err := os.Create(sourceFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cout, err := sourceTable.rowStore.fileStore.createOutWriter(out, core.Fields{}, offset, newDimensionDictionary(), false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, cout.Close())
+	assert.NoError(t, out.Close())
+	sourceTable.rowStore.fileStore.filename = sourceFile
+	source.streams["inbound"] = nil
+	for _, segment := range []string{"0000000000000000001", "0000000000000000002.snappy", "0000000000000000003"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(walDir, segment), []byte("segment 10"), 0644))
+	}
+
+	if !assert.NoError(t, source.archiveOnce(context.Background())) {
+		return
+	}
+	expectedKeys := []string{
+		"tables/tbl/" + filepath.Base(sourceFile),
+		"wal/inbound/0000000000000000001",
+		"wal/inbound/0000000000000000002.snappy",
+	}
+	assert.Equal(t, expectedKeys, archivedKeys(), "Should archive filestore and sealed WAL segments")
+
+	assert.NoError(t, os.Rename(filepath.Join(walDir, "0000000000000000001"), filepath.Join(walDir, "0000000000000000001.snappy")))
+	assert.NoError(t, source.archiveOnce(context.Background()))
+	assert.Equal(t, expectedKeys, archivedKeys(), "Shouldn't archive segments again after compressing them")
+
+	// Hydrate a new database from the archive
+	target := newDB("target")
+	target.hydrateWALs()
+	files, err := ioutil.ReadDir(filepath.Join(target.opts.Dir, "_wal", "inbound"))
+	if assert.NoError(t, err) && assert.Len(t, files, 1, "Should only hydrate up to MaxWALSize") {
+		assert.Equal(t, "0000000000000000002.snappy", files[0].Name())
+	}
+
+	targetTableDir := filepath.Join(target.opts.Dir, "tbl")
+	newTable(target).hydrate(targetTableDir)
+	files, err = ioutil.ReadDir(targetTableDir)
+	if assert.NoError(t, err) && assert.Len(t, files, 1) {
+		assert.Equal(t, filepath.Base(sourceFile), files[0].Name())
+		hydratedOffset, _, err := readWALOffset(nil, filepath.Join(targetTableDir, files[0].Name()))
+		if assert.NoError(t, err) {
+			assert.Equal(t, offset, hydratedOffset)
+		}
+	}
+	tmpFiles, _ := filepath.Glob(filepath.Join(target.opts.Dir, ".hydrating*"))
+	assert.Empty(t, tmpFiles, "Should clean up temporary files")
+
+	// Only the latest filestores are kept
+	var newFiles []string
+	for i := 0; i < 2; i++ {
+		newFile := filepath.Join(tableDir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), CurrentFileVersion))
+		assert.NoError(t, ioutil.WriteFile(newFile, []byte("filestore"), 0644))
+		sourceTable.rowStore.fileStore.filename = newFile
+		newFiles = append(newFiles, "tables/tbl/"+filepath.Base(newFile))
+		assert.NoError(t, source.archiveOnce(context.Background()))
+	}
+	assert.Equal(t, append(newFiles, expectedKeys[1:]...), archivedKeys(), "Should prune older filestores")
+
+	source.opts.Archive = &archive.Opts{WALRetention: time.Hour}
+	assert.NoError(t, source.archiveOnce(context.Background()))
+	assert.Equal(t, newFiles, archivedKeys(), "Should prune WAL segments beyond retention")
+}
@@ -0,0 +1,379 @@
+package zenodb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/encryption"
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/getlantern/zenodb/wal"
+)
+
+const (
+	atomicBatchesDir = "_atomic"
+
+	// batchTrailerMarker starts the trailer of WAL entries that were written as
+	// part of an atomic batch. It's too long to be mistaken for the length of
+	// an origin in an originTrailer.
+	batchTrailerMarker = 0xFFFF
+	batchIDSize        = 16
+	batchTrailerSize   = encoding.Width16bits + batchIDSize + encoding.Width32bits
+)
+
+// StreamPoint is a point to insert into a stream with InsertAtomically.
+type StreamPoint struct {
+	Stream string
+	TS     time.Time
+	Dims   bytemap.ByteMap
+	Vals   bytemap.ByteMap
+}
+
+// NewStreamPoint constructs a StreamPoint from maps of dimensions and values.
+func NewStreamPoint(stream string, ts time.Time, dims map[string]interface{}, vals map[string]float64) *StreamPoint {
+	return &StreamPoint{stream, ts, bytemap.New(dims), bytemap.NewFloat(vals)}
+}
+
+// atomicBatch is the journal of a batch of points inserted with
+// InsertAtomically.
+type atomicBatch struct {
+	ID string
+	// Offsets are the durable heads of the streams' WALs from before the batch
+	// was written, from which recovery looks for the batch's entries.
+	Offsets map[string]wal.Offset
+	// Entries are the WAL entries for the batch's points, by stream, without
+	// trailers.
+	Entries map[string][][]byte
+
+	recovered map[string]bool
+}
+
+// InsertAtomically inserts the given points, which may span multiple streams,
+// such that either all or none of them are inserted, even if the process
+// crashes midway. The batch is recorded in a journal before any of it is
+// written to the streams' WALs. If the process crashes before the batch has
+// been fully written and synced, the remainder of the batch is written when
+// the streams are next opened. Tables read their streams independently, so
+// queries may briefly see a batch that's only partially applied.
+func (db *DB) InsertAtomically(points []*StreamPoint) error {
+	if db.opts.Follow != nil {
+		return errors.New("Declining to insert data directly to follower")
+	}
+	if db.opts.ReadOnly {
+		return errors.New("Unable to insert atomically into read-only database")
+	}
+	if db.isShuttingDown() {
+		return ErrShuttingDown
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	id := make([]byte, batchIDSize)
+	rand.Read(id)
+	batch := &atomicBatch{
+		ID:      hex.EncodeToString(id),
+		Offsets: make(map[string]wal.Offset),
+		Entries: make(map[string][][]byte),
+	}
+	wals := make(map[string]*wal.WAL)
+	db.tablesMutex.RLock()
+	for _, point := range points {
+		stream := strings.TrimSpace(strings.ToLower(point.Stream))
+		dims, stream, err := db.validate(stream, db.anonymize(stream, db.normalize(stream, point.Dims)))
+		if err != nil {
+			db.tablesMutex.RUnlock()
+			return err
+		}
+		w := db.streams[stream]
+		if w == nil {
+			db.tablesMutex.RUnlock()
+			return errors.New("No wal found for stream %v", stream)
+		}
+		wals[stream] = w
+		batch.Entries[stream] = append(batch.Entries[stream], encodeWALEntry(point.TS, dims, point.Vals))
+	}
+	db.tablesMutex.RUnlock()
+
+	for stream := range wals {
+		if err := db.checkLeaderOf(stream); err != nil {
+			return err
+		}
+	}
+
+	for stream := range wals {
+		head, err := db.walHead(stream)
+		if err != nil {
+			log.Debugf("Unable to determine head of %v, recovery will scan entire WAL: %v", stream, err)
+		}
+		batch.Offsets[stream] = head
+	}
+
+	// Once the journal is saved, the batch is committed
+	err := db.saveAtomicBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	for stream, entries := range batch.Entries {
+		w := wals[stream]
+		for i, entry := range entries {
+			err = db.writeWAL(w, entry, batchTrailer(batch.ID, i))
+			if err != nil {
+				return errors.New("Batch %v only partially written, remainder will be written on restart: %v", batch.ID, err)
+			}
+		}
+		metrics.StreamInserted(stream, entriesSize(entries), time.Since(start)/time.Duration(len(entries)))
+	}
+
+	go db.completeAtomicBatch(batch)
+	return nil
+}
+
+func encodeWALEntry(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) []byte {
+	entry := make([]byte, encoding.Width64bits+encoding.Width32bits+len(dims)+encoding.Width32bits+len(vals))
+	encoding.EncodeTime(entry, ts)
+	b := encoding.WriteInt32(entry[encoding.Width64bits:], len(dims))
+	b = encoding.Write(b, dims)
+	b = encoding.WriteInt32(b, len(vals))
+	encoding.Write(b, vals)
+	return entry
+}
+
+func entriesSize(entries [][]byte) int {
+	size := 0
+	for _, entry := range entries {
+		size += len(entry)
+	}
+	return size
+}
+
+func batchTrailer(batchID string, idx int) []byte {
+	id, _ := hex.DecodeString(batchID)
+	trailer := make([]byte, batchTrailerSize)
+	b := encoding.WriteInt16(trailer, batchTrailerMarker)
+	b = encoding.Write(b, id)
+	encoding.WriteInt32(b, idx)
+	return trailer
+}
+
+// batchOf returns the id of the atomic batch to which the given WAL entry
+// belongs, along with the entry's index within the batch.
+func batchOf(data []byte) (batchID string, idx int, inBatch bool) {
+	remain := entryTrailer(data)
+	if len(remain) != batchTrailerSize {
+		return
+	}
+	marker, remain := encoding.ReadInt16(remain)
+	if marker != batchTrailerMarker {
+		return
+	}
+	id, remain := encoding.Read(remain, batchIDSize)
+	idx, _ = encoding.ReadInt32(remain)
+	return hex.EncodeToString(id), idx, true
+}
+
+// withoutBatchTrailer strips the atomic batch trailer, if any, from the given
+// WAL entry. Batches are only meaningful to the node that wrote them.
+func withoutBatchTrailer(data []byte) []byte {
+	if _, _, inBatch := batchOf(data); inBatch {
+		return data[:len(data)-batchTrailerSize]
+	}
+	return data
+}
+
+// entryTrailer returns whatever follows the dims and vals of the given WAL
+// entry.
+func entryTrailer(data []byte) (trailer []byte) {
+	defer func() {
+		if p := recover(); p != nil {
+			// malformed entry
+			trailer = nil
+		}
+	}()
+
+	_, remain := encoding.Read(data, encoding.Width64bits)
+	dimsLen, remain := encoding.ReadInt32(remain)
+	_, remain = encoding.Read(remain, dimsLen)
+	valsLen, remain := encoding.ReadInt32(remain)
+	_, remain = encoding.Read(remain, valsLen)
+	return remain
+}
+
+func (db *DB) atomicBatchFilename(batchID string) string {
+	return filepath.Join(db.opts.Dir, atomicBatchesDir, batchID)
+}
+
+// saveAtomicBatch durably records the given batch in its journal.
+func (db *DB) saveAtomicBatch(batch *atomicBatch) error {
+	b, err := json.Marshal(batch)
+	if err != nil {
+		return errors.New("Unable to encode atomic batch: %v", err)
+	}
+	if db.keyring != nil {
+		b, err = db.keyring.Seal(b)
+		if err != nil {
+			return errors.New("Unable to encrypt atomic batch: %v", err)
+		}
+	}
+	dir := filepath.Join(db.opts.Dir, atomicBatchesDir)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.New("Unable to create atomic batches dir: %v", err)
+	}
+	out, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		return errors.New("Unable to create atomic batch file: %v", err)
+	}
+	defer out.Close()
+	_, err = out.Write(b)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), db.atomicBatchFilename(batch.ID))
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return errors.New("Unable to save atomic batch: %v", err)
+	}
+	return nil
+}
+
+// completeAtomicBatch removes the journal for the given batch once everything
+// written to the WALs has been synced to disk.
+func (db *DB) completeAtomicBatch(batch *atomicBatch) {
+	for stream := range batch.Entries {
+		_, err := db.DurableOffset(stream)
+		if err != nil {
+			log.Errorf("Unable to sync %v for atomic batch %v, keeping journal: %v", stream, batch.ID, err)
+			return
+		}
+	}
+	err := os.Remove(db.atomicBatchFilename(batch.ID))
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Unable to remove journal for atomic batch %v: %v", batch.ID, err)
+	}
+}
+
+// loadAtomicBatches loads the journals of atomic batches that may not have
+// been completely written before the process last stopped.
+func (db *DB) loadAtomicBatches() {
+	dir := filepath.Join(db.opts.Dir, atomicBatchesDir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Unable to list atomic batches: %v", err)
+		}
+		return
+	}
+	for _, file := range files {
+		filename := filepath.Join(dir, file.Name())
+		if strings.HasPrefix(file.Name(), ".tmp") {
+			// never committed
+			os.Remove(filename)
+			continue
+		}
+		b, err := ioutil.ReadFile(filename)
+		if err == nil && encryption.IsEncrypted(b) {
+			b, err = db.openWALEntry(b)
+		}
+		if err != nil {
+			log.Errorf("Unable to read atomic batch %v, ignoring: %v", file.Name(), err)
+			continue
+		}
+		batch := &atomicBatch{}
+		err = json.Unmarshal(b, batch)
+		if err != nil {
+			log.Errorf("Unable to decode atomic batch %v, ignoring: %v", file.Name(), err)
+			continue
+		}
+		batch.recovered = make(map[string]bool)
+		db.pendingBatches = append(db.pendingBatches, batch)
+	}
+	if len(db.pendingBatches) > 0 {
+		log.Debugf("Loaded %d atomic batches to recover", len(db.pendingBatches))
+	}
+}
+
+// recoverAtomicBatches writes the entries for the given stream that are
+// missing from its WAL for every pending atomic batch. head is the end of the
+// data that was in the WAL when it was opened. Must be called before anything
+// new is written to the stream.
+func (db *DB) recoverAtomicBatches(stream string, w *wal.WAL, head wal.Offset) {
+	db.pendingBatchesMx.Lock()
+	defer db.pendingBatchesMx.Unlock()
+
+	remaining := db.pendingBatches[:0]
+	for _, batch := range db.pendingBatches {
+		entries := batch.Entries[stream]
+		if len(entries) > 0 && !batch.recovered[stream] {
+			err := db.recoverAtomicBatch(stream, w, head, batch)
+			if err != nil {
+				log.Errorf("Unable to recover atomic batch %v for %v: %v", batch.ID, stream, err)
+			} else {
+				batch.recovered[stream] = true
+			}
+		}
+		if len(batch.recovered) < len(batch.Entries) {
+			remaining = append(remaining, batch)
+			continue
+		}
+		log.Debugf("Recovered atomic batch %v", batch.ID)
+		go db.completeAtomicBatch(batch)
+	}
+	db.pendingBatches = remaining
+}
+
+func (db *DB) recoverAtomicBatch(stream string, w *wal.WAL, head wal.Offset, batch *atomicBatch) error {
+	written := make(map[int]bool)
+	if head.After(batch.Offsets[stream]) {
+		r, err := w.NewReader("atomic."+batch.ID, batch.Offsets[stream], db.walBuffers.Get)
+		if err != nil {
+			return errors.New("Unable to open WAL reader: %v", err)
+		}
+		for head.After(r.Offset()) {
+			data, err := r.Read()
+			if err != nil {
+				r.Close()
+				return errors.New("Unable to read WAL: %v", err)
+			}
+			if data == nil {
+				continue
+			}
+			data, err = db.openWALEntry(data)
+			if err != nil {
+				continue
+			}
+			if batchID, idx, inBatch := batchOf(data); inBatch && batchID == batch.ID {
+				written[idx] = true
+			}
+		}
+		r.Close()
+	}
+
+	entries := batch.Entries[stream]
+	for i, entry := range entries {
+		if written[i] {
+			continue
+		}
+		err := db.writeWAL(w, entry, batchTrailer(batch.ID, i))
+		if err != nil {
+			return errors.New("Unable to write entry %d: %v", i, err)
+		}
+	}
+	log.Debugf("Wrote %d of %d entries of atomic batch %v to %v", len(entries)-len(written), len(entries), batch.ID, stream)
+	return nil
+}
@@ -0,0 +1,121 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertAtomically(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	schema := Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound_a GROUP BY *, period(1m)",
+		},
+		"test_b": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound_b GROUP BY *, period(1m)",
+		},
+	}
+	open := func() *DB {
+		db, openErr := NewDB(&DBOpts{Dir: tmpDir})
+		if !assert.NoError(t, openErr) {
+			return nil
+		}
+		if !assert.NoError(t, db.ApplySchema(schema)) {
+			db.Close()
+			return nil
+		}
+		return db
+	}
+	query := func(db *DB, table string) float64 {
+		source, queryErr := db.Query("SELECT i FROM "+table, false, nil, true)
+		if !assert.NoError(t, queryErr) {
+			return 0
+		}
+		total := float64(0)
+		_, queryErr = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			total += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, queryErr)
+		return total
+	}
+
+	db := open()
+	if db == nil {
+		return
+	}
+	now := time.Now()
+	assert.Error(t, db.InsertAtomically([]*StreamPoint{
+		NewStreamPoint("inbound_a", now, map[string]interface{}{"dim": "a"}, map[string]float64{"i": 1}),
+		NewStreamPoint("unknown", now, map[string]interface{}{"dim": "a"}, map[string]float64{"i": 1}),
+	}), "batch including unknown stream should fail")
+
+	assert.NoError(t, db.InsertAtomically([]*StreamPoint{
+		NewStreamPoint("inbound_a", now, map[string]interface{}{"dim": "a"}, map[string]float64{"i": 1}),
+		NewStreamPoint("inbound_b", now, map[string]interface{}{"dim": "b"}, map[string]float64{"i": 2}),
+	}))
+	time.Sleep(250 * time.Millisecond)
+	assert.EqualValues(t, 1, query(db, "test_a"), "failed batch shouldn't have been inserted")
+	assert.EqualValues(t, 2, query(db, "test_b"))
+
+	// Simulate crashing after writing only part of a batch
+	batch := &atomicBatch{
+		ID:      "0123456789abcdef0123456789abcdef",
+		Offsets: make(map[string]wal.Offset),
+		Entries: make(map[string][][]byte),
+	}
+	for _, stream := range []string{"inbound_a", "inbound_b"} {
+		head, headErr := db.walHead(stream)
+		if !assert.NoError(t, headErr) {
+			db.Close()
+			return
+		}
+		batch.Offsets[stream] = head
+	}
+	batch.Entries["inbound_a"] = [][]byte{
+		encodeWALEntry(now, db.normalize("inbound_a", bytemap.New(map[string]interface{}{"dim": "a"})), bytemap.NewFloat(map[string]float64{"i": 10})),
+		encodeWALEntry(now, db.normalize("inbound_a", bytemap.New(map[string]interface{}{"dim": "a"})), bytemap.NewFloat(map[string]float64{"i": 100})),
+	}
+	batch.Entries["inbound_b"] = [][]byte{
+		encodeWALEntry(now, db.normalize("inbound_b", bytemap.New(map[string]interface{}{"dim": "b"})), bytemap.NewFloat(map[string]float64{"i": 20})),
+	}
+	if !assert.NoError(t, db.saveAtomicBatch(batch)) {
+		db.Close()
+		return
+	}
+	assert.NoError(t, db.writeWAL(db.streams["inbound_a"], batch.Entries["inbound_a"][0], batchTrailer(batch.ID, 0)))
+	time.Sleep(250 * time.Millisecond)
+	assert.EqualValues(t, 11, query(db, "test_a"))
+	assert.EqualValues(t, 2, query(db, "test_b"))
+	db.Close()
+
+	db = open()
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	time.Sleep(250 * time.Millisecond)
+	assert.EqualValues(t, 111, query(db, "test_a"), "remainder of batch should have been written exactly once on restart")
+	assert.EqualValues(t, 22, query(db, "test_b"), "remainder of batch should have been written on restart")
+	assert.Empty(t, db.pendingBatches)
+
+	// Journal is removed asynchronously
+	time.Sleep(250 * time.Millisecond)
+	_, err = os.Stat(db.atomicBatchFilename(batch.ID))
+	assert.True(t, os.IsNotExist(err), "journal should have been removed once batch was recovered")
+}
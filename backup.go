@@ -0,0 +1,404 @@
+package zenodb
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/wal"
+)
+
+const (
+	backupLockFilename    = ".backup_lock"
+	backupManifestName    = "manifest.json"
+	backupSchemaName      = "schema.yaml"
+	backupAnnotationsName = "annotations"
+	backupTablesDir       = "tables"
+	restoreDir            = "_restore"
+	restoreInProgressDir  = "_restore.inprogress"
+	restoreFileMode       = 0644
+	restoreDirMode        = 0755
+	backupCopyBufferBytes = 65536
+)
+
+// backupManifest describes the contents of a backup.
+type backupManifest struct {
+	Created time.Time
+	// Partitioning is the partitioning of the follower that was backed up, if
+	// applicable.
+	Partitioning *partitioning
+	// Tables maps table names to the WAL offset through which their filestores
+	// are current.
+	Tables map[string]wal.Offset
+	// Files maps table names to the names of their filestores within the backup.
+	Files map[string]string
+}
+
+// Backup writes a consistent, point-in-time backup of the database to w as a
+// tar archive. The backup contains the latest filestore of every table (along
+// with the WAL offset through which it's current), the schema and the
+// annotations. Memstores
+// are flushed first so that the backup includes everything inserted up to
+// now. Filestores are copied as-is, so restoring an encrypted database
+// requires the same encryption keys. The database continues to serve inserts
+// and queries while the backup runs.
+func (db *DB) Backup(ctx context.Context, w io.Writer) error {
+	if db.opts.ReadOnly {
+		return errors.New("Can't back up a ReadOnly database")
+	}
+
+	lockFile := filepath.Join(db.opts.Dir, backupLockFilename)
+	lock, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, restoreFileMode)
+	if err != nil {
+		if os.IsExist(err) {
+			return errors.New("Another backup appears to be in progress, remove %v if that's not the case", lockFile)
+		}
+		return errors.New("Unable to create backup lock: %v", err)
+	}
+	lock.Close()
+	// The lock prevents tables from removing old filestores while we copy them
+	defer os.Remove(lockFile)
+
+	db.FlushAll()
+	start := time.Now()
+
+	manifest := &backupManifest{
+		Created: db.clock.Now(),
+		Tables:  make(map[string]wal.Offset),
+		Files:   make(map[string]string),
+	}
+	if db.opts.Follow != nil {
+		p := db.partitioning()
+		manifest.Partitioning = &p
+	}
+	filenames := make(map[string]string)
+	db.tablesMutex.RLock()
+	for name, t := range db.tables {
+		if t.rowStore == nil {
+			continue
+		}
+		t.rowStore.mx.RLock()
+		filename := t.rowStore.fileStore.filename
+		t.rowStore.mx.RUnlock()
+		if filename != "" {
+			filenames[name] = filename
+		}
+	}
+	db.tablesMutex.RUnlock()
+	names := make([]string, 0, len(filenames))
+	for name, filename := range filenames {
+		offset, _, offsetErr := readWALOffset(db.keyring, filename)
+		if offsetErr != nil {
+			return errors.New("Unable to read WAL offset of %v: %v", filename, offsetErr)
+		}
+		manifest.Tables[name] = offset
+		manifest.Files[name] = path.Join(backupTablesDir, name, filepath.Base(filename))
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tar.NewWriter(&contextWriter{ctx, w})
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.New("Unable to encode backup manifest: %v", err)
+	}
+	err = writeTarEntry(tw, backupManifestName, manifestBytes)
+	if err != nil {
+		return err
+	}
+	if db.opts.SchemaFile != "" {
+		schema, readErr := ioutil.ReadFile(db.opts.SchemaFile)
+		if readErr != nil {
+			return errors.New("Unable to read schema for backup: %v", readErr)
+		}
+		err = writeTarEntry(tw, backupSchemaName, schema)
+		if err != nil {
+			return err
+		}
+	}
+	db.annotationsMx.RLock()
+	annotations, err := ioutil.ReadFile(filepath.Join(db.opts.Dir, annotationsFilename))
+	db.annotationsMx.RUnlock()
+	if err == nil {
+		err = writeTarEntry(tw, backupAnnotationsName, annotations)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return errors.New("Unable to back up annotations: %v", err)
+	}
+	for _, name := range names {
+		err = copyToTar(tw, manifest.Files[name], filenames[name])
+		if err != nil {
+			return err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return errors.New("Unable to finish writing backup: %v", err)
+	}
+	log.Debugf("Backed up %d tables in %v", len(names), time.Now().Sub(start))
+	return nil
+}
+
+// Restore reads a backup produced by Backup and stages it to replace the
+// database's data the next time that it's started. Tables in the backup resume
+// from the WAL offsets recorded in it, replaying any subsequent data that's
+// still available in the WAL (or from the leader in the case of followers).
+// Tables that aren't in the backup are left alone.
+func (db *DB) Restore(r io.Reader) error {
+	if db.opts.ReadOnly {
+		return errors.New("Can't restore into a ReadOnly database")
+	}
+
+	staging := filepath.Join(db.opts.Dir, restoreInProgressDir)
+	err := os.RemoveAll(staging)
+	if err != nil {
+		return errors.New("Unable to clear prior restore: %v", err)
+	}
+	defer os.RemoveAll(staging)
+	manifest, err := db.extractBackup(r, staging)
+	if err != nil {
+		return err
+	}
+
+	final := filepath.Join(db.opts.Dir, restoreDir)
+	err = os.RemoveAll(final)
+	if err == nil {
+		err = os.Rename(staging, final)
+	}
+	if err != nil {
+		return errors.New("Unable to stage restore: %v", err)
+	}
+	log.Debugf("Staged restore of %d tables from backup created at %v, will apply on next restart", len(manifest.Files), manifest.Created)
+	return nil
+}
+
+// extractBackup extracts the backup read from r into dir and verifies that its
+// filestores are readable.
+func (db *DB) extractBackup(r io.Reader, dir string) (*backupManifest, error) {
+	tr := tar.NewReader(r)
+	for {
+		header, readErr := tr.Next()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, errors.New("Unable to read backup: %v", readErr)
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return nil, errors.New("Backup contains invalid path %v", header.Name)
+		}
+		err := copyFromTar(tr, filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, err := readBackupManifest(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	for name, file := range manifest.Files {
+		_, _, offsetErr := readWALOffset(db.keyring, filepath.Join(dir, filepath.FromSlash(file)))
+		if offsetErr != nil {
+			return nil, errors.New("Unable to read filestore for %v from backup, is it encrypted with a key we don't have?: %v", name, offsetErr)
+		}
+	}
+	return manifest, nil
+}
+
+// applyRestore applies a restore staged by Restore. This happens at startup,
+// before any tables are opened.
+func (db *DB) applyRestore() error {
+	staged := filepath.Join(db.opts.Dir, restoreDir)
+	if _, err := os.Stat(staged); os.IsNotExist(err) {
+		// Nothing to restore
+		return nil
+	}
+	manifest, err := readBackupManifest(staged, false)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Restoring %d tables from backup created at %v", len(manifest.Files), manifest.Created)
+	for name, file := range manifest.Files {
+		restored := filepath.Join(staged, filepath.FromSlash(file))
+		if _, statErr := os.Stat(restored); os.IsNotExist(statErr) {
+			// Already moved into place before we were interrupted
+			continue
+		}
+		tableDir := filepath.Join(db.opts.Dir, name)
+		err = os.RemoveAll(tableDir)
+		if err == nil {
+			err = os.MkdirAll(tableDir, restoreDirMode)
+		}
+		if err == nil {
+			err = os.Rename(restored, filepath.Join(tableDir, path.Base(file)))
+		}
+		if err == nil {
+			// Restored data isn't in the middle of rebalancing
+			err = os.RemoveAll(filepath.Join(db.opts.Dir, rebalanceDir, name))
+		}
+		if err == nil {
+			err = os.RemoveAll(filepath.Join(db.opts.Dir, rebalanceDir, name+".dat"))
+		}
+		if err != nil {
+			return errors.New("Unable to restore table %v: %v", name, err)
+		}
+	}
+
+	if manifest.Partitioning != nil {
+		// Record the backup's partitioning so that we rebalance if it's changed
+		b, encodeErr := json.Marshal(manifest.Partitioning)
+		if encodeErr == nil {
+			err = ioutil.WriteFile(filepath.Join(db.opts.Dir, partitioningFilename), b, restoreFileMode)
+		}
+		if encodeErr != nil || err != nil {
+			return errors.New("Unable to restore partitioning: %v %v", encodeErr, err)
+		}
+	}
+
+	schema, err := ioutil.ReadFile(filepath.Join(staged, backupSchemaName))
+	if err == nil && db.opts.SchemaFile != "" {
+		err = ioutil.WriteFile(db.opts.SchemaFile, schema, restoreFileMode)
+		if err != nil {
+			return errors.New("Unable to restore schema: %v", err)
+		}
+	}
+
+	annotations, err := ioutil.ReadFile(filepath.Join(staged, backupAnnotationsName))
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(db.opts.Dir, annotationsFilename), annotations, restoreFileMode)
+		if err != nil {
+			return errors.New("Unable to restore annotations: %v", err)
+		}
+	}
+
+	// Start a new incarnation so that the leader doesn't skip data that we
+	// acknowledged prior to the restore
+	err = os.Remove(filepath.Join(db.opts.Dir, incarnationFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("Unable to reset incarnation: %v", err)
+	}
+
+	err = os.RemoveAll(staged)
+	if err != nil {
+		return errors.New("Unable to remove restored backup: %v", err)
+	}
+	log.Debug("Finished restoring from backup")
+	return nil
+}
+
+// readBackupManifest reads the manifest of the backup in dir, optionally
+// verifying that the backup contains all of the files listed in it.
+func readBackupManifest(dir string, verify bool) (*backupManifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, backupManifestName))
+	if err != nil {
+		return nil, errors.New("Unable to read backup manifest: %v", err)
+	}
+	manifest := &backupManifest{}
+	err = json.Unmarshal(b, manifest)
+	if err != nil {
+		return nil, errors.New("Unable to parse backup manifest: %v", err)
+	}
+	for name, file := range manifest.Files {
+		if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, "_") || strings.HasPrefix(name, ".") {
+			return nil, errors.New("Backup contains invalid table name %v", name)
+		}
+		if !verify {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(file))); err != nil {
+			return nil, errors.New("Backup is missing filestore for %v: %v", name, err)
+		}
+	}
+	return manifest, nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    restoreFileMode,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err != nil {
+		return errors.New("Unable to write %v to backup: %v", name, err)
+	}
+	return nil
+}
+
+func copyToTar(tw *tar.Writer, name string, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return errors.New("Unable to open %v for backup: %v", filename, err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return errors.New("Unable to stat %v for backup: %v", filename, err)
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    restoreFileMode,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	})
+	if err == nil {
+		_, err = io.CopyBuffer(tw, file, make([]byte, backupCopyBufferBytes))
+	}
+	if err != nil {
+		return errors.New("Unable to write %v to backup: %v", filename, err)
+	}
+	return nil
+}
+
+func copyFromTar(tr *tar.Reader, filename string) error {
+	err := os.MkdirAll(filepath.Dir(filename), restoreDirMode)
+	if err != nil {
+		return errors.New("Unable to create directory for %v: %v", filename, err)
+	}
+	out, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, restoreFileMode)
+	if err != nil {
+		return errors.New("Unable to create %v: %v", filename, err)
+	}
+	defer out.Close()
+	_, err = io.CopyBuffer(out, tr, make([]byte, backupCopyBufferBytes))
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		return errors.New("Unable to restore %v: %v", filename, err)
+	}
+	return nil
+}
+
+// contextWriter is an io.Writer that stops writing once its context is done.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw *contextWriter) Write(b []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(b)
+}
@@ -0,0 +1,223 @@
+package zenodb
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+)
+
+const (
+	attachedBackupsDir = "_backups"
+
+	// attachedTableSeparator separates the names of tables from the names of
+	// attached backups in queries, as in table@backup.
+	attachedTableSeparator = "@"
+)
+
+var (
+	validBackupName = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+)
+
+// attachedBackup is a backup whose tables can be queried read-only as
+// table@name.
+type attachedBackup struct {
+	name     string
+	dir      string
+	manifest *backupManifest
+}
+
+// AttachedBackup describes a backup attached with AttachBackup.
+type AttachedBackup struct {
+	Name    string
+	Created time.Time
+	Tables  []string
+}
+
+// AttachBackup makes the backup read from r (as produced by Backup) queryable
+// under the given name without restoring it. Each table in the backup can then
+// be queried like a regular, read-only table named table@name. Queries
+// interpret the backup's data using the current definition of the table, and
+// see the data as of the time that the backup was created, so relative times
+// like ASOF '-1h' are relative to that time. Backups stay attached across
+// restarts until detached with DetachBackup.
+func (db *DB) AttachBackup(name string, r io.Reader) error {
+	if db.opts.ReadOnly {
+		return errors.New("Can't attach backups to a ReadOnly database")
+	}
+	name = strings.ToLower(name)
+	if !validBackupName.MatchString(name) {
+		return errors.New("Invalid backup name '%v', use only letters, digits, '_', '.' and '-'", name)
+	}
+
+	db.attachedBackupsMx.Lock()
+	_, exists := db.attachedBackups[name]
+	db.attachedBackupsMx.Unlock()
+	if exists {
+		return errors.New("Backup %v is already attached, detach it first", name)
+	}
+
+	staging := filepath.Join(db.opts.Dir, attachedBackupsDir, "."+name+".inprogress")
+	err := os.RemoveAll(staging)
+	if err != nil {
+		return errors.New("Unable to clear prior attach of %v: %v", name, err)
+	}
+	defer os.RemoveAll(staging)
+	manifest, err := db.extractBackup(r, staging)
+	if err != nil {
+		return err
+	}
+
+	final := filepath.Join(db.opts.Dir, attachedBackupsDir, name)
+	db.attachedBackupsMx.Lock()
+	defer db.attachedBackupsMx.Unlock()
+	if _, exists := db.attachedBackups[name]; exists {
+		return errors.New("Backup %v is already attached, detach it first", name)
+	}
+	err = os.RemoveAll(final)
+	if err == nil {
+		err = os.Rename(staging, final)
+	}
+	if err != nil {
+		return errors.New("Unable to attach backup %v: %v", name, err)
+	}
+	db.attachedBackups[name] = &attachedBackup{name: name, dir: final, manifest: manifest}
+	log.Debugf("Attached backup %v created at %v with %d tables", name, manifest.Created, len(manifest.Files))
+	return nil
+}
+
+// DetachBackup detaches the named backup and removes its data.
+func (db *DB) DetachBackup(name string) error {
+	name = strings.ToLower(name)
+	db.attachedBackupsMx.Lock()
+	defer db.attachedBackupsMx.Unlock()
+	backup, found := db.attachedBackups[name]
+	if !found {
+		return errors.New("Backup %v is not attached", name)
+	}
+	delete(db.attachedBackups, name)
+	err := os.RemoveAll(backup.dir)
+	if err != nil {
+		return errors.New("Unable to remove data of backup %v: %v", name, err)
+	}
+	log.Debugf("Detached backup %v", name)
+	return nil
+}
+
+// AttachedBackups lists the attached backups, ordered by name.
+func (db *DB) AttachedBackups() []*AttachedBackup {
+	db.attachedBackupsMx.Lock()
+	defer db.attachedBackupsMx.Unlock()
+	result := make([]*AttachedBackup, 0, len(db.attachedBackups))
+	for _, backup := range db.attachedBackups {
+		tables := make([]string, 0, len(backup.manifest.Files))
+		for table := range backup.manifest.Files {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		result = append(result, &AttachedBackup{
+			Name:    backup.name,
+			Created: backup.manifest.Created,
+			Tables:  tables,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// loadAttachedBackups loads the backups that were attached before we were
+// restarted.
+func (db *DB) loadAttachedBackups() {
+	db.attachedBackups = make(map[string]*attachedBackup)
+	dirs, err := ioutil.ReadDir(filepath.Join(db.opts.Dir, attachedBackupsDir))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Unable to list attached backups: %v", err)
+		}
+		return
+	}
+	for _, dir := range dirs {
+		name := dir.Name()
+		if !dir.IsDir() || !validBackupName.MatchString(name) {
+			continue
+		}
+		backupDir := filepath.Join(db.opts.Dir, attachedBackupsDir, name)
+		manifest, err := readBackupManifest(backupDir, false)
+		if err != nil {
+			log.Errorf("Unable to load attached backup %v: %v", name, err)
+			continue
+		}
+		db.attachedBackups[name] = &attachedBackup{name: name, dir: backupDir, manifest: manifest}
+	}
+	if len(db.attachedBackups) > 0 {
+		log.Debugf("Loaded %d attached backups", len(db.attachedBackups))
+	}
+}
+
+// isAttachedTable indicates whether the given table name refers to a table in
+// an attached backup.
+func isAttachedTable(name string) bool {
+	return strings.Contains(name, attachedTableSeparator)
+}
+
+// getAttachedTable returns a read-only table for the given table@backup. The
+// table uses the current definition of the live table with the same name and
+// is frozen at the time that the backup was created.
+func (db *DB) getAttachedTable(name string) (*table, error) {
+	name = strings.ToLower(name)
+	i := strings.LastIndex(name, attachedTableSeparator)
+	tableName, backupName := name[:i], name[i+1:]
+	db.attachedBackupsMx.Lock()
+	backup, found := db.attachedBackups[backupName]
+	db.attachedBackupsMx.Unlock()
+	if !found {
+		return nil, errors.New("Backup %v is not attached", backupName)
+	}
+	file, found := backup.manifest.Files[tableName]
+	if !found {
+		return nil, errors.New("Table %v not found in backup %v", tableName, backupName)
+	}
+	live := db.getTable(tableName)
+	if live == nil {
+		return nil, errors.New("Table %v from backup %v isn't defined in the current schema", tableName, backupName)
+	}
+
+	opts := *live.TableOpts
+	opts.Name = name
+	fields := live.getFields()
+	live.whereMutex.RLock()
+	q := live.Query
+	live.whereMutex.RUnlock()
+	t := &table{
+		TableOpts: &opts,
+		Query:     q,
+		fields:    fields,
+		db:        db,
+		log:       golog.LoggerFor("zenodb." + name),
+		frozenAt:  backup.manifest.Created,
+	}
+	rs := &rowStore{
+		opts:          &rowStoreOptions{dir: filepath.Dir(filepath.Join(backup.dir, filepath.FromSlash(file)))},
+		t:             t,
+		fields:        fields,
+		fileStoreRows: -1,
+	}
+	rs.fileStore = &fileStore{
+		t:        t,
+		rs:       rs,
+		fields:   fields,
+		filename: filepath.Join(backup.dir, filepath.FromSlash(file)),
+	}
+	rs.memStore = rs.newMemStore()
+	t.rowStore = rs
+	return t, nil
+}
@@ -0,0 +1,103 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttachBackup(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	schema := Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1h)",
+		},
+	}
+	open := func() *DB {
+		db, openErr := NewDB(&DBOpts{Dir: tmpDir})
+		if !assert.NoError(t, openErr) {
+			return nil
+		}
+		if !assert.NoError(t, db.ApplySchema(schema)) {
+			db.Close()
+			return nil
+		}
+		return db
+	}
+	query := func(db *DB, sqlString string) (float64, error) {
+		source, queryErr := db.Query(sqlString, false, nil, false)
+		if queryErr != nil {
+			return 0, queryErr
+		}
+		total := float64(0)
+		_, queryErr = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			total += row.Values[0]
+			return true, nil
+		})
+		return total, queryErr
+	}
+
+	db := open()
+	if db == nil {
+		return
+	}
+	assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"dim": "a"}, map[string]float64{"i": 1}))
+	time.Sleep(250 * time.Millisecond)
+	var backup bytes.Buffer
+	if !assert.NoError(t, db.Backup(context.Background(), &backup)) {
+		return
+	}
+	assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"dim": "a"}, map[string]float64{"i": 10}))
+	time.Sleep(250 * time.Millisecond)
+	db.FlushAll()
+
+	assert.Error(t, db.AttachBackup("bad/name", bytes.NewReader(backup.Bytes())), "invalid name should be rejected")
+	assert.Error(t, db.AttachBackup("bad", bytes.NewReader(invalidBackup(t))), "invalid backup should be rejected")
+	if !assert.NoError(t, db.AttachBackup("Before-Incident", bytes.NewReader(backup.Bytes()))) {
+		db.Close()
+		return
+	}
+	assert.Error(t, db.AttachBackup("before-incident", bytes.NewReader(backup.Bytes())), "attaching twice should fail")
+	attached := db.AttachedBackups()
+	if assert.Len(t, attached, 1) {
+		assert.Equal(t, "before-incident", attached[0].Name)
+		assert.Equal(t, []string{"test_a"}, attached[0].Tables)
+	}
+
+	live, err := query(db, "SELECT i FROM test_a")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 11, live)
+	before, err := query(db, "SELECT i FROM `test_a@before-incident`")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, before, "backup should reflect data as of the time it was created")
+	_, err = query(db, "SELECT i FROM test_a@unknown")
+	assert.Error(t, err, "querying unattached backup should fail")
+	db.Close()
+
+	db = open()
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	before, err = query(db, "SELECT i FROM `test_a@before-incident`")
+	assert.NoError(t, err, "backup should remain attached after restart")
+	assert.EqualValues(t, 1, before)
+
+	assert.NoError(t, db.DetachBackup("before-incident"))
+	assert.Error(t, db.DetachBackup("before-incident"), "detaching twice should fail")
+	assert.Empty(t, db.AttachedBackups())
+	_, err = query(db, "SELECT i FROM `test_a@before-incident`")
+	assert.Error(t, err, "querying detached backup should fail")
+}
@@ -0,0 +1,96 @@
+package zenodb
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupRestore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	schema := Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1h)",
+		},
+	}
+
+	sourceDir := filepath.Join(tmpDir, "source")
+	source, err := NewDB(&DBOpts{Dir: sourceDir})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer source.Close()
+	if !assert.NoError(t, source.ApplySchema(schema)) {
+		return
+	}
+	assert.NoError(t, source.Insert("inbound", time.Now(), map[string]interface{}{"dim": "a"}, map[string]float64{"i": 1}))
+	assert.NoError(t, source.Annotate(&Annotation{Category: "deploy", Text: "v1"}))
+	time.Sleep(250 * time.Millisecond)
+
+	var backup bytes.Buffer
+	if !assert.NoError(t, source.Backup(context.Background(), &backup)) {
+		return
+	}
+	_, err = os.Stat(filepath.Join(sourceDir, backupLockFilename))
+	assert.True(t, os.IsNotExist(err), "Backup should release lock when done")
+	sourceFile := source.getTable("test_a").rowStore.fileStore.filename
+	if !assert.NotEmpty(t, sourceFile, "Backup should have flushed table") {
+		return
+	}
+	sourceOffset, _, err := readWALOffset(source.keyring, sourceFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	targetDir := filepath.Join(tmpDir, "target")
+	target, err := NewDB(&DBOpts{Dir: targetDir})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Error(t, target.Restore(bytes.NewReader(invalidBackup(t))), "Restore should reject paths outside of data directory")
+	if !assert.NoError(t, target.Restore(bytes.NewReader(backup.Bytes()))) {
+		return
+	}
+	target.Close()
+
+	target, err = NewDB(&DBOpts{Dir: targetDir})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer target.Close()
+	_, err = os.Stat(filepath.Join(targetDir, restoreDir))
+	assert.True(t, os.IsNotExist(err), "Restore should be cleaned up once applied")
+	files, err := ioutil.ReadDir(filepath.Join(targetDir, "test_a"))
+	if assert.NoError(t, err) && assert.Len(t, files, 1) {
+		assert.Equal(t, filepath.Base(sourceFile), files[0].Name())
+		restoredOffset, _, err := readWALOffset(target.keyring, filepath.Join(targetDir, "test_a", files[0].Name()))
+		if assert.NoError(t, err) {
+			assert.Equal(t, sourceOffset, restoredOffset)
+		}
+	}
+	annotations := target.Annotations(time.Time{}, time.Time{})
+	if assert.Len(t, annotations, 1, "Should restore annotations") {
+		assert.Equal(t, "v1", annotations[0].Text)
+	}
+}
+
+func invalidBackup(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.NoError(t, writeTarEntry(tw, "../escaped", []byte("data")))
+	assert.NoError(t, tw.Close())
+	return buf.Bytes()
+}
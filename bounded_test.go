@@ -0,0 +1,62 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutOfRangeValues(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	err = db.ApplySchema(Schema{
+		"requests": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT AVG(CLAMP(duration, 0, 3600)) AS clamped_duration, AVG(BOUNDED(duration, 0, 3600)) AS bounded_duration FROM inbound GROUP BY period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	for _, duration := range []float64{10, 20, 1000000, -5} {
+		assert.NoError(t, db.Insert("inbound", now, nil, map[string]float64{"duration": duration}))
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	source, err := db.Query("SELECT clamped_duration, bounded_duration FROM requests GROUP BY _", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var values []float64
+	_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+		values = row.Values
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []float64{907.5, 15}, values)
+	}
+
+	stats := db.TableStats("requests")
+	assert.Equal(t, map[string]int64{"clamped_duration": 2}, stats.ClampedValues)
+	assert.Equal(t, map[string]int64{"bounded_duration": 2}, stats.DroppedValues)
+}
@@ -148,9 +148,32 @@ nodeLoop:
 	}
 }
 
-// Copy makes a copy of this Tree.
+// Copy makes a copy of this Tree. The copy shares its data with the original,
+// so updates to either may show up in the other.
 func (bt *Tree) Copy() *Tree {
-	cp := &Tree{bytes: bt.bytes, length: bt.length, root: &node{}}
+	return bt.copy(false)
+}
+
+// DeepCopy makes a copy of this Tree that doesn't share any data with the
+// original, so that the copy can be updated without affecting the original.
+func (bt *Tree) DeepCopy() *Tree {
+	return bt.copy(true)
+}
+
+func (bt *Tree) copy(deep bool) *Tree {
+	cp := &Tree{
+		outExprs:      bt.outExprs,
+		inExprs:       bt.inExprs,
+		subMergers:    bt.subMergers,
+		outResolution: bt.outResolution,
+		inResolution:  bt.inResolution,
+		asOf:          bt.asOf,
+		until:         bt.until,
+		strideSlice:   bt.strideSlice,
+		bytes:         bt.bytes,
+		length:        bt.length,
+		root:          &node{},
+	}
 	nodes := make([]*node, 0, bt.Length())
 	nodeCopies := make([]*node, 0, bt.Length())
 	nodes = append(nodes, bt.root)
@@ -166,6 +189,14 @@ func (bt *Tree) Copy() *Tree {
 		nodeCopies = nodeCopies[1:]
 		for _, e := range n.edges {
 			cpt := &node{key: e.target.key, data: e.target.data}
+			if deep && e.target.data != nil {
+				cpt.data = make([]encoding.Sequence, len(e.target.data))
+				for i, seq := range e.target.data {
+					if seq != nil {
+						cpt.data[i] = append(encoding.Sequence(nil), seq...)
+					}
+				}
+			}
 			cpn.edges = append(cpn.edges, &edge{label: e.label, target: cpt})
 			nodes = append(nodes, e.target)
 			nodeCopies = append(nodeCopies, cpt)
@@ -175,6 +206,62 @@ func (bt *Tree) Copy() *Tree {
 	return cp
 }
 
+// Truncate makes a copy of this Tree that only includes periods after
+// truncateBefore. Keys that no longer have any data are left out. Like with
+// DeepCopy, the copy doesn't share any data with the original.
+func (bt *Tree) Truncate(truncateBefore time.Time) *Tree {
+	cp := &Tree{
+		outExprs:      bt.outExprs,
+		inExprs:       bt.inExprs,
+		subMergers:    bt.subMergers,
+		outResolution: bt.outResolution,
+		inResolution:  bt.inResolution,
+		asOf:          bt.asOf,
+		until:         bt.until,
+		strideSlice:   bt.strideSlice,
+	}
+	cp.root = cp.truncated(bt.root, truncateBefore)
+	if cp.root == nil {
+		cp.root = &node{}
+	}
+	return cp
+}
+
+// truncated returns a truncated copy of n for inclusion in bt, or nil if
+// neither n nor any of its descendants have data left after truncation.
+func (bt *Tree) truncated(n *node, truncateBefore time.Time) *node {
+	cpn := &node{key: n.key}
+	if n.data != nil {
+		var data []encoding.Sequence
+		for i, seq := range n.data {
+			seq = seq.Truncate(bt.outExprs[i].EncodedWidth(), bt.outResolution, truncateBefore, time.Time{})
+			if seq == nil {
+				continue
+			}
+			if data == nil {
+				data = make([]encoding.Sequence, len(n.data))
+			}
+			data[i] = append(encoding.Sequence(nil), seq...)
+			bt.bytes += cap(data[i])
+		}
+		if data != nil {
+			cpn.data = data
+			bt.length++
+		}
+	}
+	for _, e := range n.edges {
+		target := bt.truncated(e.target, truncateBefore)
+		if target != nil {
+			cpn.edges = append(cpn.edges, &edge{label: e.label, target: target})
+			bt.bytes += len(e.label)
+		}
+	}
+	if cpn.data == nil && len(cpn.edges) == 0 {
+		return nil
+	}
+	return cpn
+}
+
 // Update updates all of the fields at the given timestamp with the given
 // parameters.
 func (bt *Tree) Update(key []byte, vals []encoding.Sequence, params encoding.TSParams, metadata bytemap.ByteMap) int {
@@ -85,6 +85,64 @@ func TestByteTreeUpdate(t *testing.T) {
 	})
 }
 
+func TestByteTreeDeepCopy(t *testing.T) {
+	resolution := 10 * time.Second
+	e := SUM(FIELD("a"))
+	bt := New([]Expr{e}, nil, resolution, 0, epoch.Add(-1*resolution), epoch, 0)
+	bt.Update([]byte("test"), nil, params(1, 1), nil)
+
+	cp := bt.DeepCopy()
+	cp.Update([]byte("test"), nil, params(2, 2), nil)
+	cp.Update([]byte("toast"), nil, params(3, 3), nil)
+
+	values := func(bt *Tree) map[string]float64 {
+		result := make(map[string]float64)
+		bt.Walk(0, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+			val, _ := data[0].ValueAt(0, e)
+			result[string(key)] = val
+			return true, true, nil
+		})
+		return result
+	}
+	assert.Equal(t, map[string]float64{"test": 1}, values(bt), "updating deep copy shouldn't affect original")
+	assert.Equal(t, 1, bt.Length())
+	assert.Equal(t, map[string]float64{"test": 3, "toast": 3}, values(cp))
+	assert.Equal(t, 2, cp.Length())
+}
+
+func TestByteTreeTruncate(t *testing.T) {
+	resolution := 10 * time.Second
+	e := SUM(FIELD("a"))
+	bt := New([]Expr{e}, nil, resolution, 0, time.Time{}, time.Time{}, 0)
+	old := epoch.Add(-2 * resolution)
+	bt.Update([]byte("test"), nil, tsParams(old, 1, 1), nil)
+	bt.Update([]byte("test"), nil, params(2, 2), nil)
+	bt.Update([]byte("toast"), nil, tsParams(old, 3, 3), nil)
+	bt.Update([]byte("team"), nil, params(4, 4), nil)
+
+	values := func(bt *Tree) map[string][]float64 {
+		result := make(map[string][]float64)
+		bt.Walk(0, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+			for i := 0; i < data[0].NumPeriods(e.EncodedWidth()); i++ {
+				val, _ := data[0].ValueAt(i, e)
+				result[string(key)] = append(result[string(key)], val)
+			}
+			return true, true, nil
+		})
+		return result
+	}
+
+	truncated := bt.Truncate(epoch.Add(-1 * resolution))
+	assert.Equal(t, map[string][]float64{"test": {2}, "team": {4}}, values(truncated))
+	assert.Equal(t, 2, truncated.Length())
+	assert.Equal(t, map[string][]float64{"test": {2, 0, 1}, "toast": {3}, "team": {4}}, values(bt), "truncating shouldn't affect original")
+	assert.Equal(t, 3, bt.Length())
+
+	truncated.Update([]byte("toast"), nil, params(5, 5), nil)
+	assert.Equal(t, map[string][]float64{"test": {2}, "toast": {5}, "team": {4}}, values(truncated), "truncated tree should remain updatable")
+	assert.Equal(t, 3, truncated.Length())
+}
+
 func doTest(t *testing.T, populate func(bt *Tree, resolutionOut time.Duration, eA Expr, eB Expr)) {
 	resolutionOut := 10 * time.Second
 	resolutionIn := 1 * time.Second
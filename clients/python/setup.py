@@ -0,0 +1,12 @@
+from setuptools import setup
+
+setup(
+    name="zenodb",
+    version="0.1.0",
+    description="Client for zenodb's web API",
+    url="https://github.com/getlantern/zenodb",
+    license="Apache License 2.0",
+    packages=["zenodb"],
+    python_requires=">=3.6",
+    extras_require={"pandas": ["pandas>=1.0"]},
+)
@@ -0,0 +1,180 @@
+import datetime
+import gzip
+import io
+import json
+import unittest
+import urllib.error
+from unittest import mock
+
+import zenodb
+
+_TS = 1420070400000  # 2015-01-01T00:00:00Z
+
+
+class _Response(object):
+    """A fake response from urlopen."""
+
+    def __init__(self, body, status=200, headers=None):
+        if not isinstance(body, bytes):
+            body = json.dumps(body).encode("utf-8")
+        self.body = body
+        self.status = status
+        self.headers = headers or {}
+
+    def read(self):
+        return self.body
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, exc_type, exc_value, traceback):
+        pass
+
+
+def _http_error(status, message):
+    return urllib.error.HTTPError(
+        "https://zeno:17713", status, message, {}, io.BytesIO(message.encode("utf-8") + b"\n")
+    )
+
+
+class ClientTest(unittest.TestCase):
+    def setUp(self):
+        patcher = mock.patch("urllib.request.urlopen")
+        self.urlopen = patcher.start()
+        self.addCleanup(patcher.stop)
+        self.client = zenodb.Client("https://zeno:17713/", token="thetoken")
+
+    def request(self, i=0):
+        return self.urlopen.call_args_list[i][0][0]
+
+    def test_query_typed_vals(self):
+        self.urlopen.return_value = _Response(
+            {
+                "SQL": "SELECT requests, load_avg, up FROM combined GROUP BY server",
+                "Fields": ["requests", "load_avg", "up"],
+                "FieldMetaData": [
+                    {"Name": "requests", "Type": "int64"},
+                    {"Name": "load_avg", "Type": "float64"},
+                    {"Name": "up", "Type": "bool"},
+                ],
+                "Dims": ["server"],
+                "Rows": [
+                    {"TS": _TS, "Key": {"server": "a"}, "Vals": [9007199254740993, 0.5, True]},
+                    {"TS": _TS, "Key": {}, "Vals": [0, None, False]},
+                ],
+                "Stats": {"NumPartitions": 1},
+            }
+        )
+        result = self.client.query("SELECT requests, load_avg, up FROM combined GROUP BY server")
+
+        req = self.request()
+        self.assertEqual(
+            "https://zeno:17713/run?SELECT%20requests%2C%20load_avg%2C%20up%20FROM%20combined%20GROUP%20BY%20server",
+            req.full_url,
+        )
+        self.assertEqual("Bearer thetoken", req.get_header("Authorization"))
+        self.assertEqual({"NumPartitions": 1}, result.stats)
+        self.assertEqual("int64", result.field_metadata[0]["Type"])
+
+        records = list(result.records())
+        ts = datetime.datetime(2015, 1, 1, tzinfo=datetime.timezone.utc)
+        self.assertEqual(
+            [
+                {"ts": ts, "server": "a", "requests": 9007199254740993, "load_avg": 0.5, "up": True},
+                {"ts": ts, "server": None, "requests": 0, "load_avg": None, "up": False},
+            ],
+            records,
+        )
+        self.assertIsInstance(records[0]["requests"], int, "int64 fields should stay exact ints")
+        self.assertIs(records[0]["up"], True, "bool fields should be bools")
+
+    def test_query_empty_results(self):
+        self.urlopen.return_value = _Response({"Fields": ["requests"], "Dims": None, "Rows": None})
+        result = self.client.query("SELECT requests FROM combined")
+        self.assertEqual([], result.dims)
+        self.assertEqual([], result.rows)
+        self.assertEqual([], list(result.records()))
+
+        self.urlopen.return_value = _Response({"Fields": ["requests"], "Rows": [{"TS": _TS, "Vals": None}]})
+        records = list(self.client.query("SELECT requests FROM combined").records())
+        self.assertEqual(1, len(records))
+        self.assertNotIn("requests", records[0], "missing Vals shouldn't yield fields")
+
+    def test_query_gzip(self):
+        body = gzip.compress(json.dumps({"Fields": ["requests"], "Rows": [{"TS": _TS, "Vals": [5]}]}).encode("utf-8"))
+        self.urlopen.return_value = _Response(body, headers={"Content-Encoding": "gzip"})
+        records = list(self.client.query("SELECT requests FROM combined").records())
+        self.assertEqual(5, records[0]["requests"])
+
+    def test_query_fresh(self):
+        self.urlopen.return_value = _Response({})
+        self.client.query("SELECT requests FROM combined", fresh=True)
+        self.assertEqual("no-cache", self.request().get_header("Cache-control"))
+
+    @mock.patch("zenodb.client._POLL_INTERVAL", 0)
+    def test_query_polls_running_query(self):
+        self.urlopen.side_effect = [
+            _Response(b"/cached/abc\n", status=202),
+            _Response(b"/cached/abc\n", status=202),
+            _Response({"Fields": ["requests"], "Rows": [{"TS": _TS, "Vals": [5]}]}),
+        ]
+        result = self.client.query("SELECT requests FROM combined")
+        self.assertEqual(1, len(result.rows))
+        self.assertEqual("https://zeno:17713/cached/abc", self.request(2).full_url)
+
+    @mock.patch("zenodb.client._POLL_INTERVAL", 0)
+    def test_query_times_out(self):
+        self.client.timeout = -1
+        self.urlopen.return_value = _Response(b"/cached/abc\n", status=202)
+        with self.assertRaises(zenodb.ZenoError) as cm:
+            self.client.query("SELECT requests FROM combined")
+        self.assertEqual(202, cm.exception.status)
+
+    def test_error_response(self):
+        self.urlopen.side_effect = _http_error(400, "Unable to query: unknown table foo")
+        with self.assertRaises(zenodb.ZenoError) as cm:
+            self.client.query("SELECT requests FROM foo")
+        self.assertEqual(400, cm.exception.status)
+        self.assertEqual("Unable to query: unknown table foo", cm.exception.message)
+
+        self.urlopen.side_effect = _http_error(401, "Unauthorized")
+        with self.assertRaises(zenodb.ZenoError) as cm:
+            self.client.insert("inbound", [{"dims": {}, "vals": {"requests": 1}}])
+        self.assertEqual(401, cm.exception.status)
+
+    def test_prepared(self):
+        self.urlopen.return_value = _Response({"ID": "q1"})
+        self.assertEqual("q1", self.client.prepare("SELECT requests FROM combined WHERE server = ?"))
+        self.assertEqual(
+            "https://zeno:17713/prepare?sql=SELECT+requests+FROM+combined+WHERE+server+%3D+%3F",
+            self.request(0).full_url,
+        )
+
+        self.urlopen.return_value = _Response({"Rows": None})
+        self.client.query_prepared("q1", "a", 5)
+        self.assertEqual("https://zeno:17713/run/prepared/q1?param=%22a%22&param=5", self.request(1).full_url)
+
+    def test_batch_insert(self):
+        self.urlopen.return_value = _Response(b"")
+        ts = datetime.datetime(2015, 1, 1)
+        with self.client.batch_inserter("inbound", batch_size=2) as inserter:
+            inserter.insert({"server": "a"}, {"requests": 1}, ts)
+            inserter.insert({"server": "b"}, {"requests": 2})
+            inserter.insert({"server": "c"}, {"requests": 3})
+        self.assertEqual(3, inserter.inserted)
+        self.assertEqual(2, self.urlopen.call_count)
+
+        req = self.request(0)
+        self.assertEqual("https://zeno:17713/insert/inbound", req.full_url)
+        points = [json.loads(line) for line in req.data.decode("utf-8").splitlines()]
+        self.assertEqual(
+            [
+                {"dims": {"server": "a"}, "vals": {"requests": 1}, "ts": "2015-01-01T00:00:00+00:00"},
+                {"dims": {"server": "b"}, "vals": {"requests": 2}},
+            ],
+            points,
+        )
+
+
+if __name__ == "__main__":
+    unittest.main()
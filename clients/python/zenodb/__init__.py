@@ -0,0 +1,5 @@
+"""Python client for zenodb."""
+
+from .client import BatchInserter, Client, QueryResult, ZenoError
+
+__all__ = ["BatchInserter", "Client", "QueryResult", "ZenoError"]
@@ -0,0 +1,201 @@
+"""Client for zenodb's web API.
+
+zenodb's RPC API uses gRPC with a msgpack codec rather than protocol buffers,
+so this client talks to the JSON web API instead (see the README's sections on
+the web API, API tokens and prepared queries).
+"""
+
+import datetime
+import gzip
+import json
+import time
+import urllib.error
+import urllib.parse
+import urllib.request
+
+__all__ = ["Client", "BatchInserter", "QueryResult", "ZenoError"]
+
+_POLL_INTERVAL = 0.25
+
+
+class ZenoError(Exception):
+    """Raised when zenodb responds with an error."""
+
+    def __init__(self, status, message):
+        super(ZenoError, self).__init__("%d: %s" % (status, message))
+        self.status = status
+        self.message = message
+
+
+class Client(object):
+    """Client for the zenodb web API at the given base URL, for example
+    https://zeno:17713.
+
+    token is an API token with which to authenticate (see /tokens). timeout
+    limits how long to wait for query results, in seconds. context is an
+    optional ssl.SSLContext, for example to trust a self-signed certificate.
+    """
+
+    def __init__(self, url, token=None, timeout=300, context=None):
+        self.url = url.rstrip("/")
+        self.token = token
+        self.timeout = timeout
+        self.context = context
+
+    def insert(self, stream, points):
+        """Inserts the given points into the given stream in a single request.
+
+        Each point is a dict with "dims" (a dict of dimensions), "vals" (a dict
+        of numeric values) and optionally "ts" (a datetime, defaulting to now).
+        """
+        body = "".join(json.dumps(_encode_point(point)) + "\n" for point in points)
+        if not body:
+            return
+        self._request(
+            "/insert/" + urllib.parse.quote(stream),
+            data=body.encode("utf-8"),
+            headers={"Content-Type": "application/json"},
+        )
+
+    def batch_inserter(self, stream, batch_size=1000):
+        """Returns a BatchInserter that inserts into the given stream in batches
+        of batch_size points."""
+        return BatchInserter(self, stream, batch_size)
+
+    def query(self, sql, fresh=False):
+        """Runs the given SQL query and returns a QueryResult.
+
+        If fresh is True, cached results are ignored.
+        """
+        return self._query("/run?" + urllib.parse.quote(sql), fresh)
+
+    def query_prepared(self, prepared_id, *params, **kwargs):
+        """Runs the prepared query with the given id (see prepare), binding the
+        given parameters to its placeholders, and returns a QueryResult."""
+        query = urllib.parse.urlencode([("param", json.dumps(param)) for param in params])
+        path = "/run/prepared/" + urllib.parse.quote(prepared_id)
+        if query:
+            path += "?" + query
+        return self._query(path, kwargs.get("fresh", False))
+
+    def prepare(self, sql):
+        """Prepares the given SQL query with ? placeholders and returns its id."""
+        status, body = self._request("/prepare?" + urllib.parse.urlencode({"sql": sql}))
+        return json.loads(body)["ID"]
+
+    def query_df(self, sql, fresh=False):
+        """Like query, but returns the results as a pandas DataFrame."""
+        return self.query(sql, fresh).to_dataframe()
+
+    def _query(self, path, fresh):
+        headers = {}
+        if fresh:
+            headers["Cache-control"] = "no-cache"
+        deadline = time.time() + self.timeout
+        status, body = self._request(path, headers=headers)
+        while status == 202:
+            # Still running, poll for cached results
+            if time.time() > deadline:
+                raise ZenoError(status, "Timed out waiting for query results")
+            time.sleep(_POLL_INTERVAL)
+            status, body = self._request(body.decode("utf-8").strip())
+        return QueryResult(json.loads(body))
+
+    def _request(self, path, data=None, headers=None):
+        req = urllib.request.Request(self.url + path, data=data, headers=headers or {})
+        if self.token:
+            req.add_header("Authorization", "Bearer " + self.token)
+        try:
+            resp = urllib.request.urlopen(req, timeout=self.timeout, context=self.context)
+        except urllib.error.HTTPError as e:
+            raise ZenoError(e.code, e.read().decode("utf-8", "replace").strip())
+        with resp:
+            body = resp.read()
+            if resp.headers.get("Content-Encoding") == "gzip":
+                body = gzip.decompress(body)
+            return resp.status, body
+
+
+class BatchInserter(object):
+    """Buffers points and inserts them in batches. Use it as a context manager
+    or call close() when done to insert any remaining points."""
+
+    def __init__(self, client, stream, batch_size):
+        self.client = client
+        self.stream = stream
+        self.batch_size = batch_size
+        self.inserted = 0
+        self._batch = []
+
+    def insert(self, dims, vals, ts=None):
+        """Buffers a point, inserting the current batch if it's full."""
+        self._batch.append({"dims": dims, "vals": vals, "ts": ts})
+        if len(self._batch) >= self.batch_size:
+            self.flush()
+
+    def flush(self):
+        """Inserts all buffered points."""
+        batch, self._batch = self._batch, []
+        self.client.insert(self.stream, batch)
+        self.inserted += len(batch)
+
+    def close(self):
+        self.flush()
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, exc_type, exc_value, traceback):
+        if exc_type is None:
+            self.close()
+
+
+class QueryResult(object):
+    """The results of a query, as returned by the web API."""
+
+    def __init__(self, result):
+        self.raw = result
+        self.sql = result.get("SQL")
+        self.permalink = result.get("Permalink")
+        self.fields = result.get("Fields") or []
+        self.field_metadata = result.get("FieldMetaData") or []
+        self.dims = result.get("Dims") or []
+        self.rows = result.get("Rows") or []
+        self.stats = result.get("Stats")
+
+    def records(self):
+        """Yields each row as a dict of its timestamp ("ts", a UTC datetime),
+        dimensions and fields."""
+        for row in self.rows:
+            record = {"ts": _from_millis(row["TS"])}
+            key = row.get("Key") or {}
+            for dim in self.dims:
+                record[dim] = key.get(dim)
+            for field, val in zip(self.fields, row.get("Vals") or []):
+                record[field] = val
+            yield record
+
+    def to_dataframe(self):
+        """Returns the results as a pandas DataFrame with one column for the
+        timestamp ("ts"), one per dimension and one per field. The metadata of
+        the fields (units, aggregates, etc.) is available in attrs["fields"]."""
+        import pandas
+
+        columns = ["ts"] + self.dims + self.fields
+        df = pandas.DataFrame.from_records(list(self.records()), columns=columns)
+        df.attrs["fields"] = {md["Name"]: md for md in self.field_metadata}
+        return df
+
+
+def _encode_point(point):
+    encoded = {"dims": point["dims"], "vals": point["vals"]}
+    ts = point.get("ts")
+    if ts is not None:
+        if ts.tzinfo is None:
+            ts = ts.replace(tzinfo=datetime.timezone.utc)
+        encoded["ts"] = ts.isoformat()
+    return encoded
+
+
+def _from_millis(millis):
+    return datetime.datetime.fromtimestamp(millis / 1000.0, tz=datetime.timezone.utc)
@@ -0,0 +1,53 @@
+package zenodb
+
+import (
+	"time"
+
+	"github.com/getlantern/zenodb/metrics"
+)
+
+const (
+	// DefaultMaxClockSkew is the default for DBOpts.MaxClockSkew
+	DefaultMaxClockSkew = 5 * time.Second
+)
+
+// sentAt returns the time to report to the leader for clock skew detection.
+// Virtual clocks aren't comparable between nodes, so we don't report them.
+func (db *DB) sentAt() time.Time {
+	if db.opts.VirtualTime {
+		return time.Time{}
+	}
+	return db.clock.Now()
+}
+
+// checkClockSkew compares the time at which a follower sent a request to our
+// own clock. Followers whose clocks differ from ours retain and expire data at
+// different times than we do, so we log a warning when the skew exceeds
+// MaxClockSkew. The skew includes the time that the request spent in transit,
+// so it's approximate.
+func (db *DB) checkClockSkew(name string, partition int, sentAt time.Time) {
+	if sentAt.IsZero() || db.opts.VirtualTime {
+		return
+	}
+	skew := sentAt.Sub(db.clock.Now())
+	if name != "" {
+		metrics.FollowerClockSkew(name, skew)
+	}
+
+	db.followersMx.Lock()
+	prior, known := db.followerClockSkews[name]
+	db.followerClockSkews[name] = skew
+	db.followersMx.Unlock()
+
+	wasSkewed := known && exceedsClockSkew(prior, db.opts.MaxClockSkew)
+	isSkewed := exceedsClockSkew(skew, db.opts.MaxClockSkew)
+	if isSkewed && !wasSkewed {
+		log.Errorf("Clock of follower %d (%v) differs from ours by %v, which exceeds the maximum of %v. Please check that its time is synchronized.", partition, name, skew, db.opts.MaxClockSkew)
+	} else if wasSkewed && !isSkewed {
+		log.Debugf("Clock of follower %d (%v) is back in sync, differs from ours by %v", partition, name, skew)
+	}
+}
+
+func exceedsClockSkew(skew time.Duration, max time.Duration) bool {
+	return skew > max || skew < -max
+}
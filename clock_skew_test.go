@@ -0,0 +1,48 @@
+package zenodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockSkew(t *testing.T) {
+	now := time.Now()
+	clock := vtime.NewVirtualClock(now)
+	db, err := NewDB(&DBOpts{Clock: clock, MaxClockSkew: 5 * time.Second})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	assert.Equal(t, now, db.clock.Now(), "Should use supplied clock")
+	assert.Equal(t, now, db.sentAt())
+
+	skewOf := func(name string) time.Duration {
+		for _, fs := range metrics.GetStats().Followers {
+			if fs.Name == name {
+				return fs.ClockSkew
+			}
+		}
+		return 0
+	}
+
+	metrics.FollowerJoined(1000, "skewedfollower", "inbound", 0)
+	db.checkClockSkew("skewedfollower", 0, now.Add(-1*time.Minute))
+	assert.Equal(t, -1*time.Minute, db.followerClockSkews["skewedfollower"])
+	assert.Equal(t, -1*time.Minute, skewOf("skewedfollower"))
+
+	clock.Advance(now.Add(1 * time.Second))
+	db.checkClockSkew("skewedfollower", 0, now.Add(2*time.Second))
+	assert.Equal(t, 1*time.Second, skewOf("skewedfollower"))
+
+	db.checkClockSkew("skewedfollower", 0, time.Time{})
+	assert.Equal(t, 1*time.Second, skewOf("skewedfollower"), "Followers that don't report their time shouldn't affect skew")
+	metrics.FollowerFailed(1000)
+
+	assert.True(t, exceedsClockSkew(6*time.Second, 5*time.Second))
+	assert.True(t, exceedsClockSkew(-6*time.Second, 5*time.Second))
+	assert.False(t, exceedsClockSkew(-5*time.Second, 5*time.Second))
+}
@@ -1,16 +1,22 @@
 package zenodb
 
 import (
+	"context"
 	"fmt"
 	"github.com/dustin/go-humanize"
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/errors"
 	"github.com/getlantern/goexpr"
-	"github.com/getlantern/wal"
 	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/compress"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/encryption"
 	"github.com/getlantern/zenodb/metrics"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/oxtoacart/bpool"
 	"github.com/spaolacci/murmur3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"hash"
 	"runtime"
 	"sort"
@@ -20,69 +26,194 @@ import (
 	"time"
 )
 
+const (
+	followerReportInterval = 1 * time.Second
+)
+
 var (
 	errCanceled = fmt.Errorf("following canceled")
 )
 
+// walEntry is an entry read from the WAL for followers. The same entry (and
+// hence the same backing bytes) is delivered to all followers that need it.
+// Each delivery holds a reference to it, and once all references have been
+// released, data goes back to the pool from which it came (if any).
 type walEntry struct {
 	stream string
 	data   []byte
 	offset wal.Offset
+	refs   int32
+	pool   *bpool.BytePool
+}
+
+// newWALEntry creates an entry that's referenced once by its creator.
+func newWALEntry(stream string, data []byte, offset wal.Offset, pool *bpool.BytePool) *walEntry {
+	return &walEntry{stream: stream, data: data, offset: offset, refs: 1, pool: pool}
+}
+
+func (e *walEntry) retain() {
+	atomic.AddInt32(&e.refs, 1)
+}
+
+func (e *walEntry) Data() []byte       { return e.data }
+func (e *walEntry) Offset() wal.Offset { return e.offset }
+func (e *walEntry) Retain()            { e.retain() }
+func (e *walEntry) Release()           { e.release() }
+
+// release releases a reference to the entry, returning its data to the pool
+// once nothing references it anymore. The entry's data must not be used after
+// releasing it.
+func (e *walEntry) release() {
+	refs := atomic.AddInt32(&e.refs, -1)
+	if refs == 0 && e.pool != nil {
+		e.pool.Put(e.data)
+	} else if refs < 0 {
+		log.Errorf("Entry at %v released more often than retained", e.offset)
+	}
 }
 
 type followSpec struct {
 	followerID int
 	offset     wal.Offset
+	// filter is the additional filter that the follower requested for the
+	// table, if any
+	filter       goexpr.Expr
+	filterString string
 }
 
 type follower struct {
 	common.Follow
 	followerId int
-	cb         func(data []byte, offset wal.Offset) error
+	cb         func(entry common.FollowEntry) error
 	entries    chan *walEntry
 	hasFailed  int32
+	closeOnce  sync.Once
 }
 
 func (f *follower) read() {
+	var lastReported time.Time
 	for entry := range f.entries {
 		if f.failed() {
+			entry.release()
 			continue
 		}
 		// TODO: don't hardcode this
 		if len(entry.data) > 2000000 {
 			log.Debugf("Discarding entry greater than 2 MB")
+			entry.release()
 			continue
 		}
-		err := f.cb(entry.data, entry.offset)
+		err := f.cb(entry)
+		entry.release()
 		if err != nil {
 			log.Errorf("Error on following for follower %d: %v", f.PartitionNumber, err)
 			f.markFailed()
+			continue
+		}
+		// Report progress periodically to avoid contention on metrics, but always
+		// report once we've caught up so that the reported offset isn't stale
+		if now := time.Now(); !f.failed() && (len(f.entries) == 0 || now.Sub(lastReported) > followerReportInterval) {
+			metrics.FollowerSent(f.followerId, entry.offset)
+			lastReported = now
 		}
 	}
 }
 
+// submit queues the given entry for the follower, taking a reference to it
+// that's released once the follower is done with it. This blocks while the
+// follower's buffer is full. Followers that use credit-based flow control are
+// fed from WAL readers of their own (see followerJoinedWithCredits), so this
+// pauses reading the WAL for them until they grant more credits.
 func (f *follower) submit(entry *walEntry) {
 	if f.failed() {
-		close(f.entries)
+		f.closeEntries()
 		return
 	}
-	f.entries <- entry
+	entry.retain()
+	select {
+	case f.entries <- entry:
+		// okay
+	default:
+		if f.Credits > 0 {
+			log.Debugf("Follower %d (%v) out of credits with %d entries buffered, pausing", f.PartitionNumber, f.FollowerName, len(f.entries))
+			metrics.FollowerOutOfCredits(f.followerId)
+		}
+		f.entries <- entry
+	}
+}
+
+// closeEntries closes the follower's entries, which may happen both when
+// sending to it and when it reconnects.
+func (f *follower) closeEntries() {
+	f.closeOnce.Do(func() {
+		close(f.entries)
+	})
 }
 
 func (f *follower) markFailed() {
-	atomic.StoreInt32(&f.hasFailed, 1)
-	metrics.FollowerFailed(f.followerId)
+	// Only report once, since a follower that reconnected reuses the followerId
+	if atomic.CompareAndSwapInt32(&f.hasFailed, 0, 1) {
+		metrics.FollowerFailed(f.followerId)
+	}
 }
 
 func (f *follower) failed() bool {
 	return atomic.LoadInt32(&f.hasFailed) == 1
 }
 
-func (db *DB) Follow(f *common.Follow, cb func([]byte, wal.Offset) error) {
-	go db.processFollowersOnce.Do(db.processFollowers)
-	fol := &follower{Follow: *f, cb: cb, entries: make(chan *walEntry, 1000000)} // TODO: make this buffer tunable
-	db.followerJoined <- fol
+// Follow follows the stream identified by f, sending all entries relevant to
+// the follower to cb. This blocks until the follower fails or is revoked.
+// The data passed to cb is shared with other followers and recycled once cb
+// returns, so cb has to copy it if it needs it for longer.
+func (db *DB) Follow(f *common.Follow, cb func([]byte, wal.Offset) error) error {
+	return db.FollowEntries(f, func(entry common.FollowEntry) error {
+		return cb(entry.Data(), entry.Offset())
+	})
+}
+
+// FollowEntries is like Follow, but passes cb the entries themselves, which cb
+// can retain to hold on to their data without copying it.
+func (db *DB) FollowEntries(f *common.Follow, cb func(common.FollowEntry) error) (err error) {
+	_, span := common.StartSpan(common.ExtractTraceContext(context.Background(), f.TraceContext), "zenodb.follow", trace.WithAttributes(
+		attribute.String("zenodb.stream", f.Stream),
+		attribute.String("zenodb.follower", f.FollowerName),
+		attribute.Int("zenodb.partition", f.PartitionNumber),
+	))
+	defer func() {
+		common.EndSpan(span, err)
+	}()
+
+	if db.FollowerRevoked(f.FollowerName) {
+		return ErrFollowerRevoked
+	}
+	if err := db.checkLeader(f); err != nil {
+		return err
+	}
+	if err := db.checkPartitioning(f); err != nil {
+		return err
+	}
+	if err := db.checkFollowedTables(f); err != nil {
+		return err
+	}
+	db.checkClockSkew(f.FollowerName, f.PartitionNumber, f.SentAt)
+	db.translateFollow(f)
+	db.applyFollowerAcks(f)
+	followerJoined := db.followerJoinedFor(f.PartitionNumber)
+	bufferSize := db.followQueueDepth()
+	if f.Credits > 0 {
+		followerJoined = db.followerJoinedWithCredits()
+		defer close(followerJoined)
+		bufferSize = f.Credits
+	}
+	fol := &follower{Follow: *f, cb: cb, entries: make(chan *walEntry, bufferSize)}
+	db.trackFollower(fol)
+	defer db.untrackFollower(fol)
+	followerJoined <- fol
 	fol.read()
+	if db.FollowerRevoked(f.FollowerName) {
+		return ErrFollowerRevoked
+	}
+	return nil
 }
 
 type tableSpec struct {
@@ -96,10 +227,13 @@ type partitionSpec struct {
 	tables map[string]*tableSpec
 }
 
-func (db *DB) processFollowers() {
-	log.Debug("Starting to process followers")
+// processFollowers feeds the followers that join on followerJoined from WAL
+// readers named with the given readerSuffix. It stops the WAL readers and
+// returns once followerJoined is closed.
+func (db *DB) processFollowers(followerJoined chan *follower, readerSuffix string) {
+	log.Debugf("Starting to process followers%v", readerSuffix)
+	defer log.Debugf("Stopped processing followers%v", readerSuffix)
 
-	nextFollowerID := 0
 	followers := make(map[int]*follower)
 	streams := make(map[string]map[string]*partitionSpec)
 	stopWALReaders := make(map[string]func())
@@ -108,14 +242,32 @@ func (db *DB) processFollowers() {
 	stats := make([]int, db.opts.NumPartitions)
 	statsInterval := 1 * time.Minute
 	statsTicker := time.NewTicker(statsInterval)
+	defer statsTicker.Stop()
 
 	newlyJoinedStreams := make(map[string]bool)
 	onFollowerJoined := func(f *follower) {
-		nextFollowerID++
-		f.followerId = nextFollowerID
-		metrics.FollowerJoined(nextFollowerID, f.PartitionNumber)
-		log.Debugf("Follower joined: %d -> %d", nextFollowerID, f.PartitionNumber)
-		followers[nextFollowerID] = f
+		identity := followerIdentity(&f.Follow)
+		followerID, reconnected := db.followerIDFor(identity)
+		if reconnected {
+			if old := followers[followerID]; old != nil {
+				// Clean up the prior registration right away rather than waiting for
+				// sending to it to fail
+				log.Debugf("Follower %d (%v) reconnected, removing prior registration", followerID, f.FollowerName)
+				old.markFailed()
+				old.closeEntries()
+				delete(followers, followerID)
+				removeFollowSpecs(streams[old.Stream], followerID)
+			}
+		}
+		f.followerId = followerID
+		metrics.FollowerJoined(followerID, f.FollowerName, f.Stream, f.PartitionNumber)
+		skipped := db.missingTables(&f.Follow)
+		if len(skipped) > 0 {
+			log.Errorf("Tables %v requested by %d (%v) not found, not including from WAL", strings.Join(skipped, ", "), f.PartitionNumber, f.FollowerName)
+		}
+		metrics.FollowerSkippedTables(followerID, skipped)
+		log.Debugf("Follower joined: %d (%v) -> %d", followerID, f.FollowerName, f.PartitionNumber)
+		followers[followerID] = f
 
 		partitions := streams[f.Stream]
 		if partitions == nil {
@@ -131,11 +283,12 @@ func (db *DB) processFollowers() {
 				partitions[keys] = ps
 			}
 			for _, t := range partition.Tables {
+				db.recordFollowerPartitionKeys(f, t.Name, sortedKeys)
 				table := ps.tables[t.Name]
 				if table == nil {
 					tb := db.getTable(t.Name)
 					if tb == nil {
-						log.Errorf("Table %v requested by %d not found, not including from WAL", t.Name, f.PartitionNumber)
+						// skipped
 						continue
 					}
 					where := tb.Where
@@ -155,7 +308,8 @@ func (db *DB) processFollowers() {
 				if f.EarliestOffset.After(offset) {
 					offset = f.EarliestOffset
 				}
-				specs = append(specs, &followSpec{followerID: nextFollowerID, offset: offset})
+				filter, filterString := parseFollowFilter(f, t.Name, t.Filter)
+				specs = append(specs, &followSpec{followerID: followerID, offset: offset, filter: filter, filterString: filterString})
 				table.followers[f.PartitionNumber] = specs
 			}
 		}
@@ -168,7 +322,22 @@ func (db *DB) processFollowers() {
 
 	for {
 		select {
-		case f := <-db.followerJoined:
+		case f, more := <-followerJoined:
+			if !more {
+				for _, stopWALReader := range stopWALReaders {
+					stopWALReader()
+				}
+				if requests != nil {
+					close(requests)
+					// Release whatever is still being processed
+					go func() {
+						for result := range results {
+							result.entry.release()
+						}
+					}()
+				}
+				return
+			}
 			// Make a copy of streams to avoid modifying old ones
 			streamsCopy := make(map[string]map[string]*partitionSpec, len(streams))
 			for stream, partitions := range streams {
@@ -205,7 +374,10 @@ func (db *DB) processFollowers() {
 		extraFollowersLoop:
 			for {
 				select {
-				case f := <-db.followerJoined:
+				case f, more := <-followerJoined:
+					if !more {
+						break extraFollowersLoop
+					}
 					onFollowerJoined(f)
 				default:
 					break extraFollowersLoop
@@ -232,7 +404,7 @@ func (db *DB) processFollowers() {
 				}
 
 				// Start following wal
-				stopWALReader, err := db.followWAL(stream, earliestOffset, streams[stream], requests)
+				stopWALReader, err := db.followWAL(stream, readerSuffix, earliestOffset, streams[stream], requests)
 				if err != nil {
 					log.Errorf("Unable to start following wal: %v", err)
 					continue
@@ -261,6 +433,9 @@ func (db *DB) processFollowers() {
 					wherePassed := pr.wherePassed[tableName]
 					if wherePassed {
 						for _, spec := range specs {
+							if spec.filter != nil && !pr.filterPassed[spec.filterString] {
+								continue
+							}
 							if offset.After(spec.offset) {
 								includedFollowers = append(includedFollowers, spec.followerID)
 							}
@@ -286,13 +461,16 @@ func (db *DB) processFollowers() {
 					lastIncluded = included
 					f := followers[included]
 					if f.failed() {
-						// ignore failed followers
+						// disconnect failed followers, for example ones that were revoked
+						f.closeEntries()
 						continue
 					}
 					f.submit(entry)
 					stats[f.PartitionNumber]++
 				}
 			}
+			// Followers hold their own references to the entry
+			entry.release()
 
 		case <-statsTicker.C:
 			for partition, count := range stats {
@@ -300,6 +478,11 @@ func (db *DB) processFollowers() {
 			}
 			stats = make([]int, db.opts.NumPartitions)
 
+			underReplicated := metrics.GetStats().Leader.UnderReplicatedPartitions
+			if len(underReplicated) > 0 {
+				log.Debugf("Partitions with fewer than %d followers: %v", db.opts.ReplicationFactor, underReplicated)
+			}
+
 			for _, f := range followers {
 				queued := int64(len(f.entries))
 				metrics.QueuedForFollower(f.followerId, int(queued))
@@ -309,6 +492,58 @@ func (db *DB) processFollowers() {
 	}
 }
 
+// followerIDFor returns the id of the follower with the given identity (see
+// followerIdentity), assigning a new one unless the follower has been seen
+// before. Ids are unique across all processors of followers, so that they can
+// key the follower metrics, and followers that have a persistent identity keep
+// their id when they reconnect, even if they're processed by a different
+// processor.
+func (db *DB) followerIDFor(identity string) (int, bool) {
+	db.followerIDsMx.Lock()
+	defer db.followerIDsMx.Unlock()
+	followerID, found := db.followerIDs[identity]
+	if found {
+		return followerID, true
+	}
+	followerID = int(atomic.AddInt32(&db.lastFollowerID, 1))
+	if identity != "" {
+		if db.followerIDs == nil {
+			db.followerIDs = make(map[string]int)
+		}
+		db.followerIDs[identity] = followerID
+	}
+	return followerID, false
+}
+
+// followerIdentity identifies a follower's registration for a given stream and
+// partition across reconnects, or returns "" if the follower doesn't have a
+// persistent id.
+func followerIdentity(f *common.Follow) string {
+	if f.FollowerID == "" {
+		return ""
+	}
+	return fmt.Sprintf("%v|%v|%d", f.FollowerID, f.Stream, f.PartitionNumber)
+}
+
+// removeFollowSpecs removes the given follower from the tables of the given
+// partitions. The slices of specs may be shared with prior copies of the
+// partitions, so they're replaced rather than modified.
+func removeFollowSpecs(partitions map[string]*partitionSpec, followerID int) {
+	for _, partition := range partitions {
+		for _, table := range partition.tables {
+			for pid, specs := range table.followers {
+				remaining := make([]*followSpec, 0, len(specs))
+				for _, spec := range specs {
+					if spec.followerID != followerID {
+						remaining = append(remaining, spec)
+					}
+				}
+				table.followers[pid] = remaining
+			}
+		}
+	}
+}
+
 type partitionRequest struct {
 	partitions map[string]*partitionSpec
 	entry      *walEntry
@@ -322,6 +557,8 @@ type partitionsResult struct {
 type partitionResult struct {
 	pid         int
 	wherePassed map[string]bool
+	// filterPassed holds the results of followers' filters, keyed by filter
+	filterPassed map[string]bool
 }
 
 type partitionsResultsByOffset []*partitionsResult
@@ -392,12 +629,13 @@ requestsLoop:
 
 func (db *DB) mapPartitionRequests(in chan *partitionRequest, mapped chan *partitionsResult) {
 	h := partitionHash()
+	wc := newWhereCache()
 	for req := range in {
-		db.mapPartitionRequest(h, req, mapped)
+		db.mapPartitionRequest(h, wc, req, mapped)
 	}
 }
 
-func (db *DB) mapPartitionRequest(h hash.Hash32, req *partitionRequest, mapped chan *partitionsResult) {
+func (db *DB) mapPartitionRequest(h hash.Hash32, wc *whereCache, req *partitionRequest, mapped chan *partitionsResult) {
 	defer func() {
 		p := recover()
 		if p != nil {
@@ -430,12 +668,22 @@ func (db *DB) mapPartitionRequest(h hash.Hash32, req *partitionRequest, mapped c
 			if len(specs) == 0 {
 				continue
 			}
-			wherePassed, found := whereResults[table.whereString]
-			if !found {
-				wherePassed = table.where == nil || table.where.Eval(dims).(bool)
-				whereResults[table.whereString] = wherePassed
-			}
+			wherePassed := wc.wherePassed(table, dims, whereResults)
 			pr.wherePassed[tableName] = wherePassed
+			if !wherePassed {
+				continue
+			}
+			for _, spec := range specs {
+				if spec.filter == nil {
+					continue
+				}
+				if pr.filterPassed == nil {
+					pr.filterPassed = make(map[string]bool)
+				}
+				if _, found := pr.filterPassed[spec.filterString]; !found {
+					pr.filterPassed[spec.filterString] = wc.passed(spec.filter, spec.filterString, dims, whereResults)
+				}
+			}
 		}
 	}
 
@@ -458,7 +706,7 @@ func (db *DB) reducePartitionRequests(parallelism int, mapped chan *partitionsRe
 	close(results)
 }
 
-func (db *DB) followWAL(stream string, offset wal.Offset, partitions map[string]*partitionSpec, requests chan *partitionRequest) (func(), error) {
+func (db *DB) followWAL(stream string, readerSuffix string, offset wal.Offset, partitions map[string]*partitionSpec, requests chan *partitionRequest) (func(), error) {
 	var w *wal.WAL
 	db.tablesMutex.RLock()
 	w = db.streams[stream]
@@ -468,7 +716,8 @@ func (db *DB) followWAL(stream string, offset wal.Offset, partitions map[string]
 	}
 
 	log.Debugf("Following %v starting at %v", stream, offset)
-	r, err := w.NewReader(fmt.Sprintf("clusterfollower.%v", stream), offset, db.walBuffers.Get)
+	readerName := fmt.Sprintf("clusterfollower.%v%v", stream, readerSuffix)
+	r, err := w.NewReader(readerName, offset, db.walBuffers.Get)
 	if err != nil {
 		return nil, errors.New("Unable to open wal reader for %v", stream)
 	}
@@ -494,23 +743,48 @@ func (db *DB) followWAL(stream string, offset wal.Offset, partitions map[string]
 				// Ignore empty data
 				continue
 			}
+			pool := db.walBuffers
+			if encryption.IsEncrypted(data) || compress.IsCompressed(data) {
+				plaintext, openErr := db.openWALEntry(data)
+				// recycle the encrypted or compressed buffer, the plaintext doesn't
+				// come from the pool
+				db.walBuffers.Put(data)
+				if openErr != nil {
+					log.Errorf("Unable to decrypt entry from stream '%v', skipping: %v", stream, openErr)
+					continue
+				}
+				data = plaintext
+				pool = nil
+			}
 			offset := r.Offset()
 			metrics.CurrentlyReadingWAL(offset)
+			entry := newWALEntry(stream, data, offset, pool)
 			select {
-			case requests <- &partitionRequest{partitions, &walEntry{stream: stream, data: data, offset: offset}}:
+			case requests <- &partitionRequest{partitions, entry}:
 				// okay
 			case <-stop:
+				entry.release()
 				return
 			}
 		}
 	}()
 
-	return func() {
-		atomic.StoreInt32(&stopped, 1)
-		stop <- true
-		r.Close()
-		<-finished
-	}, nil
+	var stopOnce sync.Once
+	stopReader := func() {
+		stopOnce.Do(func() {
+			atomic.StoreInt32(&stopped, 1)
+			stop <- true
+			r.Close()
+			<-finished
+			db.followerWALReadersMx.Lock()
+			delete(db.followerWALReaders, readerName)
+			db.followerWALReadersMx.Unlock()
+		})
+	}
+	db.followerWALReadersMx.Lock()
+	db.followerWALReaders[readerName] = stopReader
+	db.followerWALReadersMx.Unlock()
+	return stopReader, nil
 }
 
 type tableWithOffset struct {
@@ -522,6 +796,7 @@ func (db *DB) followLeader(stream string, newSubscriber chan *tableWithOffset) {
 	// Wait a little while for database to initialize
 	timer := time.NewTimer(30 * time.Second)
 	var tables []*table
+	var tablesMx sync.RWMutex
 	var offsets []wal.Offset
 	partitions := make(map[string]*common.Partition)
 
@@ -537,7 +812,9 @@ waitForTables:
 		case subscriber := <-newSubscriber:
 			table := subscriber.t
 			offset := subscriber.o
+			tablesMx.Lock()
 			tables = append(tables, table)
+			tablesMx.Unlock()
 			offsets = append(offsets, offset)
 			partitionKeysString, partitionKeys := sortedPartitionKeys(table.PartitionBy)
 			partition := partitions[partitionKeysString]
@@ -550,18 +827,29 @@ waitForTables:
 			partition.Tables = append(partition.Tables, &common.PartitionTable{
 				Name:   table.Name,
 				Offset: offset,
+				Filter: table.getFollowFilter(),
 			})
 			// Got some tables, don't wait as long this time
 			timer.Reset(1 * time.Second)
 		}
 	}
 
+	if db.opts.AckFollow != nil && db.opts.FollowerName != "" {
+		go db.ackFollowLoop(stream, func() []*table {
+			tablesMx.RLock()
+			defer tablesMx.RUnlock()
+			return tables
+		})
+	}
+
 	for {
-		cancel := make(chan bool, 100)
+		cancel := make(chan bool)
 		go db.doFollowLeader(stream, tables, offsets, partitions, cancel)
 		subscriber := <-newSubscriber
-		cancel <- true
+		close(cancel)
+		tablesMx.Lock()
 		tables = append(tables, subscriber.t)
+		tablesMx.Unlock()
 		offsets = append(offsets, subscriber.o)
 	}
 }
@@ -574,8 +862,21 @@ func (db *DB) doFollowLeader(stream string, tables []*table, offsets []wal.Offse
 		ins = append(ins, in)
 		go t.processInserts(in)
 	}
+	db.followingLeader(stream)
 
 	makeFollow := func() *common.Follow {
+		select {
+		case <-cancel:
+			// Stop following so that we don't reconnect under the same identity as
+			// our replacement
+			return nil
+		default:
+			// Okay to continue
+		}
+		if db.isShuttingDown() {
+			return nil
+		}
+
 		offsetMx.RLock()
 		var earliestOffset wal.Offset
 		for i, offset := range offsets {
@@ -594,11 +895,23 @@ func (db *DB) doFollowLeader(stream string, tables []*table, offsets []wal.Offse
 		}
 
 		log.Debugf("Following %v starting at %v", stream, earliestOffset)
+		db.connectingToLeader(stream)
 		return &common.Follow{
-			Stream:          stream,
-			EarliestOffset:  earliestOffset,
-			PartitionNumber: db.opts.Partition,
-			Partitions:      partitions,
+			Stream:                 stream,
+			EarliestOffset:         earliestOffset,
+			PartitionNumber:        db.opts.Partition,
+			Partitions:             partitions,
+			FollowerName:           db.opts.FollowerName,
+			FollowerToken:          db.opts.FollowerToken,
+			FollowerID:             db.followerID,
+			NumPartitions:          db.opts.NumPartitions,
+			ConsistentPartitioning: db.opts.ConsistentPartitioning,
+			Incarnation:            db.incarnation,
+			SentAt:                 db.sentAt(),
+			BatchSize:              db.opts.FollowBatchSize,
+			BatchInterval:          db.opts.FollowBatchInterval,
+			BatchCompression:       db.opts.FollowBatchCompression,
+			Credits:                db.opts.FollowCredits,
 		}
 	}
 
@@ -610,20 +923,45 @@ func (db *DB) doFollowLeader(stream string, tables []*table, offsets []wal.Offse
 		default:
 			// Okay to continue
 		}
+		if db.isShuttingDown() {
+			return errCanceled
+		}
 
+		db.receivedFromLeader(stream)
+		// data is only valid until we return, so copy it once into a buffer that
+		// all tables share and that goes back to walBuffers once they're done
+		var entry *walEntry
 		for i, in := range ins {
 			priorOffset := offsets[i]
 			if newOffset.After(priorOffset) {
-				in <- &walRead{data, newOffset}
+				if entry == nil {
+					entry = newWALEntry(stream, db.copyToWALBuffer(data), newOffset, db.walBuffers)
+				}
+				entry.retain()
+				in <- &walRead{data: entry.data, offset: newOffset, entry: entry}
 				offsetMx.Lock()
 				offsets[i] = newOffset
 				offsetMx.Unlock()
 			}
 		}
+		if entry != nil {
+			entry.release()
+		}
 		return nil
 	})
 }
 
+// copyToWALBuffer copies data into a buffer from walBuffers, if it fits.
+func (db *DB) copyToWALBuffer(data []byte) []byte {
+	buf := db.walBuffers.Get()
+	if cap(buf) < len(data) {
+		buf = make([]byte, len(data))
+	}
+	buf = buf[:len(data)]
+	copy(buf, data)
+	return buf
+}
+
 func sortedPartitionKeys(partitionKeys []string) (string, []string) {
 	if len(partitionKeys) == 0 {
 		return "", partitionKeys
@@ -642,18 +980,5 @@ func (db *DB) inPartition(h hash.Hash32, dims bytemap.ByteMap, partitionKeys []s
 }
 
 func (db *DB) partitionFor(h hash.Hash32, dims bytemap.ByteMap, partitionKeys []string) int {
-	h.Reset()
-	if len(partitionKeys) > 0 {
-		// Use specific partition keys
-		for _, partitionKey := range partitionKeys {
-			b := dims.GetBytes(partitionKey)
-			if len(b) > 0 {
-				h.Write(b)
-			}
-		}
-	} else {
-		// Use all dims
-		h.Write(dims)
-	}
-	return int(h.Sum32()) % db.opts.NumPartitions
+	return db.partitioning().partitionFor(h, dims, partitionKeys)
 }
@@ -0,0 +1,333 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/oxtoacart/bpool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFollowerReconnect(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:           tmpDir,
+		Passthrough:   true,
+		NumPartitions: 1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	follow := func(received *int64) chan error {
+		done := make(chan error, 1)
+		go func() {
+			done <- db.Follow(&common.Follow{
+				Stream:        "inbound",
+				FollowerName:  "reconnecting",
+				FollowerID:    "node1",
+				NumPartitions: 1,
+				Partitions: map[string]*common.Partition{
+					"": {Tables: []*common.PartitionTable{{Name: "test_a"}}},
+				},
+			}, func(data []byte, offset wal.Offset) error {
+				atomic.AddInt64(received, 1)
+				return nil
+			})
+		}()
+		return done
+	}
+	insertUntilReceived := func(received *int64) bool {
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"a": 1}, map[string]float64{"i": 1}))
+			if atomic.LoadInt64(received) > 0 {
+				return true
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	}
+	followerStats := func() []*metrics.FollowerStats {
+		var result []*metrics.FollowerStats
+		for _, fs := range metrics.GetStats().Followers {
+			if fs.Name == "reconnecting" {
+				result = append(result, fs)
+			}
+		}
+		return result
+	}
+
+	var received1, received2 int64
+	done1 := follow(&received1)
+	if !assert.True(t, insertUntilReceived(&received1), "first connection should have received data") {
+		return
+	}
+
+	done2 := follow(&received2)
+	if !assert.True(t, insertUntilReceived(&received2), "second connection should have received data") {
+		return
+	}
+	select {
+	case err := <-done1:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "prior connection should have been cleaned up when follower reconnected")
+	}
+	stats := followerStats()
+	if assert.Len(t, stats, 1, "reconnected follower should have reused its metrics identity") {
+		assert.False(t, stats[0].Failed)
+	}
+
+	select {
+	case <-done2:
+		assert.Fail(t, "current connection should have kept following")
+	default:
+	}
+}
+
+func TestFollowFilter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:           tmpDir,
+		Passthrough:   true,
+		NumPartitions: 1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var received, receivedOther int64
+	go db.Follow(&common.Follow{
+		Stream:        "inbound",
+		FollowerName:  "filtered",
+		FollowerID:    "filtered",
+		NumPartitions: 1,
+		Partitions: map[string]*common.Partition{
+			"": {Tables: []*common.PartitionTable{{Name: "test_a", Filter: "dim = 'a'"}}},
+		},
+	}, func(data []byte, offset wal.Offset) error {
+		atomic.AddInt64(&received, 1)
+		// Skip timestamp
+		_, remain := encoding.Read(data, encoding.Width64bits)
+		dimsLen, remain := encoding.ReadInt32(remain)
+		dims, _ := encoding.Read(remain, dimsLen)
+		if bytemap.ByteMap(dims).Get("dim") != "a" {
+			atomic.AddInt64(&receivedOther, 1)
+		}
+		return nil
+	})
+
+	// The last entry passes the filter, so once it's received, all prior
+	// entries have been either sent or filtered out
+	for _, dim := range []string{"b", "a", "b", "b", "a"} {
+		assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"dim": dim}, map[string]float64{"i": 1}))
+	}
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt64(&received) >= 2 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt64(&received))
+	assert.Zero(t, atomic.LoadInt64(&receivedOther), "leader shouldn't have sent entries that fail the filter")
+}
+
+func TestFollowerOutOfCredits(t *testing.T) {
+	f := &follower{
+		Follow:  common.Follow{Stream: "stream", Credits: 2},
+		entries: make(chan *walEntry, 2),
+	}
+	f.submit(newWALEntry("stream", nil, nil, nil))
+	f.submit(newWALEntry("stream", nil, nil, nil))
+	submitted := make(chan bool)
+	go func() {
+		f.submit(newWALEntry("stream", nil, nil, nil))
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+		assert.Fail(t, "submitting to follower that ran out of credits should have paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.False(t, f.failed(), "follower that ran out of credits shouldn't fail")
+
+	<-f.entries
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		assert.Fail(t, "submitting should have resumed once follower had room again")
+	}
+	assert.Len(t, f.entries, 2)
+	f.closeEntries()
+}
+
+func TestCreditsDontHoldUpOtherFollowers(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:           tmpDir,
+		Passthrough:   true,
+		NumPartitions: 1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	follow := func(name string, credits int, cb func(data []byte, offset wal.Offset) error) {
+		go db.Follow(&common.Follow{
+			Stream:        "inbound",
+			FollowerName:  name,
+			NumPartitions: 1,
+			Credits:       credits,
+			Partitions: map[string]*common.Partition{
+				"": {Tables: []*common.PartitionTable{{Name: "test_a"}}},
+			},
+		}, cb)
+	}
+	var received, receivedWithCredits int64
+	resume := make(chan bool)
+	follow("regular", 0, func(data []byte, offset wal.Offset) error {
+		atomic.AddInt64(&received, 1)
+		return nil
+	})
+	follow("withcredits", 1, func(data []byte, offset wal.Offset) error {
+		if atomic.AddInt64(&receivedWithCredits, 1) == 1 {
+			// Stop granting credits for a while
+			<-resume
+		}
+		return nil
+	})
+
+	waitFor := func(counter *int64, expected int64) {
+		for i := 0; i < 100; i++ {
+			if atomic.LoadInt64(counter) >= expected {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"dim": i}, map[string]float64{"i": 1}))
+	}
+	waitFor(&received, 100)
+	assert.EqualValues(t, 100, atomic.LoadInt64(&received), "follower without credits shouldn't have been held up")
+	assert.EqualValues(t, 1, atomic.LoadInt64(&receivedWithCredits))
+
+	close(resume)
+	waitFor(&receivedWithCredits, 100)
+	assert.EqualValues(t, 100, atomic.LoadInt64(&receivedWithCredits), "follower with credits should have received all entries once it resumed")
+}
+
+func TestWALEntrySharedByFollowers(t *testing.T) {
+	pool := bpool.NewBytePool(1, 4)
+	data := pool.Get()
+	copy(data, "abcd")
+	entry := newWALEntry("stream", data, nil, pool)
+
+	var received [][]byte
+	newFollower := func() *follower {
+		return &follower{
+			Follow:  common.Follow{Stream: "stream"},
+			entries: make(chan *walEntry, 1),
+			cb: func(entry common.FollowEntry) error {
+				received = append(received, entry.Data())
+				return nil
+			},
+		}
+	}
+	f1, f2 := newFollower(), newFollower()
+	f1.submit(entry)
+	f2.submit(entry)
+	entry.release()
+	returnedToPool := func() bool {
+		b := pool.Get()
+		return &b[0] == &data[0]
+	}
+	assert.False(t, returnedToPool(), "data shouldn't be returned to pool while followers still need it")
+
+	f1.closeEntries()
+	f1.read()
+	assert.False(t, returnedToPool(), "data shouldn't be returned to pool while one follower still needs it")
+
+	f2.closeEntries()
+	f2.read()
+	if assert.Len(t, received, 2) {
+		assert.Equal(t, "abcd", string(received[0]))
+		assert.True(t, &received[0][0] == &received[1][0], "followers should have received the same bytes")
+	}
+	assert.True(t, returnedToPool(), "data should have been returned to pool once all followers are done")
+
+	// A follower that retains the entry keeps its data out of the pool until it
+	// releases it
+	data = pool.Get()
+	entry = newWALEntry("stream", data, nil, pool)
+	var retained common.FollowEntry
+	f3 := &follower{
+		Follow:  common.Follow{Stream: "stream"},
+		entries: make(chan *walEntry, 1),
+		cb: func(entry common.FollowEntry) error {
+			entry.Retain()
+			retained = entry
+			return nil
+		},
+	}
+	f3.submit(entry)
+	entry.release()
+	f3.closeEntries()
+	f3.read()
+	assert.False(t, returnedToPool(), "data shouldn't be returned to pool while retained")
+	retained.Release()
+	assert.True(t, returnedToPool(), "data should have been returned to pool once released")
+}
@@ -14,49 +14,139 @@ import (
 	"github.com/getlantern/mtime"
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/metrics"
 	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/sql"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	replicaRetryInterval = 50 * time.Millisecond
+
+	// clusterResultsBufferPerPartition is how many results from each partition
+	// to buffer while the leader processes them
+	clusterResultsBufferPerPartition = 100000
 )
 
 var (
 	ErrMissingQueryHandler = errors.New("Missing query handler for partition")
 )
 
-func (db *DB) RegisterQueryHandler(partition int, query planner.QueryClusterFN) {
+type partitionFailureKey struct{}
+
+// withPartitionFailure records how a clustered query handles partitions that
+// fail or time out, see sql.Query.OnPartitionFailure.
+func withPartitionFailure(ctx context.Context, policy string) context.Context {
+	return context.WithValue(ctx, partitionFailureKey{}, policy)
+}
+
+func partitionFailureFrom(ctx context.Context) string {
+	policy, _ := ctx.Value(partitionFailureKey{}).(string)
+	if policy == "" {
+		return sql.PartitionFailurePartial
+	}
+	return policy
+}
+
+// remoteQueryHandler handles a single query for a partition on behalf of a
+// replica (follower) of that partition.
+type remoteQueryHandler struct {
+	replica string
+	query   planner.QueryClusterFN
+}
+
+// RegisterQueryHandler registers a handler for a single query against the
+// given partition, served by the named replica.
+func (db *DB) RegisterQueryHandler(partition int, replica string, query planner.QueryClusterFN) {
 	db.tablesMutex.Lock()
 	handlersCh := db.remoteQueryHandlers[partition]
 	if handlersCh == nil {
-		handlersCh = make(chan planner.QueryClusterFN, db.opts.ClusterQueryConcurrency)
+		handlersCh = make(chan *remoteQueryHandler, db.opts.ClusterQueryConcurrency*db.opts.ReplicationFactor)
 	}
 	db.remoteQueryHandlers[partition] = handlersCh
 	db.tablesMutex.Unlock()
-	handlersCh <- query
+	handlersCh <- &remoteQueryHandler{replica, query}
 }
 
-func (db *DB) remoteQueryHandlerForPartition(partition int) planner.QueryClusterFN {
+// remoteQueryHandlerForPartition returns an available handler for the given
+// partition, choosing among replicas that aren't in exclude according to their
+// weights (see SetReplicaWeight). Returns nil if no suitable handler is
+// available.
+func (db *DB) remoteQueryHandlerForPartition(partition int, exclude map[string]bool) *remoteQueryHandler {
 	db.tablesMutex.RLock()
-	defer db.tablesMutex.RUnlock()
-	select {
-	case handler := <-db.remoteQueryHandlers[partition]:
-		return handler
-	default:
+	handlersCh := db.remoteQueryHandlers[partition]
+	db.tablesMutex.RUnlock()
+
+	var candidates []*remoteQueryHandler
+	var skipped []*remoteQueryHandler
+	defer func() {
+		// Return skipped handlers so that other queries can use them
+		for _, handler := range skipped {
+			select {
+			case handlersCh <- handler:
+			default:
+				log.Debugf("No room to return query handler for partition %d from %v, discarding", partition, handler.replica)
+			}
+		}
+	}()
+
+	// Take all available handlers so that we can choose among them
+	for i := len(handlersCh); i > 0; i-- {
+		var handler *remoteQueryHandler
+		select {
+		case handler = <-handlersCh:
+		default:
+		}
+		if handler == nil {
+			break
+		}
+		if exclude[handler.replica] {
+			skipped = append(skipped, handler)
+		} else {
+			candidates = append(candidates, handler)
+		}
+	}
+	if len(candidates) == 0 {
 		return nil
 	}
+
+	chosen, weight := db.chooseQueryHandler(candidates)
+	handler := candidates[chosen]
+	skipped = append(skipped, candidates[:chosen]...)
+	skipped = append(skipped, candidates[chosen+1:]...)
+	metrics.QueryDispatched(partition, handler.replica, weight)
+	return handler
 }
 
 func (db *DB) queryForRemote(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (result interface{}, err error) {
-	source, prepareErr := db.Query(sqlString, isSubQuery, subQueryResults, common.ShouldIncludeMemStore(ctx))
+	// Remote queries are cancelled by the leader through ctx, so they don't need
+	// to be cancellable with CancelQuery
+	planning := planTiming{start: time.Now()}
+	source, limits, _, prepareErr := db.query(sqlString, isSubQuery, subQueryResults, common.ShouldIncludeMemStore(ctx))
 	if prepareErr != nil {
+		prepareErr = common.ErrorWithRequestID(ctx, prepareErr)
 		log.Errorf("Error on preparing query for remote: %v", prepareErr)
 		return nil, prepareErr
 	}
+	planning.end = time.Now()
 	elapsed := mtime.Stopwatch()
 	defer func() {
 		log.Debugf("Processed query in %v, error?: %v : %v", elapsed(), err, sqlString)
 	}()
-	if unflat {
-		result, err = core.UnflattenOptimized(source).Iterate(ctx, onFields, onRow)
-	} else {
-		result, err = source.Iterate(ctx, onFields, onFlatRow)
+	if common.CallerFor(ctx) == "" {
+		ctx = common.WithCaller(ctx, "leader")
+	}
+	result, err = db.iterateWithLimits(ctx, sqlString, planning, limits, func(ctx context.Context) (interface{}, error) {
+		if unflat {
+			return core.UnflattenOptimized(source).Iterate(ctx, onFields, onRow)
+		}
+		return source.Iterate(ctx, onFields, onFlatRow)
+	})
+	if _, limited := err.(*QueryLimitError); limited {
+		// The partial results are still good, the leader learns about the limit
+		// from the stats
+		err = nil
 	}
 	return
 }
@@ -70,13 +160,14 @@ type remoteResult struct {
 	totalRows     int
 	elapsed       time.Duration
 	highWaterMark int64
+	stats         *common.QueryStats
 	err           error
 }
 
 func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
 	ctx = common.WithIncludeMemStore(ctx, includeMemStore)
 	numPartitions := db.opts.NumPartitions
-	results := make(chan *remoteResult, numPartitions*100000) // TODO: make this tunable
+	results := make(chan *remoteResult, numPartitions*clusterResultsBufferPerPartition) // TODO: make this tunable
 	resultsByPartition := make(map[int]*int64)
 
 	stats := &common.QueryStats{NumPartitions: numPartitions}
@@ -112,11 +203,40 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 		missingPartitions[partition] = true
 	}
 
+	_stopped := int64(0)
+	stopped := func() bool {
+		return atomic.LoadInt64(&_stopped) == 1
+	}
+	stop := func() {
+		atomic.StoreInt64(&_stopped, 1)
+	}
+
+	// Each partition enforces the query's limits on its own, usage adds up what
+	// they used so that the limits also apply to the query as a whole.
+	usage := queryUsageFrom(ctx)
 	finish := func(result *remoteResult) {
 		finalMx.Lock()
 		defer finalMx.Unlock()
+		partial := false
+		if result.stats != nil {
+			stats.RowsScanned += result.stats.RowsScanned
+			stats.EstimatedMemory += result.stats.EstimatedMemory
+			if result.stats.LimitExceeded != "" {
+				log.Debugf("Partition %d exceeded %v", result.partition, result.stats.LimitExceeded)
+				stats.LimitExceeded = result.stats.LimitExceeded
+				partial = true
+			}
+			if usage != nil && !usage.scannedRemotely(result.stats) {
+				// No point in waiting for the remaining partitions, the results are
+				// partial anyway
+				log.Debugf("Query exceeded %v after partition %d", usage.limitExceeded(), result.partition)
+				stop()
+			}
+		}
 		if result.err == nil {
-			stats.NumSuccessfulPartitions++
+			if !partial {
+				stats.NumSuccessfulPartitions++
+			}
 			if stats.LowestHighWaterMark == 0 || stats.LowestHighWaterMark > result.highWaterMark {
 				stats.LowestHighWaterMark = result.highWaterMark
 			}
@@ -126,17 +246,13 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 		}
 	}
 
-	_stopped := int64(0)
-	stopped := func() bool {
-		return atomic.LoadInt64(&_stopped) == 1
-	}
-	stop := func() {
-		atomic.StoreInt64(&_stopped, 1)
-	}
+	policy := partitionFailureFrom(ctx)
+	retry := policy == sql.PartitionFailureRetry
+	wait := policy == sql.PartitionFailureWait
 
 	subCtx := ctx
 	ctxDeadline, ctxHasDeadline := subCtx.Deadline()
-	if ctxHasDeadline {
+	if ctxHasDeadline && !wait {
 		// Halve timeout for sub-contexts
 		now := time.Now()
 		timeout := ctxDeadline.Sub(now)
@@ -146,26 +262,95 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 		defer cancel()
 	}
 
+	start := time.Now()
+	deadline := start.Add(db.clusterQueryTimeout())
+	if ctxHasDeadline {
+		deadline = ctxDeadline
+	} else if wait {
+		// Wait for as long as it takes, or until the query is cancelled
+		deadline = time.Time{}
+	}
+	beforeDeadline := func() bool {
+		return deadline.IsZero() || time.Now().Before(deadline)
+	}
+	stallTimeout := db.opts.ReplicaStallTimeout
+	if stallTimeout <= 0 {
+		stallTimeout = DefaultReplicaStallTimeout
+	}
+
 	for i := 0; i < numPartitions; i++ {
 		partition := i
 		_resultsForPartition := int64(0)
 		resultsForPartition := &_resultsForPartition
 		resultsByPartition[partition] = resultsForPartition
 		go func() {
+			// With replicas, buffer results so that we can fail over to a different
+			// replica if one fails or stalls mid-query. When retrying, buffer too so
+			// that we can discard the results of failed attempts.
+			buffered := db.opts.ReplicationFactor > 1 || retry
+			failedReplicas := make(map[string]bool)
+			var lastErr error
 			for {
 				elapsed := mtime.Stopwatch()
-				query := db.remoteQueryHandlerForPartition(partition)
-				if query == nil {
-					log.Errorf("No query handler for partition %d, ignoring", partition)
+				if retry && len(failedReplicas) >= db.opts.ReplicationFactor {
+					// Every replica failed, try them all again
+					failedReplicas = make(map[string]bool)
+				}
+				handler := db.remoteQueryHandlerForPartition(partition, failedReplicas)
+				for handler == nil && lastErr != nil && len(failedReplicas) < db.opts.ReplicationFactor && !stopped() && finalErr() == nil && beforeDeadline() {
+					// Other replicas may be busy with other queries, wait for one to
+					// become available.
+					time.Sleep(replicaRetryInterval)
+					handler = db.remoteQueryHandlerForPartition(partition, failedReplicas)
+				}
+				waited := elapsed()
+				if usage != nil {
+					usage.waitedInParallel(waited)
+				}
+				if handler == nil {
+					err := lastErr
+					if err == nil {
+						err = ErrMissingQueryHandler
+					}
+					log.Errorf("No query handler for partition %d, ignoring: %v", partition, common.ErrorWithRequestID(ctx, err))
 					results <- &remoteResult{
 						partition: partition,
 						totalRows: 0,
 						elapsed:   elapsed(),
-						err:       ErrMissingQueryHandler,
+						err:       err,
 					}
 					break
 				}
 
+				attemptCtx, cancelAttempt := context.WithCancel(subCtx)
+				// When retrying, a stalled replica can be retried once it's available
+				// again, otherwise we can only fail over to other replicas.
+				canFailOver := buffered && !wait && (retry || len(failedReplicas) < db.opts.ReplicationFactor-1)
+				lastProgress := time.Now().UnixNano()
+				spanCtx, span := common.StartSpan(attemptCtx, "zenodb.remoteQuery", trace.WithAttributes(
+					attribute.Int("zenodb.partition", partition),
+					attribute.String("zenodb.replica", handler.replica),
+					attribute.Int64("zenodb.wait_ms", int64(waited/time.Millisecond)),
+				))
+
+				var buffer []*remoteResult
+				var bufferMx sync.Mutex
+				abandoned := false
+				emit := func(result *remoteResult) bool {
+					atomic.StoreInt64(&lastProgress, time.Now().UnixNano())
+					if !buffered {
+						results <- result
+						return true
+					}
+					bufferMx.Lock()
+					defer bufferMx.Unlock()
+					if abandoned {
+						return false
+					}
+					buffer = append(buffer, result)
+					return true
+				}
+
 				var partOnRow func(key bytemap.ByteMap, vals core.Vals) (bool, error)
 				var partOnFlatRow func(row *core.FlatRow) (bool, error)
 				if unflat {
@@ -177,10 +362,12 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 						if stopped() {
 							return false, nil
 						}
-						results <- &remoteResult{
+						if !emit(&remoteResult{
 							partition: partition,
 							key:       key,
 							vals:      vals,
+						}) {
+							return false, nil
 						}
 						atomic.AddInt64(resultsForPartition, 1)
 						return true, nil
@@ -194,31 +381,104 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 						if stopped() {
 							return false, nil
 						}
-						results <- &remoteResult{
+						if !emit(&remoteResult{
 							partition: partition,
 							flatRow:   row,
+						}) {
+							return false, nil
 						}
 						atomic.AddInt64(resultsForPartition, 1)
 						return true, nil
 					}
 				}
 
-				qstats, err := query(subCtx, sqlString, isSubQuery, subQueryResults, unflat, func(fields core.Fields) error {
-					results <- &remoteResult{
-						partition: partition,
-						fields:    fields,
+				type attemptResult struct {
+					stats interface{}
+					err   error
+				}
+				attemptDone := make(chan *attemptResult, 1)
+				go func() {
+					qstats, err := handler.query(spanCtx, sqlString, isSubQuery, subQueryResults, unflat, func(fields core.Fields) error {
+						emit(&remoteResult{
+							partition: partition,
+							fields:    fields,
+						})
+						return nil
+					}, partOnRow, partOnFlatRow)
+					attemptDone <- &attemptResult{qstats, err}
+				}()
+
+				var qstats interface{}
+				var err error
+				abandon := func(abandonErr error) {
+					// Ignore anything the replica sends from now on
+					bufferMx.Lock()
+					abandoned = true
+					bufferMx.Unlock()
+					err = abandonErr
+				}
+				var stallCheck *time.Ticker
+				var stallCheckC <-chan time.Time
+				if canFailOver {
+					stallCheck = time.NewTicker(stallTimeout / 4)
+					stallCheckC = stallCheck.C
+				}
+			waitForAttempt:
+				for {
+					select {
+					case ar := <-attemptDone:
+						qstats, err = ar.stats, ar.err
+						break waitForAttempt
+					case <-stallCheckC:
+						sinceProgress := time.Since(time.Unix(0, atomic.LoadInt64(&lastProgress)))
+						if sinceProgress >= stallTimeout {
+							abandon(fmt.Errorf("Replica %v stalled, no results for %v", handler.replica, sinceProgress))
+							break waitForAttempt
+						}
+					case <-subCtx.Done():
+						if !canFailOver {
+							// No other replica to fail over to, keep waiting for this one
+							ar := <-attemptDone
+							qstats, err = ar.stats, ar.err
+						} else {
+							abandon(fmt.Errorf("Replica %v did not respond in time: %v", handler.replica, subCtx.Err()))
+						}
+						break waitForAttempt
 					}
-					return nil
-				}, partOnRow, partOnFlatRow)
+				}
+				if stallCheck != nil {
+					stallCheck.Stop()
+				}
+				cancelAttempt()
+				span.SetAttributes(attribute.Int64("zenodb.rows", atomic.LoadInt64(resultsForPartition)))
+				common.EndSpan(span, err)
+
 				if err != nil {
+					metrics.QueryTargetFailed(partition, handler.replica)
 					switch err.(type) {
 					case common.Retriable:
 						log.Debugf("Failed on partition %d but error is retriable, continuing: %v", partition, err)
+						if buffered {
+							// The failed attempt's rows were buffered and are discarded
+							failedReplicas[handler.replica] = true
+							atomic.StoreInt64(resultsForPartition, 0)
+						}
+						lastErr = err
 						continue
 					default:
+						if buffered && finalErr() == nil && !stopped() && subCtx.Err() == nil && beforeDeadline() {
+							log.Debugf("Replica %v failed on partition %d, retrying on another replica: %v", handler.replica, partition, err)
+							failedReplicas[handler.replica] = true
+							atomic.StoreInt64(resultsForPartition, 0)
+							lastErr = err
+							continue
+						}
 						log.Debugf("Failed on partition %d and error is not retriable, will abort: %v", partition, err)
 					}
 				}
+				for _, result := range buffer {
+					results <- result
+				}
 				var highWaterMark int64
 				qs, ok := qstats.(*common.QueryStats)
 				if ok && qs != nil {
@@ -229,6 +489,7 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 					totalRows:     int(atomic.LoadInt64(resultsForPartition)),
 					elapsed:       elapsed(),
 					highWaterMark: highWaterMark,
+					stats:         qs,
 					err:           err,
 				}
 				break
@@ -236,18 +497,19 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 		}()
 	}
 
-	start := time.Now()
-	deadline := start.Add(db.opts.ClusterQueryTimeout)
-	if ctxHasDeadline {
-		deadline = ctxDeadline
-	}
-	log.Debugf("Deadline for results from partitions: %v (T - %v)", deadline, deadline.Sub(time.Now()))
+	log.Debugf("Deadline for results from partitions: %v (T - %v), on partition failure: %v", deadline, deadline.Sub(time.Now()), policy)
 
-	timeout := time.NewTimer(deadline.Sub(time.Now()))
+	var timeoutC <-chan time.Time
+	if !deadline.IsZero() {
+		timeout := time.NewTimer(deadline.Sub(time.Now()))
+		defer timeout.Stop()
+		timeoutC = timeout.C
+	}
 	var canonicalFields core.Fields
 	fieldsByPartition := make([]core.Fields, db.opts.NumPartitions)
 	partitionRowMappers := make([]func(core.Vals) core.Vals, db.opts.NumPartitions)
 	resultCount := 0
+	done := ctx.Done()
 	for pendingPartitions := numPartitions; pendingPartitions > 0; {
 		select {
 		case result := <-results:
@@ -305,14 +567,14 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 			resultCount++
 			pendingPartitions--
 			if result.err != nil {
-				log.Errorf("Error from partition %d: %v", result.partition, result.err)
+				log.Errorf("Error from partition %d: %v", result.partition, common.ErrorWithRequestID(ctx, result.err))
 				fail(result.partition, result.err)
 			}
 			finish(result)
 			log.Debugf("%d/%d got %d results from partition %d in %v", resultCount, db.opts.NumPartitions, result.totalRows, result.partition, result.elapsed)
 			delete(resultsByPartition, result.partition)
-		case <-timeout.C:
-			log.Errorf("Failed to get results by deadline, %d of %d partitions reporting", resultCount, numPartitions)
+		case <-timeoutC:
+			log.Error(common.ErrorWithRequestID(ctx, fmt.Errorf("Failed to get results by deadline, %d of %d partitions reporting", resultCount, numPartitions)))
 			msg := bytes.NewBuffer([]byte("Missing partitions: "))
 			first := true
 			for partition, results := range resultsByPartition {
@@ -324,7 +586,19 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 				fail(partition, core.ErrDeadlineExceeded)
 			}
 			log.Debug(msg.String())
+			if usage != nil {
+				// The deadline may have come from the query's duration limit
+				usage.checkDeadline(ctx)
+			}
 			return finalStats(), finalErr()
+		case <-done:
+			if ctx.Err() == context.Canceled {
+				log.Debugf("Query cancelled, %d of %d partitions reporting", resultCount, numPartitions)
+				stop()
+				return finalStats(), ctx.Err()
+			}
+			// Deadlines are handled by timeout
+			done = nil
 		}
 	}
 
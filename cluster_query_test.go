@@ -0,0 +1,267 @@
+package zenodb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/sql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterQueryFailover(t *testing.T) {
+	db := &DB{
+		opts: &DBOpts{
+			NumPartitions:           1,
+			ReplicationFactor:       2,
+			ClusterQueryConcurrency: 1,
+			ClusterQueryTimeout:     DefaultClusterQueryTimeout,
+			ReplicaStallTimeout:     500 * time.Millisecond,
+		},
+		remoteQueryHandlers: make(map[int]chan *remoteQueryHandler),
+		// Only use replica b once a has failed, so that every scenario tries a
+		// first
+		replicaWeights: map[string]float64{"b": 0},
+	}
+
+	fields := core.Fields{core.NewField("a", expr.SUM("a"))}
+	replica := func(numRows int, err error) planner.QueryClusterFN {
+		return func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
+			onFields(fields)
+			for i := 0; i < numRows; i++ {
+				onFlatRow(&core.FlatRow{
+					TS:     int64(i),
+					Key:    bytemap.New(map[string]interface{}{"i": i}),
+					Values: []float64{float64(i)},
+				})
+			}
+			return nil, err
+		}
+	}
+
+	queryWithContext := func(ctx context.Context) ([]int64, []int, error) {
+		var tss []int64
+		stats, err := db.queryCluster(ctx, "SELECT * FROM test", false, nil, false, false, core.FieldsIgnored, nil, func(row *core.FlatRow) (bool, error) {
+			tss = append(tss, row.TS)
+			return true, nil
+		})
+		return tss, stats.(*common.QueryStats).MissingPartitions, err
+	}
+	query := func() ([]int64, []int, error) {
+		return queryWithContext(context.Background())
+	}
+
+	// Replica a fails mid-query, b completes
+	db.RegisterQueryHandler(0, "a", replica(2, errors.New("connection lost")))
+	db.RegisterQueryHandler(0, "b", replica(3, nil))
+	tss, missing, err := query()
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+	assert.Equal(t, []int64{0, 1, 2}, tss, "Should have gotten only results from replica that succeeded")
+
+	// All replicas fail
+	db.RegisterQueryHandler(0, "a", replica(2, errors.New("connection lost")))
+	db.RegisterQueryHandler(0, "b", replica(1, errors.New("connection lost")))
+	tss, missing, err = query()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0}, missing)
+	assert.Empty(t, tss, "Partial results from failed replicas should have been discarded")
+
+	// Replica a fails while b is still busy, b becomes available shortly after
+	db.RegisterQueryHandler(0, "a", replica(2, errors.New("connection lost")))
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		db.RegisterQueryHandler(0, "b", replica(3, nil))
+	}()
+	tss, missing, err = query()
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+	assert.Equal(t, []int64{0, 1, 2}, tss, "Should have waited for other replica")
+
+	// Replica a stalls, b completes within the deadline
+	stall := make(chan bool)
+	defer close(stall)
+	db.RegisterQueryHandler(0, "a", func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
+		onFields(fields)
+		onFlatRow(&core.FlatRow{TS: 100, Key: bytemap.New(map[string]interface{}{"i": 100}), Values: []float64{100}})
+		<-stall
+		return nil, nil
+	})
+	db.RegisterQueryHandler(0, "b", replica(3, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	defer cancel()
+	start := time.Now()
+	tss, missing, err = queryWithContext(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+	assert.Equal(t, []int64{0, 1, 2}, tss, "Should have gotten only results from replica that responded in time")
+	assert.True(t, time.Now().Sub(start) < 2*time.Second, "Should have retried within the deadline")
+
+	// Replica a is slow but keeps making progress, so it's not abandoned
+	db.RegisterQueryHandler(0, "a", func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
+		onFields(fields)
+		for i := 0; i < 6; i++ {
+			time.Sleep(250 * time.Millisecond)
+			onFlatRow(&core.FlatRow{TS: int64(100 + i), Key: bytemap.New(map[string]interface{}{"i": 100 + i}), Values: []float64{100}})
+		}
+		return nil, nil
+	})
+	db.RegisterQueryHandler(0, "b", replica(3, nil))
+	ctx, cancel = context.WithTimeout(context.Background(), 4*time.Second)
+	defer cancel()
+	tss, missing, err = queryWithContext(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+	assert.Equal(t, []int64{100, 101, 102, 103, 104, 105}, tss, "Slow replica that keeps sending results shouldn't be abandoned")
+}
+
+func TestClusterQueryPartitionFailure(t *testing.T) {
+	db := &DB{
+		opts: &DBOpts{
+			NumPartitions:           1,
+			ReplicationFactor:       1,
+			ClusterQueryConcurrency: 1,
+			ClusterQueryTimeout:     250 * time.Millisecond,
+		},
+		remoteQueryHandlers: make(map[int]chan *remoteQueryHandler),
+	}
+
+	fields := core.Fields{core.NewField("a", expr.SUM("a"))}
+	replica := func(numRows int, delay time.Duration, err error) planner.QueryClusterFN {
+		return func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
+			onFields(fields)
+			for i := 0; i < numRows; i++ {
+				onFlatRow(&core.FlatRow{
+					TS:     int64(i),
+					Key:    bytemap.New(map[string]interface{}{"i": i}),
+					Values: []float64{float64(i)},
+				})
+			}
+			time.Sleep(delay)
+			return nil, err
+		}
+	}
+
+	query := func(policy string) ([]int64, []int, error) {
+		var tss []int64
+		stats, err := db.queryCluster(withPartitionFailure(context.Background(), policy), "SELECT * FROM test", false, nil, false, false, core.FieldsIgnored, nil, func(row *core.FlatRow) (bool, error) {
+			tss = append(tss, row.TS)
+			return true, nil
+		})
+		return tss, stats.(*common.QueryStats).MissingPartitions, err
+	}
+
+	// By default, failed partitions are missing from the results
+	db.RegisterQueryHandler(0, "a", replica(2, 0, errors.New("connection lost")))
+	tss, missing, err := query("")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0}, missing)
+	assert.Equal(t, []int64{0, 1}, tss)
+
+	// Retrying waits for the replica to become available again and discards the
+	// results of the failed attempt
+	db.RegisterQueryHandler(0, "a", replica(2, 0, errors.New("connection lost")))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		db.RegisterQueryHandler(0, "a", replica(3, 0, nil))
+	}()
+	tss, missing, err = query(sql.PartitionFailureRetry)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+	assert.Equal(t, []int64{0, 1, 2}, tss, "Should have gotten only results from the retry")
+
+	// A slow partition is missing by default
+	db.RegisterQueryHandler(0, "a", replica(3, 500*time.Millisecond, nil))
+	_, missing, err = query(sql.PartitionFailurePartial)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0}, missing)
+
+	// Waiting gives it more time than the cluster query timeout
+	db.RegisterQueryHandler(0, "a", replica(3, 500*time.Millisecond, nil))
+	tss, missing, err = query(sql.PartitionFailureWait)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+	assert.Equal(t, []int64{0, 1, 2}, tss)
+}
+
+func TestClusterQueryLimits(t *testing.T) {
+	db := &DB{
+		opts: &DBOpts{
+			NumPartitions:           3,
+			ReplicationFactor:       1,
+			ClusterQueryConcurrency: 1,
+			ClusterQueryTimeout:     DefaultClusterQueryTimeout,
+		},
+		remoteQueryHandlers: make(map[int]chan *remoteQueryHandler),
+	}
+
+	fields := core.Fields{core.NewField("a", expr.SUM("a"))}
+	stoppedEarly := make(chan bool, 1)
+	replica := func(rowsScanned int64, slow bool) planner.QueryClusterFN {
+		return func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
+			onFields(fields)
+			for i := 0; ; i++ {
+				more, _ := onFlatRow(&core.FlatRow{
+					TS:     int64(i),
+					Key:    bytemap.New(map[string]interface{}{"i": i}),
+					Values: []float64{float64(i)},
+				})
+				if !slow {
+					break
+				}
+				if !more {
+					stoppedEarly <- true
+					break
+				}
+				if i > 500 {
+					stoppedEarly <- false
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			return &common.QueryStats{RowsScanned: rowsScanned, EstimatedMemory: rowsScanned}, nil
+		}
+	}
+
+	query := func(limits queryLimits) (*common.QueryStats, error) {
+		metadata, err := db.iterateWithLimits(context.Background(), "SELECT * FROM test", planTiming{}, limits, func(ctx context.Context) (interface{}, error) {
+			return db.queryCluster(ctx, "SELECT * FROM test", false, nil, false, false, core.FieldsIgnored, nil, func(row *core.FlatRow) (bool, error) {
+				return true, nil
+			})
+		})
+		return metadata.(*common.QueryStats), err
+	}
+
+	// Each partition stays within the limit, but together they exceed it
+	db.RegisterQueryHandler(0, "a", replica(60, false))
+	db.RegisterQueryHandler(1, "b", replica(60, false))
+	db.RegisterQueryHandler(2, "c", replica(60, true))
+	stats, err := query(queryLimits{maxRowsScanned: 100})
+	limitErr, ok := err.(*QueryLimitError)
+	if assert.True(t, ok, "Query should have been limited, got error %v", err) {
+		assert.Equal(t, limitRowsScanned, limitErr.Limit)
+	}
+	assert.Equal(t, limitRowsScanned, stats.LimitExceeded)
+	assert.EqualValues(t, 180, stats.RowsScanned)
+	assert.True(t, <-stoppedEarly, "Remaining partition should have been stopped")
+
+	// Partitions' high water marks are recorded even if one of them was limited
+	db.RegisterQueryHandler(0, "a", replica(60, false))
+	db.RegisterQueryHandler(1, "b", replica(60, false))
+	db.RegisterQueryHandler(2, "c", func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
+		onFields(fields)
+		return &common.QueryStats{RowsScanned: 10, HighestHighWaterMark: 5, LimitExceeded: limitMemory}, nil
+	})
+	stats, err = query(queryLimits{})
+	assert.Error(t, err)
+	assert.Equal(t, limitMemory, stats.LimitExceeded)
+	assert.EqualValues(t, 130, stats.RowsScanned)
+	assert.EqualValues(t, 2, stats.NumSuccessfulPartitions, "Partial results shouldn't count as successful")
+	assert.EqualValues(t, 5, stats.HighestHighWaterMark)
+}
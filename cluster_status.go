@@ -0,0 +1,30 @@
+package zenodb
+
+import (
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/getlantern/zenodb/wal"
+)
+
+// ClusterStatus reports the followers connected to this leader by partition,
+// including how far each one lags behind the head of the WAL.
+func (db *DB) ClusterStatus() *metrics.ClusterStatus {
+	db.tablesMutex.RLock()
+	streams := make(map[string]*wal.WAL, len(db.streams))
+	for name, w := range db.streams {
+		streams[name] = w
+	}
+	db.tablesMutex.RUnlock()
+
+	heads := make(map[string]wal.Offset, len(streams))
+	for name, w := range streams {
+		_, head, err := w.Latest()
+		if err != nil {
+			log.Errorf("Unable to determine head of WAL for %v: %v", name, err)
+			continue
+		}
+		if head != nil {
+			heads[name] = head
+		}
+	}
+	return metrics.GetClusterStatus(heads)
+}
@@ -0,0 +1,191 @@
+// Package clustertls provides the certificate authority used for mutual TLS
+// authentication between the nodes of a zenodb cluster. Nodes that serve
+// cluster peers (leaders, replicas and replication peers) trust the cluster CA,
+// and nodes that connect to them present client certificates issued by it.
+package clustertls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// CA is a certificate authority that issues client certificates to cluster
+// nodes.
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// LoadOrCreateCA loads the CA from the given certificate and private key PEM
+// files. If neither file exists, it creates a new self-signed CA valid for the
+// given duration and saves it to those files.
+func LoadOrCreateCA(certFile string, keyFile string, validFor time.Duration) (*CA, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return createCA(certFile, keyFile, validFor)
+	}
+
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, errors.New("Unable to read cluster CA certificate from %v: %v", certFile, err)
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.New("Unable to read cluster CA key from %v: %v", keyFile, err)
+	}
+	cert, err := parseCert(certPEM)
+	if err != nil {
+		return nil, errors.New("Unable to parse cluster CA certificate from %v: %v", certFile, err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("No PEM data found in cluster CA key file %v", keyFile)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, errors.New("Unable to parse cluster CA key from %v: %v", keyFile, err)
+	}
+	return &CA{cert: cert, key: key}, nil
+}
+
+func createCA(certFile string, keyFile string, validFor time.Duration) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.New("Unable to generate cluster CA key: %v", err)
+	}
+	template, err := newTemplate("zenodb cluster CA", validFor)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, errors.New("Unable to create cluster CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.New("Unable to parse new cluster CA certificate: %v", err)
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(keyFile, keyPEM, 0600)
+	if err != nil {
+		return nil, errors.New("Unable to save cluster CA key to %v: %v", keyFile, err)
+	}
+	err = ioutil.WriteFile(certFile, encodeCert(der), 0644)
+	if err != nil {
+		return nil, errors.New("Unable to save cluster CA certificate to %v: %v", certFile, err)
+	}
+	return &CA{cert: cert, key: key}, nil
+}
+
+// Issue issues a client certificate for the named node, valid for the given
+// duration, returning the certificate and its private key as PEM.
+func (ca *CA) Issue(name string, validFor time.Duration) (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.New("Unable to generate key for %v: %v", name, err)
+	}
+	template, err := newTemplate(name, validFor)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, errors.New("Unable to issue certificate for %v: %v", name, err)
+	}
+	keyPEM, err = encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeCert(der), keyPEM, nil
+}
+
+// LoadCertPool loads the cluster CA certificate(s) from the given PEM file for
+// use in verifying the client certificates of cluster peers.
+func LoadCertPool(certFile string) (*x509.CertPool, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, errors.New("Unable to read cluster CA certificate from %v: %v", certFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		return nil, errors.New("No certificates found in %v", certFile)
+	}
+	return pool, nil
+}
+
+// Verify verifies that the given certificate chain, as presented by a peer,
+// leads to one of the CAs in the given pool and is valid for client
+// authentication. It returns the name of the node to which the certificate was
+// issued.
+func Verify(pool *x509.CertPool, chain []*x509.Certificate) (string, error) {
+	if len(chain) == 0 {
+		return "", errors.New("No client certificate presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", errors.New("Client certificate for %v not trusted: %v", chain[0].Subject.CommonName, err)
+	}
+	return chain[0].Subject.CommonName, nil
+}
+
+func newTemplate(name string, validFor time.Duration) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.New("Unable to generate serial number: %v", err)
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: name},
+		// Allow for some clock skew between nodes
+		NotBefore: now.Add(-1 * time.Hour),
+		NotAfter:  now.Add(validFor),
+	}, nil
+}
+
+func parseCert(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("No PEM data found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func encodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, errors.New("Unable to marshal private key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
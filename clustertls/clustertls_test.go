@@ -0,0 +1,69 @@
+package clustertls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIssueAndVerify(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "clustertls")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	certFile := filepath.Join(tmpDir, "ca.pem")
+	keyFile := filepath.Join(tmpDir, "cakey.pem")
+	ca, err := LoadOrCreateCA(certFile, keyFile, time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	pool, err := LoadCertPool(certFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	verify := func(ca *CA) (string, error) {
+		certPEM, keyPEM, issueErr := ca.Issue("follower1", time.Hour)
+		if !assert.NoError(t, issueErr) {
+			t.FailNow()
+		}
+		cert, parseErr := tls.X509KeyPair(certPEM, keyPEM)
+		if !assert.NoError(t, parseErr) {
+			t.FailNow()
+		}
+		leaf, parseErr := parseCert(certPEM)
+		if !assert.NoError(t, parseErr) {
+			t.FailNow()
+		}
+		assert.Len(t, cert.Certificate, 1)
+		return Verify(pool, []*x509.Certificate{leaf})
+	}
+
+	name, err := verify(ca)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "follower1", name)
+	}
+
+	reloaded, err := LoadOrCreateCA(certFile, keyFile, time.Hour)
+	if assert.NoError(t, err) {
+		_, err = verify(reloaded)
+		assert.NoError(t, err, "certificates issued by reloaded CA should be trusted")
+	}
+
+	other, err := LoadOrCreateCA(filepath.Join(tmpDir, "otherca.pem"), filepath.Join(tmpDir, "othercakey.pem"), time.Hour)
+	if assert.NoError(t, err) {
+		_, err = verify(other)
+		assert.Error(t, err, "certificates issued by another CA shouldn't be trusted")
+	}
+
+	_, err = Verify(pool, nil)
+	assert.Error(t, err, "missing certificate shouldn't be trusted")
+}
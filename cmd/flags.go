@@ -10,6 +10,7 @@ import (
 	"github.com/getlantern/goexpr/isp/maxmind"
 	"github.com/getlantern/golog"
 	tlsredis "github.com/getlantern/tlsredis"
+	"github.com/getlantern/zenodb/encryption"
 	"gopkg.in/redis.v5"
 	"strings"
 )
@@ -19,17 +20,18 @@ var (
 )
 
 var (
-	Schema          = flag.String("schema", "schema.yaml", "Location of schema file, defaults to ./schema.yaml")
-	AliasesFile     = flag.String("aliases", "", "Optionally specify the path to a file containing expression aliases in the form alias=template(%v,%v) with one alias per line")
-	EnableGeo       = flag.Bool("enablegeo", false, "enable geolocation functions")
-	ISPFormat       = flag.String("ispformat", "ip2location", "ip2location or maxmind")
-	ISPDB           = flag.String("ispdb", "", "In order to enable ISP functions, point this to a ISP database file, either in IP2Location Lite format or MaxMind GeoIP2 ISP format")
-	RedisAddr       = flag.String("redis", "", "Redis address in \"redis[s]://host:port\" format")
-	RedisCA         = flag.String("redisca", "", "Certificate for redislabs's CA")
-	RedisClientPK   = flag.String("redisclientpk", "", "Private key for authenticating client to redis's stunnel")
-	RedisClientCert = flag.String("redisclientcert", "", "Certificate for authenticating client to redis's stunnel")
-	RedisCacheSize  = flag.Int("rediscachesize", 25000, "Configures the maximum size of redis caches for HGET operations, defaults to 25,000 per hash")
-	PprofAddr       = flag.String("pprofaddr", "localhost:4000", "if specified, will listen for pprof connections at the specified tcp address")
+	Schema             = flag.String("schema", "schema.yaml", "Location of schema file, defaults to ./schema.yaml")
+	AliasesFile        = flag.String("aliases", "", "Optionally specify the path to a file containing expression aliases in the form alias=template(%v,%v) with one alias per line")
+	EnableGeo          = flag.Bool("enablegeo", false, "enable geolocation functions")
+	ISPFormat          = flag.String("ispformat", "ip2location", "ip2location or maxmind")
+	ISPDB              = flag.String("ispdb", "", "In order to enable ISP functions, point this to a ISP database file, either in IP2Location Lite format or MaxMind GeoIP2 ISP format")
+	RedisAddr          = flag.String("redis", "", "Redis address in \"redis[s]://host:port\" format")
+	RedisCA            = flag.String("redisca", "", "Certificate for redislabs's CA")
+	RedisClientPK      = flag.String("redisclientpk", "", "Private key for authenticating client to redis's stunnel")
+	RedisClientCert    = flag.String("redisclientcert", "", "Certificate for authenticating client to redis's stunnel")
+	RedisCacheSize     = flag.Int("rediscachesize", 25000, "Configures the maximum size of redis caches for HGET operations, defaults to 25,000 per hash")
+	EncryptionKeysFile = flag.String("encryptionkeys", "", "if specified, encrypt data at rest using the keys in this file, one id=hexkey per line. The key with the highest id is used for new data, add a key with a higher id to rotate.")
+	PprofAddr          = flag.String("pprofaddr", "localhost:4000", "if specified, will listen for pprof connections at the specified tcp address")
 )
 
 func StartPprof() {
@@ -43,6 +45,30 @@ func StartPprof() {
 	}
 }
 
+// EncryptionKeys returns the configured source of encryption keys, or nil if
+// encryption isn't configured.
+func EncryptionKeys() encryption.KeySource {
+	if *EncryptionKeysFile == "" {
+		return nil
+	}
+	log.Debugf("Reading encryption keys from %v", *EncryptionKeysFile)
+	return encryption.FileKeySource(*EncryptionKeysFile)
+}
+
+// Keyring returns a Keyring for the configured encryption keys, or nil if
+// encryption isn't configured.
+func Keyring() *encryption.Keyring {
+	source := EncryptionKeys()
+	if source == nil {
+		return nil
+	}
+	kr, err := encryption.NewKeyring(source)
+	if err != nil {
+		log.Fatalf("Unable to load encryption keys: %v", err)
+	}
+	return kr
+}
+
 func ISPProvider() isp.Provider {
 	if *ISPFormat == "" || *ISPDB == "" {
 		log.Debug("ISP provider not configured")
@@ -3,9 +3,12 @@ package main
 import (
 	"crypto/tls"
 	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
@@ -29,8 +32,18 @@ const (
 	emptyPrompt = "            "
 	totalLabel  = "*total*"
 
+	StatusQueryFailed       = 1
 	StatusMissingPartitions = 100
 	StatusResultsTooOld     = 101
+	StatusEmptyResults      = 102
+
+	formatText = "text"
+	formatCSV  = "csv"
+	formatJSON = "json"
+
+	// jsonTimeKey holds the row's time in JSON output, prefixed so that it
+	// doesn't collide with a dimension called time.
+	jsonTimeKey = "_time"
 )
 
 var (
@@ -45,6 +58,11 @@ var (
 	password        = flag.String("password", "", "if specified, will authenticate against server using this password")
 	allowIncomplete = flag.Bool("allowincomplete", false, "if specified, will allow incomplete results that are missing some data from 1 or more partitions")
 	maxAge          = flag.Duration("maxage", 2*time.Hour, "control how far out of date we allow results to be")
+	execute         = flag.String("e", "", "run the given statement(s), separated by ;, and then exit")
+	file            = flag.String("f", "", "run the statements in the given file, separated by ;, and then exit")
+	format          = flag.String("format", "", "the format in which to print results, one of text, csv or json (one object per line). Defaults to csv when running statements with -e, -f or as an argument and to text otherwise")
+	failOnEmpty     = flag.Bool("failonempty", false, "when running statements with -e, -f or as an argument, exit with status 102 if any of them returns no results")
+	timing          = flag.Bool("timing", false, "Set this to show how long each query took, can be toggled with \\timing")
 )
 
 func main() {
@@ -81,24 +99,51 @@ func main() {
 	}
 	defer client.Close()
 
-	if flag.NArg() == 1 {
-		// Process single command from command-line and then exit
-		sql := strings.Trim(flag.Arg(0), ";")
-		queryErr := query(os.Stdout, os.Stderr, client, sql, true)
-		if queryErr != nil {
-			if strings.HasPrefix(queryErr.Error(), "missing partitions: ") {
-				log.Error(queryErr)
-				os.Exit(StatusMissingPartitions)
-			}
-			if strings.HasPrefix(queryErr.Error(), "results age of ") {
-				log.Error(queryErr)
-				os.Exit(StatusResultsTooOld)
-			}
-			log.Fatal(queryErr)
+	if flag.NArg() >= 2 && flag.NArg() <= 5 || flag.NArg() == 1 && flag.Arg(0) == "promote" {
+		// Back up, restore, attach, detach, export, import, delete or promote and
+		// then exit
+		var cmdErr error
+		switch {
+		case flag.NArg() == 2 && flag.Arg(0) == "backup":
+			cmdErr = backup(client, flag.Arg(1))
+		case flag.NArg() == 2 && flag.Arg(0) == "restore":
+			cmdErr = restore(client, flag.Arg(1))
+		case flag.NArg() == 3 && flag.Arg(0) == "attach":
+			cmdErr = attach(client, flag.Arg(1), flag.Arg(2))
+		case flag.NArg() == 2 && flag.Arg(0) == "detach":
+			cmdErr = detach(client, flag.Arg(1))
+		case flag.NArg() == 2 && flag.Arg(0) == "exportpartitions":
+			cmdErr = exportPartitions(client, flag.Arg(1))
+		case flag.NArg() == 2 && flag.Arg(0) == "importpartitions":
+			cmdErr = importPartitions(client, flag.Arg(1))
+		case flag.Arg(0) == "delete":
+			cmdErr = deleteRows(client, flag.Args()[1:])
+		case flag.NArg() == 1:
+			cmdErr = promote(client)
+		default:
+			cmdErr = fmt.Errorf("Unknown command %v, expected backup <file>, restore <file>, attach <name> <file>, detach <name>, exportpartitions <file>, importpartitions <file>, delete <table> <where> [<asof> [<until>]] or promote", flag.Arg(0))
+		}
+		if cmdErr != nil {
+			log.Fatal(cmdErr)
 		}
 		return
 	}
 
+	statements, err := batchStatements(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if statements != nil {
+		// Run statements from the command-line and then exit
+		if *format == "" {
+			*format = formatCSV
+		}
+		os.Exit(runBatch(os.Stdout, os.Stderr, client, statements))
+	}
+	if *format == "" {
+		*format = formatText
+	}
+
 	rl, err := readline.NewEx(&readline.Config{
 		Prompt:                 basePrompt + " ",
 		HistoryFile:            historyFile,
@@ -109,25 +154,169 @@ func main() {
 	}
 	defer rl.Close()
 
+	fmt.Fprintln(os.Stderr, "Terminate statements with ;, type \\? for help")
 	var cmds []string
 	for {
 		line, err := rl.Readline()
+		if err == readline.ErrInterrupt {
+			// Ctrl+C discards the statement being edited
+			cmds = cmds[:0]
+			rl.SetPrompt(basePrompt + " ")
+			continue
+		}
 		if err != nil {
 			return
 		}
-		cmds = processLine(rl, client, cmds, line)
+		var quit bool
+		cmds, quit = processLine(rl, client, cmds, line)
+		if quit {
+			return
+		}
 	}
 }
 
-func processLine(rl *readline.Instance, client rpc.Client, cmds []string, line string) []string {
+func backup(client rpc.Client, filename string) error {
+	out, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return fmt.Errorf("Unable to create backup file: %v", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	start := time.Now()
+	err = client.Backup(context.Background(), out)
+	if err != nil {
+		return fmt.Errorf("Unable to back up: %v", err)
+	}
+	err = out.Close()
+	if err == nil {
+		err = os.Rename(out.Name(), filename)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to save backup: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Backed up to %v in %v\n", filename, time.Now().Sub(start))
+	return nil
+}
+
+func restore(client rpc.Client, filename string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("Unable to open backup file: %v", err)
+	}
+	defer in.Close()
+
+	err = client.Restore(context.Background(), in)
+	if err != nil {
+		return fmt.Errorf("Unable to restore: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Restore from %v staged, restart the server to apply it\n", filename)
+	return nil
+}
+
+func attach(client rpc.Client, name string, filename string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("Unable to open backup file: %v", err)
+	}
+	defer in.Close()
+
+	err = client.AttachBackup(context.Background(), name, in)
+	if err != nil {
+		return fmt.Errorf("Unable to attach backup: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Attached %v, query its tables as table@%v\n", filename, name)
+	return nil
+}
+
+func detach(client rpc.Client, name string) error {
+	err := client.DetachBackup(context.Background(), name)
+	if err != nil {
+		return fmt.Errorf("Unable to detach backup: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Detached %v\n", name)
+	return nil
+}
+
+// deleteRows deletes the data of a table for rows matching a WHERE clause,
+// optionally limited to the periods between the given RFC3339 times.
+func deleteRows(client rpc.Client, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("Please specify delete <table> <where> [<asof> [<until>]]")
+	}
+	var times [2]time.Time
+	for i, arg := range args[2:] {
+		ts, err := time.Parse(time.RFC3339, arg)
+		if err != nil {
+			return fmt.Errorf("Unable to parse time %v, please use RFC3339 format: %v", arg, err)
+		}
+		times[i] = ts
+	}
+	err := client.Delete(context.Background(), args[0], args[1], times[0], times[1])
+	if err != nil {
+		return fmt.Errorf("Unable to delete data: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Deleted data from %v where %v\n", args[0], args[1])
+	return nil
+}
+
+func promote(client rpc.Client) error {
+	err := client.Promote(context.Background())
+	if err != nil {
+		return fmt.Errorf("Unable to promote follower: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Promoted follower at %v\n", *addr)
+	return nil
+}
+
+func exportPartitions(client rpc.Client, filename string) error {
+	m, err := client.ExportPartitionMap(context.Background())
+	if err != nil {
+		return fmt.Errorf("Unable to export partition map: %v", err)
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode partition map: %v", err)
+	}
+	err = ioutil.WriteFile(filename, b, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to save partition map: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported partition map with %d followers from %v to %v\n", len(m.Followers), m.LeaderID, filename)
+	return nil
+}
+
+func importPartitions(client rpc.Client, filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Unable to read partition map: %v", err)
+	}
+	m := &common.PartitionMap{}
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return fmt.Errorf("Unable to decode partition map: %v", err)
+	}
+	err = client.ImportPartitionMap(context.Background(), m)
+	if err != nil {
+		return fmt.Errorf("Unable to import partition map: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Imported partition map with %d followers from %v\n", len(m.Followers), m.LeaderID)
+	return nil
+}
+
+func processLine(rl *readline.Instance, client rpc.Client, cmds []string, line string) ([]string, bool) {
 	line = strings.TrimSpace(line)
 	if len(line) == 0 {
-		return cmds
+		return cmds, false
+	}
+	if len(cmds) == 0 && strings.HasPrefix(line, "\\") {
+		rl.SaveHistory(line)
+		return cmds, processMetaCommand(rl, client, line)
 	}
 	cmds = append(cmds, line)
 	if !strings.HasSuffix(line, ";") {
 		rl.SetPrompt(emptyPrompt)
-		return cmds
+		return cmds, false
 	}
 	cmd := strings.Join(cmds, "\n")
 	rl.SaveHistory(cmd)
@@ -136,31 +325,193 @@ func processLine(rl *readline.Instance, client rpc.Client, cmds []string, line s
 	cmds = cmds[:0]
 	rl.SetPrompt(basePrompt + " ")
 
-	err := query(rl.Stdout(), rl.Stderr(), client, cmd, false)
+	runInteractive(rl, client, cmd)
+	return cmds, false
+}
+
+// processMetaCommand runs a backslash command like \dt and reports whether the
+// user asked to quit.
+func processMetaCommand(rl *readline.Instance, client rpc.Client, line string) bool {
+	args := strings.Fields(strings.TrimSuffix(line, ";"))
+	switch {
+	case args[0] == "\\q":
+		return true
+	case args[0] == "\\dt" && len(args) == 1, args[0] == "\\d" && len(args) == 1:
+		runInteractive(rl, client, "SHOW TABLES")
+	case args[0] == "\\d" && len(args) == 2:
+		runInteractive(rl, client, "DESCRIBE "+args[1])
+	case args[0] == "\\timing" && len(args) <= 2:
+		switch {
+		case len(args) == 1:
+			*timing = !*timing
+		case args[1] == "on":
+			*timing = true
+		case args[1] == "off":
+			*timing = false
+		default:
+			fmt.Fprintf(rl.Stderr(), "Expected \\timing [on|off]\n")
+			return false
+		}
+		if *timing {
+			fmt.Fprintln(rl.Stderr(), "Timing is on.")
+		} else {
+			fmt.Fprintln(rl.Stderr(), "Timing is off.")
+		}
+	case args[0] == "\\?":
+		fmt.Fprint(rl.Stderr(), `Statements can span multiple lines and are terminated with ;
+Ctrl+C discards the statement being edited, Ctrl+D quits
+
+  \dt              list tables and views
+  \d <table>       show the options, dimensions, fields and views of a table
+  \timing [on|off] toggle showing how long queries take
+  \q               quit
+  \?               show this help
+`)
+	default:
+		fmt.Fprintf(rl.Stderr(), "Unknown command %v, type \\? for help\n", line)
+	}
+	return false
+}
+
+// runInteractive runs the given query and prints its results and any error to
+// the terminal.
+func runInteractive(rl *readline.Instance, client rpc.Client, cmd string) {
+	start := time.Now()
+	_, err := query(rl.Stdout(), rl.Stderr(), client, cmd, *format)
 	if err != nil {
 		fmt.Fprintln(rl.Stderr(), err)
 	}
+	if *timing {
+		fmt.Fprintf(rl.Stderr(), "Time: %v\n", time.Since(start))
+	}
+}
+
+// batchStatements returns the statements given with -e, -f or as the only
+// argument, or nil if there are none and zeno-cli should run interactively.
+func batchStatements(args []string) ([]string, error) {
+	switch {
+	case *execute != "":
+		return splitStatements(*execute), nil
+	case *file != "":
+		b, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read statements: %v", err)
+		}
+		return splitStatements(string(b)), nil
+	case len(args) == 1:
+		return splitStatements(args[0]), nil
+	}
+	return nil, nil
+}
+
+// runBatch runs the given statements, stopping at the first that fails, and
+// returns the status with which to exit.
+func runBatch(stdout io.Writer, stderr io.Writer, client rpc.Client, statements []string) int {
+	for _, statement := range statements {
+		rows, err := query(stdout, stderr, client, statement, *format)
+		if err != nil {
+			log.Error(err)
+			switch {
+			case strings.HasPrefix(err.Error(), "missing partitions: "):
+				return StatusMissingPartitions
+			case strings.HasPrefix(err.Error(), "results age of "):
+				return StatusResultsTooOld
+			default:
+				return StatusQueryFailed
+			}
+		}
+		if rows == 0 && *failOnEmpty {
+			log.Errorf("No results for %v", statement)
+			return StatusEmptyResults
+		}
+	}
+	return 0
+}
 
-	return cmds
+// splitStatements splits the given text into statements separated by
+// semicolons, ignoring semicolons in quoted strings, identifiers and comments.
+// Comments are kept with their statement since they may carry hints, but
+// statements consisting only of comments are dropped.
+func splitStatements(text string) []string {
+	statements := make([]string, 0, 1)
+	var quote byte
+	start := 0
+	hasContent := false
+	add := func(end int) {
+		if hasContent {
+			statements = append(statements, strings.TrimSpace(text[start:end]))
+		}
+		start = end + 1
+		hasContent = false
+	}
+	// skipPast returns the index of the last byte of the first end at or after
+	// i, or of the last byte of text if there's none
+	skipPast := func(i int, end string) int {
+		idx := strings.Index(text[i:], end)
+		if idx < 0 {
+			return len(text) - 1
+		}
+		return i + idx + len(end) - 1
+	}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			hasContent = true
+		case strings.HasPrefix(text[i:], "--"):
+			i = skipPast(i+2, "\n")
+		case strings.HasPrefix(text[i:], "/*"):
+			i = skipPast(i+2, "*/")
+		case c == ';':
+			add(i)
+		case !strings.ContainsRune(" \t\r\n", rune(c)):
+			hasContent = true
+		}
+	}
+	add(len(text))
+	return statements
 }
 
-func query(stdout io.Writer, stderr io.Writer, client rpc.Client, sql string, csv bool) error {
+// query runs the given statement, prints its results to stdout in the given
+// format and returns the number of rows that it returned.
+func query(stdout io.Writer, stderr io.Writer, client rpc.Client, sql string, format string) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
 	defer cancel()
 	md, iterate, err := client.Query(ctx, sql, *fresh)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	rows := 0
+	countingIterate := func(onRow core.OnFlatRow) (*common.QueryStats, error) {
+		return iterate(func(row *core.FlatRow) (bool, error) {
+			rows++
+			return onRow(row)
+		})
 	}
 
 	now := time.Now()
 	var stats *common.QueryStats
-	if csv {
-		stats, err = dumpCSV(stdout, md, iterate)
-	} else {
-		stats, err = dumpPlainText(stdout, sql, md, iterate)
+	switch format {
+	case formatCSV:
+		stats, err = dumpCSV(stdout, md, countingIterate)
+	case formatJSON:
+		stats, err = dumpJSON(stdout, md, countingIterate)
+	case formatText:
+		stats, err = dumpPlainText(stdout, sql, md, countingIterate)
+	default:
+		return 0, fmt.Errorf("Unknown format %v, expected text, csv or json", format)
 	}
 
 	if err == nil {
+		for _, warning := range stats.Warnings {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", warning)
+		}
 		if !*allowIncomplete && stats.NumSuccessfulPartitions < stats.NumPartitions {
 			err = fmt.Errorf("missing partitions: %v", stats.MissingPartitions)
 		} else {
@@ -170,7 +521,7 @@ func query(stdout io.Writer, stderr io.Writer, client rpc.Client, sql string, cs
 			}
 		}
 	}
-	return err
+	return rows, err
 }
 
 func dumpPlainText(stdout io.Writer, sql string, md *common.QueryMetaData, iterate func(onRow core.OnFlatRow) (*common.QueryStats, error)) (*common.QueryStats, error) {
@@ -371,6 +722,7 @@ func dumpCSV(stdout io.Writer, md *common.QueryMetaData, iterate func(onRow core
 	defer w.Flush()
 
 	numFields := numFieldsFor(md)
+	fieldTypes := fieldTypesFor(md)
 
 	i := 0
 	var knownDims []string
@@ -379,13 +731,16 @@ func dumpCSV(stdout io.Writer, md *common.QueryMetaData, iterate func(onRow core
 		rowStrings := make([]string, 0, 1+len(dims)+len(md.FieldNames))
 		rowStrings = append(rowStrings, encoding.TimeFromInt(row.TS).In(time.UTC).Format(time.RFC3339))
 		for i := range md.FieldNames {
-			var value float64
 			// if result.IsCrosstab {
 			// 	value = row.Totals[i]
 			// } else {
-			value = row.Values[i]
+			value := row.TypedValue(i, fieldTypes[i])
 			// }
-			rowStrings = append(rowStrings, fmt.Sprintf("%f", value))
+			if f, ok := value.(float64); ok {
+				rowStrings = append(rowStrings, fmt.Sprintf("%f", f))
+			} else {
+				rowStrings = append(rowStrings, fmt.Sprint(value))
+			}
 		}
 		// First add known dims
 		for _, dim := range knownDims {
@@ -485,6 +840,29 @@ func dumpCSV(stdout io.Writer, md *common.QueryMetaData, iterate func(onRow core
 	return stats, nil
 }
 
+// dumpJSON prints each row as a JSON object on its own line, with the time
+// (as _time), dimensions and fields as properties.
+func dumpJSON(stdout io.Writer, md *common.QueryMetaData, iterate func(onRow core.OnFlatRow) (*common.QueryStats, error)) (*common.QueryStats, error) {
+	printQueryStats(os.Stderr, md)
+
+	enc := json.NewEncoder(stdout)
+	fieldTypes := fieldTypesFor(md)
+	return iterate(func(row *core.FlatRow) (bool, error) {
+		obj := row.Key.AsMap()
+		obj[jsonTimeKey] = encoding.TimeFromInt(row.TS).In(time.UTC).Format(time.RFC3339)
+		for i, fieldName := range md.FieldNames {
+			value := row.TypedValue(i, fieldTypes[i])
+			if f, ok := value.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+				// not representable in JSON
+				obj[fieldName] = nil
+			} else {
+				obj[fieldName] = value
+			}
+		}
+		return true, enc.Encode(obj)
+	})
+}
+
 func nilToBlank(val interface{}) interface{} {
 	if val == nil {
 		return ""
@@ -499,6 +877,18 @@ func nilToDash(val interface{}) interface{} {
 	return val
 }
 
+// fieldTypesFor returns the type of each field (see expr.TypeOf), treating
+// fields as float64 if the server didn't send their types.
+func fieldTypesFor(md *common.QueryMetaData) []string {
+	fieldTypes := make([]string, len(md.FieldNames))
+	for i := range fieldTypes {
+		if i < len(md.Fields) && md.Fields[i] != nil {
+			fieldTypes[i] = md.Fields[i].Type
+		}
+	}
+	return fieldTypes
+}
+
 func numFieldsFor(md *common.QueryMetaData) int {
 	numFields := len(md.FieldNames)
 	// if result.IsCrosstab {
@@ -520,6 +910,7 @@ func printQueryStats(stderr io.Writer, md *common.QueryMetaData) {
 	fmt.Fprintf(stderr, "# As Of:      %v\n", md.AsOf.In(time.UTC).Format(time.RFC1123))
 	fmt.Fprintf(stderr, "# Until:      %v\n", md.Until.In(time.UTC).Format(time.RFC1123))
 	fmt.Fprintf(stderr, "# Resolution: %v\n", md.Resolution)
+	fmt.Fprintf(stderr, "# Query ID:   %v\n", md.QueryID)
 	fmt.Fprint(stderr, "\n\n")
 	fmt.Fprintln(stderr, md.Plan)
 	fmt.Fprint(stderr, "\n\n")
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/rpc"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func TestDumpTypedValues(t *testing.T) {
+	ts := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Beyond 2^53, so not exactly representable as a float64
+	const bigInt = 9007199254740993
+	row := &core.FlatRow{
+		TS:     ts.UnixNano(),
+		Key:    bytemap.New(map[string]interface{}{"dim": "a"}),
+		Values: []float64{1.5, bigInt, 1},
+		Ints:   []int64{0, bigInt, 0},
+	}
+	iterate := func(onRow core.OnFlatRow) (*common.QueryStats, error) {
+		_, err := onRow(row)
+		return &common.QueryStats{}, err
+	}
+	typed := &common.QueryMetaData{
+		FieldNames: []string{"f", "i", "b"},
+		Fields: []*common.FieldMetaData{
+			{Name: "f", Type: "float64"},
+			{Name: "i", Type: "int64"},
+			{Name: "b", Type: "bool"},
+		},
+	}
+
+	var out bytes.Buffer
+	_, err := dumpJSON(&out, typed, iterate)
+	if !assert.NoError(t, err) {
+		return
+	}
+	dec := json.NewDecoder(&out)
+	dec.UseNumber()
+	obj := make(map[string]interface{})
+	if assert.NoError(t, dec.Decode(&obj)) {
+		assert.Equal(t, json.Number("1.5"), obj["f"])
+		assert.Equal(t, json.Number("9007199254740993"), obj["i"], "integers should be exact")
+		assert.Equal(t, true, obj["b"])
+		assert.Equal(t, "a", obj["dim"])
+		assert.Equal(t, "2015-01-01T00:00:00Z", obj["_time"])
+	}
+
+	out.Reset()
+	_, err = dumpCSV(&out, typed, iterate)
+	if assert.NoError(t, err) {
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if assert.Len(t, lines, 2) {
+			assert.Equal(t, "2015-01-01T00:00:00Z,1.500000,9007199254740993,true,a", lines[0])
+			assert.Equal(t, "time,f,i,b,dim", lines[1])
+		}
+	}
+
+	// Without types, everything is a float64
+	untyped := &common.QueryMetaData{FieldNames: typed.FieldNames}
+	out.Reset()
+	_, err = dumpCSV(&out, untyped, iterate)
+	if assert.NoError(t, err) {
+		assert.True(t, strings.HasPrefix(out.String(), "2015-01-01T00:00:00Z,1.500000,9007199254740992.000000,1.000000,a\n"), out.String())
+	}
+}
+
+func TestJSONTimeDoesntCollide(t *testing.T) {
+	row := &core.FlatRow{
+		TS:     time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano(),
+		Key:    bytemap.New(map[string]interface{}{"time": "morning"}),
+		Values: []float64{1},
+	}
+	var out bytes.Buffer
+	_, err := dumpJSON(&out, &common.QueryMetaData{FieldNames: []string{"f"}}, func(onRow core.OnFlatRow) (*common.QueryStats, error) {
+		_, err := onRow(row)
+		return &common.QueryStats{}, err
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	obj := make(map[string]interface{})
+	if assert.NoError(t, json.Unmarshal(out.Bytes(), &obj)) {
+		assert.Equal(t, "morning", obj["time"], "dimension called time should be kept")
+		assert.Equal(t, "2015-01-01T00:00:00Z", obj["_time"])
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected []string
+	}{
+		{"single", "SELECT * FROM a", []string{"SELECT * FROM a"}},
+		{"multiple", " SELECT * FROM a ;\nSELECT * FROM b; ", []string{"SELECT * FROM a", "SELECT * FROM b"}},
+		{"empty", " ; ;\n", []string{}},
+		{"single quoted", "SELECT * FROM a WHERE d = ';'; SELECT * FROM b", []string{"SELECT * FROM a WHERE d = ';'", "SELECT * FROM b"}},
+		{"double quoted", `SELECT * FROM a WHERE d = "x;y"`, []string{`SELECT * FROM a WHERE d = "x;y"`}},
+		{"backquoted", "SELECT `a;b` FROM a; SELECT * FROM b", []string{"SELECT `a;b` FROM a", "SELECT * FROM b"}},
+		{"quote in other quote", `SELECT * FROM a WHERE d = "it's;"; SELECT * FROM b`, []string{`SELECT * FROM a WHERE d = "it's;"`, "SELECT * FROM b"}},
+		{"line comment", "SELECT * FROM a -- first; not a statement\n; SELECT * FROM b", []string{"SELECT * FROM a -- first; not a statement", "SELECT * FROM b"}},
+		{"block comment", "SELECT /* fresh; now */ * FROM a; SELECT * FROM b", []string{"SELECT /* fresh; now */ * FROM a", "SELECT * FROM b"}},
+		{"comment only", "SELECT * FROM a; -- done; really\n/* ; */", []string{"SELECT * FROM a"}},
+		{"leading comment", "-- check a\nSELECT * FROM a", []string{"-- check a\nSELECT * FROM a"}},
+		{"quote in comment", "SELECT * FROM a -- a's\n; SELECT * FROM b", []string{"SELECT * FROM a -- a's", "SELECT * FROM b"}},
+		{"unterminated comment", "SELECT * FROM a /* ; ", []string{"SELECT * FROM a /* ;"}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, splitStatements(test.text), test.name)
+	}
+}
+
+// parseFlags parses the given command-line arguments, returning a function
+// that restores all flags to their prior values.
+func parseFlags(t *testing.T, args ...string) func() {
+	fs := flag.CommandLine
+	priorValues := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		priorValues[f.Name] = f.Value.String()
+	})
+	reset := func() {
+		for name, value := range priorValues {
+			fs.Set(name, value)
+		}
+	}
+	if !assert.NoError(t, fs.Parse(args)) {
+		reset()
+		t.FailNow()
+	}
+	return reset
+}
+
+func TestBatchStatements(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zeno-cli")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	statementsFile := filepath.Join(tmpDir, "checks.sql")
+	if !assert.NoError(t, ioutil.WriteFile(statementsFile, []byte("SELECT * FROM a;\nSELECT * FROM b;\n"), 0644)) {
+		return
+	}
+
+	reset := parseFlags(t, "-e", "SELECT * FROM a; SELECT * FROM b")
+	statements, err := batchStatements(flag.Args())
+	reset()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"SELECT * FROM a", "SELECT * FROM b"}, statements, "-e")
+	}
+
+	reset = parseFlags(t, "-f", statementsFile)
+	statements, err = batchStatements(flag.Args())
+	reset()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"SELECT * FROM a", "SELECT * FROM b"}, statements, "-f")
+	}
+
+	reset = parseFlags(t, "-f", filepath.Join(tmpDir, "missing.sql"))
+	_, err = batchStatements(flag.Args())
+	reset()
+	assert.Error(t, err, "missing -f file")
+
+	reset = parseFlags(t, "SELECT * FROM a")
+	statements, err = batchStatements(flag.Args())
+	reset()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"SELECT * FROM a"}, statements, "argument")
+	}
+
+	reset = parseFlags(t)
+	statements, err = batchStatements(flag.Args())
+	reset()
+	if assert.NoError(t, err) {
+		assert.Nil(t, statements, "no statements means interactive")
+	}
+}
+
+// stubClient answers each query with one row (none for table empty) and the
+// stats configured for it, or fails it with the configured error.
+type stubClient struct {
+	rpc.Client
+	stats  map[string]*common.QueryStats
+	errors map[string]error
+}
+
+func (c *stubClient) Query(ctx context.Context, sqlString string, includeMemStore bool, opts ...grpc.CallOption) (*common.QueryMetaData, func(onRow core.OnFlatRow) (*common.QueryStats, error), error) {
+	if err := c.errors[sqlString]; err != nil {
+		return nil, nil, err
+	}
+	stats := c.stats[sqlString]
+	if stats == nil {
+		stats = &common.QueryStats{}
+	}
+	if stats.LowestHighWaterMark == 0 {
+		stats.LowestHighWaterMark = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	md := &common.QueryMetaData{
+		FieldNames: []string{"f"},
+		Fields:     []*common.FieldMetaData{{Name: "f", Type: "int64"}},
+	}
+	return md, func(onRow core.OnFlatRow) (*common.QueryStats, error) {
+		if sqlString != "SELECT f FROM empty" {
+			_, err := onRow(&core.FlatRow{
+				TS:     time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano(),
+				Key:    bytemap.New(map[string]interface{}{"dim": "a"}),
+				Values: []float64{5},
+				Ints:   []int64{5},
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return stats, nil
+	}, nil
+}
+
+func TestRunBatch(t *testing.T) {
+	const (
+		ok         = "SELECT f FROM a"
+		empty      = "SELECT f FROM empty"
+		failing    = "SELECT f FROM failing"
+		incomplete = "SELECT f FROM incomplete"
+		old        = "SELECT f FROM old"
+	)
+	client := &stubClient{
+		stats: map[string]*common.QueryStats{
+			incomplete: {NumPartitions: 2, NumSuccessfulPartitions: 1, MissingPartitions: []int{1}},
+			old:        {LowestHighWaterMark: time.Now().Add(-3*time.Hour).UnixNano() / int64(time.Millisecond)},
+		},
+		errors: map[string]error{
+			failing: errors.New("unknown table failing"),
+		},
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		statements []string
+		status     int
+		stdout     string
+	}{
+		{"csv", []string{"-format", "csv"}, []string{ok}, 0, "2015-01-01T00:00:00Z,5,a\ntime,f,dim\n"},
+		{"json", []string{"-format", "json"}, []string{ok, ok}, 0, `{"_time":"2015-01-01T00:00:00Z","dim":"a","f":5}` + "\n" + `{"_time":"2015-01-01T00:00:00Z","dim":"a","f":5}` + "\n"},
+		{"unknown format", []string{"-format", "xml"}, []string{ok}, StatusQueryFailed, ""},
+		{"failed", []string{"-format", "csv"}, []string{ok, failing, ok}, StatusQueryFailed, "2015-01-01T00:00:00Z,5,a\ntime,f,dim\n"},
+		{"missing partitions", []string{"-format", "csv"}, []string{incomplete}, StatusMissingPartitions, ""},
+		{"allow incomplete", []string{"-format", "csv", "-allowincomplete"}, []string{incomplete}, 0, ""},
+		{"too old", []string{"-format", "csv"}, []string{old}, StatusResultsTooOld, ""},
+		{"empty", []string{"-format", "csv"}, []string{empty, ok}, 0, ""},
+		{"fail on empty", []string{"-format", "csv", "-failonempty"}, []string{ok, empty, ok}, StatusEmptyResults, "2015-01-01T00:00:00Z,5,a\ntime,f,dim\ntime,f\n"},
+	}
+	for _, test := range tests {
+		reset := parseFlags(t, test.args...)
+		var stdout, stderr bytes.Buffer
+		status := runBatch(&stdout, &stderr, client, test.statements)
+		reset()
+		assert.Equal(t, test.status, status, test.name)
+		if test.stdout != "" {
+			assert.Equal(t, test.stdout, stdout.String(), test.name)
+		}
+	}
+}
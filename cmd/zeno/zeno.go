@@ -5,27 +5,45 @@ package main
 import (
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/getlantern/golog"
 	"github.com/getlantern/tlsdefaults"
-	"github.com/getlantern/wal"
 	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/acl"
+	"github.com/getlantern/zenodb/archive"
+	"github.com/getlantern/zenodb/clustertls"
 	"github.com/getlantern/zenodb/cmd"
 	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/election"
 	"github.com/getlantern/zenodb/planner"
 	"github.com/getlantern/zenodb/rpc"
 	"github.com/getlantern/zenodb/rpc/server"
+	"github.com/getlantern/zenodb/wal"
 	"github.com/getlantern/zenodb/web"
 	"github.com/gorilla/mux"
+	"github.com/segmentio/kafka-go"
 	"github.com/vharitonsky/iniflags"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/context"
 )
@@ -35,15 +53,58 @@ var (
 
 	dbdir                     = flag.String("dbdir", "zenodata", "The directory in which to store the database files, defaults to ./zenodata")
 	vtime                     = flag.Bool("vtime", false, "Set this flag to use virtual instead of real time. When using virtual time, the advancement of time will be governed by the timestamps received via inserts.")
+	perStreamClocks           = flag.Bool("perstreamclocks", false, "With -vtime, set this flag to give each stream its own virtual clock, so that the retention of each table is governed by the timestamps of its own stream rather than those of all streams.")
 	walSync                   = flag.Duration("walsync", 5*time.Second, "How frequently to sync the WAL to disk. Set to 0 to sync after every write. Defaults to 5 seconds.")
+	targetApplyLatency        = flag.Duration("targetapplylatency", 0, "Set to a non-zero value to automatically tune how often tables flush in order to keep the latency of applying data from the WAL under this target")
 	maxWALSize                = flag.Int("maxwalsize", 1024*1024*1024, "Maximum size of WAL segments on disk. Defaults to 1 GB.")
 	walCompressionSize        = flag.Int("walcompressionsize", 30*1024*1024, "Size above which to start compressing WAL segments with snappy. Defaults to 30 MB.")
+	walCompression            = flag.String("walcompression", "", "Set to snappy, zstd or lz4 to compress individual WAL entries as they're written, instead of compressing segments beyond -walcompressionsize")
+	minWALAge                 = flag.Duration("minwalage", 0, "Minimum time for which to keep WAL segments, even beyond -maxwalsize")
+	retainWALForFollowers     = flag.Bool("retainwalforfollowers", false, "Keep WAL segments beyond -maxwalsize until all followers have acknowledged past them")
 	maxMemory                 = flag.Float64("maxmemory", 0.7, "Set to a non-zero value to cap the total size of the process as a percentage of total system memory. Defaults to 0.7 = 70%.")
+	flushMemory               = flag.Float64("flushmemory", zenodb.DefaultFlushMemoryRatio, "Fraction of -maxmemory beyond which the largest memstores are proactively flushed")
+	throttleMemory            = flag.Float64("throttlememory", zenodb.DefaultThrottleMemoryRatio, "Fraction of -maxmemory beyond which inserts are briefly delayed while memstores are flushed")
+	spillDir                  = flag.String("spilldir", "", "directory in which queries spill data that doesn't fit in -spillmemory, defaults to _spill within -dbdir")
+	maxSpillBytes             = flag.Int64("maxspillbytes", 0, "Set to a non-zero value to cap the disk space in bytes that all queries combined may use for spilling")
+	maxSpillBytesPerQuery     = flag.Int64("maxspillbytesperquery", 0, "Set to a non-zero value to cap the disk space in bytes that a single query may use for spilling")
+	queryCacheSize            = flag.Int("querycachesize", 0, "Set to a non-zero value to cache the results of this many queries, so that repeated queries only need to compute periods that may still change")
+	maxQueryRowsScanned       = flag.Int64("maxqueryrowsscanned", 0, "Set to a non-zero value to cap the number of rows that a single query may scan")
+	maxQueryMemory            = flag.Int64("maxquerymemory", 0, "Set to a non-zero value to cap the memory in bytes taken up by the rows that a single query scans")
+	maxQueryDuration          = flag.Duration("maxqueryduration", 0, "Set to a non-zero value to cap how long a single query may run")
+	softMaxQueryRowsScanned   = flag.Int64("softmaxqueryrowsscanned", 0, "Set to a non-zero value to warn about queries that scan more than this number of rows")
+	softMaxQueryMemory        = flag.Int64("softmaxquerymemory", 0, "Set to a non-zero value to warn about queries whose scanned rows take up more than this many bytes of memory")
+	softMaxQueryDuration      = flag.Duration("softmaxqueryduration", 0, "Set to a non-zero value to warn about queries that run for longer than this")
+	softMaxQueryGroups        = flag.Int64("softmaxquerygroups", 0, "Set to a non-zero value to warn about queries that return more than this number of groups")
+	softMaxQueryResultBytes   = flag.Int64("softmaxqueryresultbytes", 0, "Set to a non-zero value to warn about queries whose results are estimated to be larger than this number of bytes")
+	slowQueryThreshold        = flag.Duration("slowquerythreshold", 0, "Set to a non-zero value to record queries that run for at least this long in slow_queries.log within -dbdir")
+	slowQueryLogMaxBytes      = flag.Int64("slowquerylogmaxbytes", zenodb.DefaultSlowQueryLogMaxBytes, "use with -slowquerythreshold, size in bytes at which to rotate the slow query log")
+	queryAuditPercent         = flag.Float64("queryauditpercent", 0, "Set to a non-zero value to send audit records for this percentage of queries to -queryauditstream and/or -queryauditkafka")
+	queryAuditLog             = flag.Bool("queryauditlog", false, "write an audit record for every query to query_audit.log within -dbdir, failing queries that can't be audited")
+	queryAuditLogMaxBytes     = flag.Int64("queryauditlogmaxbytes", zenodb.DefaultQueryAuditLogMaxBytes, "use with -queryauditlog, size in bytes at which to rotate the audit log. Set to -1 to never rotate it, keeping an append-only audit log")
+	queryAuditStream          = flag.String("queryauditstream", "", "use with -queryauditpercent, insert audit records into this stream so that they can be queried through a table on it")
+	columnUsageStream         = flag.String("columnusagestream", "", "if specified, insert a record for every dimension and field referenced by queries into this stream so that column usage can be queried through a table on it")
+	queryAuditKafka           = flag.String("queryauditkafka", "", "use with -queryauditpercent, publish audit records as JSON to the Kafka brokers at these comma,delimited addresses")
+	queryAuditKafkaTopic      = flag.String("queryauditkafkatopic", "zenodb_query_audit", "use with -queryauditkafka, the topic to which to publish audit records")
+	queryCacheLag             = flag.Duration("querycachelag", zenodb.DefaultQueryCacheLag, "use with -querycachesize, how long to wait after a period ends before caching its results")
+	coalesceQueries           = flag.Bool("coalescequeries", false, "Set to true to run identical queries that are issued concurrently only once and share their results")
+	preparedQueryCacheSize    = flag.Int("preparedquerycachesize", zenodb.DefaultPreparedQueryCacheSize, "how many prepared queries to remember, and how many recently run queries to keep in parsed form")
+	archiveBucket             = flag.String("archivebucket", "", "if specified, periodically archives filestores and sealed WAL segments to this S3-compatible bucket. credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	archivePrefix             = flag.String("archiveprefix", "", "use with -archivebucket, prefix for the keys of archived files")
+	archiveEndpoint           = flag.String("archiveendpoint", archive.DefaultEndpoint, "use with -archivebucket, URL of the S3-compatible API, for example https://storage.googleapis.com for GCS")
+	archiveRegion             = flag.String("archiveregion", archive.DefaultRegion, "use with -archivebucket, region of the bucket")
+	archiveInterval           = flag.Duration("archiveinterval", archive.DefaultInterval, "use with -archivebucket, how frequently to archive new data")
+	archiveKeepFilestores     = flag.Int("archivekeepfilestores", archive.DefaultKeepFilestores, "use with -archivebucket, how many of the latest filestores of each table to keep in the archive")
+	archiveWALRetention       = flag.Duration("archivewalretention", 0, "use with -archivebucket, if specified, archived WAL segments older than this are deleted")
+	hydrateFromArchive        = flag.Bool("hydratefromarchive", false, "use with -archivebucket, restores tables and WALs that have no data on disk from the archive")
+	spillMemory               = flag.Int("spillmemory", 0, "Set to a non-zero value to cap the memory in bytes used by each sort, grouping and materialized subquery of a query, beyond which they spill to temp files. Defaults to -maxsortmemory or else 10% of -maxmemory.")
+	maxSortMemory             = flag.Int("maxsortmemory", 0, "Deprecated, use -spillmemory")
 	iterationCoalesceInterval = flag.Duration("itercoalesce", zenodb.DefaultIterationCoalesceInterval, "Period to wait for coalescing parallel iterations")
 	iterationConcurrency      = flag.Int("iterconcurrency", zenodb.DefaultIterationConcurrency, "specifies the maximum concurrency for iterating tables")
 	addr                      = flag.String("addr", "localhost:17712", "The address at which to listen for gRPC over TLS connections, defaults to localhost:17712")
 	httpsAddr                 = flag.String("httpsaddr", "localhost:17713", "The address at which to listen for JSON over HTTPS connections, defaults to localhost:17713")
 	password                  = flag.String("password", "", "if specified, will authenticate clients using this password")
+	apiTokensFile             = flag.String("apitokensfile", "", "file in which to store the hashes of API tokens that web API clients can present as Bearer tokens, defaults to api_tokens in -dbdir. admins manage tokens at /tokens on the web API.")
+	aclFile                   = flag.String("aclfile", "", "if specified, path to a YAML file that defines principals with their passwords and their reader, writer or admin roles on tables. clients that authenticate with -password may still do anything. reload with a POST to /acl on the web API.")
 	pkfile                    = flag.String("pkfile", "pk.pem", "path to the private key PEM file")
 	certfile                  = flag.String("certfile", "cert.pem", "path to the certificate PEM file")
 	cookieHashKey             = flag.String("cookiehashkey", "", "key to use for HMAC authentication of web auth cookies, should be 64 bytes, defaults to random 64 bytes if not specified")
@@ -51,31 +112,99 @@ var (
 	oauthClientID             = flag.String("oauthclientid", "", "id to use for oauth client to connect to GitHub")
 	oauthClientSecret         = flag.String("oauthclientsecret", "", "secret id to use for oauth client to connect to GitHub")
 	gitHubOrg                 = flag.String("githuborg", "", "the GitHug org against which web users are authenticated")
+	oidcIssuer                = flag.String("oidcissuer", "", "if specified, authenticate web users with the OpenID Connect provider at this issuer URL, for example https://accounts.google.com")
+	oidcClientID              = flag.String("oidcclientid", "", "use with -oidcissuer, the client id registered with the OIDC provider")
+	oidcClientSecret          = flag.String("oidcclientsecret", "", "use with -oidcissuer, the client secret registered with the OIDC provider")
+	oidcRedirectURL           = flag.String("oidcredirecturl", "", "use with -oidcissuer, the URL to which the OIDC provider redirects users after they log in, defaults to https://<requested host>/oidc/code")
+	oidcScopes                = flag.String("oidcscopes", "", "use with -oidcissuer, comma,delimited scopes to request in addition to openid, email and profile, for example groups")
+	oidcGroups                = flag.String("oidcgroups", "", "use with -oidcissuer, if specified, only allow users in at least one of these comma,delimited groups")
+	oidcGroupsClaim           = flag.String("oidcgroupsclaim", "groups", "use with -oidcgroups, the ID token claim that lists a user's groups")
+	oidcClaims                = flag.String("oidcclaims", "", "use with -oidcissuer, if specified, only allow users whose ID tokens have the given values for the given claims, as comma,delimited claim=value pairs, for example hd=example.com to require a Google Workspace domain")
+	clusterCACert             = flag.String("clustercacert", "", "if specified, path to the PEM certificate of the cluster CA. cluster peers (followers, replicas, replication peers and query handlers) connecting to this node must then present a client certificate issued by this CA in addition to -password.")
+	clusterCAKey              = flag.String("clustercakey", "", "use with -issueclustercert, path to the PEM private key of the cluster CA")
+	clusterCert               = flag.String("clustercert", "", "if specified, path to the PEM client certificate, issued by the cluster CA, that this node presents when connecting to other zeno servers. requires -clusterkey.")
+	clusterKey                = flag.String("clusterkey", "", "use with -clustercert, path to the PEM private key of the client certificate")
+	issueClusterCert          = flag.String("issueclustercert", "", "if specified, issue a client certificate for the node with the given name from the CA at -clustercacert and -clustercakey (creating a new CA if neither file exists yet), save it to -clustercert and -clusterkey, and exit")
+	clusterCertValidity       = flag.Duration("clustercertvalidity", 365*24*time.Hour, "use with -issueclustercert, how long the issued certificate is valid")
 	insecure                  = flag.Bool("insecure", false, "set to true to disable TLS certificate verification when connecting to other zeno servers (don't use this in production!)")
 	passthrough               = flag.Bool("passthrough", false, "set to true to make this node a passthrough that doesn't capture data in table but is capable of feeding and querying other nodes. requires that -partitions to be specified.")
-	capture                   = flag.String("capture", "", "if specified, connect to the node at the given address to receive updates, authenticating with value of -password.  requires that you specify which -partition this node handles.")
+	capture                   = flag.String("capture", "", "if specified, connect to the node at the given address to receive updates, authenticating with value of -password.  requires that you specify which -partition this node handles. specify multiple comma,delimited addresses of replicated passthrough nodes to fail over between them.")
 	captureOverride           = flag.String("captureoverride", "", "if specified, dial network connection for -capture using this address, but verify TLS connection using the address from -capture")
+	coordinatorAddr           = flag.String("coordinator", "", "if specified, the address of a consul agent's HTTP API, like http://localhost:8500, through which passthrough nodes elect a single leader for each stream and followers find it. leaders are identified by -nodeid, which should be the address at which followers reach them.")
+	coordinatorToken          = flag.String("coordinatortoken", "", "use with -coordinator, the ACL token with which to authenticate to consul")
+	coordinatorTTL            = flag.Duration("coordinatorttl", election.DefaultConsulSessionTTL, "use with -coordinator, how long consul keeps a leader's session alive without hearing from it, which bounds how long it takes to fail over to another passthrough node")
+	nodeID                    = flag.String("nodeid", "", "identifies this node to replication peers and followers, defaults to the value of -addr. followers identify leaders by the addresses given to -capture, so these should match.")
+	replicateFrom             = flag.String("replicate", "", "use with -passthrough, if specified, replicate the WALs of the passthrough nodes at the given comma,delimited addresses, authenticating with value of -password.")
+	replicationRewind         = flag.Duration("replicationrewind", zenodb.DefaultReplicationRewind, "use with -replicate, how far back to rewind when a follower fails over to this node from a replication peer")
+	encryptionKeyReload       = flag.Duration("encryptionkeyreload", zenodb.DefaultEncryptionKeyReloadInterval, "use with -encryptionkeys, how frequently to reload the keys file to pick up rotated keys")
+	bootstrapFrom             = flag.String("bootstrapfrom", "", "use with -capture, comma,delimited addresses of existing replicas of this follower's partition from which to bootstrap brand-new tables, authenticating with value of -password.")
+	followerName              = flag.String("followername", "", "use with -capture, identifies this follower to the leader, defaults to the hostname")
+	followerToken             = flag.String("followertoken", "", "use with -capture, the token with which this follower authenticates to the leader")
+	standby                   = flag.Bool("standby", false, "use with -capture, follows this partition's data as a hot standby without handling queries until promoted with zeno-cli promote")
+	followBatchSize           = flag.Int("followbatchsize", 0, "use with -capture, if positive, asks the leader to send entries in compressed batches of about this many bytes (at most 1 MB) instead of one at a time")
+	followBatchInterval       = flag.Duration("followbatchinterval", 100*time.Millisecond, "use with -followbatchsize, caps how long the leader holds on to entries before sending an incomplete batch")
+	followBatchCompression    = flag.String("followbatchcompression", "snappy", "use with -followbatchsize, the algorithm with which the leader compresses batches, one of snappy, zstd, lz4 or none")
+	followQueueDepth          = flag.Int("followqueuedepth", zenodb.DefaultFollowQueueDepth, "how many entries to buffer for each follower that doesn't use -followcredits, can be changed at runtime")
+	followCredits             = flag.Int("followcredits", 0, "use with -capture, if positive, enables flow control by allowing the leader to send at most this many entries that haven't been applied yet")
+	followerTokens            = flag.String("followertokens", "", "use with -passthrough, if specified, require followers to identify themselves with one of the given comma,delimited name=token pairs")
 	feed                      = flag.String("feed", "", "if specified, connect to the nodes at the given comma,delimited addresses to handle queries for them, authenticating with value of -password. requires that you specify which -partition this node handles.")
 	feedOverride              = flag.String("feedoverride", "", "if specified, dial network connection for -feed using this address, but verify TLS connection using the address from -feed")
 	numPartitions             = flag.Int("numpartitions", 1, "The number of partitions available to distribute amongst followers")
+	consistentPartitioning    = flag.Bool("consistentpartitioning", false, "use consistent hashing to assign data to partitions, which minimizes the data that moves when changing -numpartitions. all nodes in the cluster must use the same setting.")
+	warmupQueries             = flag.String("warmupqueries", "", "if specified, path to a file containing semicolon-delimited queries to run after recovering at startup in order to warm up caches")
+	rejectDuringRecovery      = flag.Bool("rejectqueriesduringrecovery", false, "reject queries against tables that are still replaying the WAL at startup rather than returning incomplete results")
+	includeWALTail            = flag.Bool("includewaltail", false, "make fresh queries also include data that's been written to the WAL but not yet applied to tables, at the cost of reading the WAL while querying")
 	partition                 = flag.Int("partition", 0, "use with -follow, the partition number assigned to this follower")
+	perPartitionWALReaders    = flag.Bool("perpartitionwalreaders", false, "use with -passthrough, if true, read the WAL separately for the followers of each partition so that a slow partition doesn't stall the others, at the cost of re-reading the WAL once per partition")
+	replicationFactor         = flag.Int("replicationfactor", 1, "use with -passthrough, the number of followers serving each partition. if greater than 1, queries fail over to another follower of the same partition when one fails.")
+	replicaWeights            = flag.String("replicaweights", "", "use with -passthrough, comma,delimited name=weight pairs that weight how often the named followers are chosen to handle queries relative to other followers of the same partition. followers without a weight get 1. followers with weight 0 only handle queries when no other follower is available.")
 	clusterQueryConcurrency   = flag.Int("clusterqueryconcurrency", zenodb.DefaultClusterQueryConcurrency, "specifies the maximum concurrency for clustered queries")
 	clusterQueryTimeout       = flag.Duration("clusterquerytimeout", zenodb.DefaultClusterQueryTimeout, "specifies the maximum time leader will wait for followers to answer a query")
+	replicaStallTimeout       = flag.Duration("replicastalltimeout", zenodb.DefaultReplicaStallTimeout, "use with -replicationfactor, how long a follower may go without sending results for a query before the leader fails over to another replica")
 	nextQueryTimeout          = flag.Duration("nextquerytimeout", 5*time.Minute, "specifies the maximum time follower will wait for leader to send a query on an open connection")
 	maxFollowAge              = flag.Duration("maxfollowage", 0, "user with -follow, limits how far to go back when pulling data from leader")
+	missingTables             = flag.String("missingtables", zenodb.MissingTablesSkip, "use with -passthrough, set to fail to refuse followers that request tables we don't have instead of skipping those tables")
+	maxClockSkew              = flag.Duration("maxclockskew", zenodb.DefaultMaxClockSkew, "use with -passthrough, warn when the clocks of followers differ from ours by more than this")
+	shutdownTimeout           = flag.Duration("shutdowntimeout", zenodb.DefaultShutdownTimeout, "how long to wait for a graceful shutdown (draining followers and flushing tables) when receiving a signal to terminate")
 	tlsDomain                 = flag.String("tlsdomain", "", "Specify this to automatically use LetsEncrypt certs for this domain")
 	webQueryCacheTTL          = flag.Duration("webquerycachettl", 2*time.Hour, "specifies how long to cache web query results")
 	webQueryTimeout           = flag.Duration("webquerytimeout", 30*time.Minute, "time out web queries after this duration")
 	webQueryConcurrencyLimit  = flag.Int("webqueryconcurrency", 2, "limit concurrent web queries to this (subsequent queries will be queued)")
 	webMaxResponseBytes       = flag.Int("webquerymaxresponsebytes", 25*1024*1024, "limit the size of query results returned through the web API")
+	webSoftMaxResponseBytes   = flag.Int("webquerysoftmaxresponsebytes", 0, "Set to a non-zero value to warn about query results through the web API that are larger than this")
+	otlpEndpoint              = flag.String("otlpendpoint", "", "if specified, export OpenTelemetry traces to the OTLP/HTTP collector at this host:port")
+	otlpInsecure              = flag.Bool("otlpinsecure", false, "use with -otlpendpoint, connect to the collector over plain HTTP instead of HTTPS")
+	traceSampleRatio          = flag.Float64("tracesampleratio", 1, "use with -otlpendpoint, the fraction of traces to sample. traces that started on another node follow that node's sampling decision.")
 )
 
 func main() {
 	iniflags.Parse()
 
+	if *issueClusterCert != "" {
+		issueClusterCertificate()
+		return
+	}
+
 	cmd.StartPprof()
 
-	l, err := tlsdefaults.Listen(*addr, *pkfile, *certfile)
+	var clusterCAs *x509.CertPool
+	if *clusterCACert != "" {
+		var caErr error
+		clusterCAs, caErr = clustertls.LoadCertPool(*clusterCACert)
+		if caErr != nil {
+			log.Fatal(caErr)
+		}
+	}
+	var clientCerts []tls.Certificate
+	if *clusterCert != "" {
+		clientCert, certErr := tls.LoadX509KeyPair(*clusterCert, *clusterKey)
+		if certErr != nil {
+			log.Fatalf("Unable to load cluster client certificate: %v", certErr)
+		}
+		clientCerts = append(clientCerts, clientCert)
+	}
+
+	l, err := listenRPC(clusterCAs)
 	if err != nil {
 		log.Fatalf("Unable to listen for gRPC over TLS connections at %v: %v", *addr, err)
 	}
@@ -109,37 +238,126 @@ func main() {
 		}
 	}
 
+	fname := *followerName
+	if fname == "" {
+		fname, _ = os.Hostname()
+	}
+
 	clientSessionCache := tls.NewLRUClientSessionCache(10000)
+	var coordinator election.Coordinator
+	if *coordinatorAddr != "" {
+		coordinator = election.NewConsul(&election.ConsulOpts{
+			Addr:       *coordinatorAddr,
+			Token:      *coordinatorToken,
+			SessionTTL: *coordinatorTTL,
+		})
+	}
+
 	var follow func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error)
+	var ackFollow func(ack *common.FollowAck) error
+	var snapshot func(req *common.SnapshotRequest, cb func(version int, data []byte) error) error
 	var registerQueryHandler func(partition int, query planner.QueryClusterFN)
 	if *capture != "" {
-		host, _, _ := net.SplitHostPort(*capture)
-		clientTLSConfig := &tls.Config{
-			ServerName:         host,
-			InsecureSkipVerify: *insecure,
-			ClientSessionCache: clientSessionCache,
+		leaders := strings.Split(*capture, ",")
+		leaderOverrides := strings.Split(*captureOverride, ",")
+		if *captureOverride != "" && len(leaders) != len(leaderOverrides) {
+			log.Fatal("Number of servers specified to -capture must match -captureoverride")
 		}
-
-		dest := *capture
-		if *captureOverride != "" {
-			dest = *captureOverride
+		clients := make([]rpc.Client, 0, len(leaders))
+		for i, leader := range leaders {
+			dest := leader
+			if *captureOverride != "" {
+				dest = leaderOverrides[i]
+			}
+			client, dialErr := dialPeer(leader, dest, clientSessionCache, clientCerts)
+			if dialErr != nil {
+				log.Fatalf("Unable to connect to passthrough at %v: %v", leader, dialErr)
+			}
+			clients = append(clients, client)
 		}
 
-		clientOpts := &rpc.ClientOpts{
-			Password: *password,
-			Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
-				conn, dialErr := net.DialTimeout("tcp", dest, timeout)
-				if dialErr != nil {
-					return nil, dialErr
+		// With a coordinator, followers follow whichever leader is elected, which
+		// may not be one of the leaders given to -capture.
+		var leadersMx sync.RWMutex
+		leaderAt := func(i int) (string, rpc.Client) {
+			leadersMx.RLock()
+			defer leadersMx.RUnlock()
+			return leaders[i], clients[i]
+		}
+		electedLeader := func(stream string) int {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			elected, lookupErr := coordinator.Leader(ctx, election.ForStream(stream))
+			if lookupErr != nil {
+				log.Errorf("Unable to look up leader of stream %v: %v", stream, lookupErr)
+				return -1
+			}
+			if elected == "" {
+				return -1
+			}
+			leadersMx.Lock()
+			defer leadersMx.Unlock()
+			for i, leader := range leaders {
+				if leader == elected {
+					return i
 				}
-				tlsConn := tls.Client(conn, clientTLSConfig)
-				return tlsConn, tlsConn.Handshake()
-			},
+			}
+			client, dialErr := dialPeer(elected, elected, clientSessionCache, clientCerts)
+			if dialErr != nil {
+				log.Errorf("Unable to connect to elected leader %v of stream %v: %v", elected, stream, dialErr)
+				return -1
+			}
+			leaders = append(leaders, elected)
+			clients = append(clients, client)
+			return len(leaders) - 1
 		}
 
-		client, dialErr := rpc.Dial(*capture, clientOpts)
-		if dialErr != nil {
-			log.Fatalf("Unable to connect to passthrough at %v: %v", *capture, dialErr)
+		// Track which leader each stream is currently receiving data from so that
+		// acks go to the leader in whose WAL the acked offsets are expressed.
+		var receivingFromMx sync.Mutex
+		receivingFrom := make(map[string]int)
+		ackFollow = func(ack *common.FollowAck) error {
+			receivingFromMx.Lock()
+			current, found := receivingFrom[ack.Stream]
+			receivingFromMx.Unlock()
+			if !found {
+				// Not following any leader right now, nothing to ack
+				return nil
+			}
+			leader, client := leaderAt(current)
+			ack.LeaderID = leader
+			return client.AckFollow(context.Background(), ack)
+		}
+
+		if *bootstrapFrom != "" {
+			replicas := strings.Split(*bootstrapFrom, ",")
+			replicaClients := make([]rpc.Client, 0, len(replicas))
+			for _, replica := range replicas {
+				client, dialErr := dialPeer(replica, replica, clientSessionCache, clientCerts)
+				if dialErr != nil {
+					log.Fatalf("Unable to connect to replica at %v: %v", replica, dialErr)
+				}
+				replicaClients = append(replicaClients, client)
+			}
+			snapshot = func(req *common.SnapshotRequest, cb func(version int, data []byte) error) error {
+				var lastErr error
+				for i, client := range replicaClients {
+					received := false
+					lastErr = fetchSnapshot(client, req, func(version int, data []byte) error {
+						received = true
+						return cb(version, data)
+					})
+					if lastErr == nil {
+						return nil
+					}
+					log.Errorf("Unable to get snapshot of %v from %v: %v", req.Table, replicas[i], lastErr)
+					if received {
+						// Can't resume a partial snapshot from a different replica
+						return lastErr
+					}
+				}
+				return lastErr
+			}
 		}
 
 		log.Debugf("Capturing data from %v", *capture)
@@ -147,26 +365,64 @@ func main() {
 			minWait := 1 * time.Second
 			maxWait := 1 * time.Minute
 			wait := minWait
+			current := 0
+			lastLeader := ""
+			stream := ""
 			for {
 				for {
 					f := ff()
-					followFunc, followErr := client.Follow(context.Background(), f)
+					if f == nil {
+						// Following was canceled
+						return
+					}
+					stream = f.Stream
+					if coordinator != nil {
+						if elected := electedLeader(f.Stream); elected >= 0 {
+							current = elected
+						}
+					}
+					leader, client := leaderAt(current)
+					// Let the leader know whose offsets these are so that it can translate
+					// them if we're failing over from a replication peer.
+					f.LeaderID = lastLeader
+					spanCtx, span := common.StartSpan(context.Background(), "zenodb.followLeader", trace.WithAttributes(
+						attribute.String("zenodb.stream", f.Stream),
+						attribute.String("zenodb.leader", leader),
+						attribute.Int("zenodb.partition", f.PartitionNumber),
+					))
+					f.TraceContext = common.InjectTraceContext(spanCtx)
+					followFunc, followErr := client.Follow(spanCtx, f)
 					if followErr != nil {
-						log.Errorf("Error following stream %v: %v", f.Stream, followErr)
+						log.Errorf("Error following stream %v from %v: %v", f.Stream, leader, followErr)
+						common.EndSpan(span, followErr)
 						break
 					}
+					received := 0
+					leaderFailed := false
 					for {
 						data, newOffset, followErr := followFunc()
 						if followErr != nil {
-							log.Errorf("Error reading from stream %v: %v", f.Stream, followErr)
+							log.Errorf("Error reading from stream %v from %v: %v", f.Stream, leader, followErr)
+							span.SetAttributes(attribute.Int("zenodb.received", received))
+							common.EndSpan(span, followErr)
+							leaderFailed = true
 							break
 						}
+						received++
 						insertErr := insert(data, newOffset)
 						if insertErr != nil {
 							log.Errorf("Error inserting data for stream %v: %v", f.Stream, insertErr)
+							span.SetAttributes(attribute.Int("zenodb.received", received))
+							common.EndSpan(span, insertErr)
 							break
 						}
 						f.EarliestOffset = newOffset
+						if lastLeader != leader {
+							receivingFromMx.Lock()
+							receivingFrom[f.Stream] = current
+							receivingFromMx.Unlock()
+						}
+						lastLeader = leader
 						// reset wait time
 						wait = minWait
 					}
@@ -176,6 +432,71 @@ func main() {
 					if wait > maxWait {
 						wait = maxWait
 					}
+					if leaderFailed {
+						// leader failed mid-stream, fail over rather than retrying it
+						break
+					}
+				}
+				leadersMx.RLock()
+				numLeaders := len(leaders)
+				leadersMx.RUnlock()
+				if numLeaders > 1 || coordinator != nil {
+					// fail over to next leader
+					receivingFromMx.Lock()
+					delete(receivingFrom, stream)
+					receivingFromMx.Unlock()
+					current = (current + 1) % numLeaders
+					if coordinator == nil {
+						leader, _ := leaderAt(current)
+						log.Debugf("Failing over to leader %v", leader)
+					}
+				}
+			}
+		}
+	}
+
+	var replicate func(peer string, r func() *common.Replicate, cb func(data []byte, peerOffset wal.Offset) error)
+	var replicationPeers []string
+	if *replicateFrom != "" {
+		replicationPeers = strings.Split(*replicateFrom, ",")
+		peerClients := make(map[string]rpc.Client, len(replicationPeers))
+		for _, peer := range replicationPeers {
+			client, dialErr := dialPeer(peer, peer, clientSessionCache, clientCerts)
+			if dialErr != nil {
+				log.Fatalf("Unable to connect to replication peer at %v: %v", peer, dialErr)
+			}
+			peerClients[peer] = client
+		}
+
+		replicate = func(peer string, rr func() *common.Replicate, insert func(data []byte, peerOffset wal.Offset) error) {
+			client := peerClients[peer]
+			minWait := 1 * time.Second
+			maxWait := 1 * time.Minute
+			wait := minWait
+			for {
+				r := rr()
+				next, replicateErr := client.Replicate(context.Background(), r)
+				if replicateErr != nil {
+					log.Errorf("Error replicating stream %v from %v: %v", r.Stream, peer, replicateErr)
+				} else {
+					for {
+						data, peerOffset, readErr := next()
+						if readErr != nil {
+							log.Errorf("Error reading replicated stream %v from %v: %v", r.Stream, peer, readErr)
+							break
+						}
+						insertErr := insert(data, peerOffset)
+						if insertErr != nil {
+							log.Errorf("Error writing replicated data for stream %v: %v", r.Stream, insertErr)
+							break
+						}
+						wait = minWait
+					}
+				}
+				time.Sleep(wait)
+				wait *= 2
+				if wait > maxWait {
+					wait = maxWait
 				}
 			}
 		}
@@ -194,6 +515,7 @@ func main() {
 				ServerName:         host,
 				InsecureSkipVerify: *insecure,
 				ClientSessionCache: clientSessionCache,
+				Certificates:       clientCerts,
 			}
 
 			dest := leader
@@ -231,7 +553,7 @@ func main() {
 						// Continually handle queries and then reconnect for next query
 						waitTime := minWaitTime
 						for {
-							handleErr := client.ProcessRemoteQuery(context.Background(), partition, query, *nextQueryTimeout)
+							handleErr := client.ProcessRemoteQuery(context.Background(), partition, fname, query, *nextQueryTimeout)
 							if handleErr == nil {
 								waitTime = minWaitTime
 							} else {
@@ -250,28 +572,110 @@ func main() {
 		}
 	}
 
+	id := *nodeID
+	if id == "" {
+		id = *addr
+	}
+	startTracing(id)
+
+	var archiveOpts *archive.Opts
+	if *archiveBucket != "" {
+		archiveOpts = &archive.Opts{
+			Endpoint:           *archiveEndpoint,
+			Region:             *archiveRegion,
+			Bucket:             *archiveBucket,
+			Prefix:             *archivePrefix,
+			Interval:           *archiveInterval,
+			KeepFilestores:     *archiveKeepFilestores,
+			WALRetention:       *archiveWALRetention,
+			HydrateEmptyTables: *hydrateFromArchive,
+		}
+	}
+
 	db, err := zenodb.NewDB(&zenodb.DBOpts{
-		Dir:                        *dbdir,
-		SchemaFile:                 *cmd.Schema,
-		EnableGeo:                  *cmd.EnableGeo,
-		ISPProvider:                cmd.ISPProvider(),
-		AliasesFile:                *cmd.AliasesFile,
-		RedisClient:                cmd.RedisClient(),
-		RedisCacheSize:             *cmd.RedisCacheSize,
-		VirtualTime:                *vtime,
-		WALSyncInterval:            *walSync,
-		MaxWALSize:                 *maxWALSize,
-		WALCompressionSize:         *walCompressionSize,
-		MaxMemoryRatio:             *maxMemory,
-		IterationCoalesceInterval:  *iterationCoalesceInterval,
-		Passthrough:                *passthrough,
-		NumPartitions:              *numPartitions,
-		Partition:                  *partition,
-		ClusterQueryConcurrency:    *clusterQueryConcurrency,
-		ClusterQueryTimeout:        *clusterQueryTimeout,
-		Follow:                     follow,
-		MaxFollowAge:               *maxFollowAge,
-		RegisterRemoteQueryHandler: registerQueryHandler,
+		Dir:                         *dbdir,
+		SchemaFile:                  *cmd.Schema,
+		EnableGeo:                   *cmd.EnableGeo,
+		ISPProvider:                 cmd.ISPProvider(),
+		AliasesFile:                 *cmd.AliasesFile,
+		RedisClient:                 cmd.RedisClient(),
+		RedisCacheSize:              *cmd.RedisCacheSize,
+		EncryptionKeys:              cmd.EncryptionKeys(),
+		EncryptionKeyReloadInterval: *encryptionKeyReload,
+		VirtualTime:                 *vtime,
+		PerStreamClocks:             *perStreamClocks,
+		WALSyncInterval:             *walSync,
+		TargetApplyLatency:          *targetApplyLatency,
+		MaxWALSize:                  *maxWALSize,
+		WALCompressionSize:          *walCompressionSize,
+		WALCompression:              *walCompression,
+		MinWALAge:                   *minWALAge,
+		RetainWALForFollowers:       *retainWALForFollowers,
+		MaxMemoryRatio:              *maxMemory,
+		FlushMemoryRatio:            *flushMemory,
+		ThrottleMemoryRatio:         *throttleMemory,
+		SpillMemory:                 *spillMemory,
+		MaxSortMemory:               *maxSortMemory,
+		SpillDir:                    *spillDir,
+		MaxSpillBytes:               *maxSpillBytes,
+		MaxSpillBytesPerQuery:       *maxSpillBytesPerQuery,
+		QueryCacheSize:              *queryCacheSize,
+		QueryCacheLag:               *queryCacheLag,
+		CoalesceQueries:             *coalesceQueries,
+		PreparedQueryCacheSize:      *preparedQueryCacheSize,
+		MaxQueryRowsScanned:         *maxQueryRowsScanned,
+		MaxQueryMemory:              *maxQueryMemory,
+		MaxQueryDuration:            *maxQueryDuration,
+		SoftMaxQueryRowsScanned:     *softMaxQueryRowsScanned,
+		SoftMaxQueryMemory:          *softMaxQueryMemory,
+		SoftMaxQueryDuration:        *softMaxQueryDuration,
+		SoftMaxQueryGroups:          *softMaxQueryGroups,
+		SoftMaxQueryResultBytes:     *softMaxQueryResultBytes,
+		SlowQueryThreshold:          *slowQueryThreshold,
+		SlowQueryLogMaxBytes:        *slowQueryLogMaxBytes,
+		QueryAuditPercent:           *queryAuditPercent,
+		QueryAuditLog:               *queryAuditLog,
+		QueryAuditLogMaxBytes:       *queryAuditLogMaxBytes,
+		QueryAuditStream:            *queryAuditStream,
+		ColumnUsageStream:           *columnUsageStream,
+		QueryAuditSink:              kafkaQueryAuditSink(),
+		IterationCoalesceInterval:   *iterationCoalesceInterval,
+		Passthrough:                 *passthrough,
+		NumPartitions:               *numPartitions,
+		ConsistentPartitioning:      *consistentPartitioning,
+		Partition:                   *partition,
+		ReplicationFactor:           *replicationFactor,
+		PerPartitionWALReaders:      *perPartitionWALReaders,
+		ClusterQueryConcurrency:     *clusterQueryConcurrency,
+		ClusterQueryTimeout:         *clusterQueryTimeout,
+		ReplicaStallTimeout:         *replicaStallTimeout,
+		ReplicaWeights:              parseReplicaWeights(*replicaWeights),
+		Follow:                      follow,
+		AckFollow:                   ackFollow,
+		Snapshot:                    snapshot,
+		MaxFollowAge:                *maxFollowAge,
+		MaxClockSkew:                *maxClockSkew,
+		MissingTablesPolicy:         *missingTables,
+		FollowerName:                fname,
+		Standby:                     *standby,
+		FollowerToken:               *followerToken,
+		FollowBatchSize:             *followBatchSize,
+		FollowBatchInterval:         *followBatchInterval,
+		FollowBatchCompression:      *followBatchCompression,
+		FollowCredits:               *followCredits,
+		FollowQueueDepth:            *followQueueDepth,
+		RejectQueriesDuringRecovery: *rejectDuringRecovery,
+		IncludeWALTail:              *includeWALTail,
+		WarmupQueries:               loadWarmupQueries(*warmupQueries),
+		WaitForWarmupHandler:        true, // the web handler registers one in serveHTTP
+		RegisterRemoteQueryHandler:  registerQueryHandler,
+		NodeID:                      id,
+		Coordinator:                 coordinator,
+		ReplicationPeers:            replicationPeers,
+		ReplicationRewind:           *replicationRewind,
+		Replicate:                   replicate,
+		Archive:                     archiveOpts,
+		ShutdownTimeout:             *shutdownTimeout,
 	})
 	db.HandleShutdownSignal()
 
@@ -279,37 +683,138 @@ func main() {
 		log.Fatalf("Unable to open database at %v: %v", *dbdir, err)
 	}
 	fmt.Printf("Opened database at %v\n", *dbdir)
+	db.AddSettings(flagSettings()...)
 
 	fmt.Printf("Listening for gRPC connections at %v\n", l.Addr())
 	fmt.Printf("Listening for HTTP connections at %v\n", hl.Addr())
 
-	go serveHTTP(db, hl)
-	serveRPC(db, l)
+	var accessControl *acl.ACL
+	if *aclFile != "" {
+		accessControl, err = acl.Load(*aclFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *apiTokensFile == "" {
+		*apiTokensFile = filepath.Join(*dbdir, "api_tokens")
+	}
+	apiTokens, err := acl.OpenTokenStore(*apiTokensFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go serveHTTP(db, hl, accessControl, apiTokens)
+	serveRPC(db, l, accessControl, clusterCAs)
 }
 
-func serveRPC(db *zenodb.DB, l net.Listener) {
+// kafkaQueryAuditSink publishes query audit records as JSON to
+// -queryauditkafka, if specified. Records are published asynchronously, so
+// failures are only logged.
+func kafkaQueryAuditSink() func(audit *zenodb.QueryAudit) error {
+	if *queryAuditKafka == "" {
+		return nil
+	}
+	w := &kafka.Writer{
+		Addr:     kafka.TCP(strings.Split(*queryAuditKafka, ",")...),
+		Topic:    *queryAuditKafkaTopic,
+		Balancer: &kafka.LeastBytes{},
+		Async:    true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				log.Errorf("Unable to publish %d query audit records to Kafka: %v", len(messages), err)
+			}
+		},
+	}
+	return func(audit *zenodb.QueryAudit) error {
+		b, err := json.Marshal(audit)
+		if err != nil {
+			return err
+		}
+		return w.WriteMessages(context.Background(), kafka.Message{Value: b})
+	}
+}
+
+// startTracing exports OpenTelemetry traces to -otlpendpoint, if specified.
+func startTracing(id string) {
+	if *otlpEndpoint == "" {
+		return
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(*otlpEndpoint)}
+	if *otlpInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		log.Fatalf("Unable to create OTLP exporter for %v: %v", *otlpEndpoint, err)
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*traceSampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String("zeno"),
+			semconv.ServiceInstanceIDKey.String(id),
+		)),
+	))
+	log.Debugf("Exporting traces to %v", *otlpEndpoint)
+}
+
+// flagSettings lists the command-line flags so that they show up in the
+// database's settings.
+func flagSettings() []*zenodb.Setting {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var settings []*zenodb.Setting
+	flag.VisitAll(func(f *flag.Flag) {
+		source := zenodb.SettingSourceFlagDefault
+		if set[f.Name] {
+			source = zenodb.SettingSourceFlag
+		}
+		settings = append(settings, &zenodb.Setting{Name: "-" + f.Name, Value: f.Value.String(), Source: source})
+	})
+	return settings
+}
+
+func serveRPC(db *zenodb.DB, l net.Listener, accessControl *acl.ACL, clusterCAs *x509.CertPool) {
 	err := rpcserver.Serve(db, l, &rpcserver.Opts{
-		Password: *password,
+		Password:       *password,
+		ACL:            accessControl,
+		FollowerTokens: parseFollowerTokens(*followerTokens),
+		ClusterCAs:     clusterCAs,
 	})
 	if err != nil {
 		log.Fatalf("Error serving gRPC: %v", err)
 	}
 }
 
-func serveHTTP(db *zenodb.DB, hl net.Listener) {
+func serveHTTP(db *zenodb.DB, hl net.Listener, accessControl *acl.ACL, apiTokens *acl.TokenStore) {
 	router := mux.NewRouter()
 	err := web.Configure(db, router, &web.Opts{
 		OAuthClientID:         *oauthClientID,
 		OAuthClientSecret:     *oauthClientSecret,
 		GitHubOrg:             *gitHubOrg,
+		OIDCIssuerURL:         *oidcIssuer,
+		OIDCClientID:          *oidcClientID,
+		OIDCClientSecret:      *oidcClientSecret,
+		OIDCRedirectURL:       *oidcRedirectURL,
+		OIDCScopes:            splitList(*oidcScopes),
+		OIDCAllowedGroups:     splitList(*oidcGroups),
+		OIDCGroupsClaim:       *oidcGroupsClaim,
+		OIDCRequiredClaims:    parseOIDCClaims(*oidcClaims),
 		HashKey:               *cookieHashKey,
 		BlockKey:              *cookieBlockKey,
 		Password:              *password,
+		ACL:                   accessControl,
+		APITokens:             apiTokens,
 		CacheDir:              filepath.Join(*dbdir, "_webcache"),
 		CacheTTL:              *webQueryCacheTTL,
 		QueryTimeout:          *webQueryTimeout,
 		QueryConcurrencyLimit: *webQueryConcurrencyLimit,
 		MaxResponseBytes:      *webMaxResponseBytes,
+		SoftMaxResponseBytes:  *webSoftMaxResponseBytes,
 	})
 	if err != nil {
 		log.Errorf("Unable to configure web: %v", err)
@@ -318,6 +823,177 @@ func serveHTTP(db *zenodb.DB, hl net.Listener) {
 	http.Serve(hl, router)
 }
 
+// loadWarmupQueries loads semicolon-delimited queries from the given file.
+func loadWarmupQueries(filename string) []string {
+	if filename == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatalf("Unable to read warm-up queries from %v: %v", filename, err)
+	}
+	var queries []string
+	for _, query := range strings.Split(string(b), ";") {
+		query = strings.TrimSpace(query)
+		if query != "" {
+			queries = append(queries, query)
+		}
+	}
+	return queries
+}
+
+// parseFollowerTokens parses a comma,delimited list of name=token pairs.
+func parseFollowerTokens(spec string) map[string]string {
+	tokens := make(map[string]string)
+	if spec == "" {
+		return tokens
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Fatalf("Invalid follower token '%v', please specify as name=token", pair)
+		}
+		tokens[parts[0]] = parts[1]
+	}
+	return tokens
+}
+
+// splitList splits a comma,delimited list, returning nil for an empty list.
+func splitList(spec string) []string {
+	if spec == "" {
+		return nil
+	}
+	items := strings.Split(spec, ",")
+	for i, item := range items {
+		items[i] = strings.TrimSpace(item)
+	}
+	return items
+}
+
+func parseOIDCClaims(spec string) map[string]string {
+	claims := make(map[string]string)
+	for _, pair := range splitList(spec) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Fatalf("Invalid OIDC claim '%v', please specify as claim=value", pair)
+		}
+		claims[parts[0]] = parts[1]
+	}
+	return claims
+}
+
+func parseReplicaWeights(spec string) map[string]float64 {
+	weights := make(map[string]float64)
+	if spec == "" {
+		return weights
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Fatalf("Invalid replica weight '%v', please specify as name=weight", pair)
+		}
+		weight, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			log.Fatalf("Invalid replica weight '%v': %v", pair, err)
+		}
+		weights[parts[0]] = weight
+	}
+	return weights
+}
+
+// fetchSnapshot fetches a snapshot of a table from a single replica.
+func fetchSnapshot(client rpc.Client, req *common.SnapshotRequest, cb func(version int, data []byte) error) error {
+	next, err := client.Snapshot(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	for {
+		version, data, err := next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = cb(version, data)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dialPeer dials another zeno node at dest, verifying its TLS certificate
+// using the host from addr.
+func dialPeer(addr string, dest string, clientSessionCache tls.ClientSessionCache, clientCerts []tls.Certificate) (rpc.Client, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	clientTLSConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: *insecure,
+		ClientSessionCache: clientSessionCache,
+		Certificates:       clientCerts,
+	}
+
+	clientOpts := &rpc.ClientOpts{
+		Password: *password,
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			conn, dialErr := net.DialTimeout("tcp", dest, timeout)
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			tlsConn := tls.Client(conn, clientTLSConfig)
+			return tlsConn, tlsConn.Handshake()
+		},
+	}
+
+	return rpc.Dial(addr, clientOpts)
+}
+
+// listenRPC listens for gRPC over TLS connections at -addr. If clusterCAs are
+// specified, it asks clients for certificates issued by them so that the
+// server can tell cluster peers from other clients.
+func listenRPC(clusterCAs *x509.CertPool) (net.Listener, error) {
+	if clusterCAs == nil {
+		return tlsdefaults.Listen(*addr, *pkfile, *certfile)
+	}
+	tlsConfig, err := tlsdefaults.BuildListenerConfig(*addr, *pkfile, *certfile)
+	if err != nil {
+		return nil, err
+	}
+	// Other clients don't need certificates, so only verify them when given
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	tlsConfig.ClientCAs = clusterCAs
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, tlsConfig), nil
+}
+
+// issueClusterCertificate issues a client certificate for the node named by
+// -issueclustercert.
+func issueClusterCertificate() {
+	if *clusterCACert == "" || *clusterCAKey == "" || *clusterCert == "" || *clusterKey == "" {
+		log.Fatal("-issueclustercert requires -clustercacert, -clustercakey, -clustercert and -clusterkey")
+	}
+	ca, err := clustertls.LoadOrCreateCA(*clusterCACert, *clusterCAKey, 10*365*24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	certPEM, keyPEM, err := ca.Issue(*issueClusterCert, *clusterCertValidity)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ioutil.WriteFile(*clusterKey, keyPEM, 0600)
+	if err != nil {
+		log.Fatalf("Unable to save cluster client key to %v: %v", *clusterKey, err)
+	}
+	err = ioutil.WriteFile(*clusterCert, certPEM, 0644)
+	if err != nil {
+		log.Fatalf("Unable to save cluster client certificate to %v: %v", *clusterCert, err)
+	}
+	fmt.Printf("Issued cluster client certificate for %v to %v\n", *issueClusterCert, *clusterCert)
+}
+
 // this allows us to reuse a session ticket key across restarts, which avoids
 // excessive TLS renegotiation with old clients.
 func getSessionTicketKey() [32]byte {
@@ -37,9 +37,11 @@ func main() {
 		log.Fatal("Please specify at last one input file")
 	}
 
+	keyring := cmd.Keyring()
+
 	if *info {
 		for _, inFile := range inFiles {
-			highWaterMark, fieldsString, _, err := zenodb.FileInfo(inFile)
+			highWaterMark, fieldsString, _, err := zenodb.FileInfo(keyring, inFile)
 			if err != nil {
 				log.Error(err)
 			} else {
@@ -67,7 +69,7 @@ func main() {
 	}
 
 	if *check {
-		errors := zenodb.Check(inFiles...)
+		errors := zenodb.Check(keyring, inFiles...)
 		if len(errors) > 0 {
 			log.Debug("------------- Files with Error -------------")
 			for filename, err := range errors {
@@ -96,6 +98,7 @@ func main() {
 		AliasesFile:    *cmd.AliasesFile,
 		RedisClient:    cmd.RedisClient(),
 		RedisCacheSize: *cmd.RedisCacheSize,
+		EncryptionKeys: cmd.EncryptionKeys(),
 	})
 	if err != nil {
 		log.Fatalf("Unable to initialize DB: %v", err)
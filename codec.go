@@ -0,0 +1,103 @@
+package zenodb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	// CodecRaw stores sequences in the filestore using their fixed-width
+	// in-memory layout.
+	CodecRaw = "raw"
+
+	// CodecGorilla compresses sequences in the filestore using the XOR encoding
+	// from Facebook's Gorilla paper, which greatly reduces the size of smooth,
+	// gauge-like fields.
+	CodecGorilla = "gorilla"
+
+	// gorillaColumn is set in the column length of columns that are stored with
+	// CodecGorilla
+	gorillaColumn = uint64(1) << 63
+
+	// deltaOfDeltaColumn is set in the column length of gorilla columns whose
+	// until timestamp is stored as a delta-of-delta (see encoding.DeltaOfDelta)
+	deltaOfDeltaColumn = uint64(1) << 62
+)
+
+func validateCodec(codec string) error {
+	switch strings.ToLower(codec) {
+	case "", CodecRaw, CodecGorilla:
+		return nil
+	default:
+		return fmt.Errorf("Unknown Codec '%v', please use '%v' or '%v'", codec, CodecRaw, CodecGorilla)
+	}
+}
+
+func (t *table) applyCodec(codec string) {
+	t.whereMutex.Lock()
+	t.Codec = codec
+	t.whereMutex.Unlock()
+}
+
+func (t *table) getCodec() string {
+	t.whereMutex.RLock()
+	codec := strings.ToLower(t.Codec)
+	t.whereMutex.RUnlock()
+	return codec
+}
+
+func (t *table) applyCompression(compression string) {
+	t.whereMutex.Lock()
+	t.Compression = compression
+	t.whereMutex.Unlock()
+}
+
+func (t *table) getCompression() string {
+	t.whereMutex.RLock()
+	compression := t.Compression
+	t.whereMutex.RUnlock()
+	return compression
+}
+
+// encodeColumn encodes the given sequence for storage in the filestore,
+// returning the encoded bytes as well as the column length to record for them.
+// If timestamps is non-nil, gorilla encoded columns store their until
+// timestamps relative to the ones previously encoded with it.
+func encodeColumn(codec string, seq encoding.Sequence, width int, timestamps *encoding.DeltaOfDelta) ([]byte, uint64) {
+	if codec == CodecGorilla {
+		encoded, ok := seq.EncodeGorilla(width, timestamps)
+		if ok {
+			colLength := uint64(len(encoded)) | gorillaColumn
+			if timestamps != nil {
+				colLength |= deltaOfDeltaColumn
+			}
+			return encoded, colLength
+		}
+	}
+	return seq, uint64(len(seq))
+}
+
+// columnEncoding describes how a column was encoded by encodeColumn
+type columnEncoding uint64
+
+// decodeColumnLength decodes a column length that was recorded by
+// encodeColumn, returning the actual length in bytes and how the column is
+// encoded.
+func decodeColumnLength(colLength uint64) (int, columnEncoding) {
+	return int(colLength &^ (gorillaColumn | deltaOfDeltaColumn)), columnEncoding(colLength & (gorillaColumn | deltaOfDeltaColumn))
+}
+
+// decode decodes a column that was read using the length from
+// decodeColumnLength. timestamps must be the same (fresh) DeltaOfDelta for all
+// columns that were encoded with the same one.
+func (enc columnEncoding) decode(seq encoding.Sequence, timestamps *encoding.DeltaOfDelta) (encoding.Sequence, error) {
+	if uint64(enc)&gorillaColumn == 0 {
+		return seq, nil
+	}
+	if uint64(enc)&deltaOfDeltaColumn == 0 {
+		timestamps = nil
+	}
+	return encoding.DecodeGorilla(seq, timestamps)
+}
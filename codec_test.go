@@ -0,0 +1,92 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodec(t *testing.T) {
+	assert.NoError(t, validateCodec(""))
+	assert.NoError(t, validateCodec("Gorilla"))
+	assert.Error(t, validateCodec("zip"))
+
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: vtime.NewVirtualClock(epoch),
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	sqlString := "SELECT AVG(load) AS load FROM inbound GROUP BY server, period(1m)"
+	err = db.ApplySchema(Schema{
+		"test_raw": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			SQL:             sqlString,
+		},
+		"test_gorilla": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			SQL:             sqlString,
+			Codec:           CodecGorilla,
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, server := range []string{"a", "b", "c"} {
+		for i := 0; i < 600; i++ {
+			load := 1 + math.Floor(10*math.Sin(float64(i)/60))/10
+			err = db.Insert("inbound", epoch.Add(time.Duration(-i)*time.Minute), map[string]interface{}{"server": server}, map[string]float64{"load": load})
+			if !assert.NoError(t, err) {
+				return
+			}
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	db.FlushAll()
+
+	query := func(table string) map[string]float64 {
+		source, err := db.Query("SELECT load FROM "+table+" ASOF '-12h' GROUP BY server, period(1m)", false, nil, false)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		result := make(map[string]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result[row.Key.Get("server").(string)+" "+time.Unix(0, row.TS).UTC().String()] = row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+	expected := query("test_raw")
+	assert.Len(t, expected, 3*600)
+	assert.Equal(t, expected, query("test_gorilla"), "Gorilla encoded table should return same results as raw table")
+
+	size := func(table string) int64 {
+		fi, err := os.Stat(db.getTable(table).rowStore.fileStore.filename)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		return fi.Size()
+	}
+	rawSize, gorillaSize := size("test_raw"), size("test_gorilla")
+	assert.True(t, gorillaSize < rawSize/2, "Gorilla encoded filestore should be several times smaller, was %d vs %d", gorillaSize, rawSize)
+}
@@ -0,0 +1,183 @@
+package zenodb
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	// ColumnKindDimension marks column usage records for dimensions
+	ColumnKindDimension = "dimension"
+	// ColumnKindField marks column usage records for fields
+	ColumnKindField = "field"
+
+	// columnUsageAll is recorded as the dimension used by queries that group by
+	// all dimensions of a table that itself groups by all dimensions
+	columnUsageAll = "*"
+
+	// columnUsageBacklog is how many usage records can wait to be inserted
+	// before new ones are dropped
+	columnUsageBacklog = 10000
+)
+
+// ColumnUsage records that a query referenced a dimension or field of a table.
+type ColumnUsage struct {
+	TS     time.Time
+	Table  string
+	Column string
+	// Kind is ColumnKindDimension or ColumnKindField
+	Kind string
+}
+
+// columnUsageRecorder inserts the columns referenced by queries into the
+// ColumnUsageStream in the background, so that recording usage doesn't slow
+// down queries. If inserting falls too far behind, records are dropped.
+type columnUsageRecorder struct {
+	db      *DB
+	records chan []*ColumnUsage
+	dropped int64
+	stop    chan interface{}
+	stopped chan interface{}
+}
+
+func (db *DB) initColumnUsage() {
+	if db.opts.ColumnUsageStream == "" {
+		return
+	}
+	r := &columnUsageRecorder{
+		db:      db,
+		records: make(chan []*ColumnUsage, columnUsageBacklog),
+		stop:    make(chan interface{}),
+		stopped: make(chan interface{}),
+	}
+	db.columnUsage = r
+	go r.insert()
+}
+
+// recordColumnUsage records which dimensions and fields of which tables the
+// given query references.
+func (db *DB) recordColumnUsage(sqlString string) {
+	r := db.columnUsage
+	if r == nil {
+		return
+	}
+	q, err := db.parse(sqlString)
+	if err != nil || q.Explain {
+		return
+	}
+	usage := db.columnUsageFor(q, db.clock.Now())
+	if len(usage) == 0 {
+		return
+	}
+	select {
+	case r.records <- usage:
+		// submitted
+	default:
+		if atomic.AddInt64(&r.dropped, 1)%1000 == 1 {
+			log.Errorf("Recording column usage is falling behind, dropped usage of %d queries so far", atomic.LoadInt64(&r.dropped))
+		}
+	}
+}
+
+// columnUsageFor determines the columns that the given query references. It
+// attributes the dimensions referenced in the WHERE, GROUP BY and CROSSTAB
+// clauses at every level of the query to the table at the bottom, along with
+// the fields that the bottom level needs to read from that table.
+func (db *DB) columnUsageFor(q *sql.Query, ts time.Time) []*ColumnUsage {
+	bottom := q
+	for bottom.FromSubQuery != nil {
+		bottom = bottom.FromSubQuery
+	}
+	t := db.getTable(bottom.From)
+	if t == nil {
+		// Unknown or attached table
+		return nil
+	}
+
+	dims := make(map[string]bool)
+	groupByAll := true
+	for current := q; current != nil; current = current.FromSubQuery {
+		if current.Where != nil {
+			current.Where.WalkParams(func(dim string) { dims[dim] = true })
+		}
+		if current.Crosstab != nil {
+			current.Crosstab.WalkParams(func(dim string) { dims[dim] = true })
+		}
+		if !current.GroupByAll {
+			groupByAll = false
+		}
+		for _, groupBy := range current.GroupBy {
+			groupBy.Expr.WalkParams(func(dim string) { dims[dim] = true })
+		}
+	}
+	if groupByAll {
+		// Every dimension of the table is used
+		if t.GroupByAll {
+			dims[columnUsageAll] = true
+		} else {
+			for _, groupBy := range t.GroupBy {
+				dims[groupBy.Name] = true
+			}
+		}
+	}
+
+	var usage []*ColumnUsage
+	names := make([]string, 0, len(dims))
+	for dim := range dims {
+		names = append(names, dim)
+	}
+	sort.Strings(names)
+	for _, dim := range names {
+		usage = append(usage, &ColumnUsage{TS: ts, Table: t.Name, Column: dim, Kind: ColumnKindDimension})
+	}
+
+	fields, err := planner.FieldsNeeded(bottom, t.getFields())
+	if err != nil {
+		log.Debugf("Unable to determine fields used by query: %v", err)
+		return usage
+	}
+	for _, field := range fields {
+		if field.Name == core.PointsField.Name {
+			// Not a real field of the table
+			continue
+		}
+		usage = append(usage, &ColumnUsage{TS: ts, Table: t.Name, Column: field.Name, Kind: ColumnKindField})
+	}
+	return usage
+}
+
+func (r *columnUsageRecorder) insert() {
+	defer close(r.stopped)
+	for {
+		var usage []*ColumnUsage
+		select {
+		case <-r.stop:
+			return
+		case usage = <-r.records:
+		}
+		for _, u := range usage {
+			err := r.db.Insert(r.db.opts.ColumnUsageStream, u.TS, map[string]interface{}{
+				"table_name":  u.Table,
+				"column_name": u.Column,
+				"kind":        u.Kind,
+			}, map[string]float64{
+				"references": 1,
+			})
+			if err != nil {
+				log.Errorf("Unable to insert column usage into stream %v: %v", r.db.opts.ColumnUsageStream, err)
+			}
+		}
+	}
+}
+
+// close stops inserting usage so that nothing is inserted into the
+// ColumnUsageStream while the DB is closing.
+func (r *columnUsageRecorder) close() {
+	close(r.stop)
+	<-r.stopped
+}
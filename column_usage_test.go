@@ -0,0 +1,95 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestColumnUsage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+		ColumnUsageStream:         "column_usage",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i, ii FROM inbound GROUP BY a, b, c, period(1m)",
+		},
+		"usage": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT references FROM column_usage GROUP BY table_name, column_name, kind, period(1h)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	usageFor := func(sqlString string) []*ColumnUsage {
+		q, err := db.parse(sqlString)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return db.columnUsageFor(q, time.Now())
+	}
+	assertUsage := func(sqlString string, expected ...string) {
+		var actual []string
+		for _, u := range usageFor(sqlString) {
+			assert.Equal(t, "test_a", u.Table)
+			actual = append(actual, u.Kind+" "+u.Column)
+		}
+		assert.Equal(t, expected, actual, sqlString)
+	}
+	assertUsage("SELECT i FROM test_a WHERE a = 1 GROUP BY b", "dimension a", "dimension b", "field i")
+	assertUsage("SELECT * FROM test_a", "dimension a", "dimension b", "dimension c", "field i", "field ii")
+	assertUsage("SELECT SUM(i) AS total FROM (SELECT * FROM test_a GROUP BY a, b) GROUP BY a, CROSSTAB(b)", "dimension a", "dimension b", "field i", "field ii")
+	assert.Empty(t, usageFor("SELECT * FROM unknown"))
+
+	now := time.Now()
+	assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"a": 1, "b": 2, "c": 3}, map[string]float64{"i": 1, "ii": 2}))
+	time.Sleep(250 * time.Millisecond)
+
+	query := func(sqlString string) map[string]float64 {
+		source, err := db.Query(sqlString, false, nil, true)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		result := make(map[string]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			kind, _ := row.Key.Get("kind").(string)
+			column, _ := row.Key.Get("column_name").(string)
+			result[kind+" "+column] = row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	query("SELECT i FROM test_a WHERE a = 1 GROUP BY b")
+	query("SELECT i FROM test_a GROUP BY a")
+	query("EXPLAIN SELECT ii FROM test_a GROUP BY c")
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, map[string]float64{
+		"dimension a": 2,
+		"dimension b": 1,
+		"field i":     2,
+	}, query("SELECT references FROM usage WHERE table_name = 'test_a' GROUP BY column_name, kind"))
+	// Wait for usage of the last query to be inserted before closing
+	time.Sleep(250 * time.Millisecond)
+}
@@ -0,0 +1,811 @@
+package zenodb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/compress"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/encryption"
+	"github.com/getlantern/zenodb/wal"
+)
+
+const (
+	// LayoutRow stores the key and all columns of each row together in the
+	// filestore. It's the default.
+	LayoutRow = "row"
+
+	// LayoutColumnar stores the filestore as a columnar segment (see
+	// FileVersionColumnar), so that queries only read the fields they need.
+	LayoutColumnar = "columnar"
+
+	// columnarRowGroupSize is the number of rows in each row group of a
+	// columnar segment
+	columnarRowGroupSize = 8192
+)
+
+var (
+	// columnarMagic marks columnar segments whose footers include a zoneMap for
+	// each row group and the locations of indexes
+	columnarMagic = []byte("ZENOCOL3")
+
+	// columnarMagicV2 marks columnar segments with zone maps but without
+	// indexes
+	columnarMagicV2 = []byte("ZENOCOL2")
+
+	// columnarMagicV1 marks columnar segments without zone maps or indexes
+	columnarMagicV1 = []byte("ZENOCOL1")
+)
+
+func validateLayout(layout string) error {
+	switch strings.ToLower(layout) {
+	case "", LayoutRow, LayoutColumnar:
+		return nil
+	default:
+		return fmt.Errorf("Unknown Layout '%v', please use '%v' or '%v'", layout, LayoutRow, LayoutColumnar)
+	}
+}
+
+func (t *table) applyLayout(layout string) {
+	t.whereMutex.Lock()
+	t.Layout = layout
+	t.whereMutex.Unlock()
+}
+
+func (t *table) getLayout() string {
+	t.whereMutex.RLock()
+	layout := strings.ToLower(t.Layout)
+	t.whereMutex.RUnlock()
+	if layout == "" {
+		return LayoutRow
+	}
+	return layout
+}
+
+// fileVersion returns the file version with which flushes of this table are
+// written, based on its Layout.
+func (t *table) fileVersion() int {
+	if t.getLayout() == LayoutColumnar {
+		return FileVersionColumnar
+	}
+	return CurrentFileVersion
+}
+
+// columnarChunk locates a compressed (and possibly encrypted) chunk of data
+// within a columnar segment.
+type columnarChunk struct {
+	offset uint64
+	length uint64
+}
+
+// columnarColumn is a chunk holding one field's sequences for all rows of a
+// row group, along with the earliest and latest times for which any of those
+// sequences hold data (as unix nanos).
+type columnarColumn struct {
+	columnarChunk
+	minTS int64
+	maxTS int64
+}
+
+type columnarGroup struct {
+	rows    int
+	keys    columnarChunk
+	columns []columnarColumn
+	// zoneMap is nil for segments written before zone maps were introduced
+	zoneMap *zoneMap
+}
+
+// timeRange returns the earliest and latest times for which any of the
+// group's columns hold data.
+func (group *columnarGroup) timeRange() (int64, int64) {
+	minTS, maxTS := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, col := range group.columns {
+		if col.minTS < minTS {
+			minTS = col.minTS
+		}
+		if col.maxTS > maxTS {
+			maxTS = col.maxTS
+		}
+	}
+	return minTS, maxTS
+}
+
+// columnarFooter describes the contents of a columnar segment.
+type columnarFooter struct {
+	offset       wal.Offset
+	fieldsString string
+	dict         *dimensionDictionary
+	groups       []*columnarGroup
+	// indexes locates the index chunk of each indexed dimension
+	indexes map[string]columnarChunk
+}
+
+// A columnar segment (FileVersionColumnar) is laid out as:
+//
+//	magic|group1keys|group1col1|...|group1lastcol|group2keys|...|footer|footerlength|magic
+//
+// Rows are split into row groups of up to columnarRowGroupSize rows. For each
+// row group, the keys (encoded with the segment's dimensionDictionary) are
+// stored in one chunk and the sequences of each field in another. Every chunk
+// (including the footer) is individually compressed with the table's
+// Compression and encrypted with the current key, so that readers can load only
+// the chunks they need.
+//
+// The key chunk contains, per row: keylength (16 bits)|key
+// Column chunks contain, per row: collength (64 bits, see encodeColumn)|col
+//
+// The footer contains the WAL offset, the fields, the dimensionDictionary and
+// the location of each chunk, plus the time range covered by each column
+// chunk and a zoneMap for each row group. It ends with the location of the
+// index chunk for each of the table's Indexes (see columnarIndexBuilder).
+// footerlength is 64 bits.
+//
+// Segments that start and end with columnarMagicV2 don't have indexes and those
+// that start and end with columnarMagicV1 don't have zone maps either.
+type columnarWriter struct {
+	out         io.Writer
+	fields      core.Fields
+	dict        *dimensionDictionary
+	codec       string
+	compression string
+	keyring     *encryption.Keyring
+	resolution  time.Duration
+	position    uint64
+	footer      *columnarFooter
+
+	rows       int
+	keys       *bytes.Buffer
+	columns    []*bytes.Buffer
+	minTS      []int64
+	maxTS      []int64
+	timestamps []encoding.DeltaOfDelta
+	zoneMap    *zoneMapBuilder
+	indexes    []*columnarIndexBuilder
+}
+
+func (fs *fileStore) newColumnarWriter(out io.Writer, fields core.Fields, offset wal.Offset, dict *dimensionDictionary) (*columnarWriter, error) {
+	fieldStrings := make([]string, 0, len(fields))
+	for _, field := range fields {
+		fieldStrings = append(fieldStrings, field.String())
+	}
+	cw := &columnarWriter{
+		out:         out,
+		fields:      fields,
+		dict:        dict,
+		codec:       fs.t.getCodec(),
+		compression: fs.t.getCompression(),
+		keyring:     fs.t.keyring(),
+		resolution:  fs.t.Resolution,
+		footer: &columnarFooter{
+			offset:       offset,
+			fieldsString: strings.Join(fieldStrings, fieldsDelims[FileVersionColumnar]),
+			dict:         dict,
+			indexes:      make(map[string]columnarChunk),
+		},
+	}
+	for _, dim := range fs.t.getIndexes() {
+		cw.indexes = append(cw.indexes, newColumnarIndexBuilder(dim))
+	}
+	if cw.footer.offset == nil {
+		cw.footer.offset = emptyOffset
+	}
+	cw.resetGroup()
+	_, err := out.Write(columnarMagic)
+	if err != nil {
+		return nil, errors.New("Unable to write magic: %v", err)
+	}
+	cw.position = uint64(len(columnarMagic))
+	return cw, nil
+}
+
+func (cw *columnarWriter) resetGroup() {
+	cw.rows = 0
+	cw.keys = &bytes.Buffer{}
+	cw.zoneMap = newZoneMapBuilder()
+	cw.columns = make([]*bytes.Buffer, len(cw.fields))
+	cw.minTS = make([]int64, len(cw.fields))
+	cw.maxTS = make([]int64, len(cw.fields))
+	cw.timestamps = make([]encoding.DeltaOfDelta, len(cw.fields))
+	for i := range cw.fields {
+		cw.columns[i] = &bytes.Buffer{}
+		cw.minTS[i] = math.MaxInt64
+		cw.maxTS[i] = math.MinInt64
+	}
+}
+
+// write adds a row to the current row group, writing out the row group once
+// it's full.
+func (cw *columnarWriter) write(key bytemap.ByteMap, columns []encoding.Sequence) error {
+	encodedKey := cw.dict.encodeKey(key)
+	binary.Write(cw.keys, encoding.Binary, uint16(len(encodedKey)))
+	cw.keys.Write(encodedKey)
+	cw.zoneMap.addKey(key)
+	ref := columnarRowRef{group: uint32(len(cw.footer.groups)), row: uint32(cw.rows)}
+	for _, index := range cw.indexes {
+		index.addKey(key, ref)
+	}
+	for i, seq := range columns {
+		width := cw.fields[i].Expr.EncodedWidth()
+		encoded, colLength := encodeColumn(cw.codec, seq, width, &cw.timestamps[i])
+		binary.Write(cw.columns[i], encoding.Binary, colLength)
+		cw.columns[i].Write(encoded)
+		if seq == nil {
+			continue
+		}
+		if minTS := seq.AsOf(width, cw.resolution).UnixNano(); minTS < cw.minTS[i] {
+			cw.minTS[i] = minTS
+		}
+		if maxTS := seq.UntilInt(); maxTS > cw.maxTS[i] {
+			cw.maxTS[i] = maxTS
+		}
+	}
+	cw.rows++
+	if cw.rows >= columnarRowGroupSize {
+		return cw.writeGroup()
+	}
+	return nil
+}
+
+func (cw *columnarWriter) writeGroup() error {
+	if cw.rows == 0 {
+		return nil
+	}
+	group := &columnarGroup{
+		rows:    cw.rows,
+		columns: make([]columnarColumn, len(cw.columns)),
+		zoneMap: cw.zoneMap.build(),
+	}
+	var err error
+	group.keys, err = cw.writeChunk(cw.keys.Bytes())
+	if err != nil {
+		return err
+	}
+	for i, col := range cw.columns {
+		group.columns[i].columnarChunk, err = cw.writeChunk(col.Bytes())
+		if err != nil {
+			return err
+		}
+		group.columns[i].minTS = cw.minTS[i]
+		group.columns[i].maxTS = cw.maxTS[i]
+	}
+	cw.footer.groups = append(cw.footer.groups, group)
+	cw.resetGroup()
+	return nil
+}
+
+func (cw *columnarWriter) writeChunk(data []byte) (columnarChunk, error) {
+	compressed, err := compress.Encode(cw.compression, data)
+	if err != nil {
+		return columnarChunk{}, errors.New("Unable to compress chunk: %v", err)
+	}
+	sealed, err := cw.keyring.Seal(compressed)
+	if err != nil {
+		return columnarChunk{}, errors.New("Unable to encrypt chunk: %v", err)
+	}
+	_, err = cw.out.Write(sealed)
+	if err != nil {
+		return columnarChunk{}, errors.New("Unable to write chunk: %v", err)
+	}
+	chunk := columnarChunk{offset: cw.position, length: uint64(len(sealed))}
+	cw.position += chunk.length
+	return chunk, nil
+}
+
+// Close writes out the last row group, the indexes and the footer. It does not
+// close the underlying writer.
+func (cw *columnarWriter) Close() error {
+	err := cw.writeGroup()
+	if err != nil {
+		return err
+	}
+	for _, index := range cw.indexes {
+		if index.unindexed {
+			continue
+		}
+		cw.footer.indexes[index.dim], err = cw.writeChunk(index.encode())
+		if err != nil {
+			return errors.New("Unable to write index on %v: %v", index.dim, err)
+		}
+	}
+	footer, err := cw.footer.encode()
+	if err != nil {
+		return err
+	}
+	chunk, err := cw.writeChunk(footer)
+	if err != nil {
+		return errors.New("Unable to write footer: %v", err)
+	}
+	trailer := make([]byte, encoding.Width64bits+len(columnarMagic))
+	encoding.Binary.PutUint64(trailer, chunk.length)
+	copy(trailer[encoding.Width64bits:], columnarMagic)
+	_, err = cw.out.Write(trailer)
+	if err != nil {
+		return errors.New("Unable to write trailer: %v", err)
+	}
+	return nil
+}
+
+func (f *columnarFooter) encode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.Write(f.offset)
+	binary.Write(buf, encoding.Binary, uint32(len(f.fieldsString)))
+	buf.WriteString(f.fieldsString)
+	err := f.dict.write(buf)
+	if err != nil {
+		return nil, errors.New("Unable to write dictionary: %v", err)
+	}
+	binary.Write(buf, encoding.Binary, uint32(len(f.groups)))
+	for _, group := range f.groups {
+		binary.Write(buf, encoding.Binary, uint32(group.rows))
+		binary.Write(buf, encoding.Binary, group.keys.offset)
+		binary.Write(buf, encoding.Binary, group.keys.length)
+		binary.Write(buf, encoding.Binary, uint16(len(group.columns)))
+		for _, col := range group.columns {
+			binary.Write(buf, encoding.Binary, col.offset)
+			binary.Write(buf, encoding.Binary, col.length)
+			binary.Write(buf, encoding.Binary, col.minTS)
+			binary.Write(buf, encoding.Binary, col.maxTS)
+		}
+		group.zoneMap.write(buf)
+	}
+	dims := make([]string, 0, len(f.indexes))
+	for dim := range f.indexes {
+		dims = append(dims, dim)
+	}
+	sort.Strings(dims)
+	binary.Write(buf, encoding.Binary, uint16(len(dims)))
+	for _, dim := range dims {
+		chunk := f.indexes[dim]
+		binary.Write(buf, encoding.Binary, uint16(len(dim)))
+		buf.WriteString(dim)
+		binary.Write(buf, encoding.Binary, chunk.offset)
+		binary.Write(buf, encoding.Binary, chunk.length)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeColumnarFooter(b []byte, hasZoneMaps bool, hasIndexes bool) (*columnarFooter, error) {
+	if len(b) < wal.OffsetSize {
+		return nil, errors.New("Footer too short")
+	}
+	f := &columnarFooter{offset: wal.Offset(b[:wal.OffsetSize])}
+	r := bytes.NewReader(b[wal.OffsetSize:])
+	fieldsLength := uint32(0)
+	err := binary.Read(r, encoding.Binary, &fieldsLength)
+	if err != nil {
+		return nil, errors.New("Unable to read fields length: %v", err)
+	}
+	fieldsBytes := make([]byte, fieldsLength)
+	_, err = io.ReadFull(r, fieldsBytes)
+	if err != nil {
+		return nil, errors.New("Unable to read fields: %v", err)
+	}
+	f.fieldsString = string(fieldsBytes)
+	f.dict, err = readDimensionDictionary(r)
+	if err != nil {
+		return nil, err
+	}
+	numGroups := uint32(0)
+	err = binary.Read(r, encoding.Binary, &numGroups)
+	if err != nil {
+		return nil, errors.New("Unable to read number of row groups: %v", err)
+	}
+	for i := uint32(0); i < numGroups; i++ {
+		var rows uint32
+		var numColumns uint16
+		group := &columnarGroup{}
+		for _, v := range []interface{}{&rows, &group.keys.offset, &group.keys.length, &numColumns} {
+			err = binary.Read(r, encoding.Binary, v)
+			if err != nil {
+				return nil, errors.New("Unable to read row group: %v", err)
+			}
+		}
+		group.rows = int(rows)
+		group.columns = make([]columnarColumn, numColumns)
+		for j := range group.columns {
+			col := &group.columns[j]
+			for _, v := range []interface{}{&col.offset, &col.length, &col.minTS, &col.maxTS} {
+				err = binary.Read(r, encoding.Binary, v)
+				if err != nil {
+					return nil, errors.New("Unable to read column: %v", err)
+				}
+			}
+		}
+		if hasZoneMaps {
+			group.zoneMap, err = readZoneMap(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		f.groups = append(f.groups, group)
+	}
+	f.indexes = make(map[string]columnarChunk)
+	if !hasIndexes {
+		return f, nil
+	}
+	var numIndexes uint16
+	err = binary.Read(r, encoding.Binary, &numIndexes)
+	if err != nil {
+		return nil, errors.New("Unable to read number of indexes: %v", err)
+	}
+	for i := uint16(0); i < numIndexes; i++ {
+		var dimLength uint16
+		err = binary.Read(r, encoding.Binary, &dimLength)
+		if err != nil {
+			return nil, errors.New("Unable to read index dimension length: %v", err)
+		}
+		dim := make([]byte, dimLength)
+		_, err = io.ReadFull(r, dim)
+		if err != nil {
+			return nil, errors.New("Unable to read index dimension: %v", err)
+		}
+		var chunk columnarChunk
+		for _, v := range []interface{}{&chunk.offset, &chunk.length} {
+			err = binary.Read(r, encoding.Binary, v)
+			if err != nil {
+				return nil, errors.New("Unable to read index location: %v", err)
+			}
+		}
+		f.indexes[string(dim)] = chunk
+	}
+	return f, nil
+}
+
+// columnarReader reads chunks from a columnar segment.
+type columnarReader struct {
+	file    *os.File
+	keyring *encryption.Keyring
+	footer  *columnarFooter
+	// footerChunk is the footer as stored in the file, used to determine which
+	// key the segment is encrypted with
+	footerChunk []byte
+}
+
+func openColumnar(keyring *encryption.Keyring, filename string) (*columnarReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newColumnarReader(keyring, file)
+}
+
+// newColumnarReader returns a reader for the given columnar segment, which it
+// closes on error.
+func newColumnarReader(keyring *encryption.Keyring, file *os.File) (*columnarReader, error) {
+	cr := &columnarReader{file: file, keyring: keyring}
+	err := cr.readFooter()
+	if err != nil {
+		file.Close()
+		return nil, errors.New("Unable to read columnar segment %v: %v", file.Name(), err)
+	}
+	return cr, nil
+}
+
+func (cr *columnarReader) readFooter() error {
+	fi, err := cr.file.Stat()
+	if err != nil {
+		return err
+	}
+	trailerLength := int64(encoding.Width64bits + len(columnarMagic))
+	if fi.Size() < int64(len(columnarMagic))+trailerLength {
+		return errors.New("File too short")
+	}
+	trailer := make([]byte, trailerLength)
+	_, err = cr.file.ReadAt(trailer, fi.Size()-trailerLength)
+	if err != nil {
+		return err
+	}
+	magic := trailer[encoding.Width64bits:]
+	hasIndexes := bytes.Equal(magic, columnarMagic)
+	hasZoneMaps := hasIndexes || bytes.Equal(magic, columnarMagicV2)
+	if !hasZoneMaps && !bytes.Equal(magic, columnarMagicV1) {
+		return errors.New("Missing magic, file is incomplete")
+	}
+	footerLength := encoding.Binary.Uint64(trailer)
+	if int64(footerLength) > fi.Size()-trailerLength {
+		return errors.New("Invalid footer length %d", footerLength)
+	}
+	chunk := columnarChunk{offset: uint64(fi.Size()-trailerLength) - footerLength, length: footerLength}
+	cr.footerChunk = make([]byte, chunk.length)
+	_, err = cr.file.ReadAt(cr.footerChunk, int64(chunk.offset))
+	if err != nil {
+		return err
+	}
+	b, err := cr.decode(cr.footerChunk)
+	if err != nil {
+		return err
+	}
+	cr.footer, err = decodeColumnarFooter(b, hasZoneMaps, hasIndexes)
+	return err
+}
+
+func (cr *columnarReader) readChunk(chunk columnarChunk) ([]byte, error) {
+	b := make([]byte, chunk.length)
+	_, err := cr.file.ReadAt(b, int64(chunk.offset))
+	if err != nil {
+		return nil, errors.New("Unable to read chunk: %v", err)
+	}
+	return cr.decode(b)
+}
+
+func (cr *columnarReader) decode(b []byte) ([]byte, error) {
+	b, err := cr.keyring.Open(b)
+	if err != nil {
+		return nil, err
+	}
+	return compress.Decode(b)
+}
+
+// readKeys reads and decodes the keys of all rows in the given row group.
+func (cr *columnarReader) readKeys(group *columnarGroup) ([]bytemap.ByteMap, error) {
+	b, err := cr.readChunk(group.keys)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]bytemap.ByteMap, 0, group.rows)
+	for i := 0; i < group.rows; i++ {
+		if len(b) < encoding.Width16bits {
+			return nil, errors.New("Not enough data left to decode key length")
+		}
+		keyLength, remain := encoding.ReadInt16(b)
+		if keyLength > len(remain) {
+			return nil, errors.New("Not enough data left to decode key, wanted %d have %d", keyLength, len(remain))
+		}
+		key, err := cr.footer.dict.decodeKey(remain[:keyLength])
+		if err != nil {
+			return nil, errors.New("Unable to decode key: %v", err)
+		}
+		keys = append(keys, key)
+		b = remain[keyLength:]
+	}
+	return keys, nil
+}
+
+// readColumn reads and decodes the sequences of all rows in the given column of
+// the given row group.
+func (cr *columnarReader) readColumn(group *columnarGroup, i int) ([]encoding.Sequence, error) {
+	b, err := cr.readChunk(group.columns[i].columnarChunk)
+	if err != nil {
+		return nil, err
+	}
+	seqs := make([]encoding.Sequence, 0, group.rows)
+	var timestamps encoding.DeltaOfDelta
+	for j := 0; j < group.rows; j++ {
+		if len(b) < encoding.Width64bits {
+			return nil, errors.New("Not enough data left to decode column length!")
+		}
+		colLength, colEncoding := decodeColumnLength(encoding.Binary.Uint64(b))
+		b = b[encoding.Width64bits:]
+		if colLength > len(b) {
+			return nil, errors.New("Not enough data left to decode column, wanted %d have %d", colLength, len(b))
+		}
+		var seq encoding.Sequence
+		seq, b = encoding.ReadSequence(b, colLength)
+		seq, err = colEncoding.decode(seq, &timestamps)
+		if err != nil {
+			return nil, errors.New("Unable to decode gorilla encoded column: %v", err)
+		}
+		seqs = append(seqs, seq)
+	}
+	return seqs, nil
+}
+
+// keyID returns the id of the key with which the segment is encrypted.
+func (cr *columnarReader) keyID() (uint32, bool) {
+	return encryption.KeyIDOf(cr.footerChunk)
+}
+
+func (cr *columnarReader) Close() error {
+	return cr.file.Close()
+}
+
+// flushColumnar is like flush, but writes a columnar segment. Raw rows are
+// never passed through and rows aren't sorted.
+func (fs *fileStore) flushColumnar(out *os.File, fields core.Fields, offset wal.Offset, ms *memstore) (int64, int64) {
+	// Keys are encoded as rows are written, so columnar segments extend the
+	// dictionary of the previous segment rather than rebuilding it
+	dict, err := fs.dictionaryFor(ms)
+	if err != nil {
+		fs.t.log.Errorf("Unable to build dictionary, writing without one: %v", err)
+		dict = newDimensionDictionary()
+	}
+	cw, err := fs.newColumnarWriter(out, fields, offset, dict)
+	if err != nil {
+		panic(err)
+	}
+
+	highWaterMark := int64(0)
+	rows := int64(0)
+	truncateBefore := fs.t.truncateBefore()
+	_, err = fs.iterate(fields, ms, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		hasActiveSequence := false
+		for i, seq := range columns {
+			seq = seq.Truncate(fields[i].Expr.EncodedWidth(), fs.t.Resolution, truncateBefore, time.Time{})
+			columns[i] = seq
+			if seq != nil {
+				hasActiveSequence = true
+				if ts := seq.UntilInt(); ts > highWaterMark {
+					highWaterMark = ts
+				}
+			}
+		}
+		if !hasActiveSequence {
+			// all encoding.Sequences expired, remove key
+			return true, nil
+		}
+		rows++
+		return true, cw.write(key, columns)
+	})
+	if err != nil {
+		panic(err)
+	}
+	err = cw.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	return highWaterMark, rows
+}
+
+// iterateColumnar iterates over the rows of a columnar segment, reading only
+// the columns that map to outFields. Columns whose data has all fallen out of
+// the retention period or that the filters exclude are skipped without being
+// read, as are row groups for which none of the needed columns have any data
+// and row groups that the filters exclude. If the segment is indexed on
+// dimensions that the filters require to equal some value, only the rows that
+// the indexes point to are read.
+func (fs *fileStore) iterateColumnar(ctx int64, filters segmentFilters, outFields core.Fields, ms *memstore, memToOut func(out []encoding.Sequence, i int, seq encoding.Sequence) bool, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (more bool, err error)) (time.Time, error) {
+	var highWaterMark time.Time
+	cr, err := openColumnar(fs.t.keyring(), fs.filename)
+	if err != nil {
+		return highWaterMark, log.Error(err)
+	}
+	defer cr.Close()
+
+	highWaterMark = cr.footer.offset.TS()
+	log.Debugf("Set highWaterMark from data file: %v", highWaterMark)
+	fileFields := fs.parseFields(cr.footer.fieldsString, fieldsDelims[FileVersionColumnar])
+	outIdxs := outIdxsFor(outFields, fileFields)
+	truncateBefore := fs.t.truncateBefore().UnixNano()
+	indexedRows, err := filters.indexedRows(cr)
+	if err != nil {
+		return highWaterMark, log.Errorf("Unable to use indexes: %v", err)
+	}
+
+	for g, group := range cr.footer.groups {
+		if len(group.columns) != len(fileFields) {
+			return highWaterMark, log.Errorf("Row group has %d columns, expected %d", len(group.columns), len(fileFields))
+		}
+		var rowsToRead []int
+		if indexedRows != nil {
+			rowsToRead = indexedRows[g]
+			if len(rowsToRead) == 0 {
+				// None of the needed rows are in this group. Any corresponding rows
+				// in the memstore are still returned when walking the memstore.
+				continue
+			}
+		}
+		if filters.excludesGroup(group) {
+			// Any corresponding rows in the memstore are still returned when
+			// walking the memstore.
+			continue
+		}
+		columns := make([][]encoding.Sequence, len(fileFields))
+		includesAtLeastOneColumn := false
+		for i, col := range group.columns {
+			if outIdxs[i] < 0 || col.maxTS < truncateBefore || filters.excludesTime(col.minTS, col.maxTS) {
+				continue
+			}
+			columns[i], err = cr.readColumn(group, i)
+			if err != nil {
+				return highWaterMark, log.Errorf("Unable to read column %v: %v", fileFields[i].Name, err)
+			}
+			includesAtLeastOneColumn = true
+		}
+		if !includesAtLeastOneColumn {
+			// Nothing to read here. Any corresponding rows in the memstore are
+			// still returned when walking the memstore.
+			continue
+		}
+
+		keys, err := cr.readKeys(group)
+		if err != nil {
+			return highWaterMark, log.Errorf("Unable to read keys: %v", err)
+		}
+		if rowsToRead == nil {
+			rowsToRead = make([]int, len(keys))
+			for r := range rowsToRead {
+				rowsToRead[r] = r
+			}
+		}
+		for _, r := range rowsToRead {
+			if r >= len(keys) {
+				return highWaterMark, log.Errorf("Index refers to row %d of a row group with only %d rows", r, len(keys))
+			}
+			key := keys[r]
+			var msColumns []encoding.Sequence
+			if ms != nil {
+				msColumns = ms.tree.Remove(ctx, key)
+			}
+
+			rowHasColumn := false
+			out := make([]encoding.Sequence, len(outFields))
+			for i, column := range columns {
+				if column == nil || column[r] == nil {
+					continue
+				}
+				out[outIdxs[i]] = column[r]
+				rowHasColumn = true
+			}
+
+			// Merge memStore columns into fileStore columns
+			for i, msColumn := range msColumns {
+				if memToOut(out, i, msColumn) {
+					rowHasColumn = true
+				}
+			}
+
+			if !rowHasColumn {
+				continue
+			}
+			more, err := onRow(key, out, nil)
+			if err != nil {
+				log.Errorf("Error processing row: %v", err)
+			}
+			if !more || err != nil {
+				return highWaterMark, err
+			}
+		}
+	}
+
+	return highWaterMark, nil
+}
+
+// columnarInfo is like fileStore.info for columnar segments.
+func (fs *fileStore) columnarInfo(keyring *encryption.Keyring) (time.Time, string, core.Fields, error) {
+	cr, err := openColumnar(keyring, fs.filename)
+	if err != nil {
+		return time.Time{}, "", nil, err
+	}
+	defer cr.Close()
+	fieldsString := cr.footer.fieldsString
+	return cr.footer.offset.TS(), fieldsString, fs.parseFields(fieldsString, fieldsDelims[FileVersionColumnar]), nil
+}
+
+// checkColumnar checks that all chunks of the given columnar segment can be
+// read.
+func checkColumnar(keyring *encryption.Keyring, filename string) error {
+	cr, err := openColumnar(keyring, filename)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	for _, group := range cr.footer.groups {
+		_, err = cr.readKeys(group)
+		if err != nil {
+			return err
+		}
+		for i := range group.columns {
+			_, err = cr.readColumn(group, i)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isColumnar indicates whether the given filestore file is a columnar segment.
+func isColumnar(filename string) bool {
+	return versionFor(filename) == FileVersionColumnar
+}
@@ -0,0 +1,189 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestColumnar(t *testing.T) {
+	assert.NoError(t, validateLayout(""))
+	assert.NoError(t, validateLayout("Columnar"))
+	assert.Error(t, validateLayout("diagonal"))
+
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	keys := map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: vtime.NewVirtualClock(epoch),
+		EncryptionKeys: func() (map[uint32][]byte, error) {
+			return keys, nil
+		},
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	sqlString := "SELECT SUM(a) AS a, SUM(b) AS b FROM inbound GROUP BY server, dc, period(1h)"
+	schema := Schema{
+		"test_row": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			SQL:             sqlString,
+		},
+		"test_columnar": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			SQL:             sqlString,
+			Layout:          LayoutColumnar,
+			Codec:           CodecGorilla,
+		},
+	}
+	if !assert.NoError(t, db.ApplySchema(schema)) {
+		return
+	}
+
+	// Enough servers to fill more than one row group
+	numServers := columnarRowGroupSize + 100
+	insert := func(ts time.Time, from int, to int) {
+		for i := from; i < to; i++ {
+			err := db.Insert("inbound", ts, map[string]interface{}{"server": fmt.Sprintf("server%d", i), "dc": "dc1"}, map[string]float64{"a": float64(i), "b": 1})
+			if !assert.NoError(t, err) {
+				return
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+		db.FlushAll()
+	}
+
+	query := func(table string) map[string][]float64 {
+		source, err := db.Query("SELECT * FROM "+table+" ASOF '-12h' GROUP BY server, period(1h)", false, nil, false)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		result := make(map[string][]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result[row.Key.Get("server").(string)+" "+time.Unix(0, row.TS).UTC().String()] = append([]float64{}, row.Values...)
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	filename := func(table string) string {
+		return db.getTable(table).rowStore.fileStore.filename
+	}
+
+	insert(epoch.Add(-2*time.Hour), 0, numServers)
+	// Second flush merges into the existing columnar segment
+	insert(epoch.Add(-1*time.Hour), numServers/2, numServers)
+
+	assert.Equal(t, FileVersionColumnar, versionFor(filename("test_columnar")))
+	assert.Equal(t, CurrentFileVersion, versionFor(filename("test_row")))
+	expected := query("test_row")
+	assert.Len(t, expected, numServers+numServers/2)
+	assert.Equal(t, expected, query("test_columnar"), "Columnar table should return same results as row table")
+
+	cr, err := openColumnar(db.keyring, filename("test_columnar"))
+	if assert.NoError(t, err) {
+		assert.Len(t, cr.footer.groups, 2)
+		assert.Equal(t, numServers, cr.footer.groups[0].rows+cr.footer.groups[1].rows)
+		col := cr.footer.groups[0].columns[0]
+		assert.True(t, col.minTS <= epoch.Add(-2*time.Hour).UnixNano())
+		assert.True(t, col.maxTS >= epoch.Add(-1*time.Hour).UnixNano())
+		cr.Close()
+	}
+
+	// Only read the requested column
+	tbl := db.getTable("test_columnar")
+	b := tbl.getFields()[1]
+	rows := 0
+	_, err = tbl.rowStore.fileStore.iterate(core.Fields{b}, nil, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		rows++
+		assert.Len(t, columns, 1)
+		assert.NotNil(t, columns[0])
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, numServers, rows)
+
+	// Skip row groups that zone maps exclude
+	iterateFiltered := func(filter *segmentFilter) (int, int) {
+		rows, matching := 0, 0
+		_, err := tbl.rowStore.fileStore.iterateFiltered(segmentFilters{filter}, core.Fields{b}, nil, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			rows++
+			if key.Get("server") == "server5" {
+				matching++
+			}
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return rows, matching
+	}
+	rows, matching := iterateFiltered(newSegmentFilter(epoch.Add(-3*time.Hour), epoch, map[string]string{"server": "server5"}))
+	assert.Equal(t, 1, matching)
+	assert.True(t, rows <= columnarRowGroupSize, "should have skipped row group without server5")
+	rows, _ = iterateFiltered(newSegmentFilter(epoch.Add(-3*time.Hour), epoch, map[string]string{"server": "server5", "dc": "dc2"}))
+	assert.Zero(t, rows, "should have skipped row groups without dc2")
+	rows, _ = iterateFiltered(newSegmentFilter(epoch.Add(time.Hour), epoch.Add(2*time.Hour), nil))
+	assert.Zero(t, rows, "should have skipped row groups outside of time range")
+	rows, _ = iterateFiltered(newSegmentFilter(epoch.Add(-3*time.Hour), epoch, nil))
+	assert.Equal(t, numServers, rows)
+
+	whereQuery := func(table string) map[string][]float64 {
+		source, err := db.Query("SELECT * FROM "+table+" ASOF '-12h' WHERE server = 'server5000' AND dc = 'dc1' GROUP BY server, period(1h)", false, nil, false)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		result := make(map[string][]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result[row.Key.Get("server").(string)+" "+time.Unix(0, row.TS).UTC().String()] = append([]float64{}, row.Values...)
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+	expected = whereQuery("test_row")
+	assert.Len(t, expected, 2)
+	assert.Equal(t, expected, whereQuery("test_columnar"), "Pruned columnar table should return same results as row table")
+
+	highWaterMark, fieldsString, _, err := FileInfo(db.keyring, filename("test_columnar"))
+	if assert.NoError(t, err) {
+		assert.Contains(t, fieldsString, "b")
+		assert.False(t, highWaterMark.IsZero())
+	}
+	assert.Empty(t, Check(db.keyring, filename("test_columnar")))
+	offset, _, err := readWALOffset(db.keyring, filename("test_columnar"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, highWaterMark, offset.TS())
+	}
+	dict, err := tbl.rowStore.fileStore.readDictionary()
+	if assert.NoError(t, err) {
+		assert.Len(t, dict.ids["dc"], 1)
+	}
+
+	// Switching back to the row layout rewrites the data on the next flush
+	schema["test_columnar"].Layout = LayoutRow
+	if !assert.NoError(t, db.ApplySchema(schema)) {
+		return
+	}
+	insert(epoch.Add(-1*time.Hour), 0, 1)
+	assert.Equal(t, CurrentFileVersion, versionFor(filename("test_columnar")))
+	assert.Equal(t, query("test_row"), query("test_columnar"), "Table converted back to rows should return same results as row table")
+}
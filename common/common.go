@@ -6,13 +6,16 @@ import (
 	"time"
 
 	"github.com/getlantern/bytemap"
-	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/wal"
 
 	"github.com/getlantern/zenodb/encoding"
 )
 
 const (
 	keyIncludeMemStore = "zenodb.includeMemStore"
+	keyCaller          = "zenodb.caller"
+	keyPrincipal       = "zenodb.principal"
+	keyRequestID       = "zenodb.requestID"
 
 	nanosPerMilli = 1000000
 )
@@ -25,6 +28,10 @@ type Partition struct {
 type PartitionTable struct {
 	Name   string
 	Offset wal.Offset
+	// Filter is an optional WHERE condition that the leader evaluates in
+	// addition to the table's WHERE clause, so that it only sends the follower
+	// the entries that it needs.
+	Filter string
 }
 
 type Follow struct {
@@ -32,6 +39,128 @@ type Follow struct {
 	EarliestOffset  wal.Offset
 	PartitionNumber int
 	Partitions      map[string]*Partition
+	// FollowerName identifies the follower to the leader
+	FollowerName string
+	// FollowerToken authenticates the follower identified by FollowerName
+	FollowerToken string
+	// FollowerID persistently identifies the follower's node, even across
+	// restarts, so that the leader can recognize a follower that reconnects.
+	FollowerID string
+	// LeaderID identifies the leader in whose WAL the offsets of this Follow are
+	// expressed. When a follower fails over to a different leader, that leader
+	// uses this to translate the offsets into its own WAL.
+	LeaderID string
+	// NumPartitions and ConsistentPartitioning describe how the follower
+	// partitions data, which needs to match the leader.
+	NumPartitions          int
+	ConsistentPartitioning bool
+	// Incarnation identifies the follower's current data, which changes when
+	// it's restored from a backup.
+	Incarnation string
+	// SentAt is the time on the follower's clock when it sent this Follow,
+	// used to detect clock skew.
+	SentAt time.Time
+	// TraceContext links the leader's span for this Follow to the follower's.
+	TraceContext TraceContext
+	// BatchSize, if positive, asks the leader to send entries in compressed
+	// batches of about this many bytes instead of one at a time. Leaders that
+	// don't support batching ignore it and send individual entries.
+	BatchSize int
+	// BatchInterval caps how long the leader holds on to entries before
+	// sending an incomplete batch.
+	BatchInterval time.Duration
+	// BatchCompression is the algorithm with which the leader compresses
+	// batches, see package compress.
+	BatchCompression string
+	// Credits, if positive, enables credit-based flow control. The follower
+	// initially grants the leader this many entries and grants more as it
+	// applies them. The leader stops sending once it runs out of credits and
+	// holds at most this many entries in memory for the follower.
+	Credits int
+}
+
+// FollowEntry is an entry from a leader's WAL that's being sent to a
+// follower. Its data is shared with other followers and only valid until the
+// callback to which it was passed returns, unless the callback retains it, in
+// which case the data stays valid until the matching Release.
+type FollowEntry interface {
+	Data() []byte
+	Offset() wal.Offset
+	Retain()
+	Release()
+}
+
+// FollowAck acknowledges that a follower has durably applied all entries
+// through the given offsets, keyed by table name.
+type FollowAck struct {
+	Stream          string
+	PartitionNumber int
+	FollowerName    string
+	FollowerToken   string
+	// FollowerID is the follower's persistent id (see Follow.FollowerID)
+	FollowerID string
+	// LeaderID identifies the leader in whose WAL the Offsets are expressed.
+	LeaderID               string
+	Incarnation            string
+	NumPartitions          int
+	ConsistentPartitioning bool
+	Offsets                map[string]wal.Offset
+	// SentAt is the time on the follower's clock when it sent this ack.
+	SentAt time.Time
+}
+
+// PartitionMap is an exportable document describing a leader's replication
+// state: which followers follow which partitions of which streams and the
+// offsets through which they've acknowledged applying entries. Importing it on
+// a replacement leader lets followers resume from their acknowledged offsets.
+type PartitionMap struct {
+	// LeaderID is the NodeID of the leader that exported the map, in whose WAL
+	// the offsets are expressed.
+	LeaderID               string
+	NumPartitions          int
+	ConsistentPartitioning bool
+	ExportedAt             time.Time
+	Followers              []*FollowerAssignment
+	// RevokedFollowers are the names of followers that may not follow.
+	RevokedFollowers []string
+}
+
+// FollowerAssignment describes a single follower's partition of a stream
+// within a PartitionMap.
+type FollowerAssignment struct {
+	FollowerName    string
+	FollowerID      string
+	Stream          string
+	PartitionNumber int
+	// Incarnation, NumPartitions and ConsistentPartitioning are as reported by
+	// the follower when it acknowledged the Offsets.
+	Incarnation            string
+	NumPartitions          int
+	ConsistentPartitioning bool
+	// Offsets are the acknowledged offsets, keyed by table name.
+	Offsets map[string]wal.Offset
+	// Connected indicates that the follower was following when the map was
+	// exported.
+	Connected bool
+}
+
+// SnapshotRequest is a request from a brand-new follower to an existing
+// replica of its partition for a snapshot of a table's data.
+type SnapshotRequest struct {
+	Table                  string
+	Partition              int
+	NumPartitions          int
+	ConsistentPartitioning bool
+	FollowerName           string
+	FollowerToken          string
+}
+
+// Replicate is a request from one passthrough node to another to receive the
+// locally originated WAL entries for a stream.
+type Replicate struct {
+	Stream string
+	Since  wal.Offset
+	NodeID string
 }
 
 type QueryRemote func(sqlString string, includeMemStore bool, isSubQuery bool, subQueryResults [][]interface{}, onValue func(bytemap.ByteMap, []encoding.Sequence)) (hasReadResult bool, err error)
@@ -42,6 +171,39 @@ type QueryMetaData struct {
 	Until      time.Time
 	Resolution time.Duration
 	Plan       string
+	// QueryID identifies the running query so that it can be cancelled.
+	QueryID string
+	// Fields describes each of the fields in FieldNames, in the same order.
+	Fields []*FieldMetaData
+}
+
+// FieldMetaData describes a field (column) of query results so that clients can
+// format and further aggregate its values without knowing the query.
+type FieldMetaData struct {
+	Name string
+	// Type is the data type of the field's values, float64, int64 or bool (see
+	// expr.TypeOf).
+	Type string
+	// Unit is the unit of the field's values, like ms or bytes, if known.
+	Unit string
+	// Expr is the expression that computes the field from the fields of the
+	// underlying stream, for example SUM(requests).
+	Expr string
+	// Aggregate is the outermost aggregate of Expr (SUM, COUNT, MIN, MAX, AVG
+	// or PERCENTILE), or empty if the field is calculated from other
+	// aggregates.
+	Aggregate string
+	// Additive indicates that values of the field for different groups can be
+	// summed to obtain the value for the combined group.
+	Additive bool
+}
+
+// PreparedQuery identifies a query with ? placeholders that's been prepared so
+// that it can be run repeatedly with different params.
+type PreparedQuery struct {
+	ID        string
+	SQL       string
+	NumParams int
 }
 
 // QueryStats captures stats about query
@@ -51,6 +213,62 @@ type QueryStats struct {
 	LowestHighWaterMark     int64
 	HighestHighWaterMark    int64
 	MissingPartitions       []int
+	// RowsScanned and EstimatedMemory report the rows that the query scanned
+	// and an estimate of the memory (in bytes) that they took up.
+	RowsScanned     int64
+	EstimatedMemory int64
+	// LimitExceeded names the resource limit that stopped the query early, if
+	// any, in which case the results are partial.
+	LimitExceeded string
+	// Warnings describe soft limits that the query exceeded. The results are
+	// complete, but the query would fail if the corresponding hard limits were
+	// tightened to the soft limits.
+	Warnings []string `json:",omitempty"`
+	// Clamped indicates that the query asked for data outside of the time range
+	// that the queried table retains and was clamped to that range.
+	// RequestedAsOf and RequestedUntil are the ASOF and UNTIL that the query
+	// asked for, or zero for ends that weren't clamped. The results (and the
+	// AsOf and Until in the QueryMetaData) cover only the retained range.
+	Clamped        bool
+	RequestedAsOf  time.Time
+	RequestedUntil time.Time
+}
+
+// TableStats presents statistics for a given table. The point counts are only
+// since the last time the database process was started. The storage stats
+// describe the table's memstore and filestore as of now.
+type TableStats struct {
+	Table          string
+	FilteredPoints int64
+	QueuedPoints   int64
+	InsertedPoints int64
+	DroppedPoints  int64
+	ExpiredValues  int64
+	// LatePoints counts points that were later than the table's MaxLateness.
+	// Unless the table's LatePolicy applies them, they're also counted in
+	// DroppedPoints.
+	LatePoints int64
+	// DedupedPoints counts points that weren't inserted because an identical
+	// point had already been inserted within the table's DedupWindow.
+	DedupedPoints int64
+	// ClampedValues and DroppedValues count, by field name, the values of
+	// individual points that CLAMP and BOUNDED expressions clamped to or dropped
+	// for being outside of their range.
+	ClampedValues map[string]int64
+	DroppedValues map[string]int64
+	// MemStoreRows and MemStoreBytes describe the data that hasn't been
+	// flushed to disk yet (or all data, for in-memory tables).
+	MemStoreRows  int64
+	MemStoreBytes int64
+	// FileStoreRows is the number of rows on disk as of the last flush, or an
+	// estimate if the table hasn't flushed since opening. FileStoreBytes is the
+	// size of the current filestore.
+	FileStoreRows  int64
+	FileStoreBytes int64
+	// LastFlush is when the memstore was last flushed, zero if it hasn't been
+	// flushed since opening, and LastFlushDuration is how long that took.
+	LastFlush         time.Time
+	LastFlushDuration time.Duration
 }
 
 // Retriable is a marker for retriable errors
@@ -86,6 +304,30 @@ func ShouldIncludeMemStore(ctx context.Context) bool {
 	return include != nil && include.(bool)
 }
 
+// WithCaller records who is running a query, like the address of a client, so
+// that it can be reported in the slow query log.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, keyCaller, caller)
+}
+
+// CallerFor returns the caller recorded with WithCaller, if any.
+func CallerFor(ctx context.Context) string {
+	caller, _ := ctx.Value(keyCaller).(string)
+	return caller
+}
+
+// WithPrincipal records the name of the authenticated principal that's running
+// a query so that it can be reported in the slow query log.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, keyPrincipal, principal)
+}
+
+// PrincipalFor returns the principal recorded with WithPrincipal, if any.
+func PrincipalFor(ctx context.Context) string {
+	principal, _ := ctx.Value(keyPrincipal).(string)
+	return principal
+}
+
 func NanosToMillis(nanos int64) int64 {
 	return nanos / nanosPerMilli
 }
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// RequestIDHeader is the HTTP header and gRPC metadata key with which
+	// clients can supply their own request ID and with which the server
+	// reports the ID of every request.
+	RequestIDHeader = "X-Request-Id"
+
+	maxRequestIDLength = 64
+)
+
+// NewRequestID generates a random ID for a request.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SanitizeRequestID returns the given client supplied request ID if it's
+// reasonably short and only contains letters, digits, dashes, underscores and
+// dots, otherwise it generates a new one.
+func SanitizeRequestID(id string) string {
+	if id == "" || len(id) > maxRequestIDLength {
+		return NewRequestID()
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return NewRequestID()
+		}
+	}
+	return id
+}
+
+// WithRequestID records the ID of the request that's being handled, so that
+// it can be included in logs and errors on every node that handles it.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, keyRequestID, id)
+}
+
+// RequestIDFor returns the request ID recorded with WithRequestID, if any.
+func RequestIDFor(ctx context.Context) string {
+	id, _ := ctx.Value(keyRequestID).(string)
+	return id
+}
+
+type requestIDError struct {
+	wrapped error
+	id      string
+}
+
+func (err *requestIDError) Error() string {
+	return fmt.Sprintf("%v (request %v)", err.wrapped.Error(), err.id)
+}
+
+func (err *requestIDError) Unwrap() error {
+	return err.wrapped
+}
+
+// ErrorWithRequestID adds the request ID recorded in ctx, if any, to the
+// message of the given error, unless it's already there. Retriable errors stay
+// retriable.
+func ErrorWithRequestID(ctx context.Context, err error) error {
+	id := RequestIDFor(ctx)
+	if err == nil || id == "" || strings.Contains(err.Error(), "(request "+id+")") {
+		return err
+	}
+	if r, ok := err.(*retriable); ok {
+		return MarkRetriable(&requestIDError{r.wrapped, id})
+	}
+	return &requestIDError{err, id}
+}
@@ -0,0 +1,76 @@
+package common
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/getlantern/zenodb"
+)
+
+var (
+	tracePropagator = propagation.TraceContext{}
+)
+
+// TraceContext carries the W3C trace context of a span between nodes, so that
+// spans on the receiving node join the sender's trace.
+type TraceContext map[string]string
+
+// Get implements propagation.TextMapCarrier
+func (tc TraceContext) Get(key string) string {
+	return tc[key]
+}
+
+// Set implements propagation.TextMapCarrier
+func (tc TraceContext) Set(key string, value string) {
+	tc[key] = value
+}
+
+// Keys implements propagation.TextMapCarrier
+func (tc TraceContext) Keys() []string {
+	keys := make([]string, 0, len(tc))
+	for key := range tc {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// StartSpan starts an OpenTelemetry span using the globally registered
+// TracerProvider. Unless the application registers one with
+// otel.SetTracerProvider, spans are no-ops.
+func StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.GetTracerProvider().Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// EndSpan ends the given span, recording err if it's not nil.
+func EndSpan(span trace.Span, err error, opts ...trace.SpanEndOption) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(opts...)
+}
+
+// InjectTraceContext returns the trace context of the span in ctx, or nil if
+// there isn't one.
+func InjectTraceContext(ctx context.Context) TraceContext {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	tc := make(TraceContext)
+	tracePropagator.Inject(ctx, tc)
+	return tc
+}
+
+// ExtractTraceContext returns a context whose spans continue the trace in tc.
+func ExtractTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	if len(tc) == 0 {
+		return ctx
+	}
+	return tracePropagator.Extract(ctx, tc)
+}
@@ -0,0 +1,257 @@
+// Package compress provides the compression algorithms that zenodb can use for
+// filestores and WAL entries, both for individual records (like WAL entries)
+// and for streams (like filestore files).
+//
+// Compressed records are marked with magic bytes identifying the algorithm and
+// streams are identified by their algorithm's own header, so data can always be
+// read regardless of which algorithm is currently configured. Records that
+// aren't compressed are passed through unchanged and streams without a
+// recognized header are assumed to be snappy, which was the only algorithm
+// supported by earlier versions of zenodb.
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+const (
+	// Snappy is fast with moderate compression. It's the default.
+	Snappy = "snappy"
+	// Zstd compresses considerably better than Snappy at the cost of more CPU.
+	Zstd = "zstd"
+	// LZ4 is about as fast as Snappy, with similar compression.
+	LZ4 = "lz4"
+	// None stores data uncompressed.
+	None = "none"
+)
+
+var (
+	// Magic bytes that precede compressed records, followed by a byte
+	// identifying the algorithm. The leading 0xFF guarantees that these never
+	// collide with uncompressed WAL entries, which start with a big-endian
+	// timestamp that would have to be negative.
+	recordMagic = []byte{0xFF, 'Z', 'C'}
+
+	// Magic bytes that precede uncompressed streams
+	noneStreamMagic = []byte{0xFF, 'Z', 'C', 'N'}
+	zstdStreamMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+	lz4StreamMagic  = []byte{0x04, 0x22, 0x4D, 0x18}
+
+	streamMagicSize = 4
+
+	lz4HashTableSize = 64 * 1024
+
+	algorithmIDs = map[string]byte{
+		Snappy: 's',
+		Zstd:   'z',
+		LZ4:    'l',
+	}
+	// lz4StoredID marks lz4 records whose data was incompressible and stored as
+	// is
+	lz4StoredID = byte('L')
+
+	zstdEncoder     *zstd.Encoder
+	zstdDecoder     *zstd.Decoder
+	zstdInitErr     error
+	initZstdRecords sync.Once
+)
+
+// Validate checks that the given algorithm is supported. Blank means the
+// default (Snappy).
+func Validate(algorithm string) error {
+	switch normalize(algorithm) {
+	case Snappy, Zstd, LZ4, None:
+		return nil
+	default:
+		return fmt.Errorf("Unknown compression '%v', please use one of '%v', '%v', '%v' or '%v'", algorithm, Snappy, Zstd, LZ4, None)
+	}
+}
+
+func normalize(algorithm string) string {
+	algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+	if algorithm == "" {
+		return Snappy
+	}
+	return algorithm
+}
+
+// IsCompressed indicates whether the given record was compressed with Encode.
+func IsCompressed(data []byte) bool {
+	return len(data) > len(recordMagic) && bytes.Equal(data[:len(recordMagic)], recordMagic)
+}
+
+// Encode compresses the concatenation of the given buffers into a single
+// record using the given algorithm. With None, the buffers are just
+// concatenated.
+func Encode(algorithm string, bufs ...[]byte) ([]byte, error) {
+	algorithm = normalize(algorithm)
+	var data []byte
+	if len(bufs) == 1 {
+		data = bufs[0]
+	} else {
+		data = bytes.Join(bufs, nil)
+	}
+
+	id, found := algorithmIDs[algorithm]
+	if !found {
+		if algorithm == None {
+			return data, nil
+		}
+		return nil, Validate(algorithm)
+	}
+
+	header := append(append(make([]byte, 0, len(recordMagic)+5), recordMagic...), id)
+	switch algorithm {
+	case Zstd:
+		enc, _, err := zstdRecords()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(data, header), nil
+	case LZ4:
+		compressed := make([]byte, len(header)+4+lz4.CompressBlockBound(len(data)))
+		copy(compressed, header)
+		binary.BigEndian.PutUint32(compressed[len(header):], uint32(len(data)))
+		n, err := lz4.CompressBlock(data, compressed[len(header)+4:], make([]int, lz4HashTableSize))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to compress record with lz4: %v", err)
+		}
+		if n == 0 {
+			// Incompressible, store as is
+			n = copy(compressed[len(header)+4:], data)
+			compressed[len(recordMagic)] = lz4StoredID
+		}
+		return compressed[:len(header)+4+n], nil
+	default:
+		return append(header, snappy.Encode(nil, data)...), nil
+	}
+}
+
+// Decode decompresses the given record. Records that aren't compressed are
+// returned unchanged.
+func Decode(data []byte) ([]byte, error) {
+	if !IsCompressed(data) {
+		return data, nil
+	}
+	id := data[len(recordMagic)]
+	data = data[len(recordMagic)+1:]
+	switch id {
+	case algorithmIDs[Zstd]:
+		_, dec, err := zstdRecords()
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := dec.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decompress zstd record: %v", err)
+		}
+		return decoded, nil
+	case algorithmIDs[LZ4], lz4StoredID:
+		if len(data) < 4 {
+			return nil, fmt.Errorf("lz4 record truncated")
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if id == lz4StoredID {
+			return data, nil
+		}
+		decoded := make([]byte, size)
+		n, err := lz4.UncompressBlock(data, decoded)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decompress lz4 record: %v", err)
+		}
+		return decoded[:n], nil
+	case algorithmIDs[Snappy]:
+		decoded, err := snappy.Decode(nil, data)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decompress snappy record: %v", err)
+		}
+		return decoded, nil
+	default:
+		return nil, fmt.Errorf("Record compressed with unknown algorithm '%v'", string(id))
+	}
+}
+
+func zstdRecords() (*zstd.Encoder, *zstd.Decoder, error) {
+	initZstdRecords.Do(func() {
+		zstdEncoder, zstdInitErr = zstd.NewWriter(nil)
+		if zstdInitErr == nil {
+			zstdDecoder, zstdInitErr = zstd.NewReader(nil)
+		}
+		if zstdInitErr != nil {
+			zstdInitErr = fmt.Errorf("Unable to initialize zstd: %v", zstdInitErr)
+		}
+	})
+	return zstdEncoder, zstdDecoder, zstdInitErr
+}
+
+// NewWriter returns a writer that compresses everything written to it with
+// the given algorithm before writing it to out. Closing the writer flushes it
+// but doesn't close out.
+func NewWriter(algorithm string, out io.Writer) (io.WriteCloser, error) {
+	switch normalize(algorithm) {
+	case Snappy:
+		return snappy.NewBufferedWriter(out), nil
+	case Zstd:
+		w, err := zstd.NewWriter(out, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create zstd writer: %v", err)
+		}
+		return w, nil
+	case LZ4:
+		return lz4.NewWriter(out), nil
+	case None:
+		_, err := out.Write(noneStreamMagic)
+		if err != nil {
+			return nil, err
+		}
+		return &nopCloser{out}, nil
+	default:
+		return nil, Validate(algorithm)
+	}
+}
+
+// NewReader returns a reader that decompresses the given stream, detecting
+// the algorithm with which it was compressed. The reader must be closed to
+// release its resources, which doesn't close in.
+func NewReader(in io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(in)
+	magic, err := br.Peek(streamMagicSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(magic, zstdStreamMagic):
+		dec, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create zstd reader: %v", err)
+		}
+		return dec.IOReadCloser(), nil
+	case bytes.Equal(magic, lz4StreamMagic):
+		return ioutil.NopCloser(lz4.NewReader(br)), nil
+	case bytes.Equal(magic, noneStreamMagic):
+		br.Discard(streamMagicSize)
+		return ioutil.NopCloser(br), nil
+	default:
+		return ioutil.NopCloser(snappy.NewReader(br)), nil
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nc *nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,97 @@
+package compress
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+var algorithms = []string{Snappy, Zstd, LZ4, None}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Validate(""))
+	assert.NoError(t, Validate("ZSTD"))
+	for _, algorithm := range algorithms {
+		assert.NoError(t, Validate(algorithm))
+	}
+	assert.Error(t, Validate("gzip"))
+}
+
+func TestRecords(t *testing.T) {
+	data := bytes.Repeat([]byte("hello world "), 100)
+	for _, algorithm := range algorithms {
+		encoded, err := Encode(algorithm, data[:6], data[6:])
+		if !assert.NoError(t, err, algorithm) {
+			continue
+		}
+		assert.Equal(t, algorithm != None, IsCompressed(encoded), algorithm)
+		if algorithm != None {
+			assert.True(t, len(encoded) < len(data), "%v should have compressed record", algorithm)
+		}
+		decoded, err := Decode(encoded)
+		assert.NoError(t, err, algorithm)
+		assert.Equal(t, data, decoded, algorithm)
+	}
+
+	incompressible := []byte{1, 2, 3}
+	encoded, err := Encode(LZ4, incompressible)
+	if assert.NoError(t, err) {
+		decoded, err := Decode(encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, incompressible, decoded)
+	}
+
+	uncompressed := []byte("not compressed")
+	decoded, err := Decode(uncompressed)
+	assert.NoError(t, err)
+	assert.Equal(t, uncompressed, decoded, "uncompressed records should pass through")
+
+	_, err = Encode("gzip", data)
+	assert.Error(t, err)
+}
+
+func TestStreams(t *testing.T) {
+	data := bytes.Repeat([]byte("hello world "), 10000)
+	for _, algorithm := range algorithms {
+		var buf bytes.Buffer
+		w, err := NewWriter(algorithm, &buf)
+		if !assert.NoError(t, err, algorithm) {
+			continue
+		}
+		_, err = w.Write(data)
+		assert.NoError(t, err, algorithm)
+		assert.NoError(t, w.Close(), algorithm)
+		if algorithm != None {
+			assert.True(t, buf.Len() < len(data), "%v should have compressed stream", algorithm)
+		}
+
+		r, err := NewReader(&buf)
+		if !assert.NoError(t, err, algorithm) {
+			continue
+		}
+		read, err := ioutil.ReadAll(r)
+		assert.NoError(t, err, algorithm)
+		assert.NoError(t, r.Close(), algorithm)
+		assert.Equal(t, data, read, algorithm)
+	}
+}
+
+func TestLegacySnappyStream(t *testing.T) {
+	data := []byte("written before compression was configurable")
+	var buf bytes.Buffer
+	w := snappy.NewBufferedWriter(&buf)
+	w.Write(data)
+	w.Close()
+
+	r, err := NewReader(&buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	read, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, read)
+}
@@ -0,0 +1,101 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/compress"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = NewDB(&DBOpts{Dir: tmpDir, WALCompression: "gzip"})
+	assert.Error(t, err, "unknown WAL compression should be rejected")
+
+	algorithms := []string{"", compress.Snappy, compress.Zstd, compress.LZ4, compress.None}
+	tableName := func(algorithm string) string {
+		if algorithm == "" {
+			return "test_default"
+		}
+		return "test_" + algorithm
+	}
+	open := func(walCompression string, tableCompression func(algorithm string) string) *DB {
+		db, openErr := NewDB(&DBOpts{
+			Dir:            tmpDir,
+			WALCompression: walCompression,
+		})
+		if !assert.NoError(t, openErr) {
+			return nil
+		}
+		schema := Schema{}
+		for _, algorithm := range algorithms {
+			schema[tableName(algorithm)] = &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+				Compression:     tableCompression(algorithm),
+			}
+		}
+		if !assert.NoError(t, db.ApplySchema(schema)) {
+			db.Close()
+			return nil
+		}
+		return db
+	}
+	query := func(db *DB, table string) float64 {
+		source, queryErr := db.Query("SELECT i FROM "+table, false, nil, false)
+		if !assert.NoError(t, queryErr) {
+			return 0
+		}
+		total := float64(0)
+		_, queryErr = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			total += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, queryErr)
+		return total
+	}
+
+	db := open(compress.Zstd, func(algorithm string) string { return algorithm })
+	if db == nil {
+		return
+	}
+	assert.Error(t, db.CreateTable(&TableOpts{Name: "test_gzip", Compression: "gzip", RetentionPeriod: time.Hour, SQL: "SELECT i FROM inbound"}), "unknown table compression should be rejected")
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"dim": i}, map[string]float64{"i": 1}))
+	}
+	time.Sleep(500 * time.Millisecond)
+	db.FlushAll()
+	for _, algorithm := range algorithms {
+		assert.EqualValues(t, 100, query(db, tableName(algorithm)), algorithm)
+	}
+	b, err := ioutil.ReadFile(db.getTable("test_zstd").rowStore.fileStore.filename)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{0x28, 0xB5, 0x2F, 0xFD}, b[:4], "filestore should have been compressed with zstd")
+	}
+	db.Close()
+
+	// Switch everything back to defaults, existing data should remain readable
+	db = open("", func(algorithm string) string { return "" })
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"dim": i}, map[string]float64{"i": 1}))
+	}
+	time.Sleep(500 * time.Millisecond)
+	db.FlushAll()
+	for _, algorithm := range algorithms {
+		assert.EqualValues(t, 110, query(db, tableName(algorithm)), algorithm)
+	}
+}
@@ -0,0 +1,62 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditionalAggregatesOnFields(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	err = db.ApplySchema(Schema{
+		"requests": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT SUMIF(bytes, status >= 500) AS error_bytes, COUNTIF(bytes, status >= 500 AND server = 'a') AS a_errors, AVGIF(bytes, status < 500) AS ok_bytes FROM inbound GROUP BY server, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	insert := func(server string, status float64, bytes float64) {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"server": server}, map[string]float64{"status": status, "bytes": bytes}))
+	}
+	insert("a", 200, 10)
+	insert("a", 500, 20)
+	insert("b", 503, 40)
+	insert("b", 404, 30)
+	time.Sleep(250 * time.Millisecond)
+
+	source, err := db.Query("SELECT error_bytes, a_errors, ok_bytes FROM requests GROUP BY _", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var values []float64
+	_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+		values = row.Values
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []float64{60, 1, 20}, values)
+	}
+}
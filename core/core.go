@@ -7,6 +7,7 @@ import (
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/expr"
+	"math"
 	"strings"
 	"sync"
 	"time"
@@ -176,6 +177,11 @@ type FlatRow struct {
 	Key bytemap.ByteMap
 	// Values for each field
 	Values []float64
+	// Ints holds the exact values of the fields whose values are integers (see
+	// expr.TypeOf) at the same positions as in Values, since float64 Values
+	// can't represent all integers beyond 2^53. It's nil if none of the fields
+	// have integer values.
+	Ints   []int64
 	fields Fields
 }
 
@@ -183,6 +189,23 @@ func (row *FlatRow) SetFields(fields Fields) {
 	row.fields = fields
 }
 
+// TypedValue returns the value of the i-th field as the given type (int64,
+// bool or float64, see expr.TypeOf), so that integers come out exact and
+// comparisons as booleans.
+func (row *FlatRow) TypedValue(i int, fieldType string) interface{} {
+	switch fieldType {
+	case "int64":
+		if i < len(row.Ints) {
+			return row.Ints[i]
+		}
+		return int64(math.Round(row.Values[i]))
+	case "bool":
+		return row.Values[i] != 0
+	default:
+		return row.Values[i]
+	}
+}
+
 type Source interface {
 	GetGroupBy() []GroupBy
 
@@ -23,7 +23,7 @@ var (
 	cond, _    = goexpr.Boolean(">", goexpr.Param("d"), goexpr.Constant(0))
 	eA         = IF(cond, SUM("a"))
 	eB         = SUM("b")
-	totalField = NewField("total", ADD(eA, eB))
+	totalField = NewField("total", ADD(COALESCE(eA, 0), COALESCE(eB, 0)))
 
 	errTest = errors.New("test error")
 )
@@ -99,7 +99,7 @@ func TestDeadlineFilter(t *testing.T) {
 }
 
 func TestDeadlineGroup(t *testing.T) {
-	eTotal := ADD(eA, eB)
+	eTotal := ADD(COALESCE(eA, 0), COALESCE(eB, 0))
 	g := Group(&infiniteSource{}, GroupOpts{
 		By: []GroupBy{NewGroupBy("x", goexpr.Param("x"))},
 		Fields: StaticFieldSource{
@@ -127,7 +127,7 @@ func TestDeadlineGroup(t *testing.T) {
 }
 
 func TestGroupSingle(t *testing.T) {
-	eTotal := ADD(eA, eB)
+	eTotal := ADD(COALESCE(eA, 0), COALESCE(eB, 0))
 	gx := Group(&goodSource{}, GroupOpts{
 		By: []GroupBy{NewGroupBy("x", goexpr.Param("x"))},
 		Fields: StaticFieldSource{
@@ -167,7 +167,7 @@ func TestGroupSingle(t *testing.T) {
 }
 
 func TestGroupCrosstabSingle(t *testing.T) {
-	eAdd := ADD(eA, eB)
+	eAdd := ADD(COALESCE(eA, 0), COALESCE(eB, 0))
 	addField := Field{
 		Name: "add",
 		Expr: eAdd,
@@ -251,8 +251,54 @@ func TestGroupCrosstabSingle(t *testing.T) {
 	}
 }
 
+func TestGroupCrosstabOrderAndLimit(t *testing.T) {
+	eAdd := ADD(COALESCE(eA, 0), COALESCE(eB, 0))
+	crosstab := goexpr.Concat(goexpr.Constant("_"), goexpr.Param("y"))
+
+	check := func(order string, limit int, expectedTotals map[string]float64, expectedNames ...string) {
+		gx := Group(&goodSource{}, GroupOpts{
+			Crosstab:      crosstab,
+			CrosstabOrder: order,
+			CrosstabLimit: limit,
+			Fields:        StaticFieldSource{NewField("add", eAdd)},
+			Resolution:    resolution * 20,
+		})
+		var fields Fields
+		totals := make(map[string]float64)
+		_, err := gx.Iterate(context.Background(), func(inFields Fields) error {
+			fields = inFields
+			return nil
+		}, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+			for i, val := range vals {
+				for p := 0; p < val.NumPeriods(fields[i].Expr.EncodedWidth()); p++ {
+					v, _ := val.ValueAt(p, fields[i].Expr)
+					totals[fields[i].Name] += v
+				}
+			}
+			return true, nil
+		})
+		if assert.NoError(t, err) {
+			assert.Equal(t, expectedNames, fields.Names(), "%v %d", order, limit)
+			assert.Equal(t, expectedTotals, totals, "%v %d", order, limit)
+		}
+	}
+
+	check(CrosstabOrderTotal, 0,
+		map[string]float64{"3_add": 150, "5_add": 150, "2_add": 100, "1_add": 80},
+		"3_add", "5_add", "2_add", "1_add")
+	check(CrosstabOrderTotal, 2,
+		map[string]float64{"3_add": 150, "5_add": 150, "other_add": 180},
+		"3_add", "5_add", "other_add")
+	check("", 3,
+		map[string]float64{"2_add": 100, "3_add": 150, "5_add": 150, "other_add": 80},
+		"2_add", "3_add", "5_add", "other_add")
+	check("", 4,
+		map[string]float64{"1_add": 80, "2_add": 100, "3_add": 150, "5_add": 150},
+		"1_add", "2_add", "3_add", "5_add")
+}
+
 func TestGroupResolutionOnly(t *testing.T) {
-	eTotal := ADD(eA, eB)
+	eTotal := ADD(COALESCE(eA, 0), COALESCE(eB, 0))
 	gx := Group(&goodSource{}, GroupOpts{
 		By: []GroupBy{NewGroupBy("_", goexpr.Constant("_"))},
 		Fields: StaticFieldSource{
@@ -281,7 +327,7 @@ func TestGroupResolutionOnly(t *testing.T) {
 }
 
 func TestGroupNone(t *testing.T) {
-	eTotal := ADD(eA, eB)
+	eTotal := ADD(COALESCE(eA, 0), COALESCE(eB, 0))
 	gx := Group(&goodSource{}, GroupOpts{
 		Fields: StaticFieldSource{
 			Field{
@@ -315,6 +361,35 @@ func TestGroupNone(t *testing.T) {
 	assert.Empty(t, expectedValues, "All combinations should have been seen")
 }
 
+func TestGroupLocation(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if !assert.NoError(t, err) {
+		return
+	}
+	eTotal := SUM("a")
+	flat := Localize(Flatten(Group(&hourlySource{eTotal}, GroupOpts{
+		Fields:     StaticFieldSource{NewField("total", eTotal)},
+		Resolution: 24 * time.Hour,
+		Location:   loc,
+	})), loc)
+
+	// Daylight saving time ends on November 5th, which has 25 hours. Periods are
+	// labeled by when they end, i.e. midnight of the following day.
+	expectedTotals := map[time.Time]float64{
+		time.Date(2017, 11, 5, 0, 0, 0, 0, loc): 24,
+		time.Date(2017, 11, 6, 0, 0, 0, 0, loc): 25,
+		time.Date(2017, 11, 7, 0, 0, 0, 0, loc): 24,
+	}
+	totals := make(map[time.Time]float64)
+	_, err = flat.Iterate(context.Background(), FieldsIgnored, func(row *FlatRow) (bool, error) {
+		totals[time.Unix(0, row.TS).In(loc)] += row.Values[0]
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, expectedTotals, totals)
+	}
+}
+
 func TestFlattenSortOffsetAndLimit(t *testing.T) {
 	// TODO: add test that tests flattening of rows that contain multiple periods
 	// worth of values
@@ -359,7 +434,7 @@ func TestUnflattenTransform(t *testing.T) {
 }
 
 func TestUnflattenOptimized(t *testing.T) {
-	total := ADD(eA, eB)
+	total := ADD(COALESCE(eA, 0), COALESCE(eB, 0))
 	s := &totalingSource{}
 	f := Flatten(s)
 	u := UnflattenOptimized(f)
@@ -532,6 +607,43 @@ func (s *infiniteSource) String() string {
 	return "test.infinite"
 }
 
+// hourlySource returns a value of 1 for every hour from midnight on November
+// 4th to midnight on November 7th 2017 in New York.
+type hourlySource struct {
+	e Expr
+}
+
+func (s *hourlySource) GetGroupBy() []GroupBy {
+	return nil
+}
+
+func (s *hourlySource) GetResolution() time.Duration {
+	return time.Hour
+}
+
+func (s *hourlySource) GetAsOf() time.Time {
+	return time.Date(2017, 11, 4, 4, 0, 0, 0, time.UTC)
+}
+
+func (s *hourlySource) GetUntil() time.Time {
+	return time.Date(2017, 11, 7, 5, 0, 0, 0, time.UTC)
+}
+
+func (s *hourlySource) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (interface{}, error) {
+	onFields(Fields{NewField("total", s.e)})
+	for ts := s.GetAsOf().Add(time.Hour); !ts.After(s.GetUntil()); ts = ts.Add(time.Hour) {
+		more, err := onRow(nil, Vals{encoding.NewFloatValue(s.e, ts, 1)})
+		if !more || err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (s *hourlySource) String() string {
+	return "test.hourly"
+}
+
 type errorSource struct {
 	testSource
 }
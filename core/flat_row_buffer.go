@@ -0,0 +1,112 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/spill"
+)
+
+// FlatRowBuffer buffers FlatRows so that they can be iterated more than once.
+// Once the buffered rows take up more than memLimit bytes, they're spilled to
+// a file counted against quota. If memLimit <= 0, all rows stay in memory.
+type FlatRowBuffer struct {
+	fields   Fields
+	memLimit int
+	quota    *spill.Quota
+	rows     []*FlatRow
+	memUsed  int
+	file     *spill.File
+	out      *bufio.Writer
+}
+
+// NewFlatRowBuffer creates a FlatRowBuffer for rows with the given fields.
+func NewFlatRowBuffer(fields Fields, memLimit int, quota *spill.Quota) *FlatRowBuffer {
+	return &FlatRowBuffer{
+		fields:   fields,
+		memLimit: memLimit,
+		quota:    quota,
+	}
+}
+
+// Add adds a row to the buffer, spilling the buffered rows if necessary.
+func (b *FlatRowBuffer) Add(row *FlatRow) error {
+	b.rows = append(b.rows, row)
+	if b.memLimit <= 0 {
+		return nil
+	}
+	b.memUsed += flatRowOverhead + len(row.Key) + (len(row.Values)+len(row.Ints))*encoding.Width64bits
+	if b.memUsed <= b.memLimit {
+		return nil
+	}
+	if b.file == nil {
+		file, err := b.quota.Create()
+		if err != nil {
+			return err
+		}
+		b.file = file
+		b.out = bufio.NewWriterSize(file, spillBufferSize)
+	}
+	for _, row := range b.rows {
+		_, err := b.out.Write(encodeFlatRow(row))
+		if err != nil {
+			return err
+		}
+	}
+	b.rows = b.rows[:0]
+	b.memUsed = 0
+	return nil
+}
+
+// Finish finishes writing any spilled rows. It has to be called after adding
+// the last row and before iterating.
+func (b *FlatRowBuffer) Finish() error {
+	if b.out == nil {
+		return nil
+	}
+	return b.out.Flush()
+}
+
+// Spilled indicates whether any rows have been spilled to disk.
+func (b *FlatRowBuffer) Spilled() bool {
+	return b.file != nil
+}
+
+// Iterate calls onRow with every buffered row in the order in which they were
+// added, stopping once onRow returns false or an error. It's safe to iterate
+// concurrently.
+func (b *FlatRowBuffer) Iterate(onRow OnFlatRow) error {
+	if b.file != nil {
+		in := b.file.NewReader(spillBufferSize)
+		for {
+			encoded, readErr := readEncoded(in)
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil {
+				return fmt.Errorf("Unable to read spilled rows: %v", readErr)
+			}
+			more, onRowErr := onRow(decodeFlatRow(encoded, b.fields))
+			if !more || onRowErr != nil {
+				return onRowErr
+			}
+		}
+	}
+	for _, row := range b.rows {
+		more, err := onRow(row)
+		if !more || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove removes any spilled rows from disk.
+func (b *FlatRowBuffer) Remove() {
+	if b.file != nil {
+		b.file.Remove()
+		b.file = nil
+	}
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/spill"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlatRowBuffer(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbspill")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	m, err := spill.New(&spill.Opts{Dir: tmpDir})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	fields := Fields{NewField("val", expr.FIELD("val"))}
+	var rows []*FlatRow
+	for i := 0; i < 10; i++ {
+		rows = append(rows, &FlatRow{
+			TS:     int64(i),
+			Key:    bytemap.New(map[string]interface{}{"i": i}),
+			Values: []float64{float64(i)},
+			fields: fields,
+		})
+	}
+
+	// Enough memory for a few rows
+	b := NewFlatRowBuffer(fields, 3*(flatRowOverhead+len(rows[0].Key)+8), m.NewQuota())
+	for _, row := range rows {
+		if !assert.NoError(t, b.Add(row)) {
+			return
+		}
+	}
+	if !assert.NoError(t, b.Finish()) {
+		return
+	}
+	assert.True(t, b.Spilled())
+	assert.True(t, m.Used() > 0)
+
+	iterate := func() []*FlatRow {
+		var actual []*FlatRow
+		assert.NoError(t, b.Iterate(func(row *FlatRow) (bool, error) {
+			actual = append(actual, row)
+			return true, nil
+		}))
+		return actual
+	}
+	for i := 0; i < 2; i++ {
+		actual := iterate()
+		if assert.Len(t, actual, len(rows), "iteration %d", i) {
+			for j, row := range actual {
+				assert.Equal(t, rows[j].TS, row.TS)
+				assert.Equal(t, rows[j].Key, row.Key)
+				assert.Equal(t, rows[j].Values, row.Values)
+				assert.Equal(t, rows[j].Get("val"), row.Get("val"), "Spilled rows should retain their fields")
+			}
+		}
+	}
+
+	b.Remove()
+	assert.EqualValues(t, 0, m.Used(), "Spilled data should have been cleaned up")
+	files, _ := ioutil.ReadDir(tmpDir)
+	assert.Empty(t, files, "Spill files should have been removed")
+}
@@ -23,10 +23,19 @@ func (f *flatten) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRo
 
 	var fields Fields
 	var numFields int
+	var intFields []bool
+	anyIntFields := false
 
 	return f.source.Iterate(ctx, func(inFields Fields) error {
 		fields = inFields
 		numFields = len(inFields)
+		intFields = make([]bool, numFields)
+		for i, field := range inFields {
+			if expr.TypeOf(field.Expr) == expr.Int {
+				intFields[i] = true
+				anyIntFields = true
+			}
+		}
 		// Transform to flattened version of fields
 		outFields := make(Fields, 0, len(inFields))
 		for _, field := range inFields {
@@ -64,6 +73,9 @@ func (f *flatten) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRo
 				Values: make([]float64, numFields),
 				fields: fields,
 			}
+			if anyIntFields {
+				row.Ints = make([]int64, numFields)
+			}
 			anyNonConstantValueFound := false
 			for i, field := range fields {
 				val, found := vals[i].ValueAtTime(ts, field.Expr, resolution)
@@ -71,6 +83,9 @@ func (f *flatten) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRo
 					anyNonConstantValueFound = true
 				}
 				row.Values[i] = val
+				if intFields[i] {
+					row.Ints[i], _ = vals[i].IntValueAtTime(ts, field.Expr, resolution)
+				}
 			}
 			if anyNonConstantValueFound {
 				more, err := onRow(row)
@@ -26,4 +26,11 @@ func doFormatSource(result *bytes.Buffer, indent string, source Source) {
 		s := t.GetSource()
 		doFormatSource(result, indent, s)
 	}
+	c, ok := source.(Combination)
+	if ok {
+		indent += "  "
+		for _, s := range c.GetSources() {
+			doFormatSource(result, indent, s)
+		}
+	}
 }
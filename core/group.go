@@ -9,11 +9,24 @@ import (
 	"github.com/getlantern/zenodb/bytetree"
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/spill"
 	"sort"
 	"strings"
 	"time"
 )
 
+const (
+	// CrosstabOrderAlphabetical orders crosstab columns alphabetically by their
+	// crosstab value
+	CrosstabOrderAlphabetical = "alphabetical"
+	// CrosstabOrderTotal orders crosstab columns by their total, largest first
+	CrosstabOrderTotal = "total"
+
+	// CrosstabOther is the crosstab value of the columns that combine the values
+	// which didn't make the CrosstabLimit
+	CrosstabOther = "other"
+)
+
 var (
 	// ClusterCrosstab is the crosstab expression for crosstabs that come from an
 	// contained Group By (i.e. from a cluster follower)
@@ -60,6 +73,26 @@ type GroupOpts struct {
 	AsOf                  time.Time
 	Until                 time.Time
 	StrideSlice           time.Duration
+	// CrosstabOrder is how crosstab columns are ordered, CrosstabOrderAlphabetical
+	// by default.
+	CrosstabOrder string
+	// CrosstabLimit, if positive, caps how many crosstab values get their own
+	// columns. The values with the largest totals are kept and the rest are
+	// combined into CrosstabOther columns. Totals are calculated from the first
+	// field.
+	CrosstabLimit int
+	// Location, if set, buckets periods by their wall clock time in this time
+	// zone instead of UTC. Resulting rows are timestamped with wall clock times
+	// expressed as UTC, use Localize to convert them back.
+	Location *time.Location
+	// MemLimit, if positive, caps the approximate memory used for the groups
+	// (and for the rows buffered for a Crosstab). Beyond it, they spill to files
+	// counted against SpillQuota. Spilled groups are merged back together by key,
+	// so groups come out in key order rather than in their usual order.
+	MemLimit int
+	// SpillQuota limits the disk space used for spilling. If nil, spilling uses
+	// the system temp directory without limits.
+	SpillQuota *spill.Quota
 }
 
 func Group(source RowSource, opts GroupOpts) RowSource {
@@ -145,30 +178,58 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (in
 	}
 
 	var bt *bytetree.Tree
+	var gs *groupSpill
+	var spillErr error
+	defer func() {
+		if gs != nil {
+			gs.remove()
+		}
+	}()
 	var ctabs map[string]interface{}
-	var kvs []*keyedVals
+	kvs := &keyedValsBuffer{memLimit: g.MemLimit, quota: g.SpillQuota}
+	defer kvs.remove()
 	var inFields Fields
 	var outFields Fields
 	if g.Fields == nil {
 		g.Fields = PassthroughFieldSource
 	}
 
-	updateTree := func(key bytemap.ByteMap, vals Vals) {
+	newTree := func(outExprs []expr.Expr) *bytetree.Tree {
+		asOf, until := g.GetAsOf(), g.GetUntil()
+		if g.Location != nil {
+			resolution := g.GetResolution()
+			asOf = encoding.RoundTimeDown(encoding.ToWallClock(asOf, g.Location), resolution)
+			until = encoding.RoundTimeUp(encoding.PeriodToWallClock(until, g.Location), resolution)
+		}
+		return bytetree.New(
+			outExprs,
+			inFields.Exprs(),
+			g.GetResolution(),
+			g.source.GetResolution(),
+			asOf,
+			until,
+			g.StrideSlice,
+		)
+	}
+
+	updateTree := func(key bytemap.ByteMap, vals Vals) error {
 		// Lazily initialize bytetree
 		if bt == nil {
-			bt = bytetree.New(
-				outFields.Exprs(),
-				inFields.Exprs(),
-				g.GetResolution(),
-				g.source.GetResolution(),
-				g.GetAsOf(),
-				g.GetUntil(),
-				g.StrideSlice,
-			)
+			bt = newTree(outFields.Exprs())
 		}
 		metadata := key
 		key = sliceKey(key)
 		bt.Update(key, vals, nil, metadata)
+		if g.MemLimit <= 0 || bt.Bytes() <= g.MemLimit {
+			return nil
+		}
+		if gs == nil {
+			gs = &groupSpill{quota: g.SpillQuota}
+		}
+		spillErr = gs.spill(bt)
+		// Start over with an empty tree
+		bt = nil
+		return spillErr
 	}
 
 	metadata, err := g.source.Iterate(ctx, func(fields Fields) error {
@@ -180,34 +241,40 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (in
 		}
 		return nil
 	}, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+		if g.Location != nil {
+			vals = g.localize(inFields, vals)
+		}
 		if g.Crosstab != nil {
 			if ctabs == nil {
 				ctabs = make(map[string]interface{})
 			}
 			ctab := g.Crosstab.Eval(key).(string)
 			ctabs[ctab] = nil
-			kvs = append(kvs, &keyedVals{key, vals})
+			spillErr = kvs.add(&keyedVals{key, vals})
 		} else {
 			updateTree(key, vals)
 		}
+		if spillErr != nil {
+			return false, spillErr
+		}
 		return guard.Proceed()
 	})
+	if spillErr != nil {
+		// Don't bother returning partial results
+		return metadata, spillErr
+	}
 
 	var walkErr error
 	if err != ErrDeadlineExceeded {
 		if g.Crosstab != nil {
 			origOutFields := outFields
-			sortedCtabs := make([]string, 0, len(ctabs))
-			for ctab := range ctabs {
-				sortedCtabs = append(sortedCtabs, ctab)
+			columnCtabs, otherCtabs, columnsErr := g.crosstabColumns(ctabs, kvs, origOutFields, newTree)
+			if columnsErr != nil {
+				return metadata, columnsErr
 			}
-			sort.Strings(sortedCtabs)
-			outFields = make([]Field, 0, (len(sortedCtabs)+1)*len(origOutFields))
+			outFields = make([]Field, 0, (len(columnCtabs)+2)*len(origOutFields))
 			var havingField Field
-			for _, ctab := range sortedCtabs {
-				if guard.TimedOut() {
-					return metadata, ErrDeadlineExceeded
-				}
+			addColumns := func(name string, cond goexpr.Expr) {
 				for _, outField := range origOutFields {
 					if outField.Name == HavingFieldName {
 						// _having is not subjected to CROSSTAB treatment, save it and
@@ -215,13 +282,26 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (in
 						havingField = outField
 						continue
 					}
-					cond, condErr := goexpr.Binary("=", g.Crosstab, goexpr.Constant(ctab))
-					if condErr != nil {
-						return metadata, condErr
-					}
 					ifex := expr.IF(cond, outField.Expr)
-					outFields = append(outFields, NewField(fmt.Sprintf("%v_%v", strings.ToLower(ctab), outField.Name), ifex))
+					outFields = append(outFields, NewField(fmt.Sprintf("%v_%v", strings.ToLower(name), outField.Name), ifex))
+				}
+			}
+			for _, ctab := range columnCtabs {
+				if guard.TimedOut() {
+					return metadata, ErrDeadlineExceeded
+				}
+				cond, condErr := goexpr.Binary("=", g.Crosstab, goexpr.Constant(ctab))
+				if condErr != nil {
+					return metadata, condErr
 				}
+				addColumns(ctab, cond)
+			}
+			if len(otherCtabs) > 0 {
+				others := make(goexpr.ArrayList, 0, len(otherCtabs))
+				for _, ctab := range otherCtabs {
+					others = append(others, goexpr.Constant(ctab))
+				}
+				addColumns(CrosstabOther, goexpr.In(g.Crosstab, others))
 			}
 			if g.CrosstabIncludesTotal {
 				for _, outField := range origOutFields {
@@ -234,11 +314,14 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (in
 				outFields = append(outFields, havingField)
 			}
 
-			for _, kv := range kvs {
+			updateErr := kvs.iterate(func(kv *keyedVals) error {
 				if guard.TimedOut() {
-					return metadata, ErrDeadlineExceeded
+					return ErrDeadlineExceeded
 				}
-				updateTree(kv.key, kv.vals)
+				return updateTree(kv.key, kv.vals)
+			})
+			if updateErr != nil {
+				return metadata, updateErr
 			}
 		}
 
@@ -247,7 +330,15 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (in
 			return metadata, onFieldsErr
 		}
 
-		if bt != nil {
+		if gs != nil {
+			if bt != nil {
+				spillErr = gs.spill(bt)
+				if spillErr != nil {
+					return metadata, spillErr
+				}
+			}
+			walkErr = gs.merge(outFields.Exprs(), g.GetResolution(), guard, onRow)
+		} else if bt != nil {
 			walkErr = bt.Walk(0, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
 				more, iterErr := onRow(key, data)
 				if iterErr == nil && guard.TimedOut() {
@@ -266,6 +357,84 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (in
 	return metadata, err
 }
 
+// crosstabColumns returns the crosstab values that get their own columns, in
+// the order of their columns, and the values that are combined into the
+// CrosstabOther columns.
+func (g *group) crosstabColumns(ctabs map[string]interface{}, kvs *keyedValsBuffer, outFields Fields, newTree func([]expr.Expr) *bytetree.Tree) ([]string, []string, error) {
+	columns := make([]string, 0, len(ctabs))
+	for ctab := range ctabs {
+		columns = append(columns, ctab)
+	}
+	sort.Strings(columns)
+	limited := g.CrosstabLimit > 0 && len(columns) > g.CrosstabLimit
+	if g.CrosstabOrder != CrosstabOrderTotal && !limited {
+		return columns, nil, nil
+	}
+
+	totals, err := g.crosstabTotals(kvs, outFields, newTree)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Stable, so that columns with the same total stay in alphabetical order
+	sort.SliceStable(columns, func(i, j int) bool {
+		return totals[columns[i]] > totals[columns[j]]
+	})
+	if !limited {
+		return columns, nil, nil
+	}
+	kept, other := columns[:g.CrosstabLimit], columns[g.CrosstabLimit:]
+	if g.CrosstabOrder != CrosstabOrderTotal {
+		sort.Strings(kept)
+	}
+	return kept, other, nil
+}
+
+// crosstabTotals totals the first of the given fields across all rows and
+// periods for each crosstab value.
+func (g *group) crosstabTotals(kvs *keyedValsBuffer, outFields Fields, newTree func([]expr.Expr) *bytetree.Tree) (map[string]float64, error) {
+	totals := make(map[string]float64)
+	var e expr.Expr
+	for _, field := range outFields {
+		if field.Name != HavingFieldName {
+			e = field.Expr
+			break
+		}
+	}
+	if e == nil {
+		return totals, nil
+	}
+
+	bt := newTree([]expr.Expr{e})
+	err := kvs.iterate(func(kv *keyedVals) error {
+		bt.Update([]byte(g.Crosstab.Eval(kv.key).(string)), kv.vals, nil, kv.key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var values []float64
+	var found []bool
+	err = bt.Walk(0, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+		values, found = data[0].Values(e, values[:0], found[:0])
+		for _, val := range values {
+			totals[string(key)] += val
+		}
+		return true, true, nil
+	})
+	return totals, err
+}
+
+// localize moves the periods of the given vals to their wall clock times in
+// g.Location.
+func (g *group) localize(fields Fields, vals Vals) Vals {
+	resolution := g.source.GetResolution()
+	localized := make(Vals, len(vals))
+	for i, val := range vals {
+		localized[i] = val.Localize(fields[i].Expr, resolution, g.Location)
+	}
+	return localized
+}
+
 func (g *group) String() string {
 	result := &bytes.Buffer{}
 	result.WriteString("group")
@@ -275,6 +444,12 @@ func (g *group) String() string {
 	if g.Crosstab != nil {
 		result.WriteString(fmt.Sprintf("\n       crosstab: %v", g.Crosstab))
 		result.WriteString(fmt.Sprintf("\n       crosstab includes total: %v", g.CrosstabIncludesTotal))
+		if g.CrosstabOrder != "" {
+			result.WriteString(fmt.Sprintf("\n       crosstab order: %v", g.CrosstabOrder))
+		}
+		if g.CrosstabLimit > 0 {
+			result.WriteString(fmt.Sprintf("\n       crosstab limit: %d", g.CrosstabLimit))
+		}
 	}
 	if g.Fields != nil {
 		result.WriteString(fmt.Sprintf("\n       fields: %v", g.Fields))
@@ -282,6 +457,9 @@ func (g *group) String() string {
 	if g.Resolution > 0 {
 		result.WriteString(fmt.Sprintf("\n       resolution: %v", g.Resolution))
 	}
+	if g.Location != nil {
+		result.WriteString(fmt.Sprintf("\n       location: %v", g.Location))
+	}
 	if !g.AsOf.IsZero() {
 		result.WriteString(fmt.Sprintf("\n       as of: %v", g.AsOf.In(time.UTC)))
 	}
@@ -0,0 +1,265 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/getlantern/zenodb/bytetree"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/spill"
+)
+
+const (
+	// keyedValsOverhead approximates the memory used by a keyedVals in addition
+	// to its key and values.
+	keyedValsOverhead = 64
+)
+
+// groupSpill spills the groups of a group to sorted runs on disk once they
+// exceed its memory limit and then merges the runs, combining the values of
+// groups that ended up in more than one run.
+type groupSpill struct {
+	quota *spill.Quota
+	runs  []*spill.File
+}
+
+// spill writes all groups from the given tree to a new run, sorted by key.
+func (gs *groupSpill) spill(bt *bytetree.Tree) error {
+	groups := make([]*keyedVals, 0, bt.Length())
+	err := bt.Walk(0, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+		groups = append(groups, &keyedVals{key, data})
+		return true, true, nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return bytes.Compare(groups[i].key, groups[j].key) < 0
+	})
+
+	run, err := gs.quota.Create()
+	if err != nil {
+		return err
+	}
+	gs.runs = append(gs.runs, run)
+	out := bufio.NewWriterSize(run, spillBufferSize)
+	for _, kv := range groups {
+		_, err = out.Write(encodeKeyedVals(kv))
+		if err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// merge merges the sorted runs, passing each group to onRow once with the
+// values from all runs merged using the given exprs.
+func (gs *groupSpill) merge(exprs []expr.Expr, resolution time.Duration, guard TimeoutGuard, onRow OnRow) error {
+	readers := make([]io.Reader, 0, len(gs.runs))
+	heads := &keyedValsHeap{}
+	next := func(i int) error {
+		b, err := readEncoded(readers[i])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to read spilled groups: %v", err)
+		}
+		heap.Push(heads, &keyedValsHead{decodeKeyedVals(b), i})
+		return nil
+	}
+
+	for i, run := range gs.runs {
+		readers = append(readers, run.NewReader(spillBufferSize))
+		err := next(i)
+		if err != nil {
+			return err
+		}
+	}
+
+	for heads.Len() > 0 {
+		if guard.TimedOut() {
+			return ErrDeadlineExceeded
+		}
+		head := heap.Pop(heads).(*keyedValsHead)
+		key, vals := head.kv.key, head.kv.vals
+		err := next(head.run)
+		if err != nil {
+			return err
+		}
+		for heads.Len() > 0 && bytes.Equal(heads.heads[0].kv.key, key) {
+			other := heap.Pop(heads).(*keyedValsHead)
+			for i, e := range exprs {
+				vals[i] = vals[i].Merge(other.kv.vals[i], e, resolution, time.Time{})
+			}
+			err = next(other.run)
+			if err != nil {
+				return err
+			}
+		}
+		more, onRowErr := onRow(key, vals)
+		if onRowErr != nil {
+			return onRowErr
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (gs *groupSpill) remove() {
+	for _, run := range gs.runs {
+		run.Remove()
+	}
+}
+
+// keyedValsBuffer buffers keyedVals so that they can be iterated more than
+// once, spilling them to disk once they exceed memLimit.
+type keyedValsBuffer struct {
+	memLimit int
+	quota    *spill.Quota
+	kvs      []*keyedVals
+	memUsed  int
+	file     *spill.File
+	out      *bufio.Writer
+}
+
+func (b *keyedValsBuffer) add(kv *keyedVals) error {
+	b.kvs = append(b.kvs, kv)
+	if b.memLimit <= 0 {
+		return nil
+	}
+	b.memUsed += keyedValsOverhead + len(kv.key)
+	for _, val := range kv.vals {
+		b.memUsed += len(val)
+	}
+	if b.memUsed <= b.memLimit {
+		return nil
+	}
+	if b.file == nil {
+		file, err := b.quota.Create()
+		if err != nil {
+			return err
+		}
+		b.file = file
+		b.out = bufio.NewWriterSize(file, spillBufferSize)
+	}
+	for _, kv := range b.kvs {
+		_, err := b.out.Write(encodeKeyedVals(kv))
+		if err != nil {
+			return err
+		}
+	}
+	b.kvs = b.kvs[:0]
+	b.memUsed = 0
+	return nil
+}
+
+// iterate calls fn with every buffered keyedVals, the spilled ones first.
+func (b *keyedValsBuffer) iterate(fn func(kv *keyedVals) error) error {
+	if b.file != nil {
+		err := b.out.Flush()
+		if err != nil {
+			return err
+		}
+		in := b.file.NewReader(spillBufferSize)
+		for {
+			encoded, readErr := readEncoded(in)
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil {
+				return fmt.Errorf("Unable to read spilled rows: %v", readErr)
+			}
+			err = fn(decodeKeyedVals(encoded))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, kv := range b.kvs {
+		err := fn(kv)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *keyedValsBuffer) remove() {
+	if b.file != nil {
+		b.file.Remove()
+		b.file = nil
+	}
+}
+
+// keyedValsHead is the next group from one of the runs being merged
+type keyedValsHead struct {
+	kv  *keyedVals
+	run int
+}
+
+type keyedValsHeap struct {
+	heads []*keyedValsHead
+}
+
+func (h *keyedValsHeap) Len() int      { return len(h.heads) }
+func (h *keyedValsHeap) Swap(i, j int) { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+func (h *keyedValsHeap) Less(i, j int) bool {
+	return bytes.Compare(h.heads[i].kv.key, h.heads[j].kv.key) < 0
+}
+
+func (h *keyedValsHeap) Push(x interface{}) {
+	h.heads = append(h.heads, x.(*keyedValsHead))
+}
+
+func (h *keyedValsHeap) Pop() interface{} {
+	n := len(h.heads)
+	x := h.heads[n-1]
+	h.heads = h.heads[:n-1]
+	return x
+}
+
+// encodeKeyedVals encodes a keyedVals as:
+//
+//	rowLength(64) | keyLength(32) | key | numVals(16) | (valLength(32) | val)*
+//
+// where rowLength includes itself.
+func encodeKeyedVals(kv *keyedVals) []byte {
+	rowLength := encoding.Width64bits + encoding.Width32bits + len(kv.key) + encoding.Width16bits
+	for _, val := range kv.vals {
+		rowLength += encoding.Width32bits + len(val)
+	}
+	_b := make([]byte, rowLength)
+	b := encoding.WriteInt64(_b, rowLength)
+	b = encoding.WriteInt32(b, len(kv.key))
+	b = b[copy(b, kv.key):]
+	b = encoding.WriteInt16(b, len(kv.vals))
+	for _, val := range kv.vals {
+		b = encoding.WriteInt32(b, len(val))
+		b = b[copy(b, val):]
+	}
+	return _b
+}
+
+func decodeKeyedVals(b []byte) *keyedVals {
+	b = b[encoding.Width64bits:]
+	keyLength, b := encoding.ReadInt32(b)
+	key, b := encoding.ReadByteMap(b, keyLength)
+	numVals, b := encoding.ReadInt16(b)
+	vals := make(Vals, numVals)
+	for i := range vals {
+		var valLength int
+		valLength, b = encoding.ReadInt32(b)
+		vals[i] = encoding.Sequence(b[:valLength:valLength])
+		b = b[valLength:]
+	}
+	return &keyedVals{key, vals}
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/spill"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupWithMemoryLimit(t *testing.T) {
+	groupOpts := func(crosstab goexpr.Expr, memLimit int) GroupOpts {
+		return GroupOpts{
+			By:         []GroupBy{NewGroupBy("x", goexpr.Param("x"))},
+			Crosstab:   crosstab,
+			Fields:     StaticFieldSource{NewField("a", eA), NewField("b", eB)},
+			Resolution: resolution * 2,
+			MemLimit:   memLimit,
+		}
+	}
+
+	for _, crosstab := range []goexpr.Expr{nil, goexpr.Concat(goexpr.Constant("_"), goexpr.Param("y"))} {
+		expected := collectGroups(t, Group(&goodSource{}, groupOpts(crosstab, 0)))
+		if !assert.NotEmpty(t, expected) {
+			return
+		}
+		// A tiny memory limit forces spilling every group to disk
+		actual := collectGroups(t, Group(&goodSource{}, groupOpts(crosstab, 1)))
+		assert.Equal(t, expected, actual, "crosstab %v", crosstab)
+	}
+
+	// Stopping early shouldn't hang
+	rows := 0
+	_, err := Group(&goodSource{}, groupOpts(nil, 1)).Iterate(context.Background(), FieldsIgnored, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+		rows++
+		return false, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rows)
+}
+
+func TestGroupSpillQuota(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbspill")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	m, err := spill.New(&spill.Opts{Dir: tmpDir, MaxBytesPerQuery: 100})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, crosstab := range []goexpr.Expr{nil, goexpr.Concat(goexpr.Constant("_"), goexpr.Param("y"))} {
+		g := Group(&goodSource{}, GroupOpts{
+			By:         []GroupBy{NewGroupBy("x", goexpr.Param("x"))},
+			Crosstab:   crosstab,
+			Fields:     StaticFieldSource{NewField("a", eA), NewField("b", eB)},
+			MemLimit:   1,
+			SpillQuota: m.NewQuota(),
+		})
+		_, err = g.Iterate(context.Background(), FieldsIgnored, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+			return true, nil
+		})
+		assert.Equal(t, spill.ErrQuotaExceeded, err, "crosstab %v", crosstab)
+		assert.EqualValues(t, 0, m.Used(), "Spilled data should have been cleaned up")
+		files, _ := ioutil.ReadDir(tmpDir)
+		assert.Empty(t, files, "Spill files should have been removed")
+	}
+}
+
+// collectGroups returns the values of every group by key, field and period.
+func collectGroups(t *testing.T, g RowSource) map[string]map[string]map[time.Time]float64 {
+	groups := make(map[string]map[string]map[time.Time]float64)
+	var fields Fields
+	_, err := g.Iterate(context.Background(), func(inFields Fields) error {
+		fields = inFields
+		return nil
+	}, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+		group := make(map[string]map[time.Time]float64)
+		for i, field := range fields {
+			values := make(map[time.Time]float64)
+			val := vals[i]
+			for p := 0; p < val.NumPeriods(field.Expr.EncodedWidth()); p++ {
+				if v, found := val.ValueAt(p, field.Expr); found {
+					values[val.Until().Add(-1*time.Duration(p)*g.GetResolution())] = v
+				}
+			}
+			group[field.Name] = values
+		}
+		groups[string(key)] = group
+		return true, nil
+	})
+	assert.NoError(t, err)
+	return groups
+}
@@ -0,0 +1,35 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// Localize converts the timestamps of rows that were grouped with a
+// GroupOpts.Location from wall clock times back to the instants that they
+// represent in loc.
+func Localize(source FlatRowSource, loc *time.Location) FlatRowSource {
+	return &localize{
+		flatRowTransform{source},
+		loc,
+	}
+}
+
+type localize struct {
+	flatRowTransform
+	loc *time.Location
+}
+
+func (l *localize) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRow) (interface{}, error) {
+	return l.source.Iterate(ctx, onFields, func(row *FlatRow) (bool, error) {
+		row.TS = encoding.FromWallClock(time.Unix(0, row.TS), l.loc).UnixNano()
+		return onRow(row)
+	})
+}
+
+func (l *localize) String() string {
+	return fmt.Sprintf("localize to %v", l.loc)
+}
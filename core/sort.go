@@ -1,9 +1,26 @@
 package core
 
 import (
+	"bufio"
+	"container/heap"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 	"sort"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/spill"
+)
+
+const (
+	// flatRowOverhead approximates the memory used by a FlatRow in addition to
+	// its key and values.
+	flatRowOverhead = 96
+
+	spillBufferSize = 65536
 )
 
 // OrderBy specifies an element by whith to order (element being ither a field
@@ -41,16 +58,29 @@ func (row *FlatRow) Get(param string) interface{} {
 	return row.Key.Get(param)
 }
 
+// Sort sorts all rows from source in memory.
 func Sort(source FlatRowSource, by ...OrderBy) FlatRowSource {
+	return SortWithMemoryLimit(source, 0, nil, by...)
+}
+
+// SortWithMemoryLimit sorts rows from source, keeping approximately memLimit
+// bytes worth of rows in memory. Once that's exceeded, it falls back to an
+// external merge sort that spills sorted runs to files counted against quota.
+// If memLimit <= 0, it sorts everything in memory.
+func SortWithMemoryLimit(source FlatRowSource, memLimit int, quota *spill.Quota, by ...OrderBy) FlatRowSource {
 	return &sorter{
 		flatRowTransform{source},
 		by,
+		memLimit,
+		quota,
 	}
 }
 
 type sorter struct {
 	flatRowTransform
-	by []OrderBy
+	by       []OrderBy
+	memLimit int
+	quota    *spill.Quota
 }
 
 func (s *sorter) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRow) (interface{}, error) {
@@ -59,12 +89,46 @@ func (s *sorter) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRow
 	rows := orderedRows{
 		orderBy: s.by,
 	}
+	memUsed := 0
+	var es *externalSort
 
 	metadata, err := s.source.Iterate(ctx, onFields, func(row *FlatRow) (bool, error) {
 		rows.rows = append(rows.rows, row)
+		if s.memLimit > 0 {
+			memUsed += flatRowOverhead + len(row.Key) + (len(row.Values)+len(row.Ints))*encoding.Width64bits
+			if memUsed > s.memLimit {
+				if es == nil {
+					es = &externalSort{by: s.by, fields: row.fields, quota: s.quota}
+				}
+				spillErr := es.spill(rows)
+				if spillErr != nil {
+					return false, spillErr
+				}
+				rows.rows = rows.rows[:0]
+				memUsed = 0
+			}
+		}
 		return guard.Proceed()
 	})
 
+	if es != nil {
+		defer es.remove()
+		if err == ErrDeadlineExceeded {
+			return metadata, err
+		}
+		if len(rows.rows) > 0 {
+			spillErr := es.spill(rows)
+			if spillErr != nil {
+				return metadata, spillErr
+			}
+		}
+		mergeErr := es.merge(guard, onRow)
+		if mergeErr != nil {
+			return metadata, mergeErr
+		}
+		return metadata, err
+	}
+
 	if err != ErrDeadlineExceeded {
 		sort.Sort(rows)
 		for _, row := range rows.rows {
@@ -84,6 +148,176 @@ func (s *sorter) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRow
 	return metadata, err
 }
 
+// externalSort spills sorted runs of rows to disk and then merges them.
+type externalSort struct {
+	by     []OrderBy
+	fields Fields
+	quota  *spill.Quota
+	runs   []*spill.File
+}
+
+// spill sorts the given rows and writes them to a new run on disk.
+func (es *externalSort) spill(rows orderedRows) error {
+	sort.Sort(rows)
+	run, err := es.quota.Create()
+	if err != nil {
+		return err
+	}
+	es.runs = append(es.runs, run)
+	out := bufio.NewWriterSize(run, spillBufferSize)
+	for _, row := range rows.rows {
+		_, err = out.Write(encodeFlatRow(row))
+		if err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// merge merges the sorted runs, passing the rows to onRow in order.
+func (es *externalSort) merge(guard TimeoutGuard, onRow OnFlatRow) error {
+	readers := make([]io.Reader, 0, len(es.runs))
+	heads := &rowHeap{orderBy: es.by}
+	next := func(i int) error {
+		b, err := readEncoded(readers[i])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to read spilled rows: %v", err)
+		}
+		heap.Push(heads, &runHead{decodeFlatRow(b, es.fields), i})
+		return nil
+	}
+
+	for i, run := range es.runs {
+		readers = append(readers, run.NewReader(spillBufferSize))
+		err := next(i)
+		if err != nil {
+			return err
+		}
+	}
+
+	for heads.Len() > 0 {
+		if guard.TimedOut() {
+			return ErrDeadlineExceeded
+		}
+		head := heap.Pop(heads).(*runHead)
+		more, onRowErr := onRow(head.row)
+		if onRowErr != nil {
+			return onRowErr
+		}
+		if !more {
+			return nil
+		}
+		err := next(head.run)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (es *externalSort) remove() {
+	for _, run := range es.runs {
+		run.Remove()
+	}
+}
+
+// runHead is the next row from one of the runs being merged
+type runHead struct {
+	row *FlatRow
+	run int
+}
+
+type rowHeap struct {
+	orderBy []OrderBy
+	heads   []*runHead
+}
+
+func (h *rowHeap) Len() int      { return len(h.heads) }
+func (h *rowHeap) Swap(i, j int) { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+func (h *rowHeap) Less(i, j int) bool {
+	return lessFlatRows(h.orderBy, h.heads[i].row, h.heads[j].row)
+}
+
+func (h *rowHeap) Push(x interface{}) {
+	h.heads = append(h.heads, x.(*runHead))
+}
+
+func (h *rowHeap) Pop() interface{} {
+	n := len(h.heads)
+	x := h.heads[n-1]
+	h.heads = h.heads[:n-1]
+	return x
+}
+
+// encodeFlatRow encodes a FlatRow as:
+//
+//	rowLength(64) | ts(64) | keyLength(32) | key | numValues(16) | values(64 each) | numInts(16) | ints(64 each)
+//
+// where rowLength includes itself.
+func encodeFlatRow(row *FlatRow) []byte {
+	rowLength := encoding.Width64bits + encoding.Width64bits + encoding.Width32bits + len(row.Key) + encoding.Width16bits + len(row.Values)*encoding.Width64bits + encoding.Width16bits + len(row.Ints)*encoding.Width64bits
+	_b := make([]byte, rowLength)
+	b := encoding.WriteInt64(_b, rowLength)
+	b = encoding.WriteInt64(b, int(row.TS))
+	b = encoding.WriteInt32(b, len(row.Key))
+	b = b[copy(b, row.Key):]
+	b = encoding.WriteInt16(b, len(row.Values))
+	for _, val := range row.Values {
+		encoding.Binary.PutUint64(b, math.Float64bits(val))
+		b = b[encoding.Width64bits:]
+	}
+	b = encoding.WriteInt16(b, len(row.Ints))
+	for _, val := range row.Ints {
+		encoding.Binary.PutUint64(b, uint64(val))
+		b = b[encoding.Width64bits:]
+	}
+	return _b
+}
+
+func decodeFlatRow(b []byte, fields Fields) *FlatRow {
+	b = b[encoding.Width64bits:]
+	ts, b := encoding.ReadInt64(b)
+	keyLength, b := encoding.ReadInt32(b)
+	key, b := encoding.ReadByteMap(b, keyLength)
+	numValues, b := encoding.ReadInt16(b)
+	values := make([]float64, numValues)
+	for i := range values {
+		values[i] = math.Float64frombits(encoding.Binary.Uint64(b))
+		b = b[encoding.Width64bits:]
+	}
+	numInts, b := encoding.ReadInt16(b)
+	var ints []int64
+	if numInts > 0 {
+		ints = make([]int64, numInts)
+		for i := range ints {
+			ints[i] = int64(encoding.Binary.Uint64(b))
+			b = b[encoding.Width64bits:]
+		}
+	}
+	return &FlatRow{
+		TS:     int64(ts),
+		Key:    bytemap.ByteMap(key),
+		Values: values,
+		Ints:   ints,
+		fields: fields,
+	}
+}
+
+func readEncoded(r io.Reader) ([]byte, error) {
+	rowLength := uint64(0)
+	err := binary.Read(r, encoding.Binary, &rowLength)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, rowLength)
+	encoding.Binary.PutUint64(b, rowLength)
+	_, err = io.ReadFull(r, b[encoding.Width64bits:])
+	return b, err
+}
+
 func (s *sorter) String() string {
 	return fmt.Sprintf("order by %v", s.by)
 }
@@ -96,9 +330,11 @@ type orderedRows struct {
 func (r orderedRows) Len() int      { return len(r.rows) }
 func (r orderedRows) Swap(i, j int) { r.rows[i], r.rows[j] = r.rows[j], r.rows[i] }
 func (r orderedRows) Less(i, j int) bool {
-	a := r.rows[i]
-	b := r.rows[j]
-	for _, order := range r.orderBy {
+	return lessFlatRows(r.orderBy, r.rows[i], r.rows[j])
+}
+
+func lessFlatRows(orderBy []OrderBy, a *FlatRow, b *FlatRow) bool {
+	for _, order := range orderBy {
 		// _time is a special case
 		if order.Field == "_time" {
 			ta := a.TS
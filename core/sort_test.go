@@ -1,11 +1,17 @@
 package core
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/spill"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -55,6 +61,95 @@ func TestSortAll(t *testing.T) {
 	assert.Equal(t, []int64{3, 0, 4, 2, 5, 1}, actualTimes(rows))
 }
 
+func TestSortWithMemoryLimit(t *testing.T) {
+	g := Group(&goodSource{}, GroupOpts{
+		Fields: StaticFieldSource{NewField("a", eA), NewField("b", eB), NewField("c", expr.CONST(10))},
+	})
+	by := []OrderBy{NewOrderBy("b", true), NewOrderBy("a", false), NewOrderBy("_time", false)}
+
+	collect := func(source FlatRowSource) []*FlatRow {
+		var rows []*FlatRow
+		_, err := source.Iterate(context.Background(), FieldsIgnored, func(row *FlatRow) (bool, error) {
+			rows = append(rows, row)
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return rows
+	}
+
+	expected := collect(Sort(Flatten(g), by...))
+	if !assert.NotEmpty(t, expected) {
+		return
+	}
+
+	// A tiny memory limit forces spilling every row to disk
+	actual := collect(SortWithMemoryLimit(Flatten(g), 1, nil, by...))
+	if assert.Len(t, actual, len(expected)) {
+		for i, row := range actual {
+			assert.Equal(t, expected[i].TS, row.TS)
+			assert.Equal(t, expected[i].Key, row.Key)
+			assert.Equal(t, expected[i].Values, row.Values)
+			assert.Equal(t, expected[i].Get("b"), row.Get("b"), "Spilled rows should retain their fields")
+		}
+	}
+
+	// Stopping early shouldn't hang
+	limited := collect(Limit(SortWithMemoryLimit(Flatten(g), 1, nil, by...), 2))
+	if assert.Len(t, limited, 2) {
+		assert.Equal(t, expected[0].TS, limited[0].TS)
+		assert.Equal(t, expected[1].TS, limited[1].TS)
+	}
+}
+
+func TestSortSpillQuota(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbspill")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	m, err := spill.New(&spill.Opts{Dir: tmpDir, MaxBytesPerQuery: 100})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	g := Group(&goodSource{}, GroupOpts{
+		Fields: StaticFieldSource{NewField("a", eA), NewField("b", eB)},
+	})
+	s := SortWithMemoryLimit(Flatten(g), 1, m.NewQuota(), NewOrderBy("a", false))
+	_, err = s.Iterate(context.Background(), FieldsIgnored, func(row *FlatRow) (bool, error) {
+		return true, nil
+	})
+	assert.Equal(t, spill.ErrQuotaExceeded, err)
+	assert.EqualValues(t, 0, m.Used(), "Spilled data should have been cleaned up")
+	files, _ := ioutil.ReadDir(tmpDir)
+	assert.Empty(t, files, "Spill files should have been removed")
+}
+
+func TestEncodeFlatRow(t *testing.T) {
+	fields := Fields{NewField("val", expr.FIELD("val"))}
+	row := &FlatRow{
+		TS:     56,
+		Key:    bytemap.New(map[string]interface{}{"s": "a", "b": true}),
+		Values: []float64{1.5, -2},
+		fields: fields,
+	}
+	decoded := decodeFlatRow(encodeFlatRow(row), fields)
+	assert.Equal(t, row, decoded)
+
+	row.Ints = []int64{1<<53 + 1, -2}
+	decoded = decodeFlatRow(encodeFlatRow(row), fields)
+	assert.Equal(t, row, decoded)
+
+	bigKey := make(map[string]interface{})
+	for i := 0; i < 20; i++ {
+		bigKey[fmt.Sprint(i)] = strings.Repeat("a", 4000)
+	}
+	row.Key = bytemap.New(bigKey)
+	decoded = decodeFlatRow(encodeFlatRow(row), fields)
+	assert.Equal(t, row, decoded, "keys longer than 64 KiB should survive spilling")
+}
+
 func actualTimes(rows []*FlatRow) []int64 {
 	return []int64{rows[0].TS, rows[1].TS, rows[2].TS, rows[3].TS, rows[4].TS, rows[5].TS}
 }
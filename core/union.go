@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/getlantern/bytemap"
+	"strings"
+	"time"
+)
+
+// Combination is implemented by sources that combine the rows of multiple
+// sources.
+type Combination interface {
+	GetSources() []Source
+}
+
+// Union combines the rows of the given sources, which all need to have the
+// same resolution. Its fields are the given fields, each of which needs to be
+// reported by one of the sources. Rows get the values of the fields reported
+// by the source from which they came and empty values for all other fields, so
+// Union is usually followed by a Group that merges the rows for the same key.
+// Sources are iterated one after the other and the metadata of the first
+// source is returned.
+func Union(fields Fields, sources ...RowSource) RowSource {
+	return &union{fields: fields, sources: sources}
+}
+
+type union struct {
+	fields  Fields
+	sources []RowSource
+}
+
+func (u *union) GetGroupBy() []GroupBy {
+	return u.sources[0].GetGroupBy()
+}
+
+func (u *union) GetResolution() time.Duration {
+	return u.sources[0].GetResolution()
+}
+
+// GetAsOf returns the earliest asOf of all sources.
+func (u *union) GetAsOf() time.Time {
+	asOf := u.sources[0].GetAsOf()
+	for _, source := range u.sources[1:] {
+		if sourceAsOf := source.GetAsOf(); sourceAsOf.Before(asOf) {
+			asOf = sourceAsOf
+		}
+	}
+	return asOf
+}
+
+// GetUntil returns the latest until of all sources.
+func (u *union) GetUntil() time.Time {
+	until := u.sources[0].GetUntil()
+	for _, source := range u.sources[1:] {
+		if sourceUntil := source.GetUntil(); sourceUntil.After(until) {
+			until = sourceUntil
+		}
+	}
+	return until
+}
+
+func (u *union) GetSources() []Source {
+	sources := make([]Source, 0, len(u.sources))
+	for _, source := range u.sources {
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+func (u *union) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (interface{}, error) {
+	err := onFields(u.fields)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata interface{}
+	for s, source := range u.sources {
+		// idxs maps the fields of the source to our fields
+		var idxs []int
+		sourceMetadata, err := source.Iterate(ctx, func(sourceFields Fields) error {
+			idxs = make([]int, len(sourceFields))
+			for i, sourceField := range sourceFields {
+				idxs[i] = -1
+				for j, field := range u.fields {
+					if field.Name == sourceField.Name {
+						idxs[i] = j
+						break
+					}
+				}
+			}
+			return nil
+		}, func(key bytemap.ByteMap, sourceVals Vals) (bool, error) {
+			vals := make(Vals, len(u.fields))
+			for i, idx := range idxs {
+				if idx >= 0 {
+					vals[idx] = sourceVals[i]
+				}
+			}
+			return onRow(key, vals)
+		})
+		if s == 0 {
+			metadata = sourceMetadata
+		}
+		if err != nil {
+			return metadata, err
+		}
+	}
+	return metadata, nil
+}
+
+func (u *union) String() string {
+	return fmt.Sprintf("union of %d sources: %v", len(u.sources), strings.Join(u.fields.Names(), ", "))
+}
@@ -0,0 +1,94 @@
+package zenodb
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/bytemap"
+)
+
+// dedupEntry records when a point with the given hash was inserted.
+type dedupEntry struct {
+	hash uint64
+	at   time.Time
+}
+
+// dedupWindow remembers hashes of the dimensions and timestamps of the points
+// that a table inserted within its DedupWindow in order to detect duplicates.
+// A nil dedupWindow never detects duplicates.
+type dedupWindow struct {
+	window time.Duration
+	seen   map[uint64]time.Time
+	// entries is ordered by insertion time, so that expired hashes can be
+	// pruned from the front
+	entries []dedupEntry
+	mx      sync.Mutex
+}
+
+func newDedupWindow(window time.Duration) *dedupWindow {
+	return &dedupWindow{
+		window: window,
+		seen:   make(map[uint64]time.Time),
+	}
+}
+
+// setWindow changes the duration of the window. A non-positive window
+// disables deduplication and forgets all remembered points.
+func (d *dedupWindow) setWindow(window time.Duration) {
+	if d == nil {
+		return
+	}
+	d.mx.Lock()
+	d.window = window
+	if window <= 0 {
+		d.seen = make(map[uint64]time.Time)
+		d.entries = nil
+	}
+	d.mx.Unlock()
+}
+
+// duplicate indicates whether a point with the same timestamp and dimensions
+// was already seen within the window as of now. If not, it remembers the
+// point.
+func (d *dedupWindow) duplicate(ts time.Time, dims bytemap.ByteMap, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if d.window <= 0 {
+		return false
+	}
+
+	cutoff := now.Add(-1 * d.window)
+	pruned := 0
+	for _, entry := range d.entries {
+		if !entry.at.Before(cutoff) {
+			break
+		}
+		if d.seen[entry.hash].Equal(entry.at) {
+			delete(d.seen, entry.hash)
+		}
+		pruned++
+	}
+	d.entries = d.entries[pruned:]
+
+	hash := dedupHash(ts, dims)
+	if _, found := d.seen[hash]; found {
+		return true
+	}
+	d.seen[hash] = now
+	d.entries = append(d.entries, dedupEntry{hash, now})
+	return false
+}
+
+func dedupHash(ts time.Time, dims bytemap.ByteMap) uint64 {
+	h := fnv.New64a()
+	var tsBytes [8]byte
+	binary.BigEndian.PutUint64(tsBytes[:], uint64(ts.UnixNano()))
+	h.Write(tsBytes[:])
+	h.Write(dims)
+	return h.Sum64()
+}
@@ -0,0 +1,102 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupWindow(t *testing.T) {
+	epoch := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	a := bytemap.New(map[string]interface{}{"a": 1})
+	b := bytemap.New(map[string]interface{}{"a": 2})
+
+	var disabled *dedupWindow
+	assert.False(t, disabled.duplicate(epoch, a, epoch))
+	assert.False(t, disabled.duplicate(epoch, a, epoch))
+
+	d := newDedupWindow(time.Minute)
+	assert.False(t, d.duplicate(epoch, a, epoch))
+	assert.True(t, d.duplicate(epoch, a, epoch.Add(30*time.Second)), "identical point within window should be a duplicate")
+	assert.False(t, d.duplicate(epoch, b, epoch.Add(30*time.Second)), "point with different dims shouldn't be a duplicate")
+	assert.False(t, d.duplicate(epoch.Add(time.Second), a, epoch.Add(30*time.Second)), "point with different timestamp shouldn't be a duplicate")
+	assert.False(t, d.duplicate(epoch, a, epoch.Add(90*time.Second)), "identical point outside of window shouldn't be a duplicate")
+	assert.Len(t, d.seen, 3, "expired points should have been forgotten")
+	assert.Len(t, d.entries, 3)
+
+	d.setWindow(0)
+	assert.Empty(t, d.seen)
+	assert.False(t, d.duplicate(epoch, a, epoch.Add(90*time.Second)))
+	assert.False(t, d.duplicate(epoch, a, epoch.Add(90*time.Second)), "disabled window shouldn't detect duplicates")
+}
+
+func TestDedup(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: vtime.NewVirtualClock(epoch),
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_dedup": &TableOpts{
+			RetentionPeriod: time.Hour,
+			DedupWindow:     time.Minute,
+			SQL:             "SELECT i FROM inbound GROUP BY period(1m)",
+		},
+		"test_all": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	insert := func(ts time.Time, dim int) {
+		assert.NoError(t, db.Insert("inbound", ts, map[string]interface{}{"dim": dim}, map[string]float64{"i": 1}))
+	}
+	insert(epoch, 1)
+	// Retried insert
+	insert(epoch, 1)
+	insert(epoch, 2)
+	insert(epoch.Add(time.Second), 1)
+	time.Sleep(250 * time.Millisecond)
+
+	query := func(table string) float64 {
+		source, err := db.Query("SELECT i FROM "+table, false, nil, true)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		total := float64(0)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			total += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return total
+	}
+	assert.EqualValues(t, 3, query("test_dedup"))
+	assert.EqualValues(t, 4, query("test_all"))
+	stats := db.TableStats("test_dedup")
+	assert.EqualValues(t, 3, stats.InsertedPoints)
+	assert.EqualValues(t, 1, stats.DedupedPoints)
+	assert.EqualValues(t, 0, db.TableStats("test_all").DedupedPoints)
+}
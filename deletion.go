@@ -0,0 +1,238 @@
+package zenodb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	tombstonesDir = "_tombstones"
+)
+
+// tombstone marks data of a table as deleted until it's been removed from
+// disk.
+type tombstone struct {
+	Where string
+	AsOf  time.Time
+	Until time.Time
+	where goexpr.Expr
+}
+
+type tombstones []*tombstone
+
+// Delete deletes the data of the named table for rows whose dimensions match
+// the given WHERE clause (e.g. "client = 'abc'"), limited to periods ending
+// after asOf and up to until unless those are zero. The deletion is recorded
+// as a tombstone that hides the data from queries right away. Delete then
+// rewrites the table's filestore (and rollup, if any) without the data and
+// removes the tombstone. Tombstones survive restarts, so interrupted deletions
+// complete when the table is next opened. Data that's inserted for the deleted
+// rows and periods while the deletion is in progress is deleted too. Delete
+// doesn't remove data from the WAL, from backups or from views of the table.
+func (db *DB) Delete(table string, where string, asOf time.Time, until time.Time) error {
+	if db.opts.ReadOnly {
+		return errors.New("Can't delete data from a ReadOnly database")
+	}
+	t := db.getTable(table)
+	if t == nil {
+		return errors.New("Table %v not found", table)
+	}
+	if t.Virtual {
+		return errors.New("Table %v is virtual and has no data to delete", table)
+	}
+	if t.InMemory {
+		return errors.New("Table %v is in-memory, its data expires with its retention period", table)
+	}
+	if where == "" {
+		return errors.New("Please specify a WHERE clause selecting the rows to delete")
+	}
+	if !asOf.IsZero() && !until.IsZero() && !until.After(asOf) {
+		return errors.New("Until %v must be after asOf %v", until, asOf)
+	}
+	ts, err := newTombstone(where, asOf, until)
+	if err != nil {
+		return err
+	}
+
+	err = t.addTombstone(ts)
+	if err != nil {
+		return err
+	}
+	t.log.Debugf("Deleting data where %v between %v and %v", where, asOf, until)
+	return t.completeDeletions()
+}
+
+// completeDeletions removes the data deleted by the table's tombstones from
+// disk, after which the tombstones are removed.
+func (t *table) completeDeletions() error {
+	tss := t.getTombstones()
+	if t.getRollup() != nil {
+		err := t.deleteFromRollup(tss)
+		if err != nil {
+			return err
+		}
+	}
+	t.rowStore.compact()
+	return nil
+}
+
+func newTombstone(where string, asOf time.Time, until time.Time) (*tombstone, error) {
+	whereExpr, err := whereFor(where)
+	if err != nil {
+		return nil, err
+	}
+	return &tombstone{Where: where, AsOf: asOf, Until: until, where: whereExpr}, nil
+}
+
+// matches indicates whether the tombstone applies to the row with the given
+// key.
+func (ts *tombstone) matches(key bytemap.ByteMap) bool {
+	matched, _ := ts.where.Eval(key).(bool)
+	return matched
+}
+
+// filter wraps onRow so that it doesn't see data deleted by any of the
+// tombstones. Rows that have no data left are skipped.
+func (tss tombstones) filter(fields core.Fields, resolution time.Duration, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (bool, error)) func(bytemap.ByteMap, []encoding.Sequence, []byte) (bool, error) {
+	return func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		for _, ts := range tss {
+			if !ts.matches(key) {
+				continue
+			}
+			if ts.AsOf.IsZero() && ts.Until.IsZero() {
+				// the whole row is deleted
+				return true, nil
+			}
+			remaining := false
+			for i, seq := range columns {
+				if seq == nil {
+					continue
+				}
+				seq = seq.ClearPeriods(fields[i].Expr.EncodedWidth(), resolution, ts.AsOf, ts.Until)
+				columns[i] = seq
+				if seq != nil {
+					remaining = true
+				}
+			}
+			if !remaining {
+				return true, nil
+			}
+		}
+		return onRow(key, columns, raw)
+	}
+}
+
+func (t *table) tombstonesFile() string {
+	return filepath.Join(t.db.opts.Dir, tombstonesDir, t.Name+".json")
+}
+
+func (t *table) getTombstones() tombstones {
+	t.tombstonesMx.RLock()
+	tss := t.tombstones
+	t.tombstonesMx.RUnlock()
+	return tss
+}
+
+func (t *table) addTombstone(ts *tombstone) error {
+	t.tombstonesMx.Lock()
+	defer t.tombstonesMx.Unlock()
+	tss := append(append(tombstones{}, t.tombstones...), ts)
+	err := t.saveTombstones(tss)
+	if err != nil {
+		return err
+	}
+	t.tombstones = tss
+	return nil
+}
+
+// removeTombstones removes the given tombstones once the data that they delete
+// has been removed from disk.
+func (t *table) removeTombstones(removed tombstones) {
+	if len(removed) == 0 {
+		return
+	}
+	t.tombstonesMx.Lock()
+	defer t.tombstonesMx.Unlock()
+	var tss tombstones
+	for _, ts := range t.tombstones {
+		keep := true
+		for _, r := range removed {
+			if ts == r {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			tss = append(tss, ts)
+		}
+	}
+	err := t.saveTombstones(tss)
+	if err != nil {
+		t.log.Errorf("Unable to remove tombstones, will apply them again: %v", err)
+		return
+	}
+	t.tombstones = tss
+}
+
+func (t *table) saveTombstones(tss tombstones) error {
+	filename := t.tombstonesFile()
+	if len(tss) == 0 {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.New("Unable to remove tombstones file: %v", err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(tss)
+	if err != nil {
+		return errors.New("Unable to encode tombstones: %v", err)
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return errors.New("Unable to create tombstones directory: %v", err)
+	}
+	tmpFile := filename + ".tmp"
+	err = ioutil.WriteFile(tmpFile, b, 0644)
+	if err == nil {
+		err = os.Rename(tmpFile, filename)
+	}
+	if err != nil {
+		return errors.New("Unable to save tombstones: %v", err)
+	}
+	return nil
+}
+
+// openTombstones loads the tombstones of deletions that didn't complete before
+// we were last stopped.
+func (t *table) openTombstones() error {
+	b, err := ioutil.ReadFile(t.tombstonesFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.New("Unable to read tombstones: %v", err)
+	}
+	var tss tombstones
+	err = json.Unmarshal(b, &tss)
+	if err != nil {
+		return errors.New("Unable to decode tombstones: %v", err)
+	}
+	for _, ts := range tss {
+		ts.where, err = whereFor(ts.Where)
+		if err != nil {
+			return err
+		}
+	}
+	t.tombstones = tss
+	t.log.Debugf("Found %d pending deletions", len(tss))
+	return nil
+}
@@ -0,0 +1,113 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelete(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: vtime.NewVirtualClock(epoch),
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT requests FROM inbound GROUP BY client, period(10m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	insert := func(ts time.Time, client string, requests float64) {
+		assert.NoError(t, db.Insert("inbound", ts, map[string]interface{}{"client": client}, map[string]float64{"requests": requests}))
+	}
+	insert(epoch.Add(-35*time.Minute), "a", 1)
+	insert(epoch.Add(-25*time.Minute), "a", 2)
+	insert(epoch.Add(-15*time.Minute), "a", 4)
+	insert(epoch.Add(-35*time.Minute), "b", 8)
+	insert(epoch.Add(-15*time.Minute), "b", 16)
+	time.Sleep(250 * time.Millisecond)
+
+	query := func() map[string]float64 {
+		source, err := db.Query("SELECT requests FROM test_a ASOF '-1h' GROUP BY client, period(10m)", false, nil, true)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		results := make(map[string]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			if row.Values[0] != 0 {
+				key := row.Key.Get("client").(string) + " " + time.Unix(0, row.TS).UTC().Format("15:04")
+				results[key] = row.Values[0]
+			}
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return results
+	}
+
+	assert.Equal(t, map[string]float64{
+		"a 11:30": 1,
+		"a 11:40": 2,
+		"a 11:50": 4,
+		"b 11:30": 8,
+		"b 11:50": 16,
+	}, query(), "before deleting")
+
+	assert.Error(t, db.Delete("unknown", "client = 'a'", time.Time{}, time.Time{}), "deleting from unknown table should fail")
+	assert.Error(t, db.Delete("test_a", "", time.Time{}, time.Time{}), "deleting without WHERE clause should fail")
+	assert.Error(t, db.Delete("test_a", "client = 'a'", epoch, epoch.Add(-1*time.Hour)), "deleting with until before asOf should fail")
+
+	if !assert.NoError(t, db.Delete("test_a", "client = 'a'", epoch.Add(-30*time.Minute), epoch.Add(-20*time.Minute))) {
+		return
+	}
+	assert.Equal(t, map[string]float64{
+		"a 11:30": 1,
+		"a 11:50": 4,
+		"b 11:30": 8,
+		"b 11:50": 16,
+	}, query(), "after deleting time range")
+
+	if !assert.NoError(t, db.Delete("test_a", "client = 'b'", time.Time{}, time.Time{})) {
+		return
+	}
+	assert.Equal(t, map[string]float64{
+		"a 11:30": 1,
+		"a 11:50": 4,
+	}, query(), "after deleting whole rows")
+
+	table := db.getTable("test_a")
+	assert.Empty(t, table.getTombstones())
+	_, err = os.Stat(table.tombstonesFile())
+	assert.True(t, os.IsNotExist(err), "tombstones file should be removed after compaction")
+
+	insert(epoch.Add(-15*time.Minute), "b", 32)
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, map[string]float64{
+		"a 11:30": 1,
+		"a 11:50": 4,
+		"b 11:50": 32,
+	}, query(), "new data should be kept after deletion completes")
+}
@@ -0,0 +1,204 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+)
+
+const (
+	describeKindDim  = "kind"
+	describeNameDim  = "name"
+	describeValueDim = "value"
+
+	tableTypeDim       = "type"
+	tableFromDim       = "from"
+	tableRetentionDim  = "retention"
+	tableResolutionDim = "resolution"
+)
+
+// tablesSource is a core.FlatRowSource for a SHOW TABLES statement. It returns
+// one row per table and view, with its name, type, source stream or table,
+// retention period and resolution as dimensions.
+type tablesSource struct {
+	db *DB
+}
+
+func (s *tablesSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	stats := s.db.metaDataStats()
+	err := onFields(core.Fields{})
+	if err != nil {
+		return stats, err
+	}
+	s.db.tablesMutex.RLock()
+	tables := make([]*table, 0, len(s.db.tables))
+	for _, t := range s.db.tables {
+		tables = append(tables, t)
+	}
+	s.db.tablesMutex.RUnlock()
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].Name < tables[j].Name
+	})
+
+	ts := s.GetUntil().UnixNano()
+	for _, t := range tables {
+		tableType := "table"
+		if t.View {
+			tableType = "view"
+		}
+		more, err := onRow(&core.FlatRow{
+			TS: ts,
+			Key: bytemap.New(map[string]interface{}{
+				describeNameDim:    t.Name,
+				tableTypeDim:       tableType,
+				tableFromDim:       t.readsFrom(),
+				tableRetentionDim:  t.RetentionPeriod.String(),
+				tableResolutionDim: t.Resolution.String(),
+			}),
+		})
+		if !more || err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func (s *tablesSource) GetGroupBy() []core.GroupBy {
+	return nil
+}
+
+func (s *tablesSource) GetResolution() time.Duration {
+	return 0
+}
+
+func (s *tablesSource) GetAsOf() time.Time {
+	return s.GetUntil()
+}
+
+func (s *tablesSource) GetUntil() time.Time {
+	return s.db.clock.Now()
+}
+
+func (s *tablesSource) String() string {
+	return "show tables"
+}
+
+// describeSource is a core.FlatRowSource for a DESCRIBE statement. It returns
+// one row per option, dimension, field and view of the table, with the kind of
+// row, the name and the value (like the expression of a field) as dimensions.
+type describeSource struct {
+	db *DB
+	t  *table
+}
+
+func (db *DB) describe(name string) (*describeSource, error) {
+	var t *table
+	if isAttachedTable(name) {
+		var err error
+		t, err = db.getAttachedTable(name)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		t = db.getTable(name)
+		if t == nil {
+			return nil, errors.New("Table %v not found", name)
+		}
+	}
+	return &describeSource{db: db, t: t}, nil
+}
+
+func (s *describeSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	stats := s.db.metaDataStats()
+	err := onFields(core.Fields{})
+	if err != nil {
+		return stats, err
+	}
+
+	t := s.t
+	t.whereMutex.RLock()
+	groupBy := t.GroupBy
+	t.whereMutex.RUnlock()
+	type row struct{ kind, name, value string }
+	rows := []row{
+		{"option", "from", t.readsFrom()},
+		{"option", "retentionperiod", t.RetentionPeriod.String()},
+		{"option", "resolution", t.Resolution.String()},
+		{"option", "sql", t.TableOpts.SQL},
+	}
+	if len(groupBy) == 0 {
+		rows = append(rows, row{"dimension", "*", "all dimensions"})
+	}
+	for _, gb := range groupBy {
+		rows = append(rows, row{"dimension", gb.Name, gb.Expr.String()})
+	}
+	for _, field := range t.getFields() {
+		rows = append(rows, row{"field", field.Name, field.Expr.String()})
+	}
+	views := s.db.viewsOf(t.Name)
+	sort.Strings(views)
+	for _, view := range views {
+		value := ""
+		if v := s.db.getTable(view); v != nil {
+			value = fmt.Sprintf("retention %v, resolution %v", v.RetentionPeriod, v.Resolution)
+		}
+		rows = append(rows, row{"view", view, value})
+	}
+
+	ts := s.GetUntil().UnixNano()
+	for _, r := range rows {
+		more, err := onRow(&core.FlatRow{
+			TS: ts,
+			Key: bytemap.New(map[string]interface{}{
+				describeKindDim:  r.kind,
+				describeNameDim:  r.name,
+				describeValueDim: r.value,
+			}),
+		})
+		if !more || err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func (s *describeSource) GetGroupBy() []core.GroupBy {
+	return nil
+}
+
+func (s *describeSource) GetResolution() time.Duration {
+	return 0
+}
+
+func (s *describeSource) GetAsOf() time.Time {
+	return s.GetUntil()
+}
+
+func (s *describeSource) GetUntil() time.Time {
+	return s.db.clock.Now()
+}
+
+func (s *describeSource) String() string {
+	return "describe " + s.t.Name
+}
+
+// readsFrom returns the name of the table of a view, or the stream of a table.
+func (t *table) readsFrom() string {
+	if t.View {
+		return t.viewOf
+	}
+	return t.From
+}
+
+// metaDataStats returns stats for statements like SHOW SETTINGS that describe
+// this node rather than reading data.
+func (db *DB) metaDataStats() *common.QueryStats {
+	now := common.TimeToMillis(db.clock.Now())
+	return &common.QueryStats{NumPartitions: 1, NumSuccessfulPartitions: 1, LowestHighWaterMark: now, HighestHighWaterMark: now}
+}
@@ -0,0 +1,75 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShowTablesAndDescribe(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i, SUM(ii) AS ii FROM inbound GROUP BY server, period(1m)",
+		},
+		"view_a": &TableOpts{
+			View:            true,
+			RetentionPeriod: 2 * time.Hour,
+			SQL:             "SELECT i FROM test_a GROUP BY period(5m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	query := func(sqlString string, dims ...string) [][]string {
+		source, err := db.Query(sqlString, false, nil, false)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		var rows [][]string
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			values := make([]string, 0, len(dims))
+			for _, dim := range dims {
+				values = append(values, row.Key.Get(dim).(string))
+			}
+			rows = append(rows, values)
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return rows
+	}
+
+	assert.Equal(t, [][]string{
+		{"test_a", "table", "inbound", "1h0m0s", "1m0s"},
+		{"view_a", "view", "test_a", "2h0m0s", "5m0s"},
+	}, query("SHOW TABLES", "name", "type", "from", "retention", "resolution"))
+
+	described := query("DESCRIBE test_a", "kind", "name", "value")
+	assert.Contains(t, described, []string{"option", "retentionperiod", "1h0m0s"})
+	assert.Contains(t, described, []string{"dimension", "server", "server"})
+	assert.Contains(t, described, []string{"field", "ii", "SUM(ii)"})
+	assert.Contains(t, described, []string{"view", "view_a", "retention 2h0m0s, resolution 5m0s"})
+
+	_, err = db.Query("DESCRIBE unknown", false, nil, false)
+	assert.Error(t, err, "describing unknown table should fail")
+}
@@ -0,0 +1,529 @@
+package zenodb
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/compress"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/oxtoacart/emsort"
+)
+
+const (
+	// maxDictionaryValuesPerDim caps the number of distinct values of a single
+	// dimension that are dictionary encoded. Dimensions with more distinct
+	// values than this aren't considered low-cardinality and are stored as is.
+	maxDictionaryValuesPerDim = 256
+
+	// maxDictionaryEntries is the most entries that fit into a dictionary, given
+	// that ids are 16 bits wide.
+	maxDictionaryEntries = math.MaxUint16
+)
+
+type dictionaryEntry struct {
+	dim   string
+	value string
+}
+
+// dimensionDictionary maps repeated string dimension values to small integer
+// ids. Every filestore (starting with FileVersion_5) contains its own
+// dictionary, written right after the header, and the keys of its rows refer
+// to dimension values by id. Values that aren't in the dictionary are stored
+// as is, so a dictionary never has to be complete.
+type dimensionDictionary struct {
+	entries []dictionaryEntry
+	ids     map[string]map[string]uint16
+}
+
+func newDimensionDictionary() *dimensionDictionary {
+	return &dimensionDictionary{
+		ids: make(map[string]map[string]uint16),
+	}
+}
+
+// add adds the given dimension value to the dictionary if it's not there
+// already and there's still room for it.
+func (d *dimensionDictionary) add(dim string, value string) {
+	values := d.ids[dim]
+	if _, found := values[value]; found {
+		return
+	}
+	if len(values) >= maxDictionaryValuesPerDim || len(d.entries) >= maxDictionaryEntries {
+		return
+	}
+	if values == nil {
+		values = make(map[string]uint16)
+		d.ids[dim] = values
+	}
+	values[value] = uint16(len(d.entries))
+	d.entries = append(d.entries, dictionaryEntry{dim, value})
+}
+
+func (d *dimensionDictionary) copy() *dimensionDictionary {
+	result := newDimensionDictionary()
+	for _, entry := range d.entries {
+		result.add(entry.dim, entry.value)
+	}
+	return result
+}
+
+// encodeKey encodes the given key as the number of dictionary ids, followed
+// by the ids of all dimension values found in the dictionary and a ByteMap
+// with the remaining dimensions.
+func (d *dimensionDictionary) encodeKey(key bytemap.ByteMap) []byte {
+	var ids []uint16
+	var residualDims []string
+	var residualValues []interface{}
+	key.IterateValues(func(dim string, value interface{}) bool {
+		if s, ok := value.(string); ok {
+			if id, found := d.ids[dim][s]; found {
+				ids = append(ids, id)
+				return true
+			}
+		}
+		residualDims = append(residualDims, dim)
+		residualValues = append(residualValues, value)
+		return true
+	})
+
+	residual := key
+	if len(ids) > 0 {
+		residual = bytemap.FromSortedKeysAndValues(residualDims, residualValues)
+	}
+	encoded := make([]byte, encoding.Width16bits*(1+len(ids))+len(residual))
+	encoding.Binary.PutUint16(encoded, uint16(len(ids)))
+	for i, id := range ids {
+		encoding.Binary.PutUint16(encoded[encoding.Width16bits*(1+i):], id)
+	}
+	copy(encoded[encoding.Width16bits*(1+len(ids)):], residual)
+	return encoded
+}
+
+// decodeKey reverses encodeKey.
+func (d *dimensionDictionary) decodeKey(encoded []byte) (bytemap.ByteMap, error) {
+	if len(encoded) < encoding.Width16bits {
+		return nil, errors.New("Encoded key too short")
+	}
+	numIDs := int(encoding.Binary.Uint16(encoded))
+	idsLength := encoding.Width16bits * (1 + numIDs)
+	if len(encoded) < idsLength {
+		return nil, errors.New("Encoded key too short for %d dictionary ids", numIDs)
+	}
+	residual := bytemap.ByteMap(encoded[idsLength:])
+	if numIDs == 0 {
+		return residual, nil
+	}
+
+	dims := make([]string, 0, numIDs)
+	values := make([]interface{}, 0, numIDs)
+	i := 0
+	nextEntry := func() (*dictionaryEntry, error) {
+		if i >= numIDs {
+			return nil, nil
+		}
+		id := int(encoding.Binary.Uint16(encoded[encoding.Width16bits*(1+i):]))
+		if id >= len(d.entries) {
+			return nil, errors.New("Unknown dictionary id %d", id)
+		}
+		return &d.entries[id], nil
+	}
+	entry, err := nextEntry()
+	if err != nil {
+		return nil, err
+	}
+	// Both the dictionary encoded dimensions and the residual dimensions are
+	// sorted, merge them into a single sorted list.
+	residual.IterateValues(func(dim string, value interface{}) bool {
+		for entry != nil && entry.dim < dim {
+			dims = append(dims, entry.dim)
+			values = append(values, entry.value)
+			i++
+			entry, err = nextEntry()
+			if err != nil {
+				return false
+			}
+		}
+		dims = append(dims, dim)
+		values = append(values, value)
+		return true
+	})
+	for err == nil && entry != nil {
+		dims = append(dims, entry.dim)
+		values = append(values, entry.value)
+		i++
+		entry, err = nextEntry()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytemap.FromSortedKeysAndValues(dims, values), nil
+}
+
+// write writes the dictionary, prefixed with its length.
+func (d *dimensionDictionary) write(w io.Writer) error {
+	length := encoding.Width16bits
+	for _, entry := range d.entries {
+		length += 2*encoding.Width16bits + len(entry.dim) + len(entry.value)
+	}
+	b := make([]byte, encoding.Width32bits+length)
+	encoding.Binary.PutUint32(b, uint32(length))
+	offset := encoding.Width32bits
+	encoding.Binary.PutUint16(b[offset:], uint16(len(d.entries)))
+	offset += encoding.Width16bits
+	for _, entry := range d.entries {
+		for _, s := range []string{entry.dim, entry.value} {
+			encoding.Binary.PutUint16(b[offset:], uint16(len(s)))
+			offset += encoding.Width16bits
+			offset += copy(b[offset:], s)
+		}
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readDimensionDictionary reads a dictionary that was written with write.
+func readDimensionDictionary(r io.Reader) (*dimensionDictionary, error) {
+	length := uint32(0)
+	err := binary.Read(r, encoding.Binary, &length)
+	if err != nil {
+		return nil, errors.New("Unable to read dictionary length: %v", err)
+	}
+	b := make([]byte, length)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, errors.New("Unable to read dictionary: %v", err)
+	}
+	if len(b) < encoding.Width16bits {
+		return nil, errors.New("Dictionary too short")
+	}
+	d := newDimensionDictionary()
+	numEntries, b := encoding.ReadInt16(b)
+	readString := func() (string, error) {
+		if len(b) < encoding.Width16bits {
+			return "", errors.New("Dictionary truncated")
+		}
+		var l int
+		l, b = encoding.ReadInt16(b)
+		if len(b) < l {
+			return "", errors.New("Dictionary truncated")
+		}
+		s := string(b[:l])
+		b = b[l:]
+		return s, nil
+	}
+	for i := 0; i < numEntries; i++ {
+		dim, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		// Don't use add, ids have to match the order in which entries were
+		// written even if caps have changed since.
+		values := d.ids[dim]
+		if values == nil {
+			values = make(map[string]uint16)
+			d.ids[dim] = values
+		}
+		values[value] = uint16(len(d.entries))
+		d.entries = append(d.entries, dictionaryEntry{dim, value})
+	}
+	return d, nil
+}
+
+// dictionaryBuilder collects the distinct string values of dimensions in
+// order to build a dictionary.
+type dictionaryBuilder struct {
+	values          map[string]map[string]bool
+	highCardinality map[string]bool
+}
+
+func newDictionaryBuilder() *dictionaryBuilder {
+	return &dictionaryBuilder{
+		values:          make(map[string]map[string]bool),
+		highCardinality: make(map[string]bool),
+	}
+}
+
+func (b *dictionaryBuilder) addKey(key bytemap.ByteMap) {
+	key.IterateValues(func(dim string, value interface{}) bool {
+		if s, ok := value.(string); ok {
+			b.addValue(dim, s)
+		}
+		return true
+	})
+}
+
+func (b *dictionaryBuilder) addDictionary(d *dimensionDictionary) {
+	for _, entry := range d.entries {
+		b.addValue(entry.dim, entry.value)
+	}
+}
+
+func (b *dictionaryBuilder) addValue(dim string, value string) {
+	if b.highCardinality[dim] {
+		return
+	}
+	values := b.values[dim]
+	if values == nil {
+		values = make(map[string]bool)
+		b.values[dim] = values
+	}
+	values[value] = true
+	if len(values) > maxDictionaryValuesPerDim {
+		// Don't bother tracking values for this dimension anymore
+		delete(b.values, dim)
+		b.highCardinality[dim] = true
+	}
+}
+
+// build builds a dictionary containing all entries of base (which may be nil)
+// with the same ids, plus the values of low-cardinality dimensions that were
+// collected by this builder.
+func (b *dictionaryBuilder) build(base *dimensionDictionary) *dimensionDictionary {
+	d := newDimensionDictionary()
+	if base != nil {
+		d = base.copy()
+	}
+	dims := make([]string, 0, len(b.values))
+	for dim := range b.values {
+		dims = append(dims, dim)
+	}
+	sort.Strings(dims)
+	for _, dim := range dims {
+		values := make([]string, 0, len(b.values[dim]))
+		for value := range b.values[dim] {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			d.add(dim, value)
+		}
+	}
+	return d
+}
+
+// dictionaryFor builds the dictionary for the filestore that's written when
+// flushing the given memstore into this fileStore without sorting. The new
+// filestore may include raw rows from this one, so its dictionary starts out as
+// a copy of this one's, to which new values from the memstore are added.
+// Sorted flushes rebuild the dictionary instead (see dictionaryRebuilder).
+func (fs *fileStore) dictionaryFor(ms *memstore) (*dimensionDictionary, error) {
+	base, err := fs.readDictionary()
+	if err != nil {
+		return nil, err
+	}
+	b := newDictionaryBuilder()
+	if ms != nil {
+		ms.tree.Walk(time.Now().UnixNano(), func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+			b.addKey(key)
+			return true, true, nil
+		})
+	}
+	return b.build(base), nil
+}
+
+// readDictionary reads the dictionary of this filestore. Filestores that don't
+// exist yet or that were written prior to FileVersion_5 have empty
+// dictionaries.
+func (fs *fileStore) readDictionary() (*dimensionDictionary, error) {
+	d := newDimensionDictionary()
+	if fs.filename != "" && isColumnar(fs.filename) {
+		cr, err := openColumnar(fs.t.keyring(), fs.filename)
+		if os.IsNotExist(err) {
+			return d, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer cr.Close()
+		return cr.footer.dict, nil
+	}
+	err := fs.readHeader(func(r io.Reader, dict *dimensionDictionary) error {
+		d = dict
+		return nil
+	})
+	return d, err
+}
+
+// dictionaryRebuilder sorts the rows written to it and collects the dimension
+// values of their keys along the way, so that sorted flushes can rebuild the
+// dictionary without an additional pass over the data. Rows are written with
+// keys encoded using the dictionary in. Once they've all been sorted, they're
+// passed to a dictionaryReencoder.
+type dictionaryRebuilder struct {
+	sorted  emsort.SortedWriter
+	in      *dimensionDictionary
+	builder *dictionaryBuilder
+}
+
+// Write writes a single, complete row.
+func (r *dictionaryRebuilder) Write(row []byte) (int, error) {
+	key, err := r.in.decodeKey(encodedKeyOf(row))
+	if err != nil {
+		return 0, err
+	}
+	r.builder.addKey(key)
+	return r.sorted.Write(row)
+}
+
+func (r *dictionaryRebuilder) Close() error {
+	return r.sorted.Close()
+}
+
+// dictionaryReencoder receives the sorted rows from a dictionaryRebuilder. It
+// writes the dictionary built from their keys, followed by the rows with their
+// keys re-encoded using that dictionary.
+type dictionaryReencoder struct {
+	out     io.WriteCloser
+	in      *dimensionDictionary
+	builder *dictionaryBuilder
+	dict    *dimensionDictionary
+	buf     []byte
+}
+
+func (r *dictionaryReencoder) writeDictionary() error {
+	if r.dict != nil {
+		return nil
+	}
+	r.dict = r.builder.build(nil)
+	err := r.dict.write(r.out)
+	if err != nil {
+		return errors.New("Unable to write dictionary: %v", err)
+	}
+	return nil
+}
+
+// Write accepts arbitrary chunks of rows, buffering partial rows until they're
+// complete.
+func (r *dictionaryReencoder) Write(b []byte) (int, error) {
+	err := r.writeDictionary()
+	if err != nil {
+		return 0, err
+	}
+	r.buf = append(r.buf, b...)
+	remain := r.buf
+	for len(remain) >= encoding.Width64bits {
+		rowLength := int(encoding.Binary.Uint64(remain))
+		if len(remain) < rowLength {
+			break
+		}
+		err = r.writeRow(remain[:rowLength])
+		if err != nil {
+			return 0, err
+		}
+		remain = remain[rowLength:]
+	}
+	r.buf = append(r.buf[:0], remain...)
+	return len(b), nil
+}
+
+func (r *dictionaryReencoder) writeRow(row []byte) error {
+	encodedKey := encodedKeyOf(row)
+	key, err := r.in.decodeKey(encodedKey)
+	if err != nil {
+		return err
+	}
+	reencodedKey := r.dict.encodeKey(key)
+	rest := row[encoding.Width64bits+encoding.Width16bits+len(encodedKey):]
+	header := make([]byte, encoding.Width64bits+encoding.Width16bits)
+	encoding.Binary.PutUint64(header, uint64(len(header)+len(reencodedKey)+len(rest)))
+	encoding.Binary.PutUint16(header[encoding.Width64bits:], uint16(len(reencodedKey)))
+	for _, b := range [][]byte{header, reencodedKey, rest} {
+		_, err = r.out.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *dictionaryReencoder) Close() error {
+	err := r.writeDictionary()
+	if err != nil {
+		return err
+	}
+	if len(r.buf) > 0 {
+		return errors.New("%d bytes of incomplete row left after sorting", len(r.buf))
+	}
+	return r.out.Close()
+}
+
+// encodedKeyOf returns the encoded key of the given row (see fileStore).
+func encodedKeyOf(row []byte) []byte {
+	keyLength := int(encoding.Binary.Uint16(row[encoding.Width64bits:]))
+	start := encoding.Width64bits + encoding.Width16bits
+	return row[start : start+keyLength]
+}
+
+// excludes indicates that the given key, which was encoded with this
+// dictionary, can't have the given dimension values. This only considers
+// dimensions whose values in the key are in the dictionary, which allows
+// skipping rows without decoding their keys.
+func (d *dimensionDictionary) excludes(encodedKey []byte, equals map[string]string) bool {
+	if len(equals) == 0 || len(encodedKey) < encoding.Width16bits {
+		return false
+	}
+	numIDs := int(encoding.Binary.Uint16(encodedKey))
+	if len(encodedKey) < encoding.Width16bits*(1+numIDs) {
+		return false
+	}
+	for i := 0; i < numIDs; i++ {
+		id := int(encoding.Binary.Uint16(encodedKey[encoding.Width16bits*(1+i):]))
+		if id >= len(d.entries) {
+			// leave it to decodeKey to report the problem
+			return false
+		}
+		entry := &d.entries[id]
+		if value, found := equals[entry.dim]; found && value != entry.value {
+			return true
+		}
+	}
+	return false
+}
+
+// readHeader opens this filestore, reads its header and dictionary and then
+// calls fn with a reader positioned at the first row. If the filestore doesn't
+// exist, fn isn't called.
+func (fs *fileStore) readHeader(fn func(r io.Reader, dict *dimensionDictionary) error) error {
+	if fs.filename == "" {
+		return nil
+	}
+	file, err := os.Open(fs.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New("Unable to open file %v: %v", fs.filename, err)
+	}
+	defer file.Close()
+	dr, err := fs.t.keyring().NewReader(file)
+	if err != nil {
+		return errors.New("Unable to decrypt file %v: %v", fs.filename, err)
+	}
+	r, err := compress.NewReader(dr)
+	if err != nil {
+		return errors.New("Unable to decompress file %v: %v", fs.filename, err)
+	}
+	defer r.Close()
+	_, _, _, err = fs.info(r)
+	if err != nil {
+		return err
+	}
+	dict := newDimensionDictionary()
+	if versionFor(fs.filename) >= FileVersion_5 {
+		dict, err = readDimensionDictionary(r)
+		if err != nil {
+			return err
+		}
+	}
+	return fn(r, dict)
+}
@@ -0,0 +1,171 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDimensionDictionaryEncoding(t *testing.T) {
+	b := newDictionaryBuilder()
+	for i := 0; i < maxDictionaryValuesPerDim+1; i++ {
+		b.addValue("id", fmt.Sprint(i))
+	}
+	b.addKey(bytemap.New(map[string]interface{}{"country": "us", "dc": "ams", "num": 5}))
+	b.addKey(bytemap.New(map[string]interface{}{"country": "de"}))
+	d := b.build(nil)
+	assert.Len(t, d.entries, 3, "high cardinality and non-string dimensions shouldn't be included")
+
+	keys := []bytemap.ByteMap{
+		bytemap.New(map[string]interface{}{"country": "us", "dc": "ams", "id": "12", "num": 5}),
+		bytemap.New(map[string]interface{}{"a": "first", "country": "de", "z": "last"}),
+		bytemap.New(map[string]interface{}{"country": "fr", "num": 6}),
+		bytemap.New(map[string]interface{}{"country": "us", "dc": "ams"}),
+		bytemap.New(nil),
+	}
+	for _, key := range keys {
+		encoded := d.encodeKey(key)
+		decoded, err := d.decodeKey(encoded)
+		if assert.NoError(t, err) {
+			assert.Equal(t, key.AsMap(), decoded.AsMap())
+		}
+	}
+	assert.True(t, len(d.encodeKey(keys[3])) < len(keys[3]), "encoded key should be smaller")
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, d.write(&buf)) {
+		return
+	}
+	read, err := readDimensionDictionary(&buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, d.entries, read.entries)
+	decoded, err := read.decodeKey(d.encodeKey(keys[0]))
+	if assert.NoError(t, err) {
+		assert.Equal(t, keys[0].AsMap(), decoded.AsMap())
+	}
+
+	b = newDictionaryBuilder()
+	b.addValue("country", "at")
+	b.addValue("country", "us")
+	extended := b.build(d)
+	assert.Equal(t, d.entries, extended.entries[:len(d.entries)], "extending dictionary should retain existing ids")
+	assert.Len(t, extended.entries, len(d.entries)+1)
+
+	_, err = newDimensionDictionary().decodeKey(d.encodeKey(keys[0]))
+	assert.Error(t, err, "decoding with wrong dictionary should fail")
+}
+
+func TestDimensionDictionary(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir: tmpDir,
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			// Only flush when forced, so that each batch of inserts is flushed at once
+			MinFlushLatency: time.Hour,
+			MaxFlushLatency: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1h)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	insert := func(countries ...string) {
+		for _, country := range countries {
+			for i := 0; i < 300; i++ {
+				assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"country": country, "id": fmt.Sprint(i)}, map[string]float64{"i": 1}))
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+		db.FlushAll()
+	}
+	query := func() map[string]float64 {
+		source, queryErr := db.Query("SELECT i FROM test_a GROUP BY country", false, nil, false)
+		if !assert.NoError(t, queryErr) {
+			return nil
+		}
+		result := make(map[string]float64)
+		_, queryErr = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result[row.Key.Get("country").(string)] += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, queryErr)
+		return result
+	}
+	currentFileStore := func() *fileStore {
+		rs := db.getTable("test_a").rowStore
+		rs.mx.RLock()
+		defer rs.mx.RUnlock()
+		return rs.fileStore
+	}
+
+	insert("us", "de")
+	d, err := currentFileStore().readDictionary()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []dictionaryEntry{{"country", "de"}, {"country", "us"}}, d.entries, "only low-cardinality dimension should be in dictionary")
+	assert.Equal(t, map[string]float64{"de": 300, "us": 300}, query())
+
+	insert("at", "us")
+	d2, err := currentFileStore().readDictionary()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, append(d.entries, dictionaryEntry{"country", "at"}), d2.entries, "dictionary should have been extended")
+	assert.Equal(t, map[string]float64{"at": 300, "de": 300, "us": 600}, query())
+
+	// Sorted flushes rebuild the dictionary while sorting
+	fs := currentFileStore()
+	out, err := os.Create(filepath.Join(tmpDir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), CurrentFileVersion)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer out.Close()
+	_, rows := fs.flush(out, fs.fields, nil, nil, nil, true, false)
+	assert.EqualValues(t, 900, rows)
+	if !assert.NoError(t, out.Close()) {
+		return
+	}
+	sorted := &fileStore{fs.t, fs.rs, fs.fields, out.Name()}
+	rebuilt, err := sorted.readDictionary()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []dictionaryEntry{{"country", "at"}, {"country", "de"}, {"country", "us"}}, rebuilt.entries, "rebuilt dictionary should be sorted")
+	}
+
+	// Filtering on dictionary encoded dimensions skips rows without decoding them
+	rows = 0
+	_, err = sorted.iterateFiltered(segmentFilters{newSegmentFilter(time.Time{}, time.Time{}, map[string]string{"country": "us"})}, nil, nil, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		assert.Equal(t, "us", key.Get("country"))
+		rows++
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 300, rows)
+}
@@ -0,0 +1,268 @@
+package election
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultConsulSessionTTL   = 15 * time.Second
+	DefaultConsulPollInterval = 1 * time.Second
+)
+
+// ConsulOpts configures a Consul coordinator.
+type ConsulOpts struct {
+	// Addr is the address of a consul agent's HTTP API, like
+	// http://localhost:8500.
+	Addr string
+	// Token, if specified, is the ACL token with which to authenticate to
+	// consul.
+	Token string
+	// SessionTTL is how long consul keeps a leader's session alive without
+	// hearing from it, which bounds how long it takes to fail over to another
+	// candidate. Defaults to DefaultConsulSessionTTL.
+	SessionTTL time.Duration
+	// PollInterval is how often candidates check whether they can become the
+	// leader. Defaults to DefaultConsulPollInterval.
+	PollInterval time.Duration
+}
+
+type consulSession struct {
+	id   string
+	lost chan struct{}
+	stop chan struct{}
+}
+
+// Consul is a Coordinator that holds elections with consul's sessions and KV
+// store. Each election is a key whose value names the leader. Candidates
+// acquire the key with a session that they keep alive while they lead.
+type Consul struct {
+	opts     ConsulOpts
+	client   *http.Client
+	sessions map[string]*consulSession
+	mx       sync.Mutex
+}
+
+// NewConsul creates a Coordinator that uses the consul agent configured in
+// opts.
+func NewConsul(opts *ConsulOpts) *Consul {
+	c := &Consul{
+		opts:     *opts,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		sessions: make(map[string]*consulSession),
+	}
+	c.opts.Addr = strings.TrimRight(c.opts.Addr, "/")
+	if c.opts.SessionTTL <= 0 {
+		c.opts.SessionTTL = DefaultConsulSessionTTL
+	}
+	if c.opts.PollInterval <= 0 {
+		c.opts.PollInterval = DefaultConsulPollInterval
+	}
+	return c
+}
+
+func (c *Consul) Campaign(ctx context.Context, election string, candidate string) (<-chan struct{}, error) {
+	sessionID, err := c.createSession(ctx, candidate)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		acquired, err := c.put(ctx, fmt.Sprintf("/v1/kv/%v?acquire=%v", election, url.QueryEscape(sessionID)), []byte(candidate))
+		if err != nil {
+			log.Errorf("Unable to campaign for %v: %v", election, err)
+		} else if acquired {
+			break
+		}
+		if _, err := c.put(ctx, "/v1/session/renew/"+sessionID, nil); err != nil {
+			log.Debugf("Unable to renew session for %v, creating a new one: %v", election, err)
+			c.destroySession(sessionID)
+			sessionID, err = c.createSession(ctx, candidate)
+			if err != nil {
+				return nil, err
+			}
+		}
+		select {
+		case <-time.After(c.opts.PollInterval):
+			// try again
+		case <-ctx.Done():
+			c.destroySession(sessionID)
+			return nil, ctx.Err()
+		}
+	}
+
+	s := &consulSession{id: sessionID, lost: make(chan struct{}), stop: make(chan struct{})}
+	key := election + "|" + candidate
+	c.mx.Lock()
+	c.sessions[key] = s
+	c.mx.Unlock()
+	go c.keepAlive(key, election, s)
+	return s.lost, nil
+}
+
+// keepAlive renews the leader's session until it resigns or loses the
+// election.
+func (c *Consul) keepAlive(key string, election string, s *consulSession) {
+	defer close(s.lost)
+	defer func() {
+		c.mx.Lock()
+		if c.sessions[key] == s {
+			delete(c.sessions, key)
+		}
+		c.mx.Unlock()
+	}()
+
+	ticker := time.NewTicker(c.opts.SessionTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if _, err := c.put(context.Background(), "/v1/session/renew/"+s.id, nil); err != nil {
+				log.Errorf("Unable to renew session, lost leadership of %v: %v", election, err)
+				return
+			}
+			holder, err := c.get(context.Background(), election)
+			if err == nil && holder.Session != s.id {
+				log.Errorf("Leadership of %v was taken over by %v", election, holder.leader())
+				return
+			}
+		}
+	}
+}
+
+func (c *Consul) Resign(ctx context.Context, election string, candidate string) error {
+	key := election + "|" + candidate
+	c.mx.Lock()
+	s := c.sessions[key]
+	delete(c.sessions, key)
+	c.mx.Unlock()
+	if s == nil {
+		return ErrNotElected
+	}
+	close(s.stop)
+	_, err := c.put(ctx, fmt.Sprintf("/v1/kv/%v?release=%v", election, url.QueryEscape(s.id)), []byte(candidate))
+	c.destroySession(s.id)
+	return err
+}
+
+func (c *Consul) Leader(ctx context.Context, election string) (string, error) {
+	holder, err := c.get(ctx, election)
+	if err != nil {
+		return "", err
+	}
+	return holder.leader(), nil
+}
+
+type consulKV struct {
+	Value   string
+	Session string
+}
+
+func (kv *consulKV) leader() string {
+	if kv == nil || kv.Session == "" {
+		return ""
+	}
+	leader, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return ""
+	}
+	return string(leader)
+}
+
+func (c *Consul) createSession(ctx context.Context, candidate string) (string, error) {
+	body, _ := json.Marshal(map[string]string{
+		"Name":      candidate,
+		"TTL":       c.opts.SessionTTL.String(),
+		"Behavior":  "release",
+		"LockDelay": "0s",
+	})
+	resp, err := c.do(ctx, http.MethodPut, "/v1/session/create", body)
+	if err != nil {
+		return "", fmt.Errorf("Unable to create consul session: %v", err)
+	}
+	session := &struct{ ID string }{}
+	if err := json.Unmarshal(resp, session); err != nil || session.ID == "" {
+		return "", fmt.Errorf("Unexpected response creating consul session: %v", string(resp))
+	}
+	return session.ID, nil
+}
+
+func (c *Consul) destroySession(sessionID string) {
+	if _, err := c.do(context.Background(), http.MethodPut, "/v1/session/destroy/"+sessionID, nil); err != nil {
+		log.Debugf("Unable to destroy consul session %v: %v", sessionID, err)
+	}
+}
+
+// put issues a PUT to consul and returns whether consul responded with true.
+func (c *Consul) put(ctx context.Context, path string, body []byte) (bool, error) {
+	resp, err := c.do(ctx, http.MethodPut, path, body)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(resp)) == "true", nil
+}
+
+// get gets the given key from consul's KV store, returning nil if it doesn't
+// exist.
+func (c *Consul) get(ctx context.Context, key string) (*consulKV, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/v1/kv/"+key, nil)
+	if err == errConsulNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var kvs []*consulKV
+	if err := json.Unmarshal(resp, &kvs); err != nil {
+		return nil, fmt.Errorf("Unexpected response getting %v from consul: %v", key, err)
+	}
+	if len(kvs) == 0 {
+		return nil, nil
+	}
+	return kvs[0], nil
+}
+
+var errConsulNotFound = fmt.Errorf("Not found in consul")
+
+func (c *Consul) do(ctx context.Context, method string, path string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.opts.Addr+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.opts.Token != "" {
+		req.Header.Set("X-Consul-Token", c.opts.Token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet {
+		return nil, errConsulNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status from consul for %v %v: %v %v", method, path, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
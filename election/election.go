@@ -0,0 +1,46 @@
+// Package election lets passthrough nodes elect a single active leader per
+// stream through an external coordinator like etcd or consul.
+//
+// Coordinators are pluggable through the Coordinator interface. This package
+// provides an in-process Memory coordinator, which is handy for tests and for
+// nodes sharing a single process, and a Consul coordinator that talks to
+// consul's HTTP API. etcd can be plugged in by wrapping the election from its
+// clientv3/concurrency package.
+package election
+
+import (
+	"context"
+	"errors"
+
+	"github.com/getlantern/golog"
+)
+
+var (
+	log = golog.LoggerFor("zenodb.election")
+
+	// ErrNotElected indicates that a candidate tried to resign from an election
+	// that it isn't leading.
+	ErrNotElected = errors.New("Not the leader of this election")
+)
+
+// Coordinator elects leaders through an external coordination service.
+type Coordinator interface {
+	// Campaign blocks until candidate becomes the leader of the named election
+	// or ctx is done. Once elected, the returned channel is closed when the
+	// candidate loses leadership, for example because it resigned or its
+	// session with the coordinator expired.
+	Campaign(ctx context.Context, election string, candidate string) (lost <-chan struct{}, err error)
+
+	// Resign gives up candidate's leadership of the named election.
+	Resign(ctx context.Context, election string, candidate string) error
+
+	// Leader returns the current leader of the named election, or "" if there
+	// is none.
+	Leader(ctx context.Context, election string) (string, error)
+}
+
+// ForStream returns the name of the election for the leader of the given
+// stream.
+func ForStream(stream string) string {
+	return "zenodb/streams/" + stream
+}
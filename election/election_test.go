@@ -0,0 +1,192 @@
+package election
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	testCoordinator(t, NewMemory())
+}
+
+func TestConsul(t *testing.T) {
+	fc := newFakeConsul()
+	server := httptest.NewServer(fc)
+	defer server.Close()
+	c := NewConsul(&ConsulOpts{
+		Addr:         server.URL,
+		SessionTTL:   300 * time.Millisecond,
+		PollInterval: 10 * time.Millisecond,
+	})
+	testCoordinator(t, c)
+
+	// Leadership is lost when the session expires
+	lost, err := c.Campaign(context.Background(), "expiring", "a")
+	if !assert.NoError(t, err) {
+		return
+	}
+	fc.mx.Lock()
+	fc.sessions = make(map[string]bool)
+	fc.mx.Unlock()
+	select {
+	case <-lost:
+		// okay
+	case <-time.After(time.Second):
+		assert.Fail(t, "leadership should have been lost when session expired")
+	}
+}
+
+func testCoordinator(t *testing.T, c Coordinator) {
+	ctx := context.Background()
+	e := ForStream("inbound")
+
+	leader, err := c.Leader(ctx, e)
+	assert.NoError(t, err)
+	assert.Empty(t, leader)
+
+	lostA, err := c.Campaign(ctx, e, "a")
+	if !assert.NoError(t, err) {
+		return
+	}
+	leader, err = c.Leader(ctx, e)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", leader)
+
+	// b waits until a resigns
+	electedB := make(chan (<-chan struct{}), 1)
+	go func() {
+		lost, err := c.Campaign(ctx, e, "b")
+		if assert.NoError(t, err) {
+			electedB <- lost
+		}
+	}()
+	select {
+	case <-electedB:
+		assert.Fail(t, "b shouldn't have been elected while a leads")
+	case <-time.After(100 * time.Millisecond):
+		// okay
+	}
+
+	assert.Equal(t, ErrNotElected, c.Resign(ctx, e, "b"))
+	assert.NoError(t, c.Resign(ctx, e, "a"))
+	select {
+	case <-lostA:
+		// okay
+	case <-time.After(time.Second):
+		assert.Fail(t, "a should have lost leadership after resigning")
+	}
+
+	var lostB <-chan struct{}
+	select {
+	case lostB = <-electedB:
+		// okay
+	case <-time.After(time.Second):
+		assert.Fail(t, "b should have been elected once a resigned")
+		return
+	}
+	leader, err = c.Leader(ctx, e)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", leader)
+
+	// Campaigning stops once the context is done
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = c.Campaign(timeoutCtx, e, "c")
+	assert.Error(t, err)
+
+	assert.NoError(t, c.Resign(ctx, e, "b"))
+	<-lostB
+	leader, err = c.Leader(ctx, e)
+	assert.NoError(t, err)
+	assert.Empty(t, leader)
+}
+
+// fakeConsul implements just enough of consul's session and KV APIs for
+// elections.
+type fakeConsul struct {
+	sessions    map[string]bool
+	kvs         map[string]*consulKV
+	nextSession int
+	mx          sync.Mutex
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{sessions: make(map[string]bool), kvs: make(map[string]*consulKV)}
+}
+
+func (fc *fakeConsul) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	fc.mx.Lock()
+	defer fc.mx.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	path := req.URL.Path
+	switch {
+	case path == "/v1/session/create":
+		fc.nextSession++
+		id := fmt.Sprintf("session%d", fc.nextSession)
+		fc.sessions[id] = true
+		json.NewEncoder(resp).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(path, "/v1/session/renew/"):
+		if !fc.sessions[strings.TrimPrefix(path, "/v1/session/renew/")] {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp.Write([]byte("[]"))
+	case strings.HasPrefix(path, "/v1/session/destroy/"):
+		id := strings.TrimPrefix(path, "/v1/session/destroy/")
+		delete(fc.sessions, id)
+		for _, kv := range fc.kvs {
+			if kv.Session == id {
+				kv.Session = ""
+			}
+		}
+		resp.Write([]byte("true"))
+	case strings.HasPrefix(path, "/v1/kv/"):
+		key := strings.TrimPrefix(path, "/v1/kv/")
+		kv := fc.kvs[key]
+		if req.Method == http.MethodGet {
+			if kv == nil {
+				resp.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(resp).Encode([]*consulKV{kv})
+			return
+		}
+		if kv == nil {
+			kv = &consulKV{}
+			fc.kvs[key] = kv
+		}
+		if session := req.URL.Query().Get("acquire"); session != "" {
+			if !fc.sessions[session] || (kv.Session != "" && kv.Session != session) {
+				resp.Write([]byte("false"))
+				return
+			}
+			kv.Session = session
+			kv.Value = base64.StdEncoding.EncodeToString(body)
+			resp.Write([]byte("true"))
+			return
+		}
+		if session := req.URL.Query().Get("release"); session != "" {
+			if kv.Session != session {
+				resp.Write([]byte("false"))
+				return
+			}
+			kv.Session = ""
+			resp.Write([]byte("true"))
+			return
+		}
+		resp.WriteHeader(http.StatusBadRequest)
+	default:
+		resp.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,74 @@
+package election
+
+import (
+	"context"
+	"sync"
+)
+
+type memoryLeader struct {
+	candidate string
+	lost      chan struct{}
+}
+
+// Memory is a Coordinator that holds elections in memory, so it only
+// coordinates candidates within a single process.
+type Memory struct {
+	leaders map[string]*memoryLeader
+	changed chan struct{}
+	mx      sync.Mutex
+}
+
+// NewMemory creates a new in-memory Coordinator.
+func NewMemory() *Memory {
+	return &Memory{
+		leaders: make(map[string]*memoryLeader),
+		changed: make(chan struct{}),
+	}
+}
+
+func (m *Memory) Campaign(ctx context.Context, election string, candidate string) (<-chan struct{}, error) {
+	for {
+		m.mx.Lock()
+		leader := m.leaders[election]
+		if leader == nil {
+			leader = &memoryLeader{candidate: candidate, lost: make(chan struct{})}
+			m.leaders[election] = leader
+			m.mx.Unlock()
+			return leader.lost, nil
+		}
+		changed := m.changed
+		m.mx.Unlock()
+
+		select {
+		case <-changed:
+			// try again
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (m *Memory) Resign(ctx context.Context, election string, candidate string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	leader := m.leaders[election]
+	if leader == nil || leader.candidate != candidate {
+		return ErrNotElected
+	}
+	delete(m.leaders, election)
+	close(leader.lost)
+	// Wake up campaigning candidates
+	close(m.changed)
+	m.changed = make(chan struct{})
+	return nil
+}
+
+func (m *Memory) Leader(ctx context.Context, election string) (string, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	leader := m.leaders[election]
+	if leader == nil {
+		return "", nil
+	}
+	return leader.candidate, nil
+}
@@ -0,0 +1,73 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEMA(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	err = db.ApplySchema(Schema{
+		"loads": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT EMA(load, 0.5) AS smoothed_load FROM inbound GROUP BY period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now().Truncate(time.Minute)
+	insert := func(ts time.Time, load float64) {
+		assert.NoError(t, db.Insert("inbound", ts, nil, map[string]float64{"load": load}))
+	}
+	insert(now.Add(-3*time.Minute), 10)
+	insert(now.Add(-3*time.Minute), 20)
+	insert(now.Add(-2*time.Minute), 30)
+	time.Sleep(250 * time.Millisecond)
+	// flush so that later points have to be merged with the filestore
+	db.FlushAll()
+	insert(now.Add(-2*time.Minute), 10)
+	insert(now, 50)
+	time.Sleep(250 * time.Millisecond)
+
+	source, err := db.Query("SELECT smoothed_load FROM loads GROUP BY _", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	values := make(map[time.Time]float64)
+	_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+		values[encoding.TimeFromInt(row.TS)] = row.Values[0]
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		// the average carries over the minute without any loads
+		assert.Equal(t, map[time.Time]float64{
+			now.Add(-3 * time.Minute): 15,
+			now.Add(-2 * time.Minute): 17.5,
+			now.Add(-1 * time.Minute): 17.5,
+			now:                       33.75,
+		}, values)
+	}
+}
@@ -0,0 +1,158 @@
+package zenodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// Row is a row of results returned by QueryContext.
+type Row struct {
+	// TS is the timestamp of the period covered by the row
+	TS time.Time
+	// Dims are the dimensions by which the row is grouped
+	Dims map[string]interface{}
+	// Vals are the values of the query's fields, keyed by field name
+	Vals map[string]float64
+}
+
+// Rows iterates over the results of a query run with QueryContext. Like
+// database/sql's Rows, call Next before reading each row and check Err once Next
+// returns false:
+//
+//	rows, err := db.QueryContext(ctx, "SELECT requests FROM combined WHERE server = ?", server)
+//	if err != nil {
+//	  return err
+//	}
+//	defer rows.Close()
+//	for rows.Next() {
+//	  row := rows.Row()
+//	  fmt.Println(row.TS, row.Dims["path"], row.Vals["requests"])
+//	}
+//	return rows.Err()
+type Rows struct {
+	rows     chan *Row
+	current  *Row
+	fields   []string
+	stats    *common.QueryStats
+	err      error
+	cancel   context.CancelFunc
+	finished bool
+	closed   bool
+}
+
+// QueryContext runs the given query and returns its results, for programs that
+// embed zenodb. Any ? placeholders in sqlString are bound to the given params
+// in order (see sql.Bind for supported types), so values don't need to be
+// escaped by hand. Results include data that hasn't been flushed to disk yet.
+// Cancelling ctx stops the query.
+func (db *DB) QueryContext(ctx context.Context, sqlString string, params ...interface{}) (*Rows, error) {
+	bound, err := sql.Bind(sqlString, params...)
+	if err != nil {
+		return nil, err
+	}
+	source, err := db.Query(bound, false, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if common.CallerFor(ctx) == "" {
+		ctx = common.WithCaller(ctx, "embedded")
+	}
+	if common.RequestIDFor(ctx) == "" {
+		ctx = common.WithRequestID(ctx, common.NewRequestID())
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r := &Rows{
+		rows:   make(chan *Row),
+		cancel: cancel,
+	}
+	go r.iterate(ctx, source)
+	return r, nil
+}
+
+func (r *Rows) iterate(ctx context.Context, source core.FlatRowSource) {
+	defer close(r.rows)
+	var fields []string
+	metadata, err := source.Iterate(ctx, func(f core.Fields) error {
+		fields = f.Names()
+		r.fields = fields
+		return nil
+	}, func(flatRow *core.FlatRow) (bool, error) {
+		row := &Row{
+			TS:   encoding.TimeFromInt(flatRow.TS),
+			Dims: flatRow.Key.AsMap(),
+			Vals: make(map[string]float64, len(fields)),
+		}
+		for i, val := range flatRow.Values {
+			if i < len(fields) {
+				row.Vals[fields[i]] = val
+			}
+		}
+		select {
+		case r.rows <- row:
+			return true, nil
+		case <-ctx.Done():
+			return false, nil
+		}
+	})
+	r.stats, _ = metadata.(*common.QueryStats)
+	r.err = common.ErrorWithRequestID(ctx, err)
+}
+
+// Next advances to the next row, returning false once there are no more rows
+// or the query failed.
+func (r *Rows) Next() bool {
+	row, ok := <-r.rows
+	if !ok {
+		r.current = nil
+		r.finished = true
+		return false
+	}
+	r.current = row
+	return true
+}
+
+// Row returns the current row.
+func (r *Rows) Row() *Row {
+	return r.current
+}
+
+// Fields returns the names of the query's fields. It's only available once
+// Next has returned true or the query has finished.
+func (r *Rows) Fields() []string {
+	return r.fields
+}
+
+// Stats returns statistics about the query, once Next has returned false.
+func (r *Rows) Stats() *common.QueryStats {
+	return r.stats
+}
+
+// Err returns the error, if any, that stopped the query. It's only meaningful
+// once Next has returned false.
+func (r *Rows) Err() error {
+	if r.closed && !r.finished {
+		// stopped by Close
+		return nil
+	}
+	return r.err
+}
+
+// Close stops the query if it's still running. It's safe to call Close more
+// than once.
+func (r *Rows) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.cancel()
+	for range r.rows {
+		// drain until the query stops
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryContext(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"dim": i, "name": "it's"}, map[string]float64{"i": float64(i)}))
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	ctx := context.Background()
+	rows, err := db.QueryContext(ctx, "SELECT i FROM test_a WHERE name = ? AND dim IN (?) GROUP BY dim ORDER BY dim", "it's", []int{3, 4, 5})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var dims []interface{}
+	var total float64
+	for rows.Next() {
+		row := rows.Row()
+		assert.WithinDuration(t, now, row.TS, time.Minute)
+		dims = append(dims, row.Dims["dim"])
+		total += row.Vals["i"]
+	}
+	assert.NoError(t, rows.Err())
+	assert.NoError(t, rows.Close())
+	assert.Equal(t, []interface{}{3, 4, 5}, dims)
+	assert.EqualValues(t, 12, total)
+	assert.Equal(t, []string{"i"}, rows.Fields())
+	if assert.NotNil(t, rows.Stats()) {
+		assert.EqualValues(t, 10, rows.Stats().RowsScanned)
+	}
+
+	rows, err = db.QueryContext(ctx, "SELECT i FROM test_a GROUP BY dim")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, rows.Next())
+	assert.NoError(t, rows.Close(), "closing before the end should stop the query")
+	assert.False(t, rows.Next())
+	assert.NoError(t, rows.Err())
+
+	_, err = db.QueryContext(ctx, "SELECT i FROM test_a WHERE dim = ?")
+	assert.Error(t, err, "missing parameter")
+	_, err = db.QueryContext(ctx, "SELECT i FROM unknown")
+	assert.Error(t, err, "unknown table")
+}
@@ -0,0 +1,321 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+var (
+	errGorillaTruncated = errors.New("gorilla encoded sequence is truncated")
+)
+
+// EncodeGorilla compresses the Sequence using the XOR encoding from Facebook's
+// Gorilla paper, which works well for smooth, gauge-like values whose
+// accumulator states change little from one period to the next.
+//
+// Periods within a Sequence are evenly spaced, so the delta-of-delta of their
+// timestamps is always zero and only the until timestamp needs to be stored.
+// If timestamps is non-nil, the until timestamp is itself stored as its
+// delta-of-delta relative to the previous sequences encoded with the same
+// DeltaOfDelta, which usually takes a single byte because neighbouring
+// sequences tend to share the same until. Each period's accumulator state is
+// XORed with the state of the period before it and only the bits between the
+// leading and trailing zeros of the result are stored, reusing the previous
+// window of meaningful bits when the new one fits inside of it. Because this
+// works on whole accumulator states rather than individual floats, it applies
+// to any Expr regardless of its layout.
+//
+// The encoding is:
+//
+//	until|width|numPeriods|bits
+//
+// until is 64 bits (or a varint delta-of-delta if timestamps is non-nil),
+// width and numPeriods are uvarints and bits is the bit stream of XORed
+// periods, padded to a whole byte.
+//
+// ok is false if the Sequence can't be encoded with the given width or if the
+// encoded form wouldn't be smaller than the original, in which case timestamps
+// is left unchanged.
+func (seq Sequence) EncodeGorilla(width int, timestamps *DeltaOfDelta) (encoded []byte, ok bool) {
+	if width <= 0 || len(seq) <= Width64bits || seq.DataLength()%width != 0 {
+		return nil, false
+	}
+	numPeriods := seq.NumPeriods(width)
+	stateBits := width * 8
+	countBits := bits.Len(uint(stateBits))
+
+	w := &bitWriter{b: make([]byte, 3*binary.MaxVarintLen64)}
+	var n int
+	var nextTimestamps DeltaOfDelta
+	if timestamps != nil {
+		nextTimestamps = *timestamps
+		n = binary.PutVarint(w.b, nextTimestamps.encode(seq.UntilInt()))
+	} else {
+		n = copy(w.b, seq[:Width64bits])
+	}
+	n += binary.PutUvarint(w.b[n:], uint64(width))
+	n += binary.PutUvarint(w.b[n:], uint64(numPeriods))
+	w.b = w.b[:n]
+
+	prev := make([]byte, width)
+	xor := make([]byte, width)
+	prevLeading, prevMeaningful := -1, 0
+	data := seq[Width64bits:]
+	for p := 0; p < numPeriods; p++ {
+		state := data[p*width : (p+1)*width]
+		for i := range state {
+			xor[i] = state[i] ^ prev[i]
+		}
+		copy(prev, state)
+
+		leading, trailing := zeroBits(xor)
+		if leading == stateBits {
+			// Same as previous period
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+		if prevLeading >= 0 && leading >= prevLeading && stateBits-trailing <= prevLeading+prevMeaningful {
+			// Fits within previous window
+			w.writeBit(false)
+		} else {
+			w.writeBit(true)
+			prevLeading = leading
+			prevMeaningful = stateBits - leading - trailing
+			w.writeBits(uint64(prevLeading), countBits)
+			w.writeBits(uint64(prevMeaningful-1), countBits)
+		}
+		w.copyBits(xor, prevLeading, prevLeading+prevMeaningful)
+		if len(w.b) >= len(seq) {
+			// Not worth it
+			return nil, false
+		}
+	}
+
+	if timestamps != nil {
+		*timestamps = nextTimestamps
+	}
+	return w.b, true
+}
+
+// DecodeGorilla decodes a Sequence that was encoded with EncodeGorilla.
+// timestamps must be nil if it was nil when encoding, otherwise it must have
+// decoded the same sequences that the encoding DeltaOfDelta had encoded.
+func DecodeGorilla(b []byte, timestamps *DeltaOfDelta) (Sequence, error) {
+	var until int64
+	if timestamps != nil {
+		dod, n := binary.Varint(b)
+		if n <= 0 {
+			return nil, errGorillaTruncated
+		}
+		b = b[n:]
+		until = timestamps.peek(dod)
+	} else {
+		if len(b) < Width64bits {
+			return nil, errGorillaTruncated
+		}
+		until = int64(Binary.Uint64(b))
+		b = b[Width64bits:]
+	}
+	r := &bitReader{b: b}
+	width, n := binary.Uvarint(r.b)
+	if n <= 0 || width == 0 {
+		return nil, errGorillaTruncated
+	}
+	r.b = r.b[n:]
+	numPeriods, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return nil, errGorillaTruncated
+	}
+	r.b = r.b[n:]
+	stateBits := int(width) * 8
+	countBits := bits.Len(uint(stateBits))
+	if numPeriods > uint64(len(r.b))*8 {
+		// Each period takes at least one bit
+		return nil, errGorillaTruncated
+	}
+
+	seq := NewSequence(int(width), int(numPeriods))
+	Binary.PutUint64(seq, uint64(until))
+	data := seq[Width64bits:]
+	prev := make([]byte, width)
+	leading, meaningful := -1, 0
+	for p := 0; p < int(numPeriods); p++ {
+		state := data[p*int(width) : (p+1)*int(width)]
+		changed, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			newWindow, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if newWindow {
+				l, err := r.readBits(countBits)
+				if err != nil {
+					return nil, err
+				}
+				m, err := r.readBits(countBits)
+				if err != nil {
+					return nil, err
+				}
+				leading, meaningful = int(l), int(m)+1
+			}
+			if leading < 0 || leading+meaningful > stateBits {
+				return nil, errors.New("gorilla encoded sequence is corrupt")
+			}
+			err = r.xorBits(state, leading, leading+meaningful)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for i := range state {
+			state[i] ^= prev[i]
+		}
+		copy(prev, state)
+	}
+
+	if timestamps != nil {
+		timestamps.advance(until)
+	}
+	return seq, nil
+}
+
+// DeltaOfDelta holds the state for encoding a series of timestamps as the
+// difference between consecutive deltas, as described in the Gorilla paper.
+// The first timestamp is stored as is and the ones after it are stored as if
+// the delta before them had been zero. The zero value is ready to use and a
+// fresh one should be used wherever the decoder will start decoding.
+type DeltaOfDelta struct {
+	prev      int64
+	prevDelta int64
+	started   bool
+}
+
+// encode returns the delta-of-delta for ts and advances to it
+func (d *DeltaOfDelta) encode(ts int64) int64 {
+	dod := d.peekDelta(ts)
+	d.advance(ts)
+	return dod
+}
+
+func (d *DeltaOfDelta) peekDelta(ts int64) int64 {
+	if !d.started {
+		return ts
+	}
+	return ts - d.prev - d.prevDelta
+}
+
+// peek returns the timestamp for the given delta-of-delta without advancing
+func (d *DeltaOfDelta) peek(dod int64) int64 {
+	if !d.started {
+		return dod
+	}
+	return d.prev + d.prevDelta + dod
+}
+
+// advance advances to the given timestamp
+func (d *DeltaOfDelta) advance(ts int64) {
+	if d.started {
+		d.prevDelta = ts - d.prev
+	}
+	d.prev = ts
+	d.started = true
+}
+
+// zeroBits returns the number of leading and trailing zero bits in b
+func zeroBits(b []byte) (leading int, trailing int) {
+	i := 0
+	for ; i < len(b) && b[i] == 0; i++ {
+		leading += 8
+	}
+	if i == len(b) {
+		return leading, leading
+	}
+	leading += bits.LeadingZeros8(b[i])
+	j := len(b) - 1
+	for ; b[j] == 0; j-- {
+		trailing += 8
+	}
+	trailing += bits.TrailingZeros8(b[j])
+	return
+}
+
+type bitWriter struct {
+	b    []byte
+	used uint // bits used in the last byte, 0 means it's full
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.used == 0 {
+		w.b = append(w.b, 0)
+	}
+	if bit {
+		w.b[len(w.b)-1] |= 0x80 >> w.used
+	}
+	w.used = (w.used + 1) % 8
+}
+
+// writeBits writes the lowest n bits of v, most significant first
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(v&(1<<uint(i)) != 0)
+	}
+}
+
+// copyBits writes the bits of src from bit from up to bit to
+func (w *bitWriter) copyBits(src []byte, from int, to int) {
+	for i := from; i < to; i++ {
+		w.writeBit(src[i/8]&(0x80>>uint(i%8)) != 0)
+	}
+}
+
+type bitReader struct {
+	b    []byte
+	used uint // bits consumed from the first byte
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if len(r.b) == 0 {
+		return false, errGorillaTruncated
+	}
+	bit := r.b[0]&(0x80>>r.used) != 0
+	r.used++
+	if r.used == 8 {
+		r.b = r.b[1:]
+		r.used = 0
+	}
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	var v uint64
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+	return v, nil
+}
+
+// xorBits reads bits into dst from bit from up to bit to, XORing them with
+// what's already there
+func (r *bitReader) xorBits(dst []byte, from int, to int) error {
+	for i := from; i < to; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return err
+		}
+		if bit {
+			dst[i/8] ^= 0x80 >> uint(i%8)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package encoding
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	. "github.com/getlantern/zenodb/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGorilla(t *testing.T) {
+	for _, e := range []Expr{SUM("a"), AVG("a"), MAX("a")} {
+		width := e.EncodedWidth()
+		length := 1000
+		seq := NewSequence(width, length)
+		seq.SetUntil(epoch)
+		for i := 0; i < length; i++ {
+			if i%100 == 7 {
+				// Leave some gaps
+				continue
+			}
+			// A smooth gauge
+			val := 1000 + math.Floor(100*math.Sin(float64(i)/50))
+			seq.UpdateValueAt(i, e, FloatParams(val), nil)
+		}
+
+		encoded, ok := seq.EncodeGorilla(width, nil)
+		if !assert.True(t, ok, "%v should have been encoded", e) {
+			continue
+		}
+		assert.True(t, len(encoded) < len(seq)/3*2, "%v should have been compressed, was %d of %d bytes", e, len(encoded), len(seq))
+		decoded, err := DecodeGorilla(encoded, nil)
+		if assert.NoError(t, err) {
+			assert.Equal(t, seq, decoded, "%v should have round-tripped", e)
+		}
+
+		_, err = DecodeGorilla(encoded[:len(encoded)/2], nil)
+		assert.Error(t, err, "Decoding truncated sequence should fail")
+	}
+
+	// Encode a series of sequences with delta-of-delta timestamps
+	e := SUM("a")
+	var untils []time.Time
+	for i := 0; i < 5; i++ {
+		untils = append(untils, epoch.Add(time.Duration(i*i)*time.Minute))
+	}
+	untils = append(untils, epoch, epoch, epoch)
+	var encoder DeltaOfDelta
+	var encoded [][]byte
+	var seqs []Sequence
+	for _, until := range untils {
+		seq := NewSequence(e.EncodedWidth(), 10)
+		seq.SetUntil(until)
+		for i := 0; i < 10; i++ {
+			seq.UpdateValueAt(i, e, FloatParams(5), nil)
+		}
+		b, ok := seq.EncodeGorilla(e.EncodedWidth(), &encoder)
+		if !assert.True(t, ok) {
+			return
+		}
+		seqs = append(seqs, seq)
+		encoded = append(encoded, b)
+	}
+	var decoder DeltaOfDelta
+	for i, b := range encoded {
+		decoded, err := DecodeGorilla(b, &decoder)
+		if assert.NoError(t, err) {
+			assert.Equal(t, seqs[i], decoded, "Sequence %d should have round-tripped", i)
+		}
+	}
+	last := len(seqs) - 1
+	withoutTimestamps, _ := seqs[last].EncodeGorilla(e.EncodedWidth(), nil)
+	assert.Len(t, encoded[last], len(withoutTimestamps)-Width64bits+1, "Repeated until should take a single byte")
+
+	// Random data isn't worth compressing
+	seq := NewSequence(e.EncodedWidth(), 10)
+	rand.Read(seq)
+	before := encoder
+	_, ok := seq.EncodeGorilla(e.EncodedWidth(), &encoder)
+	assert.False(t, ok)
+	assert.Equal(t, before, encoder, "Failing to encode should not advance timestamps")
+	_, ok = seq.EncodeGorilla(e.EncodedWidth()+1, nil)
+	assert.False(t, ok, "Width that doesn't match sequence should not be encoded")
+	_, ok = Sequence(nil).EncodeGorilla(e.EncodedWidth(), nil)
+	assert.False(t, ok)
+}
@@ -0,0 +1,70 @@
+package encoding
+
+import (
+	"time"
+
+	"github.com/getlantern/zenodb/expr"
+)
+
+// ToWallClock returns the wall clock time of ts in loc, expressed as if it were
+// UTC. Grouping wall clock times by a fixed resolution aligns periods with
+// loc's calendar, so that for example days start at local midnight.
+func ToWallClock(ts time.Time, loc *time.Location) time.Time {
+	_, offset := ts.In(loc).Zone()
+	return ts.Add(time.Duration(offset) * time.Second)
+}
+
+// PeriodToWallClock is like ToWallClock for the period ending at until, whose
+// wall clock end depends on the offset in effect during the period rather than
+// at its end.
+func PeriodToWallClock(until time.Time, loc *time.Location) time.Time {
+	return ToWallClock(until.Add(-1), loc).Add(1)
+}
+
+// FromWallClock converts a wall clock time produced by ToWallClock back to the
+// instant that it represents in loc. Wall clock times that are skipped or
+// repeated by daylight saving time transitions are resolved the same way as
+// time.Date does.
+func FromWallClock(ts time.Time, loc *time.Location) time.Time {
+	u := ts.UTC()
+	return time.Date(u.Year(), u.Month(), u.Day(), u.Hour(), u.Minute(), u.Second(), u.Nanosecond(), loc)
+}
+
+// Localize returns a copy of this Sequence, whose periods have the given
+// resolution, with each period moved to its wall clock time in loc (see
+// PeriodToWallClock). Periods whose wall clock time is repeated when daylight
+// saving time ends are merged using the given Expr, and the wall clock times
+// that are skipped when it starts are left empty, so that grouping the result
+// by days yields 23 and 25 hour days at the transitions. Wall clock times are
+// rounded up to the resolution, so zones with offsets that aren't a multiple
+// of it are only approximately aligned.
+func (seq Sequence) Localize(e expr.Expr, resolution time.Duration, loc *time.Location) Sequence {
+	width := e.EncodedWidth()
+	numPeriods := seq.NumPeriods(width)
+	if numPeriods == 0 {
+		return seq
+	}
+
+	until := seq.Until()
+	wallClock := make([]time.Time, numPeriods)
+	var latest, earliest time.Time
+	for i := 0; i < numPeriods; i++ {
+		ts := until.Add(-1 * time.Duration(i) * resolution)
+		wallClock[i] = RoundTimeUp(PeriodToWallClock(ts, loc), resolution)
+		if i == 0 || wallClock[i].After(latest) {
+			latest = wallClock[i]
+		}
+		if i == 0 || wallClock[i].Before(earliest) {
+			earliest = wallClock[i]
+		}
+	}
+
+	result := NewSequence(width, int(latest.Sub(earliest)/resolution)+1)
+	result.SetUntil(latest)
+	for i, ts := range wallClock {
+		in := seq[Width64bits+i*width:]
+		out := result[Width64bits+int(latest.Sub(ts)/resolution)*width:]
+		e.Merge(out, out, in)
+	}
+	return result
+}
@@ -141,6 +141,100 @@ func (seq Sequence) ValueAtOffset(offset int, e expr.Expr) (val float64, found b
 	return val, wasSet
 }
 
+// IntValueAtTime is like ValueAtTime but gets the value as an int64 using
+// expr.GetInt, which is exact for integer expressions like ISUM.
+func (seq Sequence) IntValueAtTime(t time.Time, e expr.Expr, resolution time.Duration) (val int64, found bool) {
+	if e.IsConstant() {
+		val, found, _ = expr.GetInt(e, nil)
+		return
+	}
+	if len(seq) == 0 {
+		return 0, false
+	}
+	until := seq.Until()
+	t = RoundTimeUntilUp(t, resolution, until)
+	if t.After(until) {
+		return 0, false
+	}
+	period := int(until.Sub(t) / resolution)
+	return seq.IntValueAt(period, e)
+}
+
+// IntValueAt is like ValueAt but gets the value as an int64 using
+// expr.GetInt, which is exact for integer expressions like ISUM.
+func (seq Sequence) IntValueAt(period int, e expr.Expr) (val int64, found bool) {
+	if e.IsConstant() {
+		val, found, _ = expr.GetInt(e, nil)
+		return
+	}
+	if len(seq) == 0 || period < 0 {
+		return 0, false
+	}
+	offset := period*e.EncodedWidth() + Width64bits
+	if offset >= len(seq) {
+		return 0, false
+	}
+	val, found, _ = expr.GetInt(e, seq[offset:])
+	return val, found
+}
+
+// ValuesAt gets the value at the given period from each of the given Sequences
+// in a single batch using the given Expr, storing it in values and storing
+// whether or not it was set in found. values and found need to be at least as
+// long as seqs.
+func ValuesAt(seqs []Sequence, period int, e expr.Expr, values []float64, found []bool) {
+	if e.IsConstant() {
+		val, wasSet, _ := e.Get(nil)
+		for i := range seqs {
+			values[i], found[i] = val, wasSet
+		}
+		return
+	}
+	offset := Width64bits + period*e.EncodedWidth()
+	bs := make([][]byte, 0, len(seqs))
+	idxs := make([]int, 0, len(seqs))
+	for i, seq := range seqs {
+		values[i], found[i] = 0, false
+		if period >= 0 && offset < len(seq) {
+			bs = append(bs, seq[offset:])
+			idxs = append(idxs, i)
+		}
+	}
+	if len(idxs) == len(seqs) {
+		expr.GetBatch(e, bs, values, found)
+		return
+	}
+	batchValues := make([]float64, len(bs))
+	batchFound := make([]bool, len(bs))
+	expr.GetBatch(e, bs, batchValues, batchFound)
+	for b, i := range idxs {
+		values[i], found[i] = batchValues[b], batchFound[b]
+	}
+}
+
+// Values gets the values of all periods in this Sequence in a single batch
+// using the given Expr, most recent first, appending them to values and
+// appending whether or not they were set to found.
+func (seq Sequence) Values(e expr.Expr, values []float64, found []bool) ([]float64, []bool) {
+	width := e.EncodedWidth()
+	if width == 0 {
+		return values, found
+	}
+	numPeriods := seq.NumPeriods(width)
+	if numPeriods == 0 {
+		return values, found
+	}
+	bs := make([][]byte, numPeriods)
+	for p := range bs {
+		bs[p] = seq[Width64bits+p*width:]
+	}
+	start := len(values)
+	values = append(values, make([]float64, numPeriods)...)
+	found = append(found, make([]bool, numPeriods)...)
+	expr.GetBatch(e, bs, values[start:], found[start:])
+	return values, found
+}
+
 // UpdateValueAt updates the value at the given period by applying the supplied
 // Params to the given expression. metadata represents metadata about the
 // operation that's used by the Expr as well (e.g. information about the
@@ -224,6 +318,7 @@ func (seq Sequence) UpdateValue(ts time.Time, params expr.Params, metadata goexp
 		copy(out[Width64bits+gapPeriods*width:], seq[Width64bits:origEnd])
 		out.SetUntil(ts)
 		out.UpdateValueAt(0, e, params, metadata)
+		out.carry(e, gapPeriods-1)
 		return out
 	}
 
@@ -237,6 +332,7 @@ func (seq Sequence) UpdateValue(ts time.Time, params expr.Params, metadata goexp
 		copy(out, seq)
 	}
 	out.UpdateValueAtOffset(offset, e, params, metadata)
+	out.carry(e, period-1)
 	return out
 }
 
@@ -316,6 +412,7 @@ func (seq Sequence) SubMerge(other Sequence, metadata goexpr.Params, resolution
 			submerge(result[Width64bits+p*width:], other[Width64bits+po*otherWidth:], otherResolution, metadata)
 		}
 	}
+	result.carry(ex, resultPeriods-2)
 	return
 }
 
@@ -393,9 +490,7 @@ func (seq Sequence) Merge(other Sequence, e expr.Expr, resolution time.Duration,
 			overlapPeriods = int(startA.Sub(endA) / resolution)
 		}
 		overlapPeriods -= leadNoOverlapPeriods
-		for i := 0; i < overlapPeriods; i++ {
-			sout, sa, sb = e.Merge(sout, sa, sb)
-		}
+		sout, sa, sb = expr.MergeBatch(e, sout, sa, sb, overlapPeriods)
 	} else if startB.Before(endA) {
 		// Handle gap
 		gapPeriods := int(endA.Sub(startB) / resolution)
@@ -410,9 +505,26 @@ func (seq Sequence) Merge(other Sequence, e expr.Expr, resolution time.Duration,
 		copy(sout, sb)
 	}
 
+	out.carry(e, totalPeriods-2)
 	return out
 }
 
+// carry carries the state of Exprs like EMA over into each period from the
+// given one through the most recent one, from the period preceding it.
+func (seq Sequence) carry(e expr.Expr, from int) {
+	if from < 0 || !expr.Carries(e) {
+		return
+	}
+	width := e.EncodedWidth()
+	if numPeriods := seq.NumPeriods(width); from > numPeriods-2 {
+		from = numPeriods - 2
+	}
+	for p := from; p >= 0; p-- {
+		offset := Width64bits + p*width
+		expr.Carry(e, seq[offset:offset+width], seq[offset+width:offset+2*width])
+	}
+}
+
 // Truncate truncates all periods in the Sequence that fall outside of the given
 // asOf and until.
 func (seq Sequence) Truncate(width int, resolution time.Duration, asOf time.Time, until time.Time) (result Sequence) {
@@ -452,6 +564,41 @@ func (seq Sequence) Truncate(width int, resolution time.Duration, asOf time.Time
 	return result
 }
 
+// ClearPeriods returns a copy of this Sequence in which the values of all
+// periods after asOf and up to and including until are unset (like Truncate,
+// periods are identified by the time at which they end). A zero asOf or until
+// leaves the range open on that side. If no values remain set, this returns
+// nil.
+func (seq Sequence) ClearPeriods(width int, resolution time.Duration, asOf time.Time, until time.Time) Sequence {
+	if len(seq) == 0 {
+		return nil
+	}
+	result := make(Sequence, len(seq))
+	copy(result, seq)
+	seqUntil := result.Until()
+	anySet := false
+	for i := 0; i < result.NumPeriods(width); i++ {
+		ts := seqUntil.Add(-1 * time.Duration(i) * resolution)
+		period := result[Width64bits+i*width : Width64bits+(i+1)*width]
+		if (asOf.IsZero() || ts.After(asOf)) && (until.IsZero() || !ts.After(until)) {
+			for j := range period {
+				period[j] = 0
+			}
+			continue
+		}
+		for _, b := range period {
+			if b != 0 {
+				anySet = true
+				break
+			}
+		}
+	}
+	if !anySet {
+		return nil
+	}
+	return result
+}
+
 // String provides a string representation of this Sequence assuming that it
 // holds data for the given Expr.
 func (seq Sequence) String(e expr.Expr, resolution time.Duration) string {
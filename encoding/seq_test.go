@@ -118,7 +118,7 @@ func TestSequenceFull(t *testing.T) {
 	resolutionIn := res
 	resolutionOut := 3 * resolutionIn
 
-	eOut := ADD(SUM(FIELD("a")), SUM(FIELD("b")))
+	eOut := ADD(SUM(FIELD("a")), COALESCE(SUM(FIELD("b")), 0))
 	eIn := SUM(FIELD("a"))
 	eB := SUM(FIELD("b"))
 	submergers := eOut.SubMergers([]Expr{eIn, eB})
@@ -183,6 +183,117 @@ func TestSequenceValue(t *testing.T) {
 	assert.Equal(t, 56.78, val)
 }
 
+func TestSequenceIntValue(t *testing.T) {
+	e := ISUM(FIELD("a"))
+	seq := NewFloatValue(e, epoch, 1<<53)
+	seq = seq.UpdateValue(epoch, bytemapParams(bytemap.NewFloat(map[string]float64{"a": 1})), nil, e, res, truncateBefore)
+	val, found := seq.IntValueAtTime(epoch, e, res)
+	assert.True(t, found)
+	assert.EqualValues(t, 1<<53+1, val)
+	_, found = seq.IntValueAt(1, e)
+	assert.False(t, found)
+}
+
+func TestSequenceClearPeriods(t *testing.T) {
+	e := SUM(FIELD("a"))
+	width := e.EncodedWidth()
+	seq := NewSequence(width, 4)
+	seq.SetUntil(epoch)
+	for i := 0; i < 4; i++ {
+		seq.UpdateValueAt(i, e, FloatParams(float64(i+1)), nil)
+	}
+
+	cleared := seq.ClearPeriods(width, res, epoch.Add(-2*res), epoch)
+	for i, expected := range []float64{0, 0, 3, 4} {
+		val, found := cleared.ValueAt(i, e)
+		assert.Equal(t, expected != 0, found, "period %d", i)
+		assert.Equal(t, expected, val, "period %d", i)
+	}
+	val, _ := seq.ValueAt(0, e)
+	assert.EqualValues(t, 1, val, "original sequence should be unchanged")
+
+	assert.Nil(t, seq.ClearPeriods(width, res, time.Time{}, time.Time{}), "clearing everything should return nil")
+	assert.Nil(t, cleared.ClearPeriods(width, res, epoch.Add(-5*res), epoch.Add(-3*res)).ClearPeriods(width, res, epoch.Add(-3*res), time.Time{}))
+}
+
+func TestSequenceValues(t *testing.T) {
+	for _, e := range []Expr{SUM(FIELD("a")), AVG(FIELD("a")), MULT(SUM(FIELD("a")), CONST(2))} {
+		width := e.EncodedWidth()
+		seqs := make([]Sequence, 0, 3)
+		for s := 0; s < 3; s++ {
+			seq := NewSequence(width, s)
+			seq.SetUntil(epoch)
+			for p := 0; p < s; p++ {
+				seq.UpdateValueAt(p, e, FloatParams(float64(10*s+p)), nil)
+			}
+			seqs = append(seqs, seq)
+
+			values, found := seq.Values(e, []float64{-1}, []bool{true})
+			if assert.Len(t, values, s+1) && assert.Len(t, found, s+1) {
+				assert.Equal(t, -1.0, values[0], "%v: existing values should be kept", e)
+				for p := 0; p < s; p++ {
+					expected, _ := seq.ValueAt(p, e)
+					assert.True(t, found[p+1], "%v: period %d", e, p)
+					assert.Equal(t, expected, values[p+1], "%v: period %d", e, p)
+				}
+			}
+		}
+		seqs = append(seqs, nil)
+
+		values := make([]float64, len(seqs))
+		found := make([]bool, len(seqs))
+		ValuesAt(seqs, 1, e, values, found)
+		assert.Equal(t, []bool{false, false, true, false}, found, "%v", e)
+		expected, _ := seqs[2].ValueAt(1, e)
+		assert.Equal(t, []float64{0, 0, expected, 0}, values, "%v", e)
+	}
+}
+
+func TestSequenceEMA(t *testing.T) {
+	e := EMA(FIELD("a"), 0.5)
+	width := e.EncodedWidth()
+	update := func(seq Sequence, period int, value float64) Sequence {
+		return seq.UpdateValue(epoch.Add(time.Duration(period)*res), Map{"a": value}, nil, e, res, truncateBefore)
+	}
+	values := func(seq Sequence) []float64 {
+		result := make([]float64, 0, seq.NumPeriods(width))
+		for p := seq.NumPeriods(width) - 1; p >= 0; p-- {
+			value, _ := seq.ValueAt(p, e)
+			result = append(result, value)
+		}
+		return result
+	}
+
+	var seq Sequence
+	seq = update(seq, 0, 10)
+	seq = update(seq, 0, 20)
+	seq = update(seq, 1, 30)
+	seq = update(seq, 3, 50)
+	// the average carries over the period without values
+	assert.Equal(t, []float64{15, 22.5, 22.5, 36.25}, values(seq))
+
+	// late values update the periods after them too
+	seq = update(seq, 1, 10)
+	expected := []float64{15, 17.5, 17.5, 33.75}
+	assert.Equal(t, expected, values(seq))
+
+	// merging partial sequences yields the same result, regardless of order
+	var older, newer Sequence
+	older = update(older, 0, 10)
+	older = update(older, 1, 30)
+	newer = update(newer, 0, 20)
+	newer = update(newer, 1, 10)
+	newer = update(newer, 3, 50)
+	assert.Equal(t, expected, values(older.Merge(newer, e, res, truncateBefore)))
+	assert.Equal(t, expected, values(newer.Merge(older, e, res, truncateBefore)))
+
+	// truncated sequences keep the average carried over from truncated periods
+	truncated := seq.Truncate(width, res, epoch.Add(res), time.Time{})
+	assert.Equal(t, []float64{17.5, 33.75}, values(truncated))
+	truncated = update(truncated, 4, 100)
+	assert.Equal(t, []float64{17.5, 33.75, 66.875}, values(truncated))
+}
+
 func TestSequenceConstant(t *testing.T) {
 	e := CONST(5.1)
 	s := Sequence(nil)
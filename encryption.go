@@ -0,0 +1,164 @@
+package zenodb
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/compress"
+	"github.com/getlantern/zenodb/encryption"
+	"github.com/getlantern/zenodb/wal"
+)
+
+const (
+	// DefaultEncryptionKeyReloadInterval is the default for
+	// DBOpts.EncryptionKeyReloadInterval
+	DefaultEncryptionKeyReloadInterval = 1 * time.Minute
+)
+
+func (db *DB) initEncryption() error {
+	if db.opts.EncryptionKeys == nil {
+		return nil
+	}
+	kr, err := encryption.NewKeyring(db.opts.EncryptionKeys)
+	if err != nil {
+		return errors.New("Unable to initialize encryption: %v", err)
+	}
+	db.keyring = kr
+	log.Debugf("Encrypting data at rest with key %d", kr.CurrentKeyID())
+	return nil
+}
+
+// RotateEncryptionKey reloads encryption keys from DBOpts.EncryptionKeys. If a
+// new current key is found, new data will be encrypted with that key and
+// existing filestores are re-encrypted in the background. Existing WAL
+// segments remain encrypted with the keys that were current when they were
+// written until they age out, so old keys must remain available at least that
+// long.
+func (db *DB) RotateEncryptionKey() (rotated bool, err error) {
+	if db.keyring == nil {
+		return false, errors.New("Encryption not enabled")
+	}
+	rotated, err = db.keyring.Reload()
+	if err != nil {
+		return false, err
+	}
+	if rotated {
+		log.Debugf("Rotated to encryption key %d, re-encrypting filestores", db.keyring.CurrentKeyID())
+		go db.reencryptFileStores()
+	}
+	return rotated, nil
+}
+
+func (db *DB) reloadEncryptionKeysPeriodically() {
+	// Catch up on any filestores that haven't been encrypted with the current
+	// key yet, for example because encryption was just turned on or we crashed
+	// in the middle of re-encrypting.
+	db.reencryptFileStores()
+	for {
+		time.Sleep(db.opts.EncryptionKeyReloadInterval)
+		_, err := db.RotateEncryptionKey()
+		if err != nil {
+			log.Errorf("Unable to reload encryption keys: %v", err)
+		}
+	}
+}
+
+func (db *DB) reencryptFileStores() {
+	db.tablesMutex.RLock()
+	tables := make([]*table, 0, len(db.orderedTables))
+	for _, t := range db.orderedTables {
+		if t.rowStore != nil {
+			tables = append(tables, t)
+		}
+	}
+	db.tablesMutex.RUnlock()
+
+	for _, t := range tables {
+		t.rowStore.reencrypt()
+	}
+}
+
+// writeWAL writes the concatenation of bufs to the given WAL, compressing it
+// first if WALCompression is set and encrypting it if encryption is enabled.
+func (db *DB) writeWAL(w *wal.WAL, bufs ...[]byte) error {
+	if db.opts.WALCompression != compress.None {
+		compressed, err := compress.Encode(db.opts.WALCompression, bufs...)
+		if err != nil {
+			return err
+		}
+		bufs = [][]byte{compressed}
+	}
+	if db.keyring == nil {
+		_, err := w.Write(bufs...)
+		return err
+	}
+	sealed, err := db.keyring.Seal(bufs...)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// openWALEntry decrypts and decompresses the given WAL entry if necessary.
+func (db *DB) openWALEntry(data []byte) ([]byte, error) {
+	data, err := db.keyring.Open(data)
+	if err != nil {
+		return nil, err
+	}
+	return compress.Decode(data)
+}
+
+func (t *table) keyring() *encryption.Keyring {
+	if t == nil || t.db == nil {
+		return nil
+	}
+	return t.db.keyring
+}
+
+// needsReencryption checks whether this filestore is encrypted with something
+// other than the current key.
+func (fs *fileStore) needsReencryption() bool {
+	kr := fs.t.keyring()
+	if kr == nil || fs.filename == "" {
+		return false
+	}
+	if isColumnar(fs.filename) {
+		cr, err := openColumnar(kr, fs.filename)
+		if err != nil {
+			fs.t.log.Errorf("Unable to determine encryption key of %v: %v", fs.filename, err)
+			return false
+		}
+		defer cr.Close()
+		keyID, encrypted := cr.keyID()
+		return !encrypted || keyID != kr.CurrentKeyID()
+	}
+	file, err := os.Open(fs.filename)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	keyID, encrypted, err := encryption.KeyIDOfStream(file)
+	if err != nil {
+		fs.t.log.Errorf("Unable to determine encryption key of %v: %v", fs.filename, err)
+		return false
+	}
+	return !encrypted || keyID != kr.CurrentKeyID()
+}
+
+// closeChain is an io.WriteCloser that closes next after closing itself.
+type closeChain struct {
+	io.WriteCloser
+	next io.Closer
+}
+
+func (cc *closeChain) Close() error {
+	err := cc.WriteCloser.Close()
+	nextErr := cc.next.Close()
+	if err != nil {
+		return err
+	}
+	return nextErr
+}
@@ -0,0 +1,442 @@
+// Package encryption provides AES-GCM encryption of data at rest, both for
+// individual records (like WAL entries) and for streams (like filestore files).
+//
+// Keys are identified by a numeric id that's stored alongside the encrypted
+// data, so that data encrypted with an older key can still be decrypted after
+// rotating to a new key. Data that isn't encrypted is passed through unchanged,
+// which allows turning on encryption for an existing database.
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+)
+
+const (
+	keyIDSize       = 4
+	nonceSize       = 12
+	noncePrefixSize = nonceSize - 4
+	lengthSize      = 4
+
+	// MaxChunkSize is the maximum size of plaintext chunks in encrypted streams
+	MaxChunkSize = 64 * 1024
+)
+
+var (
+	log = golog.LoggerFor("zenodb.encryption")
+
+	// Magic bytes that precede encrypted data. The leading 0xFF guarantees that
+	// these never collide with plaintext WAL entries, which start with a
+	// big-endian timestamp that would have to be negative.
+	recordMagic = []byte{0xFF, 'Z', 'E', 'R'}
+	streamMagic = []byte{0xFF, 'Z', 'E', 'S'}
+
+	recordHeaderSize = len(recordMagic) + keyIDSize + nonceSize
+	streamHeaderSize = len(streamMagic) + keyIDSize + noncePrefixSize
+
+	finalChunk    = []byte{1}
+	nonFinalChunk = []byte{0}
+
+	// ErrNoKeyring indicates that we encountered encrypted data without having
+	// a keyring with which to decrypt it.
+	ErrNoKeyring = errors.New("data is encrypted but no encryption keys configured")
+
+	// ErrTruncated indicates that an encrypted stream ended prematurely.
+	ErrTruncated = errors.New("encrypted stream truncated")
+)
+
+// KeySource supplies encryption keys by id. The key with the highest id is used
+// for encrypting new data. Keys must be 16, 24 or 32 bytes long (AES-128,
+// AES-192 or AES-256).
+type KeySource func() (map[uint32][]byte, error)
+
+// FileKeySource reads keys from a file containing lines of the form:
+//
+//	id=hexkey
+//
+// Blank lines and lines starting with # are ignored.
+func FileKeySource(filename string) KeySource {
+	return func() (map[uint32][]byte, error) {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, errors.New("Unable to read encryption keys from %v: %v", filename, err)
+		}
+		keys := make(map[uint32][]byte)
+		for i, line := range strings.Split(string(b), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) != 2 {
+				return nil, errors.New("Invalid key on line %d of %v, expected id=hexkey", i+1, filename)
+			}
+			id, parseErr := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+			if parseErr != nil {
+				return nil, errors.New("Invalid key id on line %d of %v: %v", i+1, filename, parseErr)
+			}
+			key, decodeErr := hex.DecodeString(strings.TrimSpace(parts[1]))
+			if decodeErr != nil {
+				return nil, errors.New("Invalid key on line %d of %v: %v", i+1, filename, decodeErr)
+			}
+			keys[uint32(id)] = key
+		}
+		return keys, nil
+	}
+}
+
+// Keyring holds the keys used for encrypting and decrypting data. A nil
+// *Keyring is valid and simply passes through data without encrypting it.
+type Keyring struct {
+	source  KeySource
+	aeads   map[uint32]cipher.AEAD
+	current uint32
+	mx      sync.RWMutex
+}
+
+// NewKeyring creates a Keyring using keys from the given source.
+func NewKeyring(source KeySource) (*Keyring, error) {
+	kr := &Keyring{source: source}
+	_, err := kr.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// Reload reloads keys from the key source. If a new key with a higher id than
+// the current key is found, it becomes the current key and rotated is true.
+// Keys that are no longer present in the source are retained so that existing
+// data remains readable.
+func (kr *Keyring) Reload() (rotated bool, err error) {
+	keys, err := kr.source()
+	if err != nil {
+		return false, err
+	}
+	if len(keys) == 0 {
+		return false, errors.New("No encryption keys found")
+	}
+
+	aeads := make(map[uint32]cipher.AEAD, len(keys))
+	current := uint32(0)
+	first := true
+	for id, key := range keys {
+		block, cipherErr := aes.NewCipher(key)
+		if cipherErr != nil {
+			return false, errors.New("Invalid encryption key %d: %v", id, cipherErr)
+		}
+		aead, gcmErr := cipher.NewGCM(block)
+		if gcmErr != nil {
+			return false, errors.New("Unable to initialize GCM for key %d: %v", id, gcmErr)
+		}
+		aeads[id] = aead
+		if first || id > current {
+			current = id
+			first = false
+		}
+	}
+
+	kr.mx.Lock()
+	defer kr.mx.Unlock()
+	rotated = kr.aeads != nil && current != kr.current
+	for id, aead := range kr.aeads {
+		if _, found := aeads[id]; !found {
+			log.Debugf("Key %d no longer in key source, retaining for decryption", id)
+			aeads[id] = aead
+		}
+	}
+	kr.aeads = aeads
+	kr.current = current
+	log.Debugf("Loaded %d encryption keys, current key is %d", len(keys), current)
+	return rotated, nil
+}
+
+// CurrentKeyID returns the id of the key used for encrypting new data.
+func (kr *Keyring) CurrentKeyID() uint32 {
+	kr.mx.RLock()
+	defer kr.mx.RUnlock()
+	return kr.current
+}
+
+func (kr *Keyring) currentAEAD() (uint32, cipher.AEAD) {
+	kr.mx.RLock()
+	defer kr.mx.RUnlock()
+	return kr.current, kr.aeads[kr.current]
+}
+
+func (kr *Keyring) aeadFor(id uint32) (cipher.AEAD, error) {
+	if kr == nil {
+		return nil, ErrNoKeyring
+	}
+	kr.mx.RLock()
+	aead := kr.aeads[id]
+	kr.mx.RUnlock()
+	if aead == nil {
+		return nil, errors.New("Unknown encryption key %d", id)
+	}
+	return aead, nil
+}
+
+// IsEncrypted indicates whether the given record was encrypted with Seal.
+func IsEncrypted(data []byte) bool {
+	return len(data) >= recordHeaderSize && bytes.Equal(data[:len(recordMagic)], recordMagic)
+}
+
+// KeyIDOf returns the id of the key with which the given record was encrypted.
+func KeyIDOf(data []byte) (uint32, bool) {
+	if !IsEncrypted(data) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(data[len(recordMagic):]), true
+}
+
+// Seal encrypts the concatenation of the given bufs using the current key. If
+// kr is nil, this simply returns the concatenated bufs.
+func (kr *Keyring) Seal(bufs ...[]byte) ([]byte, error) {
+	plaintextLen := 0
+	for _, buf := range bufs {
+		plaintextLen += len(buf)
+	}
+	plaintext := make([]byte, 0, plaintextLen)
+	for _, buf := range bufs {
+		plaintext = append(plaintext, buf...)
+	}
+	if kr == nil {
+		return plaintext, nil
+	}
+
+	id, aead := kr.currentAEAD()
+	out := make([]byte, recordHeaderSize, recordHeaderSize+plaintextLen+aead.Overhead())
+	copy(out, recordMagic)
+	binary.BigEndian.PutUint32(out[len(recordMagic):], id)
+	nonce := out[len(recordMagic)+keyIDSize : recordHeaderSize]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.New("Unable to generate nonce: %v", err)
+	}
+	return aead.Seal(out, nonce, plaintext, out[:len(recordMagic)+keyIDSize]), nil
+}
+
+// Open decrypts a record that was encrypted with Seal. Records that aren't
+// encrypted are returned unchanged.
+func (kr *Keyring) Open(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	id, _ := KeyIDOf(data)
+	aead, err := kr.aeadFor(id)
+	if err != nil {
+		return nil, err
+	}
+	nonce := data[len(recordMagic)+keyIDSize : recordHeaderSize]
+	plaintext, err := aead.Open(nil, nonce, data[recordHeaderSize:], data[:len(recordMagic)+keyIDSize])
+	if err != nil {
+		return nil, errors.New("Unable to decrypt record with key %d: %v", id, err)
+	}
+	return plaintext, nil
+}
+
+// NewWriter returns a writer that encrypts everything written to it with the
+// current key before writing to out. Closing the writer writes the final chunk
+// but does not close out. If kr is nil, data is written to out unencrypted.
+func (kr *Keyring) NewWriter(out io.Writer) (io.WriteCloser, error) {
+	if kr == nil {
+		return &nopCloser{out}, nil
+	}
+
+	id, aead := kr.currentAEAD()
+	header := make([]byte, streamHeaderSize)
+	copy(header, streamMagic)
+	binary.BigEndian.PutUint32(header[len(streamMagic):], id)
+	if _, err := io.ReadFull(rand.Reader, header[len(streamMagic)+keyIDSize:]); err != nil {
+		return nil, errors.New("Unable to generate nonce: %v", err)
+	}
+	if _, err := out.Write(header); err != nil {
+		return nil, errors.New("Unable to write encryption header: %v", err)
+	}
+	w := &writer{
+		out:   out,
+		aead:  aead,
+		nonce: make([]byte, nonceSize),
+		buf:   make([]byte, 0, MaxChunkSize),
+	}
+	copy(w.nonce, header[len(streamMagic)+keyIDSize:])
+	return w, nil
+}
+
+// NewReader returns a reader that decrypts a stream written with NewWriter.
+// Streams that aren't encrypted are read unchanged.
+func (kr *Keyring) NewReader(in io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(in)
+	magic, err := br.Peek(len(streamMagic))
+	if err != nil || !bytes.Equal(magic, streamMagic) {
+		// Not encrypted (or too short to tell)
+		return br, nil
+	}
+
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, errors.New("Unable to read encryption header: %v", err)
+	}
+	id := binary.BigEndian.Uint32(header[len(streamMagic):])
+	aead, err := kr.aeadFor(id)
+	if err != nil {
+		return nil, err
+	}
+	r := &reader{
+		in:    br,
+		aead:  aead,
+		nonce: make([]byte, nonceSize),
+	}
+	copy(r.nonce, header[len(streamMagic)+keyIDSize:])
+	return r, nil
+}
+
+type writer struct {
+	out     io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("Write to closed encrypted stream")
+	}
+	n := 0
+	for len(b) > 0 {
+		space := MaxChunkSize - len(w.buf)
+		if space == 0 {
+			if err := w.writeChunk(nonFinalChunk); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if space > len(b) {
+			space = len(b)
+		}
+		w.buf = append(w.buf, b[:space]...)
+		b = b[space:]
+		n += space
+	}
+	return n, nil
+}
+
+func (w *writer) writeChunk(final []byte) error {
+	binary.BigEndian.PutUint32(w.nonce[noncePrefixSize:], w.counter)
+	w.counter++
+	if w.counter == 0 {
+		return errors.New("Encrypted stream too long")
+	}
+	chunk := make([]byte, lengthSize, lengthSize+len(w.buf)+w.aead.Overhead())
+	chunk = w.aead.Seal(chunk, w.nonce, w.buf, final)
+	binary.BigEndian.PutUint32(chunk, uint32(len(chunk)-lengthSize))
+	w.buf = w.buf[:0]
+	_, err := w.out.Write(chunk)
+	return err
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.writeChunk(finalChunk)
+}
+
+type reader struct {
+	in      io.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *reader) readChunk() error {
+	lengthBytes := make([]byte, lengthSize)
+	if _, err := io.ReadFull(r.in, lengthBytes); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+	length := binary.BigEndian.Uint32(lengthBytes)
+	if int(length) > MaxChunkSize+r.aead.Overhead() {
+		return fmt.Errorf("Encrypted chunk of size %d exceeds maximum", length)
+	}
+	ciphertext := make([]byte, length)
+	if _, err := io.ReadFull(r.in, ciphertext); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+	binary.BigEndian.PutUint32(r.nonce[noncePrefixSize:], r.counter)
+	r.counter++
+	plaintext, err := r.aead.Open(nil, r.nonce, ciphertext, nonFinalChunk)
+	if err != nil {
+		plaintext, err = r.aead.Open(nil, r.nonce, ciphertext, finalChunk)
+		if err != nil {
+			return errors.New("Unable to decrypt chunk: %v", err)
+		}
+		r.done = true
+	}
+	r.buf = plaintext
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (c *nopCloser) Close() error {
+	return nil
+}
+
+// KeyIDOfStream reads the header of a stream written with NewWriter and returns
+// the id of the key with which it was encrypted. If the stream isn't encrypted,
+// encrypted is false.
+func KeyIDOfStream(in io.Reader) (id uint32, encrypted bool, err error) {
+	header := make([]byte, streamHeaderSize)
+	_, err = io.ReadFull(in, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if !bytes.Equal(header[:len(streamMagic)], streamMagic) {
+		return 0, false, nil
+	}
+	return binary.BigEndian.Uint32(header[len(streamMagic):]), true, nil
+}
@@ -0,0 +1,143 @@
+package encryption
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func staticKeys(keys map[uint32][]byte) KeySource {
+	return func() (map[uint32][]byte, error) {
+		return keys, nil
+	}
+}
+
+func TestRecords(t *testing.T) {
+	keys := map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}
+	kr, err := NewKeyring(staticKeys(keys))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	sealed, err := kr.Seal([]byte("hello "), []byte("world"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, IsEncrypted(sealed))
+	assert.NotContains(t, string(sealed), "hello")
+	keyID, _ := KeyIDOf(sealed)
+	assert.EqualValues(t, 1, keyID)
+
+	plaintext, err := kr.Open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(plaintext))
+
+	unencrypted := []byte("not encrypted")
+	plaintext, err = kr.Open(unencrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, unencrypted, plaintext, "unencrypted records should pass through")
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1]++
+	_, err = kr.Open(tampered)
+	assert.Error(t, err)
+
+	var nilKR *Keyring
+	_, err = nilKR.Open(sealed)
+	assert.Equal(t, ErrNoKeyring, err)
+	plaintext, err = nilKR.Seal([]byte("a"), []byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ab", string(plaintext))
+
+	// Rotate
+	keys[2] = bytes.Repeat([]byte{2}, 16)
+	rotated, err := kr.Reload()
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+	assert.EqualValues(t, 2, kr.CurrentKeyID())
+	resealed, _ := kr.Seal([]byte("hello world"))
+	keyID, _ = KeyIDOf(resealed)
+	assert.EqualValues(t, 2, keyID)
+
+	// Old key is retained even after removal from source
+	delete(keys, 1)
+	rotated, err = kr.Reload()
+	assert.NoError(t, err)
+	assert.False(t, rotated)
+	plaintext, err = kr.Open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(plaintext))
+}
+
+func TestStreams(t *testing.T) {
+	kr, err := NewKeyring(staticKeys(map[uint32][]byte{7: bytes.Repeat([]byte{7}, 32)}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data := make([]byte, MaxChunkSize*3+17)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := kr.NewWriter(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = w.Write(data[:10])
+	assert.NoError(t, err)
+	_, err = w.Write(data[10:])
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	encrypted := buf.Bytes()
+
+	keyID, isEncrypted, err := KeyIDOfStream(bytes.NewReader(encrypted))
+	assert.NoError(t, err)
+	assert.True(t, isEncrypted)
+	assert.EqualValues(t, 7, keyID)
+
+	r, err := kr.NewReader(bytes.NewReader(encrypted))
+	if !assert.NoError(t, err) {
+		return
+	}
+	decrypted, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	r, err = kr.NewReader(bytes.NewReader(encrypted[:len(encrypted)-MaxChunkSize]))
+	if assert.NoError(t, err) {
+		_, err = ioutil.ReadAll(r)
+		assert.Equal(t, ErrTruncated, err)
+	}
+
+	r, err = kr.NewReader(bytes.NewReader(data))
+	if assert.NoError(t, err) {
+		decrypted, err = ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, data, decrypted, "unencrypted streams should pass through")
+	}
+}
+
+func TestFileKeySource(t *testing.T) {
+	file, err := ioutil.TempFile("", "keys")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# comment\n\n1=000102030405060708090a0b0c0d0e0f\n 2 = 0f0e0d0c0b0a09080706050403020100 \n")
+	file.Close()
+
+	keys, err := FileKeySource(file.Name())()
+	if assert.NoError(t, err) {
+		assert.Len(t, keys, 2)
+		assert.Equal(t, byte(0x0f), keys[2][0])
+	}
+
+	ioutil.WriteFile(file.Name(), []byte("1=nothex"), 0644)
+	_, err = FileKeySource(file.Name())()
+	assert.Error(t, err)
+}
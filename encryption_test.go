@@ -0,0 +1,94 @@
+package zenodb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/encryption"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var keysMx sync.Mutex
+	keys := map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}
+	keySource := func() (map[uint32][]byte, error) {
+		keysMx.Lock()
+		defer keysMx.Unlock()
+		result := make(map[uint32][]byte, len(keys))
+		for id, key := range keys {
+			result[id] = key
+		}
+		return result, nil
+	}
+
+	db, err := NewDB(&DBOpts{
+		Dir:                         tmpDir,
+		EncryptionKeys:              keySource,
+		EncryptionKeyReloadInterval: time.Hour,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1h)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"secretdim": "secretvalue"}, map[string]float64{"i": 1}))
+	time.Sleep(250 * time.Millisecond)
+	db.FlushAll()
+
+	walFiles, _ := filepath.Glob(filepath.Join(tmpDir, "_wal", "inbound", "*"))
+	if assert.NotEmpty(t, walFiles) {
+		for _, walFile := range walFiles {
+			b, _ := ioutil.ReadFile(walFile)
+			assert.False(t, strings.Contains(string(b), "secretvalue"), "WAL should be encrypted")
+		}
+	}
+
+	keyIDOfFileStore := func() uint32 {
+		fs := db.getTable("test_a").rowStore.fileStore
+		file, openErr := os.Open(fs.filename)
+		if !assert.NoError(t, openErr) {
+			return 0
+		}
+		defer file.Close()
+		keyID, encrypted, keyErr := encryption.KeyIDOfStream(file)
+		assert.NoError(t, keyErr)
+		assert.True(t, encrypted)
+		return keyID
+	}
+	assert.EqualValues(t, 1, keyIDOfFileStore())
+
+	keysMx.Lock()
+	keys[2] = bytes.Repeat([]byte{2}, 32)
+	keysMx.Unlock()
+	rotated, err := db.RotateEncryptionKey()
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+	db.reencryptFileStores()
+	assert.EqualValues(t, 2, keyIDOfFileStore())
+
+	_, fieldsString, _, err := FileInfo(db.keyring, db.getTable("test_a").rowStore.fileStore.filename)
+	assert.NoError(t, err)
+	assert.Contains(t, fieldsString, "i")
+}
@@ -0,0 +1,206 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/planner"
+)
+
+const (
+	explainPlanDim      = "plan"
+	explainPartitionDim = "partition"
+	explainRowsField    = "estimated_rows"
+)
+
+var (
+	explainFields = core.Fields{core.NewField(explainRowsField, expr.FIELD(explainRowsField))}
+)
+
+// explainLine is one line of the plan returned by an EXPLAIN statement
+type explainLine struct {
+	text          string
+	partition     int
+	hasPartition  bool
+	estimatedRows int64
+}
+
+// explainSource is a core.FlatRowSource that returns the plan for a query
+// instead of its results, one row per line of the plan. Each row has the text
+// of the line in the plan dimension and, for lines from followers, the
+// follower's partition in the partition dimension. The estimated_rows field
+// estimates how many rows the corresponding step would scan.
+type explainSource struct {
+	core.FlatRowSource
+	db              *DB
+	includeMemStore bool
+}
+
+func (db *DB) explain(plan core.FlatRowSource, includeMemStore bool) core.FlatRowSource {
+	return &explainSource{FlatRowSource: plan, db: db, includeMemStore: includeMemStore}
+}
+
+func (e *explainSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	stats := &common.QueryStats{NumPartitions: 1, NumSuccessfulPartitions: 1}
+	lines, _, err := e.explain(ctx, e.FlatRowSource, "", stats)
+	if err != nil {
+		return nil, err
+	}
+	// Explaining doesn't read any data, so the results are always current
+	now := common.TimeToMillis(e.db.clock.Now())
+	stats.LowestHighWaterMark = now
+	stats.HighestHighWaterMark = now
+
+	err = onFields(explainFields)
+	if err != nil {
+		return stats, err
+	}
+	ts := e.GetUntil().UnixNano()
+	for _, line := range lines {
+		key := map[string]interface{}{explainPlanDim: line.text}
+		if line.hasPartition {
+			key[explainPartitionDim] = line.partition
+		} else if e.db.opts.Follow != nil {
+			key[explainPartitionDim] = e.db.opts.Partition
+		}
+		more, err := onRow(&core.FlatRow{
+			TS:     ts,
+			Key:    bytemap.New(key),
+			Values: []float64{float64(line.estimatedRows)},
+		})
+		if !more || err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// explain explains the given source and everything that it's based on,
+// returning the lines of the plan as well as the estimated number of rows that
+// source would scan.
+func (e *explainSource) explain(ctx context.Context, source core.Source, indent string, stats *common.QueryStats) ([]*explainLine, int64, error) {
+	var lines []*explainLine
+	for i, text := range strings.Split(source.String(), "\n") {
+		if i == 0 {
+			text = "<- " + text
+		}
+		lines = append(lines, &explainLine{text: indent + text})
+	}
+
+	var estimatedRows int64
+	indent += "  "
+	switch s := source.(type) {
+	case *queryable:
+		if s.t.rowStore != nil {
+			estimatedRows = s.t.rowStore.estimatedRows(s.includeMemStore)
+		}
+	case planner.ClusterSource:
+		clusterLines, clusterRows, err := e.explainCluster(ctx, s, indent, stats)
+		if err != nil {
+			return nil, 0, err
+		}
+		lines = append(lines, clusterLines...)
+		estimatedRows = clusterRows
+	case core.Transform:
+		sourceLines, sourceRows, err := e.explain(ctx, s.GetSource(), indent, stats)
+		if err != nil {
+			return nil, 0, err
+		}
+		lines = append(lines, sourceLines...)
+		estimatedRows = sourceRows
+
+	case core.Combination:
+		for _, source := range s.GetSources() {
+			sourceLines, sourceRows, err := e.explain(ctx, source, indent, stats)
+			if err != nil {
+				return nil, 0, err
+			}
+			lines = append(lines, sourceLines...)
+			estimatedRows += sourceRows
+		}
+	}
+	lines[0].estimatedRows = estimatedRows
+	return lines, estimatedRows, nil
+}
+
+// explainCluster explains the query that the given source runs on the
+// partitions by running EXPLAIN for it on every partition.
+func (e *explainSource) explainCluster(ctx context.Context, source planner.ClusterSource, indent string, stats *common.QueryStats) ([]*explainLine, int64, error) {
+	var mergeText string
+	if source.Pushdown() {
+		mergeText = "leader combines results from partitions"
+	} else {
+		mergeText = "leader groups results from partitions"
+	}
+
+	linesByPartition := make(map[int][]*explainLine)
+	rowsByPartition := make(map[int]int64)
+	clusterStats, err := e.db.queryCluster(ctx, "EXPLAIN "+source.ClusterSQL(), source.IsSubQuery(), nil, e.includeMemStore, false, core.FieldsIgnored, nil, func(row *core.FlatRow) (bool, error) {
+		partition, _ := row.Key.Get(explainPartitionDim).(int)
+		text, _ := row.Key.Get(explainPlanDim).(string)
+		line := &explainLine{
+			text:         indent + "  " + text,
+			partition:    partition,
+			hasPartition: true,
+		}
+		if len(row.Values) > 0 {
+			line.estimatedRows = int64(row.Values[0])
+			if !strings.HasPrefix(text, " ") {
+				// The top level step includes the rows from all steps below it
+				rowsByPartition[partition] += line.estimatedRows
+			}
+		}
+		linesByPartition[partition] = append(linesByPartition[partition], line)
+		return true, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	partitionStats, _ := clusterStats.(*common.QueryStats)
+	if partitionStats == nil {
+		partitionStats = &common.QueryStats{}
+	}
+	stats.NumPartitions = partitionStats.NumPartitions
+	stats.NumSuccessfulPartitions = partitionStats.NumSuccessfulPartitions
+	stats.MissingPartitions = partitionStats.MissingPartitions
+
+	partitions := make([]int, 0, len(linesByPartition))
+	for partition := range linesByPartition {
+		partitions = append(partitions, partition)
+	}
+	sort.Ints(partitions)
+	lines := []*explainLine{
+		{text: fmt.Sprintf("%v%v", indent, mergeText)},
+		{text: fmt.Sprintf("%vpartitions queried: %d of %d", indent, partitionStats.NumSuccessfulPartitions, partitionStats.NumPartitions)},
+	}
+	if len(partitionStats.MissingPartitions) > 0 {
+		lines = append(lines, &explainLine{text: fmt.Sprintf("%vmissing partitions: %v", indent, partitionStats.MissingPartitions)})
+	}
+	var estimatedRows int64
+	for _, partition := range partitions {
+		lines = append(lines, &explainLine{
+			text:          fmt.Sprintf("%v<- partition %d", indent, partition),
+			partition:     partition,
+			hasPartition:  true,
+			estimatedRows: rowsByPartition[partition],
+		})
+		lines = append(lines, linesByPartition[partition]...)
+		estimatedRows += rowsByPartition[partition]
+	}
+	return lines, estimatedRows, nil
+}
+
+func (e *explainSource) GetSource() core.Source {
+	return e.FlatRowSource
+}
+
+func (e *explainSource) String() string {
+	return "explain"
+}
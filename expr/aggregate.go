@@ -94,6 +94,31 @@ func (e *aggregate) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte)
 	return b, remainX, remainY
 }
 
+func (e *aggregate) UpdateBatch(bs [][]byte, params []Params, metadata []goexpr.Params) {
+	f, wrapsField := e.Wrapped.(*field)
+	if !wrapsField {
+		for i, b := range bs {
+			e.Update(b, params[i], metadataAt(metadata, i))
+		}
+		return
+	}
+	// Fields don't have any state, so read their values straight from the params
+	for i, b := range bs {
+		next, found := params[i].Get(f.Name)
+		if found {
+			value, wasSet, _ := e.load(b)
+			e.save(b, e.update(wasSet, value, next))
+		}
+	}
+}
+
+func (e *aggregate) MergeBatch(b []byte, x []byte, y []byte, n int) ([]byte, []byte, []byte) {
+	for i := 0; i < n; i++ {
+		b, x, y = e.Merge(b, x, y)
+	}
+	return b, x, y
+}
+
 func (e *aggregate) SubMergers(subs []Expr) []SubMerge {
 	result := make([]SubMerge, len(subs))
 	for i, sub := range subs {
@@ -112,6 +137,12 @@ func (e *aggregate) Get(b []byte) (float64, bool, []byte) {
 	return e.load(b)
 }
 
+func (e *aggregate) GetBatch(bs [][]byte, values []float64, oks []bool) {
+	for i, b := range bs {
+		values[i], oks[i], _ = e.load(b)
+	}
+}
+
 func (e *aggregate) load(b []byte) (float64, bool, []byte) {
 	remain := b[width64bits+1:]
 	value := float64(0)
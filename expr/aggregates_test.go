@@ -111,3 +111,43 @@ func doTestAggregate(t *testing.T, e Expr, expected float64) {
 		AssertFloatEquals(t, expected, val)
 	}
 }
+
+func TestConditionalOnFields(t *testing.T) {
+	status, _ := goexpr.Binary(">=", goexpr.Param("status"), goexpr.Constant(500))
+	server, _ := goexpr.Binary("=", goexpr.Param("server"), goexpr.Constant("a"))
+	cond, _ := goexpr.Binary("AND", status, server)
+	md := goexpr.MapParams{"server": "a"}
+	points := []Map{
+		{"bytes": 10, "status": 200},
+		{"bytes": 20, "status": 500},
+		{"bytes": 40, "status": 503},
+		{"bytes": 80},
+	}
+
+	for _, tc := range []struct {
+		e        Expr
+		expected float64
+	}{
+		{SUMIF("bytes", status), 60},
+		{COUNTIF("bytes", status), 2},
+		{AVGIF("bytes", status), 30},
+		{SUMIF("bytes", cond), 60},
+	} {
+		e := msgpacked(t, tc.e)
+		b := make([]byte, e.EncodedWidth())
+		for _, params := range points {
+			e.Update(b, params, md)
+		}
+		val, wasSet, _ := e.Get(b)
+		if assert.True(t, wasSet, "%v", e) {
+			AssertFloatEquals(t, tc.expected, val)
+		}
+	}
+
+	// Dimensions take precedence over fields
+	e := SUMIF("bytes", status)
+	b := make([]byte, e.EncodedWidth())
+	e.Update(b, Map{"bytes": 10, "status": 500}, goexpr.MapParams{"status": 200})
+	_, wasSet, _ := e.Get(b)
+	assert.False(t, wasSet)
+}
@@ -82,6 +82,19 @@ func (e *avg) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
 	return b, remainX, remainY
 }
 
+func (e *avg) UpdateBatch(bs [][]byte, params []Params, metadata []goexpr.Params) {
+	for i, b := range bs {
+		e.Update(b, params[i], metadataAt(metadata, i))
+	}
+}
+
+func (e *avg) MergeBatch(b []byte, x []byte, y []byte, n int) ([]byte, []byte, []byte) {
+	for i := 0; i < n; i++ {
+		b, x, y = e.Merge(b, x, y)
+	}
+	return b, x, y
+}
+
 func (e *avg) SubMergers(subs []Expr) []SubMerge {
 	result := make([]SubMerge, 0, len(subs))
 	for _, sub := range subs {
@@ -106,6 +119,16 @@ func (e *avg) Get(b []byte) (float64, bool, []byte) {
 	return e.calc(count, total), wasSet, remain
 }
 
+func (e *avg) GetBatch(bs [][]byte, values []float64, oks []bool) {
+	for i, b := range bs {
+		count, total, wasSet, _ := e.load(b)
+		values[i], oks[i] = 0, wasSet
+		if wasSet {
+			values[i] = e.calc(count, total)
+		}
+	}
+}
+
 func (e *avg) calc(count float64, total float64) float64 {
 	if count == 0 {
 		return 0
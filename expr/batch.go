@@ -0,0 +1,68 @@
+package expr
+
+import (
+	"github.com/getlantern/goexpr"
+)
+
+// BatchExpr is implemented by Exprs that can evaluate many values at once,
+// which for scans over lots of rows and periods is more cache friendly and
+// avoids an interface call per value. Use the UpdateBatch, GetBatch and
+// MergeBatch functions, which fall back to evaluating one value at a time for
+// Exprs that don't implement BatchExpr.
+type BatchExpr interface {
+	// UpdateBatch is like Update, applying params[i] and metadata[i] to the
+	// value in bs[i].
+	UpdateBatch(bs [][]byte, params []Params, metadata []goexpr.Params)
+
+	// GetBatch is like Get, storing the value in bs[i] in values[i] and whether
+	// or not it was set in oks[i].
+	GetBatch(bs [][]byte, values []float64, oks []bool)
+
+	// MergeBatch is like Merge, merging n consecutive values from x and y into
+	// b. It returns the remaining portions of b, x and y.
+	MergeBatch(b []byte, x []byte, y []byte, n int) (remainB []byte, remainX []byte, remainY []byte)
+}
+
+// UpdateBatch updates the value in each of bs by applying the corresponding
+// params and metadata using the given Expr. metadata may be nil.
+func UpdateBatch(e Expr, bs [][]byte, params []Params, metadata []goexpr.Params) {
+	if be, ok := e.(BatchExpr); ok {
+		be.UpdateBatch(bs, params, metadata)
+		return
+	}
+	for i, b := range bs {
+		e.Update(b, params[i], metadataAt(metadata, i))
+	}
+}
+
+// GetBatch gets the value in each of bs using the given Expr, storing it in
+// values and storing whether or not it was set in oks. values and oks need to
+// be at least as long as bs.
+func GetBatch(e Expr, bs [][]byte, values []float64, oks []bool) {
+	if be, ok := e.(BatchExpr); ok {
+		be.GetBatch(bs, values, oks)
+		return
+	}
+	for i, b := range bs {
+		values[i], oks[i], _ = e.Get(b)
+	}
+}
+
+// MergeBatch merges n consecutive values from x and y into b using the given
+// Expr, returning the remaining portions of b, x and y.
+func MergeBatch(e Expr, b []byte, x []byte, y []byte, n int) ([]byte, []byte, []byte) {
+	if be, ok := e.(BatchExpr); ok {
+		return be.MergeBatch(b, x, y, n)
+	}
+	for i := 0; i < n; i++ {
+		b, x, y = e.Merge(b, x, y)
+	}
+	return b, x, y
+}
+
+func metadataAt(metadata []goexpr.Params, i int) goexpr.Params {
+	if metadata == nil {
+		return nil
+	}
+	return metadata[i]
+}
@@ -0,0 +1,86 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/getlantern/goexpr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch(t *testing.T) {
+	exprs := []Expr{
+		SUM("a"),
+		COUNT("a"),
+		MIN("a"),
+		MAX(boundedA()),
+		AVG("a"),
+		WAVG("a", "b"),
+		EMA("a", 0.5),
+		HISTOGRAM("a", 3, 5),
+		ISUM("a"),
+		// doesn't implement BatchExpr
+		DIV(SUM("a"), SUM("b")),
+	}
+	params := []Params{
+		Map{"a": 4.4, "b": 2},
+		Map{"b": 3},
+		Map{"a": 8.8, "b": 0.5},
+		Map{"a": 2.4, "b": 1},
+	}
+	metadata := []goexpr.Params{goexpr.MapParams{}, nil, goexpr.MapParams{}, nil}
+
+	for _, e := range exprs {
+		e = msgpacked(t, e)
+		width := e.EncodedWidth()
+
+		// Value i gets the first i+1 params applied, once one at a time and once
+		// in batches
+		single := make([][]byte, len(params))
+		batched := make([][]byte, len(params))
+		for i := range params {
+			single[i] = make([]byte, width)
+			batched[i] = make([]byte, width)
+			for j := 0; j <= i; j++ {
+				e.Update(single[i], params[j], metadata[j])
+			}
+		}
+		for j := range params {
+			// apply params[j] to all values from j on
+			repeated := make([]Params, len(params)-j)
+			repeatedMetadata := make([]goexpr.Params, len(params)-j)
+			for k := range repeated {
+				repeated[k] = params[j]
+				repeatedMetadata[k] = metadata[j]
+			}
+			UpdateBatch(e, batched[j:], repeated, repeatedMetadata)
+		}
+
+		values := make([]float64, len(params))
+		oks := make([]bool, len(params))
+		GetBatch(e, batched, values, oks)
+		for i := range params {
+			expected, expectedOK, _ := e.Get(single[i])
+			assert.Equal(t, expectedOK, oks[i], "%v: wrong ok at %d", e, i)
+			AssertFloatEquals(t, expected, values[i])
+		}
+
+		// Merge contiguous values
+		x := make([]byte, 0, len(params)*width)
+		y := make([]byte, 0, len(params)*width)
+		for i := range params {
+			x = append(x, single[i]...)
+			y = append(y, batched[len(params)-1-i]...)
+		}
+		expectedMerged := make([]byte, len(x))
+		b, rx, ry := expectedMerged, x, y
+		for range params {
+			b, rx, ry = e.Merge(b, rx, ry)
+		}
+		merged := make([]byte, len(x))
+		remainB, remainX, remainY := MergeBatch(e, merged, x, y, len(params))
+		assert.Equal(t, expectedMerged, merged, "%v: wrong merge result", e)
+		assert.Equal(t, len(b), len(remainB), "%v: wrong remaining b", e)
+		assert.Equal(t, len(rx), len(remainX), "%v: wrong remaining x", e)
+		assert.Equal(t, len(ry), len(remainY), "%v: wrong remaining y", e)
+	}
+}
@@ -20,24 +20,35 @@ func binaryExprFor(op string, left interface{}, right interface{}) *binaryExpr {
 }
 
 func registerBinaryExpr(op string, calc calcFN) {
+	registerNullableBinaryExpr(op, calc, nil)
+}
+
+// registerNullableBinaryExpr registers a binary expression that uses calcNull
+// to determine its value when one or both sides have no value. Binary
+// expressions registered without a calcNull have no value in that case.
+func registerNullableBinaryExpr(op string, calc calcFN, calcNull nullCalcFN) {
 	binaryExprs[op] = func(left interface{}, right interface{}) *binaryExpr {
 		return &binaryExpr{
-			Op:    op,
-			Left:  exprFor(left),
-			Right: exprFor(right),
-			calc:  calc,
+			Op:       op,
+			Left:     exprFor(left),
+			Right:    exprFor(right),
+			calc:     calc,
+			calcNull: calcNull,
 		}
 	}
 }
 
 type calcFN func(left float64, right float64) float64
 
+type nullCalcFN func(left float64, leftWasSet bool, right float64, rightWasSet bool) (float64, bool)
+
 type binaryExpr struct {
 	Op           string
 	Left         Expr
 	Right        Expr
 	DeAggregated bool
 	calc         calcFN
+	calcNull     nullCalcFN
 }
 
 func (e *binaryExpr) Validate() error {
@@ -54,16 +65,21 @@ func (e *binaryExpr) validateWrappedInBinary(wrapped Expr) error {
 	}
 	typeOfWrapped := reflect.TypeOf(wrapped)
 	if typeOfWrapped == aggregateType ||
+		typeOfWrapped == intAggregateType ||
 		typeOfWrapped == ifType ||
 		typeOfWrapped == avgType ||
 		typeOfWrapped == constType ||
 		typeOfWrapped == shiftType ||
 		typeOfWrapped == unaryMathType ||
 		typeOfWrapped == percentileType ||
-		typeOfWrapped == percentileOptimizedType {
+		typeOfWrapped == percentileOptimizedType ||
+		typeOfWrapped == aggregateUDFType ||
+		typeOfWrapped == emaType ||
+		typeOfWrapped == histogramType ||
+		typeOfWrapped == histogramBucketType {
 		return nil
 	}
-	if typeOfWrapped == binaryType {
+	if typeOfWrapped == binaryType || typeOfWrapped == scalarUDFType || typeOfWrapped == coalesceType || typeOfWrapped == nullCheckType {
 		return wrapped.Validate()
 	}
 	if e.DeAggregated {
@@ -143,7 +159,12 @@ func combinedSubMerge(left SubMerge, width int, right SubMerge) SubMerge {
 func (e *binaryExpr) Get(b []byte) (float64, bool, []byte) {
 	valueLeft, leftWasSet, remain := e.Left.Get(b)
 	valueRight, rightWasSet, remain := e.Right.Get(remain)
-	if !leftWasSet && !rightWasSet {
+	if !leftWasSet || !rightWasSet {
+		if e.calcNull != nil {
+			value, wasSet := e.calcNull(valueLeft, leftWasSet, valueRight, rightWasSet)
+			return value, wasSet, remain
+		}
+		// Missing values don't count as zeros, so the result is missing too
 		return 0, false, remain
 	}
 	return e.calc(valueLeft, valueRight), true, remain
@@ -177,5 +198,6 @@ func (e *binaryExpr) DecodeMsgpack(dec *msgpack.Decoder) error {
 	e.Left = e2.Left
 	e.Right = e2.Right
 	e.calc = e2.calc
+	e.calcNull = e2.calcNull
 	return nil
 }
@@ -2,12 +2,21 @@ package expr
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/getlantern/goexpr"
 	"github.com/getlantern/msgpack"
 )
 
+const (
+	// OutOfRangeDrop discards values that fall outside of the bounds.
+	OutOfRangeDrop = "drop"
+	// OutOfRangeClamp replaces values that fall outside of the bounds with the
+	// nearest bound.
+	OutOfRangeClamp = "clamp"
+)
+
 // BOUNDED bounds the given expression to min <= val <= max. Any values
 // that fall outside of the bounds will appear as unset (i.e. they are
 // discarded.)
@@ -17,6 +26,29 @@ func BOUNDED(expr interface{}, min float64, max float64) Expr {
 		wrapped: wrapped,
 		min:     min,
 		max:     max,
+		policy:  OutOfRangeDrop,
+	}
+}
+
+// CLAMP bounds the given expression to min <= val <= max. Any values that fall
+// outside of the bounds are replaced with the nearest bound.
+func CLAMP(expr interface{}, min float64, max float64) Expr {
+	e := BOUNDED(expr, min, max).(*bounded)
+	e.policy = OutOfRangeClamp
+	return e
+}
+
+// BoundedWithPolicy bounds the given expression to min <= val <= max, handling
+// values that fall outside of the bounds according to the given policy
+// (OutOfRangeDrop or OutOfRangeClamp).
+func BoundedWithPolicy(expr interface{}, min float64, max float64, policy string) (Expr, error) {
+	switch strings.ToLower(policy) {
+	case OutOfRangeDrop:
+		return BOUNDED(expr, min, max), nil
+	case OutOfRangeClamp:
+		return CLAMP(expr, min, max), nil
+	default:
+		return nil, fmt.Errorf("Unknown out of range policy '%v', use '%v' or '%v'", policy, OutOfRangeDrop, OutOfRangeClamp)
 	}
 }
 
@@ -24,6 +56,7 @@ type bounded struct {
 	wrapped Expr
 	min     float64
 	max     float64
+	policy  string
 }
 
 func (e *bounded) Validate() error {
@@ -40,9 +73,9 @@ func (e *bounded) Shift() time.Duration {
 
 func (e *bounded) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
 	remain, value, updated := e.wrapped.Update(b, params, metadata)
-	if !e.test(value) {
+	value, inBounds := e.apply(value)
+	if !inBounds {
 		updated = false
-		value = 0
 	}
 	return remain, value, updated
 }
@@ -51,6 +84,25 @@ func (e *bounded) test(val float64) bool {
 	return val >= e.min && val <= e.max
 }
 
+func (e *bounded) clamps() bool {
+	return e.policy == OutOfRangeClamp
+}
+
+// apply applies the bounds to the given value, returning the resulting value
+// and whether or not it should be kept.
+func (e *bounded) apply(val float64) (float64, bool) {
+	if e.test(val) {
+		return val, true
+	}
+	if !e.clamps() {
+		return 0, false
+	}
+	if val < e.min {
+		return e.min, true
+	}
+	return e.max, true
+}
+
 func (e *bounded) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
 	return e.wrapped.Merge(b, x, y)
 }
@@ -61,10 +113,11 @@ func (e *bounded) SubMergers(subs []Expr) []SubMerge {
 
 func (e *bounded) Get(b []byte) (float64, bool, []byte) {
 	val, wasSet, remain := e.wrapped.Get(b)
-	if !wasSet || !e.test(val) {
+	if !wasSet {
 		return 0, false, remain
 	}
-	return val, wasSet, remain
+	val, inBounds := e.apply(val)
+	return val, inBounds, remain
 }
 
 func (e *bounded) IsConstant() bool {
@@ -72,10 +125,16 @@ func (e *bounded) IsConstant() bool {
 }
 
 func (e *bounded) DeAggregate() Expr {
+	if e.clamps() {
+		return CLAMP(e.wrapped.DeAggregate(), e.min, e.max)
+	}
 	return BOUNDED(e.wrapped.DeAggregate(), e.min, e.max)
 }
 
 func (e *bounded) String() string {
+	if e.clamps() {
+		return fmt.Sprintf("CLAMP(%v, %v, %v)", e.wrapped, e.min, e.max)
+	}
 	return fmt.Sprintf("BOUNDED(%v, %v, %v)", e.wrapped, e.min, e.max)
 }
 
@@ -83,9 +142,80 @@ var _ msgpack.CustomEncoder = (*bounded)(nil)
 var _ msgpack.CustomDecoder = (*bounded)(nil)
 
 func (e *bounded) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if e.clamps() {
+		// The policy goes first so that older nodes fail to decode expressions
+		// that they don't know how to apply
+		return enc.Encode(e.policy, e.wrapped, e.min, e.max)
+	}
 	return enc.Encode(e.wrapped, e.min, e.max)
 }
 
 func (e *bounded) DecodeMsgpack(dec *msgpack.Decoder) error {
-	return dec.Decode(&e.wrapped, &e.min, &e.max)
+	var first interface{}
+	err := dec.Decode(&first)
+	if err != nil {
+		return err
+	}
+	e.policy = OutOfRangeDrop
+	if policy, ok := first.(string); ok {
+		e.policy = policy
+		return dec.Decode(&e.wrapped, &e.min, &e.max)
+	}
+	wrapped, ok := first.(Expr)
+	if !ok {
+		return fmt.Errorf("Unexpected %v in bounded expression", first)
+	}
+	e.wrapped = wrapped
+	return dec.Decode(&e.min, &e.max)
+}
+
+// HasPointBounds indicates whether the given expression contains BOUNDED or
+// CLAMP expressions that apply to the values of individual points, like those
+// wrapped in aggregates.
+func HasPointBounds(e Expr) bool {
+	if b, ok := e.(*bounded); ok && b.boundsPoints() {
+		return true
+	}
+	for _, sub := range subExprsOf(e) {
+		if HasPointBounds(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// OutOfRange counts the values of the given point that BOUNDED and CLAMP
+// expressions within e clamp or drop, considering only expressions that apply
+// to the values of individual points.
+func OutOfRange(e Expr, params Params, metadata goexpr.Params) (clamped int, dropped int) {
+	switch t := e.(type) {
+	case *bounded:
+		if t.boundsPoints() {
+			_, value, updated := t.wrapped.Update(nil, params, metadata)
+			if updated && !t.test(value) {
+				if t.clamps() {
+					clamped++
+				} else {
+					dropped++
+				}
+			}
+			return
+		}
+	case *ifExpr:
+		if !t.include(params, metadata) {
+			return
+		}
+	}
+	for _, sub := range subExprsOf(e) {
+		c, d := OutOfRange(sub, params, metadata)
+		clamped += c
+		dropped += d
+	}
+	return
+}
+
+// boundsPoints indicates whether this expression bounds the values of
+// individual points rather than aggregated values.
+func (e *bounded) boundsPoints() bool {
+	return e.wrapped.EncodedWidth() == 0 && !e.wrapped.IsConstant()
 }
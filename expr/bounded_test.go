@@ -0,0 +1,63 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/getlantern/goexpr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCLAMP(t *testing.T) {
+	points := []Map{{"a": 4.4}, {"a": 0.01}, {"a": 8.9}, {"b": 1}}
+	for _, tc := range []struct {
+		e        Expr
+		expected float64
+	}{
+		// out of range values are clamped to 0.1 and 8.8
+		{SUM(CLAMP("a", 0.1, 8.8)), 13.3},
+		// out of range values are ignored
+		{SUM(BOUNDED("a", 0.1, 8.8)), 4.4},
+		{AVG(CLAMP("a", 0.1, 8.8)), 4.433333333},
+	} {
+		e := msgpacked(t, tc.e)
+		b := make([]byte, e.EncodedWidth())
+		for _, params := range points {
+			e.Update(b, params, nil)
+		}
+		val, wasSet, _ := e.Get(b)
+		if assert.True(t, wasSet, "%v", e) {
+			AssertFloatEquals(t, tc.expected, val)
+		}
+	}
+}
+
+func TestBoundedWithPolicy(t *testing.T) {
+	e, err := BoundedWithPolicy("a", 0.1, 8.8, OutOfRangeClamp)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "SUM(CLAMP(a, 0.1, 8.8))", msgpacked(t, SUM(e)).String())
+	}
+	e, err = BoundedWithPolicy("a", 0.1, 8.8, OutOfRangeDrop)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "SUM(BOUNDED(a, 0.1, 8.8))", msgpacked(t, SUM(e)).String())
+	}
+	_, err = BoundedWithPolicy("a", 0.1, 8.8, "wrap")
+	assert.Error(t, err)
+}
+
+func TestOutOfRange(t *testing.T) {
+	e := ADD(SUM(CLAMP("a", 0, 10)), IF(goexpr.Param("i"), SUM(BOUNDED("b", 0, 10))))
+	assert.True(t, HasPointBounds(e))
+	assert.False(t, HasPointBounds(BOUNDED(SUM("a"), 0, 10)))
+
+	clamped, dropped := OutOfRange(e, Map{"a": 11, "b": 11}, goexpr.MapParams{"i": true})
+	assert.Equal(t, 1, clamped)
+	assert.Equal(t, 1, dropped)
+
+	clamped, dropped = OutOfRange(e, Map{"a": -1, "b": 11}, goexpr.MapParams{})
+	assert.Equal(t, 1, clamped)
+	assert.Equal(t, 0, dropped, "point excluded by IF shouldn't count")
+
+	clamped, dropped = OutOfRange(e, Map{"a": 5}, goexpr.MapParams{"i": true})
+	assert.Equal(t, 0, clamped)
+	assert.Equal(t, 0, dropped)
+}
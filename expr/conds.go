@@ -25,13 +25,13 @@ func init() {
 		return left > right
 	})
 
-	registerCond("AND", func(left float64, right float64) bool {
+	registerLogical("AND", func(left float64, right float64) bool {
 		return left > 0 && right > 0
-	})
+	}, false)
 
-	registerCond("OR", func(left float64, right float64) bool {
+	registerLogical("OR", func(left float64, right float64) bool {
 		return left > 0 || right > 0
-	})
+	}, true)
 }
 
 type compareFN func(left float64, right float64) bool
@@ -40,11 +40,31 @@ type compareFN func(left float64, right float64) bool
 // the given compareFN and that returns 0 or 1 depending on whether or not the
 // comparison evaluates to true.
 func registerCond(cond string, compare compareFN) {
-	registerBinaryExpr(cond, func(left float64, right float64) float64 {
+	registerBinaryExpr(cond, condCalc(compare))
+}
+
+func condCalc(compare compareFN) calcFN {
+	return func(left float64, right float64) float64 {
 		if compare(left, right) {
 			return 1
 		}
 		return 0
+	}
+}
+
+// registerLogical registers a logical operator like registerCond. When one
+// side has no value, the result is still known if the other side alone decides
+// it, which is the case when that side evaluates to decisive (false for AND,
+// true for OR). Otherwise, the result has no value.
+func registerLogical(op string, compare compareFN, decisive bool) {
+	registerNullableBinaryExpr(op, condCalc(compare), func(left float64, leftWasSet bool, right float64, rightWasSet bool) (float64, bool) {
+		if (leftWasSet && (left > 0) == decisive) || (rightWasSet && (right > 0) == decisive) {
+			if decisive {
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
 	})
 }
 
@@ -0,0 +1,226 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/getlantern/goexpr"
+)
+
+const (
+	emaWidth = 1 + width64bits*3
+
+	emaHasValues  = 1
+	emaHasCarried = 2
+)
+
+var (
+	emaType = reflect.TypeOf((*ema)(nil))
+)
+
+// EMA creates an Expr that obtains its value as the exponential moving average
+// over the given value with the smoothing factor alpha (0 < alpha <= 1). Each
+// period weighs the mean of its own values by alpha and the average as of the
+// preceding period by 1 - alpha, so unlike other aggregates, its value depends
+// on the periods that came before it. Sequences carry that state over from
+// one period to the next (see Carry), and periods without any values of their
+// own just carry over the average.
+func EMA(val interface{}, alpha float64) Expr {
+	return &ema{exprFor(val), alpha}
+}
+
+type ema struct {
+	Wrapped Expr
+	Alpha   float64
+}
+
+// emaState is the state of an EMA for a single period. total and count are
+// the sum and count of the period's own values, carried is the average as of
+// the preceding period.
+type emaState struct {
+	total      float64
+	count      float64
+	carried    float64
+	hasCarried bool
+}
+
+func (e *ema) Validate() error {
+	if e.Alpha <= 0 || e.Alpha > 1 {
+		return fmt.Errorf("EMA smoothing factor must be greater than 0 and at most 1, not %v", e.Alpha)
+	}
+	return validateWrappedInAggregate(e.Wrapped)
+}
+
+func (e *ema) EncodedWidth() int {
+	return emaWidth + e.Wrapped.EncodedWidth()
+}
+
+func (e *ema) Shift() time.Duration {
+	return e.Wrapped.Shift()
+}
+
+func (e *ema) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	state, more := e.load(b)
+	remain, value, updated := e.Wrapped.Update(more, params, metadata)
+	if updated {
+		state.total += value
+		state.count++
+		e.save(b, state)
+	}
+	result, _ := e.calc(state)
+	return remain, result, updated
+}
+
+// Merge combines the values of x and y for the same period. Since they carry
+// over the same preceding periods, it keeps the carried average of x, falling
+// back to that of y.
+func (e *ema) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	stateX, remainX := e.load(x)
+	stateY, remainY := e.load(y)
+	stateX.total += stateY.total
+	stateX.count += stateY.count
+	if !stateX.hasCarried {
+		stateX.carried, stateX.hasCarried = stateY.carried, stateY.hasCarried
+	}
+	return e.save(b, stateX), remainX, remainY
+}
+
+func (e *ema) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, len(subs))
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			result[i] = e.subMerge
+		}
+	}
+	return result
+}
+
+// subMerge prefers the carried average of other, since sequences are sub
+// merged from their most recent period backwards, so that the carried average
+// of a period at a lower resolution is the one from its earliest sub period.
+func (e *ema) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	e.Merge(data, other, data)
+}
+
+func (e *ema) Get(b []byte) (float64, bool, []byte) {
+	state, remain := e.load(b)
+	value, wasSet := e.calc(state)
+	return value, wasSet, remain
+}
+
+// carry sets the carried average in b to the average in prev, the value of the
+// preceding period.
+func (e *ema) carry(b []byte, prev []byte) {
+	state, _ := e.load(b)
+	stateBefore, _ := e.load(prev)
+	state.carried, state.hasCarried = e.calc(stateBefore)
+	e.save(b, state)
+}
+
+func (e *ema) calc(state emaState) (float64, bool) {
+	switch {
+	case state.count > 0 && state.hasCarried:
+		return e.Alpha*state.total/state.count + (1-e.Alpha)*state.carried, true
+	case state.count > 0:
+		return state.total / state.count, true
+	case state.hasCarried:
+		return state.carried, true
+	default:
+		return 0, false
+	}
+}
+
+func (e *ema) load(b []byte) (emaState, []byte) {
+	remain := b[emaWidth:]
+	var state emaState
+	if b[0]&emaHasValues != 0 {
+		state.total = math.Float64frombits(binaryEncoding.Uint64(b[1:]))
+		state.count = math.Float64frombits(binaryEncoding.Uint64(b[width64bits+1:]))
+	}
+	if b[0]&emaHasCarried != 0 {
+		state.carried = math.Float64frombits(binaryEncoding.Uint64(b[width64bits*2+1:]))
+		state.hasCarried = true
+	}
+	return state, remain
+}
+
+func (e *ema) save(b []byte, state emaState) []byte {
+	b[0] = 0
+	if state.count > 0 {
+		b[0] |= emaHasValues
+	}
+	if state.hasCarried {
+		b[0] |= emaHasCarried
+	}
+	binaryEncoding.PutUint64(b[1:], math.Float64bits(state.total))
+	binaryEncoding.PutUint64(b[width64bits+1:], math.Float64bits(state.count))
+	binaryEncoding.PutUint64(b[width64bits*2+1:], math.Float64bits(state.carried))
+	return b[emaWidth:]
+}
+
+func (e *ema) IsConstant() bool {
+	return e.Wrapped.IsConstant()
+}
+
+func (e *ema) DeAggregate() Expr {
+	return e.Wrapped.DeAggregate()
+}
+
+func (e *ema) String() string {
+	return fmt.Sprintf("EMA(%v, %v)", e.Wrapped, e.Alpha)
+}
+
+// Carries indicates whether the given expression contains EMAs, whose values
+// depend on the periods preceding them.
+func Carries(e Expr) bool {
+	if _, ok := e.(*ema); ok {
+		return true
+	}
+	for _, sub := range subExprsOf(e) {
+		if Carries(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// Carry carries the state of any EMAs within the given expression over from
+// prev, the value of the preceding period, into b. Sequences call this from
+// their earliest period to their most recent one whenever they change.
+func Carry(e Expr, b []byte, prev []byte) {
+	carry(e, b, prev)
+}
+
+func carry(e Expr, b []byte, prev []byte) ([]byte, []byte) {
+	switch t := e.(type) {
+	case *ema:
+		t.carry(b, prev)
+	case *ifExpr:
+		return carry(t.Wrapped, b, prev)
+	case *shift:
+		return carry(t.Wrapped, b, prev)
+	case *bounded:
+		return carry(t.wrapped, b, prev)
+	case *unaryMathExpr:
+		return carry(t.Wrapped, b, prev)
+	case *binaryExpr:
+		b, prev = carry(t.Left, b, prev)
+		return carry(t.Right, b, prev)
+	case *scalarUDFExpr:
+		for _, arg := range t.Args {
+			b, prev = carry(arg, b, prev)
+		}
+		return b, prev
+	case *coalesce:
+		for _, wrapped := range t.Exprs {
+			b, prev = carry(wrapped, b, prev)
+		}
+		return b, prev
+	case *nullCheck:
+		return carry(t.Wrapped, b, prev)
+	}
+	width := e.EncodedWidth()
+	return b[width:], prev[width:]
+}
@@ -0,0 +1,66 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEMA(t *testing.T) {
+	e := msgpacked(t, EMA("a", 0.25))
+	assert.Equal(t, "EMA(a, 0.25)", e.String())
+	assert.NoError(t, e.Validate())
+	assert.Error(t, EMA("a", 0).Validate())
+	assert.Error(t, EMA("a", 1.5).Validate())
+	assert.Error(t, EMA(SUM("a"), 0.5).Validate())
+
+	width := e.EncodedWidth()
+	prev := make([]byte, width)
+	b := make([]byte, width)
+	_, wasSet, _ := e.Get(b)
+	assert.False(t, wasSet)
+
+	e.Update(prev, Map{"a": 8}, nil)
+	e.Update(b, Map{"a": 4}, nil)
+	e.Update(b, Map{"b": 100}, nil)
+	e.Update(b, Map{"a": 2}, nil)
+	val, wasSet, _ := e.Get(b)
+	if assert.True(t, wasSet) {
+		AssertFloatEquals(t, 3, val)
+	}
+
+	Carry(e, b, prev)
+	val, _, _ = e.Get(b)
+	AssertFloatEquals(t, 0.25*3+0.75*8, val)
+
+	// periods without values of their own carry over the average
+	empty := make([]byte, width)
+	Carry(e, empty, b)
+	val, wasSet, _ = e.Get(empty)
+	if assert.True(t, wasSet) {
+		AssertFloatEquals(t, 0.25*3+0.75*8, val)
+	}
+
+	// merging keeps the carried average
+	other := make([]byte, width)
+	e.Update(other, Map{"a": 6}, nil)
+	merged := make([]byte, width)
+	e.Merge(merged, other, b)
+	val, _, _ = e.Get(merged)
+	AssertFloatEquals(t, 0.25*4+0.75*8, val)
+}
+
+func TestCarryNested(t *testing.T) {
+	e := msgpacked(t, ADD(SUM("b"), MULT(EMA("a", 0.5), CONST(2))))
+	assert.True(t, Carries(e))
+	assert.False(t, Carries(ADD(SUM("b"), AVG("a"))))
+
+	width := e.EncodedWidth()
+	prev := make([]byte, width)
+	b := make([]byte, width)
+	e.Update(prev, Map{"a": 10, "b": 1}, nil)
+	e.Update(b, Map{"a": 20, "b": 2}, nil)
+	Carry(e, b, prev)
+	val, _, _ := e.Get(b)
+	AssertFloatEquals(t, 2+2*15, val)
+}
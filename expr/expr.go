@@ -47,6 +47,14 @@ func init() {
 	msgpack.RegisterExt(58, &unaryMathExpr{})
 	msgpack.RegisterExt(59, &ptile{})
 	msgpack.RegisterExt(60, &ptileOptimized{})
+	msgpack.RegisterExt(61, &scalarUDFExpr{})
+	msgpack.RegisterExt(62, &aggregateUDFExpr{})
+	msgpack.RegisterExt(63, &ema{})
+	msgpack.RegisterExt(64, &histogram{})
+	msgpack.RegisterExt(65, &histogramBucket{})
+	msgpack.RegisterExt(66, &coalesce{})
+	msgpack.RegisterExt(67, &nullCheck{})
+	msgpack.RegisterExt(68, &intAggregate{})
 }
 
 // Params is an interface for data structures that can contain named values.
@@ -0,0 +1,231 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/goexpr"
+)
+
+var (
+	histogramType       = reflect.TypeOf((*histogram)(nil))
+	histogramBucketType = reflect.TypeOf((*histogramBucket)(nil))
+)
+
+// HISTOGRAM counts the values of the given expression in buckets delimited by
+// the given bounds, which need to be in ascending order. Bucket i counts the
+// values that are at most bounds[i] (and greater than bounds[i-1]), and an
+// additional bucket counts the values that are greater than the last bound.
+// The value of a HISTOGRAM is the total count across all buckets, use
+// HistogramBuckets to get at the counts of the individual buckets.
+func HISTOGRAM(value interface{}, bounds ...float64) Expr {
+	return &histogram{exprFor(value), bounds}
+}
+
+type histogram struct {
+	Wrapped Expr
+	Bounds  []float64
+}
+
+func (e *histogram) Validate() error {
+	if len(e.Bounds) == 0 {
+		return fmt.Errorf("HISTOGRAM requires at least one bucket bound")
+	}
+	for i := 1; i < len(e.Bounds); i++ {
+		if e.Bounds[i] <= e.Bounds[i-1] {
+			return fmt.Errorf("HISTOGRAM bucket bounds must be in ascending order, %v isn't", e.Bounds)
+		}
+	}
+	return validateWrappedInAggregate(e.Wrapped)
+}
+
+func (e *histogram) numBuckets() int {
+	return len(e.Bounds) + 1
+}
+
+func (e *histogram) stateWidth() int {
+	return 1 + e.numBuckets()*width64bits
+}
+
+func (e *histogram) EncodedWidth() int {
+	return e.stateWidth() + e.Wrapped.EncodedWidth()
+}
+
+func (e *histogram) Shift() time.Duration {
+	return e.Wrapped.Shift()
+}
+
+func (e *histogram) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	remain, value, updated := e.Wrapped.Update(b[e.stateWidth():], params, metadata)
+	if updated {
+		b[0] = 1
+		e.add(b, sort.SearchFloat64s(e.Bounds, value), 1)
+	}
+	total, _ := e.total(b)
+	return remain, total, updated
+}
+
+func (e *histogram) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	width := e.stateWidth()
+	if x[0] == 0 && y[0] == 0 {
+		// Nothing to save, just advance
+		return b[width:], x[width:], y[width:]
+	}
+	for i := 0; i < e.numBuckets(); i++ {
+		e.set(b, i, e.count(x, i)+e.count(y, i))
+	}
+	b[0] = 1
+	return b[width:], x[width:], y[width:]
+}
+
+func (e *histogram) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, len(subs))
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			result[i] = e.subMerge
+		}
+	}
+	return result
+}
+
+func (e *histogram) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *histogram) Get(b []byte) (float64, bool, []byte) {
+	total, wasSet := e.total(b)
+	return total, wasSet, b[e.stateWidth():]
+}
+
+func (e *histogram) total(b []byte) (float64, bool) {
+	if b[0] == 0 {
+		return 0, false
+	}
+	total := float64(0)
+	for i := 0; i < e.numBuckets(); i++ {
+		total += e.count(b, i)
+	}
+	return total, true
+}
+
+func (e *histogram) count(b []byte, bucket int) float64 {
+	return math.Float64frombits(binaryEncoding.Uint64(b[1+bucket*width64bits:]))
+}
+
+func (e *histogram) set(b []byte, bucket int, count float64) {
+	binaryEncoding.PutUint64(b[1+bucket*width64bits:], math.Float64bits(count))
+}
+
+func (e *histogram) add(b []byte, bucket int, count float64) {
+	e.set(b, bucket, e.count(b, bucket)+count)
+}
+
+func (e *histogram) IsConstant() bool {
+	return e.Wrapped.IsConstant()
+}
+
+func (e *histogram) DeAggregate() Expr {
+	return e.Wrapped.DeAggregate()
+}
+
+func (e *histogram) String() string {
+	bounds := make([]string, 0, len(e.Bounds))
+	for _, bound := range e.Bounds {
+		bounds = append(bounds, fmt.Sprint(bound))
+	}
+	return fmt.Sprintf("HISTOGRAM(%v, %v)", e.Wrapped, strings.Join(bounds, ", "))
+}
+
+// IsHistogram indicates whether the given expression is a HISTOGRAM.
+func IsHistogram(e Expr) bool {
+	_, ok := e.(*histogram)
+	return ok
+}
+
+// HistogramBuckets returns expressions for the counts of each of the buckets
+// of the given HISTOGRAM, along with labels for the buckets like le_100 (for
+// values at most 100) and gt_1000 (for values greater than the last bound).
+// The bucket expressions reuse the storage layout of the HISTOGRAM, so they can
+// be used in queries of tables that store the HISTOGRAM.
+func HistogramBuckets(e Expr) (labels []string, buckets []Expr, err error) {
+	h, ok := e.(*histogram)
+	if !ok {
+		return nil, nil, fmt.Errorf("%v is not a HISTOGRAM", e)
+	}
+	for i, bound := range h.Bounds {
+		labels = append(labels, fmt.Sprintf("le_%v", bound))
+		buckets = append(buckets, &histogramBucket{h, i})
+	}
+	labels = append(labels, fmt.Sprintf("gt_%v", h.Bounds[len(h.Bounds)-1]))
+	buckets = append(buckets, &histogramBucket{h, len(h.Bounds)})
+	return labels, buckets, nil
+}
+
+// histogramBucket is the count of a single bucket of a histogram.
+type histogramBucket struct {
+	Histogram Expr
+	Bucket    int
+}
+
+func (e *histogramBucket) histogram() *histogram {
+	return e.Histogram.(*histogram)
+}
+
+func (e *histogramBucket) Validate() error {
+	if e.Bucket < 0 || e.Bucket >= e.histogram().numBuckets() {
+		return fmt.Errorf("%v has no bucket %d", e.Histogram, e.Bucket)
+	}
+	return e.Histogram.Validate()
+}
+
+func (e *histogramBucket) EncodedWidth() int {
+	return e.Histogram.EncodedWidth()
+}
+
+func (e *histogramBucket) Shift() time.Duration {
+	return e.Histogram.Shift()
+}
+
+func (e *histogramBucket) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	remain, _, updated := e.Histogram.Update(b, params, metadata)
+	return remain, e.histogram().count(b, e.Bucket), updated
+}
+
+func (e *histogramBucket) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	return e.Histogram.Merge(b, x, y)
+}
+
+func (e *histogramBucket) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, len(subs))
+	for i, sub := range subs {
+		if e.String() == sub.String() || e.Histogram.String() == sub.String() {
+			result[i] = e.histogram().subMerge
+		}
+	}
+	return result
+}
+
+func (e *histogramBucket) Get(b []byte) (float64, bool, []byte) {
+	h := e.histogram()
+	remain := b[h.stateWidth():]
+	if b[0] == 0 {
+		return 0, false, remain
+	}
+	return h.count(b, e.Bucket), true, remain
+}
+
+func (e *histogramBucket) IsConstant() bool {
+	return e.Histogram.IsConstant()
+}
+
+func (e *histogramBucket) DeAggregate() Expr {
+	return e.Histogram.DeAggregate()
+}
+
+func (e *histogramBucket) String() string {
+	return fmt.Sprintf("HISTOGRAM_BUCKET(%v, %d)", e.Histogram, e.Bucket)
+}
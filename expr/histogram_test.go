@@ -0,0 +1,66 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	e := msgpacked(t, HISTOGRAM("a", 10, 100, 1000))
+	assert.Equal(t, "HISTOGRAM(a, 10, 100, 1000)", e.String())
+	assert.NoError(t, e.Validate())
+	assert.Error(t, HISTOGRAM("a").Validate())
+	assert.Error(t, HISTOGRAM("a", 100, 10).Validate())
+	assert.True(t, IsHistogram(e))
+	assert.True(t, IsAdditive(e))
+
+	labels, buckets, err := HistogramBuckets(e)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"le_10", "le_100", "le_1000", "gt_1000"}, labels)
+	_, _, err = HistogramBuckets(SUM("a"))
+	assert.Error(t, err)
+
+	width := e.EncodedWidth()
+	x := make([]byte, width)
+	y := make([]byte, width)
+	_, wasSet, _ := e.Get(x)
+	assert.False(t, wasSet)
+	for _, value := range []float64{5, 10, 50, 5000} {
+		e.Update(x, Map{"a": value}, nil)
+	}
+	e.Update(x, Map{"b": 1}, nil)
+	for _, value := range []float64{500, 1000, 7} {
+		e.Update(y, Map{"a": value}, nil)
+	}
+	total, wasSet, _ := e.Get(x)
+	if assert.True(t, wasSet) {
+		assert.EqualValues(t, 4, total)
+	}
+
+	merged := make([]byte, width)
+	e.Merge(merged, x, y)
+	total, _, _ = e.Get(merged)
+	assert.EqualValues(t, 7, total)
+	var counts []float64
+	for _, bucket := range buckets {
+		bucket = msgpacked(t, bucket)
+		assert.Equal(t, width, bucket.EncodedWidth())
+		count, wasSet, _ := bucket.Get(merged)
+		assert.True(t, wasSet)
+		counts = append(counts, count)
+	}
+	assert.Equal(t, []float64{3, 1, 2, 1}, counts)
+
+	// buckets sub merge from the histogram that they're based on
+	sms := buckets[1].SubMergers([]Expr{SUM("a"), e})
+	if assert.Len(t, sms, 2) && assert.NotNil(t, sms[1]) {
+		assert.Nil(t, sms[0])
+		data := make([]byte, width)
+		sms[1](data, merged, 0, nil)
+		count, _, _ := buckets[1].Get(data)
+		assert.EqualValues(t, 1, count)
+	}
+}
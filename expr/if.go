@@ -18,6 +18,42 @@ func IF(cond goexpr.Expr, wrapped interface{}) Expr {
 	return &ifExpr{cond, _wrapped, _wrapped.EncodedWidth()}
 }
 
+// SUMIF creates an Expr that sums the given value over points for which cond
+// is true. cond can refer to both dimensions and fields.
+func SUMIF(value interface{}, cond goexpr.Expr) Expr {
+	return IF(cond, SUM(value))
+}
+
+// COUNTIF creates an Expr that counts the values of the given expression or
+// field for points for which cond is true. cond can refer to both dimensions
+// and fields.
+func COUNTIF(value interface{}, cond goexpr.Expr) Expr {
+	return IF(cond, COUNT(value))
+}
+
+// AVGIF creates an Expr that averages the given value over points for which
+// cond is true. cond can refer to both dimensions and fields.
+func AVGIF(value interface{}, cond goexpr.Expr) Expr {
+	return IF(cond, AVG(value))
+}
+
+// condParams makes both dimensions and field values available to conditions.
+// Dimensions take precedence over fields of the same name.
+type condParams struct {
+	params   Params
+	metadata goexpr.Params
+}
+
+func (p *condParams) Get(name string) interface{} {
+	if val := p.metadata.Get(name); val != nil {
+		return val
+	}
+	if val, found := p.params.Get(name); found {
+		return val
+	}
+	return nil
+}
+
 func (e *ifExpr) Validate() error {
 	return e.Wrapped.Validate()
 }
@@ -31,7 +67,7 @@ func (e *ifExpr) Shift() time.Duration {
 }
 
 func (e *ifExpr) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
-	if e.include(metadata) {
+	if e.include(params, metadata) {
 		return e.Wrapped.Update(b, params, metadata)
 	}
 	value, _, remain := e.Wrapped.Get(b)
@@ -68,7 +104,7 @@ func (e *ifExpr) condSubMerger(wrapped SubMerge) SubMerge {
 		return nil
 	}
 	return func(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
-		if e.include(metadata) {
+		if e.include(nil, metadata) {
 			wrapped(data, other, otherRes, metadata)
 		}
 	}
@@ -78,11 +114,19 @@ func (e *ifExpr) subMerge(data []byte, other []byte, otherRes time.Duration, met
 	e.Wrapped.Merge(data, data, other)
 }
 
-func (e *ifExpr) include(metadata goexpr.Params) bool {
+// include evaluates the condition against the dimensions in metadata and, when
+// updating from a point, against the field values in params. When sub merging
+// there are no params, so conditions on fields only take effect at the time
+// that points are inserted. Without metadata, everything is included.
+func (e *ifExpr) include(params Params, metadata goexpr.Params) bool {
 	if metadata == nil || e.Cond == nil {
 		return true
 	}
-	val := e.Cond.Eval(metadata)
+	var cp goexpr.Params = metadata
+	if params != nil {
+		cp = &condParams{params, metadata}
+	}
+	val := e.Cond.Eval(cp)
 	if val == nil {
 		return false
 	}
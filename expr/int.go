@@ -0,0 +1,174 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/msgpack"
+)
+
+var (
+	intAggregates = make(map[string]func(wrapped interface{}) *intAggregate)
+
+	intAggregateType = reflect.TypeOf((*intAggregate)(nil))
+)
+
+func init() {
+	registerIntAggregate("ISUM", func(current int64, next float64) int64 {
+		return current + int64(math.Round(next))
+	}, func(current int64, next int64) int64 {
+		return current + next
+	})
+
+	registerIntAggregate("ICOUNT", func(current int64, next float64) int64 {
+		return current + 1
+	}, func(current int64, next int64) int64 {
+		return current + next
+	})
+}
+
+// ISUM is like SUM but keeps its sum as an int64, rounding values to the
+// nearest integer, so that it stays exact beyond the 2^53 up to which float64
+// can represent all integers. Use GetInt to get at the exact value.
+func ISUM(expr interface{}) Expr {
+	return intAggregateFor("ISUM", expr)
+}
+
+// ICOUNT is like COUNT but keeps its count as an int64.
+func ICOUNT(expr interface{}) Expr {
+	return intAggregateFor("ICOUNT", expr)
+}
+
+func intAggregateFor(name string, wrapped interface{}) *intAggregate {
+	ctor, found := intAggregates[name]
+	if !found {
+		return nil
+	}
+	return ctor(wrapped)
+}
+
+func registerIntAggregate(name string, update intUpdateFN, merge intMergeFN) {
+	intAggregates[name] = func(wrapped interface{}) *intAggregate {
+		return &intAggregate{
+			Name:    name,
+			Wrapped: exprFor(wrapped),
+			update:  update,
+			merge:   merge,
+		}
+	}
+}
+
+type intUpdateFN func(current int64, next float64) int64
+
+type intMergeFN func(current int64, next int64) int64
+
+type intAggregate struct {
+	Name    string
+	Wrapped Expr
+	update  intUpdateFN
+	merge   intMergeFN
+}
+
+func (e *intAggregate) Validate() error {
+	return validateWrappedInAggregate(e.Wrapped)
+}
+
+func (e *intAggregate) EncodedWidth() int {
+	return 1 + width64bits + e.Wrapped.EncodedWidth()
+}
+
+func (e *intAggregate) Shift() time.Duration {
+	return e.Wrapped.Shift()
+}
+
+func (e *intAggregate) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	value, _, more := e.load(b)
+	remain, wrappedValue, updated := e.Wrapped.Update(more, params, metadata)
+	if updated {
+		value = e.update(value, wrappedValue)
+		e.save(b, value)
+	}
+	return remain, float64(value), updated
+}
+
+func (e *intAggregate) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	valueX, xWasSet, remainX := e.load(x)
+	valueY, yWasSet, remainY := e.load(y)
+	switch {
+	case xWasSet && yWasSet:
+		b = e.save(b, e.merge(valueX, valueY))
+	case xWasSet:
+		b = e.save(b, valueX)
+	case yWasSet:
+		b = e.save(b, valueY)
+	default:
+		// Nothing to save, just advance
+		b = b[width64bits+1:]
+	}
+	return b, remainX, remainY
+}
+
+func (e *intAggregate) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, len(subs))
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			result[i] = e.subMerge
+		}
+	}
+	return result
+}
+
+func (e *intAggregate) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *intAggregate) Get(b []byte) (float64, bool, []byte) {
+	value, wasSet, remain := e.load(b)
+	return float64(value), wasSet, remain
+}
+
+func (e *intAggregate) load(b []byte) (int64, bool, []byte) {
+	remain := b[width64bits+1:]
+	if b[0] != 1 {
+		return 0, false, remain
+	}
+	return int64(binaryEncoding.Uint64(b[1:])), true, remain
+}
+
+func (e *intAggregate) save(b []byte, value int64) []byte {
+	b[0] = 1
+	binaryEncoding.PutUint64(b[1:], uint64(value))
+	return b[width64bits+1:]
+}
+
+func (e *intAggregate) IsConstant() bool {
+	return e.Wrapped.IsConstant()
+}
+
+func (e *intAggregate) DeAggregate() Expr {
+	return e.Wrapped.DeAggregate()
+}
+
+func (e *intAggregate) String() string {
+	return fmt.Sprintf("%v(%v)", e.Name, e.Wrapped)
+}
+
+func (e *intAggregate) DecodeMsgpack(dec *msgpack.Decoder) error {
+	m := make(map[string]interface{})
+	err := dec.Decode(&m)
+	if err != nil {
+		return err
+	}
+	e2 := intAggregateFor(m["Name"].(string), m["Wrapped"].(Expr))
+	if e2 == nil {
+		return fmt.Errorf("Unknown aggregate %v", m["Name"])
+	}
+	e.Name = e2.Name
+	e.Wrapped = e2.Wrapped
+	e.update = e2.update
+	e.merge = e2.merge
+	return nil
+}
@@ -0,0 +1,222 @@
+package expr
+
+// AggregateOf returns the name of the outermost aggregate that computes the
+// given expression (SUM, COUNT, ISUM, ICOUNT, MIN, MAX, AVG, EMA, PERCENTILE,
+// HISTOGRAM or a user-defined aggregate), or "" if the expression is calculated
+// from other aggregates or isn't aggregated at all.
+// Wrappers that don't change how the value is aggregated, like IF and SHIFT,
+// are looked through.
+func AggregateOf(e Expr) string {
+	switch t := e.(type) {
+	case *aggregate:
+		return t.Name
+	case *intAggregate:
+		return t.Name
+	case *avg:
+		return "AVG"
+	case *ema:
+		return "EMA"
+	case *histogram, *histogramBucket:
+		return "HISTOGRAM"
+	case *ptile, *ptileOptimized:
+		return "PERCENTILE"
+	case *aggregateUDFExpr:
+		return t.Name
+	case *ifExpr:
+		return AggregateOf(t.Wrapped)
+	case *shift:
+		return AggregateOf(t.Wrapped)
+	default:
+		return ""
+	}
+}
+
+// IsAdditive indicates whether values of the given expression for different
+// groups can be summed to obtain the value for the combined group. That's the
+// case for sums, counts and histograms and for sums, differences and constant
+// multiples thereof, but not for things like averages, minimums or percentiles.
+func IsAdditive(e Expr) bool {
+	switch t := e.(type) {
+	case *aggregate:
+		return t.Name == "SUM" || t.Name == "COUNT"
+	case *intAggregate:
+		return true
+	case *histogram, *histogramBucket:
+		return true
+	case *ifExpr:
+		return IsAdditive(t.Wrapped)
+	case *shift:
+		return IsAdditive(t.Wrapped)
+	case *binaryExpr:
+		switch t.Op {
+		case "+", "-":
+			return IsAdditive(t.Left) && IsAdditive(t.Right)
+		case "*":
+			return (IsAdditive(t.Left) && t.Right.IsConstant()) || (t.Left.IsConstant() && IsAdditive(t.Right))
+		case "/":
+			return IsAdditive(t.Left) && t.Right.IsConstant()
+		}
+	}
+	return false
+}
+
+// FieldsOf returns the names of the fields that the given expression reads, in
+// the order in which they first appear.
+func FieldsOf(e Expr) []string {
+	var result []string
+	seen := make(map[string]bool)
+	var visit func(e Expr)
+	visit = func(e Expr) {
+		switch t := e.(type) {
+		case *field:
+			if !seen[t.Name] {
+				seen[t.Name] = true
+				result = append(result, t.Name)
+			}
+		case *aggregate:
+			visit(t.Wrapped)
+		case *intAggregate:
+			visit(t.Wrapped)
+		case *avg:
+			visit(t.Value)
+		case *ema:
+			visit(t.Wrapped)
+		case *histogram:
+			visit(t.Wrapped)
+		case *histogramBucket:
+			visit(t.Histogram)
+		case *ptile:
+			visit(t.Value)
+		case *ptileOptimized:
+			visit(t.Wrapped)
+		case *ifExpr:
+			visit(t.Wrapped)
+		case *shift:
+			visit(t.Wrapped)
+		case *bounded:
+			visit(t.wrapped)
+		case *unaryMathExpr:
+			visit(t.Wrapped)
+		case *binaryExpr:
+			visit(t.Left)
+			visit(t.Right)
+		case *scalarUDFExpr:
+			for _, arg := range t.Args {
+				visit(arg)
+			}
+		case *coalesce:
+			for _, wrapped := range t.Exprs {
+				visit(wrapped)
+			}
+		case *nullCheck:
+			visit(t.Wrapped)
+		case *aggregateUDFExpr:
+			for _, arg := range t.Args {
+				visit(arg)
+			}
+		}
+	}
+	visit(e)
+	return result
+}
+
+// UnitOf determines the unit of the given expression based on the units of the
+// fields that it reads, as returned by fieldUnit. It returns "" if the unit
+// can't be determined, for example because the expression counts points or
+// divides one field by another.
+func UnitOf(e Expr, fieldUnit func(field string) string) string {
+	switch t := e.(type) {
+	case *field:
+		return fieldUnit(t.Name)
+	case *aggregate:
+		if t.Name == "COUNT" {
+			return ""
+		}
+		return UnitOf(t.Wrapped, fieldUnit)
+	case *intAggregate:
+		if t.Name == "ICOUNT" {
+			return ""
+		}
+		return UnitOf(t.Wrapped, fieldUnit)
+	case *avg:
+		return UnitOf(t.Value, fieldUnit)
+	case *ema:
+		return UnitOf(t.Wrapped, fieldUnit)
+	case *ptile:
+		return UnitOf(t.Value, fieldUnit)
+	case *ptileOptimized:
+		return UnitOf(t.Wrapped, fieldUnit)
+	case *ifExpr:
+		return UnitOf(t.Wrapped, fieldUnit)
+	case *shift:
+		return UnitOf(t.Wrapped, fieldUnit)
+	case *bounded:
+		return UnitOf(t.wrapped, fieldUnit)
+	case *binaryExpr:
+		switch t.Op {
+		case "+", "-":
+			left := UnitOf(t.Left, fieldUnit)
+			if t.Right.IsConstant() {
+				return left
+			}
+			right := UnitOf(t.Right, fieldUnit)
+			if t.Left.IsConstant() || left == right {
+				return right
+			}
+		case "*":
+			if t.Right.IsConstant() {
+				return UnitOf(t.Left, fieldUnit)
+			}
+			if t.Left.IsConstant() {
+				return UnitOf(t.Right, fieldUnit)
+			}
+		case "/":
+			if t.Right.IsConstant() {
+				return UnitOf(t.Left, fieldUnit)
+			}
+		}
+	}
+	return ""
+}
+
+// subExprsOf returns the expressions directly wrapped by the given expression.
+func subExprsOf(e Expr) []Expr {
+	switch t := e.(type) {
+	case *aggregate:
+		return []Expr{t.Wrapped}
+	case *intAggregate:
+		return []Expr{t.Wrapped}
+	case *avg:
+		return []Expr{t.Value, t.Weight}
+	case *ema:
+		return []Expr{t.Wrapped}
+	case *histogram:
+		return []Expr{t.Wrapped}
+	case *histogramBucket:
+		return []Expr{t.Histogram}
+	case *ptile:
+		return []Expr{t.Value}
+	case *ptileOptimized:
+		return []Expr{t.Wrapped}
+	case *ifExpr:
+		return []Expr{t.Wrapped}
+	case *shift:
+		return []Expr{t.Wrapped}
+	case *bounded:
+		return []Expr{t.wrapped}
+	case *unaryMathExpr:
+		return []Expr{t.Wrapped}
+	case *binaryExpr:
+		return []Expr{t.Left, t.Right}
+	case *scalarUDFExpr:
+		return t.Args
+	case *coalesce:
+		return t.Exprs
+	case *nullCheck:
+		return []Expr{t.Wrapped}
+	case *aggregateUDFExpr:
+		return t.Args
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,45 @@
+package expr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetaData(t *testing.T) {
+	units := map[string]string{"latency": "ms", "bytes": "B", "requests": "req"}
+	fieldUnit := func(field string) string {
+		return units[field]
+	}
+	p := PERCENTILE(FIELD("latency"), 99, 0, 1000, 1)
+
+	cases := []struct {
+		e         Expr
+		aggregate string
+		additive  bool
+		unit      string
+		fields    []string
+	}{
+		{SUM("bytes"), "SUM", true, "B", []string{"bytes"}},
+		{COUNT("bytes"), "COUNT", true, "", []string{"bytes"}},
+		{AVG("latency"), "AVG", false, "ms", []string{"latency"}},
+		{MAX("latency"), "MAX", false, "ms", []string{"latency"}},
+		{p, "PERCENTILE", false, "ms", []string{"latency"}},
+		{PERCENTILEOPT(p, 50), "PERCENTILE", false, "ms", []string{"latency"}},
+		{SHIFT(SUM("bytes"), time.Hour), "SUM", true, "B", []string{"bytes"}},
+		{ADD(SUM("bytes"), SUM("bytes")), "", true, "B", []string{"bytes"}},
+		{ADD(SUM("bytes"), SUM("requests")), "", true, "", []string{"bytes", "requests"}},
+		{MULT(SUM("bytes"), 8), "", true, "B", []string{"bytes"}},
+		{MULT(SUM("bytes"), SUM("requests")), "", false, "", []string{"bytes", "requests"}},
+		{DIV(SUM("bytes"), SUM("requests")), "", false, "", []string{"bytes", "requests"}},
+		{DIV(SUM("bytes"), 1024), "", true, "B", []string{"bytes"}},
+		{ADD(AVG("latency"), 1), "", false, "ms", []string{"latency"}},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.aggregate, AggregateOf(c.e), "aggregate of %v", c.e)
+		assert.Equal(t, c.additive, IsAdditive(c.e), "additivity of %v", c.e)
+		assert.Equal(t, c.unit, UnitOf(c.e, fieldUnit), "unit of %v", c.e)
+		assert.Equal(t, c.fields, FieldsOf(c.e), "fields of %v", c.e)
+	}
+}
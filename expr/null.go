@@ -0,0 +1,245 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/getlantern/goexpr"
+)
+
+var (
+	coalesceType  = reflect.TypeOf((*coalesce)(nil))
+	nullCheckType = reflect.TypeOf((*nullCheck)(nil))
+)
+
+// COALESCE takes the value of the first of the given expressions that has a
+// value, which makes it possible to substitute a default for missing values,
+// e.g. COALESCE(SUM("b"), 0). It only has no value if none of the expressions
+// have one.
+func COALESCE(exprs ...interface{}) Expr {
+	wrapped := make([]Expr, 0, len(exprs))
+	for _, e := range exprs {
+		wrapped = append(wrapped, exprFor(e))
+	}
+	return &coalesce{Exprs: wrapped}
+}
+
+type coalesce struct {
+	Exprs        []Expr
+	DeAggregated bool
+}
+
+func (e *coalesce) Validate() error {
+	if len(e.Exprs) == 0 {
+		return fmt.Errorf("COALESCE requires at least one expression")
+	}
+	for _, wrapped := range e.Exprs {
+		if err := validateWrappedInNull("COALESCE", wrapped, e.DeAggregated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *coalesce) EncodedWidth() int {
+	width := 0
+	for _, wrapped := range e.Exprs {
+		width += wrapped.EncodedWidth()
+	}
+	return width
+}
+
+func (e *coalesce) Shift() time.Duration {
+	var result time.Duration
+	for i, wrapped := range e.Exprs {
+		if shift := wrapped.Shift(); i == 0 || shift < result {
+			result = shift
+		}
+	}
+	return result
+}
+
+func (e *coalesce) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	result := float64(0)
+	anyUpdated := false
+	remain := b
+	for _, wrapped := range e.Exprs {
+		var value float64
+		var updated bool
+		remain, value, updated = wrapped.Update(remain, params, metadata)
+		if updated && !anyUpdated {
+			result = value
+		}
+		anyUpdated = anyUpdated || updated
+	}
+	return remain, result, anyUpdated
+}
+
+func (e *coalesce) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	for _, wrapped := range e.Exprs {
+		b, x, y = wrapped.Merge(b, x, y)
+	}
+	return b, x, y
+}
+
+func (e *coalesce) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, len(subs))
+	// See if any of the subexpressions match top level and if so, ignore others
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			result[i] = e.subMerge
+			return result
+		}
+	}
+
+	// None of sub expressions match top level, build combined ones
+	width := 0
+	for _, wrapped := range e.Exprs {
+		wrappedSubMergers := wrapped.SubMergers(subs)
+		for i := range subs {
+			result[i] = combinedSubMerge(result[i], width, wrappedSubMergers[i])
+		}
+		width += wrapped.EncodedWidth()
+	}
+	return result
+}
+
+func (e *coalesce) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *coalesce) Get(b []byte) (float64, bool, []byte) {
+	result := float64(0)
+	found := false
+	remain := b
+	for _, wrapped := range e.Exprs {
+		// Keep reading in order to consume the remaining expressions
+		value, wasSet, more := wrapped.Get(remain)
+		remain = more
+		if wasSet && !found {
+			result, found = value, true
+		}
+	}
+	return result, found, remain
+}
+
+func (e *coalesce) IsConstant() bool {
+	for _, wrapped := range e.Exprs {
+		if !wrapped.IsConstant() {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *coalesce) DeAggregate() Expr {
+	exprs := make([]Expr, 0, len(e.Exprs))
+	for _, wrapped := range e.Exprs {
+		exprs = append(exprs, wrapped.DeAggregate())
+	}
+	return &coalesce{Exprs: exprs, DeAggregated: true}
+}
+
+func (e *coalesce) String() string {
+	return udfString("COALESCE", e.Exprs)
+}
+
+// ISNULL evaluates to 1 if the given expression has no value and to 0 if it
+// does. Unlike comparisons, which have no value if either side has none, it
+// always has a value.
+func ISNULL(wrapped interface{}) Expr {
+	return &nullCheck{Wrapped: exprFor(wrapped)}
+}
+
+// ISNOTNULL evaluates to 1 if the given expression has a value and to 0 if it
+// doesn't.
+func ISNOTNULL(wrapped interface{}) Expr {
+	return &nullCheck{Wrapped: exprFor(wrapped), Not: true}
+}
+
+type nullCheck struct {
+	Wrapped      Expr
+	Not          bool
+	DeAggregated bool
+}
+
+func (e *nullCheck) Validate() error {
+	return validateWrappedInNull(e.name(), e.Wrapped, e.DeAggregated)
+}
+
+func (e *nullCheck) EncodedWidth() int {
+	return e.Wrapped.EncodedWidth()
+}
+
+func (e *nullCheck) Shift() time.Duration {
+	return e.Wrapped.Shift()
+}
+
+func (e *nullCheck) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	remain, _, updated := e.Wrapped.Update(b, params, metadata)
+	return remain, e.check(updated), updated
+}
+
+func (e *nullCheck) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	return e.Wrapped.Merge(b, x, y)
+}
+
+func (e *nullCheck) SubMergers(subs []Expr) []SubMerge {
+	result := e.Wrapped.SubMergers(subs)
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			result[i] = e.subMerge
+		}
+	}
+	return result
+}
+
+func (e *nullCheck) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *nullCheck) Get(b []byte) (float64, bool, []byte) {
+	_, wasSet, remain := e.Wrapped.Get(b)
+	return e.check(wasSet), true, remain
+}
+
+func (e *nullCheck) check(wasSet bool) float64 {
+	if wasSet == e.Not {
+		return 1
+	}
+	return 0
+}
+
+func (e *nullCheck) IsConstant() bool {
+	return e.Wrapped.IsConstant()
+}
+
+func (e *nullCheck) DeAggregate() Expr {
+	return &nullCheck{Wrapped: e.Wrapped.DeAggregate(), Not: e.Not, DeAggregated: true}
+}
+
+func (e *nullCheck) name() string {
+	if e.Not {
+		return "ISNOTNULL"
+	}
+	return "ISNULL"
+}
+
+func (e *nullCheck) String() string {
+	return fmt.Sprintf("%v(%v)", e.name(), e.Wrapped)
+}
+
+// validateWrappedInNull makes sure that COALESCE and null checks only wrap
+// aggregates, constants or calculations on those, since fields by themselves
+// don't hold on to their values.
+func validateWrappedInNull(name string, wrapped Expr, deAggregated bool) error {
+	if wrapped == nil {
+		return fmt.Errorf("%v cannot wrap nil expression", name)
+	}
+	typeOfWrapped := reflect.TypeOf(wrapped)
+	if !deAggregated && (typeOfWrapped == fieldType || typeOfWrapped == boundedType) {
+		return fmt.Errorf("%v must wrap aggregates or constants, not %v", name, wrapped)
+	}
+	return wrapped.Validate()
+}
@@ -0,0 +1,111 @@
+package expr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNullArithmetic(t *testing.T) {
+	e := msgpacked(t, DIV(SUM("a"), SUM("b")))
+	b := make([]byte, e.EncodedWidth())
+	e.Update(b, Map{"b": 4}, nil)
+	_, wasSet, _ := e.Get(b)
+	assert.False(t, wasSet, "Dividing a missing value should yield a missing value")
+
+	e.Update(b, Map{"a": 0}, nil)
+	val, wasSet, _ := e.Get(b)
+	assert.True(t, wasSet, "Dividing a true zero should yield a value")
+	AssertFloatEquals(t, 0, val)
+
+	plusOne := msgpacked(t, ADD(SUM("b"), CONST(1)))
+	b = make([]byte, plusOne.EncodedWidth())
+	_, wasSet, _ = plusOne.Get(b)
+	assert.False(t, wasSet, "Constants shouldn't make up for missing values")
+}
+
+func TestNullLogic(t *testing.T) {
+	check := func(e Expr, expected float64, expectedSet bool) {
+		e = msgpacked(t, e)
+		b := make([]byte, e.EncodedWidth())
+		e.Update(b, Map{"a": 1}, nil)
+		val, wasSet, _ := e.Get(b)
+		if assert.Equal(t, expectedSet, wasSet, e.String()) && expectedSet {
+			AssertFloatEquals(t, expected, val)
+		}
+	}
+
+	check(OR(GT(SUM("a"), 0), GT(SUM("b"), 0)), 1, true)
+	check(OR(LT(SUM("a"), 0), GT(SUM("b"), 0)), 0, false)
+	check(AND(LT(SUM("a"), 0), GT(SUM("b"), 0)), 0, true)
+	check(AND(GT(SUM("a"), 0), GT(SUM("b"), 0)), 0, false)
+}
+
+func TestCOALESCE(t *testing.T) {
+	e := msgpacked(t, COALESCE(SUM("a"), SUM("b"), 5))
+	assert.Equal(t, "COALESCE(SUM(a), SUM(b), 5.000000)", e.String())
+	assert.NoError(t, e.Validate())
+
+	check := func(params Map, expected float64) {
+		b := make([]byte, e.EncodedWidth())
+		e.Update(b, params, nil)
+		val, wasSet, remain := e.Get(b)
+		assert.True(t, wasSet)
+		assert.Len(t, remain, 0)
+		AssertFloatEquals(t, expected, val)
+	}
+	check(Map{"a": 1, "b": 2}, 1)
+	check(Map{"b": 2}, 2)
+	check(Map{}, 5)
+
+	noDefault := msgpacked(t, COALESCE(SUM("a"), SUM("b")))
+	b := make([]byte, noDefault.EncodedWidth())
+	_, wasSet, _ := noDefault.Get(b)
+	assert.False(t, wasSet)
+
+	assert.Error(t, COALESCE("a", 0).Validate(), "COALESCE shouldn't wrap plain fields")
+}
+
+func TestNullCheck(t *testing.T) {
+	isNull := msgpacked(t, ISNULL(SUM("a")))
+	isNotNull := msgpacked(t, ISNOTNULL(SUM("a")))
+	assert.Equal(t, "ISNULL(SUM(a))", isNull.String())
+	assert.Equal(t, "ISNOTNULL(SUM(a))", isNotNull.String())
+
+	b := make([]byte, isNull.EncodedWidth())
+	val, wasSet, _ := isNull.Get(b)
+	assert.True(t, wasSet)
+	AssertFloatEquals(t, 1, val)
+	val, _, _ = isNotNull.Get(b)
+	AssertFloatEquals(t, 0, val)
+
+	isNull.Update(b, Map{"a": 0}, nil)
+	val, _, _ = isNull.Get(b)
+	AssertFloatEquals(t, 0, val)
+	val, _, _ = isNotNull.Get(b)
+	AssertFloatEquals(t, 1, val)
+}
+
+func TestCOALESCESubMerge(t *testing.T) {
+	res := time.Hour
+	fa := msgpacked(t, SUM("a"))
+	fb := msgpacked(t, SUM("b"))
+	e := msgpacked(t, COALESCE(SUM("a"), SUM("b")))
+
+	a := make([]byte, fa.EncodedWidth())
+	fa.Update(a, Map{"a": 3}, nil)
+	bb := make([]byte, fb.EncodedWidth())
+	fb.Update(bb, Map{"b": 4}, nil)
+
+	b := make([]byte, e.EncodedWidth())
+	subs := e.SubMergers([]Expr{fa, fb})
+	subs[1](b, bb, res, nil)
+	val, wasSet, _ := e.Get(b)
+	assert.True(t, wasSet)
+	AssertFloatEquals(t, 4, val)
+
+	subs[0](b, a, res, nil)
+	val, _, _ = e.Get(b)
+	AssertFloatEquals(t, 3, val)
+}
@@ -47,11 +47,12 @@ func TestShiftSubMerge(t *testing.T) {
 		}
 	}
 	for i := 0; i < periods; i++ {
-		expected := 3
+		actual, wasSet, _ := fs.Get(s[i*fs.EncodedWidth():])
 		if i >= 7 {
-			expected = -1 * i
+			// Shifted value is missing, so the difference is missing too
+			assert.False(t, wasSet, "Value at position %d should be missing", i)
+			continue
 		}
-		actual, _, _ := fs.Get(s[i*fs.EncodedWidth():])
-		assert.EqualValues(t, expected, actual, "Wrong value at position %d", i)
+		assert.EqualValues(t, 3, actual, "Wrong value at position %d", i)
 	}
 }
@@ -0,0 +1,130 @@
+package expr
+
+import (
+	"math"
+)
+
+// Type is the type of the values of an expression. Expressions always get
+// their values as float64, but integer expressions can get their values
+// exactly using GetInt, and boolean expressions only ever evaluate to 0 or 1.
+type Type int
+
+const (
+	// Float values are plain float64s
+	Float Type = iota
+	// Int values are integers, like counts
+	Int
+	// Bool values are 1 for true and 0 for false, like the results of
+	// comparisons
+	Bool
+)
+
+// String returns the name of the Go type that corresponds to this Type.
+func (t Type) String() string {
+	switch t {
+	case Int:
+		return "int64"
+	case Bool:
+		return "bool"
+	default:
+		return "float64"
+	}
+}
+
+// TypeOf determines the Type of the values of the given expression. Counts and
+// integer aggregates like ISUM are Int, as are sums, differences and products
+// of Ints. Comparisons, logical operators and null checks are Bool. Everything
+// else is Float.
+func TypeOf(e Expr) Type {
+	switch t := e.(type) {
+	case *intAggregate:
+		return Int
+	case *aggregate:
+		if t.Name == "COUNT" {
+			return Int
+		}
+	case *histogram, *histogramBucket:
+		return Int
+	case *constant:
+		if t.Value == math.Trunc(t.Value) {
+			return Int
+		}
+	case *ifExpr:
+		return TypeOf(t.Wrapped)
+	case *shift:
+		return TypeOf(t.Wrapped)
+	case *nullCheck:
+		return Bool
+	case *coalesce:
+		result := TypeOf(t.Exprs[0])
+		for _, wrapped := range t.Exprs[1:] {
+			if TypeOf(wrapped) != result {
+				return Float
+			}
+		}
+		return result
+	case *binaryExpr:
+		switch t.Op {
+		case "+", "-", "*":
+			if isInteger(TypeOf(t.Left)) && isInteger(TypeOf(t.Right)) {
+				return Int
+			}
+		case "/":
+			return Float
+		default:
+			// comparisons and logical operators
+			return Bool
+		}
+	}
+	return Float
+}
+
+func isInteger(t Type) bool {
+	return t == Int || t == Bool
+}
+
+// GetInt is like Get, but gets the value as an int64. For integer aggregates
+// like ISUM and for sums, differences and products of those, the value is
+// exact, for other expressions it's the float64 value rounded to the nearest
+// integer.
+func GetInt(e Expr, b []byte) (int64, bool, []byte) {
+	switch t := e.(type) {
+	case *intAggregate:
+		return t.load(b)
+	case *ifExpr:
+		return GetInt(t.Wrapped, b)
+	case *shift:
+		return GetInt(t.Wrapped, b)
+	case *binaryExpr:
+		if TypeOf(t) != Int {
+			break
+		}
+		left, leftWasSet, remain := GetInt(t.Left, b)
+		right, rightWasSet, remain := GetInt(t.Right, remain)
+		if !leftWasSet || !rightWasSet {
+			return 0, false, remain
+		}
+		switch t.Op {
+		case "+":
+			return left + right, true, remain
+		case "-":
+			return left - right, true, remain
+		default:
+			return left * right, true, remain
+		}
+	case *coalesce:
+		result := int64(0)
+		found := false
+		remain := b
+		for _, wrapped := range t.Exprs {
+			value, wasSet, more := GetInt(wrapped, remain)
+			remain = more
+			if wasSet && !found {
+				result, found = value, true
+			}
+		}
+		return result, found, remain
+	}
+	value, wasSet, remain := e.Get(b)
+	return int64(math.Round(value)), wasSet, remain
+}
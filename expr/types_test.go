@@ -0,0 +1,82 @@
+package expr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypeOf(t *testing.T) {
+	assert.Equal(t, Int, TypeOf(COUNT("a")))
+	assert.Equal(t, Int, TypeOf(ISUM("a")))
+	assert.Equal(t, Int, TypeOf(ADD(ICOUNT("a"), CONST(1))))
+	assert.Equal(t, Float, TypeOf(ADD(ISUM("a"), CONST(1.5))))
+	assert.Equal(t, Float, TypeOf(DIV(ISUM("a"), ISUM("b"))))
+	assert.Equal(t, Float, TypeOf(SUM("a")))
+	assert.Equal(t, Bool, TypeOf(GT(SUM("a"), 0)))
+	assert.Equal(t, Bool, TypeOf(ISNULL(SUM("a"))))
+	assert.Equal(t, "int64", Int.String())
+	assert.Equal(t, "bool", Bool.String())
+	assert.Equal(t, "float64", Float.String())
+}
+
+func TestISUM(t *testing.T) {
+	e := msgpacked(t, ISUM("a"))
+	assert.Equal(t, "ISUM(a)", e.String())
+	assert.NoError(t, e.Validate())
+	assert.Equal(t, "ISUM", AggregateOf(e))
+
+	b := make([]byte, e.EncodedWidth())
+	_, wasSet, _ := GetInt(e, b)
+	assert.False(t, wasSet)
+
+	e.Update(b, Map{"a": 1 << 53}, nil)
+	e.Update(b, Map{"a": 1}, nil)
+	val, wasSet, remain := GetInt(e, b)
+	assert.True(t, wasSet)
+	assert.Len(t, remain, 0)
+	assert.EqualValues(t, 1<<53+1, val, "ISUM should stay exact beyond 2^53")
+
+	b2 := make([]byte, e.EncodedWidth())
+	e.Update(b2, Map{"a": 2.4}, nil)
+	merged := make([]byte, e.EncodedWidth())
+	e.Merge(merged, b, b2)
+	val, _, _ = GetInt(e, merged)
+	assert.EqualValues(t, 1<<53+3, val)
+
+	plusOne := msgpacked(t, ADD(ISUM("a"), CONST(1)))
+	b = make([]byte, plusOne.EncodedWidth())
+	plusOne.Update(b, Map{"a": 1 << 53}, nil)
+	val, _, _ = GetInt(plusOne, b)
+	assert.EqualValues(t, 1<<53+1, val)
+}
+
+func TestICOUNT(t *testing.T) {
+	e := msgpacked(t, ICOUNT("a"))
+	assert.Equal(t, "ICOUNT(a)", e.String())
+	b := make([]byte, e.EncodedWidth())
+	e.Update(b, Map{"a": 5}, nil)
+	e.Update(b, Map{"a": 7}, nil)
+	e.Update(b, Map{"b": 7}, nil)
+	val, wasSet, _ := GetInt(e, b)
+	assert.True(t, wasSet)
+	assert.EqualValues(t, 2, val)
+	fval, _, _ := e.Get(b)
+	AssertFloatEquals(t, 2, fval)
+}
+
+func TestISUMSubMerge(t *testing.T) {
+	e := msgpacked(t, ISUM("a"))
+	other := msgpacked(t, ISUM("a"))
+	ob := make([]byte, other.EncodedWidth())
+	other.Update(ob, Map{"a": 3}, nil)
+
+	b := make([]byte, e.EncodedWidth())
+	subs := e.SubMergers([]Expr{SUM("a"), other})
+	assert.Nil(t, subs[0])
+	subs[1](b, ob, time.Hour, nil)
+	subs[1](b, ob, time.Hour, nil)
+	val, _, _ := GetInt(e, b)
+	assert.EqualValues(t, 6, val)
+}
@@ -0,0 +1,468 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/msgpack"
+)
+
+var (
+	scalarUDFs    = make(map[string]*ScalarUDF)
+	aggregateUDFs = make(map[string]*AggregateUDF)
+	udfsMx        sync.RWMutex
+
+	scalarUDFType    = reflect.TypeOf((*scalarUDFExpr)(nil))
+	aggregateUDFType = reflect.TypeOf((*aggregateUDFExpr)(nil))
+
+	// builtins are names of built-in functions that aren't registered anywhere
+	// else in this package
+	builtins = map[string]bool{
+		"AVG":               true,
+		"WAVG":              true,
+		"IF":                true,
+		"SUMIF":             true,
+		"COUNTIF":           true,
+		"AVGIF":             true,
+		"BOUNDED":           true,
+		"CLAMP":             true,
+		"COALESCE":          true,
+		"EMA":               true,
+		"HISTOGRAM":         true,
+		"HISTOGRAM_BUCKETS": true,
+		"PERCENTILE":        true,
+		"PERCENTILEOPT":     true,
+		"SHIFT":             true,
+		"CROSSHIFT":         true,
+	}
+)
+
+// ScalarUDF is a user-defined function that calculates its value from the
+// values of other expressions, like the arithmetic operators or LN do. It
+// doesn't keep any state of its own, so it can be used on top of aggregates,
+// e.g. HAVERSINE(AVG(lat1), AVG(lon1), AVG(lat2), AVG(lon2)).
+type ScalarUDF struct {
+	// Name is the (case-insensitive) name by which the function is called
+	Name string
+	// Arity is the number of arguments that the function takes
+	Arity int
+	// Calc calculates the function's value from the values of its arguments
+	Calc func(args []float64) float64
+}
+
+// AggregateUDF is a user-defined aggregate over fields, like SUM or AVG. Its
+// state is a fixed number of float64s that's updated with the values of its
+// arguments for every point and merged when combining periods or rows.
+type AggregateUDF struct {
+	// Name is the (case-insensitive) name by which the aggregate is called
+	Name string
+	// Arity is the number of arguments that the aggregate takes, which have to
+	// be fields or constants
+	Arity int
+	// StateSize is the number of float64s that make up the aggregate's state
+	StateSize int
+	// Update updates state with the values of the aggregate's arguments for a
+	// new point. state starts out zeroed.
+	Update func(state []float64, args []float64)
+	// Merge merges the state in other into state
+	Merge func(state []float64, other []float64)
+	// Get calculates the aggregate's value from its state
+	Get func(state []float64) float64
+}
+
+// RegisterScalarUDF registers a scalar user-defined function with which
+// expressions can be built using UDF and which the SQL parser picks up.
+// Functions have to be registered on all nodes of a cluster before they're
+// used in queries or table definitions.
+func RegisterScalarUDF(udf *ScalarUDF) error {
+	if udf.Calc == nil {
+		return fmt.Errorf("Scalar function %v has no Calc", udf.Name)
+	}
+	return registerUDF(udf.Name, udf.Arity, func(name string) {
+		udf.Name = name
+		scalarUDFs[name] = udf
+	})
+}
+
+// RegisterAggregateUDF registers a user-defined aggregate with which
+// expressions can be built using UDF and which the SQL parser picks up.
+// Aggregates have to be registered on all nodes of a cluster before they're
+// used in queries or table definitions.
+func RegisterAggregateUDF(udf *AggregateUDF) error {
+	if udf.Update == nil || udf.Merge == nil || udf.Get == nil {
+		return fmt.Errorf("Aggregate %v needs Update, Merge and Get", udf.Name)
+	}
+	if udf.StateSize <= 0 {
+		return fmt.Errorf("Aggregate %v needs a positive StateSize", udf.Name)
+	}
+	return registerUDF(udf.Name, udf.Arity, func(name string) {
+		udf.Name = name
+		aggregateUDFs[name] = udf
+	})
+}
+
+func registerUDF(name string, arity int, register func(name string)) error {
+	name = strings.ToUpper(name)
+	if name == "" {
+		return fmt.Errorf("Function needs a name")
+	}
+	if arity <= 0 {
+		return fmt.Errorf("Function %v needs to take at least one argument", name)
+	}
+	udfsMx.Lock()
+	defer udfsMx.Unlock()
+	if builtins[name] || aggregates[name] != nil || intAggregates[name] != nil || unaryMathFNs[name] != nil || scalarUDFs[name] != nil || aggregateUDFs[name] != nil {
+		return fmt.Errorf("Function %v already registered", name)
+	}
+	register(name)
+	return nil
+}
+
+// UDFArity returns the number of arguments that the user-defined function or
+// aggregate of the given name takes, and whether it is an aggregate. found is
+// false if no function of that name is registered.
+func UDFArity(name string) (arity int, isAggregate bool, found bool) {
+	name = strings.ToUpper(name)
+	udfsMx.RLock()
+	defer udfsMx.RUnlock()
+	if udf := scalarUDFs[name]; udf != nil {
+		return udf.Arity, false, true
+	}
+	if udf := aggregateUDFs[name]; udf != nil {
+		return udf.Arity, true, true
+	}
+	return 0, false, false
+}
+
+// UDF creates an Expr that applies the registered user-defined function or
+// aggregate of the given name to the given expressions or fields.
+func UDF(name string, args ...interface{}) (Expr, error) {
+	name = strings.ToUpper(name)
+	udfsMx.RLock()
+	scalar := scalarUDFs[name]
+	agg := aggregateUDFs[name]
+	udfsMx.RUnlock()
+
+	arity := 0
+	if scalar != nil {
+		arity = scalar.Arity
+	} else if agg != nil {
+		arity = agg.Arity
+	} else {
+		return nil, fmt.Errorf("Unknown function %v", name)
+	}
+	if len(args) != arity {
+		return nil, fmt.Errorf("%v takes %d arguments, not %d", name, arity, len(args))
+	}
+	exprs := make([]Expr, 0, len(args))
+	for _, arg := range args {
+		exprs = append(exprs, exprFor(arg))
+	}
+	if scalar != nil {
+		return &scalarUDFExpr{Name: name, Args: exprs, udf: scalar}, nil
+	}
+	return &aggregateUDFExpr{Name: name, Args: exprs, udf: agg}, nil
+}
+
+func valuesOf(args []Expr, b []byte) ([]float64, bool, []byte) {
+	values := make([]float64, len(args))
+	allSet := true
+	remain := b
+	for i, arg := range args {
+		var wasSet bool
+		values[i], wasSet, remain = arg.Get(remain)
+		allSet = allSet && wasSet
+	}
+	return values, allSet, remain
+}
+
+type scalarUDFExpr struct {
+	Name         string
+	Args         []Expr
+	DeAggregated bool
+	udf          *ScalarUDF
+}
+
+func (e *scalarUDFExpr) Validate() error {
+	for _, arg := range e.Args {
+		if arg == nil {
+			return fmt.Errorf("%v cannot wrap nil expression", e.Name)
+		}
+		typeOfArg := reflect.TypeOf(arg)
+		if !e.DeAggregated && (typeOfArg == fieldType || typeOfArg == boundedType) {
+			return fmt.Errorf("%v must wrap aggregates or constants, not %v", e.Name, arg)
+		}
+		if err := arg.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *scalarUDFExpr) EncodedWidth() int {
+	width := 0
+	for _, arg := range e.Args {
+		width += arg.EncodedWidth()
+	}
+	return width
+}
+
+func (e *scalarUDFExpr) Shift() time.Duration {
+	var result time.Duration
+	for i, arg := range e.Args {
+		if shift := arg.Shift(); i == 0 || shift < result {
+			result = shift
+		}
+	}
+	return result
+}
+
+func (e *scalarUDFExpr) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	values := make([]float64, len(e.Args))
+	anyUpdated := false
+	remain := b
+	for i, arg := range e.Args {
+		var updated bool
+		remain, values[i], updated = arg.Update(remain, params, metadata)
+		anyUpdated = anyUpdated || updated
+	}
+	return remain, e.udf.Calc(values), anyUpdated
+}
+
+func (e *scalarUDFExpr) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	for _, arg := range e.Args {
+		b, x, y = arg.Merge(b, x, y)
+	}
+	return b, x, y
+}
+
+func (e *scalarUDFExpr) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, len(subs))
+	// See if any of the subexpressions match top level and if so, ignore others
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			result[i] = e.subMerge
+			return result
+		}
+	}
+
+	// None of sub expressions match top level, build combined ones
+	width := 0
+	for _, arg := range e.Args {
+		argSubMergers := arg.SubMergers(subs)
+		for i := range subs {
+			result[i] = combinedSubMerge(result[i], width, argSubMergers[i])
+		}
+		width += arg.EncodedWidth()
+	}
+	return result
+}
+
+func (e *scalarUDFExpr) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *scalarUDFExpr) Get(b []byte) (float64, bool, []byte) {
+	values, allSet, remain := valuesOf(e.Args, b)
+	if !allSet {
+		// Like arithmetic, functions of missing values are missing
+		return 0, false, remain
+	}
+	return e.udf.Calc(values), true, remain
+}
+
+func (e *scalarUDFExpr) IsConstant() bool {
+	for _, arg := range e.Args {
+		if !arg.IsConstant() {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *scalarUDFExpr) DeAggregate() Expr {
+	args := make([]Expr, 0, len(e.Args))
+	for _, arg := range e.Args {
+		args = append(args, arg.DeAggregate())
+	}
+	return &scalarUDFExpr{Name: e.Name, Args: args, DeAggregated: true, udf: e.udf}
+}
+
+func (e *scalarUDFExpr) String() string {
+	return udfString(e.Name, e.Args)
+}
+
+func (e *scalarUDFExpr) DecodeMsgpack(dec *msgpack.Decoder) error {
+	m := make(map[string]interface{})
+	err := dec.Decode(&m)
+	if err != nil {
+		return err
+	}
+	e.Name = m["Name"].(string)
+	e.Args = exprsFromMsgpack(m["Args"])
+	e.DeAggregated, _ = m["DeAggregated"].(bool)
+	udfsMx.RLock()
+	e.udf = scalarUDFs[e.Name]
+	udfsMx.RUnlock()
+	if e.udf == nil {
+		return fmt.Errorf("Unknown function %v", e.Name)
+	}
+	return nil
+}
+
+type aggregateUDFExpr struct {
+	Name string
+	Args []Expr
+	udf  *AggregateUDF
+}
+
+func (e *aggregateUDFExpr) Validate() error {
+	for _, arg := range e.Args {
+		if err := validateWrappedInAggregate(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *aggregateUDFExpr) EncodedWidth() int {
+	return 1 + e.udf.StateSize*width64bits
+}
+
+func (e *aggregateUDFExpr) Shift() time.Duration {
+	return 0
+}
+
+func (e *aggregateUDFExpr) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	args := make([]float64, len(e.Args))
+	anyUpdated := false
+	for i, arg := range e.Args {
+		var updated bool
+		// Arguments are fields and constants, which don't take up any space
+		_, args[i], updated = arg.Update(b, params, metadata)
+		anyUpdated = anyUpdated || updated
+	}
+	state, _, remain := e.load(b)
+	if anyUpdated {
+		e.udf.Update(state, args)
+		e.save(b, state)
+	}
+	return remain, e.udf.Get(state), anyUpdated
+}
+
+func (e *aggregateUDFExpr) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	stateX, xWasSet, remainX := e.load(x)
+	stateY, yWasSet, remainY := e.load(y)
+	if !xWasSet {
+		if yWasSet {
+			// Use stateY
+			b = e.save(b, stateY)
+		} else {
+			// Nothing to save, just advance
+			b = b[e.EncodedWidth():]
+		}
+	} else {
+		if yWasSet {
+			e.udf.Merge(stateX, stateY)
+		}
+		b = e.save(b, stateX)
+	}
+	return b, remainX, remainY
+}
+
+func (e *aggregateUDFExpr) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, len(subs))
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			result[i] = e.subMerge
+		}
+	}
+	return result
+}
+
+func (e *aggregateUDFExpr) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *aggregateUDFExpr) Get(b []byte) (float64, bool, []byte) {
+	state, wasSet, remain := e.load(b)
+	if !wasSet {
+		return 0, false, remain
+	}
+	return e.udf.Get(state), true, remain
+}
+
+func (e *aggregateUDFExpr) load(b []byte) ([]float64, bool, []byte) {
+	state := make([]float64, e.udf.StateSize)
+	wasSet := b[0] == 1
+	if wasSet {
+		for i := range state {
+			state[i] = math.Float64frombits(binaryEncoding.Uint64(b[1+i*width64bits:]))
+		}
+	}
+	return state, wasSet, b[e.EncodedWidth():]
+}
+
+func (e *aggregateUDFExpr) save(b []byte, state []float64) []byte {
+	b[0] = 1
+	for i, val := range state {
+		binaryEncoding.PutUint64(b[1+i*width64bits:], math.Float64bits(val))
+	}
+	return b[e.EncodedWidth():]
+}
+
+func (e *aggregateUDFExpr) IsConstant() bool {
+	for _, arg := range e.Args {
+		if !arg.IsConstant() {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *aggregateUDFExpr) DeAggregate() Expr {
+	return e.Args[0].DeAggregate()
+}
+
+func (e *aggregateUDFExpr) String() string {
+	return udfString(e.Name, e.Args)
+}
+
+func (e *aggregateUDFExpr) DecodeMsgpack(dec *msgpack.Decoder) error {
+	m := make(map[string]interface{})
+	err := dec.Decode(&m)
+	if err != nil {
+		return err
+	}
+	e.Name = m["Name"].(string)
+	e.Args = exprsFromMsgpack(m["Args"])
+	udfsMx.RLock()
+	e.udf = aggregateUDFs[e.Name]
+	udfsMx.RUnlock()
+	if e.udf == nil {
+		return fmt.Errorf("Unknown aggregate %v", e.Name)
+	}
+	return nil
+}
+
+func udfString(name string, args []Expr) string {
+	argStrings := make([]string, 0, len(args))
+	for _, arg := range args {
+		argStrings = append(argStrings, arg.String())
+	}
+	return fmt.Sprintf("%v(%v)", name, strings.Join(argStrings, ", "))
+}
+
+func exprsFromMsgpack(v interface{}) []Expr {
+	items, _ := v.([]interface{})
+	exprs := make([]Expr, 0, len(items))
+	for _, item := range items {
+		exprs = append(exprs, item.(Expr))
+	}
+	return exprs
+}
@@ -0,0 +1,144 @@
+package expr
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	RegisterScalarUDF(&ScalarUDF{
+		Name:  "hypot",
+		Arity: 2,
+		Calc: func(args []float64) float64 {
+			return math.Hypot(args[0], args[1])
+		},
+	})
+	// RANGE keeps track of the minimum and maximum and returns the difference
+	RegisterAggregateUDF(&AggregateUDF{
+		Name:      "range",
+		Arity:     1,
+		StateSize: 3,
+		Update: func(state []float64, args []float64) {
+			if state[2] == 0 || args[0] < state[0] {
+				state[0] = args[0]
+			}
+			if state[2] == 0 || args[0] > state[1] {
+				state[1] = args[0]
+			}
+			state[2] = 1
+		},
+		Merge: func(state []float64, other []float64) {
+			state[0] = math.Min(state[0], other[0])
+			state[1] = math.Max(state[1], other[1])
+		},
+		Get: func(state []float64) float64 {
+			return state[1] - state[0]
+		},
+	})
+}
+
+func TestRegisterUDF(t *testing.T) {
+	assert.Error(t, RegisterScalarUDF(&ScalarUDF{Name: "HYPOT", Arity: 2, Calc: func(args []float64) float64 { return 0 }}), "duplicate function")
+	assert.Error(t, RegisterScalarUDF(&ScalarUDF{Name: "sum", Arity: 1, Calc: func(args []float64) float64 { return 0 }}), "built-in aggregate")
+	assert.Error(t, RegisterScalarUDF(&ScalarUDF{Name: "if", Arity: 2, Calc: func(args []float64) float64 { return 0 }}), "built-in function")
+	assert.Error(t, RegisterScalarUDF(&ScalarUDF{Name: "nocalc", Arity: 1}), "missing Calc")
+	assert.Error(t, RegisterAggregateUDF(&AggregateUDF{Name: "nostate", Arity: 1}), "missing implementation")
+
+	arity, isAggregate, found := UDFArity("Range")
+	assert.True(t, found)
+	assert.True(t, isAggregate)
+	assert.Equal(t, 1, arity)
+	_, _, found = UDFArity("unknown")
+	assert.False(t, found)
+
+	_, err := UDF("range", "a", "b")
+	assert.Error(t, err, "wrong arity")
+	_, err = UDF("unknown", "a")
+	assert.Error(t, err, "unknown function")
+}
+
+func TestAggregateUDF(t *testing.T) {
+	e, err := UDF("range", "a")
+	if !assert.NoError(t, err) {
+		return
+	}
+	e = msgpacked(t, e)
+	assert.NoError(t, e.Validate())
+	assert.Equal(t, "RANGE(a)", e.String())
+	assert.Equal(t, "RANGE", AggregateOf(e))
+	assert.Equal(t, []string{"a"}, FieldsOf(e))
+
+	b1 := make([]byte, e.EncodedWidth())
+	_, wasSet, _ := e.Get(b1)
+	assert.False(t, wasSet)
+	e.Update(b1, Map{"a": 5}, nil)
+	e.Update(b1, Map{"b": 100}, nil)
+	e.Update(b1, Map{"a": 2}, nil)
+	val, wasSet, _ := e.Get(b1)
+	assert.True(t, wasSet)
+	AssertFloatEquals(t, 3, val)
+
+	b2 := make([]byte, e.EncodedWidth())
+	e.Update(b2, Map{"a": 9}, nil)
+	b3 := make([]byte, e.EncodedWidth())
+	e.Merge(b3, b1, b2)
+	val, _, _ = e.Get(b3)
+	AssertFloatEquals(t, 7, val)
+
+	sm := e.SubMergers([]Expr{e})[0]
+	if assert.NotNil(t, sm) {
+		sm(b2, b1, 0, nil)
+		val, _, _ = e.Get(b2)
+		AssertFloatEquals(t, 7, val)
+	}
+
+	assert.Error(t, msgpacked(t, mustUDF(t, "range", SUM("a"))).Validate(), "aggregates should only wrap fields")
+}
+
+func TestScalarUDF(t *testing.T) {
+	e := msgpacked(t, mustUDF(t, "hypot", SUM("a"), MAX("b")))
+	assert.NoError(t, e.Validate())
+	assert.Equal(t, "HYPOT(SUM(a), MAX(b))", e.String())
+	assert.Equal(t, []string{"a", "b"}, FieldsOf(e))
+
+	b1 := make([]byte, e.EncodedWidth())
+	e.Update(b1, Map{"a": 1, "b": 2}, nil)
+	e.Update(b1, Map{"a": 2, "b": 4}, nil)
+	val, wasSet, _ := e.Get(b1)
+	assert.True(t, wasSet)
+	AssertFloatEquals(t, 5, val)
+
+	b2 := make([]byte, e.EncodedWidth())
+	e.Update(b2, Map{"a": 3}, nil)
+	b3 := make([]byte, e.EncodedWidth())
+	e.Merge(b3, b1, b2)
+	val, _, _ = e.Get(b3)
+	AssertFloatEquals(t, math.Hypot(6, 4), val)
+
+	// Sub merging from the underlying aggregates
+	sum, max := SUM("a"), MAX("b")
+	sms := e.SubMergers([]Expr{sum, max})
+	sumB := make([]byte, sum.EncodedWidth())
+	sum.Update(sumB, Map{"a": 10}, nil)
+	maxB := make([]byte, max.EncodedWidth())
+	max.Update(maxB, Map{"b": 20}, nil)
+	b4 := make([]byte, e.EncodedWidth())
+	sms[0](b4, sumB, 0, nil)
+	sms[1](b4, maxB, 0, nil)
+	val, _, _ = e.Get(b4)
+	AssertFloatEquals(t, math.Hypot(10, 20), val)
+
+	assert.Error(t, mustUDF(t, "hypot", FIELD("a"), SUM("b")).Validate(), "scalar functions should wrap aggregates")
+	assert.NoError(t, e.DeAggregate().Validate())
+	assert.NoError(t, DIV(e, CONST(2)).Validate())
+}
+
+func mustUDF(t *testing.T, name string, args ...interface{}) Expr {
+	e, err := UDF(name, args...)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return e
+}
@@ -0,0 +1,87 @@
+package zenodb
+
+import (
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/sql"
+)
+
+const fieldTypeFloat = "float64"
+
+// FieldMetaData describes the given result fields of the query in sqlString,
+// including their units (per the Units of the queried table), the expressions
+// that compute them from the underlying stream and whether they're additive.
+// Fields whose expression can't be determined, for example the fields of
+// SHOW SETTINGS or crosstabbed fields, are described only by name and type,
+// which is then float64.
+func (db *DB) FieldMetaData(sqlString string, fields core.Fields) []*common.FieldMetaData {
+	result := make([]*common.FieldMetaData, 0, len(fields))
+	resolved, units := db.resolveFields(sqlString)
+	byName := make(map[string]core.Field, len(resolved))
+	for _, field := range resolved {
+		byName[field.Name] = field
+	}
+	for _, field := range fields {
+		md := &common.FieldMetaData{Name: field.Name, Type: fieldTypeFloat}
+		if rf, found := byName[field.Name]; found {
+			md.Type = expr.TypeOf(rf.Expr).String()
+			md.Expr = rf.Expr.String()
+			md.Aggregate = expr.AggregateOf(rf.Expr)
+			md.Additive = expr.IsAdditive(rf.Expr)
+			md.Unit = expr.UnitOf(rf.Expr, func(name string) string { return units[name] })
+		}
+		result = append(result, md)
+	}
+	return result
+}
+
+// resolveFields resolves the fields of the given query in terms of the fields
+// of the stream underlying the queried table and returns them along with the
+// units of the stream's fields.
+func (db *DB) resolveFields(sqlString string) (core.Fields, map[string]string) {
+	q, err := db.parse(sqlString)
+	if err != nil {
+		return nil, nil
+	}
+	queries := []*sql.Query{q}
+	for q.FromSubQuery != nil {
+		q = q.FromSubQuery
+		queries = append(queries, q)
+	}
+	t := db.getTable(q.From)
+	if t == nil {
+		return nil, nil
+	}
+
+	known := t.getFields()
+	units := rawFieldUnits(t.Units, known)
+	for i := len(queries) - 1; i >= 0; i-- {
+		known, err = queries[i].Fields.Get(known)
+		if err != nil {
+			return nil, nil
+		}
+	}
+	return known, units
+}
+
+// rawFieldUnits maps the configured units to the names of stream fields. A
+// unit configured for a table field applies to the single stream field that
+// the table field reads, if there is one.
+func rawFieldUnits(units map[string]string, tableFields core.Fields) map[string]string {
+	result := make(map[string]string, len(units))
+	for name, unit := range units {
+		result[name] = unit
+	}
+	for _, field := range tableFields {
+		unit, found := units[field.Name]
+		if !found {
+			continue
+		}
+		raw := expr.FieldsOf(field.Expr)
+		if len(raw) == 1 {
+			result[raw[0]] = unit
+		}
+	}
+	return result
+}
@@ -0,0 +1,71 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldMetaData(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir: tmpDir,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT requests, AVG(load) AS load, bytes FROM inbound GROUP BY period(1h)",
+			Units:           map[string]string{"load": "ms", "bytes": "bytes"},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	metaData := func(sqlString string) *common.QueryMetaData {
+		source, err := db.Query(sqlString, false, nil, true)
+		if !assert.NoError(t, err) {
+			return &common.QueryMetaData{}
+		}
+		var fields core.Fields
+		_, err = source.Iterate(context.Background(), func(inFields core.Fields) error {
+			fields = inFields
+			return nil
+		}, func(row *core.FlatRow) (bool, error) {
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return MetaDataFor(source, fields)
+	}
+
+	md := metaData("SELECT requests * 2 AS dbl, load, bytes / requests AS per_request, bytes + bytes AS twice, COUNT(requests) AS num FROM test_a")
+	assert.Equal(t, []*common.FieldMetaData{
+		{Name: "dbl", Type: "float64", Expr: "(SUM(requests) * 2.000000)", Additive: true},
+		{Name: "load", Type: "float64", Unit: "ms", Expr: "AVG(load)", Aggregate: "AVG"},
+		{Name: "per_request", Type: "float64", Expr: "(SUM(bytes) / SUM(requests))"},
+		{Name: "twice", Type: "float64", Unit: "bytes", Expr: "(SUM(bytes) + SUM(bytes))", Additive: true},
+		{Name: "num", Type: "int64", Expr: "COUNT(requests)", Aggregate: "COUNT", Additive: true},
+	}, md.Fields)
+
+	md = metaData("SELECT MAX(load) AS max_load FROM (SELECT load FROM test_a GROUP BY period(1h))")
+	if assert.Len(t, md.Fields, 1) {
+		assert.Equal(t, "ms", md.Fields[0].Unit, "unit should carry through subquery")
+		assert.Equal(t, "MAX", md.Fields[0].Aggregate)
+		assert.False(t, md.Fields[0].Additive)
+	}
+}
@@ -0,0 +1,63 @@
+package zenodb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/getlantern/goexpr"
+)
+
+func validateFollowFilter(opts *TableOpts) error {
+	if opts.FollowFilter == "" {
+		return nil
+	}
+	if opts.View {
+		return fmt.Errorf("Views can't have a FollowFilter")
+	}
+	_, err := whereFor(opts.FollowFilter)
+	return err
+}
+
+// withFollowFilter combines the given WHERE clause with the table's
+// FollowFilter when following a leader, so that the follower applies the
+// filter to the entries it receives even if the leader doesn't.
+func (db *DB) withFollowFilter(where goexpr.Expr, opts *TableOpts) (goexpr.Expr, error) {
+	if db.opts.Follow == nil {
+		return where, nil
+	}
+	filter, err := whereFor(opts.FollowFilter)
+	if err != nil || filter == nil {
+		return where, err
+	}
+	if where == nil {
+		return filter, nil
+	}
+	return goexpr.Binary("AND", where, filter)
+}
+
+func (t *table) applyFollowFilter(filter string) {
+	t.whereMutex.Lock()
+	t.FollowFilter = filter
+	t.whereMutex.Unlock()
+}
+
+func (t *table) getFollowFilter() string {
+	t.whereMutex.RLock()
+	filter := t.FollowFilter
+	t.whereMutex.RUnlock()
+	return filter
+}
+
+// parseFollowFilter parses the filter that a follower requested for a table.
+// If it's invalid, the follower receives all of the table's entries.
+func parseFollowFilter(f *follower, tableName string, filter string) (goexpr.Expr, string) {
+	expr, err := whereFor(filter)
+	if err != nil {
+		log.Errorf("Ignoring invalid filter for table %v requested by %d (%v): %v", tableName, f.PartitionNumber, f.FollowerName, err)
+		return nil, ""
+	}
+	if expr == nil {
+		return nil, ""
+	}
+	return expr, strings.ToLower(expr.String())
+}
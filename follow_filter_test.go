@@ -0,0 +1,62 @@
+package zenodb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithFollowFilter(t *testing.T) {
+	assert.NoError(t, validateFollowFilter(&TableOpts{}))
+	assert.NoError(t, validateFollowFilter(&TableOpts{FollowFilter: "dim = 'a'"}))
+	assert.Error(t, validateFollowFilter(&TableOpts{FollowFilter: "dim = "}))
+	assert.Error(t, validateFollowFilter(&TableOpts{FollowFilter: "dim = 'a'", View: true}))
+
+	f := &follower{Follow: common.Follow{FollowerName: "f"}}
+	filter, filterString := parseFollowFilter(f, "t", "Dim = 'a'")
+	if assert.NotNil(t, filter) {
+		assert.Equal(t, strings.ToLower(filter.String()), filterString)
+	}
+	filter, filterString = parseFollowFilter(f, "t", "dim = ")
+	assert.Nil(t, filter, "invalid filter should be ignored")
+	assert.Empty(t, filterString)
+	filter, _ = parseFollowFilter(f, "t", "")
+	assert.Nil(t, filter)
+
+	where, err := whereFor("x = 1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	opts := &TableOpts{FollowFilter: "dim = 'a'"}
+
+	leader := &DB{opts: &DBOpts{}}
+	combined, err := leader.withFollowFilter(where, opts)
+	if assert.NoError(t, err) {
+		assert.Equal(t, where, combined, "filter should only apply on followers")
+	}
+
+	follower := &DB{opts: &DBOpts{Follow: func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error) {}}}
+	passes := func(where goexpr.Expr, dims map[string]interface{}) bool {
+		return where.Eval(bytemap.New(dims)).(bool)
+	}
+	combined, err = follower.withFollowFilter(nil, opts)
+	if assert.NoError(t, err) {
+		assert.True(t, passes(combined, map[string]interface{}{"dim": "a"}))
+		assert.False(t, passes(combined, map[string]interface{}{"dim": "b"}))
+	}
+	combined, err = follower.withFollowFilter(where, opts)
+	if assert.NoError(t, err) {
+		assert.True(t, passes(combined, map[string]interface{}{"x": 1, "dim": "a"}))
+		assert.False(t, passes(combined, map[string]interface{}{"x": 2, "dim": "a"}), "table's WHERE should still apply")
+		assert.False(t, passes(combined, map[string]interface{}{"x": 1, "dim": "b"}), "filter should apply")
+	}
+	combined, err = follower.withFollowFilter(where, &TableOpts{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, where, combined)
+	}
+}
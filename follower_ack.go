@@ -0,0 +1,276 @@
+package zenodb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/wal"
+)
+
+const (
+	followerAcksFilename = "follower_acks"
+	incarnationFilename  = "incarnation"
+	followerIDFilename   = "follower_id"
+	followAckInterval    = 5 * time.Second
+)
+
+// followerAck records the offsets through which a follower has durably applied
+// the entries for each of its tables. Acks are only valid for the incarnation
+// of the follower's data and the partitioning under which they were made.
+type followerAck struct {
+	FollowerName           string
+	Incarnation            string
+	NumPartitions          int
+	ConsistentPartitioning bool
+	Tables                 map[string]wal.Offset
+}
+
+// followerAckKey keys acks by the follower's persistent id if it has one, so
+// that they survive changes to its name, and by its name otherwise.
+func followerAckKey(id string, name string, stream string, partition int) string {
+	if id != "" {
+		return fmt.Sprintf("id:%v|%v|%d", id, stream, partition)
+	}
+	return fmt.Sprintf("%v|%v|%d", name, stream, partition)
+}
+
+// followerAckFor finds the ack recorded for the given follower. For followers
+// that have a persistent id, it falls back to acks recorded by name before
+// the follower had an id. Must be called while holding followersMx.
+func (db *DB) followerAckFor(id string, name string, stream string, partition int) (string, *followerAck) {
+	key := followerAckKey(id, name, stream, partition)
+	ack := db.followerAcks[key]
+	if ack == nil && id != "" {
+		ack = db.followerAcks[followerAckKey("", name, stream, partition)]
+	}
+	return key, ack
+}
+
+// AckFollow records that the identified follower has durably applied all
+// entries through the acknowledged offsets. When that follower follows again,
+// it resumes from no earlier than these offsets so that entries aren't applied
+// twice.
+func (db *DB) AckFollow(ack *common.FollowAck) error {
+	if ack.FollowerName == "" {
+		return errors.New("Please specify the name of the follower acknowledging offsets")
+	}
+	if db.FollowerRevoked(ack.FollowerName) {
+		return ErrFollowerRevoked
+	}
+	db.checkClockSkew(ack.FollowerName, ack.PartitionNumber, ack.SentAt)
+	if !db.isLocalLeader(ack.LeaderID) {
+		log.Debugf("Ignoring ack from follower %d (%v) for offsets from leader %v", ack.PartitionNumber, ack.FollowerName, ack.LeaderID)
+		return nil
+	}
+
+	db.followersMx.Lock()
+	defer db.followersMx.Unlock()
+	key, existing := db.followerAckFor(ack.FollowerID, ack.FollowerName, ack.Stream, ack.PartitionNumber)
+	if existing != nil && db.followerAcks[key] == nil {
+		// Move ack recorded by name to the follower's id
+		delete(db.followerAcks, followerAckKey("", ack.FollowerName, ack.Stream, ack.PartitionNumber))
+		db.followerAcks[key] = existing
+	}
+	if existing == nil || existing.Incarnation != ack.Incarnation || existing.NumPartitions != ack.NumPartitions || existing.ConsistentPartitioning != ack.ConsistentPartitioning {
+		// Follower's data or partitioning changed, prior acks no longer apply
+		existing = &followerAck{
+			FollowerName:           ack.FollowerName,
+			Incarnation:            ack.Incarnation,
+			NumPartitions:          ack.NumPartitions,
+			ConsistentPartitioning: ack.ConsistentPartitioning,
+			Tables:                 make(map[string]wal.Offset, len(ack.Offsets)),
+		}
+		db.followerAcks[key] = existing
+	}
+	existing.FollowerName = ack.FollowerName
+	changed := false
+	for table, offset := range ack.Offsets {
+		if offset.After(existing.Tables[table]) {
+			existing.Tables[table] = offset
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return db.saveFollowerAcks()
+}
+
+// applyFollowerAcks advances the offsets requested by a follower to whatever
+// it has already acknowledged.
+func (db *DB) applyFollowerAcks(f *common.Follow) {
+	if f.FollowerName == "" {
+		return
+	}
+	db.followersMx.RLock()
+	defer db.followersMx.RUnlock()
+	_, ack := db.followerAckFor(f.FollowerID, f.FollowerName, f.Stream, f.PartitionNumber)
+	if ack == nil || ack.Incarnation != f.Incarnation || ack.NumPartitions != f.NumPartitions || ack.ConsistentPartitioning != f.ConsistentPartitioning {
+		return
+	}
+	for _, partition := range f.Partitions {
+		for _, t := range partition.Tables {
+			acked := ack.Tables[t.Name]
+			if acked.After(t.Offset) {
+				log.Debugf("Resuming %v for follower %d (%v) from acknowledged offset %v instead of %v", t.Name, f.PartitionNumber, f.FollowerName, acked, t.Offset)
+				t.Offset = acked
+			}
+		}
+	}
+}
+
+// saveFollowerAcks persists acknowledged offsets. Must be called while holding
+// followersMx.
+func (db *DB) saveFollowerAcks() error {
+	if db.opts.ReadOnly {
+		return nil
+	}
+	b, err := json.Marshal(db.followerAcks)
+	if err != nil {
+		return errors.New("Unable to encode follower acks: %v", err)
+	}
+	out, err := ioutil.TempFile(db.opts.Dir, followerAcksFilename)
+	if err != nil {
+		return errors.New("Unable to create follower acks file: %v", err)
+	}
+	defer out.Close()
+	_, err = out.Write(b)
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), filepath.Join(db.opts.Dir, followerAcksFilename))
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return errors.New("Unable to save follower acks: %v", err)
+	}
+	return nil
+}
+
+func (db *DB) loadFollowerAcks() {
+	b, err := ioutil.ReadFile(filepath.Join(db.opts.Dir, followerAcksFilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Unable to read follower acks: %v", err)
+		}
+		return
+	}
+	err = json.Unmarshal(b, &db.followerAcks)
+	if err != nil {
+		log.Errorf("Unable to decode follower acks, ignoring: %v", err)
+		db.followerAcks = make(map[string]*followerAck)
+		return
+	}
+	log.Debugf("Loaded acks for %d followers", len(db.followerAcks))
+}
+
+// ackFollowLoop periodically acknowledges to the leader the offsets through
+// which the given stream's tables have flushed to disk.
+func (db *DB) ackFollowLoop(stream string, tables func() []*table) {
+	db.followedStreamsMx.Lock()
+	db.followedStreams[stream] = tables
+	db.followedStreamsMx.Unlock()
+
+	ticker := time.NewTicker(followAckInterval)
+	defer ticker.Stop()
+
+	var acked map[string]wal.Offset
+	for range ticker.C {
+		if db.isShuttingDown() {
+			// Shutdown sends the final ack
+			return
+		}
+		offsets, err := db.ackFollow(stream, tables(), acked)
+		if err != nil {
+			log.Errorf("Unable to acknowledge offsets for %v: %v", stream, err)
+			continue
+		}
+		acked = offsets
+	}
+}
+
+// ackFollow acknowledges to the leader the offsets through which the given
+// tables have flushed to disk, unless they haven't changed since the given
+// acked offsets. It returns the offsets that are acknowledged.
+func (db *DB) ackFollow(stream string, tables []*table, acked map[string]wal.Offset) (map[string]wal.Offset, error) {
+	offsets := make(map[string]wal.Offset)
+	changed := false
+	for _, t := range tables {
+		offset := t.persistedOffset()
+		if offset == nil {
+			continue
+		}
+		offsets[t.Name] = offset
+		if !bytes.Equal(offset, acked[t.Name]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return acked, nil
+	}
+	err := db.opts.AckFollow(&common.FollowAck{
+		Stream:                 stream,
+		PartitionNumber:        db.opts.Partition,
+		FollowerName:           db.opts.FollowerName,
+		FollowerToken:          db.opts.FollowerToken,
+		FollowerID:             db.followerID,
+		Incarnation:            db.incarnation,
+		NumPartitions:          db.opts.NumPartitions,
+		ConsistentPartitioning: db.opts.ConsistentPartitioning,
+		Offsets:                offsets,
+		SentAt:                 db.sentAt(),
+	})
+	if err != nil {
+		return acked, err
+	}
+	return offsets, nil
+}
+
+// loadIncarnation loads the random id that identifies this incarnation of the
+// follower's data, generating a new one if necessary. Restoring from a backup
+// starts a new incarnation so that the leader doesn't resume from offsets
+// acknowledged prior to the restore.
+func (db *DB) loadIncarnation() {
+	db.incarnation = db.loadRandomID(incarnationFilename, "incarnation")
+}
+
+// loadFollowerID loads the random id that persistently identifies this follower
+// to its leaders, generating a new one if necessary.
+func (db *DB) loadFollowerID() {
+	db.followerID = db.loadRandomID(followerIDFilename, "follower id")
+}
+
+// loadRandomID loads a random id from the named file within the db dir,
+// generating and saving a new one if necessary.
+func (db *DB) loadRandomID(name string, description string) string {
+	filename := filepath.Join(db.opts.Dir, name)
+	b, err := ioutil.ReadFile(filename)
+	if err == nil && len(b) > 0 {
+		return string(b)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Unable to read %v, starting a new one: %v", description, err)
+	}
+	b = make([]byte, 8)
+	_, err = rand.Read(b)
+	if err != nil {
+		log.Errorf("Unable to generate %v: %v", description, err)
+		return ""
+	}
+	id := hex.EncodeToString(b)
+	err = ioutil.WriteFile(filename, []byte(id), 0644)
+	if err != nil {
+		log.Errorf("Unable to save %v: %v", description, err)
+	}
+	return id
+}
@@ -0,0 +1,123 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAckFollow(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	newDB := func() *DB {
+		db := &DB{
+			opts:             &DBOpts{Dir: tmpDir, NodeID: "leader"},
+			followersByName:  make(map[string]map[*follower]bool),
+			revokedFollowers: make(map[string]bool),
+			followerAcks:     make(map[string]*followerAck),
+		}
+		db.loadFollowerAcks()
+		return db
+	}
+
+	now := time.Now()
+	early := wal.NewOffsetForTS(now.Add(-1 * time.Hour))
+	acked := wal.NewOffsetForTS(now.Add(-1 * time.Minute))
+	late := wal.NewOffsetForTS(now)
+
+	newFollow := func(numPartitions int) *common.Follow {
+		return &common.Follow{
+			Stream:          "stream",
+			PartitionNumber: 1,
+			FollowerName:    "a",
+			NumPartitions:   numPartitions,
+			Partitions: map[string]*common.Partition{
+				"": {Tables: []*common.PartitionTable{
+					{Name: "behind", Offset: early},
+					{Name: "ahead", Offset: late},
+					{Name: "new", Offset: nil},
+				}},
+			},
+		}
+	}
+	offsetsOf := func(f *common.Follow) []wal.Offset {
+		var result []wal.Offset
+		for _, t := range f.Partitions[""].Tables {
+			result = append(result, t.Offset)
+		}
+		return result
+	}
+
+	db := newDB()
+	assert.Error(t, db.AckFollow(&common.FollowAck{Stream: "stream"}), "follower should have to identify itself")
+	ack := &common.FollowAck{
+		Stream:          "stream",
+		PartitionNumber: 1,
+		FollowerName:    "a",
+		NumPartitions:   2,
+		Offsets:         map[string]wal.Offset{"behind": acked, "ahead": acked},
+	}
+	assert.NoError(t, db.AckFollow(ack))
+	stale := &common.FollowAck{
+		Stream:          "stream",
+		PartitionNumber: 1,
+		FollowerName:    "a",
+		NumPartitions:   2,
+		Offsets:         map[string]wal.Offset{"behind": early},
+	}
+	assert.NoError(t, db.AckFollow(stale), "acks should never go backwards")
+	otherLeader := &common.FollowAck{
+		Stream:          "stream",
+		PartitionNumber: 1,
+		FollowerName:    "a",
+		LeaderID:        "otherleader",
+		NumPartitions:   2,
+		Offsets:         map[string]wal.Offset{"behind": late},
+	}
+	assert.NoError(t, db.AckFollow(otherLeader), "acks for other leaders' offsets should be ignored")
+
+	db = newDB()
+	f := newFollow(2)
+	db.applyFollowerAcks(f)
+	assert.Equal(t, []wal.Offset{acked, late, nil}, offsetsOf(f), "should resume from acked offsets after restart")
+
+	f = newFollow(3)
+	db.applyFollowerAcks(f)
+	assert.Equal(t, []wal.Offset{early, late, nil}, offsetsOf(f), "acks shouldn't apply after partitioning changed")
+
+	f = newFollow(2)
+	f.Incarnation = "wiped"
+	db.applyFollowerAcks(f)
+	assert.Equal(t, []wal.Offset{early, late, nil}, offsetsOf(f), "acks shouldn't apply after follower's data was wiped")
+
+	f = newFollow(2)
+	f.FollowerName = "b"
+	db.applyFollowerAcks(f)
+	assert.Equal(t, []wal.Offset{early, late, nil}, offsetsOf(f), "acks shouldn't apply to other followers")
+
+	byID := &common.FollowAck{
+		Stream:          "stream",
+		PartitionNumber: 1,
+		FollowerName:    "a",
+		FollowerID:      "node1",
+		NumPartitions:   2,
+		Offsets:         map[string]wal.Offset{"ahead": late},
+	}
+	assert.NoError(t, db.AckFollow(byID))
+
+	db = newDB()
+	f = newFollow(2)
+	f.FollowerName = "renamed"
+	f.FollowerID = "node1"
+	db.applyFollowerAcks(f)
+	assert.Equal(t, []wal.Offset{acked, late, nil}, offsetsOf(f), "acks should follow the follower's ID, including ones made before it had one")
+}
@@ -0,0 +1,132 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	revokedFollowersFilename = "revoked_followers"
+)
+
+var (
+	// ErrFollowerRevoked indicates that a follower was revoked and is no longer
+	// allowed to follow this leader.
+	ErrFollowerRevoked = errors.New("follower revoked")
+)
+
+// RevokeFollower revokes the named follower, disconnecting it if it's
+// currently connected and preventing it from following again until it's
+// reinstated.
+func (db *DB) RevokeFollower(name string) error {
+	if name == "" {
+		return errors.New("Please specify the name of the follower to revoke")
+	}
+	db.followersMx.Lock()
+	db.revokedFollowers[name] = true
+	connected := make([]*follower, 0, len(db.followersByName[name]))
+	for f := range db.followersByName[name] {
+		connected = append(connected, f)
+	}
+	err := db.saveRevokedFollowers()
+	db.followersMx.Unlock()
+
+	log.Debugf("Revoked follower %v, disconnecting %d connections", name, len(connected))
+	for _, f := range connected {
+		f.markFailed()
+	}
+	return err
+}
+
+// ReinstateFollower allows a previously revoked follower to follow again.
+func (db *DB) ReinstateFollower(name string) error {
+	db.followersMx.Lock()
+	defer db.followersMx.Unlock()
+	delete(db.revokedFollowers, name)
+	log.Debugf("Reinstated follower %v", name)
+	return db.saveRevokedFollowers()
+}
+
+// FollowerRevoked indicates whether the named follower has been revoked.
+func (db *DB) FollowerRevoked(name string) bool {
+	if name == "" {
+		return false
+	}
+	db.followersMx.RLock()
+	defer db.followersMx.RUnlock()
+	return db.revokedFollowers[name]
+}
+
+// RevokedFollowers lists the names of all revoked followers.
+func (db *DB) RevokedFollowers() []string {
+	db.followersMx.RLock()
+	names := make([]string, 0, len(db.revokedFollowers))
+	for name := range db.revokedFollowers {
+		names = append(names, name)
+	}
+	db.followersMx.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+func (db *DB) trackFollower(f *follower) {
+	db.followersMx.Lock()
+	followers := db.followersByName[f.FollowerName]
+	if followers == nil {
+		followers = make(map[*follower]bool)
+		db.followersByName[f.FollowerName] = followers
+	}
+	followers[f] = true
+	db.followersMx.Unlock()
+}
+
+func (db *DB) untrackFollower(f *follower) {
+	db.followersMx.Lock()
+	followers := db.followersByName[f.FollowerName]
+	delete(followers, f)
+	if len(followers) == 0 {
+		delete(db.followersByName, f.FollowerName)
+	}
+	db.forgetFollowerPartitionKeys(f)
+	db.followersMx.Unlock()
+}
+
+// saveRevokedFollowers persists the list of revoked followers, one per line.
+// Must be called while holding followersMx.
+func (db *DB) saveRevokedFollowers() error {
+	if db.opts.ReadOnly {
+		return nil
+	}
+	names := make([]string, 0, len(db.revokedFollowers))
+	for name := range db.revokedFollowers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	err := ioutil.WriteFile(filepath.Join(db.opts.Dir, revokedFollowersFilename), []byte(strings.Join(names, "\n")), 0644)
+	if err != nil {
+		return errors.New("Unable to save revoked followers: %v", err)
+	}
+	return nil
+}
+
+func (db *DB) loadRevokedFollowers() {
+	b, err := ioutil.ReadFile(filepath.Join(db.opts.Dir, revokedFollowersFilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Unable to read revoked followers: %v", err)
+		}
+		return
+	}
+	for _, name := range strings.Split(string(b), "\n") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			db.revokedFollowers[name] = true
+		}
+	}
+	log.Debugf("Loaded %d revoked followers", len(db.revokedFollowers))
+}
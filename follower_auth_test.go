@@ -0,0 +1,48 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevokeFollower(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	newDB := func() *DB {
+		db := &DB{
+			opts:             &DBOpts{Dir: tmpDir},
+			followersByName:  make(map[string]map[*follower]bool),
+			revokedFollowers: make(map[string]bool),
+		}
+		db.loadRevokedFollowers()
+		return db
+	}
+
+	db := newDB()
+	fol := &follower{entries: make(chan *walEntry, 1)}
+	fol.FollowerName = "a"
+	db.trackFollower(fol)
+
+	assert.Error(t, db.RevokeFollower(""))
+	assert.False(t, db.FollowerRevoked(""))
+	assert.NoError(t, db.RevokeFollower("b"))
+	assert.NoError(t, db.RevokeFollower("a"))
+	assert.True(t, fol.failed(), "connected follower should have been disconnected")
+	assert.True(t, db.FollowerRevoked("a"))
+	assert.Equal(t, []string{"a", "b"}, db.RevokedFollowers())
+
+	db = newDB()
+	assert.Equal(t, []string{"a", "b"}, db.RevokedFollowers(), "revocations should survive restart")
+	assert.NoError(t, db.ReinstateFollower("a"))
+	assert.False(t, db.FollowerRevoked("a"))
+
+	db = newDB()
+	assert.Equal(t, []string{"b"}, db.RevokedFollowers())
+}
@@ -1,6 +1,6 @@
 module github.com/getlantern/zenodb
 
-go 1.12
+go 1.15
 
 require (
 	github.com/Workiva/go-datastructures v1.0.50 // indirect
@@ -29,7 +29,6 @@ require (
 	github.com/getlantern/tlsredis v0.0.0-20180308045249-5d4ed6dd3836
 	github.com/getlantern/uuid v1.2.0
 	github.com/getlantern/vtime v0.0.0-20160810174823-dc1e573cf991
-	github.com/getlantern/wal v0.0.0-20180604193457-e99945fbd2d2
 	github.com/getlantern/withtimeout v0.0.0-20160829163843-511f017cd913
 	github.com/getlantern/yaml v0.0.0-20140912054538-97d86b60f57e
 	github.com/go-stack/stack v1.8.0 // indirect
@@ -37,22 +36,28 @@ require (
 	github.com/gorilla/mux v1.7.1
 	github.com/gorilla/securecookie v1.1.1
 	github.com/hashicorp/golang-lru v0.5.1 // indirect
+	github.com/klauspost/compress v1.9.8
 	github.com/kylelemons/godebug v1.1.0
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/oschwald/geoip2-golang v1.2.1 // indirect
 	github.com/oschwald/maxminddb-golang v1.3.0 // indirect
 	github.com/oxtoacart/bpool v0.0.0-20190227141107-8c4636f812cc
 	github.com/oxtoacart/emsort v0.0.0-20160911032127-e467347e3354
+	github.com/pierrec/lz4 v2.0.5+incompatible
 	github.com/retailnext/hllpp v1.0.0
 	github.com/rickar/props v0.0.0-20170718221555-0b06aeb2f037
+	github.com/segmentio/kafka-go v0.4.10
 	github.com/shirou/gopsutil v2.18.12+incompatible
 	github.com/spaolacci/murmur3 v1.1.0
-	github.com/stretchr/testify v1.3.0
+	github.com/stretchr/testify v1.7.0
 	github.com/vharitonsky/iniflags v0.0.0-20180513140207-a33cd0b5f3de
 	github.com/xwb1989/sqlparser v0.0.0-20180606152119-120387863bf2 // indirect
-	golang.org/x/crypto v0.0.0-20190506204251-e1dfcc566284
-	golang.org/x/net v0.0.0-20190503192946-f4e77d36d62c
-	golang.org/x/sys v0.0.0-20190509141414-a5b02f93d862 // indirect
-	google.golang.org/grpc v1.20.1
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	google.golang.org/grpc v1.40.0
 	gopkg.in/redis.v5 v5.2.9
 )
@@ -0,0 +1,191 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	HealthCheckWAL       = "wal"
+	HealthCheckSchema    = "schema"
+	HealthCheckFollowers = "followers"
+	HealthCheckLeader    = "leader"
+	HealthCheckRecovery  = "recovery"
+	HealthCheckWarmup    = "warmup"
+)
+
+// HealthCheck is the outcome of one of the checks that make up the health of a
+// node.
+type HealthCheck struct {
+	Name string
+	OK   bool
+	// Liveness indicates that a node failing this check is broken and should be
+	// restarted, as opposed to merely not being ready to serve yet.
+	Liveness bool
+	Error    string `json:",omitempty"`
+}
+
+// leaderConnection tracks a follower's connection to the leader of a stream.
+type leaderConnection struct {
+	// attempts counts the attempts to follow the leader since data was last
+	// received from it
+	attempts int
+}
+
+// HealthChecks checks whether the WALs are writable, the schema loaded
+// successfully, leaders have followers for all partitions, followers are
+// connected to their leaders and whether all tables have recovered and warmed
+// up. Checks that don't apply to this node, like leader connectivity on a
+// leader, are omitted.
+func (db *DB) HealthChecks() []*HealthCheck {
+	checks := []*HealthCheck{
+		newHealthCheck(HealthCheckWAL, true, db.checkWALsWritable()),
+		newHealthCheck(HealthCheckSchema, true, db.checkSchemaLoaded()),
+	}
+	if db.opts.Passthrough && db.opts.NumPartitions > 0 {
+		checks = append(checks, newHealthCheck(HealthCheckFollowers, false, db.checkFollowersConnected()))
+	}
+	if db.opts.Follow != nil {
+		checks = append(checks, newHealthCheck(HealthCheckLeader, false, db.checkLeaderConnected()))
+	}
+	var recoveryErr, warmupErr error
+	if !db.Recovered() {
+		recoveryErr = errors.New("tables are still recovering")
+	} else if !db.WarmedUp() {
+		warmupErr = errors.New("warm-up queries are still running")
+	}
+	checks = append(checks,
+		newHealthCheck(HealthCheckRecovery, false, recoveryErr),
+		newHealthCheck(HealthCheckWarmup, false, warmupErr))
+	return checks
+}
+
+func newHealthCheck(name string, liveness bool, err error) *HealthCheck {
+	check := &HealthCheck{Name: name, OK: err == nil, Liveness: liveness}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// checkWALsWritable makes sure that a file can be written next to the WALs,
+// which fails for example when the disk is full or has been remounted
+// read-only. The probe file doesn't go into the directories of the WALs
+// themselves so that it isn't mistaken for a WAL segment.
+func (db *DB) checkWALsWritable() error {
+	db.tablesMutex.RLock()
+	numStreams := len(db.streams)
+	db.tablesMutex.RUnlock()
+	if numStreams == 0 {
+		return nil
+	}
+
+	probe, err := ioutil.TempFile(filepath.Join(db.opts.Dir, "_wal"), ".healthcheck")
+	if err == nil {
+		defer os.Remove(probe.Name())
+		_, err = probe.Write([]byte{0})
+		if err == nil {
+			err = probe.Sync()
+		}
+		closeErr := probe.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return errors.New("WAL is not writable: %v", err)
+	}
+	return nil
+}
+
+func (db *DB) setSchemaError(err error) {
+	db.schemaMx.Lock()
+	db.schemaErr = err
+	db.schemaMx.Unlock()
+}
+
+// checkSchemaLoaded returns the error from the most recent attempt to load the
+// schema from file, if any.
+func (db *DB) checkSchemaLoaded() error {
+	db.schemaMx.RLock()
+	err := db.schemaErr
+	db.schemaMx.RUnlock()
+	if err != nil {
+		return errors.New("unable to load schema: %v", err)
+	}
+	return nil
+}
+
+// checkFollowersConnected makes sure that every partition has at least one
+// connected follower.
+func (db *DB) checkFollowersConnected() error {
+	var missing []string
+	for _, ps := range db.ClusterStatus().Partitions {
+		if ps.NumFollowers == 0 {
+			missing = append(missing, fmt.Sprint(ps.Partition))
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("no followers connected for partitions %v", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkLeaderConnected makes sure that this follower is following the leader
+// for all of its streams. Since leaders don't send anything while there's no
+// new data, a connection is optimistically considered healthy until the
+// follower has to reconnect without having received anything.
+func (db *DB) checkLeaderConnected() error {
+	db.leaderConnectionsMx.Lock()
+	var disconnected []string
+	for stream, conn := range db.leaderConnections {
+		if conn.attempts != 1 {
+			disconnected = append(disconnected, stream)
+		}
+	}
+	numStreams := len(db.leaderConnections)
+	db.leaderConnectionsMx.Unlock()
+
+	if numStreams == 0 {
+		return errors.New("not following any streams yet")
+	}
+	if len(disconnected) > 0 {
+		sort.Strings(disconnected)
+		return errors.New("not connected to leader for streams %v", strings.Join(disconnected, ", "))
+	}
+	return nil
+}
+
+// followingLeader records that this follower (re)started following the given
+// stream.
+func (db *DB) followingLeader(stream string) {
+	db.leaderConnectionsMx.Lock()
+	db.leaderConnections[stream] = &leaderConnection{}
+	db.leaderConnectionsMx.Unlock()
+}
+
+// connectingToLeader records an attempt to follow the leader of the given
+// stream.
+func (db *DB) connectingToLeader(stream string) {
+	db.leaderConnectionsMx.Lock()
+	if conn := db.leaderConnections[stream]; conn != nil {
+		conn.attempts++
+	}
+	db.leaderConnectionsMx.Unlock()
+}
+
+// receivedFromLeader records that data was received from the leader of the
+// given stream.
+func (db *DB) receivedFromLeader(stream string) {
+	db.leaderConnectionsMx.Lock()
+	if conn := db.leaderConnections[stream]; conn != nil {
+		conn.attempts = 1
+	}
+	db.leaderConnectionsMx.Unlock()
+}
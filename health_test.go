@@ -0,0 +1,73 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthChecks(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	schemaFile := filepath.Join(tmpDir, "schema.yaml")
+	err = ioutil.WriteFile(schemaFile, []byte(`
+test_a:
+  retentionperiod: 1h
+  sql: SELECT i FROM inbound GROUP BY *, period(1m)
+`), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	db, err := NewDB(&DBOpts{
+		Dir:        tmpDir,
+		SchemaFile: schemaFile,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	checks := func() map[string]*HealthCheck {
+		result := make(map[string]*HealthCheck)
+		for _, check := range db.HealthChecks() {
+			result[check.Name] = check
+		}
+		return result
+	}
+
+	initial := checks()
+	assert.True(t, initial[HealthCheckWAL].OK)
+	assert.True(t, initial[HealthCheckWAL].Liveness)
+	assert.True(t, initial[HealthCheckSchema].OK)
+	assert.Nil(t, initial[HealthCheckLeader], "leader check only applies to followers")
+	assert.Nil(t, initial[HealthCheckFollowers], "followers check only applies to leaders")
+
+	if !assert.NoError(t, ioutil.WriteFile(schemaFile, []byte("test_a: [broken"), 0644)) {
+		return
+	}
+	assert.Error(t, db.ApplySchemaFromFile(schemaFile))
+	schemaCheck := checks()[HealthCheckSchema]
+	assert.False(t, schemaCheck.OK)
+	assert.True(t, schemaCheck.Liveness)
+	assert.NotEmpty(t, schemaCheck.Error)
+
+	assert.Error(t, db.checkLeaderConnected(), "follower shouldn't be connected before following")
+	db.followingLeader("inbound")
+	db.connectingToLeader("inbound")
+	assert.NoError(t, db.checkLeaderConnected(), "connection should be considered healthy while connecting the first time")
+	db.connectingToLeader("inbound")
+	assert.Error(t, db.checkLeaderConnected(), "reconnecting without receiving anything should be unhealthy")
+	db.receivedFromLeader("inbound")
+	assert.NoError(t, db.checkLeaderConnected(), "receiving data should be healthy")
+
+	os.RemoveAll(filepath.Join(tmpDir, "_wal"))
+	assert.False(t, checks()[HealthCheckWAL].OK, "WAL shouldn't be writable once its directory is gone")
+}
@@ -0,0 +1,74 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	err = db.ApplySchema(Schema{
+		"requests": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT HISTOGRAM(latency, 100, 500) AS latency FROM inbound GROUP BY server, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	insert := func(server string, latency float64) {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"server": server}, map[string]float64{"latency": latency}))
+	}
+	insert("a", 50)
+	insert("a", 200)
+	insert("b", 700)
+	time.Sleep(250 * time.Millisecond)
+	// flush so that later points have to be merged with the filestore
+	db.FlushAll()
+	insert("a", 100)
+	insert("b", 450)
+	insert("b", 1000)
+	time.Sleep(250 * time.Millisecond)
+
+	source, err := db.Query("SELECT latency AS total, HISTOGRAM_BUCKETS(latency) FROM requests GROUP BY _", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var names []string
+	var values []float64
+	_, err = source.Iterate(context.Background(), func(fields core.Fields) error {
+		for _, field := range fields {
+			names = append(names, field.Name)
+		}
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		values = row.Values
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"total", "le_100_latency", "le_500_latency", "gt_500_latency"}, names)
+		assert.Equal(t, []float64{6, 2, 2, 2}, values)
+	}
+}
@@ -0,0 +1,121 @@
+package zenodb
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemoryTable(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := vtime.NewVirtualClock(epoch)
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_mem": &TableOpts{
+			RetentionPeriod: time.Hour,
+			MaxFlushLatency: time.Hour,
+			InMemory:        true,
+			SQL:             "SELECT i FROM inbound GROUP BY period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	query := func() float64 {
+		source, err := db.Query("SELECT i FROM test_mem", false, nil, false)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		total := float64(0)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			total += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return total
+	}
+
+	assert.NoError(t, db.Insert("inbound", epoch.Add(-30*time.Minute), map[string]interface{}{"dim": "a"}, map[string]float64{"i": 1}))
+	assert.NoError(t, db.Insert("inbound", epoch, map[string]interface{}{"dim": "a"}, map[string]float64{"i": 2}))
+	time.Sleep(250 * time.Millisecond)
+	assert.EqualValues(t, 3, query(), "in-memory data should be queryable without including memstore")
+
+	db.FlushAll()
+	assert.EqualValues(t, 3, query(), "flushing shouldn't lose data that's still within retention period")
+	_, err = os.Stat(filepath.Join(tmpDir, "test_mem"))
+	assert.True(t, os.IsNotExist(err), "in-memory table shouldn't write anything to disk")
+
+	var backup bytes.Buffer
+	if assert.NoError(t, db.Backup(context.Background(), &backup)) {
+		tr := tar.NewReader(&backup)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			assert.NotContains(t, hdr.Name, "test_mem", "in-memory table shouldn't be backed up")
+		}
+	}
+
+	clock.Advance(epoch.Add(45 * time.Minute))
+	db.FlushAll()
+	assert.EqualValues(t, 2, query(), "data within retention period should remain")
+	rs := db.getTable("test_mem").rowStore
+	rs.mx.RLock()
+	ms := rs.memStore
+	rs.mx.RUnlock()
+	retained := float64(0)
+	ms.tree.Walk(0, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+		for f, field := range ms.fields {
+			if field.Name != "i" {
+				continue
+			}
+			for p := 0; p < data[f].NumPeriods(field.Expr.EncodedWidth()); p++ {
+				val, _ := data[f].ValueAt(p, field.Expr)
+				retained += val
+			}
+		}
+		return true, true, nil
+	})
+	assert.EqualValues(t, 2, retained, "data outside of retention period should have been dropped from memory")
+
+	err = db.ApplySchema(Schema{
+		"test_mem": &TableOpts{
+			RetentionPeriod: time.Hour,
+			MaxFlushLatency: time.Hour,
+			InMemory:        true,
+			SQL:             "SELECT i, j FROM inbound GROUP BY period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	time.Sleep(250 * time.Millisecond)
+	assert.EqualValues(t, 2, query(), "changing fields should keep in-memory data")
+}
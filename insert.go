@@ -1,16 +1,23 @@
 package zenodb
 
 import (
+	"encoding/binary"
 	"fmt"
 	"hash"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/errors"
-	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/compress"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/encryption"
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/getlantern/zenodb/wal"
 )
 
 func (db *DB) Insert(stream string, ts time.Time, dims map[string]interface{}, vals map[string]float64) error {
@@ -21,8 +28,18 @@ func (db *DB) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals
 	if db.opts.Follow != nil {
 		return errors.New("Declining to insert data directly to follower")
 	}
+	if db.isShuttingDown() {
+		return ErrShuttingDown
+	}
 
 	stream = strings.TrimSpace(strings.ToLower(stream))
+	dims, stream, err := db.validate(stream, db.anonymize(stream, db.normalize(stream, dims)))
+	if err != nil {
+		return err
+	}
+	if err := db.checkLeaderOf(stream); err != nil {
+		return err
+	}
 	db.tablesMutex.Lock()
 	w := db.streams[stream]
 	db.tablesMutex.Unlock()
@@ -37,19 +54,84 @@ func (db *DB) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals
 	encoding.WriteInt32(dimsLen, len(dims))
 	valsLen := make([]byte, encoding.Width32bits)
 	encoding.WriteInt32(valsLen, len(vals))
-	_, err := w.Write(tsd, dimsLen, dims, valsLen, vals)
+	start := time.Now()
+	err = db.writeWAL(w, tsd, dimsLen, dims, valsLen, vals)
 	if err != nil {
 		log.Error(err)
 		if lastErr == nil {
 			lastErr = err
 		}
+	} else {
+		metrics.StreamInserted(stream, len(tsd)+len(dimsLen)+len(dims)+len(valsLen)+len(vals), time.Since(start))
 	}
 	return lastErr
 }
 
+// DurableOffset syncs everything inserted into the given stream so far to disk
+// and returns the WAL offset up to which the stream's data is durable. With a
+// WALSyncInterval of 0, every insert is already synced as it's written.
+func (db *DB) DurableOffset(stream string) (wal.Offset, error) {
+	stream = strings.TrimSpace(strings.ToLower(stream))
+	db.tablesMutex.Lock()
+	w := db.streams[stream]
+	db.tablesMutex.Unlock()
+	if w == nil {
+		return nil, fmt.Errorf("No wal found for stream %v", stream)
+	}
+	return w.Sync()
+}
+
+// walHead returns the offset of the end of the data that's been written to
+// disk for the given stream's WAL.
+func (db *DB) walHead(stream string) (wal.Offset, error) {
+	walDir := filepath.Join(db.opts.Dir, "_wal", stream)
+	files, err := ioutil.ReadDir(walDir)
+	if err != nil {
+		return nil, errors.New("Unable to list WAL segments for %v: %v", stream, err)
+	}
+	// The latest segment is the one being written to and is never compressed.
+	// Data only makes it to disk when the WAL syncs, so its size is the durable
+	// position.
+	for i := len(files) - 1; i >= 0; i-- {
+		segment := files[i]
+		if strings.HasSuffix(segment.Name(), walCompressedSuffix) {
+			continue
+		}
+		sequence, parseErr := strconv.ParseInt(segment.Name(), 10, 64)
+		if parseErr != nil {
+			continue
+		}
+		offset := make(wal.Offset, wal.OffsetSize)
+		binary.BigEndian.PutUint64(offset, uint64(sequence))
+		binary.BigEndian.PutUint64(offset[8:], uint64(segment.Size()))
+		return offset, nil
+	}
+	return nil, errors.New("No WAL segments found for %v", stream)
+}
+
 type walRead struct {
 	data   []byte
 	offset wal.Offset
+	// entry, if set, is the shared entry that holds data, which is released
+	// rather than recycled once the table is done with it
+	entry *walEntry
+	// prepared is set once an insert worker has prepared the entry, in which
+	// case insert holds the result (nil if the entry is skipped)
+	prepared bool
+	insert   *preparedInsert
+}
+
+// preparedInsert is a point from the WAL that's been decoded and checked
+// against the parts of the table's configuration that don't depend on prior
+// points, so that this work can be done in parallel.
+type preparedInsert struct {
+	ts     time.Time
+	dims   bytemap.ByteMap
+	vals   bytemap.ByteMap
+	offset wal.Offset
+	key    bytemap.ByteMap
+	// filteredBy names what filtered out the point, if anything
+	filteredBy string
 }
 
 func (t *table) processWALInserts() {
@@ -59,14 +141,31 @@ func (t *table) processWALInserts() {
 	for {
 		data, err := t.wal.Read()
 		if err != nil {
+			if t.db.isShuttingDown() {
+				// Shutdown closed the reader
+				close(in)
+				return
+			}
 			panic(fmt.Errorf("Unable to read from WAL: %v", err))
 		}
-		in <- &walRead{data, t.wal.Offset()}
+		if encryption.IsEncrypted(data) || compress.IsCompressed(data) {
+			plaintext, openErr := t.db.openWALEntry(data)
+			// recycle the encrypted or compressed buffer
+			t.db.walBuffers.Put(data)
+			data = plaintext
+			if openErr != nil {
+				t.log.Errorf("Unable to open WAL entry, skipping: %v", openErr)
+			}
+		}
+		in <- &walRead{data: data, offset: t.wal.Offset()}
 	}
 }
 
 func (t *table) processInserts(in chan *walRead) {
 	isFollower := t.db.opts.Follow != nil
+	if t.PrepareWorkers > 1 {
+		in = t.prepareInsertsInParallel(in, t.PrepareWorkers, isFollower)
+	}
 	start := time.Now()
 	inserted := 0
 	skipped := 0
@@ -76,17 +175,25 @@ func (t *table) processInserts(in chan *walRead) {
 	for read := range in {
 		if read.data == nil {
 			// Ignore empty data
+			t.recycle(read)
 			continue
 		}
 		bytesRead += len(read.data)
-		if t.insert(read.data, isFollower, h, read.offset) {
+		var ok bool
+		if read.prepared {
+			ok = read.insert != nil && t.applyInsert(read.insert)
+		} else {
+			ok = t.insert(read.data, isFollower, h, read.offset)
+		}
+		if ok {
 			inserted++
 		} else {
 			// Did not insert (probably due to WHERE clause)
 			t.skip(read.offset)
 			skipped++
 		}
-		t.db.walBuffers.Put(read.data)
+		t.recycle(read)
+		t.recoveredThrough(read.offset)
 		delta := time.Now().Sub(start)
 		if delta > 1*time.Minute {
 			t.log.Debugf("Read %v at %v per second", humanize.Bytes(uint64(bytesRead)), humanize.Bytes(uint64(float64(bytesRead)/delta.Seconds())))
@@ -100,11 +207,31 @@ func (t *table) processInserts(in chan *walRead) {
 	}
 }
 
+// recycle returns the data of the given read to where it came from once the
+// table is done with it.
+func (t *table) recycle(read *walRead) {
+	if read.entry != nil {
+		read.entry.release()
+	} else {
+		t.db.walBuffers.Put(read.data)
+	}
+}
+
 func (t *table) insert(data []byte, isFollower bool, h hash.Hash32, offset wal.Offset) bool {
+	point := t.prepareInsert(data, isFollower, h, offset)
+	return point != nil && t.applyInsert(point)
+}
+
+// prepareInsert decodes the given WAL entry and determines whether the table's
+// partition, WHERE clause and routing let it in and under which key. It
+// returns nil if the point doesn't belong in the table at all. Since it
+// doesn't depend on prior points, it's safe to call concurrently.
+func (t *table) prepareInsert(data []byte, isFollower bool, h hash.Hash32, offset wal.Offset) (point *preparedInsert) {
 	defer func() {
 		p := recover()
 		if p != nil {
-			log.Errorf("Panic in inserting: %v", p)
+			log.Errorf("Panic in preparing insert: %v", p)
+			point = nil
 		}
 	}()
 
@@ -112,13 +239,17 @@ func (t *table) insert(data []byte, isFollower bool, h hash.Hash32, offset wal.O
 	ts := encoding.TimeFromBytes(tsd)
 	if ts.Before(t.truncateBefore()) {
 		// Ignore old data
-		return false
+		return nil
 	}
 	dimsLen, remain := encoding.ReadInt32(remain)
 	dims, remain := encoding.Read(remain, dimsLen)
 	if isFollower && !t.db.inPartition(h, dims, t.PartitionBy, t.db.opts.Partition) {
 		// data not relevant to follower on this table
-		return false
+		return nil
+	}
+	if isFollower && t.alreadyHave(h, dims, offset) {
+		// data re-requested during rebalancing that we already had
+		return nil
 	}
 
 	valsLen, remain := encoding.ReadInt32(remain)
@@ -130,7 +261,7 @@ func (t *table) insert(data []byte, isFollower bool, h hash.Hash32, offset wal.O
 	valsBM := make(bytemap.ByteMap, len(vals))
 	copy(dimsBM, dims)
 	copy(valsBM, vals)
-	return t.doInsert(ts, dimsBM, valsBM, offset)
+	return t.prepareDims(ts, dimsBM, valsBM, offset)
 }
 
 // Skip informs the table of a new offset so that we can store it
@@ -139,53 +270,110 @@ func (t *table) skip(offset wal.Offset) {
 }
 
 func (t *table) doInsert(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap, offset wal.Offset) bool {
-	where := t.getWhere()
+	return t.applyInsert(t.prepareDims(ts, dims, vals, offset))
+}
 
+func (t *table) prepareDims(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap, offset wal.Offset) *preparedInsert {
+	point := &preparedInsert{ts: ts, dims: dims, vals: vals, offset: offset}
+	where := t.getWhere()
 	if where != nil {
 		ok := where.Eval(dims)
 		if !ok.(bool) {
-			if t.log.IsTraceEnabled() {
-				t.log.Tracef("Filtering out inbound point at %v due to %v: %v", ts, where, dims.AsMap())
-			}
-			t.statsMutex.Lock()
-			t.stats.FilteredPoints++
-			t.statsMutex.Unlock()
-			return false
+			point.filteredBy = "due to " + where.String()
+			return point
 		}
 	}
-	t.db.clock.Advance(ts)
-
-	if t.log.IsTraceEnabled() {
-		t.log.Tracef("Including inbound point at %v: %v", ts, dims.AsMap())
+	if t.routedElsewhere(dims) {
+		point.filteredBy = "because it was routed to another table"
+		return point
 	}
+	point.key = t.keyFor(dims)
+	return point
+}
 
-	var key bytemap.ByteMap
-	if len(t.GroupBy) == 0 {
-		key = dims
-	} else {
-		// Reslice dimensions
-		names := make([]string, 0, len(t.GroupBy))
-		values := make([]interface{}, 0, len(t.GroupBy))
-		for _, groupBy := range t.GroupBy {
-			val := groupBy.Expr.Eval(dims)
-			if val != nil {
-				names = append(names, groupBy.Name)
-				values = append(values, val)
-			}
+// applyInsert inserts a prepared point, unless it's filtered out, late or a
+// duplicate. Since those checks depend on prior points, prepared points have to
+// be applied one at a time in the order of the WAL.
+func (t *table) applyInsert(point *preparedInsert) (inserted bool) {
+	defer func() {
+		p := recover()
+		if p != nil {
+			log.Errorf("Panic in inserting: %v", p)
+			inserted = false
+		}
+	}()
+
+	ts, dims, vals := point.ts, point.dims, point.vals
+	if isLateTable, late := t.routedLate(ts, dims); isLateTable && !late {
+		// Late tables only receive points that are late for the tables that
+		// route to them. This is checked before our own WHERE clause so that
+		// we track their watermarks based on all of their points
+		t.statsMutex.Lock()
+		t.stats.FilteredPoints++
+		t.statsMutex.Unlock()
+		return false
+	}
+	if point.filteredBy != "" {
+		if t.log.IsTraceEnabled() {
+			t.log.Tracef("Filtering out inbound point at %v %v: %v", ts, point.filteredBy, dims.AsMap())
+		}
+		t.statsMutex.Lock()
+		t.stats.FilteredPoints++
+		t.statsMutex.Unlock()
+		return false
+	}
+	if !t.checkLate(ts) {
+		return false
+	}
+	if t.dedup.duplicate(ts, dims, t.now()) {
+		if t.log.IsTraceEnabled() {
+			t.log.Tracef("Dropping duplicate inbound point at %v: %v", ts, dims.AsMap())
 		}
-		key = bytemap.FromSortedKeysAndValues(names, values)
+		t.statsMutex.Lock()
+		t.stats.DedupedPoints++
+		t.statsMutex.Unlock()
+		metrics.TableDeduped(t.Name)
+		return false
+	}
+	t.db.advanceClock(t.From, ts)
+
+	if t.log.IsTraceEnabled() {
+		t.log.Tracef("Including inbound point at %v: %v", ts, dims.AsMap())
 	}
 
 	tsparams := encoding.NewTSParams(ts, vals)
+	_, params := tsparams.TimeAndParams()
+	t.countOutOfRange(params, dims)
+	t.db.throttleIngest()
 	t.db.capMemorySize(true)
-	t.rowStore.insert(&insert{key, tsparams, dims, offset})
+	t.rowStore.insert(&insert{point.key, tsparams, dims, point.offset})
 	t.statsMutex.Lock()
 	t.stats.InsertedPoints++
 	t.statsMutex.Unlock()
+	metrics.TableInserted(t.Name, len(dims)+len(vals))
 
 	return true
 }
 
+// keyFor determines the key under which to store a point with the given
+// dimensions, based on the table's GroupBy.
+func (t *table) keyFor(dims bytemap.ByteMap) bytemap.ByteMap {
+	if len(t.GroupBy) == 0 {
+		return dims
+	}
+	// Reslice dimensions
+	names := make([]string, 0, len(t.GroupBy))
+	values := make([]interface{}, 0, len(t.GroupBy))
+	for _, groupBy := range t.GroupBy {
+		val := groupBy.Expr.Eval(dims)
+		if val != nil {
+			names = append(names, groupBy.Name)
+			values = append(values, val)
+		}
+	}
+	return bytemap.FromSortedKeysAndValues(names, values)
+}
+
 func (t *table) recordQueued() {
 	t.statsMutex.Lock()
 	t.stats.QueuedPoints++
@@ -0,0 +1,50 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDurableOffset(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:             tmpDir,
+		WALSyncInterval: 50 * time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = db.DurableOffset("unknown")
+	assert.Error(t, err)
+
+	before, err := db.DurableOffset("inbound")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"dim": 1}, map[string]float64{"i": 1}))
+	after, err := db.DurableOffset("inbound")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, after.After(before), "offset should include insert once synced (%v vs %v)", after, before)
+}
@@ -0,0 +1,83 @@
+package zenodb
+
+import (
+	"hash"
+
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	insertWorkerQueueDepth = 1000
+)
+
+// insertJob is an entry from the WAL that's waiting to be prepared by an
+// insert worker.
+type insertJob struct {
+	read     *walRead
+	prepared chan *walRead
+}
+
+// prepareInsertsInParallel shards the entries from in among the given number
+// of workers by a hash of their dimensions, so that points with the same
+// dimensions are always prepared by the same worker. The returned channel
+// yields the prepared entries in their original order.
+func (t *table) prepareInsertsInParallel(in chan *walRead, workers int, isFollower bool) chan *walRead {
+	t.log.Debugf("Preparing inserts with %d workers", workers)
+	shards := make([]chan *insertJob, 0, workers)
+	for i := 0; i < workers; i++ {
+		shard := make(chan *insertJob, insertWorkerQueueDepth)
+		shards = append(shards, shard)
+		go t.prepareInserts(shard, isFollower)
+	}
+
+	ordered := make(chan *insertJob, workers*insertWorkerQueueDepth)
+	go func() {
+		h := partitionHash()
+		for read := range in {
+			job := &insertJob{read: read, prepared: make(chan *walRead, 1)}
+			shards[insertShardFor(h, read.data, workers)] <- job
+			ordered <- job
+		}
+		for _, shard := range shards {
+			close(shard)
+		}
+		close(ordered)
+	}()
+
+	out := make(chan *walRead, insertWorkerQueueDepth)
+	go func() {
+		for job := range ordered {
+			out <- <-job.prepared
+		}
+		close(out)
+	}()
+	return out
+}
+
+func (t *table) prepareInserts(jobs chan *insertJob, isFollower bool) {
+	h := partitionHash()
+	for job := range jobs {
+		read := job.read
+		if read.data != nil {
+			read.insert = t.prepareInsert(read.data, isFollower, h, read.offset)
+			read.prepared = true
+		}
+		job.prepared <- read
+	}
+}
+
+// insertShardFor picks the worker for the given WAL entry based on a hash of
+// its serialized dimensions.
+func insertShardFor(h hash.Hash32, data []byte, workers int) int {
+	if len(data) < encoding.Width64bits+encoding.Width32bits {
+		return 0
+	}
+	_, remain := encoding.Read(data, encoding.Width64bits)
+	dimsLen, remain := encoding.ReadInt32(remain)
+	if dimsLen < 0 || dimsLen > len(remain) {
+		return 0
+	}
+	h.Reset()
+	h.Write(remain[:dimsLen])
+	return int(h.Sum32() % uint32(workers))
+}
@@ -0,0 +1,189 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrepareWorkers(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	err = db.ApplySchema(Schema{
+		"serial": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound WHERE dim <> 'skip' GROUP BY dim, period(1m)",
+		},
+		"parallel": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound WHERE dim <> 'skip' GROUP BY dim, period(1m)",
+			PrepareWorkers:  4,
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	dims := []string{"a", "b", "c", "d", "e", "skip"}
+	for i := 0; i < 600; i++ {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"dim": dims[i%len(dims)]}, map[string]float64{"i": float64(i)}))
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	totals := func(table string) map[string]float64 {
+		source, err := db.Query("SELECT i FROM "+table+" GROUP BY dim", false, nil, true)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		result := make(map[string]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result[row.Key.Get("dim").(string)] += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	serial := totals("serial")
+	assert.Len(t, serial, 5)
+	assert.Equal(t, serial, totals("parallel"))
+
+	offsetOf := func(table string) string {
+		rs := db.getTable(table).rowStore
+		rs.mx.RLock()
+		defer rs.mx.RUnlock()
+		return rs.memStore.offset.String()
+	}
+	assert.Equal(t, offsetOf("serial"), offsetOf("parallel"), "parallel table should have applied all entries")
+	parallel := db.getTable("parallel")
+	parallel.statsMutex.RLock()
+	assert.EqualValues(t, 100, parallel.stats.FilteredPoints)
+	parallel.statsMutex.RUnlock()
+}
+
+func TestPrepareInsertsInParallelPreservesOrder(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	err = db.ApplySchema(Schema{
+		"parallel": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound WHERE dim <> 'skip' GROUP BY dim, period(1m)",
+			PrepareWorkers:  4,
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tbl := db.getTable("parallel")
+
+	const workers = 4
+	now := time.Now()
+	dims := []string{"a", "b", "c", "d", "e", "skip"}
+	h := partitionHash()
+	var reads []*walRead
+	for i := 0; i < 1000; i++ {
+		var data []byte
+		if i%100 != 99 {
+			data = encodeWALEntry(now, bytemap.New(map[string]interface{}{"dim": dims[i%len(dims)]}), bytemap.NewFloat(map[string]float64{"i": float64(i)}))
+		}
+		reads = append(reads, &walRead{data: data, offset: wal.NewOffsetForTS(now.Add(time.Duration(i)))})
+	}
+
+	in := make(chan *walRead)
+	out := tbl.prepareInsertsInParallel(in, workers, false)
+	go func() {
+		for _, read := range reads {
+			in <- read
+		}
+		close(in)
+	}()
+
+	var actual []*walRead
+	for read := range out {
+		actual = append(actual, read)
+	}
+	if !assert.Len(t, actual, len(reads)) {
+		return
+	}
+
+	perShard := func(reads []*walRead) map[int][]*walRead {
+		result := make(map[int][]*walRead)
+		for _, read := range reads {
+			shard := insertShardFor(h, read.data, workers)
+			result[shard] = append(result[shard], read)
+		}
+		return result
+	}
+	expectedShards := perShard(reads)
+	assert.True(t, len(expectedShards) > 1, "entries should have been spread across shards")
+	assert.Equal(t, expectedShards, perShard(actual), "each shard's entries should be yielded in WAL order")
+	for i, read := range actual {
+		if !assert.True(t, read == reads[i], "entry %d out of order", i) {
+			return
+		}
+		if read.data == nil {
+			assert.False(t, read.prepared, "entry %d without data shouldn't be prepared", i)
+			continue
+		}
+		if assert.True(t, read.prepared, "entry %d should be prepared", i) && assert.NotNil(t, read.insert) {
+			assert.Equal(t, float64(i), read.insert.vals.Get("i"), "entry %d prepared with wrong data", i)
+			assert.Equal(t, read.offset, read.insert.offset)
+		}
+	}
+}
+
+func TestInsertShardFor(t *testing.T) {
+	entry := func(dims map[string]interface{}) []byte {
+		tsd := make([]byte, encoding.Width64bits)
+		encoding.EncodeTime(tsd, time.Now())
+		dimsBM := bytemap.New(dims)
+		dimsLen := make([]byte, encoding.Width32bits)
+		encoding.WriteInt32(dimsLen, len(dimsBM))
+		return append(append(tsd, dimsLen...), dimsBM...)
+	}
+
+	h := partitionHash()
+	shard := insertShardFor(h, entry(map[string]interface{}{"dim": "a"}), 8)
+	assert.Equal(t, shard, insertShardFor(h, entry(map[string]interface{}{"dim": "a"}), 8), "same dims should go to same shard")
+	shards := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		shards[insertShardFor(h, entry(map[string]interface{}{"dim": i}), 8)] = true
+	}
+	assert.True(t, len(shards) > 1, "different dims should be spread across shards")
+	assert.Equal(t, 0, insertShardFor(h, []byte{1, 2}, 8), "truncated entries should go to first shard")
+}
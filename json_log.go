@@ -0,0 +1,90 @@
+package zenodb
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/getlantern/errors"
+)
+
+// jsonLog writes entries as lines of JSON to a file. Once the file exceeds
+// maxBytes, it's rotated to a file with the suffix .1, replacing any prior one.
+// If maxBytes is negative, the file is never rotated and only ever appended
+// to.
+type jsonLog struct {
+	filename string
+	maxBytes int64
+	file     *os.File
+	size     int64
+	mx       sync.Mutex
+}
+
+func openJSONLog(filename string, maxBytes int64) (*jsonLog, error) {
+	l := &jsonLog{filename: filename, maxBytes: maxBytes}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *jsonLog) open() error {
+	file, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.New("Unable to open %v: %v", l.filename, err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.New("Unable to stat %v: %v", l.filename, err)
+	}
+	l.file = file
+	l.size = fi.Size()
+	return nil
+}
+
+func (l *jsonLog) write(entry interface{}) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return errors.New("Unable to encode entry for %v: %v", l.filename, err)
+	}
+	b = append(b, '\n')
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.file == nil {
+		return errors.New("%v is closed", l.filename)
+	}
+	if l.maxBytes >= 0 && l.size > 0 && l.size+int64(len(b)) > l.maxBytes {
+		err = l.rotate()
+		if err != nil {
+			return errors.New("Unable to rotate %v: %v", l.filename, err)
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		return errors.New("Unable to write to %v: %v", l.filename, err)
+	}
+	return nil
+}
+
+func (l *jsonLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	err := os.Rename(l.filename, l.filename+".1")
+	if err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *jsonLog) close() {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
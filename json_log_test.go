@@ -0,0 +1,62 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONLogRotation(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	l, err := openJSONLog(filepath.Join(tmpDir, slowQueryLogFilename), 200)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.close()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, l.write(&SlowQuery{SQL: "SELECT * FROM table_with_a_long_enough_name"}))
+	}
+
+	current, err := ioutil.ReadFile(l.filename)
+	if assert.NoError(t, err) {
+		assert.True(t, len(current) <= 200, "log should have been rotated")
+		assert.NotEmpty(t, current)
+	}
+	rotated, err := ioutil.ReadFile(l.filename + ".1")
+	if assert.NoError(t, err) {
+		assert.NotEmpty(t, rotated)
+	}
+}
+
+func TestJSONLogAppendOnly(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	l, err := openJSONLog(filepath.Join(tmpDir, queryAuditLogFilename), -1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.close()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, l.write(&QueryAudit{SQL: "SELECT * FROM table_with_a_long_enough_name"}))
+	}
+
+	current, err := ioutil.ReadFile(l.filename)
+	if assert.NoError(t, err) {
+		assert.Len(t, strings.Split(strings.TrimSpace(string(current)), "\n"), 3, "log should contain all entries")
+	}
+	_, err = os.Stat(l.filename + ".1")
+	assert.True(t, os.IsNotExist(err), "log shouldn't have been rotated")
+}
@@ -0,0 +1,198 @@
+package zenodb
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	// LatePolicyDrop drops points that are later than a table's MaxLateness.
+	LatePolicyDrop = "drop"
+
+	// LatePolicyRoute inserts points that are later than a table's MaxLateness
+	// into its LateTable instead of the table itself.
+	LatePolicyRoute = "route"
+
+	// LatePolicyApply inserts points that are later than a table's MaxLateness
+	// anyway, correcting the periods to which they belong.
+	LatePolicyApply = "apply"
+)
+
+func validateLatePolicy(opts *TableOpts) error {
+	policy := strings.ToLower(opts.LatePolicy)
+	switch policy {
+	case "", LatePolicyDrop, LatePolicyRoute, LatePolicyApply:
+		// okay
+	default:
+		return fmt.Errorf("Unknown LatePolicy '%v', please use '%v', '%v' or '%v'", opts.LatePolicy, LatePolicyDrop, LatePolicyRoute, LatePolicyApply)
+	}
+	if opts.MaxLateness < 0 {
+		return fmt.Errorf("Please specify a non-negative MaxLateness")
+	}
+	if policy != "" && opts.MaxLateness == 0 {
+		return fmt.Errorf("LatePolicy requires a MaxLateness")
+	}
+	if policy == LatePolicyRoute {
+		if opts.View {
+			return fmt.Errorf("Views can't route late points")
+		}
+		if strings.TrimSpace(opts.LateTable) == "" {
+			return fmt.Errorf("LatePolicy '%v' requires a LateTable", LatePolicyRoute)
+		}
+	} else if opts.LateTable != "" {
+		return fmt.Errorf("LateTable requires LatePolicy '%v'", LatePolicyRoute)
+	}
+	return nil
+}
+
+// validateLateTables makes sure that every LateTable in the schema is a table
+// reading from the same stream as the tables that route late points to it.
+func validateLateTables(schema Schema) error {
+	for name, opts := range schema {
+		if strings.ToLower(opts.LatePolicy) != LatePolicyRoute {
+			continue
+		}
+		lateName := strings.ToLower(strings.TrimSpace(opts.LateTable))
+		if lateName == name {
+			return fmt.Errorf("Table %v can't be its own LateTable", name)
+		}
+		late, found := schema[lateName]
+		if !found || late.View {
+			return fmt.Errorf("LateTable %v of table %v not found", lateName, name)
+		}
+		from, err := sql.TableFor(opts.SQL)
+		if err != nil {
+			return fmt.Errorf("Unable to determine stream of table %v: %v", name, err)
+		}
+		lateFrom, err := sql.TableFor(late.SQL)
+		if err != nil {
+			return fmt.Errorf("Unable to determine stream of table %v: %v", lateName, err)
+		}
+		if from != lateFrom {
+			return fmt.Errorf("LateTable %v reads from %v, but table %v reads from %v", lateName, lateFrom, name, from)
+		}
+	}
+	return nil
+}
+
+func (t *table) applyLatePolicy(maxLateness time.Duration, policy string, lateTable string) {
+	if strings.ToLower(policy) == LatePolicyRoute {
+		atomic.StoreInt32(&t.db.routesLate, 1)
+	}
+	t.whereMutex.Lock()
+	t.MaxLateness = maxLateness
+	t.LatePolicy = policy
+	t.LateTable = lateTable
+	t.whereMutex.Unlock()
+}
+
+func (t *table) getLatePolicy() (maxLateness time.Duration, policy string, lateTable string) {
+	t.whereMutex.RLock()
+	maxLateness = t.MaxLateness
+	policy = strings.ToLower(t.LatePolicy)
+	if policy == "" {
+		policy = LatePolicyDrop
+	}
+	lateTable = strings.ToLower(strings.TrimSpace(t.LateTable))
+	t.whereMutex.RUnlock()
+	return
+}
+
+// watermark tracks the latest timestamp of the points that a table received in
+// order to determine which points are late. It's only used by the goroutine
+// that inserts into the table, so it isn't synchronized.
+type watermark struct {
+	latest time.Time
+}
+
+// late advances the watermark to ts and indicates whether ts is more than
+// maxLateness behind it.
+func (w *watermark) late(ts time.Time, maxLateness time.Duration) bool {
+	if ts.After(w.latest) {
+		w.latest = ts
+		return false
+	}
+	return maxLateness > 0 && w.latest.Sub(ts) > maxLateness
+}
+
+// checkLate applies the table's late data policy to a point that the table
+// received. It returns true if the point should be inserted into the table.
+func (t *table) checkLate(ts time.Time) bool {
+	maxLateness, policy, _ := t.getLatePolicy()
+	if t.watermark.latest.IsZero() {
+		// Points that are already on disk count towards the watermark
+		t.highWaterMarkMx.RLock()
+		disk := t.highWaterMarkDisk
+		t.highWaterMarkMx.RUnlock()
+		if disk > 0 {
+			t.watermark.latest = time.Unix(0, disk)
+		}
+	}
+	if !t.watermark.late(ts, maxLateness) {
+		return true
+	}
+
+	t.statsMutex.Lock()
+	t.stats.LatePoints++
+	if policy != LatePolicyApply {
+		t.stats.DroppedPoints++
+	}
+	t.statsMutex.Unlock()
+	metrics.TableLate(t.Name, policy != LatePolicyApply)
+	if t.log.IsTraceEnabled() {
+		t.log.Tracef("Inbound point at %v is later than %v, applying policy %v", ts, maxLateness, policy)
+	}
+	return policy == LatePolicyApply
+}
+
+// routedLate checks whether a point received by this table is late for any of
+// the tables that route late points to it. Since those tables read their
+// stream independently, this table tracks their watermarks itself based on the
+// points that match their WHERE clauses. isLateTable is false if no table
+// routes late points to this one, in which case it receives points as usual.
+func (t *table) routedLate(ts time.Time, dims bytemap.ByteMap) (isLateTable bool, late bool) {
+	if atomic.LoadInt32(&t.db.routesLate) == 0 {
+		// No table routes late points
+		return false, false
+	}
+	t.db.tablesMutex.RLock()
+	var sources []*table
+	for _, other := range t.db.orderedTables {
+		if other != t && !other.View && other.From == t.From {
+			_, policy, lateTable := other.getLatePolicy()
+			if policy == LatePolicyRoute && lateTable == t.Name {
+				sources = append(sources, other)
+			}
+		}
+	}
+	t.db.tablesMutex.RUnlock()
+	if len(sources) == 0 {
+		return false, false
+	}
+
+	if t.sourceWatermarks == nil {
+		t.sourceWatermarks = make(map[string]*watermark)
+	}
+	for _, source := range sources {
+		where := source.getWhere()
+		if where != nil && !where.Eval(dims).(bool) {
+			continue
+		}
+		w := t.sourceWatermarks[source.Name]
+		if w == nil {
+			w = &watermark{}
+			t.sourceWatermarks[source.Name] = w
+		}
+		maxLateness, _, _ := source.getLatePolicy()
+		if w.late(ts, maxLateness) {
+			late = true
+		}
+	}
+	return true, late
+}
@@ -0,0 +1,123 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateLatePolicy(t *testing.T) {
+	assert.NoError(t, validateLatePolicy(&TableOpts{}))
+	assert.NoError(t, validateLatePolicy(&TableOpts{MaxLateness: time.Minute}))
+	assert.NoError(t, validateLatePolicy(&TableOpts{MaxLateness: time.Minute, LatePolicy: "Apply"}))
+	assert.NoError(t, validateLatePolicy(&TableOpts{MaxLateness: time.Minute, LatePolicy: LatePolicyRoute, LateTable: "late"}))
+	assert.Error(t, validateLatePolicy(&TableOpts{MaxLateness: time.Minute, LatePolicy: "unknown"}))
+	assert.Error(t, validateLatePolicy(&TableOpts{MaxLateness: -1 * time.Minute}))
+	assert.Error(t, validateLatePolicy(&TableOpts{LatePolicy: LatePolicyDrop}), "policy should require max lateness")
+	assert.Error(t, validateLatePolicy(&TableOpts{MaxLateness: time.Minute, LatePolicy: LatePolicyRoute}), "routing should require late table")
+	assert.Error(t, validateLatePolicy(&TableOpts{MaxLateness: time.Minute, LateTable: "late"}), "late table should require routing")
+	assert.Error(t, validateLatePolicy(&TableOpts{MaxLateness: time.Minute, LatePolicy: LatePolicyRoute, LateTable: "late", View: true}))
+
+	route := &TableOpts{MaxLateness: time.Minute, LatePolicy: LatePolicyRoute, LateTable: "late", SQL: "SELECT i FROM inbound"}
+	assert.NoError(t, validateLateTables(Schema{"a": route, "late": &TableOpts{SQL: "SELECT i FROM inbound"}}))
+	assert.Error(t, validateLateTables(Schema{"a": route}), "missing late table should fail")
+	assert.Error(t, validateLateTables(Schema{"a": route, "late": &TableOpts{SQL: "SELECT i FROM other"}}), "late table on different stream should fail")
+	assert.Error(t, validateLateTables(Schema{"late": route}), "table shouldn't be its own late table")
+}
+
+func TestLatePolicy(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: vtime.NewVirtualClock(epoch),
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	sqlString := "SELECT i FROM inbound GROUP BY period(1m)"
+	err = db.ApplySchema(Schema{
+		"test_all": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			SQL:             sqlString,
+		},
+		"test_drop": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			MaxLateness:     5 * time.Minute,
+			SQL:             sqlString,
+		},
+		"test_apply": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			MaxLateness:     5 * time.Minute,
+			LatePolicy:      LatePolicyApply,
+			SQL:             sqlString,
+		},
+		"test_route": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			MaxLateness:     5 * time.Minute,
+			LatePolicy:      LatePolicyRoute,
+			LateTable:       "test_late",
+			SQL:             sqlString,
+		},
+		"test_late": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			SQL:             sqlString,
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, offset := range []time.Duration{0, 10 * time.Minute, time.Minute, 8 * time.Minute} {
+		assert.NoError(t, db.Insert("inbound", epoch.Add(offset), map[string]interface{}{"dim": "a"}, map[string]float64{"i": float64(offset / time.Minute)}))
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	query := func(table string) map[time.Duration]float64 {
+		source, err := db.Query("SELECT i FROM "+table+" ASOF '-1h'", false, nil, true)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		result := make(map[time.Duration]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result[time.Unix(0, row.TS).Sub(epoch)] = row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	all := map[time.Duration]float64{0: 0, 10 * time.Minute: 10, time.Minute: 1, 8 * time.Minute: 8}
+	onTime := map[time.Duration]float64{0: 0, 10 * time.Minute: 10, 8 * time.Minute: 8}
+	assert.Equal(t, all, query("test_all"))
+	assert.Equal(t, onTime, query("test_drop"))
+	assert.Equal(t, all, query("test_apply"), "late point should have been applied")
+	assert.Equal(t, onTime, query("test_route"))
+	assert.Equal(t, map[time.Duration]float64{time.Minute: 1}, query("test_late"), "late table should only receive late point")
+
+	for _, table := range []string{"test_drop", "test_route"} {
+		stats := db.TableStats(table)
+		assert.EqualValues(t, 1, stats.LatePoints, table)
+		assert.EqualValues(t, 1, stats.DroppedPoints, table)
+		assert.EqualValues(t, 3, stats.InsertedPoints, table)
+	}
+	stats := db.TableStats("test_apply")
+	assert.EqualValues(t, 1, stats.LatePoints)
+	assert.EqualValues(t, 0, stats.DroppedPoints)
+	assert.EqualValues(t, 4, stats.InsertedPoints)
+	assert.EqualValues(t, 0, db.TableStats("test_all").LatePoints)
+}
@@ -0,0 +1,140 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/election"
+)
+
+const (
+	campaignRetryInterval = 5 * time.Second
+	leaderLookupTimeout   = 5 * time.Second
+)
+
+func (db *DB) initLeaderElection() error {
+	if db.opts.Coordinator == nil {
+		return nil
+	}
+	if !db.opts.Passthrough {
+		return fmt.Errorf("Leader election requires Passthrough")
+	}
+	if db.opts.NodeID == "" {
+		return fmt.Errorf("Leader election requires a NodeID")
+	}
+	db.leading = make(map[string]bool)
+	db.campaignCtx, db.stopCampaigns = context.WithCancel(context.Background())
+	return nil
+}
+
+// campaignFor starts campaigning to become the leader of the given stream, if
+// we aren't already.
+func (db *DB) campaignFor(stream string) {
+	if db.opts.Coordinator == nil {
+		return
+	}
+	db.leadingMx.Lock()
+	_, campaigning := db.leading[stream]
+	if !campaigning {
+		db.leading[stream] = false
+	}
+	db.leadingMx.Unlock()
+	if !campaigning {
+		go db.campaign(stream)
+	}
+}
+
+func (db *DB) campaign(stream string) {
+	e := election.ForStream(stream)
+	for {
+		log.Debugf("Campaigning to lead %v as %v", stream, db.opts.NodeID)
+		lost, err := db.opts.Coordinator.Campaign(db.campaignCtx, e, db.opts.NodeID)
+		if err != nil {
+			if db.campaignCtx.Err() != nil {
+				return
+			}
+			log.Errorf("Unable to campaign to lead %v, will retry: %v", stream, err)
+			time.Sleep(campaignRetryInterval)
+			continue
+		}
+
+		log.Debugf("Elected leader of %v", stream)
+		db.setLeading(stream, true)
+		select {
+		case <-lost:
+			log.Errorf("Lost leadership of %v, disconnecting its followers", stream)
+			db.setLeading(stream, false)
+			db.disconnectFollowers(stream)
+		case <-db.campaignCtx.Done():
+			db.setLeading(stream, false)
+			ctx, cancel := context.WithTimeout(context.Background(), leaderLookupTimeout)
+			if err := db.opts.Coordinator.Resign(ctx, e, db.opts.NodeID); err != nil {
+				log.Errorf("Unable to resign leadership of %v: %v", stream, err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+func (db *DB) setLeading(stream string, leading bool) {
+	db.leadingMx.Lock()
+	db.leading[stream] = leading
+	db.leadingMx.Unlock()
+}
+
+// IsLeader indicates whether this node is the elected leader of the given
+// stream. Without a Coordinator, passthrough nodes lead all of their streams.
+func (db *DB) IsLeader(stream string) bool {
+	if db.opts.Coordinator == nil {
+		return db.opts.Passthrough
+	}
+	db.leadingMx.RLock()
+	defer db.leadingMx.RUnlock()
+	return db.leading[stream]
+}
+
+// checkLeader returns an error if the given follower can't follow the stream
+// from us because we're not its elected leader.
+func (db *DB) checkLeader(f *common.Follow) error {
+	return db.checkLeaderOf(f.Stream)
+}
+
+// checkLeaderOf returns an error naming the elected leader of the given stream
+// if it's not us. Only the leader feeds followers, so it's also the only node
+// that accepts inserts into the stream.
+func (db *DB) checkLeaderOf(stream string) error {
+	if db.opts.Coordinator == nil || db.IsLeader(stream) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), leaderLookupTimeout)
+	defer cancel()
+	leader, err := db.opts.Coordinator.Leader(ctx, election.ForStream(stream))
+	if err != nil || leader == "" {
+		leader = "unknown"
+	}
+	return fmt.Errorf("%v is not the leader of stream %v, the leader is %v", db.opts.NodeID, stream, leader)
+}
+
+// disconnectFollowers disconnects all followers of the given stream.
+func (db *DB) disconnectFollowers(stream string) {
+	db.followersMx.RLock()
+	defer db.followersMx.RUnlock()
+	for _, followers := range db.followersByName {
+		for f := range followers {
+			if f.Stream == stream {
+				f.markFailed()
+			}
+		}
+	}
+}
+
+// resignLeadership stops campaigning and gives up the leadership of all
+// streams.
+func (db *DB) resignLeadership() {
+	if db.stopCampaigns != nil {
+		db.stopCampaigns()
+	}
+}
@@ -0,0 +1,101 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/election"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaderElection(t *testing.T) {
+	coordinator := election.NewMemory()
+	newPassthrough := func(nodeID string) (*DB, func()) {
+		tmpDir, err := ioutil.TempDir("", "zenodbtest")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		db, err := NewDB(&DBOpts{
+			Dir:           tmpDir,
+			Passthrough:   true,
+			NumPartitions: 1,
+			NodeID:        nodeID,
+			Coordinator:   coordinator,
+		})
+		if !assert.NoError(t, err) {
+			os.RemoveAll(tmpDir)
+			t.FailNow()
+		}
+		err = db.ApplySchema(Schema{
+			"test_a": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+			},
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return db, func() {
+			db.Close()
+			os.RemoveAll(tmpDir)
+		}
+	}
+
+	waitForLeader := func(db *DB) bool {
+		for i := 0; i < 100; i++ {
+			if db.IsLeader("inbound") {
+				return true
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+
+	a, closeA := newPassthrough("a")
+	if !assert.True(t, waitForLeader(a), "first node should have been elected") {
+		closeA()
+		return
+	}
+	b, closeB := newPassthrough("b")
+	defer closeB()
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, b.IsLeader("inbound"), "second node shouldn't be elected while first leads")
+
+	err := b.Follow(&common.Follow{
+		Stream:        "inbound",
+		FollowerName:  "follower",
+		Credits:       100,
+		NumPartitions: 1,
+	}, func(data []byte, offset wal.Offset) error {
+		return nil
+	})
+	if assert.Error(t, err, "standby shouldn't accept followers") {
+		assert.Contains(t, err.Error(), "the leader is a")
+	}
+
+	insert := func(db *DB) error {
+		return db.Insert("inbound", time.Now(), map[string]interface{}{"dim": "a"}, map[string]float64{"i": 1})
+	}
+	assert.NoError(t, insert(a), "leader should accept inserts")
+	err = insert(b)
+	if assert.Error(t, err, "standby shouldn't accept inserts") {
+		assert.Contains(t, err.Error(), "the leader is a")
+	}
+	err = b.InsertAtomically([]*StreamPoint{NewStreamPoint("inbound", time.Now(), map[string]interface{}{"dim": "a"}, map[string]float64{"i": 1})})
+	if assert.Error(t, err, "standby shouldn't accept atomic inserts") {
+		assert.Contains(t, err.Error(), "the leader is a")
+	}
+
+	closeA()
+	assert.True(t, waitForLeader(b), "second node should have taken over once first closed")
+	assert.NoError(t, insert(b), "new leader should accept inserts")
+	leader, err := coordinator.Leader(context.Background(), election.ForStream("inbound"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b", leader)
+	assert.NoError(t, b.checkLeader(&common.Follow{Stream: "inbound"}))
+}
@@ -0,0 +1,108 @@
+package zenodb
+
+import (
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/getlantern/zenodb/metrics"
+)
+
+const (
+	// DefaultFlushMemoryRatio is the default for DBOpts.FlushMemoryRatio
+	DefaultFlushMemoryRatio = 0.8
+	// DefaultThrottleMemoryRatio is the default for DBOpts.ThrottleMemoryRatio
+	DefaultThrottleMemoryRatio = 0.9
+
+	memStatsInterval       = 2 * time.Second
+	memoryPressureInterval = 250 * time.Millisecond
+	ingestThrottleInterval = 5 * time.Millisecond
+	maxIngestThrottle      = 250 * time.Millisecond
+)
+
+// relieveMemoryPressure proactively flushes memstores, largest first, while
+// memory usage exceeds FlushMemoryRatio of the memory allowed by
+// MaxMemoryRatio, so that inserts don't have to force flushes once the cap is
+// hit. Returns true if memory was under pressure.
+func (db *DB) relieveMemoryPressure() bool {
+	if db.opts.MaxMemoryRatio <= 0 || db.opts.Passthrough {
+		return false
+	}
+
+	threshold := db.flushMemoryBytes()
+	if atomic.LoadUint64(&db.memory) <= threshold {
+		return false
+	}
+
+	atomic.StoreInt32(&db.memoryPressure, 1)
+	defer atomic.StoreInt32(&db.memoryPressure, 0)
+	for _, ms := range db.memStoreSizes() {
+		if ms.size == 0 {
+			// nothing left to flush
+			break
+		}
+		db.flushMutex.Lock()
+		actual := atomic.LoadUint64(&db.memory)
+		if actual <= threshold {
+			db.flushMutex.Unlock()
+			break
+		}
+		log.Debugf("Memory usage of %v exceeds flush threshold %v, proactively flushing %v", humanize.Bytes(actual), humanize.Bytes(threshold), ms.t.Name)
+		ms.t.forceFlush()
+		metrics.MemoryPressureFlush(ms.t.Name, false)
+		runtime.GC()
+		db.updateMemStats()
+		db.flushMutex.Unlock()
+	}
+	return true
+}
+
+// throttleIngest delays inserting into tables while memory usage exceeds
+// ThrottleMemoryRatio of the memory allowed by MaxMemoryRatio and memstores
+// are being flushed to relieve the pressure, giving the flushes a chance to
+// catch up. It waits at most maxIngestThrottle.
+func (db *DB) throttleIngest() {
+	if db.opts.MaxMemoryRatio <= 0 {
+		return
+	}
+
+	threshold := db.throttleMemoryBytes()
+	underPressure := func() bool {
+		return atomic.LoadUint64(&db.memory) > threshold && atomic.LoadInt32(&db.memoryPressure) == 1
+	}
+	if !underPressure() {
+		return
+	}
+	start := time.Now()
+	for underPressure() && time.Since(start) < maxIngestThrottle {
+		time.Sleep(ingestThrottleInterval)
+	}
+	metrics.IngestThrottled(time.Since(start))
+}
+
+func (db *DB) flushMemoryBytes() uint64 {
+	return uint64(float64(db.maxMemoryBytes()) * db.opts.FlushMemoryRatio)
+}
+
+func (db *DB) throttleMemoryBytes() uint64 {
+	return uint64(float64(db.maxMemoryBytes()) * db.opts.ThrottleMemoryRatio)
+}
+
+// memStoreSizes returns the sizes of the memstores of all tables that can be
+// flushed to free up memory, largest first. In-memory tables are excluded
+// since flushing them doesn't free anything that's within their retention
+// period.
+func (db *DB) memStoreSizes() byCurrentSize {
+	db.tablesMutex.RLock()
+	sizes := make(byCurrentSize, 0, len(db.tables))
+	for _, table := range db.tables {
+		if !table.Virtual && !table.InMemory {
+			sizes = append(sizes, &memStoreSize{table, table.memStoreSize()})
+		}
+	}
+	db.tablesMutex.RUnlock()
+	sort.Sort(sizes)
+	return sizes
+}
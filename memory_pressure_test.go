@@ -0,0 +1,79 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryPressure(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:            tmpDir,
+		MaxMemoryRatio: 1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_pressure": &TableOpts{
+			RetentionPeriod: time.Hour,
+			MaxFlushLatency: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, DefaultFlushMemoryRatio, db.opts.FlushMemoryRatio)
+	assert.Equal(t, DefaultThrottleMemoryRatio, db.opts.ThrottleMemoryRatio)
+	assert.False(t, db.relieveMemoryPressure(), "memory shouldn't be under pressure with the whole system's memory allowed")
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"dim": i}, map[string]float64{"i": 1}))
+	}
+	time.Sleep(250 * time.Millisecond)
+	tbl := db.getTable("test_pressure")
+	if !assert.True(t, tbl.memStoreSize() > 0) {
+		return
+	}
+
+	flushesBefore := pressureFlushes("test_pressure")
+	// Pretend that we're using a lot more memory than we are
+	db.opts.MaxMemoryRatio = 1e-12
+	assert.True(t, db.relieveMemoryPressure())
+	assert.Zero(t, tbl.memStoreSize(), "memstore should have been flushed")
+	assert.Equal(t, flushesBefore+1, pressureFlushes("test_pressure"))
+
+	throttledBefore := metrics.GetStats().Memory.ThrottledInserts
+	start := time.Now()
+	db.throttleIngest()
+	assert.True(t, time.Since(start) < maxIngestThrottle, "shouldn't throttle unless memstores are being flushed")
+	atomic.StoreInt32(&db.memoryPressure, 1)
+	start = time.Now()
+	db.throttleIngest()
+	atomic.StoreInt32(&db.memoryPressure, 0)
+	assert.True(t, time.Since(start) >= maxIngestThrottle, "should throttle while memstores are being flushed")
+	assert.Equal(t, throttledBefore+1, metrics.GetStats().Memory.ThrottledInserts)
+}
+
+func pressureFlushes(table string) int {
+	for _, ts := range metrics.GetStats().Tables {
+		if ts.Table == table {
+			return ts.PressureFlushes
+		}
+	}
+	return 0
+}
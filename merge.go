@@ -7,15 +7,15 @@ import (
 	"os"
 	"time"
 
-	"github.com/golang/snappy"
-
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/errors"
 	"github.com/getlantern/goexpr"
-	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/wal"
 
+	"github.com/getlantern/zenodb/compress"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/encryption"
 	"github.com/getlantern/zenodb/sql"
 )
 
@@ -37,36 +37,67 @@ func (db *DB) FilterAndMerge(table string, whereClause string, shouldSort bool,
 	return t.filterAndMerge(whereClause, shouldSort, outFile, inFiles)
 }
 
-// FileInfo returns information about the given data file
-func FileInfo(inFile string) (highWaterMark time.Time, fieldsString string, fields core.Fields, err error) {
+// FileInfo returns information about the given data file. keyring is only
+// required if the file is encrypted.
+func FileInfo(keyring *encryption.Keyring, inFile string) (highWaterMark time.Time, fieldsString string, fields core.Fields, err error) {
 	fs := &fileStore{
 		filename: inFile,
 	}
+	if isColumnar(inFile) {
+		return fs.columnarInfo(keyring)
+	}
 	file, err := os.OpenFile(fs.filename, os.O_RDONLY, 0)
 	if err != nil {
 		err = errors.New("Unable to open filestore at %v: %v", fs.filename, err)
 		return
 	}
 	defer file.Close()
-	r := snappy.NewReader(file)
+	dr, err := keyring.NewReader(file)
+	if err != nil {
+		err = errors.New("Unable to decrypt filestore at %v: %v", fs.filename, err)
+		return
+	}
+	r, err := compress.NewReader(dr)
+	if err != nil {
+		err = errors.New("Unable to decompress filestore at %v: %v", fs.filename, err)
+		return
+	}
+	defer r.Close()
 	return fs.info(r)
 }
 
 // Check checks all of the given inFiles for readability and returns errors
-// for all files that are in error.
-func Check(inFiles ...string) map[string]error {
+// for all files that are in error. keyring is only required if the files are
+// encrypted.
+func Check(keyring *encryption.Keyring, inFiles ...string) map[string]error {
 	errors := make(map[string]error)
 	for _, inFile := range inFiles {
 		fs := &fileStore{
 			filename: inFile,
 		}
+		if isColumnar(inFile) {
+			if err := checkColumnar(keyring, inFile); err != nil {
+				errors[inFile] = err
+			}
+			continue
+		}
 		file, err := os.OpenFile(fs.filename, os.O_RDONLY, 0)
 		if err != nil {
 			errors[inFile] = fmt.Errorf("Unable to open filestore at %v: %v", fs.filename, err)
 			continue
 		}
 		defer file.Close()
-		r := snappy.NewReader(file)
+		dr, err := keyring.NewReader(file)
+		if err != nil {
+			errors[inFile] = err
+			continue
+		}
+		r, err := compress.NewReader(dr)
+		if err != nil {
+			errors[inFile] = err
+			continue
+		}
+		defer r.Close()
 		_, _, _, err = fs.info(r)
 		if err != nil {
 			errors[inFile] = err
@@ -81,9 +112,6 @@ func Check(inFiles ...string) map[string]error {
 }
 
 func (t *table) filterAndMerge(whereClause string, shouldSort bool, outFile string, inFiles []string) error {
-	okayToReuseBuffers := false
-	rawOkay := false
-
 	filter, err := whereFor(whereClause)
 	if err != nil {
 		return err
@@ -92,7 +120,7 @@ func (t *table) filterAndMerge(whereClause string, shouldSort bool, outFile stri
 	// Find highest offset amongst all infiles
 	var offset wal.Offset
 	for _, inFile := range inFiles {
-		nextOffset, _, offsetErr := readWALOffset(inFile)
+		nextOffset, _, offsetErr := readWALOffset(t.keyring(), inFile)
 		if offsetErr != nil {
 			return errors.New("Unable to read WAL offset from %v: %v", inFile, offsetErr)
 		}
@@ -101,6 +129,15 @@ func (t *table) filterAndMerge(whereClause string, shouldSort bool, outFile stri
 		}
 	}
 
+	return t.writeFiltered(filter, shouldSort, offset, outFile, inFiles)
+}
+
+// writeFiltered writes all rows from inFiles that pass the filter to outFile,
+// recording the given offset in its header.
+func (t *table) writeFiltered(filter goexpr.Expr, shouldSort bool, offset wal.Offset, outFile string, inFiles []string) error {
+	okayToReuseBuffers := false
+	rawOkay := false
+
 	// Create output file
 	out, err := os.OpenFile(outFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
@@ -108,11 +145,27 @@ func (t *table) filterAndMerge(whereClause string, shouldSort bool, outFile stri
 	}
 	defer out.Close()
 
+	// Combine the dictionaries of the inFiles
+	b := newDictionaryBuilder()
+	for _, inFile := range inFiles {
+		fs := &fileStore{
+			t:        t,
+			fields:   t.fields,
+			filename: inFile,
+		}
+		inDict, dictErr := fs.readDictionary()
+		if dictErr != nil {
+			return errors.New("Unable to read dictionary from %v: %v", inFile, dictErr)
+		}
+		b.addDictionary(inDict)
+	}
+	dict := b.build(nil)
+
 	fso := &fileStore{
 		t:      t,
 		fields: t.fields,
 	}
-	cout, err := fso.createOutWriter(out, t.fields, offset, shouldSort)
+	cout, err := fso.createOutWriter(out, t.fields, offset, dict, shouldSort)
 	if err != nil {
 		return errors.New("Unable to create out writer for %v: %v", outFile, err)
 	}
@@ -126,7 +179,7 @@ func (t *table) filterAndMerge(whereClause string, shouldSort bool, outFile stri
 			filename: inFile,
 		}
 		_, err = fs.iterate(t.fields, nil, okayToReuseBuffers, rawOkay, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
-			_, writeErr := fs.doWrite(cout, t.fields, filter, truncateBefore, shouldSort, key, columns, raw)
+			_, writeErr := fs.doWrite(cout, t.fields, filter, dict, truncateBefore, shouldSort, key, columns, raw)
 			return true, writeErr
 		})
 		if err != nil {
@@ -5,15 +5,32 @@ import (
 	"sync"
 	"time"
 
-	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/wal"
 )
 
 var (
 	leaderStats    *LeaderStats
 	followerStats  map[int]*FollowerStats
 	partitionStats map[int]*PartitionStats
+	spillStats     *SpillStats
+	queryStats     *QueryStats
+	memoryStats    *MemoryStats
+	tableStats     map[string]*TableStats
+	tableIngest    map[string]*ingestCounter
+	streamIngest   map[string]*ingestCounter
+	walRetention   map[string]*walRetentionStats
+	queryTargets   map[queryTarget]*QueryTargetStats
+	clockSkews     map[string]time.Duration
 
 	mx sync.RWMutex
+
+	// now is the source of time for rate calculations
+	now = time.Now
+)
+
+const (
+	// rateInterval is the interval over which ingestion rates are calculated
+	rateInterval = 10 * time.Second
 )
 
 func init() {
@@ -24,6 +41,15 @@ func reset() {
 	leaderStats = &LeaderStats{}
 	followerStats = make(map[int]*FollowerStats, 0)
 	partitionStats = make(map[int]*PartitionStats, 0)
+	spillStats = &SpillStats{}
+	queryStats = &QueryStats{}
+	memoryStats = &MemoryStats{}
+	tableStats = make(map[string]*TableStats)
+	tableIngest = make(map[string]*ingestCounter)
+	streamIngest = make(map[string]*ingestCounter)
+	walRetention = make(map[string]*walRetentionStats)
+	queryTargets = make(map[queryTarget]*QueryTargetStats)
+	clockSkews = make(map[string]time.Duration)
 }
 
 // Stats are the overall stats
@@ -31,22 +57,46 @@ type Stats struct {
 	Leader     *LeaderStats
 	Followers  sortedFollowerStats
 	Partitions sortedPartitionStats
+	Spill      *SpillStats
+	Queries    *QueryStats
+	Memory     *MemoryStats
+	Streams    sortedStreamStats
+	Tables     sortedTableStats
+	// QueryTargets are the replicas to which the leader has dispatched queries
+	QueryTargets sortedQueryTargetStats
 }
 
 // LeaderStats provides stats for the cluster leader
 type LeaderStats struct {
 	NumPartitions       int
+	ReplicationFactor   int
 	ConnectedPartitions int
 	ConnectedFollowers  int
 	CurrentlyReadingWAL string
+	// UnderReplicatedPartitions lists the partitions that have fewer connected
+	// followers than the ReplicationFactor
+	UnderReplicatedPartitions []int
 }
 
 // FollowerStats provides stats for a single follower
 type FollowerStats struct {
 	followerId int
+	offset     wal.Offset
+	Name       string
+	Stream     string
 	Partition  int
 	Queued     int
 	Failed     bool
+	LastSeen   time.Time
+	// ClockSkew is how far ahead of the leader's clock the follower's clock is
+	// (negative if behind)
+	ClockSkew time.Duration
+	// SkippedTables lists the tables that the follower requested but that the
+	// leader doesn't have
+	SkippedTables []string
+	// OutOfCredits counts how many times the leader paused reading the WAL for
+	// the follower because it ran out of flow control credits
+	OutOfCredits int
 }
 
 // PartitionStats provides stats for a single partition
@@ -55,6 +105,133 @@ type PartitionStats struct {
 	NumFollowers int
 }
 
+// SpillStats provides stats for data that queries spilled to disk
+type SpillStats struct {
+	BytesInUse    int64
+	FilesInUse    int
+	QuotaExceeded int
+}
+
+// QueryStats provides stats on queries that were coalesced because identical
+// queries were running concurrently
+type QueryStats struct {
+	// Coalesced counts queries that were answered with the results of an
+	// identical query that was already running
+	Coalesced int64
+	// Shared counts query executions whose results were shared with at least
+	// one coalesced query
+	Shared int64
+}
+
+// MemoryStats provides stats on how the database kept its memory usage below
+// the cap set by MaxMemoryRatio
+type MemoryStats struct {
+	// PressureFlushes counts memstores that were flushed proactively because
+	// memory usage exceeded the FlushMemoryRatio
+	PressureFlushes int
+	// ForcedFlushes counts memstores that had to be flushed while inserting
+	// because memory usage exceeded the cap
+	ForcedFlushes int
+	// ThrottledInserts counts inserts that were delayed because memory usage
+	// exceeded the ThrottleMemoryRatio
+	ThrottledInserts int64
+	// ThrottleTime is the total time for which inserts were delayed
+	ThrottleTime time.Duration
+}
+
+// StreamStats provides stats on the data inserted into a single stream
+type StreamStats struct {
+	Stream string
+	// Inserts counts the points inserted into the stream since startup
+	Inserts int64
+	// Bytes counts the bytes of the points inserted into the stream since
+	// startup
+	Bytes int64
+	// InsertsPerSecond is the rate of Inserts over the latest rate interval
+	InsertsPerSecond float64
+	// BytesPerSecond is the rate of Bytes over the latest rate interval
+	BytesPerSecond float64
+	// WALAppendLatency is the average time that it took to append a point to
+	// the stream's WAL over the latest rate interval
+	WALAppendLatency time.Duration
+	// MaxWALAppendLatency is the longest that it took to append a point to the
+	// stream's WAL over the latest rate interval
+	MaxWALAppendLatency time.Duration
+	// RetainedWALBytes is how much of the stream's WAL beyond MaxWALSize was
+	// kept the last time it was truncated, because of MinWALAge or followers
+	// that hadn't acknowledged it yet
+	RetainedWALBytes int64
+	// LaggingFollower names a follower that kept the stream's WAL from being
+	// truncated the last time it was truncated, if any
+	LaggingFollower string
+	// BlockedWALTruncations counts the times that lagging followers kept the
+	// stream's WAL from being truncated to MaxWALSize
+	BlockedWALTruncations int
+}
+
+type walRetentionStats struct {
+	retainedBytes      int64
+	laggingFollower    string
+	blockedTruncations int
+}
+
+// TableStats provides stats on the data inserted into a single table and on
+// its automatic flush tuning
+type TableStats struct {
+	Table string
+	// Inserts counts the points inserted into the table since startup
+	Inserts int64
+	// Bytes counts the bytes of the points inserted into the table since
+	// startup
+	Bytes int64
+	// InsertsPerSecond is the rate of Inserts over the latest rate interval
+	InsertsPerSecond float64
+	// BytesPerSecond is the rate of Bytes over the latest rate interval
+	BytesPerSecond float64
+	// ApplyLatency is the longest that data read from the WAL waited to be
+	// applied to the table's memstore since the prior flush
+	ApplyLatency time.Duration
+	// FlushInterval is how long the table currently waits between flushes
+	FlushInterval time.Duration
+	// FlushIntervalAdjustments counts how many times FlushInterval was adjusted
+	FlushIntervalAdjustments int
+	// PressureFlushes and ForcedFlushes count the table's share of the
+	// corresponding MemoryStats
+	PressureFlushes int
+	ForcedFlushes   int
+	// DedupHits counts points that were dropped because an identical point had
+	// already been inserted within the table's DedupWindow
+	DedupHits int64
+	// LatePoints counts points that were later than the table's MaxLateness
+	// and LateDropped counts those of them that were dropped
+	LatePoints  int64
+	LateDropped int64
+	// InvalidRejected, InvalidCoerced and InvalidDiverted count points that
+	// failed the table's validation and were rejected, coerced into valid
+	// points or diverted to its dead-letter stream, respectively
+	InvalidRejected int64
+	InvalidCoerced  int64
+	InvalidDiverted int64
+}
+
+// QueryTargetStats provides stats on the queries that the leader dispatched to
+// a single replica of a partition
+type QueryTargetStats struct {
+	Partition int
+	Replica   string
+	// Weight is the replica's weight at the time of the latest query
+	Weight float64
+	// Queries counts the queries dispatched to the replica
+	Queries int
+	// Failures counts the queries that failed on the replica
+	Failures int
+}
+
+type queryTarget struct {
+	partition int
+	replica   string
+}
+
 type sortedFollowerStats []*FollowerStats
 
 func (s sortedFollowerStats) Len() int      { return len(s) }
@@ -66,6 +243,83 @@ func (s sortedFollowerStats) Less(i, j int) bool {
 	return s[i].followerId < s[j].followerId
 }
 
+// ingestCounter counts inserted points and bytes, along with their rates over
+// the latest complete rateInterval.
+type ingestCounter struct {
+	inserts          int64
+	bytes            int64
+	insertsPerSecond float64
+	bytesPerSecond   float64
+	latency          time.Duration
+	maxLatency       time.Duration
+
+	windowStart      time.Time
+	windowInserts    int64
+	windowBytes      int64
+	windowLatency    time.Duration
+	windowMaxLatency time.Duration
+}
+
+func (c *ingestCounter) record(ts time.Time, bytes int, latency time.Duration) {
+	c.roll(ts)
+	c.inserts++
+	c.bytes += int64(bytes)
+	c.windowInserts++
+	c.windowBytes += int64(bytes)
+	c.windowLatency += latency
+	if latency > c.windowMaxLatency {
+		c.windowMaxLatency = latency
+	}
+}
+
+// roll calculates the rates for the current window if it's at least
+// rateInterval old and starts a new window.
+func (c *ingestCounter) roll(ts time.Time) {
+	if c.windowStart.IsZero() {
+		c.windowStart = ts
+		return
+	}
+	elapsed := ts.Sub(c.windowStart)
+	if elapsed < rateInterval {
+		return
+	}
+	c.insertsPerSecond = float64(c.windowInserts) / elapsed.Seconds()
+	c.bytesPerSecond = float64(c.windowBytes) / elapsed.Seconds()
+	c.latency = 0
+	if c.windowInserts > 0 {
+		c.latency = c.windowLatency / time.Duration(c.windowInserts)
+	}
+	c.maxLatency = c.windowMaxLatency
+	c.windowStart = ts
+	c.windowInserts = 0
+	c.windowBytes = 0
+	c.windowLatency = 0
+	c.windowMaxLatency = 0
+}
+
+type sortedStreamStats []*StreamStats
+
+func (s sortedStreamStats) Len() int           { return len(s) }
+func (s sortedStreamStats) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sortedStreamStats) Less(i, j int) bool { return s[i].Stream < s[j].Stream }
+
+type sortedTableStats []*TableStats
+
+func (s sortedTableStats) Len() int           { return len(s) }
+func (s sortedTableStats) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sortedTableStats) Less(i, j int) bool { return s[i].Table < s[j].Table }
+
+type sortedQueryTargetStats []*QueryTargetStats
+
+func (s sortedQueryTargetStats) Len() int      { return len(s) }
+func (s sortedQueryTargetStats) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortedQueryTargetStats) Less(i, j int) bool {
+	if s[i].Partition != s[j].Partition {
+		return s[i].Partition < s[j].Partition
+	}
+	return s[i].Replica < s[j].Replica
+}
+
 type sortedPartitionStats []*PartitionStats
 
 func (s sortedPartitionStats) Len() int      { return len(s) }
@@ -81,6 +335,13 @@ func SetNumPartitions(numPartitions int) {
 	mx.Unlock()
 }
 
+// SetReplicationFactor sets the number of followers expected for each partition
+func SetReplicationFactor(replicationFactor int) {
+	mx.Lock()
+	leaderStats.ReplicationFactor = replicationFactor
+	mx.Unlock()
+}
+
 // CurrentlyReadingWAL indicates that we're currently reading the WAL at a given offset
 func CurrentlyReadingWAL(offset wal.Offset) {
 	ts := offset.TS()
@@ -89,16 +350,44 @@ func CurrentlyReadingWAL(offset wal.Offset) {
 	mx.Unlock()
 }
 
-// FollowerJoined records the fact that a follower joined the leader
-func FollowerJoined(followerID int, partition int) {
+// FollowerJoined records the fact that a follower joined the leader. A
+// follower that reconnects may join again with the same followerID, replacing
+// its prior connection.
+// FollowerSkippedTables records the tables that the given follower requested
+// but that the leader doesn't have.
+func FollowerSkippedTables(followerID int, tables []string) {
 	mx.Lock()
 	defer mx.Unlock()
-	fs := getFollowerStats(followerID)
+	fs, found := followerStats[followerID]
+	if found {
+		fs.SkippedTables = tables
+	}
+}
+
+func FollowerJoined(followerID int, name string, stream string, partition int) {
+	mx.Lock()
+	defer mx.Unlock()
+	fs, found := followerStats[followerID]
+	if !found {
+		fs = &FollowerStats{followerId: followerID}
+		followerStats[followerID] = fs
+	} else if !fs.Failed {
+		// Prior connection didn't fail, but it's gone now
+		followerLeft(fs)
+	}
+	leaderStats.ConnectedFollowers++
+	fs.Failed = false
+	fs.Name = name
+	fs.Stream = stream
 	fs.Partition = partition
+	fs.LastSeen = time.Now()
+	fs.ClockSkew = clockSkews[name]
 	ps := partitionStats[partition]
 	if ps == nil {
 		ps = &PartitionStats{Partition: partition}
 		partitionStats[partition] = ps
+	}
+	if ps.NumFollowers == 0 {
 		leaderStats.ConnectedPartitions++
 	}
 	ps.NumFollowers++
@@ -111,15 +400,54 @@ func FollowerFailed(followerID int) {
 	// Only mark failed once
 	fs, found := followerStats[followerID]
 	if found && !fs.Failed {
-		leaderStats.ConnectedFollowers--
+		followerLeft(fs)
 		fs.Failed = true
-		partitionStats[fs.Partition].NumFollowers--
-		if partitionStats[fs.Partition].NumFollowers == 0 {
-			leaderStats.ConnectedPartitions--
+	}
+}
+
+func followerLeft(fs *FollowerStats) {
+	leaderStats.ConnectedFollowers--
+	partitionStats[fs.Partition].NumFollowers--
+	if partitionStats[fs.Partition].NumFollowers == 0 {
+		leaderStats.ConnectedPartitions--
+	}
+}
+
+// FollowerSent records that the follower was sent data up to the given offset
+func FollowerSent(followerID int, offset wal.Offset) {
+	mx.Lock()
+	defer mx.Unlock()
+	fs, found := followerStats[followerID]
+	if found {
+		fs.offset = offset
+		fs.LastSeen = time.Now()
+	}
+}
+
+// FollowerClockSkew records how far ahead of the leader's clock the named
+// follower's clock is
+func FollowerClockSkew(name string, skew time.Duration) {
+	mx.Lock()
+	defer mx.Unlock()
+	clockSkews[name] = skew
+	for _, fs := range followerStats {
+		if fs.Name == name {
+			fs.ClockSkew = skew
 		}
 	}
 }
 
+// FollowerOutOfCredits records that the leader paused reading the WAL for the
+// given follower because it ran out of flow control credits.
+func FollowerOutOfCredits(followerID int) {
+	mx.Lock()
+	defer mx.Unlock()
+	fs, found := followerStats[followerID]
+	if found {
+		fs.OutOfCredits++
+	}
+}
+
 // QueuedForFollower records how many measurements are queued for a given Follower
 func QueuedForFollower(followerID int, queued int) {
 	mx.Lock()
@@ -130,26 +458,215 @@ func QueuedForFollower(followerID int, queued int) {
 	}
 }
 
-func getFollowerStats(followerID int) *FollowerStats {
-	fs, found := followerStats[followerID]
-	if !found {
-		leaderStats.ConnectedFollowers++
-		fs = &FollowerStats{
-			followerId: followerID,
-			Queued:     0,
-		}
-		followerStats[followerID] = fs
+// SpillChanged records a change in the number of bytes and files that queries
+// have spilled to disk
+func SpillChanged(deltaBytes int64, deltaFiles int) {
+	mx.Lock()
+	spillStats.BytesInUse += deltaBytes
+	spillStats.FilesInUse += deltaFiles
+	mx.Unlock()
+}
+
+// SpillQuotaExceeded records that a query failed to spill because it exceeded
+// its disk quota
+func SpillQuotaExceeded() {
+	mx.Lock()
+	spillStats.QuotaExceeded++
+	mx.Unlock()
+}
+
+// QueriesCoalesced records that the results of one query execution were
+// shared with the given number of identical queries.
+func QueriesCoalesced(waiters int) {
+	mx.Lock()
+	queryStats.Coalesced += int64(waiters)
+	queryStats.Shared++
+	mx.Unlock()
+}
+
+// MemoryPressureFlush records that the given table was flushed to relieve
+// memory pressure. forced indicates that memory usage had already exceeded the
+// cap.
+func MemoryPressureFlush(table string, forced bool) {
+	mx.Lock()
+	defer mx.Unlock()
+	ts := tableStatsFor(table)
+	if forced {
+		memoryStats.ForcedFlushes++
+		ts.ForcedFlushes++
+	} else {
+		memoryStats.PressureFlushes++
+		ts.PressureFlushes++
 	}
-	return fs
+}
+
+// IngestThrottled records that an insert was delayed by the given amount to
+// relieve memory pressure.
+func IngestThrottled(delay time.Duration) {
+	mx.Lock()
+	memoryStats.ThrottledInserts++
+	memoryStats.ThrottleTime += delay
+	mx.Unlock()
+}
+
+// FlushTuned records the apply latency of the given table and the flush
+// interval that was chosen based on it.
+func FlushTuned(table string, applyLatency time.Duration, flushInterval time.Duration, adjusted bool) {
+	mx.Lock()
+	defer mx.Unlock()
+	ts := tableStatsFor(table)
+	ts.ApplyLatency = applyLatency
+	ts.FlushInterval = flushInterval
+	if adjusted {
+		ts.FlushIntervalAdjustments++
+	}
+}
+
+// StreamInserted records that a point of the given size was inserted into the
+// given stream, taking the given time to append to the stream's WAL.
+func StreamInserted(stream string, bytes int, walAppendLatency time.Duration) {
+	ts := now()
+	mx.Lock()
+	defer mx.Unlock()
+	ingestCounterFor(streamIngest, stream).record(ts, bytes, walAppendLatency)
+}
+
+// WALRetained records that truncating the given stream's WAL kept the given
+// number of bytes beyond its maximum size. laggingFollower names the follower
+// that hadn't acknowledged the retained data, if that's why it was kept.
+func WALRetained(stream string, retainedBytes int64, laggingFollower string) {
+	mx.Lock()
+	defer mx.Unlock()
+	wr := walRetention[stream]
+	if wr == nil {
+		wr = &walRetentionStats{}
+		walRetention[stream] = wr
+	}
+	wr.retainedBytes = retainedBytes
+	wr.laggingFollower = laggingFollower
+	if laggingFollower != "" {
+		wr.blockedTruncations++
+	}
+}
+
+// TableInserted records that a point of the given size was inserted into the
+// given table.
+func TableInserted(table string, bytes int) {
+	ts := now()
+	mx.Lock()
+	defer mx.Unlock()
+	ingestCounterFor(tableIngest, table).record(ts, bytes, 0)
+}
+
+// TableDeduped records that a point was dropped from the given table as a
+// duplicate.
+func TableDeduped(table string) {
+	mx.Lock()
+	tableStatsFor(table).DedupHits++
+	mx.Unlock()
+}
+
+// TableLate records that a point that was late for the given table was
+// received, and whether it was dropped.
+func TableLate(table string, dropped bool) {
+	mx.Lock()
+	ts := tableStatsFor(table)
+	ts.LatePoints++
+	if dropped {
+		ts.LateDropped++
+	}
+	mx.Unlock()
+}
+
+// TableInvalid records that a point failed the given table's validation and
+// was rejected, coerced or diverted.
+func TableInvalid(table string, rejected bool, coerced bool, diverted bool) {
+	mx.Lock()
+	ts := tableStatsFor(table)
+	if rejected {
+		ts.InvalidRejected++
+	}
+	if coerced {
+		ts.InvalidCoerced++
+	}
+	if diverted {
+		ts.InvalidDiverted++
+	}
+	mx.Unlock()
+}
+
+func tableStatsFor(table string) *TableStats {
+	ts := tableStats[table]
+	if ts == nil {
+		ts = &TableStats{Table: table}
+		tableStats[table] = ts
+	}
+	return ts
+}
+
+func ingestCounterFor(counters map[string]*ingestCounter, name string) *ingestCounter {
+	c := counters[name]
+	if c == nil {
+		c = &ingestCounter{}
+		counters[name] = c
+	}
+	return c
+}
+
+// QueryDispatched records that the leader dispatched a query for the given
+// partition to the named replica, which had the given weight
+func QueryDispatched(partition int, replica string, weight float64) {
+	mx.Lock()
+	defer mx.Unlock()
+	qs := queryTargetStats(partition, replica)
+	qs.Weight = weight
+	qs.Queries++
+}
+
+// QueryTargetFailed records that a query for the given partition failed on the
+// named replica
+func QueryTargetFailed(partition int, replica string) {
+	mx.Lock()
+	defer mx.Unlock()
+	queryTargetStats(partition, replica).Failures++
+}
+
+func queryTargetStats(partition int, replica string) *QueryTargetStats {
+	key := queryTarget{partition, replica}
+	qs := queryTargets[key]
+	if qs == nil {
+		qs = &QueryTargetStats{Partition: partition, Replica: replica}
+		queryTargets[key] = qs
+	}
+	return qs
 }
 
 func GetStats() *Stats {
-	mx.RLock()
+	ts := now()
+	// Lock for writing since getting stats rolls the ingestion rates
+	mx.Lock()
+	leader := *leaderStats
+	leader.UnderReplicatedPartitions = nil
+	for partition := 0; partition < leader.NumPartitions; partition++ {
+		ps := partitionStats[partition]
+		if ps == nil || ps.NumFollowers < leader.ReplicationFactor {
+			leader.UnderReplicatedPartitions = append(leader.UnderReplicatedPartitions, partition)
+		}
+	}
+	spill := *spillStats
+	queries := *queryStats
+	memory := *memoryStats
 	s := &Stats{
-		Leader:     leaderStats,
+		Leader:     &leader,
+		Spill:      &spill,
+		Queries:    &queries,
+		Memory:     &memory,
 		Followers:  make(sortedFollowerStats, 0, len(followerStats)),
 		Partitions: make(sortedPartitionStats, 0, len(partitionStats)),
+		Streams:    make(sortedStreamStats, 0, len(streamIngest)),
+		Tables:     make(sortedTableStats, 0, len(tableStats)),
 	}
+	s.QueryTargets = make(sortedQueryTargetStats, 0, len(queryTargets))
 
 	for _, fs := range followerStats {
 		s.Followers = append(s.Followers, fs)
@@ -157,9 +674,148 @@ func GetStats() *Stats {
 	for _, ps := range partitionStats {
 		s.Partitions = append(s.Partitions, ps)
 	}
-	mx.RUnlock()
+	for name := range walRetention {
+		ingestCounterFor(streamIngest, name)
+	}
+	for name, c := range streamIngest {
+		c.roll(ts)
+		stream := &StreamStats{
+			Stream:              name,
+			Inserts:             c.inserts,
+			Bytes:               c.bytes,
+			InsertsPerSecond:    c.insertsPerSecond,
+			BytesPerSecond:      c.bytesPerSecond,
+			WALAppendLatency:    c.latency,
+			MaxWALAppendLatency: c.maxLatency,
+		}
+		if wr := walRetention[name]; wr != nil {
+			stream.RetainedWALBytes = wr.retainedBytes
+			stream.LaggingFollower = wr.laggingFollower
+			stream.BlockedWALTruncations = wr.blockedTruncations
+		}
+		s.Streams = append(s.Streams, stream)
+	}
+	for name := range tableIngest {
+		if tableStats[name] == nil {
+			tableStats[name] = &TableStats{Table: name}
+		}
+	}
+	for name, stats := range tableStats {
+		table := *stats
+		if c := tableIngest[name]; c != nil {
+			c.roll(ts)
+			table.Inserts = c.inserts
+			table.Bytes = c.bytes
+			table.InsertsPerSecond = c.insertsPerSecond
+			table.BytesPerSecond = c.bytesPerSecond
+		}
+		s.Tables = append(s.Tables, &table)
+	}
+	for _, qs := range queryTargets {
+		target := *qs
+		s.QueryTargets = append(s.QueryTargets, &target)
+	}
+	mx.Unlock()
 
 	sort.Sort(s.Followers)
 	sort.Sort(s.Partitions)
+	sort.Sort(s.Streams)
+	sort.Sort(s.Tables)
+	sort.Sort(s.QueryTargets)
 	return s
 }
+
+// ClusterStatus reports the state of each partition's followers
+type ClusterStatus struct {
+	NumPartitions     int
+	ReplicationFactor int
+	// WALHeads are the latest offsets in the leader's WAL, by stream
+	WALHeads   map[string]string
+	Partitions []*PartitionStatus
+}
+
+// PartitionStatus reports the state of the followers for a single partition
+type PartitionStatus struct {
+	Partition       int
+	NumFollowers    int
+	UnderReplicated bool
+	Followers       []*FollowerStatus
+}
+
+// FollowerStatus reports the state of a single follower
+type FollowerStatus struct {
+	Name   string
+	Stream string
+	Offset string
+	// Lag is how far the follower's offset trails the head of the leader's WAL.
+	// It's based on the timestamps of WAL segments, so it's approximate.
+	Lag       time.Duration
+	Queued    int
+	Failed    bool
+	LastSeen  time.Time
+	ClockSkew time.Duration
+}
+
+// GetClusterStatus reports the status of the cluster, computing the lag of
+// followers relative to the given WAL heads (by stream).
+func GetClusterStatus(walHeads map[string]wal.Offset) *ClusterStatus {
+	mx.RLock()
+	defer mx.RUnlock()
+
+	status := &ClusterStatus{
+		NumPartitions:     leaderStats.NumPartitions,
+		ReplicationFactor: leaderStats.ReplicationFactor,
+		WALHeads:          make(map[string]string, len(walHeads)),
+	}
+	for stream, head := range walHeads {
+		status.WALHeads[stream] = head.String()
+	}
+
+	partitions := make(map[int]*PartitionStatus)
+	partitionFor := func(partition int) *PartitionStatus {
+		ps := partitions[partition]
+		if ps == nil {
+			ps = &PartitionStatus{Partition: partition}
+			partitions[partition] = ps
+			status.Partitions = append(status.Partitions, ps)
+		}
+		return ps
+	}
+	for partition := 0; partition < status.NumPartitions; partition++ {
+		partitionFor(partition)
+	}
+
+	followers := make(sortedFollowerStats, 0, len(followerStats))
+	for _, fs := range followerStats {
+		followers = append(followers, fs)
+	}
+	sort.Sort(followers)
+	for _, fs := range followers {
+		ps := partitionFor(fs.Partition)
+		fstatus := &FollowerStatus{
+			Name:      fs.Name,
+			Stream:    fs.Stream,
+			Offset:    fs.offset.String(),
+			Queued:    fs.Queued,
+			Failed:    fs.Failed,
+			LastSeen:  fs.LastSeen,
+			ClockSkew: fs.ClockSkew,
+		}
+		head := walHeads[fs.Stream]
+		if head != nil && fs.offset != nil && head.After(fs.offset) {
+			fstatus.Lag = head.TS().Sub(fs.offset.TS())
+		}
+		ps.Followers = append(ps.Followers, fstatus)
+		if !fs.Failed {
+			ps.NumFollowers++
+		}
+	}
+
+	for _, ps := range status.Partitions {
+		ps.UnderReplicated = ps.NumFollowers < status.ReplicationFactor
+	}
+	sort.Slice(status.Partitions, func(i, j int) bool {
+		return status.Partitions[i].Partition < status.Partitions[j].Partition
+	})
+	return status
+}
@@ -1,10 +1,11 @@
 package metrics
 
 import (
+	"bytes"
 	"testing"
 	"time"
 
-	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/wal"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -12,11 +13,13 @@ import (
 func TestMetrics(t *testing.T) {
 	reset()
 
+	SetNumPartitions(3)
+	SetReplicationFactor(2)
 	ts := time.Now()
-	FollowerJoined(1, 1)
-	FollowerJoined(2, 1)
-	FollowerJoined(3, 2)
-	FollowerJoined(4, 2)
+	FollowerJoined(1, "a", "inbound", 1)
+	FollowerJoined(2, "b", "inbound", 1)
+	FollowerJoined(3, "c", "inbound", 2)
+	FollowerJoined(4, "d", "inbound", 2)
 	CurrentlyReadingWAL(wal.NewOffsetForTS(ts))
 	QueuedForFollower(1, 11)
 	QueuedForFollower(2, 22)
@@ -27,6 +30,7 @@ func TestMetrics(t *testing.T) {
 	assert.Equal(t, 4, s.Leader.ConnectedFollowers)
 	assert.Equal(t, ts.Format(time.RFC3339), s.Leader.CurrentlyReadingWAL)
 
+	assert.Equal(t, "a", s.Followers[0].Name)
 	assert.Equal(t, 1, s.Followers[0].Partition)
 	assert.Equal(t, 11, s.Followers[0].Queued)
 	assert.Equal(t, 1, s.Followers[1].Partition)
@@ -41,6 +45,24 @@ func TestMetrics(t *testing.T) {
 	assert.Equal(t, 2, s.Partitions[0].NumFollowers)
 	assert.Equal(t, 2, s.Partitions[1].Partition)
 	assert.Equal(t, 2, s.Partitions[1].NumFollowers)
+	assert.Equal(t, []int{0}, s.Leader.UnderReplicatedPartitions)
+
+	FollowerSent(1, wal.NewOffsetForTS(ts.Add(-1*time.Minute)))
+	FollowerClockSkew("a", -10*time.Second)
+	cs := GetClusterStatus(map[string]wal.Offset{"inbound": wal.NewOffsetForTS(ts)})
+	if assert.Len(t, cs.Partitions, 3) {
+		assert.True(t, cs.Partitions[0].UnderReplicated)
+		assert.Empty(t, cs.Partitions[0].Followers)
+		assert.False(t, cs.Partitions[1].UnderReplicated)
+		if assert.Len(t, cs.Partitions[1].Followers, 2) {
+			assert.Equal(t, "a", cs.Partitions[1].Followers[0].Name)
+			assert.Equal(t, 1*time.Minute, cs.Partitions[1].Followers[0].Lag)
+			assert.False(t, cs.Partitions[1].Followers[0].LastSeen.IsZero())
+			assert.Equal(t, -10*time.Second, cs.Partitions[1].Followers[0].ClockSkew)
+			assert.EqualValues(t, 0, cs.Partitions[1].Followers[1].ClockSkew)
+			assert.EqualValues(t, 0, cs.Partitions[1].Followers[1].Lag, "Follower that hasn't been sent anything has unknown lag")
+		}
+	}
 
 	// Fail a couple of followers. Fail each twice to make sure we don't double-
 	// subtract.
@@ -59,6 +81,7 @@ func TestMetrics(t *testing.T) {
 	assert.Equal(t, 1, s.Partitions[0].NumFollowers)
 	assert.Equal(t, 2, s.Partitions[1].Partition)
 	assert.Equal(t, 1, s.Partitions[1].NumFollowers)
+	assert.Equal(t, []int{0, 1, 2}, s.Leader.UnderReplicatedPartitions)
 
 	// Fail remaining followers.
 	FollowerFailed(1)
@@ -68,4 +91,158 @@ func TestMetrics(t *testing.T) {
 
 	assert.True(t, s.Followers[0].Failed)
 	assert.True(t, s.Followers[3].Failed)
+
+	// Rejoin with the same ids, once after failing and once while still connected
+	FollowerJoined(1, "a", "inbound", 1)
+	FollowerJoined(1, "a", "inbound", 1)
+	s = GetStats()
+	assert.Len(t, s.Followers, 4, "rejoining should reuse follower stats")
+	assert.False(t, s.Followers[0].Failed)
+	assert.Equal(t, 1, s.Leader.ConnectedFollowers)
+	assert.Equal(t, 1, s.Leader.ConnectedPartitions)
+	assert.Equal(t, 1, s.Partitions[0].NumFollowers)
+}
+
+func TestIngestStats(t *testing.T) {
+	reset()
+	ts := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return ts }
+	defer func() { now = time.Now }()
+
+	StreamInserted("inbound", 100, 2*time.Millisecond)
+	TableInserted("table_a", 50)
+	ts = ts.Add(5 * time.Second)
+	StreamInserted("inbound", 100, 4*time.Millisecond)
+	TableInserted("table_a", 50)
+	TableInserted("table_b", 10)
+
+	s := GetStats()
+	if assert.Len(t, s.Streams, 1) {
+		assert.Equal(t, "inbound", s.Streams[0].Stream)
+		assert.EqualValues(t, 2, s.Streams[0].Inserts)
+		assert.EqualValues(t, 200, s.Streams[0].Bytes)
+		assert.EqualValues(t, 0, s.Streams[0].InsertsPerSecond, "rate shouldn't be known until rate interval has elapsed")
+	}
+
+	ts = ts.Add(5 * time.Second)
+	s = GetStats()
+	if assert.Len(t, s.Streams, 1) {
+		assert.EqualValues(t, 0.2, s.Streams[0].InsertsPerSecond)
+		assert.EqualValues(t, 20, s.Streams[0].BytesPerSecond)
+		assert.Equal(t, 3*time.Millisecond, s.Streams[0].WALAppendLatency)
+		assert.Equal(t, 4*time.Millisecond, s.Streams[0].MaxWALAppendLatency)
+	}
+	if assert.Len(t, s.Tables, 2) {
+		assert.Equal(t, "table_a", s.Tables[0].Table)
+		assert.EqualValues(t, 2, s.Tables[0].Inserts)
+		assert.EqualValues(t, 10, s.Tables[0].BytesPerSecond)
+		assert.Equal(t, "table_b", s.Tables[1].Table)
+		assert.EqualValues(t, 1, s.Tables[1].Inserts)
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, WritePrometheus(&buf))
+	assert.Contains(t, buf.String(), "# TYPE zenodb_stream_inserts_total counter\nzenodb_stream_inserts_total{stream=\"inbound\"} 2\n")
+	assert.Contains(t, buf.String(), "zenodb_stream_wal_append_latency_seconds{stream=\"inbound\"} 0.003\n")
+	assert.Contains(t, buf.String(), "zenodb_table_bytes_per_second{table=\"table_a\"} 10\n")
+	assert.Equal(t, `a\"b\\c\n`, escapeLabelValue("a\"b\\c\n"))
+}
+
+func TestMemoryStats(t *testing.T) {
+	reset()
+	MemoryPressureFlush("table_a", false)
+	MemoryPressureFlush("table_a", false)
+	MemoryPressureFlush("table_b", true)
+	IngestThrottled(20 * time.Millisecond)
+	IngestThrottled(30 * time.Millisecond)
+
+	s := GetStats()
+	assert.Equal(t, &MemoryStats{PressureFlushes: 2, ForcedFlushes: 1, ThrottledInserts: 2, ThrottleTime: 50 * time.Millisecond}, s.Memory)
+	if assert.Len(t, s.Tables, 2) {
+		assert.Equal(t, 2, s.Tables[0].PressureFlushes)
+		assert.Equal(t, 0, s.Tables[0].ForcedFlushes)
+		assert.Equal(t, 1, s.Tables[1].ForcedFlushes)
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, WritePrometheus(&buf))
+	assert.Contains(t, buf.String(), "zenodb_table_memory_pressure_flushes_total{table=\"table_a\"} 2\n")
+	assert.Contains(t, buf.String(), "zenodb_table_memory_forced_flushes_total{table=\"table_b\"} 1\n")
+	assert.Contains(t, buf.String(), "zenodb_throttled_inserts_total 2\n")
+	assert.Contains(t, buf.String(), "zenodb_throttle_seconds_total 0.05\n")
+}
+
+func TestDedupStats(t *testing.T) {
+	reset()
+	TableDeduped("table_a")
+	TableDeduped("table_a")
+
+	s := GetStats()
+	if assert.Len(t, s.Tables, 1) {
+		assert.EqualValues(t, 2, s.Tables[0].DedupHits)
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, WritePrometheus(&buf))
+	assert.Contains(t, buf.String(), "zenodb_table_dedup_hits_total{table=\"table_a\"} 2\n")
+}
+
+func TestLateStats(t *testing.T) {
+	reset()
+	TableLate("table_a", true)
+	TableLate("table_a", false)
+
+	s := GetStats()
+	if assert.Len(t, s.Tables, 1) {
+		assert.EqualValues(t, 2, s.Tables[0].LatePoints)
+		assert.EqualValues(t, 1, s.Tables[0].LateDropped)
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, WritePrometheus(&buf))
+	assert.Contains(t, buf.String(), "zenodb_table_late_points_total{table=\"table_a\"} 2\n")
+	assert.Contains(t, buf.String(), "zenodb_table_late_dropped_total{table=\"table_a\"} 1\n")
+}
+
+func TestInvalidStats(t *testing.T) {
+	reset()
+	TableInvalid("table_a", true, false, false)
+	TableInvalid("table_a", false, true, false)
+	TableInvalid("table_a", false, false, true)
+	TableInvalid("table_a", false, false, true)
+
+	s := GetStats()
+	if assert.Len(t, s.Tables, 1) {
+		assert.EqualValues(t, 1, s.Tables[0].InvalidRejected)
+		assert.EqualValues(t, 1, s.Tables[0].InvalidCoerced)
+		assert.EqualValues(t, 2, s.Tables[0].InvalidDiverted)
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, WritePrometheus(&buf))
+	assert.Contains(t, buf.String(), "zenodb_table_invalid_rejected_total{table=\"table_a\"} 1\n")
+	assert.Contains(t, buf.String(), "zenodb_table_invalid_diverted_total{table=\"table_a\"} 2\n")
+}
+
+func TestWALRetention(t *testing.T) {
+	reset()
+	WALRetained("inbound", 1000, "follower_a")
+	WALRetained("inbound", 2000, "follower_a")
+
+	s := GetStats()
+	if assert.Len(t, s.Streams, 1) {
+		assert.EqualValues(t, 2000, s.Streams[0].RetainedWALBytes)
+		assert.Equal(t, "follower_a", s.Streams[0].LaggingFollower)
+		assert.Equal(t, 2, s.Streams[0].BlockedWALTruncations)
+	}
+
+	WALRetained("inbound", 0, "")
+	s = GetStats()
+	assert.Empty(t, s.Streams[0].LaggingFollower, "follower caught up")
+	assert.Equal(t, 2, s.Streams[0].BlockedWALTruncations)
+
+	var buf bytes.Buffer
+	assert.NoError(t, WritePrometheus(&buf))
+	assert.Contains(t, buf.String(), "zenodb_stream_wal_truncation_blocked{stream=\"inbound\"} 0\n")
+	assert.Contains(t, buf.String(), "zenodb_stream_wal_truncations_blocked_total{stream=\"inbound\"} 2\n")
 }
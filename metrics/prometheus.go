@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// WritePrometheus writes the current ingestion stats to w in the Prometheus
+// text exposition format.
+func WritePrometheus(w io.Writer) error {
+	s := GetStats()
+	bw := bufio.NewWriter(w)
+
+	family := func(name string, typ string, help string) {
+		fmt.Fprintf(bw, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+	}
+	sample := func(name string, labelName string, labelValue string, value float64) {
+		fmt.Fprintf(bw, "%v{%v=\"%v\"} %v\n", name, labelName, escapeLabelValue(labelValue), strconv.FormatFloat(value, 'g', -1, 64))
+	}
+	single := func(name string, value float64) {
+		fmt.Fprintf(bw, "%v %v\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+	}
+
+	family("zenodb_stream_inserts_total", "counter", "Points inserted into the stream.")
+	for _, ss := range s.Streams {
+		sample("zenodb_stream_inserts_total", "stream", ss.Stream, float64(ss.Inserts))
+	}
+	family("zenodb_stream_bytes_total", "counter", "Bytes of points inserted into the stream.")
+	for _, ss := range s.Streams {
+		sample("zenodb_stream_bytes_total", "stream", ss.Stream, float64(ss.Bytes))
+	}
+	family("zenodb_stream_inserts_per_second", "gauge", "Rate of points inserted into the stream.")
+	for _, ss := range s.Streams {
+		sample("zenodb_stream_inserts_per_second", "stream", ss.Stream, ss.InsertsPerSecond)
+	}
+	family("zenodb_stream_bytes_per_second", "gauge", "Rate of bytes inserted into the stream.")
+	for _, ss := range s.Streams {
+		sample("zenodb_stream_bytes_per_second", "stream", ss.Stream, ss.BytesPerSecond)
+	}
+	family("zenodb_stream_wal_append_latency_seconds", "gauge", "Average time taken to append a point to the stream's WAL.")
+	for _, ss := range s.Streams {
+		sample("zenodb_stream_wal_append_latency_seconds", "stream", ss.Stream, ss.WALAppendLatency.Seconds())
+	}
+	family("zenodb_stream_wal_append_latency_max_seconds", "gauge", "Longest time taken to append a point to the stream's WAL.")
+	for _, ss := range s.Streams {
+		sample("zenodb_stream_wal_append_latency_max_seconds", "stream", ss.Stream, ss.MaxWALAppendLatency.Seconds())
+	}
+	family("zenodb_stream_wal_retained_bytes", "gauge", "Bytes of the stream's WAL kept beyond the maximum WAL size.")
+	for _, ss := range s.Streams {
+		sample("zenodb_stream_wal_retained_bytes", "stream", ss.Stream, float64(ss.RetainedWALBytes))
+	}
+	family("zenodb_stream_wal_truncation_blocked", "gauge", "Whether a lagging follower kept the stream's WAL from being truncated.")
+	for _, ss := range s.Streams {
+		blocked := float64(0)
+		if ss.LaggingFollower != "" {
+			blocked = 1
+		}
+		sample("zenodb_stream_wal_truncation_blocked", "stream", ss.Stream, blocked)
+	}
+	family("zenodb_stream_wal_truncations_blocked_total", "counter", "Times that lagging followers kept the stream's WAL from being truncated.")
+	for _, ss := range s.Streams {
+		sample("zenodb_stream_wal_truncations_blocked_total", "stream", ss.Stream, float64(ss.BlockedWALTruncations))
+	}
+
+	family("zenodb_table_inserts_total", "counter", "Points inserted into the table.")
+	for _, ts := range s.Tables {
+		sample("zenodb_table_inserts_total", "table", ts.Table, float64(ts.Inserts))
+	}
+	family("zenodb_table_bytes_total", "counter", "Bytes of points inserted into the table.")
+	for _, ts := range s.Tables {
+		sample("zenodb_table_bytes_total", "table", ts.Table, float64(ts.Bytes))
+	}
+	family("zenodb_table_inserts_per_second", "gauge", "Rate of points inserted into the table.")
+	for _, ts := range s.Tables {
+		sample("zenodb_table_inserts_per_second", "table", ts.Table, ts.InsertsPerSecond)
+	}
+	family("zenodb_table_bytes_per_second", "gauge", "Rate of bytes inserted into the table.")
+	for _, ts := range s.Tables {
+		sample("zenodb_table_bytes_per_second", "table", ts.Table, ts.BytesPerSecond)
+	}
+
+	family("zenodb_table_memory_pressure_flushes_total", "counter", "Memstore flushes proactively triggered by memory pressure.")
+	for _, ts := range s.Tables {
+		sample("zenodb_table_memory_pressure_flushes_total", "table", ts.Table, float64(ts.PressureFlushes))
+	}
+	family("zenodb_table_memory_forced_flushes_total", "counter", "Memstore flushes forced because memory usage exceeded the cap.")
+	for _, ts := range s.Tables {
+		sample("zenodb_table_memory_forced_flushes_total", "table", ts.Table, float64(ts.ForcedFlushes))
+	}
+	family("zenodb_table_dedup_hits_total", "counter", "Points dropped because an identical point was inserted within the table's dedup window.")
+	for _, ts := range s.Tables {
+		sample("zenodb_table_dedup_hits_total", "table", ts.Table, float64(ts.DedupHits))
+	}
+	family("zenodb_table_late_points_total", "counter", "Points later than the table's max lateness.")
+	for _, ts := range s.Tables {
+		sample("zenodb_table_late_points_total", "table", ts.Table, float64(ts.LatePoints))
+	}
+	family("zenodb_table_late_dropped_total", "counter", "Late points dropped or routed to the table's late table.")
+	for _, ts := range s.Tables {
+		sample("zenodb_table_late_dropped_total", "table", ts.Table, float64(ts.LateDropped))
+	}
+	family("zenodb_table_invalid_rejected_total", "counter", "Points rejected at insert because they failed the table's validation.")
+	for _, ts := range s.Tables {
+		sample("zenodb_table_invalid_rejected_total", "table", ts.Table, float64(ts.InvalidRejected))
+	}
+	family("zenodb_table_invalid_coerced_total", "counter", "Points that failed the table's validation and were coerced into valid points.")
+	for _, ts := range s.Tables {
+		sample("zenodb_table_invalid_coerced_total", "table", ts.Table, float64(ts.InvalidCoerced))
+	}
+	family("zenodb_table_invalid_diverted_total", "counter", "Points that failed the table's validation and were diverted to its dead-letter stream.")
+	for _, ts := range s.Tables {
+		sample("zenodb_table_invalid_diverted_total", "table", ts.Table, float64(ts.InvalidDiverted))
+	}
+
+	family("zenodb_queries_coalesced_total", "counter", "Queries answered with the results of an identical query that was already running.")
+	single("zenodb_queries_coalesced_total", float64(s.Queries.Coalesced))
+	family("zenodb_queries_shared_total", "counter", "Query executions whose results were shared with identical queries.")
+	single("zenodb_queries_shared_total", float64(s.Queries.Shared))
+
+	family("zenodb_throttled_inserts_total", "counter", "Inserts delayed to relieve memory pressure.")
+	single("zenodb_throttled_inserts_total", float64(s.Memory.ThrottledInserts))
+	family("zenodb_throttle_seconds_total", "counter", "Total time for which inserts were delayed to relieve memory pressure.")
+	single("zenodb_throttle_seconds_total", s.Memory.ThrottleTime.Seconds())
+
+	return bw.Flush()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
@@ -0,0 +1,81 @@
+package zenodb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/zenodb/common"
+)
+
+const (
+	// MissingTablesSkip makes the leader skip tables that a follower requests
+	// but that the leader doesn't have, following the remaining tables. Skipped
+	// tables are reported in the follower's stats.
+	MissingTablesSkip = "skip"
+
+	// MissingTablesFail makes the leader refuse to let a follower follow if it
+	// requests any tables that the leader doesn't have.
+	MissingTablesFail = "fail"
+)
+
+// MissingTablesError indicates that a follower requested tables that the
+// leader doesn't have, which usually means that their schemas don't match.
+type MissingTablesError struct {
+	Follower  string
+	Partition int
+	Stream    string
+	Tables    []string
+}
+
+func (err *MissingTablesError) Error() string {
+	return fmt.Sprintf("Follower %d (%v) requested tables on stream %v that leader doesn't have: %v", err.Partition, err.Follower, err.Stream, strings.Join(err.Tables, ", "))
+}
+
+func validateMissingTablesPolicy(policy string) error {
+	switch policy {
+	case MissingTablesSkip, MissingTablesFail:
+		return nil
+	default:
+		return fmt.Errorf("Unknown MissingTablesPolicy '%v', please use '%v' or '%v'", policy, MissingTablesSkip, MissingTablesFail)
+	}
+}
+
+// checkFollowedTables fails with a MissingTablesError if the follower
+// requested tables that we don't have and the MissingTablesPolicy is
+// MissingTablesFail.
+func (db *DB) checkFollowedTables(f *common.Follow) error {
+	if db.opts.MissingTablesPolicy != MissingTablesFail {
+		return nil
+	}
+	missing := db.missingTables(f)
+	if len(missing) == 0 {
+		return nil
+	}
+	return &MissingTablesError{
+		Follower:  f.FollowerName,
+		Partition: f.PartitionNumber,
+		Stream:    f.Stream,
+		Tables:    missing,
+	}
+}
+
+// missingTables lists the tables requested by the follower that we don't have,
+// sorted by name.
+func (db *DB) missingTables(f *common.Follow) []string {
+	seen := make(map[string]bool)
+	var missing []string
+	for _, partition := range f.Partitions {
+		for _, t := range partition.Tables {
+			if seen[t.Name] {
+				continue
+			}
+			seen[t.Name] = true
+			if db.getTable(t.Name) == nil {
+				missing = append(missing, t.Name)
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
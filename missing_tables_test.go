@@ -0,0 +1,69 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissingTables(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = NewDB(&DBOpts{Dir: tmpDir, MissingTablesPolicy: "ignore"})
+	assert.Error(t, err, "unknown policy should be rejected")
+
+	db, err := NewDB(&DBOpts{Dir: tmpDir})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	assert.Equal(t, MissingTablesSkip, db.opts.MissingTablesPolicy, "should default to skipping")
+	if !assert.NoError(t, db.CreateTable(&TableOpts{Name: "present", RetentionPeriod: time.Hour, SQL: "SELECT i FROM inbound"})) {
+		return
+	}
+
+	f := &common.Follow{
+		Stream:       "inbound",
+		FollowerName: "schemafollower",
+		Partitions: map[string]*common.Partition{
+			"":  {Tables: []*common.PartitionTable{{Name: "present"}, {Name: "missing_b"}, {Name: "missing_a"}}},
+			"x": {Tables: []*common.PartitionTable{{Name: "missing_b"}}},
+		},
+	}
+	assert.Equal(t, []string{"missing_a", "missing_b"}, db.missingTables(f))
+	assert.NoError(t, db.checkFollowedTables(f), "skipping shouldn't fail")
+
+	db.opts.MissingTablesPolicy = MissingTablesFail
+	err = db.Follow(f, func(data []byte, offset wal.Offset) error { return nil })
+	if assert.IsType(t, &MissingTablesError{}, err) {
+		mte := err.(*MissingTablesError)
+		assert.Equal(t, "schemafollower", mte.Follower)
+		assert.Equal(t, "inbound", mte.Stream)
+		assert.Equal(t, []string{"missing_a", "missing_b"}, mte.Tables)
+	}
+	f.Partitions = map[string]*common.Partition{"": {Tables: []*common.PartitionTable{{Name: "present"}}}}
+	assert.NoError(t, db.checkFollowedTables(f))
+
+	skippedBy := func(name string) []string {
+		for _, fs := range metrics.GetStats().Followers {
+			if fs.Name == name {
+				return fs.SkippedTables
+			}
+		}
+		return nil
+	}
+	metrics.FollowerJoined(1001, "schemafollower", "inbound", 0)
+	metrics.FollowerSkippedTables(1001, []string{"missing_a"})
+	assert.Equal(t, []string{"missing_a"}, skippedBy("schemafollower"))
+	metrics.FollowerFailed(1001)
+}
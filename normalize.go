@@ -0,0 +1,181 @@
+package zenodb
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// DimNormalization describes how the values of a dimension are normalized
+// before they're written to the WAL, so that variants of the same value like
+// "US", "us" and " US " end up in the same group.
+type DimNormalization struct {
+	// Trim removes leading and trailing whitespace.
+	Trim bool
+	// Lowercase folds values to lower case.
+	Lowercase bool
+	// Map maps known synonyms to their canonical values. It's applied after Trim
+	// and Lowercase, which are also applied to its keys.
+	Map map[string]string
+	// MapFile is the path of a CSV file with additional synonym,canonical pairs.
+	MapFile string
+}
+
+// dimNormalizer is a compiled DimNormalization
+type dimNormalizer struct {
+	trim      bool
+	lowercase bool
+	synonyms  map[string]string
+}
+
+func (n *dimNormalizer) normalize(value string) string {
+	if n.trim {
+		value = strings.TrimSpace(value)
+	}
+	if n.lowercase {
+		value = strings.ToLower(value)
+	}
+	if canonical, found := n.synonyms[value]; found {
+		value = canonical
+	}
+	return value
+}
+
+// buildNormalizers compiles the normalizations defined by the tables in the
+// given schema, keyed by stream and then dimension. Tables that read from the
+// same stream have to agree on how to normalize any given dimension.
+func buildNormalizers(schema Schema) (map[string]map[string]*dimNormalizer, error) {
+	type definition struct {
+		table         string
+		normalization *DimNormalization
+	}
+	definitions := make(map[string]map[string]*definition)
+	for name, opts := range schema {
+		if opts.View || len(opts.Normalize) == 0 {
+			continue
+		}
+		stream, err := sql.TableFor(opts.SQL)
+		if err != nil {
+			return nil, errors.New("Unable to determine stream for table %v: %v", name, err)
+		}
+		byDim := definitions[stream]
+		if byDim == nil {
+			byDim = make(map[string]*definition)
+			definitions[stream] = byDim
+		}
+		for dim, normalization := range opts.Normalize {
+			if normalization == nil {
+				continue
+			}
+			existing := byDim[dim]
+			if existing != nil && !reflect.DeepEqual(existing.normalization, normalization) {
+				return nil, errors.New("Tables %v and %v normalize dimension %v of stream %v differently", existing.table, name, dim, stream)
+			}
+			byDim[dim] = &definition{name, normalization}
+		}
+	}
+
+	normalizers := make(map[string]map[string]*dimNormalizer, len(definitions))
+	for stream, byDim := range definitions {
+		normalizers[stream] = make(map[string]*dimNormalizer, len(byDim))
+		for dim, def := range byDim {
+			n, err := def.normalization.compile()
+			if err != nil {
+				return nil, errors.New("Unable to normalize dimension %v in table %v: %v", dim, def.table, err)
+			}
+			normalizers[stream][dim] = n
+		}
+	}
+	return normalizers, nil
+}
+
+func (dn *DimNormalization) compile() (*dimNormalizer, error) {
+	n := &dimNormalizer{
+		trim:      dn.Trim,
+		lowercase: dn.Lowercase,
+		synonyms:  make(map[string]string, len(dn.Map)),
+	}
+	if dn.MapFile != "" {
+		err := n.loadSynonyms(dn.MapFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Inline synonyms take precedence over ones from the file
+	for synonym, canonical := range dn.Map {
+		n.addSynonym(synonym, canonical)
+	}
+	return n, nil
+}
+
+func (n *dimNormalizer) addSynonym(synonym string, canonical string) {
+	// Match synonyms against values that have already been trimmed and lowercased
+	synonym = (&dimNormalizer{trim: n.trim, lowercase: n.lowercase}).normalize(synonym)
+	n.synonyms[synonym] = canonical
+}
+
+func (n *dimNormalizer) loadSynonyms(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return errors.New("Unable to open synonyms file %v: %v", filename, err)
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.New("Unable to read synonyms file %v: %v", filename, err)
+		}
+		n.addSynonym(record[0], record[1])
+	}
+}
+
+func (db *DB) applyNormalizers(normalizers map[string]map[string]*dimNormalizer) {
+	db.normalizersMx.Lock()
+	db.normalizers = normalizers
+	db.normalizersMx.Unlock()
+}
+
+// normalize applies the normalizations configured for the given stream to the
+// string values of the given dims.
+func (db *DB) normalize(stream string, dims bytemap.ByteMap) bytemap.ByteMap {
+	db.normalizersMx.RLock()
+	normalizers := db.normalizers[stream]
+	db.normalizersMx.RUnlock()
+	if len(normalizers) == 0 {
+		return dims
+	}
+
+	var normalized map[string]interface{}
+	for dim, n := range normalizers {
+		value, ok := dims.Get(dim).(string)
+		if !ok {
+			continue
+		}
+		normalizedValue := n.normalize(value)
+		if normalizedValue == value {
+			continue
+		}
+		if normalized == nil {
+			normalized = dims.AsMap()
+		}
+		normalized[dim] = normalizedValue
+	}
+	if normalized == nil {
+		return dims
+	}
+	return bytemap.New(normalized)
+}
@@ -0,0 +1,92 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	synonymsFile := filepath.Join(tmpDir, "countries.csv")
+	err = ioutil.WriteFile(synonymsFile, []byte("# synonym,canonical\nusa,us\nunited states,us\n"), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var schema Schema
+	err = yaml.Unmarshal([]byte(`
+test_a:
+  retentionperiod: 1h
+  sql: SELECT i FROM inbound GROUP BY *, period(1m)
+  normalize:
+    country:
+      trim: true
+      lowercase: true
+      map:
+        america: us
+      mapfile: `+synonymsFile+`
+test_b:
+  retentionperiod: 1h
+  sql: SELECT i FROM inbound GROUP BY country, period(1m)
+`), &schema)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	if !assert.NoError(t, db.ApplySchema(schema)) {
+		return
+	}
+
+	now := time.Now()
+	for i, country := range []string{"US", " us ", "USA", "United States", "America", "DE"} {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"country": country, "other": i}, map[string]float64{"i": 1}))
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	source, err := db.Query("SELECT i FROM test_b GROUP BY country", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	totals := make(map[string]float64)
+	_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+		totals[row.Key.Get("country").(string)] += row.Values[0]
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"us": 5, "de": 1}, totals)
+
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+			Normalize:       map[string]*DimNormalization{"country": {Trim: true}},
+		},
+		"test_b": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY country, period(1m)",
+			Normalize:       map[string]*DimNormalization{"country": {Lowercase: true}},
+		},
+	})
+	assert.Error(t, err, "conflicting normalizations should be rejected")
+}
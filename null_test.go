@@ -0,0 +1,85 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNulls(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	err = db.ApplySchema(Schema{
+		"requests": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT errors, requests FROM inbound GROUP BY period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now().Truncate(time.Minute)
+	insert := func(ts time.Time, vals map[string]float64) {
+		assert.NoError(t, db.Insert("inbound", ts, nil, vals))
+	}
+	insert(now.Add(-2*time.Minute), map[string]float64{"errors": 1, "requests": 4})
+	// no requests reported for this minute
+	insert(now.Add(-1*time.Minute), map[string]float64{"errors": 2})
+	insert(now, map[string]float64{"errors": 0, "requests": 5})
+	time.Sleep(250 * time.Millisecond)
+
+	query := func(sqlString string) map[time.Time][]float64 {
+		source, err := db.Query(sqlString, false, nil, true)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		values := make(map[time.Time][]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			values[encoding.TimeFromInt(row.TS)] = row.Values
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return values
+	}
+
+	// the minute without requests has no ratio rather than one skewed by a 0
+	assert.Equal(t, map[time.Time][]float64{
+		now.Add(-2 * time.Minute): {0.25},
+		now:                       {0},
+	}, query("SELECT errors / requests AS error_rate FROM requests GROUP BY _"))
+
+	assert.Equal(t, map[time.Time][]float64{
+		now.Add(-2 * time.Minute): {0.25},
+		now.Add(-1 * time.Minute): {-1},
+		now:                       {0},
+	}, query("SELECT COALESCE(errors / requests, -1) AS error_rate FROM requests GROUP BY _"))
+
+	assert.Equal(t, map[time.Time][]float64{
+		now.Add(-1 * time.Minute): {2},
+	}, query("SELECT errors FROM requests GROUP BY _ HAVING requests IS NULL"))
+
+	assert.Equal(t, map[time.Time][]float64{
+		now.Add(-2 * time.Minute): {1},
+		now:                       {0},
+	}, query("SELECT errors FROM requests GROUP BY _ HAVING requests IS NOT NULL"))
+}
@@ -0,0 +1,232 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/wal"
+)
+
+const (
+	leaderAliasesFilename = "leader_aliases"
+)
+
+// ExportPartitionMap exports this leader's replication state, including the
+// offsets that followers have acknowledged and which followers are currently
+// connected, so that it can be imported on a replacement leader with
+// ImportPartitionMap.
+func (db *DB) ExportPartitionMap() *common.PartitionMap {
+	m := &common.PartitionMap{
+		LeaderID:               db.opts.NodeID,
+		NumPartitions:          db.opts.NumPartitions,
+		ConsistentPartitioning: db.opts.ConsistentPartitioning,
+		ExportedAt:             db.clock.Now(),
+	}
+
+	db.followersMx.RLock()
+	defer db.followersMx.RUnlock()
+
+	byKey := make(map[string]*common.FollowerAssignment)
+	for key, ack := range db.followerAcks {
+		id, name, stream, partition, ok := parseFollowerAckKey(key)
+		if !ok {
+			log.Errorf("Not exporting acks with unparseable key %v", key)
+			continue
+		}
+		if name == "" {
+			name = ack.FollowerName
+		}
+		offsets := make(map[string]wal.Offset, len(ack.Tables))
+		for table, offset := range ack.Tables {
+			offsets[table] = offset
+		}
+		byKey[key] = &common.FollowerAssignment{
+			FollowerName:           name,
+			FollowerID:             id,
+			Stream:                 stream,
+			PartitionNumber:        partition,
+			Incarnation:            ack.Incarnation,
+			NumPartitions:          ack.NumPartitions,
+			ConsistentPartitioning: ack.ConsistentPartitioning,
+			Offsets:                offsets,
+		}
+	}
+	for _, followers := range db.followersByName {
+		for f := range followers {
+			key := followerAckKey(f.FollowerID, f.FollowerName, f.Stream, f.PartitionNumber)
+			assignment := byKey[key]
+			if assignment == nil {
+				assignment = &common.FollowerAssignment{
+					FollowerName:           f.FollowerName,
+					FollowerID:             f.FollowerID,
+					Stream:                 f.Stream,
+					PartitionNumber:        f.PartitionNumber,
+					Incarnation:            f.Incarnation,
+					NumPartitions:          f.NumPartitions,
+					ConsistentPartitioning: f.ConsistentPartitioning,
+					Offsets:                make(map[string]wal.Offset),
+				}
+				byKey[key] = assignment
+			}
+			assignment.Connected = true
+		}
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		m.Followers = append(m.Followers, byKey[key])
+	}
+	for name := range db.revokedFollowers {
+		m.RevokedFollowers = append(m.RevokedFollowers, name)
+	}
+	sort.Strings(m.RevokedFollowers)
+	return m
+}
+
+// ImportPartitionMap imports a partition map exported from another leader
+// (typically one that's being replaced) so that followers resume replication
+// from the offsets that they acknowledged to it rather than from their
+// EarliestOffset. The map's offsets only make sense if this leader has the same
+// WAL as the one that exported it, for example because its data directory was
+// restored from that leader. Offsets that are already acknowledged to this
+// leader aren't moved backwards. Revoked followers stay revoked. If the map was
+// exported by a leader with a different NodeID, this leader treats offsets
+// from that leader as its own from now on.
+func (db *DB) ImportPartitionMap(m *common.PartitionMap) error {
+	if m.NumPartitions != db.opts.NumPartitions || m.ConsistentPartitioning != db.opts.ConsistentPartitioning {
+		return errors.New("Partition map was exported with %d partitions (consistent: %v), but this leader has %d (consistent: %v)", m.NumPartitions, m.ConsistentPartitioning, db.opts.NumPartitions, db.opts.ConsistentPartitioning)
+	}
+
+	db.followersMx.Lock()
+	defer db.followersMx.Unlock()
+
+	imported := 0
+	for _, assignment := range m.Followers {
+		if len(assignment.Offsets) == 0 {
+			continue
+		}
+		key := followerAckKey(assignment.FollowerID, assignment.FollowerName, assignment.Stream, assignment.PartitionNumber)
+		existing := db.followerAcks[key]
+		if existing == nil || existing.Incarnation != assignment.Incarnation || existing.NumPartitions != assignment.NumPartitions || existing.ConsistentPartitioning != assignment.ConsistentPartitioning {
+			existing = &followerAck{
+				FollowerName:           assignment.FollowerName,
+				Incarnation:            assignment.Incarnation,
+				NumPartitions:          assignment.NumPartitions,
+				ConsistentPartitioning: assignment.ConsistentPartitioning,
+				Tables:                 make(map[string]wal.Offset, len(assignment.Offsets)),
+			}
+			db.followerAcks[key] = existing
+		}
+		for table, offset := range assignment.Offsets {
+			if offset.After(existing.Tables[table]) {
+				existing.Tables[table] = offset
+			}
+		}
+		imported++
+	}
+
+	revokedChanged := false
+	for _, name := range m.RevokedFollowers {
+		if !db.revokedFollowers[name] {
+			db.revokedFollowers[name] = true
+			revokedChanged = true
+		}
+	}
+
+	if m.LeaderID != "" && m.LeaderID != db.opts.NodeID && !db.leaderAliases[m.LeaderID] {
+		db.leaderAliases[m.LeaderID] = true
+		if err := db.saveLeaderAliases(); err != nil {
+			return err
+		}
+	}
+	if revokedChanged {
+		if err := db.saveRevokedFollowers(); err != nil {
+			return err
+		}
+	}
+	log.Debugf("Imported acknowledged offsets for %d followers from leader %v", imported, m.LeaderID)
+	return db.saveFollowerAcks()
+}
+
+// isLocalLeader indicates whether offsets from the identified leader are
+// expressed in our own WAL, either because it's us or because we imported the
+// leader's partition map.
+func (db *DB) isLocalLeader(leaderID string) bool {
+	if leaderID == "" || leaderID == db.opts.NodeID {
+		return true
+	}
+	db.followersMx.RLock()
+	defer db.followersMx.RUnlock()
+	return db.leaderAliases[leaderID]
+}
+
+// parseFollowerAckKey parses a key generated with followerAckKey.
+func parseFollowerAckKey(key string) (id string, name string, stream string, partition int, ok bool) {
+	last := strings.LastIndex(key, "|")
+	if last < 0 {
+		return
+	}
+	partition, err := strconv.Atoi(key[last+1:])
+	if err != nil {
+		return
+	}
+	rest := key[:last]
+	secondToLast := strings.LastIndex(rest, "|")
+	if secondToLast < 0 {
+		return
+	}
+	stream = rest[secondToLast+1:]
+	follower := rest[:secondToLast]
+	if strings.HasPrefix(follower, "id:") {
+		id = strings.TrimPrefix(follower, "id:")
+	} else {
+		name = follower
+	}
+	ok = true
+	return
+}
+
+// saveLeaderAliases persists the ids of leaders whose partition maps we
+// imported, one per line. Must be called while holding followersMx.
+func (db *DB) saveLeaderAliases() error {
+	if db.opts.ReadOnly {
+		return nil
+	}
+	ids := make([]string, 0, len(db.leaderAliases))
+	for id := range db.leaderAliases {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	err := ioutil.WriteFile(filepath.Join(db.opts.Dir, leaderAliasesFilename), []byte(strings.Join(ids, "\n")), 0644)
+	if err != nil {
+		return errors.New("Unable to save leader aliases: %v", err)
+	}
+	return nil
+}
+
+func (db *DB) loadLeaderAliases() {
+	b, err := ioutil.ReadFile(filepath.Join(db.opts.Dir, leaderAliasesFilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Unable to read leader aliases: %v", err)
+		}
+		return
+	}
+	for _, id := range strings.Split(string(b), "\n") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			db.leaderAliases[id] = true
+		}
+	}
+	log.Debugf("Loaded %d leader aliases", len(db.leaderAliases))
+}
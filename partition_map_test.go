@@ -0,0 +1,153 @@
+package zenodb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionMap(t *testing.T) {
+	oldDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(oldDir)
+	newDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(newDir)
+
+	newDB := func(dir string, nodeID string, numPartitions int) *DB {
+		db := &DB{
+			opts:             &DBOpts{Dir: dir, NodeID: nodeID, NumPartitions: numPartitions},
+			clock:            vtime.RealClock,
+			followersByName:  make(map[string]map[*follower]bool),
+			revokedFollowers: make(map[string]bool),
+			followerAcks:     make(map[string]*followerAck),
+			leaderAliases:    make(map[string]bool),
+		}
+		db.loadRevokedFollowers()
+		db.loadFollowerAcks()
+		db.loadLeaderAliases()
+		return db
+	}
+
+	now := time.Now()
+	early := wal.NewOffsetForTS(now.Add(-1 * time.Hour))
+	acked := wal.NewOffsetForTS(now.Add(-1 * time.Minute))
+
+	old := newDB(oldDir, "leader1", 2)
+	assert.NoError(t, old.AckFollow(&common.FollowAck{
+		Stream:          "stream",
+		PartitionNumber: 1,
+		FollowerName:    "a",
+		FollowerID:      "aid",
+		Incarnation:     "inc",
+		NumPartitions:   2,
+		Offsets:         map[string]wal.Offset{"table": acked},
+	}))
+	connected := &follower{Follow: common.Follow{Stream: "stream", PartitionNumber: 0, FollowerName: "b", NumPartitions: 2}}
+	old.trackFollower(connected)
+	assert.NoError(t, old.RevokeFollower("c"))
+
+	exported := old.ExportPartitionMap()
+	assert.Equal(t, "leader1", exported.LeaderID)
+	assert.Equal(t, 2, exported.NumPartitions)
+	assert.Equal(t, []string{"c"}, exported.RevokedFollowers)
+	if assert.Len(t, exported.Followers, 2) {
+		b, a := exported.Followers[0], exported.Followers[1]
+		assert.Equal(t, "a", a.FollowerName)
+		assert.Equal(t, "aid", a.FollowerID)
+		assert.Equal(t, "stream", a.Stream)
+		assert.Equal(t, 1, a.PartitionNumber)
+		assert.Equal(t, "inc", a.Incarnation)
+		assert.Equal(t, acked, a.Offsets["table"])
+		assert.False(t, a.Connected)
+		assert.Equal(t, "b", b.FollowerName)
+		assert.Empty(t, b.Offsets)
+		assert.True(t, b.Connected)
+	}
+
+	// Round trip through JSON like zeno-cli does
+	b, err := json.Marshal(exported)
+	if !assert.NoError(t, err) {
+		return
+	}
+	m := &common.PartitionMap{}
+	if !assert.NoError(t, json.Unmarshal(b, m)) {
+		return
+	}
+
+	assert.Error(t, newDB(newDir, "leader2", 3).ImportPartitionMap(m), "importing with different partitioning should fail")
+
+	replacement := newDB(newDir, "leader2", 2)
+	if !assert.NoError(t, replacement.ImportPartitionMap(m)) {
+		return
+	}
+	assert.True(t, replacement.FollowerRevoked("c"))
+
+	// Reload to make sure everything was persisted
+	replacement = newDB(newDir, "leader2", 2)
+	assert.True(t, replacement.FollowerRevoked("c"))
+	f := &common.Follow{
+		Stream:          "stream",
+		PartitionNumber: 1,
+		FollowerName:    "a",
+		FollowerID:      "aid",
+		Incarnation:     "inc",
+		NumPartitions:   2,
+		LeaderID:        "leader1",
+		Partitions: map[string]*common.Partition{
+			"": {Tables: []*common.PartitionTable{{Name: "table", Offset: early}}},
+		},
+	}
+	replacement.translateFollow(f)
+	assert.Equal(t, "leader2", f.LeaderID)
+	assert.Equal(t, early, f.Partitions[""].Tables[0].Offset, "offsets from the old leader shouldn't be translated")
+	replacement.applyFollowerAcks(f)
+	assert.Equal(t, acked, f.Partitions[""].Tables[0].Offset, "follower should resume from offset acknowledged to the old leader")
+
+	later := wal.NewOffsetForTS(now)
+	assert.NoError(t, replacement.AckFollow(&common.FollowAck{
+		Stream:          "stream",
+		PartitionNumber: 1,
+		FollowerName:    "a",
+		FollowerID:      "aid",
+		Incarnation:     "inc",
+		NumPartitions:   2,
+		LeaderID:        "leader1",
+		Offsets:         map[string]wal.Offset{"table": later},
+	}))
+	assert.Equal(t, later, replacement.followerAcks[followerAckKey("aid", "a", "stream", 1)].Tables["table"], "acks for offsets from the old leader should be accepted")
+
+	// Importing again shouldn't move acks backwards
+	assert.NoError(t, replacement.ImportPartitionMap(m))
+	assert.Equal(t, later, replacement.followerAcks[followerAckKey("aid", "a", "stream", 1)].Tables["table"])
+}
+
+func TestParseFollowerAckKey(t *testing.T) {
+	id, name, stream, partition, ok := parseFollowerAckKey(followerAckKey("theid", "thename", "thestream", 5))
+	assert.True(t, ok)
+	assert.Equal(t, "theid", id)
+	assert.Empty(t, name)
+	assert.Equal(t, "thestream", stream)
+	assert.Equal(t, 5, partition)
+
+	id, name, stream, partition, ok = parseFollowerAckKey(followerAckKey("", "thename", "thestream", 0))
+	assert.True(t, ok)
+	assert.Empty(t, id)
+	assert.Equal(t, "thename", name)
+	assert.Equal(t, "thestream", stream)
+	assert.Equal(t, 0, partition)
+
+	_, _, _, _, ok = parseFollowerAckKey("garbage")
+	assert.False(t, ok)
+}
@@ -0,0 +1,40 @@
+package zenodb
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// followerJoinedFor returns the channel on which followers of the given
+// partition join. Unless PerPartitionWALReaders is set, all partitions share a
+// single channel whose followers are fed from one WAL reader per stream.
+// Otherwise, each partition gets its own channel and WAL readers, so that
+// followers of one partition that can't keep up don't hold up the others.
+func (db *DB) followerJoinedFor(partition int) chan *follower {
+	if !db.opts.PerPartitionWALReaders {
+		go db.processFollowersOnce.Do(func() {
+			db.processFollowers(db.followerJoined, "")
+		})
+		return db.followerJoined
+	}
+
+	db.partitionJoinedMx.Lock()
+	defer db.partitionJoinedMx.Unlock()
+	followerJoined := db.partitionJoined[partition]
+	if followerJoined == nil {
+		followerJoined = make(chan *follower, 1)
+		db.partitionJoined[partition] = followerJoined
+		go db.processFollowers(followerJoined, fmt.Sprintf(".%d", partition))
+	}
+	return followerJoined
+}
+
+// followerJoinedWithCredits returns a channel on which a single follower that
+// uses credit-based flow control joins. The follower is fed from WAL readers of
+// its own, which stop reading whenever the follower runs out of credits without
+// holding up any other followers. Closing the channel stops the readers.
+func (db *DB) followerJoinedWithCredits() chan *follower {
+	followerJoined := make(chan *follower, 1)
+	go db.processFollowers(followerJoined, fmt.Sprintf(".credits.%d", atomic.AddInt32(&db.lastCreditsReaderID, 1)))
+	return followerJoined
+}
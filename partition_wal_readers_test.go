@@ -0,0 +1,73 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPerPartitionWALReaders(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                    tmpDir,
+		Passthrough:            true,
+		NumPartitions:          2,
+		PerPartitionWALReaders: true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var received int64
+	go db.Follow(&common.Follow{
+		Stream:          "inbound",
+		FollowerName:    "follower",
+		PartitionNumber: 1,
+		// Keep the leader from allocating a large buffer for the follower
+		Credits:       100,
+		NumPartitions: 2,
+		Partitions: map[string]*common.Partition{
+			"": {Tables: []*common.PartitionTable{{Name: "test_a"}}},
+		},
+	}, func(data []byte, offset wal.Offset) error {
+		atomic.AddInt64(&received, 1)
+		return nil
+	})
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"dim": i}, map[string]float64{"i": 1}))
+	}
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt64(&received) > 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.True(t, atomic.LoadInt64(&received) > 0, "follower should have received entries from its partition's WAL reader")
+	assert.True(t, atomic.LoadInt64(&received) < 20, "follower shouldn't have received entries for other partitions")
+
+	assert.True(t, db.followerJoinedFor(1) == db.followerJoinedFor(1), "followers of the same partition should share a WAL reader")
+	assert.False(t, db.followerJoinedFor(0) == db.followerJoinedFor(1), "followers of different partitions shouldn't share a WAL reader")
+	assert.False(t, db.followerJoinedFor(0) == db.followerJoined, "partitions shouldn't use the shared WAL reader")
+}
@@ -0,0 +1,433 @@
+package zenodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/wal"
+)
+
+const (
+	partitioningFilename = "_partitioning"
+	rebalanceDir         = "_rebalance"
+)
+
+// partitioning determines which partition a point belongs to. All nodes in a
+// cluster need to agree on the partitioning.
+type partitioning struct {
+	NumPartitions int
+	// Consistent, if true, uses jump consistent hashing instead of a simple
+	// modulo. When scaling from n to m partitions, this only moves about
+	// (m-n)/m of the keys, and only onto the new partitions.
+	Consistent bool
+}
+
+func (p partitioning) String() string {
+	scheme := "modulo"
+	if p.Consistent {
+		scheme = "consistent"
+	}
+	return fmt.Sprintf("%d partitions (%v)", p.NumPartitions, scheme)
+}
+
+func (p partitioning) partitionFor(h hash.Hash32, dims bytemap.ByteMap, partitionKeys []string) int {
+	h.Reset()
+	if len(partitionKeys) > 0 {
+		// Use specific partition keys
+		for _, partitionKey := range partitionKeys {
+			b := dims.GetBytes(partitionKey)
+			if len(b) > 0 {
+				h.Write(b)
+			}
+		}
+	} else {
+		// Use all dims
+		h.Write(dims)
+	}
+	if p.Consistent {
+		return jumpHash(uint64(h.Sum32()), p.NumPartitions)
+	}
+	return int(h.Sum32()) % p.NumPartitions
+}
+
+// jumpHash implements "A Fast, Minimal Memory, Consistent Hash Algorithm" by
+// Lamping and Veach (https://arxiv.org/abs/1406.2294).
+func jumpHash(key uint64, numBuckets int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func (db *DB) partitioning() partitioning {
+	return partitioning{NumPartitions: db.opts.NumPartitions, Consistent: db.opts.ConsistentPartitioning}
+}
+
+// checkPartitioning makes sure that a follower partitions data the same way
+// that we do. Followers that don't report their partitioning are allowed for
+// backwards compatibility.
+func (db *DB) checkPartitioning(f *common.Follow) error {
+	if f.NumPartitions == 0 {
+		return nil
+	}
+	theirs := partitioning{NumPartitions: f.NumPartitions, Consistent: f.ConsistentPartitioning}
+	ours := db.partitioning()
+	if theirs != ours {
+		return errors.New("Follower %d uses %v but leader uses %v", f.PartitionNumber, theirs, ours)
+	}
+	return nil
+}
+
+// detectPartitioningChange checks whether the partitioning of this follower
+// has changed since the last time it ran. If so, tables will rebalance when
+// they're opened.
+func (db *DB) detectPartitioningChange() {
+	if db.opts.Follow == nil || db.opts.ReadOnly {
+		return
+	}
+	b, err := ioutil.ReadFile(filepath.Join(db.opts.Dir, partitioningFilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Unable to read prior partitioning: %v", err)
+		}
+		return
+	}
+	previous := partitioning{}
+	err = json.Unmarshal(b, &previous)
+	if err != nil {
+		log.Errorf("Unable to parse prior partitioning: %v", err)
+		return
+	}
+	if previous.NumPartitions > 0 && previous != db.partitioning() {
+		log.Debugf("Partitioning changed from %v to %v, will rebalance", previous, db.partitioning())
+		db.previousPartitioning = &previous
+	}
+}
+
+// savePartitioning remembers the current partitioning so that we can detect
+// changes on the next run. This is done only after tables have been opened
+// (and hence have recorded their rebalance state).
+func (db *DB) savePartitioning() {
+	if db.opts.Follow == nil || db.opts.ReadOnly {
+		return
+	}
+	b, err := json.Marshal(db.partitioning())
+	if err != nil {
+		log.Errorf("Unable to encode partitioning: %v", err)
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(db.opts.Dir, partitioningFilename), b, 0644)
+	if err != nil {
+		log.Errorf("Unable to save partitioning: %v", err)
+	}
+}
+
+// rebalance tracks the progress of a table that's re-requesting data from the
+// leader after the partitioning changed.
+type rebalance struct {
+	// From is the partitioning prior to the change
+	From partitioning
+	// Until is the WAL offset that the table had reached at the time of the
+	// change. Up to here, the table only accepts points that moved into its
+	// partition (if Selective).
+	Until wal.Offset
+	// Selective indicates that the table kept the data that remained in its
+	// partition. If false, the table dropped all of its data and rebuilds it
+	// from scratch.
+	Selective bool
+	// Prepared indicates that the data on disk has been rebalanced and the
+	// table is ready to re-request data from the leader.
+	Prepared bool
+}
+
+func (t *table) rebalanceFile() string {
+	return filepath.Join(t.db.opts.Dir, rebalanceDir, t.Name)
+}
+
+// rebalancedFileStore is where we write the filestore containing only the
+// keys that remained in our partition, prior to moving it into place.
+func (t *table) rebalancedFileStore() string {
+	return filepath.Join(t.db.opts.Dir, rebalanceDir, t.Name+".dat")
+}
+
+// prepareRebalance is called when opening the row store of a follower and
+// rebalances the existing data on disk if the partitioning has changed. It
+// returns the filestore and WAL offset from which to continue.
+//
+// Rebalancing proceeds in the following steps, any of which can be resumed
+// after a crash:
+//
+//  1. Write the keys that remained in our partition to a new filestore
+//  2. Save the rebalance state
+//  3. Replace the contents of the row store dir with the new filestore
+//  4. Mark the rebalance state as prepared
+func (t *table) prepareRebalance(dir string, existingFileName string, walOffset wal.Offset) (string, wal.Offset, error) {
+	if t.db == nil || t.db.opts.Follow == nil || t.db.opts.ReadOnly {
+		return existingFileName, walOffset, nil
+	}
+
+	rb, err := t.loadRebalance()
+	if err != nil {
+		return "", nil, err
+	}
+	if rb != nil && rb.Prepared {
+		if walOffset.After(rb.Until) {
+			t.log.Debugf("Finished rebalancing from %v", rb.From)
+			os.Remove(t.rebalanceFile())
+		} else {
+			t.log.Debugf("Resuming rebalancing from %v until %v", rb.From, rb.Until)
+			t.rebalance = rb
+		}
+		return existingFileName, walOffset, nil
+	}
+
+	if rb == nil {
+		from := t.db.previousPartitioning
+		if from == nil || walOffset == nil {
+			// Nothing to rebalance
+			return existingFileName, walOffset, nil
+		}
+
+		rb = &rebalance{From: *from, Until: walOffset, Selective: t.canRebalanceSelectively()}
+		if rb.Selective && existingFileName != "" {
+			t.log.Debugf("Partitioning changed from %v, dropping keys that moved out of partition %d", from, t.db.opts.Partition)
+			filter := &partitionFilter{
+				partitioning:  t.db.partitioning(),
+				partitionKeys: t.PartitionBy,
+				partition:     t.db.opts.Partition,
+				h:             partitionHash(),
+			}
+			err = os.MkdirAll(filepath.Dir(t.rebalancedFileStore()), 0755)
+			if err != nil && !os.IsExist(err) {
+				return "", nil, errors.New("Unable to create rebalance dir: %v", err)
+			}
+			// Start with an empty offset so that we re-request everything within
+			// the retention period
+			err = t.writeFiltered(filter, false, make(wal.Offset, wal.OffsetSize), t.rebalancedFileStore(), []string{existingFileName})
+			if err != nil {
+				return "", nil, errors.New("Unable to drop keys that moved out of partition: %v", err)
+			}
+		} else {
+			t.log.Debugf("Partitioning changed from %v and table can't be rebalanced selectively, rebuilding from leader", from)
+		}
+		err = t.saveRebalance(rb)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	_, statErr := os.Stat(t.rebalancedFileStore())
+	haveRebalancedFileStore := statErr == nil
+	newFileName := ""
+	if haveRebalancedFileStore || !rb.Selective {
+		// Replace the contents of the dir. If we're selective but the rebalanced
+		// filestore is already gone, we've already moved it into place.
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return "", nil, errors.New("Unable to list files for rebalancing: %v", err)
+		}
+		for _, file := range files {
+			filename := filepath.Join(dir, file.Name())
+			rmErr := os.Remove(filename)
+			if rmErr != nil {
+				return "", nil, errors.New("Unable to remove %v for rebalancing: %v", filename, rmErr)
+			}
+		}
+		if haveRebalancedFileStore {
+			newFileName = filepath.Join(dir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), CurrentFileVersion))
+			err = os.Rename(t.rebalancedFileStore(), newFileName)
+			if err != nil {
+				return "", nil, errors.New("Unable to move rebalanced filestore into place: %v", err)
+			}
+		}
+	} else {
+		newFileName = existingFileName
+	}
+
+	rb.Prepared = true
+	err = t.saveRebalance(rb)
+	if err != nil {
+		return "", nil, err
+	}
+	t.rebalance = rb
+	return newFileName, nil, nil
+}
+
+func (t *table) loadRebalance() (*rebalance, error) {
+	b, err := ioutil.ReadFile(t.rebalanceFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.New("Unable to read rebalance state for %v: %v", t.Name, err)
+	}
+	rb := &rebalance{}
+	err = json.Unmarshal(b, rb)
+	if err != nil {
+		return nil, errors.New("Unable to parse rebalance state for %v: %v", t.Name, err)
+	}
+	return rb, nil
+}
+
+func (t *table) saveRebalance(rb *rebalance) error {
+	b, err := json.Marshal(rb)
+	if err != nil {
+		return errors.New("Unable to encode rebalance state: %v", err)
+	}
+	err = os.MkdirAll(filepath.Dir(t.rebalanceFile()), 0755)
+	if err != nil && !os.IsExist(err) {
+		return errors.New("Unable to create rebalance dir: %v", err)
+	}
+	err = ioutil.WriteFile(t.rebalanceFile(), b, 0644)
+	if err != nil {
+		return errors.New("Unable to save rebalance state: %v", err)
+	}
+	return nil
+}
+
+// canRebalanceSelectively determines whether we can tell the partition of the
+// keys stored in this table, which is only possible if the table partitions on
+// specific dimensions and groups by all of them.
+func (t *table) canRebalanceSelectively() bool {
+	if len(t.PartitionBy) == 0 {
+		return false
+	}
+	if t.GroupByAll {
+		return true
+	}
+	for _, partitionKey := range t.PartitionBy {
+		found := false
+		for _, groupBy := range t.GroupBy {
+			if groupBy.Name == partitionKey && groupBy.Expr.String() == goexpr.Param(partitionKey).String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// alreadyHave checks whether a point that's being re-requested during a
+// rebalance was already in this partition prior to the rebalance.
+func (t *table) alreadyHave(h hash.Hash32, dims bytemap.ByteMap, offset wal.Offset) bool {
+	rb := t.rebalance
+	if rb == nil || !rb.Selective || offset.After(rb.Until) {
+		return false
+	}
+	return rb.From.partitionFor(h, dims, t.PartitionBy) == t.db.opts.Partition
+}
+
+// partitionFilter is a goexpr.Expr that evaluates to true for keys belonging to
+// the given partition.
+type partitionFilter struct {
+	partitioning  partitioning
+	partitionKeys []string
+	partition     int
+	h             hash.Hash32
+}
+
+func (e *partitionFilter) Eval(params goexpr.Params) interface{} {
+	dims, ok := params.(bytemap.ByteMap)
+	if !ok {
+		return true
+	}
+	return e.partitioning.partitionFor(e.h, dims, e.partitionKeys) == e.partition
+}
+
+func (e *partitionFilter) WalkParams(cb func(string)) {
+	for _, key := range e.partitionKeys {
+		cb(key)
+	}
+}
+
+func (e *partitionFilter) WalkOneToOneParams(cb func(string)) {
+}
+
+func (e *partitionFilter) WalkLists(cb func(goexpr.List)) {
+}
+
+func (e *partitionFilter) String() string {
+	return fmt.Sprintf("PARTITION(%d)", e.partition)
+}
+
+// recordFollowerPartitionKeys records the keys by which the given follower
+// partitions the named table. Followers are identified by partition and name,
+// so a follower that rejoins replaces what it reported before.
+func (db *DB) recordFollowerPartitionKeys(f *follower, tableName string, keys []string) {
+	db.followersMx.Lock()
+	defer db.followersMx.Unlock()
+	byFollower := db.followerPartitionKeys[tableName]
+	if byFollower == nil {
+		byFollower = make(map[string][]string)
+		db.followerPartitionKeys[tableName] = byFollower
+	}
+	byFollower[followerPartitionKeysID(f)] = keys
+}
+
+// forgetFollowerPartitionKeys removes the keys recorded for the given follower
+// once no other connection from the same follower remains, so that followers
+// that have gone away don't hold up pushdown. Must be called while holding
+// followersMx.
+func (db *DB) forgetFollowerPartitionKeys(f *follower) {
+	for other := range db.followersByName[f.FollowerName] {
+		if other.PartitionNumber == f.PartitionNumber {
+			// follower is still connected
+			return
+		}
+	}
+	id := followerPartitionKeysID(f)
+	for tableName, byFollower := range db.followerPartitionKeys {
+		delete(byFollower, id)
+		if len(byFollower) == 0 {
+			delete(db.followerPartitionKeys, tableName)
+		}
+	}
+}
+
+func followerPartitionKeysID(f *follower) string {
+	return fmt.Sprintf("%d/%v", f.PartitionNumber, f.FollowerName)
+}
+
+// partitionKeysFor returns the keys by which the data for the given table is
+// partitioned across the cluster. When all followers agree on the keys, every
+// group whose dimensions include those keys resides wholly on one partition,
+// so queries grouped by them can be pushed down and their results streamed
+// straight through without merging them on the leader. The leader's own
+// PartitionBy is only used until followers have reported their keys. If
+// followers disagree, this returns nil so that queries aren't pushed down.
+func (db *DB) partitionKeysFor(t *table) []string {
+	db.followersMx.RLock()
+	defer db.followersMx.RUnlock()
+	var agreed []string
+	agreedString := ""
+	first := true
+	for follower, keys := range db.followerPartitionKeys[t.Name] {
+		keysString := strings.Join(keys, "|")
+		if first {
+			agreed, agreedString, first = keys, keysString, false
+		} else if keysString != agreedString {
+			log.Debugf("Follower %v partitions %v by %v instead of %v, not treating it as partitioned", follower, t.Name, keys, agreed)
+			return nil
+		}
+	}
+	if first {
+		return t.PartitionBy
+	}
+	return agreed
+}
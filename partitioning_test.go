@@ -0,0 +1,159 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/sql"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsistentPartitioning(t *testing.T) {
+	h := partitionHash()
+	from := partitioning{NumPartitions: 5, Consistent: true}
+	to := partitioning{NumPartitions: 8, Consistent: true}
+	moved := 0
+	numKeys := 10000
+	for i := 0; i < numKeys; i++ {
+		dims := bytemap.New(map[string]interface{}{"k": fmt.Sprint(i)})
+		before := from.partitionFor(h, dims, nil)
+		after := to.partitionFor(h, dims, nil)
+		if before != after {
+			moved++
+			assert.True(t, after >= from.NumPartitions, "keys should only move to new partitions")
+		}
+	}
+	// Expect about 3/8 of keys to move
+	assert.InDelta(t, 0.375, float64(moved)/float64(numKeys), 0.05)
+}
+
+func TestCheckPartitioning(t *testing.T) {
+	db := &DB{opts: &DBOpts{NumPartitions: 4}}
+	assert.NoError(t, db.checkPartitioning(&common.Follow{}), "followers that don't report partitioning should be allowed")
+	assert.NoError(t, db.checkPartitioning(&common.Follow{NumPartitions: 4}))
+	assert.Error(t, db.checkPartitioning(&common.Follow{NumPartitions: 5}))
+	assert.Error(t, db.checkPartitioning(&common.Follow{NumPartitions: 4, ConsistentPartitioning: true}))
+}
+
+func TestPartitionKeysFor(t *testing.T) {
+	db := &DB{opts: &DBOpts{NumPartitions: 2}, followerPartitionKeys: make(map[string]map[string][]string)}
+	tb := &table{TableOpts: &TableOpts{Name: "t", PartitionBy: []string{"a"}}, db: db}
+	assert.Equal(t, []string{"a"}, db.partitionKeysFor(tb), "should use own keys until followers report theirs")
+
+	db.recordFollowerPartitionKeys(&follower{Follow: common.Follow{FollowerName: "f0", PartitionNumber: 0}}, "t", []string{"a", "b"})
+	db.recordFollowerPartitionKeys(&follower{Follow: common.Follow{FollowerName: "f1", PartitionNumber: 1}}, "t", []string{"a", "b"})
+	assert.Equal(t, []string{"a", "b"}, db.partitionKeysFor(tb), "should use keys that followers agree on")
+
+	db.recordFollowerPartitionKeys(&follower{Follow: common.Follow{FollowerName: "f1", PartitionNumber: 1}}, "t", []string{"a"})
+	assert.Nil(t, db.partitionKeysFor(tb), "followers that disagree shouldn't be treated as partitioned")
+
+	f0 := &follower{Follow: common.Follow{FollowerName: "f0", PartitionNumber: 0}}
+	db.recordFollowerPartitionKeys(f0, "t", []string{"a"})
+	assert.Equal(t, []string{"a"}, db.partitionKeysFor(tb), "rejoined followers should replace their earlier keys")
+
+	db.recordFollowerPartitionKeys(&follower{Follow: common.Follow{FollowerName: "f1", PartitionNumber: 1}}, "t", []string{"b"})
+	assert.Nil(t, db.partitionKeysFor(tb))
+	db.untrackFollower(&follower{Follow: common.Follow{FollowerName: "f1", PartitionNumber: 1}})
+	assert.Equal(t, []string{"a"}, db.partitionKeysFor(tb), "followers that have gone away should be forgotten")
+
+	db.followersByName = map[string]map[*follower]bool{"f0": {f0: true}}
+	db.untrackFollower(&follower{Follow: common.Follow{FollowerName: "f0", PartitionNumber: 0}})
+	assert.Equal(t, []string{"a"}, db.partitionKeysFor(tb), "followers that are still connected should be remembered")
+	db.untrackFollower(f0)
+	assert.Empty(t, db.followerPartitionKeys, "should fall back to own keys once all followers are gone")
+}
+
+func TestRebalance(t *testing.T) {
+	db := &DB{opts: &DBOpts{NumPartitions: 3, Partition: 1}}
+	tb := &table{
+		TableOpts: &TableOpts{PartitionBy: []string{"a"}},
+		Query:     sql.Query{GroupBy: []core.GroupBy{core.NewGroupBy("a", goexpr.Param("a"))}},
+		db:        db,
+	}
+	assert.True(t, tb.canRebalanceSelectively())
+	tb.Query.GroupBy = []core.GroupBy{core.NewGroupBy("b", goexpr.Param("b"))}
+	assert.False(t, tb.canRebalanceSelectively())
+	tb.Query.GroupByAll = true
+	assert.True(t, tb.canRebalanceSelectively())
+	tb.PartitionBy = nil
+	assert.False(t, tb.canRebalanceSelectively())
+	tb.PartitionBy = []string{"a"}
+
+	now := time.Now()
+	until := wal.NewOffsetForTS(now)
+	from := partitioning{NumPartitions: 2}
+	tb.rebalance = &rebalance{From: from, Until: until, Selective: true}
+	h := partitionHash()
+	for i := 0; i < 100; i++ {
+		dims := bytemap.New(map[string]interface{}{"a": i})
+		hadBefore := from.partitionFor(h, dims, tb.PartitionBy) == 1
+		assert.Equal(t, hadBefore, tb.alreadyHave(h, dims, until))
+		assert.False(t, tb.alreadyHave(h, dims, wal.NewOffsetForTS(now.Add(time.Hour))), "should accept everything after rebalance point")
+	}
+}
+
+func TestPrepareRebalanceRebuild(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db := &DB{
+		opts: &DBOpts{
+			Dir:           tmpDir,
+			NumPartitions: 3,
+			Follow:        func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error) {},
+		},
+		previousPartitioning: &partitioning{NumPartitions: 2},
+	}
+	newTable := func() *table {
+		return &table{TableOpts: &TableOpts{Name: "tbl"}, db: db, log: golog.LoggerFor("rebalancetest")}
+	}
+	dir := filepath.Join(tmpDir, "tbl")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	existingFile := filepath.Join(dir, "filestore_1_2.dat")
+	assert.NoError(t, ioutil.WriteFile(existingFile, []byte("data"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, offsetFilename), []byte("offset"), 0644))
+
+	until := wal.NewOffsetForTS(time.Now())
+	tb := newTable()
+	fileName, offset, err := tb.prepareRebalance(dir, existingFile, until)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, fileName, "table without partition keys should drop existing data")
+	assert.Nil(t, offset, "should re-request everything")
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+	if assert.NotNil(t, tb.rebalance) {
+		assert.False(t, tb.rebalance.Selective)
+		assert.True(t, tb.rebalance.Prepared)
+	}
+
+	// Resume after restart
+	db.previousPartitioning = nil
+	tb = newTable()
+	_, offset, err = tb.prepareRebalance(dir, "", wal.NewOffsetForTS(time.Now().Add(-1*time.Hour)))
+	assert.NoError(t, err)
+	assert.NotNil(t, offset)
+	assert.NotNil(t, tb.rebalance, "should still be rebalancing")
+
+	// Finish
+	tb = newTable()
+	_, _, err = tb.prepareRebalance(dir, "", wal.NewOffsetForTS(time.Now().Add(1*time.Hour)))
+	assert.NoError(t, err)
+	assert.Nil(t, tb.rebalance)
+	_, err = os.Stat(tb.rebalanceFile())
+	assert.True(t, os.IsNotExist(err), "rebalance state should have been removed")
+}
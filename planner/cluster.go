@@ -18,6 +18,23 @@ const (
 
 type QueryClusterFN func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error)
 
+// ClusterSource is a core.Source that runs a query on every partition of a
+// cluster.
+type ClusterSource interface {
+	core.Source
+
+	// ClusterSQL returns the SQL that's run on each partition
+	ClusterSQL() string
+
+	// IsSubQuery indicates whether the partitions run the query as a subquery
+	IsSubQuery() bool
+
+	// Pushdown indicates whether the entire query is pushed down to the
+	// partitions, in which case the leader simply combines their results.
+	// Otherwise, the leader groups the results from the partitions itself.
+	Pushdown() bool
+}
+
 type clusterSource struct {
 	opts          *Opts
 	query         *sql.Query
@@ -42,6 +59,14 @@ func (cs *clusterSource) doIterate(ctx context.Context, unflat bool, onFields co
 	return cs.opts.QueryCluster(ctx, cs.query.SQL, cs.opts.IsSubQuery, subQueryResults, unflat, onFields, onRow, onFlatRow)
 }
 
+func (cs *clusterSource) ClusterSQL() string {
+	return cs.query.SQL
+}
+
+func (cs *clusterSource) IsSubQuery() bool {
+	return cs.opts.IsSubQuery
+}
+
 func (cs *clusterSource) GetGroupBy() []core.GroupBy {
 	return cs.planAsIfLocal.GetGroupBy()
 }
@@ -66,6 +91,10 @@ func (cs *clusterRowSource) Iterate(ctx context.Context, onFields core.OnFields,
 	return cs.doIterate(ctx, true, onFields, onRow, nil)
 }
 
+func (cs *clusterRowSource) Pushdown() bool {
+	return false
+}
+
 func (cs *clusterRowSource) String() string {
 	return fmt.Sprintf("cluster %v", cs.query.SQL)
 }
@@ -80,6 +109,10 @@ func (cs *clusterFlatRowSource) Iterate(ctx context.Context, onFields core.OnFie
 	})
 }
 
+func (cs *clusterFlatRowSource) Pushdown() bool {
+	return true
+}
+
 func (cs *clusterFlatRowSource) String() string {
 	return fmt.Sprintf("cluster flat %v", cs.query.SQL)
 }
@@ -176,6 +209,7 @@ func planClusterPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, erro
 	if err != nil {
 		return nil, err
 	}
+	query.SQL = clampedClusterSQL(opts, query, query.SQL, pail)
 
 	flat := &clusterFlatRowSource{
 		clusterSource{
@@ -185,7 +219,7 @@ func planClusterPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, erro
 		},
 	}
 
-	return addOrderLimitOffset(flat, query), nil
+	return addOrderLimitOffset(flat, query, opts), nil
 }
 
 func planClusterNonPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, error) {
@@ -250,7 +284,10 @@ func planClusterNonPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, e
 		groupByParts = append(groupByParts, crosstabString)
 		query.Crosstab = core.ClusterCrosstab
 	}
-	if query.Resolution != 0 {
+	if query.Resolution != 0 && query.Location == nil {
+		// Periods in a time zone don't line up with the followers' UTC periods, so
+		// followers return the table's resolution and the leader buckets by time
+		// zone.
 		groupByParts = append(groupByParts, fmt.Sprintf("period(%v)", query.Resolution))
 	}
 	if query.Stride > 0 {
@@ -264,6 +301,7 @@ func planClusterNonPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, e
 	if err != nil {
 		return nil, fmt.Errorf("Unable to plan non-pushdown query: %v", err)
 	}
+	sqlString = clampedClusterSQL(opts, query, sqlString, pail)
 
 	clusterQuery, parseErr := sql.Parse(sqlString)
 	if parseErr != nil {
@@ -279,7 +317,11 @@ func planClusterNonPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, e
 		},
 	}
 
-	if query.Resolution > pail.GetResolution() {
+	if query.Location != nil {
+		if query.Resolution%pail.GetResolution() != 0 {
+			return nil, fmt.Errorf("Query resolution '%v' is not an even multiple of table resolution '%v'", query.Resolution, pail.GetResolution())
+		}
+	} else if query.Resolution > pail.GetResolution() {
 		query.Resolution = pail.GetResolution()
 	}
 	// Pass through fields since the remote query already has the correct ones
@@ -288,14 +330,22 @@ func planClusterNonPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, e
 	// those
 	query.AsOf = time.Time{}
 	query.Until = time.Time{}
-	query.Resolution = 0
+	if query.Location == nil {
+		query.Resolution = 0
+	}
 
-	flat := core.Flatten(addGroupBy(source, query, true, query.Resolution, 0))
+	flat := core.Flatten(addGroupBy(source, query, opts, true, query.Resolution, 0))
+	if query.Location != nil {
+		flat = core.Localize(flat, query.Location)
+	}
 	if query.HasHaving {
 		flat = addHaving(flat, query)
 	}
+	if len(query.DimColumns) > 0 {
+		flat = addDimColumns(flat, query)
+	}
 
-	return addOrderLimitOffset(flat, query), nil
+	return addOrderLimitOffset(flat, query, opts), nil
 }
 
 func planAsIfLocal(opts *Opts, sqlString string) (core.FlatRowSource, error) {
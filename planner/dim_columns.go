@@ -0,0 +1,92 @@
+package planner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// checkDimColumns makes sure that the dimension columns of the given query
+// only use dimensions that are still around after grouping, since they're
+// computed from the dimensions of the grouped rows.
+func checkDimColumns(query *sql.Query) error {
+	if query.GroupByAll {
+		return nil
+	}
+	grouped := make(map[string]bool, len(query.GroupBy))
+	for _, groupBy := range query.GroupBy {
+		grouped[groupBy.Name] = true
+	}
+	for _, col := range query.DimColumns {
+		var missing string
+		col.Expr.WalkParams(func(param string) {
+			if missing == "" && !grouped[param] {
+				missing = param
+			}
+		})
+		if missing != "" {
+			return fmt.Errorf("Dimension column %v uses %v, which isn't in the GROUP BY", col.Name, missing)
+		}
+	}
+	return nil
+}
+
+// addDimColumns adds the dimension columns from the SELECT clause to the
+// dimensions of each row, computing them from the row's existing dimensions.
+func addDimColumns(flat core.FlatRowSource, query *sql.Query) core.FlatRowSource {
+	base := core.FlatRowFilter(flat, "dim columns", func(ctx context.Context, row *core.FlatRow, fields core.Fields) (*core.FlatRow, error) {
+		dims := row.Key.AsMap()
+		for _, col := range query.DimColumns {
+			dims[col.Name] = col.Expr.Eval(row.Key)
+		}
+		row.Key = bytemap.New(dims)
+		return row, nil
+	})
+	return &dimColumns{base, query.DimColumns}
+}
+
+type dimColumns struct {
+	base    core.FlatRowSource
+	columns []core.GroupBy
+}
+
+func (f *dimColumns) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	return f.base.Iterate(ctx, onFields, onRow)
+}
+
+// GetGroupBy includes the dimension columns so that consumers that list the
+// dimensions of results based on the GroupBy show them too.
+func (f *dimColumns) GetGroupBy() []core.GroupBy {
+	groupBy := f.base.GetGroupBy()
+	result := make([]core.GroupBy, 0, len(groupBy)+len(f.columns))
+	result = append(result, groupBy...)
+	return append(result, f.columns...)
+}
+
+func (f *dimColumns) GetResolution() time.Duration {
+	return f.base.GetResolution()
+}
+
+func (f *dimColumns) GetAsOf() time.Time {
+	return f.base.GetAsOf()
+}
+
+func (f *dimColumns) GetUntil() time.Time {
+	return f.base.GetUntil()
+}
+
+func (f *dimColumns) GetSource() core.Source {
+	switch t := f.base.(type) {
+	case core.Transform:
+		return t.GetSource()
+	}
+	return nil
+}
+
+func (f *dimColumns) String() string {
+	return f.base.String()
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
 	"github.com/getlantern/zenodb/sql"
 )
 
@@ -31,9 +32,8 @@ func planLocal(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
 
 	now := opts.Now(query.From)
 	asOf, asOfChanged, until, untilChanged := asOfUntilFor(query, opts, source, now)
-	sourceAsOf := source.GetAsOf()
-	if asOf.Before(sourceAsOf) {
-		return nil, fmt.Errorf("Query asOf of %v is before table asOf of %v", asOf, sourceAsOf)
+	if prunable, ok := source.(Prunable); ok {
+		prunable.Prune(asOf, until, query.WhereEquals)
 	}
 
 	resolution, strideSlice, resolutionChanged, resolutionTruncated, err := resolutionFor(query, opts, source, asOf, until)
@@ -50,18 +50,24 @@ func planLocal(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
 
 	needsGroupBy := asOfChanged || untilChanged || resolutionChanged ||
 		!query.GroupByAll || query.HasSpecificFields || query.HasHaving ||
-		query.Crosstab != nil || strideSlice > 0
+		query.Crosstab != nil || strideSlice > 0 || query.Location != nil
 	if needsGroupBy {
-		source = addGroupBy(source, query, resolutionTruncated || resolutionChanged, resolution, strideSlice)
+		source = addGroupBy(source, query, opts, resolutionTruncated || resolutionChanged, resolution, strideSlice)
 	}
 
 	flat := core.Flatten(source)
+	if query.Location != nil {
+		flat = core.Localize(flat, query.Location)
+	}
 
 	if query.HasHaving {
 		flat = addHaving(flat, query)
 	}
+	if len(query.DimColumns) > 0 {
+		flat = addDimColumns(flat, query)
+	}
 
-	return addOrderLimitOffset(flat, query), nil
+	return addOrderLimitOffset(flat, query, opts), nil
 }
 
 func sourceForSubQuery(query *sql.Query, opts *Opts) (core.RowSource, error) {
@@ -69,42 +75,47 @@ func sourceForSubQuery(query *sql.Query, opts *Opts) (core.RowSource, error) {
 	if err != nil {
 		return nil, err
 	}
-	return core.Unflatten(subSource, query.FieldsNoHaving), nil
+	fields := query.FieldsNoHaving
+	if opts.IsSubQuery {
+		// The nested query only selected the _points field, so sum those
+		fields = core.StaticFieldSource{core.NewField(core.PointsField.Name, expr.SUM(core.PointsField.Name))}
+	}
+	return core.Unflatten(subSource, fields), nil
 }
 
-func sourceForTable(query *sql.Query, opts *Opts) (core.RowSource, error) {
-	return opts.GetTable(query.From, func(tableFields core.Fields) (core.Fields, error) {
-		if query.HasSelectAll {
-			// For SELECT *, include all table fields
-			return tableFields, nil
-		}
+// FieldsNeeded determines which of the given fields of the table in its FROM
+// clause the query needs to read.
+func FieldsNeeded(query *sql.Query, tableFields core.Fields) (core.Fields, error) {
+	if query.HasSelectAll {
+		// For SELECT *, include all table fields
+		return tableFields, nil
+	}
 
-		tableExprs := tableFields.Exprs()
+	tableExprs := tableFields.Exprs()
 
-		// Otherwise, figure out minimum set of fields needed by query
-		includedFields := make([]bool, len(tableFields))
-		fields, err := query.Fields.Get(tableFields)
-		if err != nil {
-			return nil, err
-		}
-		for _, field := range fields {
-			sms := field.Expr.SubMergers(tableExprs)
-			for i, sm := range sms {
-				if sm != nil {
-					includedFields[i] = true
-				}
+	// Otherwise, figure out minimum set of fields needed by query
+	includedFields := make([]bool, len(tableFields))
+	fields, err := query.Fields.Get(tableFields)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		sms := field.Expr.SubMergers(tableExprs)
+		for i, sm := range sms {
+			if sm != nil {
+				includedFields[i] = true
 			}
 		}
+	}
 
-		result := make(core.Fields, 0, len(tableFields))
-		for i, included := range includedFields {
-			if included {
-				result = append(result, tableFields[i])
-			}
+	result := make(core.Fields, 0, len(tableFields))
+	for i, included := range includedFields {
+		if included {
+			result = append(result, tableFields[i])
 		}
+	}
 
-		return result, nil
-	})
+	return result, nil
 }
 
 func asOfUntilFor(query *sql.Query, opts *Opts, source core.RowSource, now time.Time) (time.Time, bool, time.Time, bool) {
@@ -131,9 +142,57 @@ func asOfUntilFor(query *sql.Query, opts *Opts, source core.RowSource, now time.
 		until = query.Until
 	}
 
+	// Clamp the time range to what the source retains so that we don't iterate
+	// over time for which there can't be any data.
+	var requestedAsOf, requestedUntil time.Time
+	if asOf.Before(source.GetAsOf()) {
+		log.Debugf("Query asOf of %v is before source asOf of %v, clamping", asOf, source.GetAsOf())
+		requestedAsOf = asOf
+		asOf = source.GetAsOf()
+		asOfChanged = false
+		query.AsOf = time.Time{}
+	}
+	if !source.GetUntil().IsZero() && until.After(source.GetUntil()) {
+		log.Debugf("Query until of %v is after source until of %v, clamping", until, source.GetUntil())
+		requestedUntil = until
+		until = source.GetUntil()
+		untilChanged = false
+		query.Until = time.Time{}
+	}
+	if opts.OnClamp != nil && (!requestedAsOf.IsZero() || !requestedUntil.IsZero()) {
+		opts.OnClamp(requestedAsOf, requestedUntil)
+	}
+
 	return asOf, asOfChanged, until, untilChanged
 }
 
+// clampedClusterSQL returns the SQL to run on each partition for the given
+// query. If the query asks for data from before the time range that the
+// queried table retains (per pail, the query planned as if local), its ASOF is
+// moved up to the start of the retained time range so that partitions don't
+// iterate over time for which they can't have any data.
+func clampedClusterSQL(opts *Opts, query *sql.Query, sqlString string, pail core.Source) string {
+	if query.AsOf.IsZero() && query.AsOfOffset == 0 {
+		return sqlString
+	}
+	asOf := query.AsOf
+	if query.AsOfOffset != 0 {
+		asOf = opts.Now(query.From).Add(query.AsOfOffset)
+	}
+	asOf = encoding.RoundTimeUp(asOf, pail.GetResolution())
+	retainedAsOf := pail.GetAsOf()
+	if !asOf.Before(retainedAsOf) {
+		return sqlString
+	}
+	clamped, err := sql.WithAsOf(sqlString, retainedAsOf)
+	if err != nil {
+		log.Debugf("Unable to clamp ASOF of %v, leaving as is: %v", sqlString, err)
+		return sqlString
+	}
+	log.Debugf("Clamped ASOF of %v to %v", sqlString, retainedAsOf)
+	return clamped
+}
+
 func resolutionFor(query *sql.Query, opts *Opts, source core.RowSource, asOf time.Time, until time.Time) (time.Duration, time.Duration, bool, bool, error) {
 	resolution := query.Resolution
 	var strideSlice time.Duration
@@ -0,0 +1,147 @@
+package planner
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/spill"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// materializations tracks the materialized queries within a statement, keyed
+// by their SQL.
+type materializations struct {
+	sources map[string]*materialized
+	mx      sync.Mutex
+}
+
+func newMaterializations() *materializations {
+	return &materializations{sources: make(map[string]*materialized)}
+}
+
+func (m *materializations) get(opts *Opts, query *sql.Query, plan func(*sql.Query, *Opts) (core.FlatRowSource, error)) (core.FlatRowSource, error) {
+	// Subqueries only select the _points field, so they're materialized
+	// separately from regular queries
+	key := fmt.Sprintf("%v %v", opts.IsSubQuery, query.SQL)
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	source := m.sources[key]
+	if source == nil {
+		planned, err := plan(query, opts)
+		if err != nil {
+			return nil, err
+		}
+		source = &materialized{FlatRowSource: planned, memLimit: opts.MemoryLimit, quota: opts.SpillQuota}
+		m.sources[key] = source
+	}
+	return source, nil
+}
+
+func (m *materializations) empty() bool {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return len(m.sources) == 0
+}
+
+// release releases the results of all materialized queries.
+func (m *materializations) release() {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for _, source := range m.sources {
+		source.release()
+	}
+}
+
+// materialized is a core.FlatRowSource that only iterates over the
+// underlying source once, buffering its results so that they can be iterated
+// again. Results beyond memLimit spill to disk.
+type materialized struct {
+	core.FlatRowSource
+	memLimit int
+	quota    *spill.Quota
+	iterated bool
+	fields   core.Fields
+	rows     *core.FlatRowBuffer
+	metadata interface{}
+	err      error
+	mx       sync.Mutex
+}
+
+func (m *materialized) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	m.mx.Lock()
+	if !m.iterated {
+		m.metadata, m.err = m.FlatRowSource.Iterate(ctx, func(fields core.Fields) error {
+			m.fields = fields
+			m.rows = core.NewFlatRowBuffer(fields, m.memLimit, m.quota)
+			return nil
+		}, func(row *core.FlatRow) (bool, error) {
+			return true, m.rows.Add(row)
+		})
+		if m.err == nil && m.rows != nil {
+			m.err = m.rows.Finish()
+		}
+		m.iterated = true
+	}
+	m.mx.Unlock()
+	if m.err != nil {
+		return m.metadata, m.err
+	}
+
+	guard := core.Guard(ctx)
+	err := onFields(m.fields)
+	if err != nil {
+		return m.metadata, err
+	}
+	if m.rows == nil {
+		return m.metadata, nil
+	}
+	err = m.rows.Iterate(func(row *core.FlatRow) (bool, error) {
+		return guard.ProceedAfter(onRow(row))
+	})
+	return m.metadata, err
+}
+
+// release removes the buffered results, including any that were spilled to
+// disk. Iterating again afterwards runs the underlying source again.
+func (m *materialized) release() {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if m.rows != nil {
+		m.rows.Remove()
+	}
+	m.iterated = false
+	m.fields = nil
+	m.rows = nil
+	m.metadata = nil
+	m.err = nil
+}
+
+func (m *materialized) GetSource() core.Source {
+	return m.FlatRowSource
+}
+
+func (m *materialized) String() string {
+	return "materialized"
+}
+
+// statement is the plan of a whole statement that uses materialized queries,
+// which releases their results once the statement has been iterated.
+type statement struct {
+	core.FlatRowSource
+	materializations *materializations
+}
+
+func (s *statement) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	defer s.materializations.release()
+	return s.FlatRowSource.Iterate(ctx, onFields, onRow)
+}
+
+func (s *statement) GetSource() core.Source {
+	return s.FlatRowSource
+}
+
+func (s *statement) String() string {
+	return "release materialized"
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/getlantern/golog"
 	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/spill"
 	"github.com/getlantern/zenodb/sql"
 )
 
@@ -18,12 +19,45 @@ type Table interface {
 	GetPartitionBy() []string
 }
 
+// Prunable is implemented by Tables that can skip data that falls outside of
+// the time range of a query or that can't satisfy the dimension values that its
+// WHERE clause requires (see sql.Query.WhereEquals).
+type Prunable interface {
+	Prune(asOf time.Time, until time.Time, whereEquals map[string]string)
+}
+
+// RolledUp is implemented by Tables whose older data has been rolled up to a
+// coarser resolution.
+type RolledUp interface {
+	// GetRollup returns a Table with the rolled up data, which holds the data
+	// up to the returned time, or nil if nothing has been rolled up.
+	GetRollup() (Table, time.Time, error)
+}
+
 type Opts struct {
 	GetTable        func(table string, includedFields func(tableFields core.Fields) (core.Fields, error)) (Table, error)
 	Now             func(table string) time.Time
 	IsSubQuery      bool
 	SubQueryResults [][]interface{}
 	QueryCluster    QueryClusterFN
+	// MemoryLimit caps the approximate memory used by each ORDER BY, GROUP BY
+	// and materialized subquery, beyond which they spill to temp files. If <= 0,
+	// everything happens in memory.
+	MemoryLimit int
+	// SpillQuota limits the disk space that the query can use for spilling. If
+	// nil, spilling uses the system temp directory without limits.
+	SpillQuota *spill.Quota
+	// GetViews, if set, lists the views of the given table. Queries can then
+	// reference fields that are only stored in those views, see
+	// sourceForTable.
+	GetViews func(table string) []string
+	// OnClamp, if set, is called when the time range of the query (or of one of
+	// its subqueries) is clamped to the time range that the queried table
+	// retains, with the ASOF and UNTIL that the query asked for. Ends that
+	// weren't clamped are zero. Planning may call it more than once.
+	OnClamp func(requestedAsOf time.Time, requestedUntil time.Time)
+
+	materializations *materializations
 }
 
 func Plan(sqlString string, opts *Opts) (core.FlatRowSource, error) {
@@ -31,8 +65,35 @@ func Plan(sqlString string, opts *Opts) (core.FlatRowSource, error) {
 	if err != nil {
 		return nil, err
 	}
+	return PlanQuery(query, opts)
+}
 
+// PlanQuery is like Plan but for a query that's already been parsed. Planning
+// modifies the query, so callers that plan the same parsed query more than
+// once should pass a Clone.
+func PlanQuery(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
+	if opts.materializations == nil {
+		// Materialized queries are shared within a single statement
+		statementOpts := &Opts{}
+		*statementOpts = *opts
+		statementOpts.materializations = newMaterializations()
+		planned, err := PlanQuery(query, statementOpts)
+		if err != nil || statementOpts.materializations.empty() {
+			return planned, err
+		}
+		return &statement{planned, statementOpts.materializations}, nil
+	}
+	if query.Materialize {
+		return opts.materializations.get(opts, query, plan)
+	}
+	return plan(query, opts)
+}
+
+func plan(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
 	fixupSubQuery(query, opts)
+	if err := checkDimColumns(query); err != nil {
+		return nil, err
+	}
 
 	if opts.QueryCluster != nil {
 		allowPushdown, err := pushdownAllowed(opts, query)
@@ -50,25 +111,30 @@ func Plan(sqlString string, opts *Opts) (core.FlatRowSource, error) {
 	return planLocal(query, opts)
 }
 
-func addGroupBy(source core.RowSource, query *sql.Query, applyResolution bool, resolution time.Duration, strideSlice time.Duration) core.RowSource {
-	opts := core.GroupOpts{
+func addGroupBy(source core.RowSource, query *sql.Query, opts *Opts, applyResolution bool, resolution time.Duration, strideSlice time.Duration) core.RowSource {
+	groupOpts := core.GroupOpts{
 		By:                    query.GroupBy,
 		Crosstab:              query.Crosstab,
 		CrosstabIncludesTotal: query.CrosstabIncludesTotal,
+		CrosstabOrder:         query.CrosstabOrder,
+		CrosstabLimit:         query.CrosstabLimit,
 		Fields:                query.Fields,
 		AsOf:                  query.AsOf,
 		Until:                 query.Until,
 		StrideSlice:           strideSlice,
+		Location:              query.Location,
+		MemLimit:              opts.MemoryLimit,
+		SpillQuota:            opts.SpillQuota,
 	}
 	if applyResolution {
-		opts.Resolution = resolution
+		groupOpts.Resolution = resolution
 	}
-	return core.Group(source, opts)
+	return core.Group(source, groupOpts)
 }
 
-func addOrderLimitOffset(flat core.FlatRowSource, query *sql.Query) core.FlatRowSource {
+func addOrderLimitOffset(flat core.FlatRowSource, query *sql.Query, opts *Opts) core.FlatRowSource {
 	if len(query.OrderBy) > 0 {
-		flat = core.Sort(flat, query.OrderBy...)
+		flat = core.SortWithMemoryLimit(flat, opts.MemoryLimit, opts.SpillQuota, query.OrderBy...)
 	}
 
 	if query.Offset > 0 {
@@ -3,6 +3,10 @@ package planner
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,6 +15,7 @@ import (
 	. "github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
 	. "github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/spill"
 	"github.com/getlantern/zenodb/sql"
 	"github.com/spaolacci/murmur3"
 	"github.com/stretchr/testify/assert"
@@ -402,9 +407,22 @@ func TestPlans(t *testing.T) {
 			}))
 		})
 
-	// AsOf too far
-	_, err := Plan("SELECT * FROM TableA ASOF '-6w'", defaultOpts())
-	assert.Error(t, err, "Too old ASOF should have given error")
+	pushdownScenario("ASOF before retention",
+		"SELECT * FROM TableA ASOF '-6w'",
+		"select * from TableA ASOF '2014-11-27T00:00:00Z'",
+		func(source RowSource) Source {
+			return Flatten(source)
+		})
+
+	pushdownScenario("UNTIL after retention",
+		"SELECT * FROM TableA ASOF '-5s' UNTIL '1d'",
+		"select * from TableA ASOF '-5s' UNTIL '1d'",
+		func(source RowSource) Source {
+			return Flatten(Group(source, GroupOpts{
+				Fields: textFieldSource("*"),
+				AsOf:   epoch.Add(-5 * time.Second),
+			}))
+		})
 
 	pushdownScenario("ASOF UNTIL",
 		"SELECT * FROM TableA ASOF '-5w' UNTIL '-1d'",
@@ -445,6 +463,26 @@ func TestPlans(t *testing.T) {
 			Fields: textFieldSource("passthrough"),
 		})
 
+	newYork, _ := time.LoadLocation("America/New_York")
+	nonPushdownScenario("Change Resolution in time zone",
+		"SELECT * FROM TableA GROUP BY period(2s, 'America/New_York')",
+		"select * from TableA",
+		func(source RowSource) RowSource {
+			return Group(source, GroupOpts{
+				Fields:     textFieldSource("*"),
+				Resolution: 2 * time.Second,
+				Location:   newYork,
+			})
+		},
+		func(source RowSource) Source {
+			return Localize(Flatten(source), newYork)
+		},
+		GroupOpts{
+			Fields:     textFieldSource("passthrough"),
+			Resolution: 2 * time.Second,
+			Location:   newYork,
+		})
+
 	nonPushdownScenario("Resolution smaller than data window",
 		"SELECT * FROM TableA ASOF '-5s' UNTIL '-4s' GROUP BY period(2s)",
 		"select * from TableA ASOF '-5s' UNTIL '-4s' group by period(2 as s)",
@@ -544,6 +582,73 @@ func verifyNoHaving(t *testing.T, fields Fields, plan Source, sqlString string)
 	}
 }
 
+func TestPlanClampsToRetention(t *testing.T) {
+	var requestedAsOf, requestedUntil time.Time
+	clamps := 0
+	plan := func(sqlString string, cluster bool) Source {
+		requestedAsOf, requestedUntil = time.Time{}, time.Time{}
+		opts := defaultOpts()
+		if cluster {
+			opts.QueryCluster = queryCluster
+		}
+		opts.OnClamp = func(asOf time.Time, until time.Time) {
+			clamps++
+			requestedAsOf, requestedUntil = asOf, until
+		}
+		source, err := Plan(sqlString, opts)
+		if !assert.NoError(t, err, sqlString) {
+			return nil
+		}
+		return source
+	}
+
+	for _, cluster := range []bool{false, true} {
+		// AsOf too far in past
+		clamps = 0
+		source := plan("SELECT * FROM TableA ASOF '-6w'", cluster)
+		if source == nil {
+			return
+		}
+		assert.Equal(t, asOf, source.GetAsOf(), "ASOF should have been clamped to retained range (cluster %v)", cluster)
+		assert.Equal(t, until, source.GetUntil())
+		assert.True(t, clamps > 0, "clamping should have been reported (cluster %v)", cluster)
+		assert.Equal(t, epoch.Add(-6*7*24*time.Hour), requestedAsOf, "should have reported requested ASOF (cluster %v)", cluster)
+		assert.True(t, requestedUntil.IsZero(), "UNTIL wasn't clamped (cluster %v)", cluster)
+
+		// Until in future
+		clamps = 0
+		source = plan("SELECT * FROM TableA ASOF '-5s' UNTIL '1d'", cluster)
+		if source == nil {
+			return
+		}
+		assert.Equal(t, epoch.Add(-5*time.Second), source.GetAsOf())
+		assert.Equal(t, until, source.GetUntil(), "UNTIL should have been clamped to retained range (cluster %v)", cluster)
+		assert.True(t, clamps > 0, "clamping should have been reported (cluster %v)", cluster)
+		assert.True(t, requestedAsOf.IsZero(), "ASOF wasn't clamped (cluster %v)", cluster)
+		assert.Equal(t, epoch.Add(24*time.Hour), requestedUntil, "should have reported requested UNTIL (cluster %v)", cluster)
+
+		// Within retained range
+		clamps = 0
+		plan("SELECT * FROM TableA ASOF '-5w' UNTIL '-1d'", cluster)
+		assert.Equal(t, 0, clamps, "queries within retained range shouldn't be clamped (cluster %v)", cluster)
+	}
+}
+
+func TestPlanDimColumns(t *testing.T) {
+	for _, sqlString := range []string{
+		"SELECT SUBSTR(x, 0, 1) AS p, a FROM TableA GROUP BY x",
+		"SELECT SUBSTR(x, 0, 1) AS p, a FROM TableA GROUP BY *",
+		"SELECT SUBSTR(x, 0, 1) AS p, a FROM TableA",
+		"SELECT CONCAT('_', c, y) AS p, a FROM TableA GROUP BY y, CONCAT('_', x, y) AS c",
+	} {
+		_, err := Plan(sqlString, defaultOpts())
+		assert.NoError(t, err, sqlString)
+	}
+
+	_, err := Plan("SELECT SUBSTR(x, 0, 1) AS p, a FROM TableA GROUP BY y", defaultOpts())
+	assert.EqualError(t, err, "Dimension column p uses x, which isn't in the GROUP BY")
+}
+
 func TestPlanExecution(t *testing.T) {
 	sqlString := `
 SELECT AVG(a)+AVG(b) AS avg_total
@@ -588,6 +693,107 @@ LIMIT 1
 	verify(plan)
 }
 
+func TestPlanWith(t *testing.T) {
+	sqlString := `
+WITH ones AS (SELECT * FROM tablea WHERE x = 1)
+SELECT * FROM tablea
+WHERE x IN (SELECT x FROM ones) OR y IN (SELECT y FROM ones)
+`
+
+	var iterations int32
+	opts := defaultOpts()
+	getTable := opts.GetTable
+	opts.GetTable = func(table string, includedFields func(tableFields Fields) (Fields, error)) (Table, error) {
+		tbl, err := getTable(table, includedFields)
+		if err != nil {
+			return nil, err
+		}
+		return &countingTable{tbl.(*testTable), &iterations}, nil
+	}
+
+	plan, err := Plan(sqlString, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	log.Debug(FormatSource(plan))
+	var rows []*FlatRow
+	_, err = plan.Iterate(context.Background(), FieldsIgnored, func(row *FlatRow) (bool, error) {
+		rows = append(rows, row)
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEmpty(t, rows)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&iterations), "Common table expression referenced twice should only be queried once")
+}
+
+func TestPlanWithMemoryLimit(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbspill")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	run := func(sqlString string, memoryLimit int, maxSpillBytes int64) ([]string, error) {
+		m, err := spill.New(&spill.Opts{Dir: tmpDir, MaxBytesPerQuery: maxSpillBytes})
+		if !assert.NoError(t, err) {
+			return nil, err
+		}
+		opts := defaultOpts()
+		opts.MemoryLimit = memoryLimit
+		opts.SpillQuota = m.NewQuota()
+		plan, err := Plan(sqlString, opts)
+		if !assert.NoError(t, err) {
+			return nil, err
+		}
+		var rows []string
+		_, err = plan.Iterate(context.Background(), FieldsIgnored, func(row *FlatRow) (bool, error) {
+			rows = append(rows, fmt.Sprintf("%d %v %v", row.TS, row.Key.AsMap(), row.Values))
+			return true, nil
+		})
+		assert.EqualValues(t, 0, m.Used(), "Spilled data should have been cleaned up")
+		files, _ := ioutil.ReadDir(tmpDir)
+		assert.Empty(t, files, "Spill files should have been removed")
+		// Spilled groups come out in a different order
+		sort.Strings(rows)
+		return rows, err
+	}
+
+	for _, sqlString := range []string{
+		// Grouping
+		"SELECT * FROM tablea GROUP BY x, period(1s)",
+		// Materialized subquery that's referenced twice
+		`
+WITH ones AS (SELECT * FROM tablea WHERE x = 1)
+SELECT * FROM tablea
+WHERE x IN (SELECT x FROM ones) OR y IN (SELECT y FROM ones)
+`,
+	} {
+		expected, err := run(sqlString, 0, 0)
+		if !assert.NoError(t, err) || !assert.NotEmpty(t, expected) {
+			return
+		}
+		// A tiny memory limit forces spilling
+		actual, err := run(sqlString, 1, 0)
+		if assert.NoError(t, err, sqlString) {
+			assert.Equal(t, expected, actual, sqlString)
+		}
+		_, err = run(sqlString, 1, 10)
+		assert.Equal(t, spill.ErrQuotaExceeded, err, sqlString)
+	}
+}
+
+type countingTable struct {
+	*testTable
+	iterations *int32
+}
+
+func (t *countingTable) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (interface{}, error) {
+	atomic.AddInt32(t.iterations, 1)
+	return t.testTable.Iterate(ctx, onFields, onRow)
+}
+
 func defaultOpts() *Opts {
 	return &Opts{
 		GetTable: func(table string, includedFields func(tableFields Fields) (Fields, error)) (Table, error) {
@@ -663,17 +869,23 @@ func (t *testTable) GetPartitionBy() []string {
 func (t *testTable) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (interface{}, error) {
 	onFields(t.fields)
 
-	onRow(makeRow(epoch.Add(-9*resolution), 1, 0, 10, 0))
-	onRow(makeRow(epoch.Add(-8*resolution), 0, 3, 0, 20))
+	var err error
+	row := func(key bytemap.ByteMap, vals []encoding.Sequence) {
+		if err == nil {
+			_, err = onRow(key, vals)
+		}
+	}
+	row(makeRow(epoch.Add(-9*resolution), 1, 0, 10, 0))
+	row(makeRow(epoch.Add(-8*resolution), 0, 3, 0, 20))
 
 	// Intentional gap
-	onRow(makeRow(epoch.Add(-5*resolution), 1, 3, 50, 0))
-	onRow(makeRow(epoch.Add(-4*resolution), 2, 5, 0, 60))
-	onRow(makeRow(epoch.Add(-3*resolution), 1, 0, 70, 0))
-	onRow(makeRow(epoch.Add(-2*resolution), 0, 3, 0, 80))
-	onRow(makeRow(epoch.Add(-1*resolution), 1, 5, 90, 0))
-	onRow(makeRow(epoch, 2, 2, 0, 100))
-	return nil, nil
+	row(makeRow(epoch.Add(-5*resolution), 1, 3, 50, 0))
+	row(makeRow(epoch.Add(-4*resolution), 2, 5, 0, 60))
+	row(makeRow(epoch.Add(-3*resolution), 1, 0, 70, 0))
+	row(makeRow(epoch.Add(-2*resolution), 0, 3, 0, 80))
+	row(makeRow(epoch.Add(-1*resolution), 1, 5, 90, 0))
+	row(makeRow(epoch, 2, 2, 0, 100))
+	return nil, err
 }
 
 func makeRow(ts time.Time, x int, y int, a float64, b float64) (bytemap.ByteMap, []encoding.Sequence) {
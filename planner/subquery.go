@@ -119,7 +119,15 @@ func (phfs pointsAndHavingFieldSource) Get(known core.Fields) (core.Fields, erro
 	if err != nil {
 		return result, err
 	}
-	result = append(result, core.PointsField)
+	pointsField := core.PointsField
+	for _, field := range known {
+		if field.Name == core.PointsField.Name {
+			// Use the known _points field, which for nested subqueries sums up the
+			// _points from the nested subquery
+			pointsField = field
+		}
+	}
+	result = append(result, pointsField)
 	for _, field := range origFields {
 		if field.Name == core.HavingFieldName {
 			result = append(result, field)
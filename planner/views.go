@@ -0,0 +1,206 @@
+package planner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// sourceForTable returns a source for the table in the query's FROM clause.
+// The source also includes any fields which the query needs but that are only
+// stored in views of that table, as well as data of the table that's been
+// rolled up if the query reaches back that far (see RolledUp). Data stored at
+// finer resolutions is down-sampled to the coarsest resolution among the table,
+// the views from which fields are read and the rollup, so that they can be
+// combined. If the query doesn't need any of that, this returns the table
+// itself.
+func sourceForTable(query *sql.Query, opts *Opts) (core.RowSource, error) {
+	var tableFields core.Fields
+	var tableNeeded core.Fields
+	table, err := opts.GetTable(query.From, func(fields core.Fields) (core.Fields, error) {
+		tableFields = fields
+		var neededErr error
+		tableNeeded, neededErr = FieldsNeeded(query, fields)
+		return tableNeeded, neededErr
+	})
+	if err != nil {
+		return table, err
+	}
+
+	sources := []core.RowSource{table}
+	fields := tableNeeded
+	if !query.HasSelectAll && opts.GetViews != nil {
+		views, viewFields := viewsWithFields(query, opts, tableFields)
+		sources = append(sources, views...)
+		fields = append(fields, viewFields...)
+	}
+
+	rollup, rolledUpUntil, err := rollupFor(query, opts, table)
+	if err != nil {
+		return nil, err
+	}
+	if rollup != nil {
+		sources = append(sources, rollup)
+	}
+
+	if len(sources) == 1 {
+		return table, nil
+	}
+	return newViewFieldsSource(fields, sources, rolledUpUntil)
+}
+
+// viewsWithFields returns the views of the query's table that store fields
+// which the query needs but that the table doesn't have, along with those
+// fields.
+func viewsWithFields(query *sql.Query, opts *Opts, tableFields core.Fields) ([]core.RowSource, core.Fields) {
+	known := make(map[string]bool, len(tableFields))
+	for _, field := range tableFields {
+		known[field.Name] = true
+	}
+	var sources []core.RowSource
+	var fields core.Fields
+	views := opts.GetViews(query.From)
+	sort.Strings(views)
+	for _, viewName := range views {
+		var viewNeeded core.Fields
+		view, viewErr := opts.GetTable(viewName, func(viewFields core.Fields) (core.Fields, error) {
+			candidates := append(core.Fields{}, tableFields...)
+			for _, field := range viewFields {
+				if !known[field.Name] {
+					candidates = append(candidates, field)
+				}
+			}
+			needed, neededErr := FieldsNeeded(query, candidates)
+			if neededErr != nil {
+				return nil, neededErr
+			}
+			for _, field := range needed {
+				if !known[field.Name] {
+					viewNeeded = append(viewNeeded, field)
+				}
+			}
+			return viewNeeded, nil
+		})
+		if viewErr != nil {
+			log.Debugf("Not reading fields from view %v: %v", viewName, viewErr)
+			continue
+		}
+		if len(viewNeeded) == 0 {
+			continue
+		}
+		for _, field := range viewNeeded {
+			known[field.Name] = true
+		}
+		sources = append(sources, view)
+		fields = append(fields, viewNeeded...)
+	}
+	return sources, fields
+}
+
+// rollupFor returns the rolled up data of the given table and the time until
+// which it's been rolled up if the query reads data from before that time.
+func rollupFor(query *sql.Query, opts *Opts, table Table) (Table, time.Time, error) {
+	rolledUp, ok := table.(RolledUp)
+	if !ok {
+		return nil, time.Time{}, nil
+	}
+	rollup, rolledUpUntil, err := rolledUp.GetRollup()
+	if err != nil || rollup == nil {
+		return nil, time.Time{}, err
+	}
+	if !rolledUpUntil.After(table.GetAsOf()) {
+		// everything that's been rolled up has fallen out of retention
+		return nil, time.Time{}, nil
+	}
+	asOf := query.AsOf
+	if query.AsOfOffset != 0 {
+		asOf = opts.Now(query.From).Add(query.AsOfOffset)
+	}
+	if !asOf.IsZero() && !asOf.Before(rolledUpUntil) {
+		return nil, time.Time{}, nil
+	}
+	return rollup, rolledUpUntil, nil
+}
+
+// viewFieldsSource combines the fields of a table, its views and its rollup,
+// down-sampling them to a common resolution.
+type viewFieldsSource struct {
+	core.RowSource
+	fields     core.Fields
+	sources    []core.RowSource
+	resolution time.Duration
+	// rolledUpUntil, if set, means that the last source is the rollup of the
+	// table, from which data up to this time is read
+	rolledUpUntil time.Time
+}
+
+func newViewFieldsSource(fields core.Fields, sources []core.RowSource, rolledUpUntil time.Time) (*viewFieldsSource, error) {
+	var resolution time.Duration
+	for _, source := range sources {
+		if source.GetResolution() > resolution {
+			resolution = source.GetResolution()
+		}
+	}
+	names := make([]string, 0, len(sources))
+	for _, source := range sources {
+		if resolution%source.GetResolution() != 0 {
+			return nil, fmt.Errorf("Unable to combine fields from %v because resolution '%v' is not an even multiple of resolution '%v' of %v", source, resolution, source.GetResolution(), sources[0])
+		}
+		names = append(names, source.String())
+	}
+	log.Debugf("Combining fields from %v at resolution %v", strings.Join(names, ", "), resolution)
+	s := &viewFieldsSource{fields: fields, sources: sources, resolution: resolution, rolledUpUntil: rolledUpUntil}
+	s.combine(time.Time{}, time.Time{})
+	return s, nil
+}
+
+// combine (re)builds the union of our sources, down-sampling those with finer
+// resolutions between asOf and until. If those are zero, down-sampling covers
+// everything that the sources retain. If the table has been rolled up, data up
+// to rolledUpUntil is only read from the rollup and later data only from the
+// table.
+func (s *viewFieldsSource) combine(asOf time.Time, until time.Time) {
+	sources := make([]core.RowSource, 0, len(s.sources))
+	for i, source := range s.sources {
+		sourceAsOf, sourceUntil := asOf, until
+		if !s.rolledUpUntil.IsZero() {
+			if i == 0 && sourceAsOf.Before(s.rolledUpUntil) {
+				sourceAsOf = s.rolledUpUntil
+			} else if i == len(s.sources)-1 && (sourceUntil.IsZero() || sourceUntil.After(s.rolledUpUntil)) {
+				sourceUntil = s.rolledUpUntil
+			}
+		}
+		if source.GetResolution() != s.resolution || sourceAsOf != asOf || sourceUntil != until {
+			source = core.Group(source, core.GroupOpts{
+				Resolution: s.resolution,
+				AsOf:       sourceAsOf,
+				Until:      sourceUntil,
+			})
+		}
+		sources = append(sources, source)
+	}
+	s.RowSource = core.Union(s.fields, sources...)
+}
+
+// Prune implements the Prunable interface by pruning all of our sources and
+// limiting down-sampling to the given time range.
+func (s *viewFieldsSource) Prune(asOf time.Time, until time.Time, whereEquals map[string]string) {
+	for _, source := range s.sources {
+		if prunable, ok := source.(Prunable); ok {
+			prunable.Prune(asOf, until, whereEquals)
+		}
+	}
+	s.combine(asOf, until)
+}
+
+func (s *viewFieldsSource) GetGroupBy() []core.GroupBy {
+	return s.sources[0].GetGroupBy()
+}
+
+func (s *viewFieldsSource) GetSources() []core.Source {
+	return s.RowSource.(core.Combination).GetSources()
+}
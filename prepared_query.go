@@ -0,0 +1,123 @@
+package zenodb
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	// DefaultPreparedQueryCacheSize is the default value for
+	// DBOpts.PreparedQueryCacheSize
+	DefaultPreparedQueryCacheSize = 1000
+)
+
+// PrepareQuery prepares a query with ? placeholders so that it can be run
+// repeatedly with different params using BindPrepared. The ID of the prepared
+// query is derived from its SQL, so preparing the same query again yields the
+// same ID. Only the most recently used prepared queries are remembered, so
+// callers should prepare again if BindPrepared can't find the query.
+func (db *DB) PrepareQuery(sqlString string) (*common.PreparedQuery, error) {
+	prepared, err := sql.Prepare(sqlString)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(sqlString))
+	id := hex.EncodeToString(hash[:16])
+	db.preparedQueries.put(id, prepared)
+	return &common.PreparedQuery{
+		ID:        id,
+		SQL:       sqlString,
+		NumParams: prepared.NumParams(),
+	}, nil
+}
+
+// BindPrepared binds the given params to the placeholders of the prepared query
+// identified by id (see sql.Bind), returning SQL that can be passed to Query.
+func (db *DB) BindPrepared(id string, params ...interface{}) (string, error) {
+	prepared, found := db.preparedQueries.get(id)
+	if !found {
+		return "", errors.New("Prepared query %v not found, please prepare it again", id)
+	}
+	return prepared.(*sql.Prepared).Bind(params...)
+}
+
+// parse parses the given SQL, reusing the results of parsing it before if
+// possible. Since dashboards tend to run the same queries over and over,
+// that saves parsing each time. Plans aren't reused because they depend on
+// the time at which the query runs. The returned query is the caller's to
+// modify.
+func (db *DB) parse(sqlString string) (*sql.Query, error) {
+	if cached, found := db.parsedQueries.get(sqlString); found {
+		return cached.(*sql.Query).Clone(), nil
+	}
+	q, err := sql.Parse(sqlString)
+	if err != nil {
+		return nil, err
+	}
+	if !q.HasSubQueries() {
+		db.parsedQueries.put(sqlString, q.Clone())
+	}
+	return q, nil
+}
+
+// lruCache is a size-limited map that evicts its least recently used entries.
+// A nil *lruCache caches nothing.
+type lruCache struct {
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	mx      sync.Mutex
+}
+
+type lruCacheEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+func (c *lruCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	el := c.entries[key]
+	if el == nil {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*lruCacheEntry).value, true
+}
+
+func (c *lruCache) put(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	el := c.entries[key]
+	if el != nil {
+		el.Value.(*lruCacheEntry).value = value
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&lruCacheEntry{key, value})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruCacheEntry).key)
+	}
+}
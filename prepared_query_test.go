@@ -0,0 +1,86 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreparedQuery(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+		PreparedQueryCacheSize:    1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"dim": i}, map[string]float64{"i": float64(i)}))
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	prepared, err := db.PrepareQuery("SELECT i FROM test_a WHERE dim = ? GROUP BY *")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1, prepared.NumParams)
+	again, err := db.PrepareQuery(prepared.SQL)
+	if assert.NoError(t, err) {
+		assert.Equal(t, prepared.ID, again.ID, "preparing the same query should yield the same ID")
+	}
+
+	sum := func(sqlString string) float64 {
+		rows, err := db.QueryContext(context.Background(), sqlString)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		defer rows.Close()
+		total := float64(0)
+		for rows.Next() {
+			total += rows.Row().Vals["i"]
+		}
+		assert.NoError(t, rows.Err())
+		return total
+	}
+
+	for _, dim := range []int{5, 7, 5} {
+		bound, err := db.BindPrepared(prepared.ID, dim)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.EqualValues(t, dim, sum(bound))
+		_, parsed := db.parsedQueries.get(bound)
+		assert.True(t, parsed, "query should have been kept in parsed form")
+	}
+
+	_, err = db.BindPrepared(prepared.ID)
+	assert.Error(t, err, "binding too few params should fail")
+
+	_, err = db.PrepareQuery("SELECT i FROM test_a WHERE dim > ?")
+	assert.NoError(t, err)
+	_, err = db.BindPrepared(prepared.ID, 5)
+	assert.Error(t, err, "least recently used prepared query should have been evicted")
+}
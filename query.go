@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/getlantern/bytemap"
@@ -20,38 +21,144 @@ var (
 )
 
 func (db *DB) Query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (core.FlatRowSource, error) {
-	q, err := sql.Parse(sqlString)
+	like, showSettings, err := sql.ShowSettings(sqlString)
+	if showSettings {
+		if err != nil {
+			return nil, err
+		}
+		return &settingsSource{db, like}, nil
+	}
+	showTables, err := sql.ShowTables(sqlString)
+	if showTables {
+		if err != nil {
+			return nil, err
+		}
+		return &tablesSource{db}, nil
+	}
+	describeTable, describe, err := sql.Describe(sqlString)
+	if describe {
+		if err != nil {
+			return nil, err
+		}
+		return db.describe(describeTable)
+	}
+
+	planning := planTiming{start: time.Now()}
+	plan, limits, clamp, err := db.query(sqlString, isSubQuery, subQueryResults, includeMemStore)
 	if err != nil {
 		return nil, err
 	}
+	planning.end = time.Now()
+	db.recordColumnUsage(sqlString)
+	return db.cancellable(&limitedSource{FlatRowSource: plan, db: db, sqlString: sqlString, planning: planning, limits: limits, clamp: clamp}), nil
+}
+
+// query plans the given query without making it cancellable with CancelQuery
+// or enforcing its resource limits, which it returns alongside the plan. It
+// also returns the queryClamp that records whether planning clamped the
+// query's time range.
+func (db *DB) query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (core.FlatRowSource, queryLimits, *queryClamp, error) {
+	q, err := db.parse(sqlString)
+	if err != nil {
+		return nil, queryLimits{}, nil, err
+	}
+	limits := db.queryLimitsFor(q)
 
 	if q.ForceFresh {
 		log.Debug("Query requires fresh results, including mem store")
 		includeMemStore = true
 	}
+	includeWALTail := q.IncludeWALTail || (includeMemStore && db.opts.IncludeWALTail)
+	clamp := &queryClamp{}
 
 	opts := &planner.Opts{
 		GetTable: func(table string, outFields func(tableFields core.Fields) (core.Fields, error)) (planner.Table, error) {
-			return db.getQueryable(table, outFields, includeMemStore)
+			return db.getQueryable(table, outFields, includeMemStore, includeWALTail)
 		},
 		Now:             db.now,
+		GetViews:        db.viewsOf,
 		IsSubQuery:      isSubQuery,
 		SubQueryResults: subQueryResults,
+		MemoryLimit:     db.spillMemory(),
+		SpillQuota:      db.spill.NewQuota(),
+		OnClamp:         clamp.record,
 	}
 	if db.opts.Passthrough {
 		opts.QueryCluster = func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
-			return db.queryCluster(ctx, sqlString, isSubQuery, subQueryResults, includeMemStore, unflat, onFields, onRow, onFlatRow)
+			return db.queryCluster(withPartitionFailure(ctx, q.OnPartitionFailure), sqlString, isSubQuery, subQueryResults, includeMemStore, unflat, onFields, onRow, onFlatRow)
 		}
 	}
-	plan, err := planner.Plan(sqlString, opts)
+	// Plan a clone so that q stays as parsed
+	plan, err := planner.PlanQuery(q.Clone(), opts)
 	if err != nil {
-		return nil, err
+		return nil, limits, nil, err
 	}
 	log.Debugf("\n------------ Query Plan ------------\n\n%v\n\n%v\n----------- End Query Plan ----------", sqlString, core.FormatSource(plan))
-	return plan, nil
+	if q.Explain {
+		return db.explain(plan, includeMemStore), limits, clamp, nil
+	}
+	if db.queryCache != nil && !isSubQuery && cacheable(q) {
+		plan = db.cachedQuery(q, includeMemStore, plan, func(asOf time.Time) (core.FlatRowSource, error) {
+			sqlFrom, err := sql.WithAsOf(sqlString, asOf)
+			if err != nil {
+				return nil, err
+			}
+			return planner.Plan(sqlFrom, opts)
+		})
+	}
+	if db.queryCoalescer != nil && !isSubQuery {
+		plan = db.coalescedQuery(q, includeMemStore, plan)
+	}
+	return plan, limits, clamp, nil
+}
+
+// queryClamp records the ASOF and UNTIL that a query asked for if planning
+// clamped them to the time range that the queried table retains.
+type queryClamp struct {
+	requestedAsOf  time.Time
+	requestedUntil time.Time
+	clamped        bool
+	mx             sync.Mutex
+}
+
+// record records a clamp reported by the planner. Since subqueries and
+// replanning may report more than one, it keeps the widest requested range.
+func (c *queryClamp) record(requestedAsOf time.Time, requestedUntil time.Time) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.clamped = true
+	if !requestedAsOf.IsZero() && (c.requestedAsOf.IsZero() || requestedAsOf.Before(c.requestedAsOf)) {
+		c.requestedAsOf = requestedAsOf
+	}
+	if requestedUntil.After(c.requestedUntil) {
+		c.requestedUntil = requestedUntil
+	}
+}
+
+// reportTo reports the clamp, if any, in the given stats.
+func (c *queryClamp) reportTo(stats *common.QueryStats) {
+	if c == nil {
+		return
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if !c.clamped {
+		return
+	}
+	stats.Clamped = true
+	stats.RequestedAsOf = c.requestedAsOf
+	stats.RequestedUntil = c.requestedUntil
 }
 
-func (db *DB) getQueryable(table string, outFields func(tableFields core.Fields) (core.Fields, error), includeMemStore bool) (*queryable, error) {
+func (db *DB) getQueryable(table string, outFields func(tableFields core.Fields) (core.Fields, error), includeMemStore bool, includeWALTail bool) (*queryable, error) {
+	if isAttachedTable(table) {
+		t, err := db.getAttachedTable(table)
+		if err != nil {
+			return nil, err
+		}
+		// Attached backups have neither memstore nor WAL
+		return db.queryableFor(t, outFields, false, false)
+	}
 	t := db.getTable(table)
 	if t == nil {
 		return nil, fmt.Errorf("Table %v not found", table)
@@ -59,7 +166,16 @@ func (db *DB) getQueryable(table string, outFields func(tableFields core.Fields)
 	if t.Virtual {
 		return nil, fmt.Errorf("Table %v is virtual and cannot be queried", table)
 	}
-	until := encoding.RoundTimeUp(db.clock.Now(), t.Resolution)
+	if db.opts.RejectQueriesDuringRecovery {
+		if err := t.checkRecovered(); err != nil {
+			return nil, err
+		}
+	}
+	return db.queryableFor(t, outFields, includeMemStore, includeWALTail)
+}
+
+func (db *DB) queryableFor(t *table, outFields func(tableFields core.Fields) (core.Fields, error), includeMemStore bool, includeWALTail bool) (*queryable, error) {
+	until := encoding.RoundTimeUp(t.now(), t.Resolution)
 	asOf := encoding.RoundTimeUp(until.Add(-1*t.RetentionPeriod), t.Resolution)
 	fields := t.getFields()
 	out, err := outFields(fields)
@@ -69,16 +185,28 @@ func (db *DB) getQueryable(table string, outFields func(tableFields core.Fields)
 	if out == nil {
 		out = t.getFields()
 	}
-	return &queryable{db, t, out, asOf, until, includeMemStore}, nil
+	return &queryable{db: db, t: t, fields: out, asOf: asOf, until: until, includeMemStore: includeMemStore, includeWALTail: includeWALTail}, nil
 }
 
 func MetaDataFor(source core.FlatRowSource, fields core.Fields) *common.QueryMetaData {
+	var queryID string
+	if cs, ok := source.(*cancellableSource); ok {
+		queryID = cs.id
+		source = cs.FlatRowSource
+	}
+	var fieldMetaData []*common.FieldMetaData
+	if ls, ok := source.(*limitedSource); ok {
+		source = ls.FlatRowSource
+		fieldMetaData = ls.db.FieldMetaData(ls.sqlString, fields)
+	}
 	return &common.QueryMetaData{
 		FieldNames: fields.Names(),
+		Fields:     fieldMetaData,
 		AsOf:       source.GetAsOf(),
 		Until:      source.GetUntil(),
 		Resolution: source.GetResolution(),
 		Plan:       core.FormatSource(source),
+		QueryID:    queryID,
 	}
 }
 
@@ -89,6 +217,8 @@ type queryable struct {
 	asOf            time.Time
 	until           time.Time
 	includeMemStore bool
+	includeWALTail  bool
+	filter          *segmentFilter
 }
 
 func (q *queryable) GetGroupBy() []core.GroupBy {
@@ -108,7 +238,28 @@ func (q *queryable) GetUntil() time.Time {
 }
 
 func (q *queryable) GetPartitionBy() []string {
-	return q.t.PartitionBy
+	return q.db.partitionKeysFor(q.t)
+}
+
+// Prune implements planner.Prunable, allowing iteration to skip row groups of
+// columnar segments that can't contain data for the query.
+func (q *queryable) Prune(asOf time.Time, until time.Time, whereEquals map[string]string) {
+	q.filter = newSegmentFilter(asOf, until, whereEquals)
+}
+
+// GetRollup implements planner.RolledUp.
+func (q *queryable) GetRollup() (planner.Table, time.Time, error) {
+	r := q.t.getRollup()
+	if r == nil {
+		return nil, time.Time{}, nil
+	}
+	rollup, err := q.db.queryableFor(r.t, func(tableFields core.Fields) (core.Fields, error) {
+		return q.fields, nil
+	}, false, false)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return rollup, r.until, nil
 }
 
 func (q *queryable) String() string {
@@ -126,10 +277,17 @@ func (q *queryable) Iterate(ctx context.Context, onFields core.OnFields, onRow c
 		return nil, errors.New("No fields found!")
 	}
 
+	usage := queryUsageFrom(ctx)
+	limited := false
 	i := 1
 	// When iterating, as an optimization, we read only the needed fields (not
 	// all table fields).
-	highWaterMark, err := q.t.iterate(ctx, q.fields, q.includeMemStore, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+	highWaterMark, err := q.t.iterate(ctx, q.fields, q.includeMemStore, q.includeWALTail, q.filter, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		if usage != nil && !usage.scanned(key, vals) {
+			// Stop scanning but keep what we have so far as partial results
+			limited = true
+			return false, nil
+		}
 		if i%1000 == 0 {
 			// every 1000 rows, check and cap memory size
 			if !q.db.capMemorySize(false) {
@@ -144,7 +302,7 @@ func (q *queryable) Iterate(ctx context.Context, onFields core.OnFields, onRow c
 		log.Errorf("Error on iterating: %v", err)
 	}
 	numSuccessfulPartitions := 0
-	if err == nil {
+	if err == nil && !limited {
 		numSuccessfulPartitions = 1
 	}
 	return &common.QueryStats{
@@ -0,0 +1,206 @@
+package zenodb
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+)
+
+const (
+	// DefaultQueryAuditLogMaxBytes is the default for DBOpts.QueryAuditLogMaxBytes
+	DefaultQueryAuditLogMaxBytes = 100 * 1024 * 1024
+
+	queryAuditLogFilename = "query_audit.log"
+
+	// queryAuditBacklog is how many audit records can wait to be sent to the
+	// stream and sink before new ones are dropped
+	queryAuditBacklog = 10000
+)
+
+// QueryAudit is an audit record of a query.
+type QueryAudit struct {
+	TS time.Time
+	// User identifies who ran the query, like the address of the client
+	User string `json:",omitempty"`
+	// Principal is the authenticated user or API token that ran the query, if
+	// any
+	Principal string `json:",omitempty"`
+	// RequestID identifies the request that ran the query across nodes
+	RequestID string `json:",omitempty"`
+	SQL       string
+	// Plan is the formatted query plan
+	Plan         string
+	PlanningTime time.Duration
+	Duration     time.Duration
+	RowsScanned  int64
+	RowsReturned int64
+	// ResultBytes estimates the size of the rows returned
+	ResultBytes       int64
+	MissingPartitions []int  `json:",omitempty"`
+	LimitExceeded     string `json:",omitempty"`
+	Error             string `json:",omitempty"`
+
+	// sampled indicates that the record also goes to the stream and sink
+	sampled bool
+}
+
+// queryAuditor writes audit records to the configured sinks. Every query is
+// recorded in the audit log, before its results are considered complete. A
+// sample of queries also goes to the audit stream and sink, in the background
+// so that they don't slow down queries. If those fall too far behind, their
+// records are dropped.
+type queryAuditor struct {
+	db      *DB
+	percent float64
+	file    *jsonLog
+	records chan *QueryAudit
+	dropped int64
+}
+
+func (db *DB) initQueryAudit() error {
+	if db.opts.QueryAuditPercent > 0 && !db.opts.QueryAuditLog && db.opts.QueryAuditStream == "" && db.opts.QueryAuditSink == nil {
+		return errors.New("QueryAuditPercent requires QueryAuditLog, QueryAuditStream and/or QueryAuditSink")
+	}
+	if !db.opts.QueryAuditLog && db.opts.QueryAuditPercent <= 0 {
+		return nil
+	}
+	if db.opts.QueryAuditLogMaxBytes == 0 {
+		db.opts.QueryAuditLogMaxBytes = DefaultQueryAuditLogMaxBytes
+	}
+	a := &queryAuditor{
+		db:      db,
+		percent: db.opts.QueryAuditPercent,
+		records: make(chan *QueryAudit, queryAuditBacklog),
+	}
+	if db.opts.QueryAuditLog && !db.opts.ReadOnly {
+		file, err := openJSONLog(filepath.Join(db.opts.Dir, queryAuditLogFilename), db.opts.QueryAuditLogMaxBytes)
+		if err != nil {
+			return err
+		}
+		a.file = file
+	}
+	db.queryAuditor = a
+	go a.write()
+	return nil
+}
+
+// auditQuery starts auditing a query if there's an audit log or the query is
+// sampled for auditing. If it's audited, it returns an audit record and an
+// onRow that tracks what the query returns, otherwise it returns a nil record
+// and the original onRow.
+func (db *DB) auditQuery(ctx context.Context, sqlString string, planning planTiming, plan core.FlatRowSource, onRow core.OnFlatRow) (*QueryAudit, core.OnFlatRow) {
+	a := db.queryAuditor
+	if a == nil {
+		return nil, onRow
+	}
+	sampled := a.percent > 0 && rand.Float64()*100 < a.percent
+	if a.file == nil && !sampled {
+		return nil, onRow
+	}
+	audit := &QueryAudit{
+		sampled:      sampled,
+		TS:           planning.start,
+		User:         common.CallerFor(ctx),
+		Principal:    common.PrincipalFor(ctx),
+		RequestID:    common.RequestIDFor(ctx),
+		SQL:          sqlString,
+		Plan:         core.FormatSource(plan),
+		PlanningTime: planning.end.Sub(planning.start),
+	}
+	return audit, func(row *core.FlatRow) (bool, error) {
+		audit.RowsReturned++
+		// key, timestamp and values
+		audit.ResultBytes += int64(len(row.Key) + 8 + 8*len(row.Values))
+		return onRow(row)
+	}
+}
+
+// finishQueryAudit completes the given audit record, if any, and submits it
+// to the sinks. It returns an error if the record couldn't be written to the
+// audit log, in which case the query should fail rather than go unaudited.
+func (db *DB) finishQueryAudit(audit *QueryAudit, metadata interface{}, err error) error {
+	if audit == nil {
+		return nil
+	}
+	audit.Duration = time.Since(audit.TS)
+	if stats, ok := metadata.(*common.QueryStats); ok && stats != nil {
+		audit.RowsScanned = stats.RowsScanned
+		audit.MissingPartitions = stats.MissingPartitions
+		audit.LimitExceeded = stats.LimitExceeded
+	}
+	if err != nil {
+		audit.Error = err.Error()
+	}
+	a := db.queryAuditor
+	if a.file != nil {
+		if writeErr := a.file.write(audit); writeErr != nil {
+			return errors.New("Unable to write query audit log: %v", writeErr)
+		}
+	}
+	if !audit.sampled {
+		return nil
+	}
+	select {
+	case a.records <- audit:
+		// submitted
+	default:
+		if atomic.AddInt64(&a.dropped, 1)%1000 == 1 {
+			log.Errorf("Query audit stream and sink are falling behind, dropped %d audit records so far", atomic.LoadInt64(&a.dropped))
+		}
+	}
+	return nil
+}
+
+func (a *queryAuditor) write() {
+	for audit := range a.records {
+		if a.db.opts.QueryAuditStream != "" {
+			if err := a.insert(audit); err != nil {
+				log.Errorf("Unable to insert query audit into stream %v: %v", a.db.opts.QueryAuditStream, err)
+			}
+		}
+		if a.db.opts.QueryAuditSink != nil {
+			if err := a.db.opts.QueryAuditSink(audit); err != nil {
+				log.Errorf("Unable to send query audit to sink: %v", err)
+			}
+		}
+	}
+}
+
+// insert inserts the audit record into the audit stream, so that it can be
+// queried through a table on that stream.
+func (a *queryAuditor) insert(audit *QueryAudit) error {
+	dims := map[string]interface{}{
+		"user": audit.User,
+		"sql":  audit.SQL,
+	}
+	if audit.Principal != "" {
+		dims["principal"] = audit.Principal
+	}
+	if audit.LimitExceeded != "" {
+		dims["limit_exceeded"] = audit.LimitExceeded
+	}
+	if audit.Error != "" {
+		dims["error"] = audit.Error
+	}
+	return a.db.Insert(a.db.opts.QueryAuditStream, audit.TS, dims, map[string]float64{
+		"queries":            1,
+		"planning_ms":        float64(audit.PlanningTime) / float64(time.Millisecond),
+		"duration_ms":        float64(audit.Duration) / float64(time.Millisecond),
+		"rows_scanned":       float64(audit.RowsScanned),
+		"rows_returned":      float64(audit.RowsReturned),
+		"result_bytes":       float64(audit.ResultBytes),
+		"missing_partitions": float64(len(audit.MissingPartitions)),
+	})
+}
+
+func (a *queryAuditor) close() {
+	if a.file != nil {
+		a.file.close()
+	}
+}
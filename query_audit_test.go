@@ -0,0 +1,165 @@
+package zenodb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryAudit(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = NewDB(&DBOpts{Dir: tmpDir, QueryAuditPercent: 100})
+	assert.Error(t, err, "auditing without a sink should fail")
+
+	audits := make(chan *QueryAudit, 10)
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+		QueryAuditPercent:         100,
+		QueryAuditLog:             true,
+		QueryAuditStream:          "audit",
+		QueryAuditSink: func(audit *QueryAudit) error {
+			audits <- audit
+			return nil
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+		"audits": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT queries, rows_returned FROM audit GROUP BY user, principal, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"dim": i}, map[string]float64{"i": 1}))
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	query := func(sqlString string) int {
+		source, err := db.Query(sqlString, false, nil, true)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		rows := 0
+		_, err = source.Iterate(common.WithPrincipal(common.WithCaller(context.Background(), "tester"), "alice"), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			rows++
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return rows
+	}
+
+	sqlString := "SELECT i FROM test_a GROUP BY dim"
+	assert.Equal(t, 10, query(sqlString))
+	var audit *QueryAudit
+	select {
+	case audit = <-audits:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "query wasn't audited")
+		return
+	}
+	assert.Equal(t, "tester", audit.User)
+	assert.Equal(t, "alice", audit.Principal)
+	assert.Equal(t, sqlString, audit.SQL)
+	assert.NotEmpty(t, audit.Plan)
+	assert.EqualValues(t, 10, audit.RowsScanned)
+	assert.EqualValues(t, 10, audit.RowsReturned)
+	assert.True(t, audit.ResultBytes > 0)
+	assert.True(t, audit.Duration >= audit.PlanningTime)
+	assert.Empty(t, audit.Error)
+
+	file, err := os.Open(filepath.Join(tmpDir, queryAuditLogFilename))
+	if assert.NoError(t, err) {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		if assert.True(t, scanner.Scan(), "audit log should contain a record") {
+			logged := &QueryAudit{}
+			if assert.NoError(t, json.Unmarshal(scanner.Bytes(), logged)) {
+				assert.Equal(t, sqlString, logged.SQL)
+				assert.EqualValues(t, 10, logged.RowsReturned)
+				assert.Equal(t, "alice", logged.Principal)
+			}
+		}
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, 1, query("SELECT queries, rows_returned FROM audits WHERE user = 'tester' AND principal = 'alice'"), "audit should have been inserted into audit stream")
+}
+
+func TestQueryAuditLogRecordsEveryQuery(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+		QueryAuditLog:             true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	query := func() error {
+		source, err := db.Query("SELECT i FROM test_a", false, nil, true)
+		if err != nil {
+			return err
+		}
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			return true, nil
+		})
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, query())
+	}
+	logged, err := ioutil.ReadFile(filepath.Join(tmpDir, queryAuditLogFilename))
+	if assert.NoError(t, err) {
+		assert.Len(t, strings.Split(strings.TrimSpace(string(logged)), "\n"), 3, "every query should have been audited without sampling")
+	}
+
+	db.queryAuditor.file.close()
+	err = query()
+	if assert.Error(t, err, "query that can't be audited should fail") {
+		assert.Contains(t, err.Error(), "Unable to write query audit log")
+	}
+}
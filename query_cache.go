@@ -0,0 +1,278 @@
+package zenodb
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	// DefaultQueryCacheLag is the default value for DBOpts.QueryCacheLag
+	DefaultQueryCacheLag = 1 * time.Minute
+
+	// queryCacheMaxRows caps the number of rows cached for a single query
+	queryCacheMaxRows = 100000
+)
+
+var (
+	errQueryCacheStale = errors.New("cached query results are stale")
+)
+
+// queryCache caches the results of queries for the periods that are complete,
+// so that repeating a query only requires computing the trailing periods that
+// may still change. Entries are keyed by the normalized SQL of the query and
+// evicted on a least recently used basis.
+type queryCache struct {
+	size    int
+	lag     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+	mx      sync.Mutex
+}
+
+type queryCacheEntry struct {
+	key        string
+	fields     core.Fields
+	resolution time.Duration
+	until      time.Time
+	// complete is the timestamp of the latest period whose results are final
+	complete time.Time
+	rows     []*core.FlatRow
+}
+
+func newQueryCache(size int, lag time.Duration) *queryCache {
+	return &queryCache{
+		size:    size,
+		lag:     lag,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+func (c *queryCache) get(key string) *queryCacheEntry {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	el := c.entries[key]
+	if el == nil {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*queryCacheEntry)
+}
+
+func (c *queryCache) put(entry *queryCacheEntry) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	el := c.entries[entry.key]
+	if el != nil {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*queryCacheEntry).key)
+	}
+}
+
+func (c *queryCache) remove(key string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	el := c.entries[key]
+	if el != nil {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// usableFor indicates whether the cached entry has complete periods that line
+// up with the periods of a query with the given resolution, asOf and until.
+func (entry *queryCacheEntry) usableFor(resolution time.Duration, asOf time.Time, until time.Time) bool {
+	return entry != nil &&
+		entry.resolution == resolution &&
+		!until.Before(entry.until) &&
+		until.Sub(entry.until)%resolution == 0 &&
+		entry.complete.After(asOf)
+}
+
+// cacheable determines whether the results of the given query can be cached
+// and merged with results for later periods. That's not the case for queries
+// whose results depend on all periods at once, like ones with ORDER BY or
+// LIMIT.
+func cacheable(q *sql.Query) bool {
+	if q.FromSubQuery != nil || len(q.OrderBy) > 0 || q.Limit > 0 || q.Offset > 0 || q.Crosstab != nil || q.Stride > 0 {
+		return false
+	}
+	return !q.HasSubQueries()
+}
+
+// cachedSource is a core.FlatRowSource that serves complete periods from the
+// queryCache and only runs the query for the remaining periods.
+type cachedSource struct {
+	core.FlatRowSource
+	db       *DB
+	key      string
+	planFrom func(asOf time.Time) (core.FlatRowSource, error)
+}
+
+func (db *DB) cachedQuery(q *sql.Query, includeMemStore bool, plan core.FlatRowSource, planFrom func(asOf time.Time) (core.FlatRowSource, error)) core.FlatRowSource {
+	return &cachedSource{
+		FlatRowSource: plan,
+		db:            db,
+		key:           strconv.FormatBool(includeMemStore) + " " + q.SQL,
+		planFrom:      planFrom,
+	}
+}
+
+func (s *cachedSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	cache := s.db.queryCache
+	resolution := s.GetResolution()
+	asOf := s.GetAsOf()
+	until := s.GetUntil()
+
+	entry := cache.get(s.key)
+	if entry.usableFor(resolution, asOf, until) {
+		source, err := s.planFrom(entry.complete)
+		if err != nil {
+			log.Errorf("Unable to plan query for uncached periods, running full query: %v", err)
+		} else {
+			metadata, stale, err := s.iterate(ctx, source, entry, resolution, until, onFields, onRow)
+			if !stale {
+				log.Debugf("Served results through %v from cache: %v", entry.complete, s.key)
+				return metadata, err
+			}
+			log.Debugf("Cached results don't match current fields, running full query: %v", s.key)
+			cache.remove(s.key)
+		}
+	}
+
+	metadata, _, err := s.iterate(ctx, s.FlatRowSource, nil, resolution, until, onFields, onRow)
+	return metadata, err
+}
+
+// iterate iterates over source, preceded by the complete rows from entry if
+// it's not nil, and caches the complete rows from the combined results. If the
+// fields of the results don't match the ones in entry, it stops without
+// emitting anything and returns stale = true.
+func (s *cachedSource) iterate(ctx context.Context, source core.FlatRowSource, entry *queryCacheEntry, resolution time.Duration, until time.Time, onFields core.OnFields, onRow core.OnFlatRow) (metadata interface{}, stale bool, err error) {
+	asOf := s.GetAsOf().UnixNano()
+	var fields core.Fields
+	var rows []*core.FlatRow
+	tooManyRows := false
+	stopped := false
+	emit := func(row *core.FlatRow) (bool, error) {
+		if !tooManyRows {
+			if len(rows) == queryCacheMaxRows {
+				tooManyRows = true
+				rows = nil
+			} else {
+				rows = append(rows, row)
+			}
+		}
+		more, err := onRow(row)
+		stopped = !more
+		return more, err
+	}
+
+	metadata, err = source.Iterate(ctx, func(inFields core.Fields) error {
+		fields = inFields
+		if entry == nil {
+			return onFields(fields)
+		}
+		if !fields.Equals(entry.fields) {
+			stale = true
+			return errQueryCacheStale
+		}
+		err := onFields(fields)
+		if err != nil {
+			return err
+		}
+		for _, row := range entry.rows {
+			if row.TS < asOf {
+				continue
+			}
+			more, err := emit(row)
+			if !more || err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		if stopped {
+			return false, nil
+		}
+		if entry != nil && row.TS <= entry.complete.UnixNano() {
+			// Already served from cache
+			return true, nil
+		}
+		return emit(row)
+	})
+	if err != nil || tooManyRows || stopped {
+		// Don't cache partial results
+		return
+	}
+
+	complete := s.complete(metadata, resolution, until)
+	if complete.IsZero() {
+		return
+	}
+	completeRows := make([]*core.FlatRow, 0, len(rows))
+	for _, row := range rows {
+		if row.TS <= complete.UnixNano() {
+			completeRows = append(completeRows, row)
+		}
+	}
+	s.db.queryCache.put(&queryCacheEntry{
+		key:        s.key,
+		fields:     fields,
+		resolution: resolution,
+		until:      until,
+		complete:   complete,
+		rows:       completeRows,
+	})
+	return
+}
+
+// complete determines the timestamp of the latest period in the results that
+// is final, which is the latest period that's older than both QueryCacheLag
+// and the high water mark of the data that was queried. Returns a zero time if
+// none of the periods are known to be final.
+func (s *cachedSource) complete(metadata interface{}, resolution time.Duration, until time.Time) time.Time {
+	stats, ok := metadata.(*common.QueryStats)
+	if !ok || stats.LowestHighWaterMark == 0 || stats.NumSuccessfulPartitions < stats.NumPartitions {
+		return time.Time{}
+	}
+	complete := s.db.clock.Now().Add(-1 * s.db.queryCache.lag)
+	highWaterMark := encoding.TimeFromMillis(stats.LowestHighWaterMark)
+	if highWaterMark.Before(complete) {
+		complete = highWaterMark
+	}
+	if complete.After(until) {
+		complete = until
+	}
+	// More data may still arrive with the exact timestamp of the high water mark
+	complete = encoding.RoundTimeUntilDown(complete.Add(-1), resolution, until)
+	if !complete.After(s.GetAsOf()) {
+		return time.Time{}
+	}
+	return complete
+}
+
+func (s *cachedSource) GetSource() core.Source {
+	return s.FlatRowSource
+}
+
+func (s *cachedSource) String() string {
+	return fmt.Sprintf("cached %v", s.key)
+}
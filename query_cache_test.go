@@ -0,0 +1,81 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2020, 1, 1, 0, 10, 0, 0, time.UTC)
+	db, err := NewDB(&DBOpts{
+		Dir:            tmpDir,
+		Clock:          vtime.NewVirtualClock(epoch),
+		QueryCacheSize: 1,
+		QueryCacheLag:  2 * time.Minute,
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	insert := func(ago time.Duration, i float64) {
+		assert.NoError(t, db.Insert("inbound", epoch.Add(-1*ago), map[string]interface{}{"dim": "a"}, map[string]float64{"i": i}))
+	}
+	query := func(sqlString string) map[time.Duration]float64 {
+		time.Sleep(250 * time.Millisecond)
+		source, err := db.Query(sqlString, false, nil, true)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		result := make(map[time.Duration]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result[epoch.Sub(time.Unix(0, row.TS))] += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+	sqlString := "SELECT i FROM test_a GROUP BY dim, period(1m)"
+
+	insert(5*time.Minute, 1)
+	insert(3*time.Minute, 1)
+	insert(1*time.Minute, 1)
+	expected := map[time.Duration]float64{5 * time.Minute: 1, 3 * time.Minute: 1, 1 * time.Minute: 1}
+	assert.Equal(t, expected, query(sqlString))
+
+	// Late arriving data only shows up in periods that weren't complete yet
+	insert(5*time.Minute, 10)
+	insert(1*time.Minute, 10)
+	expected[1*time.Minute] = 11
+	assert.Equal(t, expected, query(sqlString), "Complete periods should come from cache")
+	assert.Equal(t, expected, query(sqlString), "Repeated query should give same results")
+	assert.Equal(t, map[time.Duration]float64{5 * time.Minute: 11, 3 * time.Minute: 1, 1 * time.Minute: 11}, query(sqlString+" ORDER BY _time"), "Queries with ORDER BY shouldn't be cached")
+
+	// Only one query fits in the cache
+	assert.Equal(t, map[time.Duration]float64{5 * time.Minute: 11, 3 * time.Minute: 1, 1 * time.Minute: 11}, query("SELECT i AS j FROM test_a GROUP BY dim, period(1m)"))
+	assert.Equal(t, map[time.Duration]float64{5 * time.Minute: 11, 3 * time.Minute: 1, 1 * time.Minute: 11}, query(sqlString), "Evicted query should be recomputed")
+}
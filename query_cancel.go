@@ -0,0 +1,67 @@
+package zenodb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/core"
+)
+
+var (
+	// ErrQueryCancelled indicates that a query was cancelled with CancelQuery
+	// while it was running.
+	ErrQueryCancelled = errors.New("query cancelled")
+)
+
+// cancellableSource is a core.FlatRowSource for a query that can be cancelled
+// with CancelQuery while it's being iterated. Its id is reported to clients in
+// the QueryID of the query's metadata.
+type cancellableSource struct {
+	core.FlatRowSource
+	db *DB
+	id string
+}
+
+func (db *DB) cancellable(plan core.FlatRowSource) *cancellableSource {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &cancellableSource{FlatRowSource: plan, db: db, id: hex.EncodeToString(id)}
+}
+
+func (s *cancellableSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.db.runningQueriesMx.Lock()
+	s.db.runningQueries[s.id] = cancel
+	s.db.runningQueriesMx.Unlock()
+	defer func() {
+		s.db.runningQueriesMx.Lock()
+		delete(s.db.runningQueries, s.id)
+		s.db.runningQueriesMx.Unlock()
+	}()
+
+	metadata, err := s.FlatRowSource.Iterate(ctx, onFields, onRow)
+	if err != nil && ctx.Err() == context.Canceled {
+		err = ErrQueryCancelled
+	}
+	return metadata, err
+}
+
+// CancelQuery cancels the running query with the given ID, as reported in the
+// QueryID of its metadata. Iteration of the query stops promptly with
+// ErrQueryCancelled. If the query is running on a cluster, the followers that
+// are processing it for the query are told to stop as well.
+func (db *DB) CancelQuery(queryID string) error {
+	db.runningQueriesMx.Lock()
+	cancel := db.runningQueries[queryID]
+	db.runningQueriesMx.Unlock()
+	if cancel == nil {
+		return errors.New("Query %v not found, it may have already finished", queryID)
+	}
+	log.Debugf("Cancelling query %v", queryID)
+	cancel()
+	return nil
+}
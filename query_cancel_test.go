@@ -0,0 +1,90 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelQuery(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir: tmpDir,
+		// Give us time to cancel before the table is scanned
+		IterationCoalesceInterval: 250 * time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"dim": i}, map[string]float64{"i": 1}))
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	runningQueries := func() []string {
+		db.runningQueriesMx.Lock()
+		defer db.runningQueriesMx.Unlock()
+		var ids []string
+		for id := range db.runningQueries {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	query := func(cancel bool) (int, error) {
+		source, err := db.Query("SELECT i FROM test_a GROUP BY dim", false, nil, true)
+		if !assert.NoError(t, err) {
+			return 0, err
+		}
+		if cancel {
+			go func() {
+				for len(runningQueries()) == 0 {
+					time.Sleep(5 * time.Millisecond)
+				}
+				assert.NoError(t, db.CancelQuery(runningQueries()[0]))
+			}()
+		}
+		rows := 0
+		_, err = source.Iterate(context.Background(), func(fields core.Fields) error {
+			assert.NotEmpty(t, MetaDataFor(source, fields).QueryID)
+			return nil
+		}, func(row *core.FlatRow) (bool, error) {
+			rows++
+			return true, nil
+		})
+		return rows, err
+	}
+
+	rows, err := query(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, rows)
+
+	rows, err = query(true)
+	assert.Equal(t, ErrQueryCancelled, err)
+	assert.Equal(t, 0, rows)
+
+	assert.Error(t, db.CancelQuery("unknown"), "Cancelling unknown query should fail")
+	assert.Empty(t, runningQueries(), "Finished queries should no longer be running")
+}
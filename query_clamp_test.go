@@ -0,0 +1,74 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryReportsClamping(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"dim": "a"}, map[string]float64{"i": 1}))
+	time.Sleep(250 * time.Millisecond)
+
+	query := func(sqlString string) (int, *common.QueryStats) {
+		source, err := db.Query(sqlString, false, nil, true)
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		rows := 0
+		stats, err := source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			rows++
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		return rows, stats.(*common.QueryStats)
+	}
+
+	before := time.Now()
+	rows, stats := query("SELECT i FROM test_a ASOF '-24h'")
+	if assert.NotNil(t, stats) {
+		assert.Equal(t, 1, rows, "clamped query should still return retained data")
+		assert.True(t, stats.Clamped, "query reaching beyond retention should have been clamped")
+		assert.WithinDuration(t, before.Add(-24*time.Hour), stats.RequestedAsOf, 2*time.Minute, "should report requested ASOF")
+		assert.True(t, stats.RequestedUntil.IsZero(), "UNTIL wasn't clamped")
+	}
+
+	rows, stats = query("SELECT i FROM test_a ASOF '-30m'")
+	if assert.NotNil(t, stats) {
+		assert.Equal(t, 1, rows)
+		assert.False(t, stats.Clamped, "query within retention shouldn't have been clamped")
+		assert.True(t, stats.RequestedAsOf.IsZero())
+	}
+}
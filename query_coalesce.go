@@ -0,0 +1,173 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	// coalescedQueryMaxRows caps the number of rows buffered in order to share
+	// them with coalesced queries
+	coalescedQueryMaxRows = 100000
+)
+
+// queryCoalescer keeps track of the queries that are currently running, so
+// that identical queries issued while they're running can wait for and share
+// their results instead of running again. This is similar to how table
+// iterations are coalesced, but at the level of whole queries.
+type queryCoalescer struct {
+	running map[string]*coalescedRun
+	mx      sync.Mutex
+}
+
+// coalescedRun is a single execution of a query whose results may be shared
+// with identical queries.
+type coalescedRun struct {
+	done     chan struct{}
+	waiters  int
+	fields   core.Fields
+	rows     []*core.FlatRow
+	metadata interface{}
+	// shareable indicates that the run completed successfully and all of its
+	// rows were buffered
+	shareable bool
+}
+
+func newQueryCoalescer() *queryCoalescer {
+	return &queryCoalescer{
+		running: make(map[string]*coalescedRun),
+	}
+}
+
+// join returns the run for the given key and whether or not the caller should
+// execute it (because no identical query was already running).
+func (c *queryCoalescer) join(key string) (*coalescedRun, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	run := c.running[key]
+	if run != nil {
+		run.waiters++
+		return run, false
+	}
+	run = &coalescedRun{done: make(chan struct{})}
+	c.running[key] = run
+	return run, true
+}
+
+func (c *queryCoalescer) finish(key string, run *coalescedRun) {
+	c.mx.Lock()
+	delete(c.running, key)
+	waiters := run.waiters
+	c.mx.Unlock()
+	close(run.done)
+	if waiters > 0 && run.shareable {
+		metrics.QueriesCoalesced(waiters)
+	}
+}
+
+// coalescedSource is a core.FlatRowSource that shares its results with
+// identical queries issued while it's running.
+type coalescedSource struct {
+	core.FlatRowSource
+	db  *DB
+	key string
+}
+
+func (db *DB) coalescedQuery(q *sql.Query, includeMemStore bool, plan core.FlatRowSource) core.FlatRowSource {
+	return &coalescedSource{
+		FlatRowSource: plan,
+		db:            db,
+		key:           strconv.FormatBool(includeMemStore) + " " + q.SQL,
+	}
+}
+
+func (s *coalescedSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	// Relative times are resolved when planning, so only queries for the same
+	// time range are identical.
+	key := fmt.Sprintf("%v %d %d %d", s.key, s.GetResolution(), s.GetAsOf().UnixNano(), s.GetUntil().UnixNano())
+	c := s.db.queryCoalescer
+	run, execute := c.join(key)
+	if execute {
+		defer c.finish(key, run)
+		return s.execute(ctx, run, onFields, onRow)
+	}
+
+	select {
+	case <-run.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if !run.shareable {
+		log.Debugf("Coalesced query didn't complete, running on its own: %v", s.key)
+		return s.FlatRowSource.Iterate(ctx, onFields, onRow)
+	}
+	log.Debugf("Serving results of coalesced query: %v", s.key)
+	err := onFields(run.fields)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range run.rows {
+		more, err := onRow(row)
+		if !more || err != nil {
+			return copyQueryMetadata(run.metadata), err
+		}
+	}
+	return copyQueryMetadata(run.metadata), nil
+}
+
+// execute runs the query, buffering its results in run as long as they can be
+// shared.
+func (s *coalescedSource) execute(ctx context.Context, run *coalescedRun, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	tooManyRows := false
+	stopped := false
+	metadata, err := s.FlatRowSource.Iterate(ctx, func(fields core.Fields) error {
+		run.fields = fields
+		return onFields(fields)
+	}, func(row *core.FlatRow) (bool, error) {
+		if !tooManyRows {
+			if len(run.rows) == coalescedQueryMaxRows {
+				tooManyRows = true
+				run.rows = nil
+			} else {
+				run.rows = append(run.rows, row)
+			}
+		}
+		more, err := onRow(row)
+		stopped = !more
+		return more, err
+	})
+	if err == nil && !tooManyRows && !stopped {
+		run.metadata = metadata
+		run.shareable = true
+	} else {
+		// Don't share partial results
+		run.rows = nil
+	}
+	return metadata, err
+}
+
+// copyQueryMetadata copies metadata so that callers that update it don't
+// affect each other.
+func copyQueryMetadata(metadata interface{}) interface{} {
+	stats, ok := metadata.(*common.QueryStats)
+	if !ok || stats == nil {
+		return metadata
+	}
+	statsCopy := *stats
+	return &statsCopy
+}
+
+func (s *coalescedSource) GetSource() core.Source {
+	return s.FlatRowSource
+}
+
+func (s *coalescedSource) String() string {
+	return fmt.Sprintf("coalesced %v", s.key)
+}
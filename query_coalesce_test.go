@@ -0,0 +1,137 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryCoalescing(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2020, 1, 1, 0, 10, 0, 0, time.UTC)
+	db, err := NewDB(&DBOpts{
+		Dir:             tmpDir,
+		Clock:           vtime.NewVirtualClock(epoch),
+		CoalesceQueries: true,
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, dim := range []string{"a", "b", "c"} {
+		assert.NoError(t, db.Insert("inbound", epoch.Add(-5*time.Minute), map[string]interface{}{"dim": dim}, map[string]float64{"i": 1}))
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	sqlString := "SELECT i FROM test_a ASOF '-10m' GROUP BY dim, period(1m)"
+	query := func(onRow func(*core.FlatRow) bool) (map[string]float64, error) {
+		source, err := db.Query(sqlString, false, nil, true)
+		if err != nil {
+			return nil, err
+		}
+		result := make(map[string]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result[row.Key.Get("dim").(string)] += row.Values[0]
+			return onRow(row), nil
+		})
+		return result, err
+	}
+	all := func(row *core.FlatRow) bool {
+		return true
+	}
+	expected := map[string]float64{"a": 1, "b": 1, "c": 1}
+
+	waitForWaiters := func(n int) {
+		for i := 0; i < 200; i++ {
+			db.queryCoalescer.mx.Lock()
+			waiters := 0
+			for _, run := range db.queryCoalescer.running {
+				waiters += run.waiters
+			}
+			running := len(db.queryCoalescer.running)
+			db.queryCoalescer.mx.Unlock()
+			if running == 1 && waiters == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Fail(t, "Waiters didn't join in time")
+	}
+
+	runCoalesced := func(stopEarly bool) {
+		release := make(chan bool)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			released := false
+			result, err := query(func(row *core.FlatRow) bool {
+				if !released {
+					<-release
+					released = true
+				}
+				return !stopEarly
+			})
+			if assert.NoError(t, err) && !stopEarly {
+				assert.Equal(t, expected, result)
+			}
+		}()
+		// Wait for the first query to start
+		waitForWaiters(0)
+
+		numWaiters := 3
+		for i := 0; i < numWaiters; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result, err := query(all)
+				if assert.NoError(t, err) {
+					assert.Equal(t, expected, result)
+				}
+			}()
+		}
+		waitForWaiters(numWaiters)
+		close(release)
+		wg.Wait()
+	}
+
+	before := metrics.GetStats().Queries
+	runCoalesced(false)
+	after := metrics.GetStats().Queries
+	assert.EqualValues(t, 3, after.Coalesced-before.Coalesced, "all waiters should have been coalesced")
+	assert.EqualValues(t, 1, after.Shared-before.Shared)
+
+	// When the first query stops early, the others run on their own
+	runCoalesced(true)
+	assert.Equal(t, after, metrics.GetStats().Queries, "partial results shouldn't be shared")
+
+	result, err := query(all)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, result)
+	}
+	assert.Empty(t, db.queryCoalescer.running)
+}
@@ -0,0 +1,289 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	limitRowsScanned = "max_rows_scanned"
+	limitMemory      = "max_memory"
+	limitDuration    = "max_duration"
+	limitGroups      = "max_groups"
+	limitResultBytes = "max_result_bytes"
+)
+
+type queryUsageKey struct{}
+
+// QueryLimitError indicates that a query stopped early because it exceeded one
+// of its resource limits. Any results that it returned are partial. Stats
+// reports what the query had used by the time it stopped.
+type QueryLimitError struct {
+	Limit string
+	Stats *common.QueryStats
+}
+
+func (err *QueryLimitError) Error() string {
+	return fmt.Sprintf("Query exceeded %v after scanning %d rows (~%d bytes), results are partial", err.Limit, err.Stats.RowsScanned, err.Stats.EstimatedMemory)
+}
+
+// queryLimits caps the resources that a single query may use. Zero values mean
+// no limit. Exceeding a soft limit only results in a warning.
+type queryLimits struct {
+	maxRowsScanned     int64
+	maxMemory          int64
+	maxDuration        time.Duration
+	softMaxRowsScanned int64
+	softMaxMemory      int64
+	softMaxDuration    time.Duration
+	softMaxGroups      int64
+	softMaxResultBytes int64
+}
+
+// queryLimitsFor combines the database-wide limits with the ones that the
+// given query requested through hints. Queries can tighten the database-wide
+// limits but not loosen them.
+func (db *DB) queryLimitsFor(q *sql.Query) queryLimits {
+	return queryLimits{
+		maxRowsScanned: tighterLimit(db.opts.MaxQueryRowsScanned, q.MaxRowsScanned),
+		maxMemory:      tighterLimit(db.opts.MaxQueryMemory, q.MaxMemory),
+		maxDuration:    time.Duration(tighterLimit(int64(db.opts.MaxQueryDuration), int64(q.MaxDuration))),
+
+		softMaxRowsScanned: db.opts.SoftMaxQueryRowsScanned,
+		softMaxMemory:      db.opts.SoftMaxQueryMemory,
+		softMaxDuration:    db.opts.SoftMaxQueryDuration,
+		softMaxGroups:      db.opts.SoftMaxQueryGroups,
+		softMaxResultBytes: db.opts.SoftMaxQueryResultBytes,
+	}
+}
+
+// warnings describes the soft limits that a query exceeded.
+func (l queryLimits) warnings(stats *common.QueryStats, groups int64, resultBytes int64, duration time.Duration) []string {
+	var warnings []string
+	warn := func(limit string, msg string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(msg, args...)+fmt.Sprintf(", exceeding the soft limit for %v", limit))
+	}
+	if l.softMaxRowsScanned > 0 && stats.RowsScanned > l.softMaxRowsScanned {
+		warn(limitRowsScanned, "Query scanned %d rows", stats.RowsScanned)
+	}
+	if l.softMaxMemory > 0 && stats.EstimatedMemory > l.softMaxMemory {
+		warn(limitMemory, "Query used ~%d bytes of memory", stats.EstimatedMemory)
+	}
+	if l.softMaxDuration > 0 && duration > l.softMaxDuration {
+		warn(limitDuration, "Query ran for %v", duration)
+	}
+	if l.softMaxGroups > 0 && groups > l.softMaxGroups {
+		warn(limitGroups, "Query returned %d groups", groups)
+	}
+	if l.softMaxResultBytes > 0 && resultBytes > l.softMaxResultBytes {
+		warn(limitResultBytes, "Query returned ~%d bytes of results", resultBytes)
+	}
+	return warnings
+}
+
+func tighterLimit(a int64, b int64) int64 {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// queryUsage tracks the resources used by a query across all of the tables
+// that it scans. It travels with the query's context.
+type queryUsage struct {
+	limits          queryLimits
+	deadline        time.Time
+	rowsScanned     int64
+	estimatedMemory int64
+	groups          int64
+	resultBytes     int64
+	wait            int64
+	parallelWait    int64
+	exceeded        string
+	mx              sync.Mutex
+}
+
+func queryUsageFrom(ctx context.Context) *queryUsage {
+	u, _ := ctx.Value(queryUsageKey{}).(*queryUsage)
+	return u
+}
+
+// scanned records that the query scanned the given row and returns false if
+// that exceeded one of its limits. The memory taken up by a row is estimated
+// as the size of its key and values.
+func (u *queryUsage) scanned(key bytemap.ByteMap, vals []encoding.Sequence) bool {
+	size := int64(len(key))
+	for _, val := range vals {
+		size += int64(len(val))
+	}
+	return u.add(1, size)
+}
+
+// scannedRemotely records the rows scanned and memory used by one partition of
+// a clustered query and returns false if that took the query as a whole over
+// one of its limits, or if the partition itself exceeded one of its limits.
+func (u *queryUsage) scannedRemotely(stats *common.QueryStats) bool {
+	if stats.LimitExceeded != "" {
+		u.exceed(stats.LimitExceeded)
+	}
+	return u.add(stats.RowsScanned, stats.EstimatedMemory)
+}
+
+func (u *queryUsage) add(rows int64, memory int64) bool {
+	rows = atomic.AddInt64(&u.rowsScanned, rows)
+	memory = atomic.AddInt64(&u.estimatedMemory, memory)
+	if u.limits.maxRowsScanned > 0 && rows > u.limits.maxRowsScanned {
+		u.exceed(limitRowsScanned)
+	} else if u.limits.maxMemory > 0 && memory > u.limits.maxMemory {
+		u.exceed(limitMemory)
+	}
+	return u.limitExceeded() == ""
+}
+
+// waited records time that the query spent waiting, for example for a table
+// scan to start.
+func (u *queryUsage) waited(d time.Duration) {
+	atomic.AddInt64(&u.wait, int64(d))
+}
+
+// waitedInParallel records time that one of several parallel parts of the
+// query spent waiting. Only the longest of these waits counts.
+func (u *queryUsage) waitedInParallel(d time.Duration) {
+	for {
+		prior := atomic.LoadInt64(&u.parallelWait)
+		if int64(d) <= prior || atomic.CompareAndSwapInt64(&u.parallelWait, prior, int64(d)) {
+			return
+		}
+	}
+}
+
+func (u *queryUsage) waitTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&u.wait) + atomic.LoadInt64(&u.parallelWait))
+}
+
+// checkDeadline records that the query exceeded its duration limit if the
+// deadline of ctx, which ran out, is the one set by that limit rather than an
+// earlier one set by the caller.
+func (u *queryUsage) checkDeadline(ctx context.Context) {
+	deadline, hasDeadline := ctx.Deadline()
+	if !u.deadline.IsZero() && hasDeadline && !deadline.Before(u.deadline) {
+		u.exceed(limitDuration)
+	}
+}
+
+func (u *queryUsage) exceed(limit string) {
+	u.mx.Lock()
+	if u.exceeded == "" {
+		u.exceeded = limit
+	}
+	u.mx.Unlock()
+}
+
+func (u *queryUsage) limitExceeded() string {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	return u.exceeded
+}
+
+// iterateWithLimits runs iterate with a context that tracks the resources used
+// against the given limits. When a limit is exceeded, the query stops scanning
+// and returns a *QueryLimitError along with whatever results it had produced.
+// Queries that run for longer than SlowQueryThreshold are recorded in the slow
+// query log. The query and its planning are traced as spans.
+func (db *DB) iterateWithLimits(ctx context.Context, sqlString string, planning planTiming, limits queryLimits, iterate func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	start := time.Now()
+	ctx, span := db.startQuerySpan(ctx, sqlString, planning)
+	u := &queryUsage{limits: limits}
+	ctx = context.WithValue(ctx, queryUsageKey{}, u)
+	if limits.maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.maxDuration)
+		defer cancel()
+		u.deadline, _ = ctx.Deadline()
+	}
+
+	metadata, err := iterate(ctx)
+	if ctx.Err() == context.DeadlineExceeded {
+		u.checkDeadline(ctx)
+	}
+
+	stats, _ := metadata.(*common.QueryStats)
+	if stats == nil {
+		stats = &common.QueryStats{}
+		if metadata == nil {
+			metadata = stats
+		}
+	}
+	if rows := atomic.LoadInt64(&u.rowsScanned); rows > 0 {
+		// Includes what the partitions of clustered queries reported
+		stats.RowsScanned = rows
+		stats.EstimatedMemory = atomic.LoadInt64(&u.estimatedMemory)
+	}
+	if limit := u.limitExceeded(); limit != "" {
+		stats.LimitExceeded = limit
+	}
+	stats.Warnings = append(stats.Warnings, limits.warnings(stats, atomic.LoadInt64(&u.groups), atomic.LoadInt64(&u.resultBytes), time.Since(start))...)
+	if stats.LimitExceeded != "" {
+		log.Debugf("Query exceeded %v after scanning %d rows", stats.LimitExceeded, stats.RowsScanned)
+		if err == nil || stats.LimitExceeded == limitDuration {
+			err = &QueryLimitError{Limit: stats.LimitExceeded, Stats: stats}
+		}
+	}
+	db.logIfSlow(ctx, sqlString, start, u, stats, err)
+	endQuerySpan(span, u.waitTime(), stats, err)
+	return metadata, err
+}
+
+// limitedSource is a core.FlatRowSource that tracks the resources used by a
+// query, reporting them in its stats, and enforces the query's limits.
+type limitedSource struct {
+	core.FlatRowSource
+	db        *DB
+	sqlString string
+	planning  planTiming
+	limits    queryLimits
+	clamp     *queryClamp
+}
+
+func (s *limitedSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	audit, onRow := s.db.auditQuery(ctx, s.sqlString, s.planning, s.FlatRowSource, onRow)
+	metadata, err := s.db.iterateWithLimits(ctx, s.sqlString, s.planning, s.limits, func(ctx context.Context) (interface{}, error) {
+		u := queryUsageFrom(ctx)
+		return s.FlatRowSource.Iterate(ctx, onFields, func(row *core.FlatRow) (bool, error) {
+			// Each row of the final results is a group
+			atomic.AddInt64(&u.groups, 1)
+			atomic.AddInt64(&u.resultBytes, estimatedResultBytes(row))
+			return onRow(row)
+		})
+	})
+	if stats, ok := metadata.(*common.QueryStats); ok {
+		s.clamp.reportTo(stats)
+	}
+	if auditErr := s.db.finishQueryAudit(audit, metadata, err); auditErr != nil && err == nil {
+		err = auditErr
+	}
+	return metadata, err
+}
+
+// estimatedResultBytes estimates the size of a row of results as the size of
+// its key, timestamp and values.
+func estimatedResultBytes(row *core.FlatRow) int64 {
+	return int64(len(row.Key) + encoding.Width64bits + len(row.Values)*encoding.Width64bits)
+}
+
+func (s *limitedSource) GetSource() core.Source {
+	return s.FlatRowSource
+}
+
+func (s *limitedSource) String() string {
+	return "limited"
+}
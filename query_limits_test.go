@@ -0,0 +1,150 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryLimits(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                 tmpDir,
+		MaxQueryRowsScanned: 50,
+		// Slow enough for short duration limits to expire before scanning
+		IterationCoalesceInterval: 100 * time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"dim": i}, map[string]float64{"i": 1}))
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	query := func(hints string) (int, *common.QueryStats, error) {
+		source, err := db.Query("SELECT "+hints+" i FROM test_a GROUP BY dim", false, nil, true)
+		if !assert.NoError(t, err) {
+			return 0, nil, err
+		}
+		rows := 0
+		stats, err := source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			rows++
+			return true, nil
+		})
+		return rows, stats.(*common.QueryStats), err
+	}
+
+	assertLimited := func(limit string, hints string, maxRows int) {
+		rows, stats, err := query(hints)
+		limitErr, ok := err.(*QueryLimitError)
+		if !assert.True(t, ok, "%v should have been limited, got error %v", hints, err) {
+			return
+		}
+		assert.Equal(t, limit, limitErr.Limit)
+		assert.Equal(t, limit, stats.LimitExceeded)
+		assert.True(t, rows <= maxRows, "%v should return partial results, got %d rows", hints, rows)
+		if limit != limitDuration {
+			assert.True(t, stats.NumSuccessfulPartitions < stats.NumPartitions, "partial results shouldn't count as successful")
+		}
+	}
+
+	assertLimited(limitRowsScanned, "", 50)
+	assertLimited(limitRowsScanned, "/* max_rows_scanned(10) */", 10)
+	assertLimited(limitRowsScanned, "/* max_rows_scanned(1000) */", 50)
+	assertLimited(limitMemory, "/* max_memory(100) */", 10)
+	assertLimited(limitDuration, "/* max_duration(10ms) */", 99)
+
+	db.opts.MaxQueryRowsScanned = 0
+	rows, stats, err := query("")
+	assert.NoError(t, err)
+	assert.Equal(t, 100, rows)
+	assert.EqualValues(t, 100, stats.RowsScanned)
+	assert.True(t, stats.EstimatedMemory > 0)
+	assert.Empty(t, stats.LimitExceeded)
+}
+
+func TestSoftQueryLimits(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+		SoftMaxQueryRowsScanned:   50,
+		SoftMaxQueryMemory:        1000000,
+		SoftMaxQueryGroups:        5,
+		SoftMaxQueryResultBytes:   200,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"dim": i % 10, "other": i}, map[string]float64{"i": 1}))
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	query := func(sqlString string) (int, []string) {
+		source, err := db.Query(sqlString, false, nil, true)
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		rows := 0
+		stats, err := source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			rows++
+			return true, nil
+		})
+		assert.NoError(t, err, "soft limits shouldn't fail queries")
+		return rows, stats.(*common.QueryStats).Warnings
+	}
+
+	rows, warnings := query("SELECT i FROM test_a GROUP BY dim")
+	assert.Equal(t, 10, rows)
+	assert.Equal(t, []string{
+		"Query scanned 100 rows, exceeding the soft limit for max_rows_scanned",
+		"Query returned 10 groups, exceeding the soft limit for max_groups",
+		"Query returned ~340 bytes of results, exceeding the soft limit for max_result_bytes",
+	}, warnings)
+
+	rows, warnings = query("SELECT i FROM test_a WHERE dim < 5 GROUP BY dim")
+	assert.Equal(t, 5, rows)
+	assert.Equal(t, []string{"Query scanned 100 rows, exceeding the soft limit for max_rows_scanned"}, warnings)
+}
@@ -0,0 +1,193 @@
+package zenodb
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/wal"
+)
+
+const (
+	recoveryLogInterval = 15 * time.Second
+)
+
+// RecoveryStats reports the progress of a table replaying the WAL at startup.
+type RecoveryStats struct {
+	Table         string
+	StartOffset   string
+	CurrentOffset string
+	TargetOffset  string
+	// Progress is the fraction of the WAL that's been replayed, from 0 to 1
+	Progress  float64
+	Elapsed   time.Duration
+	ETA       time.Duration
+	Recovered bool
+}
+
+// recovery tracks a table's progress replaying the WAL from where it left off
+// up to where the WAL ended at startup. Offsets are compared based on their
+// timestamps, which makes progress an estimate.
+type recovery struct {
+	start       wal.Offset
+	first       wal.Offset
+	target      wal.Offset
+	current     wal.Offset
+	startedAt   time.Time
+	recoveredAt time.Time
+	mx          sync.RWMutex
+}
+
+func newRecovery(start wal.Offset, target wal.Offset) *recovery {
+	r := &recovery{start: start, target: target, current: start, startedAt: time.Now()}
+	if target == nil || !target.After(start) {
+		// Nothing to replay
+		r.recoveredAt = r.startedAt
+	}
+	return r
+}
+
+// advance records that everything up to offset has been replayed and returns
+// true if this completed the recovery.
+func (r *recovery) advance(offset wal.Offset) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if !r.recoveredAt.IsZero() {
+		return false
+	}
+	if r.first == nil {
+		r.first = offset
+	}
+	r.current = offset
+	if !r.target.After(offset) {
+		r.recoveredAt = time.Now()
+		return true
+	}
+	return false
+}
+
+func (r *recovery) recovered() bool {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return !r.recoveredAt.IsZero()
+}
+
+func (r *recovery) stats(table string) *RecoveryStats {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	stats := &RecoveryStats{
+		Table:         table,
+		StartOffset:   r.start.String(),
+		CurrentOffset: r.current.String(),
+		TargetOffset:  r.target.String(),
+		Recovered:     !r.recoveredAt.IsZero(),
+	}
+	if stats.Recovered {
+		stats.Progress = 1
+		stats.Elapsed = r.recoveredAt.Sub(r.startedAt)
+		return stats
+	}
+
+	stats.Elapsed = time.Now().Sub(r.startedAt)
+	startTS := r.start.TS()
+	if r.start == nil {
+		// Starting from the beginning of the WAL, so we don't know where it
+		// starts. Use the first offset that we've seen instead.
+		startTS = r.first.TS()
+	}
+	total := r.target.TS().Sub(startTS)
+	done := r.current.TS().Sub(startTS)
+	if total > 0 && done > 0 {
+		stats.Progress = float64(done) / float64(total)
+		if stats.Progress > 1 {
+			stats.Progress = 1
+		}
+		stats.ETA = time.Duration(float64(stats.Elapsed) / stats.Progress * (1 - stats.Progress))
+	}
+	return stats
+}
+
+// startRecovery starts tracking recovery for this table, which will replay the
+// given stream's WAL from walOffset. The target is determined once per stream,
+// when the WAL is first opened.
+func (t *table) startRecovery(w *wal.WAL, walOffset wal.Offset) {
+	target, found := t.db.recoveryTargets[t.From]
+	if !found {
+		var err error
+		_, target, err = w.Latest()
+		if err != nil {
+			t.log.Errorf("Unable to determine end of WAL, assuming nothing to recover: %v", err)
+		}
+		t.db.recoveryTargets[t.From] = target
+	}
+	t.recovery = newRecovery(walOffset, target)
+	if !t.recovery.recovered() {
+		t.log.Debugf("Recovering from %v to %v", walOffset, target)
+		if atomic.CompareAndSwapInt32(&t.db.loggingRecovery, 0, 1) {
+			go t.db.logRecovery()
+		}
+	}
+}
+
+// recoveredThrough records that the table has replayed the WAL through the
+// given offset.
+func (t *table) recoveredThrough(offset wal.Offset) {
+	if t.recovery != nil && t.recovery.advance(offset) {
+		t.log.Debugf("Recovered in %v", t.recovery.stats(t.Name).Elapsed)
+	}
+}
+
+func (t *table) checkRecovered() error {
+	if t.recovery == nil || t.recovery.recovered() {
+		return nil
+	}
+	stats := t.recovery.stats(t.Name)
+	return errors.New("Table %v is still recovering (%.0f%% done, ETA %v)", t.Name, stats.Progress*100, stats.ETA)
+}
+
+// RecoveryStats reports the recovery progress of all tables that replay the
+// WAL, ordered by table name.
+func (db *DB) RecoveryStats() []*RecoveryStats {
+	db.tablesMutex.RLock()
+	result := make([]*RecoveryStats, 0, len(db.tables))
+	for _, t := range db.tables {
+		if t.recovery != nil {
+			result = append(result, t.recovery.stats(t.Name))
+		}
+	}
+	db.tablesMutex.RUnlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Table < result[j].Table
+	})
+	return result
+}
+
+// Recovered indicates whether all tables have finished replaying the WAL.
+func (db *DB) Recovered() bool {
+	for _, stats := range db.RecoveryStats() {
+		if !stats.Recovered {
+			return false
+		}
+	}
+	return true
+}
+
+func (db *DB) logRecovery() {
+	for {
+		time.Sleep(recoveryLogInterval)
+		recovering := 0
+		for _, stats := range db.RecoveryStats() {
+			if !stats.Recovered {
+				recovering++
+				log.Debugf("Recovering %v: %.1f%% at %v, ETA %v", stats.Table, stats.Progress*100, stats.CurrentOffset, stats.ETA)
+			}
+		}
+		if recovering == 0 {
+			log.Debug("All tables recovered")
+			atomic.StoreInt32(&db.loggingRecovery, 0)
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package zenodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecovery(t *testing.T) {
+	epoch := time.Now().Add(-1 * time.Hour)
+	offsetAt := func(minutes int) wal.Offset {
+		return wal.NewOffsetForTS(epoch.Add(time.Duration(minutes) * time.Minute))
+	}
+
+	assert.True(t, newRecovery(offsetAt(10), nil).recovered(), "Empty WAL should not require recovery")
+	assert.True(t, newRecovery(offsetAt(10), offsetAt(10)).recovered(), "Being at end of WAL should not require recovery")
+
+	r := newRecovery(offsetAt(0), offsetAt(100))
+	assert.False(t, r.recovered())
+	stats := r.stats("test")
+	assert.Equal(t, "test", stats.Table)
+	assert.False(t, stats.Recovered)
+	assert.EqualValues(t, 0, stats.Progress)
+
+	assert.False(t, r.advance(offsetAt(25)))
+	stats = r.stats("test")
+	assert.False(t, stats.Recovered)
+	assert.InDelta(t, 0.25, stats.Progress, 0.001)
+	assert.Equal(t, offsetAt(25).String(), stats.CurrentOffset)
+
+	assert.True(t, r.advance(offsetAt(100)), "Reaching target should complete recovery")
+	assert.False(t, r.advance(offsetAt(101)), "Recovery should only complete once")
+	stats = r.stats("test")
+	assert.True(t, stats.Recovered)
+	assert.EqualValues(t, 1, stats.Progress)
+
+	// Starting from the beginning of the WAL, progress is based on the first
+	// offset seen
+	r = newRecovery(nil, offsetAt(100))
+	assert.False(t, r.recovered())
+	r.advance(offsetAt(50))
+	r.advance(offsetAt(75))
+	assert.InDelta(t, 0.5, r.stats("test").Progress, 0.001)
+
+	tbl := &table{TableOpts: &TableOpts{Name: "test"}, recovery: r, log: log}
+	assert.Error(t, tbl.checkRecovered(), "Querying recovering table should fail")
+	tbl.recoveredThrough(offsetAt(100))
+	assert.NoError(t, tbl.checkRecovered(), "Querying recovered table should succeed")
+}
@@ -0,0 +1,97 @@
+package zenodb
+
+import (
+	"math/rand"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// DefaultReplicaWeight is the weight of replicas that haven't been assigned
+	// one.
+	DefaultReplicaWeight = 1.0
+)
+
+// SetReplicaWeight sets the weight with which the named replica (follower) is
+// chosen to handle queries for its partition, relative to the other replicas
+// of that partition. Replicas with a weight of 0 only handle queries when no
+// replica with a positive weight is available. Weights set this way last until
+// the leader restarts.
+func (db *DB) SetReplicaWeight(name string, weight float64) error {
+	if name == "" {
+		return errors.New("Please specify the name of the replica")
+	}
+	if weight < 0 {
+		return errors.New("Weight of replica %v must not be negative, got %v", name, weight)
+	}
+	db.replicaWeightsMx.Lock()
+	db.replicaWeights[name] = weight
+	db.replicaWeightsMx.Unlock()
+	log.Debugf("Set weight of replica %v to %v", name, weight)
+	return nil
+}
+
+// ReplicaWeights returns the weights of all replicas that have been assigned
+// one, by name.
+func (db *DB) ReplicaWeights() map[string]float64 {
+	db.replicaWeightsMx.RLock()
+	defer db.replicaWeightsMx.RUnlock()
+	result := make(map[string]float64, len(db.replicaWeights))
+	for name, weight := range db.replicaWeights {
+		result[name] = weight
+	}
+	return result
+}
+
+func (db *DB) replicaWeight(name string) float64 {
+	db.replicaWeightsMx.RLock()
+	defer db.replicaWeightsMx.RUnlock()
+	weight, found := db.replicaWeights[name]
+	if !found {
+		return DefaultReplicaWeight
+	}
+	return weight
+}
+
+// chooseQueryHandler picks one of the given candidate handlers, returning its
+// index and the weight of its replica. Replicas are chosen at random with
+// probability proportional to their weights, regardless of how many of their
+// handlers are available. If none of the candidates' replicas has a positive
+// weight, replicas are chosen uniformly.
+func (db *DB) chooseQueryHandler(candidates []*remoteQueryHandler) (int, float64) {
+	// Consider each replica once, using its first available handler
+	var firstHandlers []int
+	var weights []float64
+	seen := make(map[string]bool, len(candidates))
+	total := 0.0
+	for i, handler := range candidates {
+		if seen[handler.replica] {
+			continue
+		}
+		seen[handler.replica] = true
+		weight := db.replicaWeight(handler.replica)
+		firstHandlers = append(firstHandlers, i)
+		weights = append(weights, weight)
+		total += weight
+	}
+
+	if total <= 0 {
+		i := rand.Intn(len(firstHandlers))
+		return firstHandlers[i], weights[i]
+	}
+	target := rand.Float64() * total
+	chosen := -1
+	for i, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		// Fall back to the last replica with a positive weight in case of
+		// rounding error
+		chosen = i
+		target -= weight
+		if target < 0 {
+			break
+		}
+	}
+	return firstHandlers[chosen], weights[chosen]
+}
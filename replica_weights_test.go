@@ -0,0 +1,68 @@
+package zenodb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicaWeights(t *testing.T) {
+	db := &DB{
+		opts: &DBOpts{
+			NumPartitions:           1,
+			ReplicationFactor:       3,
+			ClusterQueryConcurrency: 2,
+		},
+		remoteQueryHandlers: make(map[int]chan *remoteQueryHandler),
+		replicaWeights:      make(map[string]float64),
+	}
+	query := func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
+		return nil, nil
+	}
+
+	assert.Error(t, db.SetReplicaWeight("weighted_a", -1), "negative weights shouldn't be allowed")
+	assert.NoError(t, db.SetReplicaWeight("weighted_a", 9))
+	assert.NoError(t, db.SetReplicaWeight("weighted_c", 0))
+	assert.Equal(t, map[string]float64{"weighted_a": 9, "weighted_c": 0}, db.ReplicaWeights())
+
+	for _, replica := range []string{"weighted_a", "weighted_b", "weighted_c"} {
+		// Register multiple handlers for each replica to make sure that replicas
+		// are chosen by weight rather than by the number of available handlers
+		db.RegisterQueryHandler(0, replica, query)
+		db.RegisterQueryHandler(0, replica, query)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		handler := db.remoteQueryHandlerForPartition(0, nil)
+		if !assert.NotNil(t, handler) {
+			return
+		}
+		counts[handler.replica]++
+		db.RegisterQueryHandler(0, handler.replica, handler.query)
+	}
+	assert.True(t, counts["weighted_a"] > 800 && counts["weighted_a"] < 980, "replica a should have gotten about 90% of queries, got %d", counts["weighted_a"])
+	assert.Equal(t, 1000, counts["weighted_a"]+counts["weighted_b"], "replica with weight 0 shouldn't get queries while others are available")
+
+	handler := db.remoteQueryHandlerForPartition(0, map[string]bool{"weighted_a": true, "weighted_b": true})
+	if assert.NotNil(t, handler) {
+		assert.Equal(t, "weighted_c", handler.replica, "replica with weight 0 should get queries when no others are available")
+	}
+	assert.Nil(t, db.remoteQueryHandlerForPartition(0, map[string]bool{"weighted_a": true, "weighted_b": true, "weighted_c": true}))
+
+	targets := make(map[string]*metrics.QueryTargetStats)
+	for _, qs := range metrics.GetStats().QueryTargets {
+		targets[qs.Replica] = qs
+	}
+	if assert.NotNil(t, targets["weighted_a"]) {
+		assert.Equal(t, counts["weighted_a"], targets["weighted_a"].Queries)
+		assert.EqualValues(t, 9, targets["weighted_a"].Weight)
+	}
+	if assert.NotNil(t, targets["weighted_c"]) {
+		assert.Equal(t, 1, targets["weighted_c"].Queries)
+		assert.EqualValues(t, 0, targets["weighted_c"].Weight)
+	}
+}
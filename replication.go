@@ -0,0 +1,314 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/wal"
+)
+
+const (
+	// DefaultReplicationRewind is the default for DBOpts.ReplicationRewind
+	DefaultReplicationRewind = 1 * time.Minute
+
+	replicationDir                = "_replication"
+	replicationCheckpointInterval = 1 * time.Second
+	maxReplicationCheckpoints     = 24 * 60 * 60
+)
+
+// replicationCheckpoint records the local time at which an entry from a peer's
+// WAL was written to our own WAL. These are used to translate offsets from the
+// peer's WAL into our own.
+type replicationCheckpoint struct {
+	peerOffset wal.Offset
+	localTS    time.Time
+}
+
+type replicationState struct {
+	checkpoints []*replicationCheckpoint
+	mx          sync.RWMutex
+}
+
+func (rs *replicationState) record(peerOffset wal.Offset, localTS time.Time) {
+	rs.mx.Lock()
+	defer rs.mx.Unlock()
+	if len(rs.checkpoints) > 0 {
+		last := rs.checkpoints[len(rs.checkpoints)-1]
+		if localTS.Sub(last.localTS) < replicationCheckpointInterval {
+			// Checkpointed recently enough, just update the peer offset
+			last.peerOffset = peerOffset
+			return
+		}
+	}
+	rs.checkpoints = append(rs.checkpoints, &replicationCheckpoint{peerOffset, localTS})
+	if len(rs.checkpoints) > maxReplicationCheckpoints {
+		rs.checkpoints = rs.checkpoints[len(rs.checkpoints)-maxReplicationCheckpoints:]
+	}
+}
+
+// localTSFor finds the local time at which we had replicated everything up to
+// the given peerOffset. If we don't know, this returns false.
+func (rs *replicationState) localTSFor(peerOffset wal.Offset) (time.Time, bool) {
+	rs.mx.RLock()
+	defer rs.mx.RUnlock()
+	for i := len(rs.checkpoints) - 1; i >= 0; i-- {
+		cp := rs.checkpoints[i]
+		if !cp.peerOffset.After(peerOffset) {
+			if i == len(rs.checkpoints)-1 {
+				return cp.localTS, true
+			}
+			// The entry at peerOffset was written sometime before the next
+			// checkpoint
+			return rs.checkpoints[i+1].localTS, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// originTrailer builds the trailer that gets appended to WAL entries that were
+// replicated from a peer. It's encoded as:
+//
+//	originLen|origin|originOffset
+//
+// originLen is 16 bits and does not include itself.
+// originOffset is the offset of the entry in the origin's WAL.
+//
+// Readers that don't care about the origin simply ignore the trailing bytes.
+func originTrailer(origin string, originOffset wal.Offset) []byte {
+	trailer := make([]byte, encoding.Width16bits+len(origin)+wal.OffsetSize)
+	b := encoding.WriteInt16(trailer, len(origin))
+	b = encoding.Write(b, []byte(origin))
+	encoding.Write(b, originOffset)
+	return trailer
+}
+
+// originOf returns the origin of the given WAL entry, if it was replicated from
+// a peer.
+func originOf(data []byte) (origin string, originOffset wal.Offset, replicated bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			// malformed entry, treat as local
+			origin, originOffset, replicated = "", nil, false
+		}
+	}()
+
+	_, remain := encoding.Read(data, encoding.Width64bits)
+	dimsLen, remain := encoding.ReadInt32(remain)
+	_, remain = encoding.Read(remain, dimsLen)
+	valsLen, remain := encoding.ReadInt32(remain)
+	_, remain = encoding.Read(remain, valsLen)
+	if len(remain) < encoding.Width16bits {
+		return
+	}
+	originLen, remain := encoding.ReadInt16(remain)
+	if len(remain) != originLen+wal.OffsetSize {
+		return
+	}
+	_origin, remain := encoding.Read(remain, originLen)
+	return string(_origin), wal.Offset(remain), true
+}
+
+func (db *DB) replicationStateFor(peer string, stream string) *replicationState {
+	key := peer + "|" + stream
+	db.replicationMx.Lock()
+	defer db.replicationMx.Unlock()
+	rs := db.replicationStates[key]
+	if rs == nil {
+		rs = &replicationState{}
+		db.replicationStates[key] = rs
+	}
+	return rs
+}
+
+// startReplication starts replicating the given stream from all configured
+// peers. It's safe to call this multiple times for the same stream.
+func (db *DB) startReplication(stream string) {
+	if db.opts.Replicate == nil || len(db.opts.ReplicationPeers) == 0 {
+		return
+	}
+	db.replicationMx.Lock()
+	alreadyReplicating := db.replicatingStreams[stream]
+	db.replicatingStreams[stream] = true
+	db.replicationMx.Unlock()
+	if alreadyReplicating {
+		return
+	}
+
+	for _, peer := range db.opts.ReplicationPeers {
+		if peer == db.opts.NodeID {
+			continue
+		}
+		go db.replicateFrom(peer, stream)
+	}
+}
+
+func (db *DB) replicateFrom(peer string, stream string) {
+	rs := db.replicationStateFor(peer, stream)
+	offsetFile := filepath.Join(db.opts.Dir, replicationDir, stream, peer)
+	since, err := ioutil.ReadFile(offsetFile)
+	if err != nil || len(since) != wal.OffsetSize {
+		since = nil
+	}
+	log.Debugf("Replicating %v from %v starting at %v", stream, peer, wal.Offset(since))
+
+	lastPersisted := time.Now()
+	db.opts.Replicate(peer, func() *common.Replicate {
+		return &common.Replicate{
+			Stream: stream,
+			Since:  since,
+			NodeID: db.opts.NodeID,
+		}
+	}, func(data []byte, peerOffset wal.Offset) error {
+		writeErr := db.writeReplicated(stream, data, peer, peerOffset)
+		if writeErr != nil {
+			return writeErr
+		}
+		since = peerOffset
+		rs.record(peerOffset, time.Now())
+		if time.Now().Sub(lastPersisted) > replicationCheckpointInterval {
+			persistErr := writeOffsetFile(offsetFile, peerOffset)
+			if persistErr != nil {
+				log.Errorf("Unable to persist replication offset for %v from %v: %v", stream, peer, persistErr)
+			}
+			lastPersisted = time.Now()
+		}
+		return nil
+	})
+}
+
+func (db *DB) writeReplicated(stream string, data []byte, peer string, peerOffset wal.Offset) error {
+	if db.isShuttingDown() {
+		return ErrShuttingDown
+	}
+	db.tablesMutex.RLock()
+	w := db.streams[stream]
+	db.tablesMutex.RUnlock()
+	if w == nil {
+		return fmt.Errorf("No wal found for stream %v", stream)
+	}
+	if _, _, replicated := originOf(data); replicated {
+		// Never re-replicate data that didn't originate at the peer
+		return nil
+	}
+	return db.writeWAL(w, withoutBatchTrailer(data), originTrailer(peer, peerOffset))
+}
+
+// Replicate sends all entries from the requested stream that originated at
+// this node (i.e. weren't themselves replicated from a peer) to the given
+// callback.
+func (db *DB) Replicate(r *common.Replicate, cb func(data []byte, offset wal.Offset) error) error {
+	db.tablesMutex.RLock()
+	w := db.streams[r.Stream]
+	db.tablesMutex.RUnlock()
+	if w == nil {
+		return errors.New("Stream '%v' not found", r.Stream)
+	}
+
+	log.Debugf("Peer %v replicating %v starting at %v", r.NodeID, r.Stream, r.Since)
+	reader, err := w.NewReader(fmt.Sprintf("replication.%v.%v", r.NodeID, r.Stream), r.Since, db.walBuffers.Get)
+	if err != nil {
+		return errors.New("Unable to open wal reader for %v: %v", r.Stream, err)
+	}
+	defer reader.Close()
+
+	for {
+		data, readErr := reader.Read()
+		if readErr != nil {
+			return errors.New("Unable to read from stream '%v': %v", r.Stream, readErr)
+		}
+		if data == nil {
+			continue
+		}
+		data, readErr = db.openWALEntry(data)
+		if readErr != nil {
+			log.Errorf("Unable to decrypt entry from stream '%v', skipping: %v", r.Stream, readErr)
+			continue
+		}
+		if _, _, replicated := originOf(data); replicated {
+			continue
+		}
+		cbErr := cb(data, reader.Offset())
+		if cbErr != nil {
+			return cbErr
+		}
+	}
+}
+
+// translateFollow translates the offsets in the given Follow from the WAL of
+// the leader that the follower was previously following into our own WAL. Since
+// replication between leaders is asynchronous, we rewind by ReplicationRewind
+// to make sure that the follower doesn't miss anything. This may result in the
+// follower receiving some duplicate data. Offsets from leaders that aren't
+// among our ReplicationPeers are taken to be our own, since followers identify
+// leaders by the address at which they reach them, which may not match our
+// NodeID.
+func (db *DB) translateFollow(f *common.Follow) {
+	if db.isLocalLeader(f.LeaderID) || !db.isReplicationPeer(f.LeaderID) {
+		if f.LeaderID != "" {
+			// Offsets from a leader whose partition map we imported are already
+			// in our WAL
+			f.LeaderID = db.opts.NodeID
+		}
+		return
+	}
+	translate := func(offset wal.Offset) wal.Offset {
+		if offset == nil {
+			return offset
+		}
+		localTS, found := db.replicationStateFor(f.LeaderID, f.Stream).localTSFor(offset)
+		if !found {
+			localTS = offset.TS()
+		}
+		return wal.NewOffsetForTS(localTS.Add(-1 * db.opts.ReplicationRewind))
+	}
+	log.Debugf("Translating offsets for follower %d failing over from %v", f.PartitionNumber, f.LeaderID)
+	f.EarliestOffset = translate(f.EarliestOffset)
+	for _, partition := range f.Partitions {
+		for _, t := range partition.Tables {
+			t.Offset = translate(t.Offset)
+		}
+	}
+	f.LeaderID = db.opts.NodeID
+}
+
+// isReplicationPeer indicates whether the given leader is one of the
+// ReplicationPeers whose entries we replicate.
+func (db *DB) isReplicationPeer(leaderID string) bool {
+	for _, peer := range db.opts.ReplicationPeers {
+		if peer == leaderID {
+			return true
+		}
+	}
+	return false
+}
+
+func writeOffsetFile(filename string, offset wal.Offset) error {
+	dirErr := os.MkdirAll(filepath.Dir(filename), 0755)
+	if dirErr != nil && !os.IsExist(dirErr) {
+		return dirErr
+	}
+	out, err := ioutil.TempFile("", "nextoffset")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = out.Write(offset)
+	if err != nil {
+		return fmt.Errorf("Unable to write next offset: %v", err)
+	}
+
+	err = out.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to close offset file: %v", err)
+	}
+
+	return os.Rename(out.Name(), filename)
+}
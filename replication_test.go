@@ -0,0 +1,81 @@
+package zenodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOriginTrailer(t *testing.T) {
+	dims := bytemap.New(map[string]interface{}{"a": "b"})
+	vals := bytemap.NewFloat(map[string]float64{"c": 1})
+	data := make([]byte, encoding.Width64bits+encoding.Width32bits+len(dims)+encoding.Width32bits+len(vals))
+	b := data[encoding.Width64bits:]
+	b = encoding.WriteInt32(b, len(dims))
+	b = encoding.Write(b, dims)
+	b = encoding.WriteInt32(b, len(vals))
+	encoding.Write(b, vals)
+
+	_, _, replicated := originOf(data)
+	assert.False(t, replicated, "local entry shouldn't look replicated")
+
+	offset := wal.NewOffsetForTS(time.Now())
+	origin, originOffset, replicated := originOf(append(data, originTrailer("peer1", offset)...))
+	if assert.True(t, replicated) {
+		assert.Equal(t, "peer1", origin)
+		assert.EqualValues(t, offset, originOffset)
+	}
+}
+
+func TestReplicationCheckpoints(t *testing.T) {
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 5, time.UTC)
+	rs := &replicationState{}
+	for i := 0; i < 10; i++ {
+		rs.record(wal.NewOffsetForTS(epoch.Add(time.Duration(i)*time.Minute)), epoch.Add(time.Duration(i)*time.Minute+5*time.Second))
+	}
+
+	_, found := rs.localTSFor(wal.NewOffsetForTS(epoch.Add(-1 * time.Minute)))
+	assert.False(t, found, "offset before first checkpoint should be unknown")
+
+	localTS, found := rs.localTSFor(wal.NewOffsetForTS(epoch.Add(90 * time.Second)))
+	if assert.True(t, found) {
+		assert.Equal(t, epoch.Add(2*time.Minute+5*time.Second), localTS)
+	}
+}
+
+func TestTranslateFollow(t *testing.T) {
+	db := &DB{
+		opts: &DBOpts{
+			NodeID:            "leader1",
+			ReplicationPeers:  []string{"leader2"},
+			ReplicationRewind: time.Minute,
+		},
+		replicationStates: make(map[string]*replicationState),
+	}
+	now := time.Now()
+	offset := wal.NewOffsetForTS(now)
+	newFollow := func(leaderID string) *common.Follow {
+		return &common.Follow{
+			Stream:   "stream",
+			LeaderID: leaderID,
+			Partitions: map[string]*common.Partition{
+				"": {Tables: []*common.PartitionTable{{Name: "table", Offset: offset}}},
+			},
+		}
+	}
+
+	f := newFollow("leader1:17712")
+	db.translateFollow(f)
+	assert.Equal(t, "leader1", f.LeaderID)
+	assert.Equal(t, offset, f.Partitions[""].Tables[0].Offset, "offsets from leaders that aren't replication peers shouldn't be rewound")
+
+	f = newFollow("leader2")
+	db.translateFollow(f)
+	assert.Equal(t, "leader1", f.LeaderID)
+	assert.Equal(t, wal.NewOffsetForTS(now.Add(-1*time.Minute)), f.Partitions[""].Tables[0].Offset, "offsets from replication peers should be rewound")
+}
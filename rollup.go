@@ -0,0 +1,257 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb/bytetree"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/wal"
+)
+
+const (
+	rollupsDir   = "_rollups"
+	rollupPrefix = "rollup_"
+)
+
+var (
+	// rollupCheckInterval is how often tables check whether there's data to
+	// roll up
+	rollupCheckInterval = 1 * time.Minute
+)
+
+// rollup is the data of a table that's been rolled up to its RollupResolution.
+type rollup struct {
+	// t is a read-only table at RollupResolution whose filestore holds the
+	// rolled up data
+	t *table
+	// until is the time up to which data has been rolled up
+	until time.Time
+}
+
+func validateRollup(opts *TableOpts, resolution time.Duration) error {
+	if opts.RollupAfter == 0 && opts.RollupResolution == 0 {
+		return nil
+	}
+	if opts.RollupAfter <= 0 || opts.RollupResolution <= 0 {
+		return errors.New("Please specify both a positive RollupAfter and a positive RollupResolution")
+	}
+	if opts.InMemory {
+		return errors.New("In-memory tables can't be rolled up")
+	}
+	if resolution <= 0 || opts.RollupResolution <= resolution || opts.RollupResolution%resolution != 0 {
+		return errors.New("RollupResolution '%v' is not a multiple of table resolution '%v'", opts.RollupResolution, resolution)
+	}
+	return nil
+}
+
+func (t *table) rollupDir() string {
+	return filepath.Join(t.db.opts.Dir, rollupsDir, t.Name)
+}
+
+func (t *table) getRollup() *rollup {
+	t.rollupMx.RLock()
+	r := t.rollup
+	t.rollupMx.RUnlock()
+	return r
+}
+
+// openRollup loads the most recent rollup of the table, if any.
+func (t *table) openRollup() error {
+	files, err := ioutil.ReadDir(t.rollupDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.New("Unable to list rollups: %v", err)
+	}
+	latest := ""
+	for _, file := range files {
+		// files are sorted by name and hence by time
+		if strings.HasPrefix(file.Name(), rollupPrefix) {
+			latest = file.Name()
+		}
+	}
+	if latest == "" {
+		return nil
+	}
+	until, err := rolledUpUntil(latest)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(t.rollupDir(), latest)
+	t.rollup = &rollup{t: t.newRollupTable(filename, t.getFields()), until: until}
+	t.log.Debugf("Opened rollup %v of data until %v", filename, until.In(time.UTC))
+	return nil
+}
+
+// rolledUpUntil extracts the time up to which the given rollup file holds data
+// from its name.
+func rolledUpUntil(filename string) (time.Time, error) {
+	parts := strings.Split(filepath.Base(filename), "_")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("Unexpected rollup file name %v", filename)
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("Unable to determine time of rollup %v: %v", filename, err)
+	}
+	return time.Unix(0, ts), nil
+}
+
+// newRollupTable returns a read-only table at RollupResolution whose filestore
+// is the given file. If filename is empty, the table has no data.
+func (t *table) newRollupTable(filename string, fields core.Fields) *table {
+	opts := *t.TableOpts
+	opts.Name = t.Name + "_rollup"
+	opts.Layout = LayoutRow
+	opts.Indexes = nil
+	t.whereMutex.RLock()
+	q := t.Query
+	t.whereMutex.RUnlock()
+	q.Resolution = t.RollupResolution
+	rt := &table{
+		TableOpts: &opts,
+		Query:     q,
+		fields:    fields,
+		db:        t.db,
+		log:       golog.LoggerFor("zenodb." + opts.Name),
+	}
+	rs := &rowStore{
+		opts:          &rowStoreOptions{dir: filepath.Dir(filename), inMemory: filename == ""},
+		t:             rt,
+		fields:        fields,
+		fileStoreRows: -1,
+	}
+	rs.fileStore = &fileStore{
+		t:        rt,
+		rs:       rs,
+		fields:   fields,
+		filename: filename,
+	}
+	rs.memStore = rs.newMemStore()
+	rt.rowStore = rs
+	return rt
+}
+
+func (t *table) rollUpPeriodically() {
+	for {
+		time.Sleep(rollupCheckInterval)
+		err := t.rollUp()
+		if err != nil {
+			t.log.Errorf("Unable to roll up: %v", err)
+		}
+	}
+}
+
+// rollUp rolls up the table's data from before RollupAfter that hasn't been
+// rolled up yet and merges it with the prior rollup into a new rollup file.
+// Once that's done, the table stops reading the rolled up data and subsequent
+// flushes remove it from disk.
+func (t *table) rollUp() error {
+	t.rollingUp.Lock()
+	defer t.rollingUp.Unlock()
+
+	now := t.now()
+	until := encoding.RoundTimeDown(now.Add(-1*t.RollupAfter), t.RollupResolution)
+	asOf := now.Add(-1 * t.RetentionPeriod)
+	prior := t.getRollup()
+	if prior != nil && prior.until.After(asOf) {
+		asOf = prior.until
+	}
+	if !until.After(asOf) {
+		// nothing new to roll up
+		return nil
+	}
+
+	start := time.Now()
+	fields := t.getFields()
+	tree := bytetree.New(fields.Exprs(), fields.Exprs(), t.RollupResolution, t.Resolution, asOf, until, 0)
+	_, err := t.rowStore.iterate(context.Background(), nil, fields, true, false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		tree.Update(key, vals, nil, key)
+		return true, nil
+	})
+	if err != nil {
+		return errors.New("Unable to read data to roll up: %v", err)
+	}
+
+	rows, filename, err := t.writeRollup(prior, tree, until, fields, nil)
+	if err != nil {
+		return err
+	}
+	t.log.Debugf("Rolled up %d rows of data until %v to %v in %v", rows, until.In(time.UTC), filename, time.Since(start))
+	return nil
+}
+
+// deleteFromRollup rewrites the rollup without the data deleted by the given
+// tombstones.
+func (t *table) deleteFromRollup(tss tombstones) error {
+	t.rollingUp.Lock()
+	defer t.rollingUp.Unlock()
+
+	prior := t.getRollup()
+	if prior == nil {
+		return nil
+	}
+	fields := t.getFields()
+	tree := bytetree.New(fields.Exprs(), nil, t.RollupResolution, 0, time.Time{}, time.Time{}, 0)
+	_, _, err := t.writeRollup(prior, tree, prior.until, fields, tss)
+	return err
+}
+
+// writeRollup merges the data in tree with the prior rollup (if any), omitting
+// data deleted by the given tombstones, and makes the result the table's
+// rollup.
+func (t *table) writeRollup(prior *rollup, tree *bytetree.Tree, until time.Time, fields core.Fields, tss tombstones) (int64, string, error) {
+	dir := t.rollupDir()
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return 0, "", errors.New("Unable to create rollup directory %v: %v", dir, err)
+	}
+	out, err := ioutil.TempFile(dir, "nextrollup")
+	if err != nil {
+		return 0, "", errors.New("Unable to create rollup file: %v", err)
+	}
+	defer out.Close()
+
+	priorFilename := ""
+	if prior != nil {
+		priorFilename = prior.t.rowStore.fileStore.filename
+	}
+	merged := t.newRollupTable(priorFilename, fields)
+	merged.tombstones = tss
+	_, rows := merged.rowStore.fileStore.flush(out, fields, nil, wal.NewOffsetForTS(until), &memstore{fields: fields, tree: tree}, false, true)
+	err = out.Close()
+	if err != nil {
+		return 0, "", errors.New("Unable to close rollup file: %v", err)
+	}
+
+	// Note - we left-pad the unix nano value to the widest possible length to
+	// ensure lexicographical sort matches time-based sort.
+	filename := filepath.Join(dir, fmt.Sprintf("%v%020d_%d.dat", rollupPrefix, until.UnixNano(), CurrentFileVersion))
+	err = os.Rename(out.Name(), filename)
+	if err != nil {
+		return 0, "", errors.New("Unable to rename rollup file: %v", err)
+	}
+
+	t.rollupMx.Lock()
+	t.rollup = &rollup{t: t.newRollupTable(filename, fields), until: until}
+	t.rollupMx.Unlock()
+	if priorFilename != "" && priorFilename != filename {
+		err = os.Remove(priorFilename)
+		if err != nil {
+			t.log.Errorf("Unable to remove prior rollup: %v", err)
+		}
+	}
+	return rows, filename, nil
+}
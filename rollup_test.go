@@ -0,0 +1,110 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollup(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: vtime.NewVirtualClock(epoch),
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	assert.Error(t, db.CreateTable(&TableOpts{
+		Name:             "bad_rollup",
+		RetentionPeriod:  2 * time.Hour,
+		RollupAfter:      30 * time.Minute,
+		RollupResolution: 90 * time.Second,
+		SQL:              "SELECT requests FROM inbound GROUP BY server, period(1m)",
+	}), "RollupResolution should have to be a multiple of the table's resolution")
+
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod:  2 * time.Hour,
+			RollupAfter:      30 * time.Minute,
+			RollupResolution: 10 * time.Minute,
+			SQL:              "SELECT requests FROM inbound GROUP BY server, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	insert := func(ts time.Time, server string, requests float64) {
+		assert.NoError(t, db.Insert("inbound", ts, map[string]interface{}{"server": server}, map[string]float64{"requests": requests}))
+	}
+	insert(epoch.Add(-58*time.Minute), "a", 1)
+	insert(epoch.Add(-53*time.Minute), "a", 2)
+	insert(epoch.Add(-44*time.Minute), "b", 4)
+	insert(epoch.Add(-10*time.Minute), "a", 8)
+	time.Sleep(250 * time.Millisecond)
+
+	query := func(sqlString string) map[string]float64 {
+		source, err := db.Query(sqlString, false, nil, true)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		results := make(map[string]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			if row.Values[0] != 0 {
+				key := row.Key.Get("server").(string) + " " + time.Unix(0, row.TS).UTC().Format("15:04")
+				results[key] = row.Values[0]
+			}
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return results
+	}
+
+	expected := map[string]float64{
+		"a 11:10": 3,
+		"b 11:20": 4,
+		"a 11:50": 8,
+	}
+	sqlString := "SELECT requests FROM test_a ASOF '-90m' GROUP BY server, period(10m)"
+	assert.Equal(t, expected, query(sqlString), "before rolling up")
+
+	table := db.getTable("test_a")
+	if !assert.NoError(t, table.rollUp()) {
+		return
+	}
+	r := table.getRollup()
+	if !assert.NotNil(t, r) {
+		return
+	}
+	assert.Equal(t, epoch.Add(-30*time.Minute), r.until.In(time.UTC))
+	rollups, _ := filepath.Glob(filepath.Join(tmpDir, rollupsDir, "test_a", rollupPrefix+"*"))
+	assert.Len(t, rollups, 1)
+
+	assert.Equal(t, expected, query(sqlString), "after rolling up")
+	assert.NoError(t, table.rollUp())
+	assert.Equal(t, expected, query(sqlString), "rolling up again shouldn't change anything")
+
+	insert(epoch.Add(-50*time.Minute), "a", 16)
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, expected, query(sqlString), "points for rolled up time should be dropped")
+
+	assert.Equal(t, map[string]float64{"a 11:50": 8}, query("SELECT requests FROM test_a ASOF '-20m' GROUP BY server, period(1m)"), "recent data should still be available at the table's resolution")
+}
@@ -0,0 +1,121 @@
+package zenodb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
+)
+
+const (
+	// RoutingAll routes every point that matches a table's WHERE clause to the
+	// table, regardless of what other tables on the same stream do.
+	RoutingAll = "all"
+
+	// RoutingFirst routes each point only to the highest priority RoutingFirst
+	// table whose WHERE clause matches it.
+	RoutingFirst = "first"
+)
+
+func validateRoutingMode(mode string) error {
+	switch strings.ToLower(mode) {
+	case "", RoutingAll, RoutingFirst:
+		return nil
+	default:
+		return fmt.Errorf("Unknown RoutingMode '%v', please use '%v' or '%v'", mode, RoutingAll, RoutingFirst)
+	}
+}
+
+func (t *table) applyRouting(mode string, priority int) {
+	t.whereMutex.Lock()
+	t.RoutingMode = mode
+	t.RoutingPriority = priority
+	t.whereMutex.Unlock()
+	t.db.refreshRouting()
+}
+
+func (t *table) getRouting() (exclusive bool, priority int) {
+	t.whereMutex.RLock()
+	exclusive = strings.ToLower(t.RoutingMode) == RoutingFirst
+	priority = t.RoutingPriority
+	t.whereMutex.RUnlock()
+	return
+}
+
+// routingName is the name used to break ties between tables of equal
+// priority. Views use the name of the table on which they're based.
+func (t *table) routingName() string {
+	if t.viewOf != "" {
+		return t.viewOf
+	}
+	return t.Name
+}
+
+// precedes indicates whether this table is evaluated before the other table
+// when routing points in RoutingFirst mode.
+func (t *table) precedes(priority int, other *table, otherPriority int) bool {
+	if priority != otherPriority {
+		return priority < otherPriority
+	}
+	return t.routingName() < other.routingName()
+}
+
+// routing maps each RoutingFirst table to the WHERE clauses of the higher
+// priority RoutingFirst tables on the same stream, in order of precedence. A nil
+// WHERE clause claims every point.
+type routing map[*table][]goexpr.Expr
+
+// updateRouting recomputes the routing whenever tables are added or their WHERE
+// clauses or routing change, so that inserts can route points without locking.
+// It must be called with tablesMutex held for writing.
+func (db *DB) updateRouting() {
+	r := make(routing)
+	for _, t := range db.orderedTables {
+		exclusive, priority := t.getRouting()
+		if !exclusive {
+			continue
+		}
+		var ahead []*table
+		for _, other := range db.orderedTables {
+			// Views don't claim points on their own, they follow their table
+			if other == t || other.View || other.Name == t.viewOf || other.From != t.From {
+				continue
+			}
+			otherExclusive, otherPriority := other.getRouting()
+			if otherExclusive && other.precedes(otherPriority, t, priority) {
+				ahead = append(ahead, other)
+			}
+		}
+		sort.Slice(ahead, func(i, j int) bool {
+			_, pi := ahead[i].getRouting()
+			_, pj := ahead[j].getRouting()
+			return ahead[i].precedes(pi, ahead[j], pj)
+		})
+		wheres := make([]goexpr.Expr, 0, len(ahead))
+		for _, other := range ahead {
+			wheres = append(wheres, other.getWhere())
+		}
+		r[t] = wheres
+	}
+	db.routing.Store(r)
+}
+
+func (db *DB) refreshRouting() {
+	db.tablesMutex.Lock()
+	db.updateRouting()
+	db.tablesMutex.Unlock()
+}
+
+// routedElsewhere checks whether the point with the given dims is claimed by a
+// higher priority RoutingFirst table reading from the same stream.
+func (t *table) routedElsewhere(dims bytemap.ByteMap) bool {
+	r, _ := t.db.routing.Load().(routing)
+	for _, where := range r[t] {
+		if where == nil || where.Eval(dims).(bool) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package zenodb
+
+import (
+	"testing"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/sql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutingFirst(t *testing.T) {
+	db := &DB{tables: make(map[string]*table)}
+	addTable := func(name string, mode string, priority int, where goexpr.Expr) *table {
+		tb := &table{
+			TableOpts: &TableOpts{Name: name, RoutingMode: mode, RoutingPriority: priority},
+			Query:     sql.Query{From: "inbound", Where: where},
+			db:        db,
+		}
+		db.tables[name] = tb
+		db.orderedTables = append(db.orderedTables, tb)
+		db.updateRouting()
+		return tb
+	}
+	eq := func(dim string, val string) goexpr.Expr {
+		ex, _ := goexpr.Binary("=", goexpr.Param(dim), goexpr.Constant(val))
+		return ex
+	}
+
+	errors := addTable("errors", RoutingFirst, 1, eq("status", "500"))
+	catchall := addTable("catchall", RoutingFirst, 2, nil)
+	everything := addTable("everything", RoutingAll, 0, nil)
+
+	errorPoint := bytemap.New(map[string]interface{}{"status": "500"})
+	okPoint := bytemap.New(map[string]interface{}{"status": "200"})
+
+	assert.False(t, errors.routedElsewhere(errorPoint))
+	assert.True(t, catchall.routedElsewhere(errorPoint))
+	assert.False(t, everything.routedElsewhere(errorPoint))
+
+	assert.False(t, errors.routedElsewhere(okPoint))
+	assert.False(t, catchall.routedElsewhere(okPoint))
+	assert.False(t, everything.routedElsewhere(okPoint))
+
+	catchall.applyRouting(RoutingFirst, 0)
+	assert.True(t, errors.routedElsewhere(errorPoint), "catchall should now take precedence")
+	assert.False(t, catchall.routedElsewhere(errorPoint))
+
+	assert.NoError(t, validateRoutingMode(""))
+	assert.NoError(t, validateRoutingMode("First"))
+	assert.Error(t, validateRoutingMode("some"))
+}
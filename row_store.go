@@ -12,32 +12,48 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/golang/snappy"
 	"github.com/oxtoacart/emsort"
 
 	"github.com/dustin/go-humanize"
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/errors"
 	"github.com/getlantern/goexpr"
-	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/wal"
 	"github.com/getlantern/zenodb/bytetree"
+	"github.com/getlantern/zenodb/compress"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/encryption"
+	"github.com/getlantern/zenodb/metrics"
 )
 
 const (
 	// File format versions
-	FileVersion_4      = 4
-	CurrentFileVersion = FileVersion_4
+	FileVersion_4 = 4
+	// FileVersion_5 adds a dictionary of dimension values (see
+	// dimensionDictionary) after the header
+	FileVersion_5 = 5
+	// FileVersion_7 allows columns to be gorilla encoded (see CodecGorilla),
+	// which is flagged in the highest bits of their column lengths
+	FileVersion_7      = 7
+	CurrentFileVersion = FileVersion_7
+	// FileVersionColumnar is used for filestores of tables with
+	// LayoutColumnar, which are stored as columnar segments (see
+	// columnarWriter) instead of row by row
+	FileVersionColumnar = 6
 
 	offsetFilename = "offset"
 )
 
 var (
 	fieldsDelims = map[int]string{
-		FileVersion_4: "|",
+		FileVersion_4:       "|",
+		FileVersion_5:       "|",
+		FileVersionColumnar: "|",
+		FileVersion_7:       "|",
 	}
 )
 
@@ -45,6 +61,12 @@ type rowStoreOptions struct {
 	dir             string
 	minFlushLatency time.Duration
 	maxFlushLatency time.Duration
+	// targetApplyLatency, if specified, enables automatic tuning of the flush
+	// interval to keep apply latency under this target
+	targetApplyLatency time.Duration
+	// inMemory, if true, keeps all data in the memstore. Instead of flushing,
+	// data that's fallen out of the retention period is truncated.
+	inMemory bool
 }
 
 type insert struct {
@@ -64,8 +86,24 @@ type rowStore struct {
 	inserts             chan *insert
 	forceFlushes        chan bool
 	forceFlushCompletes chan bool
+	reencrypts          chan bool
+	reencryptCompletes  chan bool
+	compactions         chan bool
+	compactCompletes    chan bool
 	flushCount          int
+	persisted           wal.Offset
 	mx                  sync.RWMutex
+
+	// maxApplyLatency is the longest an insert has waited to be applied since
+	// the last flush, in nanoseconds. Only tracked when tuning the flush interval.
+	maxApplyLatency int64
+
+	// fileStoreRows is the number of rows in the fileStore as of the last flush,
+	// or -1 if it hasn't flushed since opening
+	fileStoreRows int64
+
+	lastFlush         time.Time
+	lastFlushDuration time.Duration
 }
 
 type memstore struct {
@@ -84,7 +122,21 @@ func (ms *memstore) copy() *memstore {
 	}
 }
 
+// deepCopy is like copy, but the copy can be updated without affecting ms.
+func (ms *memstore) deepCopy() *memstore {
+	return &memstore{
+		fields:        ms.fields,
+		tree:          ms.tree.DeepCopy(),
+		offset:        ms.offset,
+		offsetChanged: ms.offsetChanged,
+	}
+}
+
 func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, wal.Offset, error) {
+	if opts.inMemory {
+		return t.openInMemoryRowStore(opts), nil, nil
+	}
+
 	err := os.MkdirAll(opts.dir, 0755)
 	if err != nil && !os.IsExist(err) {
 		return nil, nil, fmt.Errorf("Unable to create folder for row store: %v", err)
@@ -121,7 +173,7 @@ func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, wal.Offset, erro
 			versionFor(existingFileName)
 
 			// Get WAL offset
-			newWALOffset, opened, err := readWALOffset(existingFileName)
+			newWALOffset, opened, err := readWALOffset(t.keyring(), existingFileName)
 			if err != nil {
 				if !opened {
 					return nil, nil, err
@@ -143,6 +195,11 @@ func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, wal.Offset, erro
 		}
 	}
 
+	existingFileName, walOffset, err = t.prepareRebalance(opts.dir, existingFileName, walOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	fields := t.getFields()
 	rs := &rowStore{
 		opts:                opts,
@@ -152,6 +209,12 @@ func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, wal.Offset, erro
 		inserts:             make(chan *insert),
 		forceFlushes:        make(chan bool),
 		forceFlushCompletes: make(chan bool),
+		reencrypts:          make(chan bool),
+		reencryptCompletes:  make(chan bool),
+		compactions:         make(chan bool),
+		compactCompletes:    make(chan bool),
+		persisted:           walOffset,
+		fileStoreRows:       -1,
 		fileStore: &fileStore{
 			t:        t,
 			fields:   fields,
@@ -166,7 +229,35 @@ func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, wal.Offset, erro
 	return rs, walOffset, nil
 }
 
-func readWALOffset(filename string) (wal.Offset, bool, error) {
+// openInMemoryRowStore opens a rowStore that never touches disk. Its data
+// starts out empty and is rebuilt from the WAL, going back as far as the
+// table's retention period.
+func (t *table) openInMemoryRowStore(opts *rowStoreOptions) *rowStore {
+	fields := t.getFields()
+	rs := &rowStore{
+		opts:                opts,
+		t:                   t,
+		fields:              fields,
+		fieldUpdates:        make(chan core.Fields),
+		inserts:             make(chan *insert),
+		forceFlushes:        make(chan bool),
+		forceFlushCompletes: make(chan bool),
+		reencrypts:          make(chan bool),
+		reencryptCompletes:  make(chan bool),
+		fileStoreRows:       0,
+		fileStore: &fileStore{
+			t:      t,
+			fields: fields,
+		},
+	}
+	rs.fileStore.rs = rs
+
+	go rs.processInserts()
+
+	return rs
+}
+
+func readWALOffset(keyring *encryption.Keyring, filename string) (wal.Offset, bool, error) {
 	opened := false
 	file, err := os.Open(filename)
 	if err != nil {
@@ -175,7 +266,23 @@ func readWALOffset(filename string) (wal.Offset, bool, error) {
 	defer file.Close()
 	opened = true
 
-	r := snappy.NewReader(file)
+	if isColumnar(filename) {
+		cr, err := newColumnarReader(keyring, file)
+		if err != nil {
+			return nil, opened, err
+		}
+		return cr.footer.offset, opened, nil
+	}
+
+	dr, err := keyring.NewReader(file)
+	if err != nil {
+		return nil, opened, err
+	}
+	r, err := compress.NewReader(dr)
+	if err != nil {
+		return nil, opened, err
+	}
+	defer r.Close()
 
 	// Read WAL along with preceeding header length
 	walOffset := make(wal.Offset, wal.OffsetSize+4)
@@ -188,6 +295,60 @@ func readWALOffset(filename string) (wal.Offset, bool, error) {
 	return walOffset[4:], opened, nil
 }
 
+// estimatedRows estimates the number of rows that iterating over this rowStore
+// would scan. Rows in the fileStore are only known as of the last flush, so
+// until then they're estimated from the size of the fileStore, assuming rows
+// of the same size as the ones in the memStore.
+func (rs *rowStore) estimatedRows(includeMemStore bool) int64 {
+	rs.mx.RLock()
+	defer rs.mx.RUnlock()
+	memStoreRows := int64(0)
+	memStoreBytes := 0
+	if rs.memStore != nil {
+		memStoreRows = int64(rs.memStore.tree.Length())
+		memStoreBytes = rs.memStore.tree.Bytes()
+	}
+	fileStoreRows := rs.fileStoreRows
+	if fileStoreRows < 0 {
+		fileStoreRows = 0
+		if rs.fileStore != nil && rs.fileStore.filename != "" && memStoreRows > 0 && memStoreBytes > 0 {
+			fi, err := os.Stat(rs.fileStore.filename)
+			if err == nil {
+				fileStoreRows = fi.Size() * memStoreRows / int64(memStoreBytes)
+			}
+		}
+	}
+	if includeMemStore {
+		return fileStoreRows + memStoreRows
+	}
+	return fileStoreRows
+}
+
+// storageStats fills in the memstore, filestore and flush stats of the given
+// TableStats.
+func (rs *rowStore) storageStats(stats *TableStats) {
+	stats.FileStoreRows = rs.estimatedRows(false)
+	rs.mx.RLock()
+	if rs.memStore != nil {
+		stats.MemStoreRows = int64(rs.memStore.tree.Length())
+		stats.MemStoreBytes = int64(rs.memStore.tree.Bytes())
+	}
+	filename := ""
+	if rs.fileStore != nil {
+		filename = rs.fileStore.filename
+	}
+	stats.LastFlush = rs.lastFlush
+	stats.LastFlushDuration = rs.lastFlushDuration
+	rs.mx.RUnlock()
+
+	if filename != "" {
+		fi, err := os.Stat(filename)
+		if err == nil {
+			stats.FileStoreBytes = fi.Size()
+		}
+	}
+}
+
 func (rs *rowStore) memStoreSize() int {
 	size := 0
 	rs.mx.RLock()
@@ -199,7 +360,22 @@ func (rs *rowStore) memStoreSize() int {
 }
 
 func (rs *rowStore) insert(insert *insert) {
+	if rs.opts.targetApplyLatency <= 0 {
+		rs.inserts <- insert
+		return
+	}
+	// Inserts are applied as soon as the memstore is free, so the time spent
+	// waiting to hand off the insert is its apply latency. Subsequent data in the
+	// WAL waits at least as long.
+	start := time.Now()
 	rs.inserts <- insert
+	latency := int64(time.Since(start))
+	for {
+		max := atomic.LoadInt64(&rs.maxApplyLatency)
+		if latency <= max || atomic.CompareAndSwapInt64(&rs.maxApplyLatency, max, latency) {
+			return
+		}
+	}
 }
 
 func (rs *rowStore) forceFlush() {
@@ -207,6 +383,19 @@ func (rs *rowStore) forceFlush() {
 	<-rs.forceFlushCompletes
 }
 
+// reencrypt rewrites the filestore if it isn't encrypted with the current key.
+func (rs *rowStore) reencrypt() {
+	rs.reencrypts <- true
+	<-rs.reencryptCompletes
+}
+
+// compact rewrites the filestore without the data deleted by the table's
+// tombstones, even if there's nothing new to flush.
+func (rs *rowStore) compact() {
+	rs.compactions <- true
+	<-rs.compactCompletes
+}
+
 func (rs *rowStore) newMemStore() *memstore {
 	fields := rs.fields
 	tree := bytetree.New(fields.Exprs(), nil, rs.t.Resolution, 0, time.Time{}, time.Time{}, 0)
@@ -220,10 +409,16 @@ func (rs *rowStore) processInserts() {
 	rs.mx.Unlock()
 
 	flushInterval := rs.opts.maxFlushLatency
+	var tunedFlushInterval time.Duration
 	flushTimer := time.NewTimer(flushInterval)
 	rs.t.log.Debugf("Will flush after %v", flushInterval)
 
 	flush := func(allowSort bool) *memstore {
+		if rs.opts.inMemory {
+			ms = rs.truncateMemStore(ms)
+			flushTimer.Reset(flushInterval)
+			return ms
+		}
 		if ms.tree.Length() == 0 {
 			rs.t.log.Trace("No data to flush")
 
@@ -232,6 +427,8 @@ func (rs *rowStore) processInserts() {
 				err := rs.writeOffset(ms.offset)
 				if err != nil {
 					rs.t.log.Errorf("Unable to write updated offset: %v", err)
+				} else {
+					rs.setPersistedOffset(ms.offset)
 				}
 				ms.offsetChanged = false
 			}
@@ -251,10 +448,33 @@ func (rs *rowStore) processInserts() {
 		} else if flushInterval < rs.opts.minFlushLatency {
 			flushInterval = rs.opts.minFlushLatency
 		}
+		if rs.opts.targetApplyLatency > 0 {
+			if tunedFlushInterval == 0 {
+				// start tuning from the usual interval
+				tunedFlushInterval = flushInterval
+			}
+			tunedFlushInterval = rs.tuneFlushInterval(tunedFlushInterval, flushDuration)
+			flushInterval = tunedFlushInterval
+		}
 		flushTimer.Reset(flushInterval)
 		return newMS
 	}
 
+	// rewrite flushes to a new filestore even if the memstore is empty
+	rewrite := func(fs *fileStore, reason string) {
+		if ms.offset == nil {
+			// No new data since last flush, keep the offset from the file
+			offset, _, err := readWALOffset(rs.t.keyring(), fs.filename)
+			if err != nil {
+				rs.t.log.Errorf("Unable to read offset from %v, not %v: %v", fs.filename, reason, err)
+				return
+			}
+			ms.offset = offset
+		}
+		ms, _ = rs.processFlush(ms, false)
+		flushTimer.Reset(flushInterval)
+	}
+
 	for {
 		select {
 		case insert := <-rs.inserts:
@@ -273,6 +493,32 @@ func (rs *rowStore) processInserts() {
 			rs.t.log.Debug("Forcing flush")
 			flush(true)
 			rs.forceFlushCompletes <- true
+		case <-rs.reencrypts:
+			if rs.opts.inMemory {
+				// nothing on disk to re-encrypt
+				rs.reencryptCompletes <- true
+				continue
+			}
+			rs.mx.RLock()
+			fs := rs.fileStore
+			rs.mx.RUnlock()
+			if fs.needsReencryption() {
+				rs.t.log.Debugf("Re-encrypting %v", fs.filename)
+				rewrite(fs, "re-encrypting")
+			}
+			rs.reencryptCompletes <- true
+		case <-rs.compactions:
+			rs.mx.RLock()
+			fs := rs.fileStore
+			rs.mx.RUnlock()
+			if fs.filename == "" && ms.tree.Length() == 0 {
+				// nothing stored, so nothing to delete
+				rs.t.removeTombstones(rs.t.getTombstones())
+			} else {
+				rs.t.log.Debugf("Compacting %v", fs.filename)
+				rewrite(fs, "compacting")
+			}
+			rs.compactCompletes <- true
 		case fields := <-rs.fieldUpdates:
 			rs.t.log.Debugf("Updating fields to %v", fields)
 			// update fields immediately
@@ -292,23 +538,108 @@ func (rs *rowStore) processInserts() {
 	}
 }
 
-func (rs *rowStore) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) (time.Time, error) {
+// tuneFlushInterval adjusts the flush interval to keep the latency with which
+// inserts are applied under the target. Inserts wait while the memstore is
+// flushed, and bigger memstores take longer to flush, so when latency exceeds
+// the target we flush more often. When latency is comfortably below the target,
+// we flush less often to save on I/O. The interval stays within the table's
+// MinFlushLatency and MaxFlushLatency.
+func (rs *rowStore) tuneFlushInterval(current time.Duration, flushDuration time.Duration) time.Duration {
+	latency := time.Duration(atomic.SwapInt64(&rs.maxApplyLatency, 0))
+	target := rs.opts.targetApplyLatency
+	tuned := current
+	if latency > target {
+		tuned = current / 2
+	} else if latency < target/2 {
+		tuned = current + current/2
+		if tuned < current {
+			// overflow
+			tuned = rs.opts.maxFlushLatency
+		}
+	}
+
+	// Flushing about as often as flushes take would leave no time for inserts
+	floor := rs.opts.minFlushLatency
+	if floor < 2*flushDuration {
+		floor = 2 * flushDuration
+	}
+	if tuned < floor {
+		tuned = floor
+	}
+	if tuned > rs.opts.maxFlushLatency {
+		tuned = rs.opts.maxFlushLatency
+	}
+
+	adjusted := tuned != current
+	if adjusted {
+		rs.t.log.Debugf("Apply latency of %v vs target of %v, changing flush interval from %v to %v", latency, target, current, tuned)
+	}
+	metrics.FlushTuned(rs.t.Name, latency, tuned, adjusted)
+	return tuned
+}
+
+func (rs *rowStore) iterate(ctx context.Context, filters segmentFilters, outFields core.Fields, includeMemStore bool, includeWALTail bool, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) (time.Time, error) {
 	guard := core.Guard(ctx)
+	if rs.opts.inMemory {
+		// all data is in the memstore
+		includeMemStore = true
+	}
 
 	rs.mx.RLock()
 	fs := rs.fileStore
 	var ms *memstore
-	if includeMemStore {
+	applied := rs.persisted
+	if includeWALTail {
+		ms = rs.memStore.deepCopy()
+	} else if includeMemStore {
 		ms = rs.memStore.copy()
 	}
+	if ms != nil && ms.offset != nil {
+		applied = ms.offset
+	}
 	rs.mx.RUnlock()
-	return fs.iterate(outFields, ms, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+	if includeWALTail {
+		rs.t.applyWALTail(ctx, ms, applied)
+	}
+	return fs.iterateFiltered(filters, outFields, ms, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
 		return guard.ProceedAfter(onValue(key, columns))
 	})
 }
 
+// truncateMemStore replaces the memstore of an in-memory rowStore with a copy
+// that omits data that's fallen out of the table's retention period.
+func (rs *rowStore) truncateMemStore(ms *memstore) *memstore {
+	start := time.Now()
+	truncated := &memstore{
+		fields:        ms.fields,
+		tree:          ms.tree.Truncate(rs.t.truncateBefore()),
+		offset:        ms.offset,
+		offsetChanged: ms.offsetChanged,
+	}
+	if !truncated.fields.Equals(rs.fields) {
+		// fields changed, carry over the data for the new fields
+		tree := bytetree.New(rs.fields.Exprs(), ms.fields.Exprs(), rs.t.Resolution, rs.t.Resolution, time.Time{}, time.Time{}, 0)
+		truncated.tree.Walk(0, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+			tree.Update(key, data, nil, bytemap.ByteMap(key))
+			return true, true, nil
+		})
+		truncated.fields = rs.fields
+		truncated.tree = tree
+	}
+	truncateDuration := time.Since(start)
+	rs.mx.Lock()
+	rs.memStore = truncated
+	rs.lastFlush = start
+	rs.lastFlushDuration = truncateDuration
+	rs.mx.Unlock()
+	rs.t.log.Debugf("Truncated in-memory data from %d to %d rows in %v", ms.tree.Length(), truncated.tree.Length(), truncateDuration)
+	return truncated
+}
+
 func (rs *rowStore) processFlush(ms *memstore, allowSort bool) (*memstore, time.Duration) {
-	shouldSort := allowSort && rs.t.shouldSort()
+	// Columnar segments aren't sorted
+	version := rs.t.fileVersion()
+	shouldSort := allowSort && version != FileVersionColumnar && rs.t.shouldSort()
 	willSort := "not sorted"
 	if shouldSort {
 	}
@@ -321,6 +652,8 @@ func (rs *rowStore) processFlush(ms *memstore, allowSort bool) (*memstore, time.
 	rs.mx.RLock()
 	fs := rs.fileStore
 	rs.mx.RUnlock()
+	// Writing the new filestore removes deleted data from disk
+	tombstones := rs.t.getTombstones()
 	// We allow raw most of the time for efficiency purposes, but every 10 flushes
 	// we don't so that we have an opportunity to truncate old data.
 	disallowRaw := rs.flushCount%10 == 9
@@ -338,7 +671,12 @@ func (rs *rowStore) processFlush(ms *memstore, allowSort bool) (*memstore, time.
 	}
 	defer out.Close()
 
-	highWaterMark := fs.flush(out, rs.fields, nil, ms.offset, ms, shouldSort, disallowRaw)
+	var highWaterMark, rows int64
+	if version == FileVersionColumnar {
+		highWaterMark, rows = fs.flushColumnar(out, rs.fields, ms.offset, ms)
+	} else {
+		highWaterMark, rows = fs.flush(out, rs.fields, nil, ms.offset, ms, shouldSort, disallowRaw)
+	}
 
 	fi, err := out.Stat()
 	if err != nil {
@@ -352,59 +690,92 @@ func (rs *rowStore) processFlush(ms *memstore, allowSort bool) (*memstore, time.
 	// Note - we left-pad the unix nano value to the widest possible length to
 	// ensure lexicographical sort matches time-based sort (e.g. on directory
 	// listing).
-	newFileStoreName := filepath.Join(rs.opts.dir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), CurrentFileVersion))
+	newFileStoreName := filepath.Join(rs.opts.dir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), version))
 	if renameErr := os.Rename(out.Name(), newFileStoreName); renameErr != nil {
 		panic(renameErr)
 	}
 
+	offset := ms.offset
 	fs = &fileStore{rs.t, rs, rs.fields, newFileStoreName}
 	ms = rs.newMemStore()
+	flushDuration := time.Now().Sub(start)
 	rs.mx.Lock()
 	rs.fileStore = fs
+	rs.fileStoreRows = rows
 	rs.memStore = ms
+	if offset != nil {
+		rs.persisted = offset
+	}
+	rs.lastFlush = start
+	rs.lastFlushDuration = flushDuration
 	rs.mx.Unlock()
 
-	flushDuration := time.Now().Sub(start)
 	if fi != nil {
 		rs.t.log.Debugf("Flushed to %v in %v, size %v. %v.", newFileStoreName, flushDuration, humanize.Bytes(uint64(fi.Size())), willSort)
 	} else {
 		rs.t.log.Debugf("Flushed to %v in %v. %v.", newFileStoreName, flushDuration, willSort)
 	}
 
+	rs.t.removeTombstones(tombstones)
 	rs.t.updateHighWaterMarkDisk(highWaterMark)
 	return ms, flushDuration
 }
 
-func (fs *fileStore) flush(out *os.File, fields core.Fields, filter goexpr.Expr, offset wal.Offset, ms *memstore, shouldSort bool, disallowRaw bool) int64 {
-	cout, err := fs.createOutWriter(out, fields, offset, shouldSort)
+func (fs *fileStore) flush(out *os.File, fields core.Fields, filter goexpr.Expr, offset wal.Offset, ms *memstore, shouldSort bool, disallowRaw bool) (int64, int64) {
+	// Raw rows are only written when not sorting, in which case they refer to
+	// the existing dictionary. When sorting, keys are written without a
+	// dictionary and createOutWriter rebuilds it from the rows as it sorts them.
+	dict := newDimensionDictionary()
+	if !shouldSort {
+		var err error
+		dict, err = fs.dictionaryFor(ms)
+		if err != nil {
+			fs.t.log.Errorf("Unable to build dictionary, writing without one: %v", err)
+			dict = newDimensionDictionary()
+			disallowRaw = true
+		}
+	}
+	cout, err := fs.createOutWriter(out, fields, offset, dict, shouldSort)
 	if err != nil {
 		panic(err)
 	}
 
 	highWaterMark := int64(0)
+	rows := int64(0)
 	truncateBefore := fs.t.truncateBefore()
 	write := func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
-		nextHighWaterMark, err := fs.doWrite(cout, fields, filter, truncateBefore, shouldSort, key, columns, raw)
+		nextHighWaterMark, err := fs.doWrite(cout, fields, filter, dict, truncateBefore, shouldSort, key, columns, raw)
 		if err != nil {
 			panic(err)
 		}
+		rows++
 		if nextHighWaterMark > highWaterMark {
 			highWaterMark = nextHighWaterMark
 		}
 		return true, nil
 	}
 
-	fs.iterate(fields, ms, !shouldSort, !disallowRaw, write)
+	// Raw rows can't be sorted and their keys are encoded with the existing
+	// dictionary, so only pass them through when not sorting
+	fs.iterate(fields, ms, !shouldSort, !shouldSort && !disallowRaw, write)
 	err = cout.Close()
 	if err != nil {
 		panic(err)
 	}
 
-	return highWaterMark
+	return highWaterMark, rows
 }
 
-func (fs *fileStore) createOutWriter(out *os.File, fields core.Fields, offset wal.Offset, shouldSort bool) (io.WriteCloser, error) {
-	sout := snappy.NewBufferedWriter(out)
+func (fs *fileStore) createOutWriter(out *os.File, fields core.Fields, offset wal.Offset, dict *dimensionDictionary, shouldSort bool) (io.WriteCloser, error) {
+	eout, err := fs.t.keyring().NewWriter(out)
+	if err != nil {
+		return nil, errors.New("Unable to create encrypting writer: %v", err)
+	}
+	cw, err := compress.NewWriter(fs.t.getCompression(), eout)
+	if err != nil {
+		return nil, errors.New("Unable to create compressing writer: %v", err)
+	}
+	sout := &closeChain{cw, eout}
 
 	fieldStrings := make([]string, 0, len(fields))
 	for _, field := range fields {
@@ -412,7 +783,7 @@ func (fs *fileStore) createOutWriter(out *os.File, fields core.Fields, offset wa
 	}
 	fieldsBytes := []byte(strings.Join(fieldStrings, fieldsDelims[CurrentFileVersion]))
 	headerLength := uint32(len(offset) + len(fieldsBytes))
-	err := binary.Write(sout, encoding.Binary, headerLength)
+	err = binary.Write(sout, encoding.Binary, headerLength)
 	if err != nil {
 		return nil, errors.New("Unable to write header length: %v", err)
 	}
@@ -424,10 +795,18 @@ func (fs *fileStore) createOutWriter(out *os.File, fields core.Fields, offset wa
 	if err != nil {
 		return nil, errors.New("Unable to write header: %v", err)
 	}
-
 	if !shouldSort {
+		err = dict.write(sout)
+		if err != nil {
+			return nil, errors.New("Unable to write dictionary: %v", err)
+		}
 		return sout, nil
 	}
+
+	// When sorting, the dictionary is rebuilt from the rows being sorted and
+	// only written once they've all been sorted.
+	builder := newDictionaryBuilder()
+	reencoder := &dictionaryReencoder{out: sout, in: dict, builder: builder}
 	chunk := func(r io.Reader) ([]byte, error) {
 		rowLength := uint64(0)
 		readErr := binary.Read(r, encoding.Binary, &rowLength)
@@ -446,15 +825,15 @@ func (fs *fileStore) createOutWriter(out *os.File, fields core.Fields, offset wa
 		return bytes.Compare(a, b) < 0
 	}
 
-	cout, sortErr := emsort.New(sout, chunk, less, int(fs.t.db.maxMemoryBytes())/10)
+	sorted, sortErr := emsort.New(reencoder, chunk, less, int(fs.t.db.maxMemoryBytes())/10)
 	if sortErr != nil {
 		panic(sortErr)
 	}
 
-	return cout, nil
+	return &dictionaryRebuilder{sorted: sorted, in: dict, builder: builder}, nil
 }
 
-func (fs *fileStore) doWrite(cout io.WriteCloser, fields core.Fields, filter goexpr.Expr, truncateBefore time.Time, shouldSort bool, key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (int64, error) {
+func (fs *fileStore) doWrite(cout io.WriteCloser, fields core.Fields, filter goexpr.Expr, dict *dimensionDictionary, truncateBefore time.Time, shouldSort bool, key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (int64, error) {
 	highWaterMark := int64(0)
 
 	if !shouldSort && raw != nil {
@@ -483,9 +862,15 @@ func (fs *fileStore) doWrite(cout io.WriteCloser, fields core.Fields, filter goe
 		return highWaterMark, nil
 	}
 
-	rowLength := encoding.Width64bits + encoding.Width16bits + len(key) + encoding.Width16bits
-	for _, seq := range columns {
-		rowLength += encoding.Width64bits + len(seq)
+	encodedKey := dict.encodeKey(key)
+	codec := fs.t.getCodec()
+	encodedColumns := make([][]byte, len(columns))
+	colLengths := make([]uint64, len(columns))
+	var timestamps encoding.DeltaOfDelta
+	rowLength := encoding.Width64bits + encoding.Width16bits + len(encodedKey) + encoding.Width16bits
+	for i, seq := range columns {
+		encodedColumns[i], colLengths[i] = encodeColumn(codec, seq, fields[i].Expr.EncodedWidth(), &timestamps)
+		rowLength += encoding.Width64bits + len(encodedColumns[i])
 		ts := seq.UntilInt()
 		if ts > highWaterMark {
 			highWaterMark = ts
@@ -508,11 +893,11 @@ func (fs *fileStore) doWrite(cout io.WriteCloser, fields core.Fields, filter goe
 		return highWaterMark, errors.Wrap(err)
 	}
 
-	err = binary.Write(o, encoding.Binary, uint16(len(key)))
+	err = binary.Write(o, encoding.Binary, uint16(len(encodedKey)))
 	if err != nil {
 		return highWaterMark, errors.Wrap(err)
 	}
-	_, err = o.Write(key)
+	_, err = o.Write(encodedKey)
 	if err != nil {
 		return highWaterMark, errors.Wrap(err)
 	}
@@ -521,14 +906,14 @@ func (fs *fileStore) doWrite(cout io.WriteCloser, fields core.Fields, filter goe
 	if err != nil {
 		return highWaterMark, errors.Wrap(err)
 	}
-	for _, seq := range columns {
-		err = binary.Write(o, encoding.Binary, uint64(len(seq)))
+	for _, colLength := range colLengths {
+		err = binary.Write(o, encoding.Binary, colLength)
 		if err != nil {
 			return highWaterMark, errors.Wrap(err)
 		}
 	}
-	for _, seq := range columns {
-		_, err = o.Write(seq)
+	for _, col := range encodedColumns {
+		_, err = o.Write(col)
 		if err != nil {
 			return highWaterMark, errors.Wrap(err)
 		}
@@ -546,6 +931,20 @@ func (fs *fileStore) doWrite(cout io.WriteCloser, fields core.Fields, filter goe
 	return highWaterMark, nil
 }
 
+func (rs *rowStore) setPersistedOffset(offset wal.Offset) {
+	rs.mx.Lock()
+	rs.persisted = offset
+	rs.mx.Unlock()
+}
+
+// persistedOffset returns the offset through which inserts have been durably
+// written to disk.
+func (rs *rowStore) persistedOffset() wal.Offset {
+	rs.mx.RLock()
+	defer rs.mx.RUnlock()
+	return rs.persisted
+}
+
 func (rs *rowStore) writeOffset(offset wal.Offset) error {
 	out, err := ioutil.TempFile("", "nextoffset")
 	if err != nil {
@@ -604,9 +1003,14 @@ func (rs *rowStore) removeOldFiles() {
 //
 // rowLength is 64 bits and includes itself
 // keylength is 16 bits and does not include itself
-// key can be up to 64KB
+// key can be up to 64KB, starting with FileVersion_5 it's encoded with the
+// file's dimensionDictionary
 // numcolumns is 16 bits (i.e. 65,536 columns allowed)
-// col*len is 64 bits
+// col*len is 64 bits, starting with FileVersion_7 the highest bits indicate
+// whether the column is gorilla encoded (see encodeColumn)
+//
+// Filestores of tables with LayoutColumnar are columnar segments instead (see
+// columnarWriter).
 type fileStore struct {
 	t        *table
 	rs       *rowStore
@@ -615,6 +1019,14 @@ type fileStore struct {
 }
 
 func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBuffer bool, rawOkay bool, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (more bool, err error)) (time.Time, error) {
+	return fs.iterateFiltered(nil, outFields, ms, okayToReuseBuffer, rawOkay, onRow)
+}
+
+// iterateFiltered is like iterate, but skips data in columnar segments that the
+// given filters exclude. Filestores with LayoutRow are read in full, but rows
+// whose dictionary encoded dimension values the filters exclude are skipped
+// without decoding their keys.
+func (fs *fileStore) iterateFiltered(filters segmentFilters, outFields []core.Field, ms *memstore, okayToReuseBuffer bool, rawOkay bool, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (more bool, err error)) (time.Time, error) {
 	ctx := time.Now().UnixNano()
 	var highWaterMark time.Time
 
@@ -628,6 +1040,12 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 		outFields = fs.fields
 	}
 
+	if tombstones := fs.t.getTombstones(); len(tombstones) > 0 {
+		// Raw rows would bypass the removal of deleted data
+		rawOkay = false
+		onRow = tombstones.filter(outFields, fs.t.Resolution, onRow)
+	}
+
 	// this function will map fields from the memstore into the right positions on
 	// the outbound row
 	var memToOut func(out []encoding.Sequence, i int, seq encoding.Sequence) bool
@@ -636,7 +1054,9 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 	}
 
 	file, err := os.OpenFile(fs.filename, os.O_RDONLY, 0)
-	if os.IsNotExist(err) {
+	if fs.rs.opts.inMemory {
+		// no filestore, only the memstore
+	} else if os.IsNotExist(err) {
 		log.Debugf("No filestore available at %v , (yet), try reading the offset file", fs.filename)
 		offsetFile := filepath.Join(fs.rs.opts.dir, offsetFilename)
 		o, err := ioutil.ReadFile(offsetFile)
@@ -653,7 +1073,23 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 			return highWaterMark, log.Errorf("Unable to open file %v: %v", fs.filename, err)
 		}
 		log.Debugf("Found filestore at %v", fs.filename)
-		r := snappy.NewReader(file)
+		if isColumnar(fs.filename) {
+			file.Close()
+			highWaterMark, err = fs.iterateColumnar(ctx, filters, outFields, ms, memToOut, onRow)
+			if err != nil {
+				return highWaterMark, err
+			}
+			return fs.iterateMemStore(ctx, highWaterMark, outFields, ms, memToOut, onRow)
+		}
+		dr, err := fs.t.keyring().NewReader(file)
+		if err != nil {
+			return highWaterMark, log.Errorf("Unable to decrypt file %v: %v", fs.filename, err)
+		}
+		r, err := compress.NewReader(dr)
+		if err != nil {
+			return highWaterMark, log.Errorf("Unable to decompress file %v: %v", fs.filename, err)
+		}
+		defer r.Close()
 
 		var fileFields core.Fields
 		highWaterMark, _, fileFields, err = fs.info(r)
@@ -662,8 +1098,21 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 		}
 		log.Debugf("Set highWaterMark from data file: %v", highWaterMark)
 
-		// raw is only okay if the file fields match the out fields
-		rawOkay = rawOkay && fileFields.Equals(outFields)
+		fileVersion := versionFor(fs.filename)
+		var dict *dimensionDictionary
+		if fileVersion >= FileVersion_5 {
+			dict, err = readDimensionDictionary(r)
+			if err != nil {
+				return highWaterMark, log.Errorf("Unable to read dictionary from %v: %v", fs.filename, err)
+			}
+		}
+
+		// prior to FileVersion_7, column lengths were plain lengths
+		supportsColumnEncoding := fileVersion >= FileVersion_7
+
+		// raw is only okay if the file fields match the out fields and the rows
+		// are encoded the same way as the ones we're writing
+		rawOkay = rawOkay && fileFields.Equals(outFields) && fileVersion == CurrentFileVersion
 
 		// this function will map fields from the file into the right positions on
 		// the outbound row
@@ -700,7 +1149,19 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 			}
 
 			keyLength, row := encoding.ReadInt16(row)
-			key, row := encoding.ReadByteMap(row, keyLength)
+			var key bytemap.ByteMap
+			if dict != nil {
+				if filters.excludesEncodedKey(dict, row[:keyLength]) {
+					continue
+				}
+				key, err = dict.decodeKey(row[:keyLength])
+				if err != nil {
+					return highWaterMark, log.Errorf("Unable to decode key: %v", err)
+				}
+				row = row[keyLength:]
+			} else {
+				key, row = encoding.ReadByteMap(row, keyLength)
+			}
 
 			var msColumns []encoding.Sequence
 			if ms != nil {
@@ -720,23 +1181,36 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 
 			numColumns, row := encoding.ReadInt16(row)
 			colLengths := make([]int, 0, numColumns)
+			colEncodings := make([]columnEncoding, 0, numColumns)
 			for i := 0; i < numColumns; i++ {
 				if len(row) < 8 {
 					return highWaterMark, log.Errorf("Not enough data left to decode column length!")
 				}
 				var colLength int
-				colLength, row = encoding.ReadInt64(row)
-				colLengths = append(colLengths, int(colLength))
+				var colEncoding columnEncoding
+				if supportsColumnEncoding {
+					colLength, colEncoding = decodeColumnLength(encoding.Binary.Uint64(row))
+					row = row[encoding.Width64bits:]
+				} else {
+					colLength, row = encoding.ReadInt64(row)
+				}
+				colLengths = append(colLengths, colLength)
+				colEncodings = append(colEncodings, colEncoding)
 			}
 
 			includesAtLeastOneColumn := false
 			columns := make([]encoding.Sequence, len(outFields))
+			var timestamps encoding.DeltaOfDelta
 			for i, colLength := range colLengths {
 				var seq encoding.Sequence
 				if colLength > len(row) {
 					return highWaterMark, log.Errorf("Not enough data left to decode column, wanted %d have %d", colLength, len(row))
 				}
 				seq, row = encoding.ReadSequence(row, colLength)
+				seq, err = colEncodings[i].decode(seq, &timestamps)
+				if err != nil {
+					return highWaterMark, log.Errorf("Unable to decode gorilla encoded column: %v", err)
+				}
 				if seq != nil && fileToOut(columns, i, seq) {
 					includesAtLeastOneColumn = true
 				}
@@ -766,7 +1240,12 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 		}
 	}
 
-	// Read remaining stuff from memstore
+	return fs.iterateMemStore(ctx, highWaterMark, outFields, ms, memToOut, onRow)
+}
+
+// iterateMemStore iterates over the rows remaining in the memstore after
+// merging it with the file.
+func (fs *fileStore) iterateMemStore(ctx int64, highWaterMark time.Time, outFields []core.Field, ms *memstore, memToOut func(out []encoding.Sequence, i int, seq encoding.Sequence) bool, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (more bool, err error)) (time.Time, error) {
 	if ms != nil {
 		msts := ms.offset.TS()
 		if msts.After(highWaterMark) {
@@ -802,8 +1281,13 @@ func (fs *fileStore) info(r io.Reader) (time.Time, string, core.Fields, error) {
 	}
 	highWaterMark = wal.Offset(fieldsBytes[:wal.OffsetSize]).TS()
 	fieldsBytes = fieldsBytes[wal.OffsetSize:]
-	delim := fieldsDelims[fileVersion]
 	fieldsString := string(fieldsBytes)
+	return highWaterMark, fieldsString, fs.parseFields(fieldsString, fieldsDelims[fileVersion]), nil
+}
+
+// parseFields parses the fields recorded in a file, mapping them to the fields
+// of this fileStore. Fields that no longer exist are returned as empty Fields.
+func (fs *fileStore) parseFields(fieldsString string, delim string) core.Fields {
 	fieldStrings := strings.Split(fieldsString, delim)
 	fileFields := make(core.Fields, 0, len(fieldStrings))
 	for _, fieldString := range fieldStrings {
@@ -819,8 +1303,7 @@ func (fs *fileStore) info(r io.Reader) (time.Time, string, core.Fields, error) {
 			fileFields = append(fileFields, core.Field{})
 		}
 	}
-
-	return highWaterMark, fieldsString, fileFields, nil
+	return fileFields
 }
 
 func versionFor(filename string) int {
@@ -4,8 +4,10 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb/metrics"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,3 +32,40 @@ func TestStorage(t *testing.T) {
 		cs.insert(&insert{})
 	}
 }
+
+func TestTuneFlushInterval(t *testing.T) {
+	rs := &rowStore{
+		t: &table{
+			TableOpts: &TableOpts{Name: "tuned"},
+			log:       golog.LoggerFor("tunetest"),
+		},
+		opts: &rowStoreOptions{
+			minFlushLatency:    time.Second,
+			maxFlushLatency:    time.Minute,
+			targetApplyLatency: 100 * time.Millisecond,
+		},
+	}
+	tune := func(applyLatency time.Duration, current time.Duration, flushDuration time.Duration) time.Duration {
+		rs.maxApplyLatency = int64(applyLatency)
+		return rs.tuneFlushInterval(current, flushDuration)
+	}
+
+	assert.Equal(t, 10*time.Second, tune(200*time.Millisecond, 20*time.Second, 10*time.Millisecond), "latency above target should flush more often")
+	assert.Equal(t, 20*time.Second, tune(80*time.Millisecond, 20*time.Second, 10*time.Millisecond), "latency close to target should leave interval alone")
+	assert.Equal(t, 30*time.Second, tune(10*time.Millisecond, 20*time.Second, 10*time.Millisecond), "latency well below target should flush less often")
+	assert.Equal(t, time.Second, tune(time.Second, 1500*time.Millisecond, 10*time.Millisecond), "interval shouldn't go below MinFlushLatency")
+	assert.Equal(t, 6*time.Second, tune(time.Second, 4*time.Second, 3*time.Second), "interval should leave time between flushes")
+	assert.Equal(t, time.Minute, tune(0, 50*time.Second, 10*time.Millisecond), "interval shouldn't go above MaxFlushLatency")
+	assert.Zero(t, rs.maxApplyLatency, "tuning should reset apply latency")
+
+	var stats *metrics.TableStats
+	for _, ts := range metrics.GetStats().Tables {
+		if ts.Table == "tuned" {
+			stats = ts
+		}
+	}
+	if assert.NotNil(t, stats) {
+		assert.Equal(t, time.Minute, stats.FlushInterval)
+		assert.Equal(t, 5, stats.FlushIntervalAdjustments)
+	}
+}
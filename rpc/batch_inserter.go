@@ -0,0 +1,205 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/wal"
+	"google.golang.org/grpc"
+)
+
+type batchInserter struct {
+	clientStream  grpc.ClientStream
+	streamName    string
+	batchSize     int
+	flushInterval time.Duration
+	// inFlight holds a token for every batch that hasn't been acknowledged yet
+	inFlight  chan bool
+	acksDone  chan bool
+	stopFlush chan bool
+	closeOnce sync.Once
+	// mx guards the batch and sending. It may be held while waiting for room in
+	// inFlight, so receiving acks must not depend on it.
+	batch []*Insert
+	seq   int
+	mx    sync.Mutex
+	// reportMx guards the report and err
+	report   *InsertReport
+	err      error
+	reportMx sync.Mutex
+}
+
+func (c *client) NewBatchInserter(ctx context.Context, streamName string, opts ...grpc.CallOption) (BatchInserter, error) {
+	clientStream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[11], c.cc, "/zenodb/insertBatches", opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &batchInserter{
+		clientStream:  clientStream,
+		streamName:    streamName,
+		batchSize:     c.opts.InsertBatchSize,
+		flushInterval: c.opts.InsertFlushInterval,
+		inFlight:      make(chan bool, c.opts.MaxInsertBatchesInFlight),
+		batch:         make([]*Insert, 0, c.opts.InsertBatchSize),
+		report:        &InsertReport{Errors: make(map[int]string)},
+		acksDone:      make(chan bool),
+		stopFlush:     make(chan bool),
+	}
+	go i.receiveAcks()
+	go i.flushPeriodically()
+	return i, nil
+}
+
+func (i *batchInserter) Insert(ts time.Time, dims map[string]interface{}, vals func(func(string, interface{}))) error {
+	insert := &Insert{
+		TS:   ts.UnixNano(),
+		Dims: bytemap.New(dims),
+		Vals: bytemap.Build(vals, nil, true),
+	}
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	if err := i.getErr(); err != nil {
+		return err
+	}
+	i.batch = append(i.batch, insert)
+	if len(i.batch) < i.batchSize {
+		return nil
+	}
+	return i.sendBatch()
+}
+
+func (i *batchInserter) Flush() error {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	if err := i.getErr(); err != nil {
+		return err
+	}
+	return i.sendBatch()
+}
+
+func (i *batchInserter) DurableOffset() wal.Offset {
+	i.reportMx.Lock()
+	defer i.reportMx.Unlock()
+	return i.report.DurableOffset
+}
+
+func (i *batchInserter) getErr() error {
+	i.reportMx.Lock()
+	defer i.reportMx.Unlock()
+	return i.err
+}
+
+// setErr records the first error encountered and returns the recorded error.
+func (i *batchInserter) setErr(err error) error {
+	i.reportMx.Lock()
+	defer i.reportMx.Unlock()
+	if i.err == nil {
+		i.err = err
+	}
+	return i.err
+}
+
+// sendBatch sends the buffered inserts, blocking until there's room for
+// another batch in flight. Must be called with mx held.
+func (i *batchInserter) sendBatch() error {
+	if len(i.batch) == 0 {
+		return nil
+	}
+	select {
+	case i.inFlight <- true:
+		// room for another batch
+	case <-i.acksDone:
+		return i.setErr(fmt.Errorf("Server stopped acknowledging inserts"))
+	}
+	err := i.clientStream.SendMsg(&InsertBatch{
+		Stream:  i.streamName,
+		Seq:     i.seq,
+		Inserts: i.batch,
+	})
+	if err != nil {
+		return i.setErr(fmt.Errorf("Unable to send insert batch: %v", err))
+	}
+	// Set streamName to "" to prevent sending it unnecessarily in subsequent batches
+	i.streamName = ""
+	i.seq++
+	i.batch = make([]*Insert, 0, i.batchSize)
+	return nil
+}
+
+func (i *batchInserter) flushPeriodically() {
+	ticker := time.NewTicker(i.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.stopFlush:
+			return
+		case <-ticker.C:
+			i.Flush()
+		}
+	}
+}
+
+func (i *batchInserter) receiveAcks() {
+	defer close(i.acksDone)
+	for {
+		ack := &InsertAck{}
+		err := i.clientStream.RecvMsg(ack)
+		if err != nil {
+			if err != io.EOF {
+				i.setErr(fmt.Errorf("Error from server: %v", err))
+			}
+			return
+		}
+		<-i.inFlight
+		i.reportMx.Lock()
+		i.report.Received += ack.Received
+		i.report.Succeeded += ack.Succeeded
+		for idx, msg := range ack.Errors {
+			i.report.Errors[idx] = msg
+		}
+		if ack.Offset != nil {
+			i.report.DurableOffset = ack.Offset
+		}
+		i.reportMx.Unlock()
+	}
+}
+
+func (i *batchInserter) Close() (*InsertReport, error) {
+	i.closeOnce.Do(func() {
+		close(i.stopFlush)
+	})
+	i.mx.Lock()
+	err := i.getErr()
+	if err == nil {
+		err = i.sendBatch()
+	}
+	if err == nil {
+		err = i.clientStream.SendMsg(&InsertBatch{EndOfInserts: true})
+		if err != nil {
+			err = fmt.Errorf("Unable to send closing message: %v", err)
+		}
+	}
+	if err == nil {
+		err = i.clientStream.CloseSend()
+		if err != nil {
+			err = fmt.Errorf("Unable to close send: %v", err)
+		}
+	}
+	i.mx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	<-i.acksDone
+	i.reportMx.Lock()
+	defer i.reportMx.Unlock()
+	if i.err != nil {
+		return nil, i.err
+	}
+	return i.report, nil
+}
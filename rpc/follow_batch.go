@@ -0,0 +1,68 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/getlantern/zenodb/compress"
+	"github.com/getlantern/zenodb/wal"
+)
+
+// EncodeFollowBatch encodes the given entries into a single Point whose data
+// is compressed with the given algorithm. Each entry is stored as its length
+// and data followed by its offset's length and offset, with 32 bit big-endian
+// lengths.
+func EncodeFollowBatch(algorithm string, entries []*Point) (*Point, error) {
+	size := 0
+	for _, entry := range entries {
+		size += 8 + len(entry.Data) + len(entry.Offset)
+	}
+	buf := make([]byte, 0, size)
+	var lenBuf [4]byte
+	for _, entry := range entries {
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(entry.Data)))
+		buf = append(append(buf, lenBuf[:]...), entry.Data...)
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(entry.Offset)))
+		buf = append(append(buf, lenBuf[:]...), entry.Offset...)
+	}
+	data, err := compress.Encode(algorithm, buf)
+	if err != nil {
+		return nil, err
+	}
+	return &Point{Data: data, Offset: entries[len(entries)-1].Offset, Batched: true}, nil
+}
+
+// DecodeFollowBatch decodes the entries of a batch encoded with
+// EncodeFollowBatch.
+func DecodeFollowBatch(point *Point) ([]*Point, error) {
+	buf, err := compress.Decode(point.Data)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Point
+	read := func() ([]byte, error) {
+		if len(buf) < 4 {
+			return nil, fmt.Errorf("Follow batch truncated")
+		}
+		l := int(binary.BigEndian.Uint32(buf))
+		buf = buf[4:]
+		if len(buf) < l {
+			return nil, fmt.Errorf("Follow batch truncated")
+		}
+		b := buf[:l]
+		buf = buf[l:]
+		return b, nil
+	}
+	for len(buf) > 0 {
+		data, err := read()
+		if err != nil {
+			return nil, err
+		}
+		offset, err := read()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &Point{Data: data, Offset: wal.Offset(offset)})
+	}
+	return entries, nil
+}
@@ -2,14 +2,16 @@ package rpc
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/golog"
-	"github.com/getlantern/wal"
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/metrics"
 	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/wal"
 	"google.golang.org/grpc"
 )
 
@@ -35,21 +37,61 @@ type InsertReport struct {
 	Received  int
 	Succeeded int
 	Errors    map[int]string
+	// DurableOffset is the WAL offset up to which the server acknowledged that
+	// inserts were persisted. It's only set for batched inserts.
+	DurableOffset wal.Offset
+}
+
+// InsertBatch is a batch of inserts sent by a BatchInserter. Only the first
+// batch needs to include the Stream.
+type InsertBatch struct {
+	Stream       string
+	Seq          int
+	Inserts      []*Insert
+	EndOfInserts bool
+}
+
+// InsertAck acknowledges the InsertBatch with the same Seq once its inserts
+// are durable in the stream's WAL. Errors are keyed by the index of the insert
+// among all inserts sent on the stream.
+type InsertAck struct {
+	Seq       int
+	Received  int
+	Succeeded int
+	Errors    map[int]string
+	Offset    wal.Offset
 }
 
 type Query struct {
-	SQLString       string
+	SQLString string
+	// PreparedQueryID, if specified, identifies a query prepared with
+	// PrepareQuery that's run instead of SQLString.
+	PreparedQueryID string
+	// Params are bound to the ? placeholders of the query.
+	Params          []interface{}
 	IsSubQuery      bool
 	SubQueryResults [][]interface{}
 	IncludeMemStore bool
 	Unflat          bool
 	Deadline        time.Time
 	HasDeadline     bool
+	// Cancel, when sent to a follower that's processing a remote query, tells
+	// the follower to stop processing it.
+	Cancel bool
+	// TraceContext continues the sender's trace on the node that runs the
+	// query.
+	TraceContext common.TraceContext
+	// RequestID identifies the client's request on the node that runs the
+	// query, for logs and errors.
+	RequestID string
 }
 
 type Point struct {
 	Data   []byte
 	Offset wal.Offset
+	// Batched indicates that Data is a batch of entries encoded with
+	// EncodeFollowBatch, in which case Offset is the offset of the last entry.
+	Batched bool
 }
 
 type RemoteQueryResult struct {
@@ -62,18 +104,164 @@ type RemoteQueryResult struct {
 	EndOfResults bool
 }
 
+type ClusterStatusRequest struct{}
+
+// TableStatsRequest asks the server for the stats of all of its tables. The
+// server responds with a TableStatsResult.
+type TableStatsRequest struct{}
+
+// TableStatsResult holds the stats of all tables, keyed to the table names.
+type TableStatsResult struct {
+	Tables map[string]*common.TableStats
+}
+
+// SnapshotChunk is a chunk of a table snapshot.
+type SnapshotChunk struct {
+	Version int
+	Data    []byte
+}
+
+type BackupRequest struct{}
+
+// BackupChunk is a chunk of a backup. When restoring or attaching, the final
+// chunk sets EndOfBackup.
+type BackupChunk struct {
+	Data        []byte
+	EndOfBackup bool
+	// Name is the name under which to attach the backup, set on the first chunk
+	// when attaching
+	Name string
+}
+
+// RestoreResult confirms that the server staged a restore.
+type RestoreResult struct{}
+
+// BackupAttached confirms that the server attached a backup.
+type BackupAttached struct{}
+
+// DetachBackup asks the server to detach the named backup.
+type DetachBackup struct {
+	Name string
+}
+
+// BackupDetached confirms that the server detached a backup.
+type BackupDetached struct{}
+
+// DeleteRows asks the server to delete the data of Table for rows matching
+// Where, limited to the periods between AsOf and Until if those are set.
+type DeleteRows struct {
+	Table string
+	Where string
+	AsOf  time.Time
+	Until time.Time
+}
+
+// RowsDeleted confirms that the server deleted data.
+type RowsDeleted struct{}
+
+// PromoteRequest asks a hot standby follower to start handling queries.
+type PromoteRequest struct{}
+
+// Promoted confirms that the follower was promoted.
+type Promoted struct{}
+
+// FollowCredits is sent by followers that use credit-based flow control to
+// allow the leader to send Entries more entries.
+type FollowCredits struct {
+	Entries int
+}
+
+// FollowAcked confirms that the leader recorded a common.FollowAck.
+type FollowAcked struct{}
+
+// CancelQuery asks the server to cancel the running query identified by
+// QueryID.
+type CancelQuery struct {
+	QueryID string
+}
+
+// QueryCancelled confirms that the server cancelled a query.
+type QueryCancelled struct{}
+
+// PrepareQuery asks the server to prepare a query with ? placeholders. The
+// server responds with a common.PreparedQuery.
+type PrepareQuery struct {
+	SQLString string
+}
+
+// ExportPartitionMapRequest asks a leader to export its partition map. The
+// server responds with a common.PartitionMap.
+type ExportPartitionMapRequest struct{}
+
+// PartitionMapImported confirms that the server imported a partition map.
+type PartitionMapImported struct{}
+
 type RegisterQueryHandler struct {
 	Partition int
+	// FollowerName identifies the replica of the partition that's handling
+	// queries.
+	FollowerName string
 }
 
 type Client interface {
 	NewInserter(ctx context.Context, stream string, opts ...grpc.CallOption) (Inserter, error)
 
+	NewBatchInserter(ctx context.Context, stream string, opts ...grpc.CallOption) (BatchInserter, error)
+
 	Query(ctx context.Context, sqlString string, includeMemStore bool, opts ...grpc.CallOption) (*common.QueryMetaData, func(onRow core.OnFlatRow) (*common.QueryStats, error), error)
 
+	// PrepareQuery prepares a query with ? placeholders on the server so that
+	// it can be run repeatedly with QueryPrepared.
+	PrepareQuery(ctx context.Context, sqlString string, opts ...grpc.CallOption) (*common.PreparedQuery, error)
+
+	// QueryPrepared runs a query prepared with PrepareQuery, binding its
+	// placeholders to the given params.
+	QueryPrepared(ctx context.Context, preparedQueryID string, params []interface{}, includeMemStore bool, opts ...grpc.CallOption) (*common.QueryMetaData, func(onRow core.OnFlatRow) (*common.QueryStats, error), error)
+
 	Follow(ctx context.Context, in *common.Follow, opts ...grpc.CallOption) (func() (data []byte, newOffset wal.Offset, err error), error)
 
-	ProcessRemoteQuery(ctx context.Context, partition int, query planner.QueryClusterFN, timeout time.Duration, opts ...grpc.CallOption) error
+	ProcessRemoteQuery(ctx context.Context, partition int, followerName string, query planner.QueryClusterFN, timeout time.Duration, opts ...grpc.CallOption) error
+
+	Replicate(ctx context.Context, in *common.Replicate, opts ...grpc.CallOption) (func() (data []byte, newOffset wal.Offset, err error), error)
+
+	ClusterStatus(ctx context.Context, opts ...grpc.CallOption) (*metrics.ClusterStatus, error)
+
+	AckFollow(ctx context.Context, ack *common.FollowAck, opts ...grpc.CallOption) error
+
+	Snapshot(ctx context.Context, req *common.SnapshotRequest, opts ...grpc.CallOption) (func() (version int, data []byte, err error), error)
+
+	Backup(ctx context.Context, w io.Writer, opts ...grpc.CallOption) error
+
+	Restore(ctx context.Context, r io.Reader, opts ...grpc.CallOption) error
+
+	// AttachBackup attaches the backup read from r under the given name, making
+	// its tables queryable as table@name.
+	AttachBackup(ctx context.Context, name string, r io.Reader, opts ...grpc.CallOption) error
+
+	DetachBackup(ctx context.Context, name string, opts ...grpc.CallOption) error
+
+	CancelQuery(ctx context.Context, queryID string, opts ...grpc.CallOption) error
+
+	// TableStats returns the stats of all tables on the server, keyed to the
+	// table names.
+	TableStats(ctx context.Context, opts ...grpc.CallOption) (map[string]*common.TableStats, error)
+
+	// ExportPartitionMap exports the leader's partition map, including the
+	// offsets acknowledged by its followers.
+	ExportPartitionMap(ctx context.Context, opts ...grpc.CallOption) (*common.PartitionMap, error)
+
+	// ImportPartitionMap imports a partition map exported from another leader so
+	// that followers resume from the offsets that they acknowledged to it.
+	ImportPartitionMap(ctx context.Context, m *common.PartitionMap, opts ...grpc.CallOption) error
+
+	// Delete deletes the data of the given table for rows matching the given
+	// WHERE clause, limited to the periods between asOf and until unless those
+	// are zero.
+	Delete(ctx context.Context, table string, where string, asOf time.Time, until time.Time, opts ...grpc.CallOption) error
+
+	// Promote makes a hot standby follower start handling queries for its
+	// partition.
+	Promote(ctx context.Context, opts ...grpc.CallOption) error
 
 	Close() error
 }
@@ -81,11 +269,43 @@ type Client interface {
 type Server interface {
 	Insert(stream grpc.ServerStream) error
 
+	InsertBatches(stream grpc.ServerStream) error
+
 	Query(*Query, grpc.ServerStream) error
 
 	Follow(*common.Follow, grpc.ServerStream) error
 
 	HandleRemoteQueries(r *RegisterQueryHandler, stream grpc.ServerStream) error
+
+	Replicate(*common.Replicate, grpc.ServerStream) error
+
+	ClusterStatus(*ClusterStatusRequest, grpc.ServerStream) error
+
+	AckFollow(*common.FollowAck, grpc.ServerStream) error
+
+	Snapshot(*common.SnapshotRequest, grpc.ServerStream) error
+
+	Backup(*BackupRequest, grpc.ServerStream) error
+
+	Restore(grpc.ServerStream) error
+
+	AttachBackup(grpc.ServerStream) error
+
+	DetachBackup(*DetachBackup, grpc.ServerStream) error
+
+	CancelQuery(*CancelQuery, grpc.ServerStream) error
+
+	PrepareQuery(*PrepareQuery, grpc.ServerStream) error
+
+	TableStats(*TableStatsRequest, grpc.ServerStream) error
+
+	ExportPartitionMap(*ExportPartitionMapRequest, grpc.ServerStream) error
+
+	ImportPartitionMap(*common.PartitionMap, grpc.ServerStream) error
+
+	Delete(*DeleteRows, grpc.ServerStream) error
+
+	Promote(*PromoteRequest, grpc.ServerStream) error
 }
 
 var ServiceDesc = grpc.ServiceDesc{
@@ -102,6 +322,7 @@ var ServiceDesc = grpc.ServiceDesc{
 			StreamName:    "follow",
 			Handler:       followHandler,
 			ServerStreams: true,
+			ClientStreams: true,
 		},
 		{
 			StreamName:    "remoteQuery",
@@ -114,6 +335,87 @@ var ServiceDesc = grpc.ServiceDesc{
 			Handler:       insertHandler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "replicate",
+			Handler:       replicateHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "clusterStatus",
+			Handler:       clusterStatusHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ackFollow",
+			Handler:       ackFollowHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "snapshot",
+			Handler:       snapshotHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "backup",
+			Handler:       backupHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "restore",
+			Handler:       restoreHandler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "cancelQuery",
+			Handler:       cancelQueryHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "insertBatches",
+			Handler:       insertBatchesHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "prepareQuery",
+			Handler:       prepareQueryHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "tableStats",
+			Handler:       tableStatsHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "attachBackup",
+			Handler:       attachBackupHandler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "detachBackup",
+			Handler:       detachBackupHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "exportPartitionMap",
+			Handler:       exportPartitionMapHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "importPartitionMap",
+			Handler:       importPartitionMapHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "delete",
+			Handler:       deleteHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "promote",
+			Handler:       promoteHandler,
+			ServerStreams: true,
+		},
 	},
 }
 
@@ -121,6 +423,10 @@ func insertHandler(srv interface{}, stream grpc.ServerStream) error {
 	return srv.(Server).Insert(stream)
 }
 
+func insertBatchesHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(Server).InsertBatches(stream)
+}
+
 func queryHandler(srv interface{}, stream grpc.ServerStream) error {
 	q := new(Query)
 	if err := stream.RecvMsg(q); err != nil {
@@ -144,3 +450,115 @@ func remoteQueryHandler(srv interface{}, stream grpc.ServerStream) error {
 	}
 	return srv.(Server).HandleRemoteQueries(r, stream)
 }
+
+func replicateHandler(srv interface{}, stream grpc.ServerStream) error {
+	r := new(common.Replicate)
+	if err := stream.RecvMsg(r); err != nil {
+		return err
+	}
+	return srv.(Server).Replicate(r, stream)
+}
+
+func clusterStatusHandler(srv interface{}, stream grpc.ServerStream) error {
+	r := new(ClusterStatusRequest)
+	if err := stream.RecvMsg(r); err != nil {
+		return err
+	}
+	return srv.(Server).ClusterStatus(r, stream)
+}
+
+func ackFollowHandler(srv interface{}, stream grpc.ServerStream) error {
+	ack := new(common.FollowAck)
+	if err := stream.RecvMsg(ack); err != nil {
+		return err
+	}
+	return srv.(Server).AckFollow(ack, stream)
+}
+
+func snapshotHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := new(common.SnapshotRequest)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(Server).Snapshot(req, stream)
+}
+
+func backupHandler(srv interface{}, stream grpc.ServerStream) error {
+	r := new(BackupRequest)
+	if err := stream.RecvMsg(r); err != nil {
+		return err
+	}
+	return srv.(Server).Backup(r, stream)
+}
+
+func restoreHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(Server).Restore(stream)
+}
+
+func attachBackupHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(Server).AttachBackup(stream)
+}
+
+func detachBackupHandler(srv interface{}, stream grpc.ServerStream) error {
+	d := new(DetachBackup)
+	if err := stream.RecvMsg(d); err != nil {
+		return err
+	}
+	return srv.(Server).DetachBackup(d, stream)
+}
+
+func cancelQueryHandler(srv interface{}, stream grpc.ServerStream) error {
+	c := new(CancelQuery)
+	if err := stream.RecvMsg(c); err != nil {
+		return err
+	}
+	return srv.(Server).CancelQuery(c, stream)
+}
+
+func prepareQueryHandler(srv interface{}, stream grpc.ServerStream) error {
+	p := new(PrepareQuery)
+	if err := stream.RecvMsg(p); err != nil {
+		return err
+	}
+	return srv.(Server).PrepareQuery(p, stream)
+}
+
+func tableStatsHandler(srv interface{}, stream grpc.ServerStream) error {
+	r := new(TableStatsRequest)
+	if err := stream.RecvMsg(r); err != nil {
+		return err
+	}
+	return srv.(Server).TableStats(r, stream)
+}
+
+func exportPartitionMapHandler(srv interface{}, stream grpc.ServerStream) error {
+	r := new(ExportPartitionMapRequest)
+	if err := stream.RecvMsg(r); err != nil {
+		return err
+	}
+	return srv.(Server).ExportPartitionMap(r, stream)
+}
+
+func importPartitionMapHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(common.PartitionMap)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(Server).ImportPartitionMap(m, stream)
+}
+
+func deleteHandler(srv interface{}, stream grpc.ServerStream) error {
+	d := new(DeleteRows)
+	if err := stream.RecvMsg(d); err != nil {
+		return err
+	}
+	return srv.(Server).Delete(d, stream)
+}
+
+func promoteHandler(srv interface{}, stream grpc.ServerStream) error {
+	r := new(PromoteRequest)
+	if err := stream.RecvMsg(r); err != nil {
+		return err
+	}
+	return srv.(Server).Promote(r, stream)
+}
@@ -10,20 +10,48 @@ import (
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/errors"
 	"github.com/getlantern/mtime"
-	"github.com/getlantern/wal"
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/metrics"
 	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/wal"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 )
 
+const (
+	backupChunkSize = 65536
+
+	// DefaultInsertBatchSize is the default for ClientOpts.InsertBatchSize
+	DefaultInsertBatchSize = 1000
+
+	// DefaultInsertFlushInterval is the default for ClientOpts.InsertFlushInterval
+	DefaultInsertFlushInterval = 1 * time.Second
+
+	// DefaultMaxInsertBatchesInFlight is the default for
+	// ClientOpts.MaxInsertBatchesInFlight
+	DefaultMaxInsertBatchesInFlight = 10
+)
+
 type ClientOpts struct {
 	// Password, if specified, is the password that client will present to server
 	// in order to gain access.
 	Password string
 
 	Dialer func(string, time.Duration) (net.Conn, error)
+
+	// InsertBatchSize is how many inserts a BatchInserter buffers before sending
+	// them to the server. Defaults to DefaultInsertBatchSize.
+	InsertBatchSize int
+
+	// InsertFlushInterval is how long a BatchInserter waits before sending a
+	// partially filled batch. Defaults to DefaultInsertFlushInterval.
+	InsertFlushInterval time.Duration
+
+	// MaxInsertBatchesInFlight is how many batches a BatchInserter sends before
+	// waiting for the server to acknowledge them. Once that many are in flight,
+	// Insert blocks. Defaults to DefaultMaxInsertBatchesInFlight.
+	MaxInsertBatchesInFlight int
 }
 
 type Inserter interface {
@@ -32,6 +60,20 @@ type Inserter interface {
 	Close() (*InsertReport, error)
 }
 
+// BatchInserter is an Inserter that sends inserts to the server in batches and
+// learns from the server's acknowledgements up to which point its inserts are
+// durable. Its Close waits for all batches to be acknowledged.
+type BatchInserter interface {
+	Inserter
+
+	// Flush sends any buffered inserts without waiting for the batch to fill.
+	Flush() error
+
+	// DurableOffset returns the WAL offset up to which the server has
+	// acknowledged inserts as durable so far.
+	DurableOffset() wal.Offset
+}
+
 func Dial(addr string, opts *ClientOpts) (Client, error) {
 	if opts.Dialer == nil {
 		// Use default dialer
@@ -41,6 +83,15 @@ func Dial(addr string, opts *ClientOpts) (Client, error) {
 	}
 
 	opts.Dialer = snappyDialer(opts.Dialer)
+	if opts.InsertBatchSize <= 0 {
+		opts.InsertBatchSize = DefaultInsertBatchSize
+	}
+	if opts.InsertFlushInterval <= 0 {
+		opts.InsertFlushInterval = DefaultInsertFlushInterval
+	}
+	if opts.MaxInsertBatchesInFlight <= 0 {
+		opts.MaxInsertBatchesInFlight = DefaultMaxInsertBatchesInFlight
+	}
 
 	conn, err := grpc.Dial(addr,
 		grpc.WithInsecure(),
@@ -50,12 +101,13 @@ func Dial(addr string, opts *ClientOpts) (Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &client{conn, opts.Password}, nil
+	return &client{conn, opts.Password, opts}, nil
 }
 
 type client struct {
 	cc       *grpc.ClientConn
 	password string
+	opts     *ClientOpts
 }
 
 type inserter struct {
@@ -64,7 +116,7 @@ type inserter struct {
 }
 
 func (c *client) NewInserter(ctx context.Context, streamName string, opts ...grpc.CallOption) (Inserter, error) {
-	clientStream, err := grpc.NewClientStream(ctx, &ServiceDesc.Streams[3], c.cc, "/zenodb/insert", opts...)
+	clientStream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[3], c.cc, "/zenodb/insert", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -105,11 +157,38 @@ func (i *inserter) Close() (*InsertReport, error) {
 }
 
 func (c *client) Query(ctx context.Context, sqlString string, includeMemStore bool, opts ...grpc.CallOption) (*common.QueryMetaData, func(onRow core.OnFlatRow) (*common.QueryStats, error), error) {
+	return c.query(ctx, &Query{SQLString: sqlString, IncludeMemStore: includeMemStore}, opts...)
+}
+
+func (c *client) PrepareQuery(ctx context.Context, sqlString string, opts ...grpc.CallOption) (*common.PreparedQuery, error) {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[12], c.cc, "/zenodb/prepareQuery", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&PrepareQuery{SQLString: sqlString}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	prepared := &common.PreparedQuery{}
+	if err := stream.RecvMsg(prepared); err != nil {
+		return nil, err
+	}
+	return prepared, nil
+}
+
+func (c *client) QueryPrepared(ctx context.Context, preparedQueryID string, params []interface{}, includeMemStore bool, opts ...grpc.CallOption) (*common.QueryMetaData, func(onRow core.OnFlatRow) (*common.QueryStats, error), error) {
+	return c.query(ctx, &Query{PreparedQueryID: preparedQueryID, Params: params, IncludeMemStore: includeMemStore}, opts...)
+}
+
+func (c *client) query(ctx context.Context, q *Query, opts ...grpc.CallOption) (*common.QueryMetaData, func(onRow core.OnFlatRow) (*common.QueryStats, error), error) {
 	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[0], c.cc, "/zenodb/query", opts...)
 	if err != nil {
 		return nil, nil, err
 	}
-	if err = stream.SendMsg(&Query{SQLString: sqlString, IncludeMemStore: includeMemStore}); err != nil {
+	q.TraceContext = common.InjectTraceContext(ctx)
+	if err = stream.SendMsg(q); err != nil {
 		return nil, nil, err
 	}
 	if err = stream.CloseSend(); err != nil {
@@ -150,6 +229,63 @@ func (c *client) Follow(ctx context.Context, f *common.Follow, opts ...grpc.Call
 	if err := stream.SendMsg(f); err != nil {
 		return nil, err
 	}
+	if f.Credits <= 0 {
+		if err := stream.CloseSend(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Grant credits back in chunks of half the initial credits so that the
+	// leader can keep sending while we process what we've received
+	grantEvery := f.Credits / 2
+	if grantEvery < 1 {
+		grantEvery = 1
+	}
+	consumed := 0
+	// entries from the latest batch that haven't been returned yet
+	var batched []*Point
+	next := func() ([]byte, wal.Offset, error) {
+		if f.Credits > 0 && consumed >= grantEvery {
+			// Entries returned so far have been handled by the caller
+			// io.EOF means that the stream ended, in which case RecvMsg below
+			// returns the actual status
+			if err := stream.SendMsg(&FollowCredits{Entries: consumed}); err != nil && err != io.EOF {
+				return nil, nil, err
+			}
+			consumed = 0
+		}
+		for len(batched) == 0 {
+			point := &Point{}
+			err := stream.RecvMsg(point)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !point.Batched {
+				consumed++
+				return point.Data, point.Offset, nil
+			}
+			batched, err = DecodeFollowBatch(point)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		point := batched[0]
+		batched = batched[1:]
+		consumed++
+		return point.Data, point.Offset, nil
+	}
+
+	return next, nil
+}
+
+func (c *client) Replicate(ctx context.Context, r *common.Replicate, opts ...grpc.CallOption) (func() (data []byte, newOffset wal.Offset, err error), error) {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[4], c.cc, "/zenodb/replicate", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(r); err != nil {
+		return nil, err
+	}
 	if err := stream.CloseSend(); err != nil {
 		return nil, err
 	}
@@ -166,7 +302,245 @@ func (c *client) Follow(ctx context.Context, f *common.Follow, opts ...grpc.Call
 	return next, nil
 }
 
-func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, query planner.QueryClusterFN, timeout time.Duration, opts ...grpc.CallOption) error {
+func (c *client) ClusterStatus(ctx context.Context, opts ...grpc.CallOption) (*metrics.ClusterStatus, error) {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[5], c.cc, "/zenodb/clusterStatus", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&ClusterStatusRequest{}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	status := &metrics.ClusterStatus{}
+	if err := stream.RecvMsg(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (c *client) TableStats(ctx context.Context, opts ...grpc.CallOption) (map[string]*common.TableStats, error) {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[13], c.cc, "/zenodb/tableStats", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&TableStatsRequest{}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	result := &TableStatsResult{}
+	if err := stream.RecvMsg(result); err != nil {
+		return nil, err
+	}
+	return result.Tables, nil
+}
+
+func (c *client) ExportPartitionMap(ctx context.Context, opts ...grpc.CallOption) (*common.PartitionMap, error) {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[16], c.cc, "/zenodb/exportPartitionMap", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&ExportPartitionMapRequest{}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	result := &common.PartitionMap{}
+	if err := stream.RecvMsg(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *client) ImportPartitionMap(ctx context.Context, m *common.PartitionMap, opts ...grpc.CallOption) error {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[17], c.cc, "/zenodb/importPartitionMap", opts...)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(m); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return stream.RecvMsg(&PartitionMapImported{})
+}
+
+func (c *client) AckFollow(ctx context.Context, ack *common.FollowAck, opts ...grpc.CallOption) error {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[6], c.cc, "/zenodb/ackFollow", opts...)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(ack); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return stream.RecvMsg(&FollowAcked{})
+}
+
+func (c *client) Snapshot(ctx context.Context, req *common.SnapshotRequest, opts ...grpc.CallOption) (func() (version int, data []byte, err error), error) {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[7], c.cc, "/zenodb/snapshot", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	next := func() (int, []byte, error) {
+		chunk := &SnapshotChunk{}
+		err := stream.RecvMsg(chunk)
+		if err != nil {
+			return 0, nil, err
+		}
+		return chunk.Version, chunk.Data, nil
+	}
+
+	return next, nil
+}
+
+func (c *client) Backup(ctx context.Context, w io.Writer, opts ...grpc.CallOption) error {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[8], c.cc, "/zenodb/backup", opts...)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&BackupRequest{}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		chunk := &BackupChunk{}
+		err := stream.RecvMsg(chunk)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return errors.New("Unable to write backup: %v", err)
+		}
+	}
+}
+
+func (c *client) Restore(ctx context.Context, r io.Reader, opts ...grpc.CallOption) error {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[9], c.cc, "/zenodb/restore", opts...)
+	if err != nil {
+		return err
+	}
+	if err := sendBackup(stream, "", r); err != nil {
+		return err
+	}
+	return stream.RecvMsg(&RestoreResult{})
+}
+
+func (c *client) AttachBackup(ctx context.Context, name string, r io.Reader, opts ...grpc.CallOption) error {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[14], c.cc, "/zenodb/attachBackup", opts...)
+	if err != nil {
+		return err
+	}
+	if err := sendBackup(stream, name, r); err != nil {
+		return err
+	}
+	return stream.RecvMsg(&BackupAttached{})
+}
+
+// sendBackup sends the backup read from r as BackupChunks, the first of which
+// carries the given name.
+func sendBackup(stream grpc.ClientStream, name string, r io.Reader) error {
+	buf := make([]byte, backupChunkSize)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			if err := stream.SendMsg(&BackupChunk{Data: buf[:n], Name: name}); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return errors.New("Unable to read backup: %v", readErr)
+		}
+	}
+	if err := stream.SendMsg(&BackupChunk{EndOfBackup: true, Name: name}); err != nil {
+		return err
+	}
+	return stream.CloseSend()
+}
+
+func (c *client) DetachBackup(ctx context.Context, name string, opts ...grpc.CallOption) error {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[15], c.cc, "/zenodb/detachBackup", opts...)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&DetachBackup{Name: name}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return stream.RecvMsg(&BackupDetached{})
+}
+
+func (c *client) Delete(ctx context.Context, table string, where string, asOf time.Time, until time.Time, opts ...grpc.CallOption) error {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[18], c.cc, "/zenodb/delete", opts...)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&DeleteRows{Table: table, Where: where, AsOf: asOf, Until: until}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return stream.RecvMsg(&RowsDeleted{})
+}
+
+func (c *client) Promote(ctx context.Context, opts ...grpc.CallOption) error {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[19], c.cc, "/zenodb/promote", opts...)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&PromoteRequest{}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return stream.RecvMsg(&Promoted{})
+}
+
+func (c *client) CancelQuery(ctx context.Context, queryID string, opts ...grpc.CallOption) error {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[10], c.cc, "/zenodb/cancelQuery", opts...)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&CancelQuery{QueryID: queryID}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return stream.RecvMsg(&QueryCancelled{})
+}
+
+func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, followerName string, query planner.QueryClusterFN, timeout time.Duration, opts ...grpc.CallOption) error {
 	elapsed := mtime.Stopwatch()
 
 	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[2], c.cc, "/zenodb/remoteQuery", opts...)
@@ -175,7 +549,7 @@ func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, query pl
 	}
 	defer stream.CloseSend()
 
-	if err := stream.SendMsg(&RegisterQueryHandler{partition}); err != nil {
+	if err := stream.SendMsg(&RegisterQueryHandler{Partition: partition, FollowerName: followerName}); err != nil {
 		return errors.New("Unable to send registration message: %v", err)
 	}
 
@@ -234,6 +608,23 @@ func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, query pl
 		defer cancel()
 	}
 	streamCtx = common.WithIncludeMemStore(streamCtx, q.IncludeMemStore)
+	streamCtx = common.ExtractTraceContext(streamCtx, q.TraceContext)
+	if q.RequestID != "" {
+		streamCtx = common.WithRequestID(streamCtx, q.RequestID)
+	}
+	streamCtx, cancel := context.WithCancel(streamCtx)
+	defer cancel()
+	go func() {
+		// The leader only sends something else on the stream if it wants us to
+		// cancel the query. If the stream fails, the leader is gone and there's
+		// no point in continuing either.
+		cancelMsg := &Query{}
+		recvErr := stream.RecvMsg(cancelMsg)
+		if recvErr == nil && cancelMsg.Cancel {
+			log.Debugf("Leader cancelled query on partition %d: %v", partition, q.SQLString)
+		}
+		cancel()
+	}()
 
 	_stats, queryErr := query(streamCtx, q.SQLString, q.IsSubQuery, q.SubQueryResults, q.Unflat, onFields, onRow, onFlatRow)
 	var stats *common.QueryStats
@@ -242,6 +633,7 @@ func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, query pl
 	}
 	result := &RemoteQueryResult{Stats: stats, EndOfResults: true}
 	if queryErr != nil && queryErr != io.EOF {
+		queryErr = common.ErrorWithRequestID(streamCtx, queryErr)
 		log.Debugf("Error on querying: %v", queryErr)
 		result.Error = queryErr.Error()
 	}
@@ -255,9 +647,16 @@ func (c *client) Close() error {
 }
 
 func (c *client) authenticated(ctx context.Context) context.Context {
-	if c.password == "" {
+	md := metadata.MD{}
+	if c.password != "" {
+		md.Set(PasswordKey, c.password)
+	}
+	if id := common.RequestIDFor(ctx); id != "" {
+		// Let the server use our request ID
+		md.Set(common.RequestIDHeader, id)
+	}
+	if len(md) == 0 {
 		return ctx
 	}
-	md := metadata.New(map[string]string{PasswordKey: c.password})
 	return metadata.NewOutgoingContext(ctx, md)
 }
@@ -0,0 +1,131 @@
+package rpcserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/rpc"
+)
+
+const (
+	// maxFollowBatchSize caps the size of follow batches so that, even with a
+	// large final entry, they stay well within gRPC's maximum message size.
+	maxFollowBatchSize = 1024 * 1024
+
+	defaultFollowBatchInterval = 100 * time.Millisecond
+)
+
+// followBatcher collects the entries sent to a follower into batches, sending
+// them once they reach the batch size or the batch interval elapses. Rather
+// than copying their data, it retains the entries until their batch is sent.
+type followBatcher struct {
+	send        func(*rpc.Point) error
+	size        int
+	compression string
+	entries     []common.FollowEntry
+	// points are the entries of the current batch as rpc.Points, which are
+	// reused from one batch to the next
+	points  []*rpc.Point
+	bytes   int
+	err     error
+	mx      sync.Mutex
+	stop    chan bool
+	stopped chan bool
+}
+
+func newFollowBatcher(send func(*rpc.Point) error, size int, interval time.Duration, compression string) *followBatcher {
+	if size > maxFollowBatchSize {
+		size = maxFollowBatchSize
+	}
+	if interval <= 0 {
+		interval = defaultFollowBatchInterval
+	}
+	b := &followBatcher{
+		send:        send,
+		size:        size,
+		compression: compression,
+		stop:        make(chan bool),
+		stopped:     make(chan bool),
+	}
+	go b.flushPeriodically(interval)
+	return b
+}
+
+// add adds an entry to the current batch, sending the batch if it's full. It
+// returns the error from sending any prior batch, which stops following.
+func (b *followBatcher) add(entry common.FollowEntry) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	entry.Retain()
+	b.entries = append(b.entries, entry)
+	n := len(b.points)
+	if n < cap(b.points) {
+		b.points = b.points[:n+1]
+	} else {
+		b.points = append(b.points, nil)
+	}
+	point := b.points[n]
+	if point == nil {
+		point = &rpc.Point{}
+		b.points[n] = point
+	}
+	point.Data, point.Offset = entry.Data(), entry.Offset()
+	b.bytes += len(point.Data)
+	if b.bytes >= b.size {
+		b.flush()
+	}
+	return b.err
+}
+
+func (b *followBatcher) flushPeriodically(interval time.Duration) {
+	defer close(b.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.mx.Lock()
+			b.flush()
+			b.mx.Unlock()
+		}
+	}
+}
+
+// flush sends the current batch, if any, and releases its entries. It must be
+// called with mx held.
+func (b *followBatcher) flush() {
+	if len(b.entries) == 0 {
+		return
+	}
+	if b.err == nil {
+		point, err := rpc.EncodeFollowBatch(b.compression, b.points)
+		if err == nil {
+			err = b.send(point)
+		}
+		b.err = err
+	}
+	for i, entry := range b.entries {
+		entry.Release()
+		b.entries[i] = nil
+		b.points[i].Data = nil
+	}
+	b.entries = b.entries[:0]
+	b.points = b.points[:0]
+	b.bytes = 0
+}
+
+// close stops periodic flushing and sends the remaining entries.
+func (b *followBatcher) close() error {
+	close(b.stop)
+	<-b.stopped
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.flush()
+	return b.err
+}
@@ -0,0 +1,54 @@
+package rpcserver
+
+import (
+	"sync"
+)
+
+// followCredits tracks how many more entries the leader may send to a
+// follower that uses credit-based flow control.
+type followCredits struct {
+	available int
+	closed    bool
+	mx        sync.Mutex
+	cond      *sync.Cond
+}
+
+func newFollowCredits(initial int) *followCredits {
+	c := &followCredits{available: initial}
+	c.cond = sync.NewCond(&c.mx)
+	return c
+}
+
+// grant makes n more credits available.
+func (c *followCredits) grant(n int) {
+	if n <= 0 {
+		return
+	}
+	c.mx.Lock()
+	c.available += n
+	c.mx.Unlock()
+	c.cond.Broadcast()
+}
+
+// take uses up a credit, waiting until one is available. It returns false if
+// the credits were closed, in which case the follower is gone.
+func (c *followCredits) take() bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for c.available <= 0 && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return false
+	}
+	c.available--
+	return true
+}
+
+// close wakes up anyone waiting for credits.
+func (c *followCredits) close() {
+	c.mx.Lock()
+	c.closed = true
+	c.mx.Unlock()
+	c.cond.Broadcast()
+}
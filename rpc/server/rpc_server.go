@@ -1,59 +1,145 @@
 package rpcserver
 
 import (
+	"bufio"
 	"context"
+	"crypto/subtle"
+	"crypto/x509"
 	"fmt"
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/errors"
 	"github.com/getlantern/golog"
-	"github.com/getlantern/wal"
 	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/acl"
+	"github.com/getlantern/zenodb/clustertls"
 	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/compress"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/metrics"
 	"github.com/getlantern/zenodb/planner"
 	"github.com/getlantern/zenodb/rpc"
+	"github.com/getlantern/zenodb/sql"
+	"github.com/getlantern/zenodb/wal"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"io"
 	"net"
 	"time"
 )
 
+const (
+	backupChunkSize = 65536
+
+	// maxPendingInsertAcks caps how many insert batches can wait to be
+	// acknowledged before the server stops reading new batches.
+	maxPendingInsertAcks = 100
+)
+
 var (
 	log = golog.LoggerFor("zenodb.rpc")
 )
 
 type Opts struct {
 	// Password, if specified, is the password that clients must present in order
-	// to access the server.
+	// to access the server. Clients that present it may do anything.
 	Password string
+
+	// ACL, if specified, authenticates principals by their passwords and
+	// restricts what they may do by their roles. When an ACL is specified,
+	// inserts require the writer role on the stream.
+	ACL *acl.ACL
+
+	// FollowerTokens, if specified, maps follower names to the tokens that they
+	// must present in order to follow. If empty, followers aren't required to
+	// identify themselves.
+	FollowerTokens map[string]string
+
+	// ClusterCAs, if specified, are the certificate authorities of the cluster.
+	// Cluster peers (followers, replicas, replication peers and query handlers)
+	// must then present a TLS client certificate issued by one of them in
+	// addition to authenticating with a password. This requires the listener
+	// passed to Serve to terminate TLS and request client certificates.
+	ClusterCAs *x509.CertPool
 }
 
 // DB is an interface for database-like things (implemented by common.DB).
 type DB interface {
 	InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error
 
+	DurableOffset(stream string) (wal.Offset, error)
+
 	Query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (core.FlatRowSource, error)
 
-	Follow(f *common.Follow, cb func([]byte, wal.Offset) error)
+	FollowEntries(f *common.Follow, cb func(common.FollowEntry) error) error
+
+	RegisterQueryHandler(partition int, replica string, query planner.QueryClusterFN)
+
+	Replicate(r *common.Replicate, cb func([]byte, wal.Offset) error) error
+
+	ClusterStatus() *metrics.ClusterStatus
+
+	AllTableStats() map[string]common.TableStats
+
+	AckFollow(ack *common.FollowAck) error
+
+	Snapshot(req *common.SnapshotRequest, cb func(version int, data []byte) error) error
+
+	Backup(ctx context.Context, w io.Writer) error
+
+	Restore(r io.Reader) error
+
+	AttachBackup(name string, r io.Reader) error
+
+	DetachBackup(name string) error
+
+	Delete(table string, where string, asOf time.Time, until time.Time) error
+
+	Promote() error
+
+	ExportPartitionMap() *common.PartitionMap
+
+	ImportPartitionMap(m *common.PartitionMap) error
+
+	CancelQuery(queryID string) error
 
-	RegisterQueryHandler(partition int, query planner.QueryClusterFN)
+	PrepareQuery(sqlString string) (*common.PreparedQuery, error)
+
+	BindPrepared(id string, params ...interface{}) (string, error)
 }
 
 func Serve(db DB, l net.Listener, opts *Opts) error {
 	l = &rpc.SnappyListener{l}
-	gs := grpc.NewServer(grpc.CustomCodec(rpc.Codec))
-	gs.RegisterService(&rpc.ServiceDesc, &server{db, opts.Password})
+	serverOpts := []grpc.ServerOption{grpc.CustomCodec(rpc.Codec)}
+	if opts.ClusterCAs != nil {
+		serverOpts = append(serverOpts, grpc.Creds(rpc.TLSStateCredentials()))
+	}
+	gs := grpc.NewServer(serverOpts...)
+	gs.RegisterService(&rpc.ServiceDesc, &server{db, opts.Password, opts.ACL, opts.FollowerTokens, opts.ClusterCAs})
 	return gs.Serve(l)
 }
 
 type server struct {
-	db       DB
-	password string
+	db             DB
+	password       string
+	acl            *acl.ACL
+	followerTokens map[string]string
+	clusterCAs     *x509.CertPool
 }
 
 func (s *server) Insert(stream grpc.ServerStream) error {
-	// No need to authorize, anyone can insert
+	ctx := requestContext(stream)
+	return requestError(ctx, "inserting", s.doInsert(ctx, stream))
+}
+
+func (s *server) doInsert(ctx context.Context, stream grpc.ServerStream) error {
+	// Without an ACL, there's no need to authorize, anyone can insert
+	principal, authorizeErr := s.authorizeInserts(stream)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
 
 	now := time.Now()
 	streamName := ""
@@ -81,46 +167,194 @@ func (s *server) Insert(stream grpc.ServerStream) error {
 			if streamName == "" {
 				return fmt.Errorf("Please specify a stream")
 			}
+			if err := principal.Check(acl.Writer, streamName); err != nil {
+				return err
+			}
 		}
 
-		if len(insert.Dims) == 0 {
-			report.Errors[i] = fmt.Sprintf("Need at least one dim")
+		insertErr := s.insert(streamName, now, insert)
+		if insertErr != nil {
+			report.Errors[i] = insertErr.Error()
 			continue
 		}
-		if len(insert.Vals) == 0 {
-			report.Errors[i] = fmt.Sprintf("Need at least one val")
-			continue
+		report.Succeeded++
+	}
+}
+
+func (s *server) insert(streamName string, now time.Time, insert *rpc.Insert) error {
+	if len(insert.Dims) == 0 {
+		return fmt.Errorf("Need at least one dim")
+	}
+	if len(insert.Vals) == 0 {
+		return fmt.Errorf("Need at least one val")
+	}
+	var ts time.Time
+	if insert.TS == 0 {
+		ts = now
+	} else {
+		ts = encoding.TimeFromInt(insert.TS)
+	}
+
+	// TODO: make sure we don't barf on invalid bytemaps here
+	insertErr := s.db.InsertRaw(streamName, ts, bytemap.ByteMap(insert.Dims), bytemap.ByteMap(insert.Vals))
+	if insertErr != nil {
+		return fmt.Errorf("Unable to insert: %v", insertErr)
+	}
+	return nil
+}
+
+// InsertBatches inserts batches of data and acknowledges each batch once its
+// data is durable. Acknowledgements are sent in the background so that the
+// client can keep sending while the WAL syncs.
+func (s *server) InsertBatches(stream grpc.ServerStream) error {
+	ctx := requestContext(stream)
+	return requestError(ctx, "inserting batches", s.insertBatches(ctx, stream))
+}
+
+func (s *server) insertBatches(ctx context.Context, stream grpc.ServerStream) error {
+	// Without an ACL, there's no need to authorize, anyone can insert
+	principal, authorizeErr := s.authorizeInserts(stream)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	now := time.Now()
+	streamName := ""
+	var acks chan *rpc.InsertAck
+	var ackErr chan error
+	finishAcks := func() error {
+		if acks == nil {
+			return nil
 		}
-		var ts time.Time
-		if insert.TS == 0 {
-			ts = now
-		} else {
-			ts = encoding.TimeFromInt(insert.TS)
+		close(acks)
+		return <-ackErr
+	}
+
+	i := -1
+	for {
+		batch := &rpc.InsertBatch{}
+		err := stream.RecvMsg(batch)
+		if err != nil {
+			finishAcks()
+			return fmt.Errorf("Error reading insert batch: %v", err)
+		}
+		if batch.EndOfInserts {
+			// We're done inserting, wait for all batches to be acknowledged
+			return finishAcks()
 		}
 
-		// TODO: make sure we don't barf on invalid bytemaps here
-		insertErr := s.db.InsertRaw(streamName, ts, bytemap.ByteMap(insert.Dims), bytemap.ByteMap(insert.Vals))
-		if insertErr != nil {
-			report.Errors[i] = fmt.Sprintf("Unable to insert: %v", insertErr)
-			continue
+		if streamName == "" {
+			streamName = batch.Stream
+			if streamName == "" {
+				return fmt.Errorf("Please specify a stream")
+			}
+			if err := principal.Check(acl.Writer, streamName); err != nil {
+				return err
+			}
+			acks = make(chan *rpc.InsertAck, maxPendingInsertAcks)
+			ackErr = make(chan error, 1)
+			go func() {
+				ackErr <- s.ackInserts(stream, streamName, acks)
+			}()
+		}
+
+		ack := &rpc.InsertAck{
+			Seq:    batch.Seq,
+			Errors: make(map[int]string),
+		}
+		for _, insert := range batch.Inserts {
+			i++
+			ack.Received++
+			insertErr := s.insert(streamName, now, insert)
+			if insertErr != nil {
+				ack.Errors[i] = insertErr.Error()
+				continue
+			}
+			ack.Succeeded++
+		}
+
+		select {
+		case acks <- ack:
+			// queued
+		case err := <-ackErr:
+			return err
+		}
+	}
+}
+
+// ackInserts sends acknowledgements with the durable WAL offset. Batches that
+// queue up while waiting for the WAL to sync are acknowledged together.
+func (s *server) ackInserts(stream grpc.ServerStream, streamName string, acks <-chan *rpc.InsertAck) error {
+	for ack := range acks {
+		pending := []*rpc.InsertAck{ack}
+	drain:
+		for {
+			select {
+			case next, ok := <-acks:
+				if !ok {
+					break drain
+				}
+				pending = append(pending, next)
+			default:
+				break drain
+			}
+		}
+
+		offset, err := s.db.DurableOffset(streamName)
+		if err != nil {
+			return fmt.Errorf("Unable to determine durable offset: %v", err)
+		}
+		for _, ack := range pending {
+			ack.Offset = offset
+			err = stream.SendMsg(ack)
+			if err != nil {
+				return fmt.Errorf("Unable to send insert ack: %v", err)
+			}
 		}
-		report.Succeeded++
 	}
+	return nil
 }
 
 func (s *server) Query(q *rpc.Query, stream grpc.ServerStream) error {
-	authorizeErr := s.authorize(stream)
-	if authorizeErr != nil {
-		return authorizeErr
+	ctx := requestContext(stream)
+	return requestError(ctx, "querying", s.query(ctx, q, stream))
+}
+
+func (s *server) query(ctx context.Context, q *rpc.Query, stream grpc.ServerStream) error {
+	principal, authenticateErr := s.authenticate(stream)
+	if authenticateErr != nil {
+		return authenticateErr
+	}
+
+	sqlString := q.SQLString
+	var err error
+	if q.PreparedQueryID != "" {
+		sqlString, err = s.db.BindPrepared(q.PreparedQueryID, q.Params...)
+	} else if len(q.Params) > 0 {
+		sqlString, err = sql.Bind(sqlString, q.Params...)
+	}
+	if err != nil {
+		return err
+	}
+	err = principal.CheckQuery(sqlString)
+	if err != nil {
+		return err
 	}
 
-	source, err := s.db.Query(q.SQLString, q.IsSubQuery, q.SubQueryResults, q.IncludeMemStore)
+	source, err := s.db.Query(sqlString, q.IsSubQuery, q.SubQueryResults, q.IncludeMemStore)
 	if err != nil {
 		return err
 	}
 
+	ctx = common.ExtractTraceContext(ctx, q.TraceContext)
+	if p, ok := peer.FromContext(ctx); ok {
+		ctx = common.WithCaller(ctx, "rpc:"+p.Addr.String())
+	}
+	if principal != nil {
+		ctx = common.WithPrincipal(ctx, principal.Name)
+	}
 	rr := &rpc.RemoteQueryResult{}
-	stats, err := source.Iterate(stream.Context(), func(fields core.Fields) error {
+	stats, err := source.Iterate(ctx, func(fields core.Fields) error {
 		// Send query metadata
 		md := zenodb.MetaDataFor(source, fields)
 		return stream.SendMsg(md)
@@ -142,20 +376,361 @@ func (s *server) Query(q *rpc.Query, stream grpc.ServerStream) error {
 }
 
 func (s *server) Follow(f *common.Follow, stream grpc.ServerStream) error {
-	authorizeErr := s.authorize(stream)
+	_, authorizeErr := s.authorize(stream, acl.Admin, f.Stream)
 	if authorizeErr != nil {
 		return authorizeErr
 	}
+	peerErr := s.authenticatePeer(stream)
+	if peerErr != nil {
+		return peerErr
+	}
 
-	log.Debugf("Follower %d joined", f.PartitionNumber)
-	defer log.Debugf("Follower %d left", f.PartitionNumber)
-	s.db.Follow(f, func(data []byte, newOffset wal.Offset) error {
-		return stream.SendMsg(&rpc.Point{data, newOffset})
-	})
+	authenticateErr := s.authenticateFollower(f.FollowerName, f.FollowerToken, f.PartitionNumber)
+	if authenticateErr != nil {
+		return authenticateErr
+	}
+
+	log.Debugf("Follower %d (%v) joined", f.PartitionNumber, f.FollowerName)
+	defer log.Debugf("Follower %d (%v) left", f.PartitionNumber, f.FollowerName)
+	send := func(point *rpc.Point) error {
+		return stream.SendMsg(point)
+	}
+	withCredits := func(cb func(common.FollowEntry) error) func(common.FollowEntry) error {
+		return cb
+	}
+	if f.Credits > 0 {
+		credits := newFollowCredits(f.Credits)
+		defer credits.close()
+		go s.receiveFollowCredits(f, stream, credits)
+		withCredits = func(cb func(common.FollowEntry) error) func(common.FollowEntry) error {
+			return func(entry common.FollowEntry) error {
+				if !credits.take() {
+					return fmt.Errorf("Follower %d (%v) stopped granting credits", f.PartitionNumber, f.FollowerName)
+				}
+				return cb(entry)
+			}
+		}
+	}
+	if f.BatchSize <= 0 {
+		return s.db.FollowEntries(f, withCredits(func(entry common.FollowEntry) error {
+			return send(&rpc.Point{Data: entry.Data(), Offset: entry.Offset()})
+		}))
+	}
+
+	if err := compress.Validate(f.BatchCompression); err != nil {
+		return err
+	}
+	b := newFollowBatcher(send, f.BatchSize, f.BatchInterval, f.BatchCompression)
+	followErr := s.db.FollowEntries(f, withCredits(b.add))
+	closeErr := b.close()
+	if followErr != nil {
+		return followErr
+	}
+	return closeErr
+}
+
+// receiveFollowCredits grants the credits that the follower sends until the
+// stream ends.
+func (s *server) receiveFollowCredits(f *common.Follow, stream grpc.ServerStream, credits *followCredits) {
+	defer credits.close()
+	for {
+		grant := &rpc.FollowCredits{}
+		if err := stream.RecvMsg(grant); err != nil {
+			if err != io.EOF {
+				log.Debugf("Error receiving credits from follower %d (%v): %v", f.PartitionNumber, f.FollowerName, err)
+			}
+			return
+		}
+		credits.grant(grant.Entries)
+	}
+}
+
+func (s *server) authenticateFollower(name string, token string, partition int) error {
+	if len(s.followerTokens) == 0 {
+		return nil
+	}
+	expectedToken, found := s.followerTokens[name]
+	if !found || subtle.ConstantTimeCompare([]byte(expectedToken), []byte(token)) != 1 {
+		return log.Errorf("Follower '%v' for partition %d not authorized", name, partition)
+	}
 	return nil
 }
 
+func (s *server) AckFollow(ack *common.FollowAck, stream grpc.ServerStream) error {
+	_, authorizeErr := s.authorize(stream, acl.Admin, acl.AllTables)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+	peerErr := s.authenticatePeer(stream)
+	if peerErr != nil {
+		return peerErr
+	}
+
+	authenticateErr := s.authenticateFollower(ack.FollowerName, ack.FollowerToken, ack.PartitionNumber)
+	if authenticateErr != nil {
+		return authenticateErr
+	}
+
+	ackErr := s.db.AckFollow(ack)
+	if ackErr != nil {
+		return ackErr
+	}
+	return stream.SendMsg(&rpc.FollowAcked{})
+}
+
+func (s *server) Snapshot(req *common.SnapshotRequest, stream grpc.ServerStream) error {
+	_, authorizeErr := s.authorize(stream, acl.Admin, acl.AllTables)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+	peerErr := s.authenticatePeer(stream)
+	if peerErr != nil {
+		return peerErr
+	}
+
+	authenticateErr := s.authenticateFollower(req.FollowerName, req.FollowerToken, req.Partition)
+	if authenticateErr != nil {
+		return authenticateErr
+	}
+
+	return s.db.Snapshot(req, func(version int, data []byte) error {
+		return stream.SendMsg(&rpc.SnapshotChunk{Version: version, Data: data})
+	})
+}
+
+func (s *server) Backup(r *rpc.BackupRequest, stream grpc.ServerStream) error {
+	_, authorizeErr := s.authorize(stream, acl.Admin, acl.AllTables)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	log.Debug("Sending backup")
+	out := bufio.NewWriterSize(&backupWriter{stream}, backupChunkSize)
+	err := s.db.Backup(stream.Context(), out)
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+func (s *server) Restore(stream grpc.ServerStream) error {
+	_, authorizeErr := s.authorize(stream, acl.Admin, acl.AllTables)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	log.Debug("Receiving backup to restore")
+	err := receiveBackup(stream, func(name string, r io.Reader) error {
+		return s.db.Restore(r)
+	})
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(&rpc.RestoreResult{})
+}
+
+func (s *server) AttachBackup(stream grpc.ServerStream) error {
+	_, authorizeErr := s.authorize(stream, acl.Admin, acl.AllTables)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	log.Debug("Receiving backup to attach")
+	err := receiveBackup(stream, s.db.AttachBackup)
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(&rpc.BackupAttached{})
+}
+
+func (s *server) DetachBackup(d *rpc.DetachBackup, stream grpc.ServerStream) error {
+	_, authorizeErr := s.authorize(stream, acl.Admin, acl.AllTables)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	err := s.db.DetachBackup(d.Name)
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(&rpc.BackupDetached{})
+}
+
+func (s *server) Delete(d *rpc.DeleteRows, stream grpc.ServerStream) error {
+	_, authorizeErr := s.authorize(stream, acl.Admin, d.Table)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	err := s.db.Delete(d.Table, d.Where, d.AsOf, d.Until)
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(&rpc.RowsDeleted{})
+}
+
+func (s *server) Promote(r *rpc.PromoteRequest, stream grpc.ServerStream) error {
+	_, authorizeErr := s.authorize(stream, acl.Admin, acl.AllTables)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	err := s.db.Promote()
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(&rpc.Promoted{})
+}
+
+func (s *server) ExportPartitionMap(r *rpc.ExportPartitionMapRequest, stream grpc.ServerStream) error {
+	_, authorizeErr := s.authorize(stream, acl.Admin, acl.AllTables)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	return stream.SendMsg(s.db.ExportPartitionMap())
+}
+
+func (s *server) ImportPartitionMap(m *common.PartitionMap, stream grpc.ServerStream) error {
+	_, authorizeErr := s.authorize(stream, acl.Admin, acl.AllTables)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	log.Debugf("Importing partition map from leader %v with %d followers", m.LeaderID, len(m.Followers))
+	err := s.db.ImportPartitionMap(m)
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(&rpc.PartitionMapImported{})
+}
+
+// receiveBackup receives a backup sent as BackupChunks and passes it to
+// process along with the name from the first chunk.
+func receiveBackup(stream grpc.ServerStream, process func(name string, r io.Reader) error) error {
+	first := &rpc.BackupChunk{}
+	err := stream.RecvMsg(first)
+	if err != nil {
+		return errors.New("Error reading backup: %v", err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		chunk := first
+		for {
+			if chunk.EndOfBackup {
+				pw.Close()
+				return
+			}
+			_, err := pw.Write(chunk.Data)
+			if err != nil {
+				// process stopped reading
+				return
+			}
+			chunk = &rpc.BackupChunk{}
+			err = stream.RecvMsg(chunk)
+			if err != nil {
+				pw.CloseWithError(errors.New("Error reading backup: %v", err))
+				return
+			}
+		}
+	}()
+	err = process(first.Name, pr)
+	pr.Close()
+	return err
+}
+
+// backupWriter is an io.Writer that sends backup data as BackupChunks.
+type backupWriter struct {
+	stream grpc.ServerStream
+}
+
+func (bw *backupWriter) Write(b []byte) (int, error) {
+	err := bw.stream.SendMsg(&rpc.BackupChunk{Data: b})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s *server) CancelQuery(c *rpc.CancelQuery, stream grpc.ServerStream) error {
+	_, authorizeErr := s.authorize(stream, acl.Admin, acl.AllTables)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	cancelErr := s.db.CancelQuery(c.QueryID)
+	if cancelErr != nil {
+		return cancelErr
+	}
+	return stream.SendMsg(&rpc.QueryCancelled{})
+}
+
+func (s *server) PrepareQuery(p *rpc.PrepareQuery, stream grpc.ServerStream) error {
+	_, authorizeErr := s.authenticate(stream)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	prepared, err := s.db.PrepareQuery(p.SQLString)
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(prepared)
+}
+
+func (s *server) Replicate(r *common.Replicate, stream grpc.ServerStream) error {
+	_, authorizeErr := s.authorize(stream, acl.Admin, r.Stream)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+	peerErr := s.authenticatePeer(stream)
+	if peerErr != nil {
+		return peerErr
+	}
+
+	log.Debugf("Peer %v replicating %v", r.NodeID, r.Stream)
+	defer log.Debugf("Peer %v stopped replicating %v", r.NodeID, r.Stream)
+	return s.db.Replicate(r, func(data []byte, newOffset wal.Offset) error {
+		return stream.SendMsg(&rpc.Point{Data: data, Offset: newOffset})
+	})
+}
+
+func (s *server) ClusterStatus(r *rpc.ClusterStatusRequest, stream grpc.ServerStream) error {
+	_, authorizeErr := s.authenticate(stream)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	return stream.SendMsg(s.db.ClusterStatus())
+}
+
+func (s *server) TableStats(r *rpc.TableStatsRequest, stream grpc.ServerStream) error {
+	_, authorizeErr := s.authenticate(stream)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	result := &rpc.TableStatsResult{Tables: make(map[string]*common.TableStats)}
+	for name, stats := range s.db.AllTableStats() {
+		stats := stats
+		result.Tables[name] = &stats
+	}
+	return stream.SendMsg(result)
+}
+
 func (s *server) HandleRemoteQueries(r *rpc.RegisterQueryHandler, stream grpc.ServerStream) error {
+	if s.acl != nil {
+		// Only admins may answer queries on behalf of the leader
+		_, authorizeErr := s.authorize(stream, acl.Admin, acl.AllTables)
+		if authorizeErr != nil {
+			return authorizeErr
+		}
+	}
+	peerErr := s.authenticatePeer(stream)
+	if peerErr != nil {
+		return peerErr
+	}
+
 	initialResultCh := make(chan *rpc.RemoteQueryResult)
 	initialErrCh := make(chan error, 1)
 	finalErrCh := make(chan error, 1)
@@ -169,13 +744,15 @@ func (s *server) HandleRemoteQueries(r *rpc.RegisterQueryHandler, stream grpc.Se
 		}
 	}
 
-	s.db.RegisterQueryHandler(r.Partition, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
+	s.db.RegisterQueryHandler(r.Partition, r.FollowerName, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
 		q := &rpc.Query{
 			SQLString:       sqlString,
 			IsSubQuery:      isSubQuery,
 			SubQueryResults: subQueryResults,
 			Unflat:          unflat,
 			IncludeMemStore: common.ShouldIncludeMemStore(ctx),
+			TraceContext:    common.InjectTraceContext(ctx),
+			RequestID:       common.RequestIDFor(ctx),
 		}
 		q.Deadline, q.HasDeadline = ctx.Deadline()
 		sendErr := stream.SendMsg(q)
@@ -190,6 +767,21 @@ func (s *server) HandleRemoteQueries(r *rpc.RegisterQueryHandler, stream grpc.Se
 			return nil, common.MarkRetriable(err)
 		}
 
+		stopWatching := make(chan struct{})
+		defer close(stopWatching)
+		go func() {
+			select {
+			case <-ctx.Done():
+				if ctx.Err() == context.Canceled {
+					// Tell the follower to stop processing the query
+					log.Debugf("Cancelling query on partition %d", r.Partition)
+					stream.SendMsg(&rpc.Query{Cancel: true})
+				}
+			case <-stopWatching:
+				// Query finished
+			}
+		}()
+
 		var finalErr error
 
 		first := true
@@ -253,21 +845,103 @@ func (s *server) HandleRemoteQueries(r *rpc.RegisterQueryHandler, stream grpc.Se
 	return err
 }
 
-func (s *server) authorize(stream grpc.ServerStream) error {
-	if s.password == "" {
+// requestContext returns the context of the stream with the ID of the request,
+// which the client can supply in the stream's metadata, and reports the ID to
+// the client in the stream's header.
+func requestContext(stream grpc.ServerStream) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		if ids := md.Get(common.RequestIDHeader); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	id = common.SanitizeRequestID(id)
+	stream.SetHeader(metadata.Pairs(common.RequestIDHeader, id))
+	return common.WithRequestID(stream.Context(), id)
+}
+
+// requestError logs the given error, if any, and adds the request ID to it so
+// that the client can match it to the log.
+func requestError(ctx context.Context, action string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	err = common.ErrorWithRequestID(ctx, err)
+	log.Errorf("Error %v: %v", action, err)
+	return err
+}
+
+// authenticate returns the principal identified by the passwords in the
+// stream's metadata. Clients that present the shared password authenticate as
+// acl.Root. If neither a password nor an ACL is configured, everyone is allowed
+// and the principal is nil.
+func (s *server) authenticate(stream grpc.ServerStream) (*acl.Principal, error) {
+	if s.password == "" && s.acl == nil {
 		log.Debug("No password specified, allowing access to world")
-		return nil
+		return nil, nil
 	}
 	md, ok := metadata.FromIncomingContext(stream.Context())
 	if !ok {
-		return log.Error("No metadata provided, unable to authenticate")
+		return nil, log.Error("No metadata provided, unable to authenticate")
 	}
 	passwords := md[rpc.PasswordKey]
 	for _, password := range passwords {
-		if password == s.password {
+		if s.password != "" && subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) == 1 {
 			// authorized
-			return nil
+			return acl.Root, nil
+		}
+		if s.acl != nil {
+			principal, err := s.acl.Authenticate(password)
+			if err == nil {
+				return principal, nil
+			}
 		}
 	}
-	return log.Error("None of the provided passwords matched, not authorized!")
+	return nil, log.Error("None of the provided passwords matched, not authorized!")
+}
+
+// authorize authenticates the stream's principal and checks that it has the
+// given role on all of the given tables.
+func (s *server) authorize(stream grpc.ServerStream, role acl.Role, tables ...string) (*acl.Principal, error) {
+	principal, err := s.authenticate(stream)
+	if err != nil {
+		return nil, err
+	}
+	err = principal.Check(role, tables...)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return principal, nil
+}
+
+// authenticatePeer checks that the stream comes from a cluster peer with a
+// client certificate issued by one of the cluster CAs. Without cluster CAs,
+// peers are identified by their passwords alone.
+func (s *server) authenticatePeer(stream grpc.ServerStream) error {
+	if s.clusterCAs == nil {
+		return nil
+	}
+	p, ok := peer.FromContext(stream.Context())
+	if !ok {
+		return log.Error("Unable to determine peer, not authorized as cluster peer")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return log.Errorf("Peer %v not using TLS, not authorized as cluster peer", p.Addr)
+	}
+	name, err := clustertls.Verify(s.clusterCAs, tlsInfo.State.PeerCertificates)
+	if err != nil {
+		return log.Errorf("Peer %v not authorized as cluster peer: %v", p.Addr, err)
+	}
+	log.Debugf("Peer %v authenticated as cluster peer %v", p.Addr, name)
+	return nil
+}
+
+// authorizeInserts authenticates the principal of an insert stream. Without an
+// ACL, anyone can insert, so inserts aren't authenticated at all.
+func (s *server) authorizeInserts(stream grpc.ServerStream) (*acl.Principal, error) {
+	if s.acl == nil {
+		return nil, nil
+	}
+	return s.authenticate(stream)
 }
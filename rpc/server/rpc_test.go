@@ -1,19 +1,34 @@
 package rpcserver
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/getlantern/bytemap"
-	"github.com/getlantern/wal"
+	"github.com/getlantern/tlsdefaults"
+	"github.com/getlantern/zenodb/acl"
+	"github.com/getlantern/zenodb/clustertls"
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/metrics"
 	"github.com/getlantern/zenodb/planner"
 	"github.com/getlantern/zenodb/rpc"
+	"github.com/getlantern/zenodb/sql"
+	"github.com/getlantern/zenodb/wal"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestInsert(t *testing.T) {
@@ -79,8 +94,848 @@ func TestInsert(t *testing.T) {
 	}
 }
 
+func TestInsertBatches(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go func() {
+		Serve(db, l, &Opts{})
+	}()
+	time.Sleep(1 * time.Second)
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+		InsertBatchSize:          3,
+		InsertFlushInterval:      50 * time.Millisecond,
+		MaxInsertBatchesInFlight: 1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	inserter, err := client.NewBatchInserter(context.Background(), "thestream")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for i := 0; i < 10; i++ {
+		dims := map[string]interface{}{"dim": "dimval"}
+		if i == 4 {
+			dims = nil
+		}
+		err = inserter.Insert(time.Time{}, dims, func(cb func(key string, value interface{})) {
+			cb("val", float64(i))
+		})
+		if !assert.NoError(t, err, "Error on iteration %d", i) {
+			return
+		}
+	}
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, 9, db.NumInserts(), "partial batch should have been flushed on interval")
+	assert.EqualValues(t, 9, inserter.DurableOffset().Position(), "all batches should have been acknowledged")
+
+	assert.NoError(t, inserter.Insert(time.Time{}, map[string]interface{}{"dim": "dimval"}, func(cb func(key string, value interface{})) {
+		cb("val", float64(10))
+	}))
+	report, err := inserter.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, 11, report.Received)
+	assert.Equal(t, 10, report.Succeeded)
+	assert.Equal(t, 10, db.NumInserts())
+	assert.Equal(t, map[int]string{4: "Need at least one dim"}, report.Errors)
+	assert.EqualValues(t, 10, report.DurableOffset.Position())
+}
+
+func TestClusterStatus(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	go func() {
+		Serve(&mockDB{}, l, &Opts{
+			Password: "password",
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	dial := func(password string) rpc.Client {
+		client, dialErr := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+			Password: password,
+			Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+				return net.DialTimeout("tcp", addr, timeout)
+			},
+		})
+		if !assert.NoError(t, dialErr) {
+			t.FailNow()
+		}
+		return client
+	}
+
+	client := dial("password")
+	defer client.Close()
+	status, err := client.ClusterStatus(context.Background())
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, status.NumPartitions)
+	}
+
+	tableStats, err := client.TableStats(context.Background())
+	if assert.NoError(t, err) && assert.Len(t, tableStats, 1) {
+		stats := tableStats["table_a"]
+		if assert.NotNil(t, stats) {
+			assert.Equal(t, "table_a", stats.Table)
+			assert.EqualValues(t, 5, stats.InsertedPoints)
+			assert.EqualValues(t, 2, stats.MemStoreRows)
+			assert.EqualValues(t, 1024, stats.FileStoreBytes)
+			assert.Equal(t, time.Second, stats.LastFlushDuration)
+		}
+	}
+
+	badClient := dial("wrong")
+	defer badClient.Close()
+	_, err = badClient.ClusterStatus(context.Background())
+	assert.Error(t, err, "Should require password")
+	_, err = badClient.TableStats(context.Background())
+	assert.Error(t, err, "Should require password")
+}
+
+func TestAckFollow(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go func() {
+		Serve(db, l, &Opts{
+			Password:       "password",
+			FollowerTokens: map[string]string{"f1": "token"},
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+		Password: "password",
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	offset := wal.NewOffsetForTS(time.Now())
+	ack := &common.FollowAck{
+		Stream:        "thestream",
+		FollowerName:  "f1",
+		FollowerToken: "wrong",
+		Offsets:       map[string]wal.Offset{"thetable": offset},
+	}
+	assert.Error(t, client.AckFollow(context.Background(), ack), "Should require follower token")
+	assert.Nil(t, db.lastAck)
+
+	ack.FollowerToken = "token"
+	if assert.NoError(t, client.AckFollow(context.Background(), ack)) && assert.NotNil(t, db.lastAck) {
+		assert.Equal(t, offset, db.lastAck.Offsets["thetable"])
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	backup := make([]byte, 3*backupChunkSize/2)
+	rand.Read(backup)
+	db := &mockDB{backup: backup}
+	go func() {
+		Serve(db, l, &Opts{
+			Password: "password",
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+		Password: "password",
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	var buf bytes.Buffer
+	if assert.NoError(t, client.Backup(context.Background(), &buf)) {
+		assert.Equal(t, backup, buf.Bytes())
+	}
+	if assert.NoError(t, client.Restore(context.Background(), &buf)) {
+		assert.Equal(t, backup, db.restored)
+	}
+	if assert.NoError(t, client.AttachBackup(context.Background(), "snap", bytes.NewReader(backup))) {
+		assert.Equal(t, backup, db.attached["snap"])
+	}
+	assert.NoError(t, client.DetachBackup(context.Background(), "snap"))
+	assert.Empty(t, db.attached)
+	assert.Error(t, client.DetachBackup(context.Background(), "snap"))
+}
+
+func TestPartitionMap(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	offset := wal.NewOffsetForTS(time.Now())
+	db := &mockDB{partitionMap: &common.PartitionMap{
+		LeaderID:      "leader1",
+		NumPartitions: 2,
+		Followers: []*common.FollowerAssignment{
+			{FollowerName: "f1", Stream: "thestream", PartitionNumber: 1, Offsets: map[string]wal.Offset{"thetable": offset}, Connected: true},
+		},
+		RevokedFollowers: []string{"f2"},
+	}}
+	a, err := acl.New(acl.Config{
+		"reader": {Password: "readerpass", Grants: map[string]acl.Role{"*": acl.Reader}},
+		"admin":  {Password: "adminpass", Grants: map[string]acl.Role{"*": acl.Admin}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go func() {
+		Serve(db, l, &Opts{
+			ACL: a,
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	dial := func(password string) rpc.Client {
+		client, dialErr := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+			Password: password,
+			Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+				return net.DialTimeout("tcp", addr, timeout)
+			},
+		})
+		if !assert.NoError(t, dialErr) {
+			t.FailNow()
+		}
+		return client
+	}
+
+	reader := dial("readerpass")
+	defer reader.Close()
+	_, err = reader.ExportPartitionMap(context.Background())
+	assert.Error(t, err, "Exporting should require admin")
+	assert.Error(t, reader.ImportPartitionMap(context.Background(), db.partitionMap), "Importing should require admin")
+
+	admin := dial("adminpass")
+	defer admin.Close()
+	m, err := admin.ExportPartitionMap(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "leader1", m.LeaderID)
+	assert.Equal(t, 2, m.NumPartitions)
+	assert.Equal(t, []string{"f2"}, m.RevokedFollowers)
+	if assert.Len(t, m.Followers, 1) {
+		assert.Equal(t, "f1", m.Followers[0].FollowerName)
+		assert.True(t, m.Followers[0].Connected)
+		assert.Equal(t, offset, m.Followers[0].Offsets["thetable"])
+	}
+
+	m.LeaderID = "leader2"
+	if assert.NoError(t, admin.ImportPartitionMap(context.Background(), m)) {
+		assert.Equal(t, "leader2", db.partitionMap.LeaderID)
+	}
+	m.NumPartitions = 3
+	assert.Error(t, admin.ImportPartitionMap(context.Background(), m))
+}
+
+func TestCancelQuery(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go func() {
+		Serve(db, l, &Opts{
+			Password: "password",
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+		Password: "password",
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	if assert.NoError(t, client.CancelQuery(context.Background(), "running")) {
+		assert.Equal(t, "running", db.cancelled)
+	}
+	assert.Error(t, client.CancelQuery(context.Background(), "unknown"), "Cancelling unknown query should fail")
+}
+
+func TestDelete(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go func() {
+		Serve(db, l, &Opts{
+			Password: "password",
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+		Password: "password",
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	asOf := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if assert.NoError(t, client.Delete(context.Background(), "table_a", "client = 'abc'", asOf, time.Time{})) && assert.NotNil(t, db.deleted) {
+		assert.Equal(t, "table_a", db.deleted.Table)
+		assert.Equal(t, "client = 'abc'", db.deleted.Where)
+		assert.True(t, asOf.Equal(db.deleted.AsOf))
+		assert.True(t, db.deleted.Until.IsZero())
+	}
+	assert.Error(t, client.Delete(context.Background(), "table_b", "client = 'abc'", time.Time{}, time.Time{}), "Deleting from unknown table should fail")
+}
+
+func TestPromote(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go func() {
+		Serve(db, l, &Opts{
+			Password: "password",
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+		Password: "password",
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	assert.NoError(t, client.Promote(context.Background()))
+	assert.True(t, db.promoted)
+	assert.Error(t, client.Promote(context.Background()), "Promoting twice should fail")
+}
+
+func TestPreparedQuery(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go func() {
+		Serve(db, l, &Opts{
+			Password: "password",
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+		Password: "password",
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	prepared, err := client.PrepareQuery(context.Background(), "SELECT * FROM t WHERE a = ? AND b = ?")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "prepared", prepared.ID)
+	assert.Equal(t, 2, prepared.NumParams)
+
+	_, iterate, err := client.QueryPrepared(context.Background(), prepared.ID, []interface{}{"it's", 5}, false)
+	if assert.NoError(t, err) {
+		_, err = iterate(func(row *core.FlatRow) (bool, error) {
+			return true, nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "SELECT * FROM t WHERE a = 'it''s' AND b = 5", db.lastQuery)
+	}
+
+	_, _, err = client.QueryPrepared(context.Background(), prepared.ID, []interface{}{"a"}, false)
+	assert.Error(t, err, "Querying with too few params should fail")
+	_, _, err = client.QueryPrepared(context.Background(), "unknown", nil, false)
+	assert.Error(t, err, "Querying unknown prepared query should fail")
+}
+
+func TestFollowBatching(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	for i := 0; i < 100; i++ {
+		db.followEntries = append(db.followEntries, &rpc.Point{
+			Data:   bytes.Repeat([]byte{byte(i)}, 100),
+			Offset: wal.NewOffsetForTS(time.Unix(int64(i), 0)),
+		})
+	}
+	go func() {
+		Serve(db, l, &Opts{
+			Password: "password",
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+		Password: "password",
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	follow := func(f *common.Follow) {
+		next, err := client.Follow(context.Background(), f)
+		if !assert.NoError(t, err) {
+			return
+		}
+		for i, expected := range db.followEntries {
+			data, offset, err := next()
+			if !assert.NoError(t, err, "entry %d", i) {
+				return
+			}
+			assert.Equal(t, expected.Data, data)
+			assert.Equal(t, expected.Offset, offset)
+		}
+		_, _, err = next()
+		assert.Equal(t, io.EOF, err)
+	}
+
+	follow(&common.Follow{Stream: "stream"})
+	follow(&common.Follow{Stream: "stream", BatchSize: 1000})
+	follow(&common.Follow{Stream: "stream", BatchSize: 1000, BatchCompression: "zstd"})
+	follow(&common.Follow{Stream: "stream", BatchSize: 1000000, BatchInterval: time.Millisecond, BatchCompression: "none"})
+	follow(&common.Follow{Stream: "stream", Credits: 10})
+	follow(&common.Follow{Stream: "stream", Credits: 1})
+	follow(&common.Follow{Stream: "stream", Credits: 7, BatchSize: 1000, BatchInterval: 10 * time.Millisecond})
+
+	next, err := client.Follow(context.Background(), &common.Follow{Stream: "stream", BatchSize: 1000, BatchCompression: "unknown"})
+	if assert.NoError(t, err) {
+		_, _, err = next()
+		assert.Error(t, err, "unknown compression should fail")
+	}
+}
+
+func TestFollowBatcher(t *testing.T) {
+	var sent []*rpc.Point
+	var mx sync.Mutex
+	b := newFollowBatcher(func(point *rpc.Point) error {
+		mx.Lock()
+		sent = append(sent, point)
+		mx.Unlock()
+		return nil
+	}, 1000, time.Hour, "snappy")
+	var entries []*testFollowEntry
+	for i := 0; i < 25; i++ {
+		entry := newTestFollowEntry(make([]byte, 100), wal.NewOffsetForTS(time.Unix(int64(i), 0)))
+		entries = append(entries, entry)
+		assert.NoError(t, b.add(entry))
+		entry.Release()
+	}
+	mx.Lock()
+	assert.Len(t, sent, 2, "full batches should have been sent")
+	mx.Unlock()
+	for i, entry := range entries {
+		assert.Equal(t, i >= 20, entry.refs() > 0, "only entries of unsent batch should be retained, entry %d", i)
+	}
+	assert.NoError(t, b.close())
+	if assert.Len(t, sent, 3, "closing should have sent remaining entries") {
+		entries, err := rpc.DecodeFollowBatch(sent[2])
+		if assert.NoError(t, err) {
+			assert.Len(t, entries, 5)
+		}
+		assert.Equal(t, wal.NewOffsetForTS(time.Unix(24, 0)), sent[2].Offset)
+	}
+	for i, entry := range entries {
+		assert.EqualValues(t, 0, entry.refs(), "entry %d should have been released", i)
+	}
+
+	sendErr := errors.New("send failed")
+	b = newFollowBatcher(func(point *rpc.Point) error {
+		return sendErr
+	}, 100, time.Millisecond, "none")
+	first := newTestFollowEntry(make([]byte, 10), nil)
+	assert.NoError(t, b.add(first))
+	first.Release()
+	time.Sleep(50 * time.Millisecond)
+	second := newTestFollowEntry(make([]byte, 10), nil)
+	assert.Equal(t, sendErr, b.add(second), "error sending periodic flush should stop following")
+	second.Release()
+	assert.Equal(t, sendErr, b.close())
+	assert.EqualValues(t, 0, first.refs(), "entry of failed batch should have been released")
+	assert.EqualValues(t, 0, second.refs(), "entry added after failure shouldn't have been retained")
+}
+
+func TestFollowBatcherAllocs(t *testing.T) {
+	b := newFollowBatcher(func(point *rpc.Point) error {
+		return nil
+	}, maxFollowBatchSize, time.Hour, "none")
+	defer b.close()
+	var entries []*testFollowEntry
+	for i := 0; i < 100; i++ {
+		entries = append(entries, newTestFollowEntry(make([]byte, 100), wal.NewOffsetForTS(time.Unix(int64(i), 0))))
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		for _, entry := range entries {
+			b.add(entry)
+		}
+		b.mx.Lock()
+		b.flush()
+		b.mx.Unlock()
+	})
+	assert.True(t, allocs <= 2, "adding entries to a batch shouldn't allocate, only encoding the batch should (%v allocs per batch)", allocs)
+}
+
+// testFollowEntry is a common.FollowEntry that clears its data once it's been
+// released as often as retained, like the leader recycles its entries.
+type testFollowEntry struct {
+	data   []byte
+	offset wal.Offset
+	count  int32
+}
+
+func newTestFollowEntry(data []byte, offset wal.Offset) *testFollowEntry {
+	return &testFollowEntry{data: data, offset: offset, count: 1}
+}
+
+func (e *testFollowEntry) Data() []byte       { return e.data }
+func (e *testFollowEntry) Offset() wal.Offset { return e.offset }
+func (e *testFollowEntry) Retain()            { atomic.AddInt32(&e.count, 1) }
+
+func (e *testFollowEntry) Release() {
+	if atomic.AddInt32(&e.count, -1) == 0 {
+		for i := range e.data {
+			e.data[i] = 0
+		}
+	}
+}
+
+func (e *testFollowEntry) refs() int32 {
+	return atomic.LoadInt32(&e.count)
+}
+
+func TestFollowCredits(t *testing.T) {
+	c := newFollowCredits(2)
+	assert.True(t, c.take())
+	assert.True(t, c.take())
+
+	took := make(chan bool)
+	go func() {
+		took <- c.take()
+	}()
+	select {
+	case <-took:
+		assert.Fail(t, "shouldn't be able to take credit before it's granted")
+	case <-time.After(50 * time.Millisecond):
+		// okay
+	}
+	c.grant(1)
+	assert.True(t, <-took, "granting should have unblocked take")
+
+	go func() {
+		took <- c.take()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.close()
+	assert.False(t, <-took, "closing should have unblocked take")
+	c.grant(1)
+	assert.False(t, c.take(), "closed credits shouldn't be usable")
+}
+
+func TestEncodeFollowBatch(t *testing.T) {
+	entries := []*rpc.Point{
+		{Data: []byte("a"), Offset: wal.NewOffsetForTS(time.Unix(1, 0))},
+		{Data: []byte{}, Offset: wal.NewOffsetForTS(time.Unix(2, 0))},
+		{Data: []byte("ccc"), Offset: wal.NewOffsetForTS(time.Unix(3, 0))},
+	}
+	point, err := rpc.EncodeFollowBatch("snappy", entries)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, point.Batched)
+	assert.Equal(t, entries[2].Offset, point.Offset)
+	decoded, err := rpc.DecodeFollowBatch(point)
+	if assert.NoError(t, err) && assert.Len(t, decoded, 3) {
+		for i, entry := range entries {
+			assert.Equal(t, string(entry.Data), string(decoded[i].Data))
+			assert.Equal(t, entry.Offset, decoded[i].Offset)
+		}
+	}
+
+	point, err = rpc.EncodeFollowBatch("none", entries)
+	if assert.NoError(t, err) {
+		point.Data = point.Data[:len(point.Data)-1]
+		_, err = rpc.DecodeFollowBatch(point)
+		assert.Error(t, err, "truncated batch should fail")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go func() {
+		Serve(db, l, &Opts{
+			Password: "password",
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+		Password: "password",
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	ctx := common.WithRequestID(context.Background(), "my-request")
+	_, _, err = client.QueryPrepared(ctx, "unknown", nil, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "(request my-request)", "error should include client supplied request ID")
+	}
+
+	ctx = common.WithRequestID(context.Background(), "not a valid id")
+	_, _, err = client.QueryPrepared(ctx, "unknown", nil, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "(request ", "error should include generated request ID")
+		assert.NotContains(t, err.Error(), "not a valid id")
+	}
+}
+
+func TestACL(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	a, err := acl.New(acl.Config{
+		"reader": {Password: "readerpass", Grants: map[string]acl.Role{"table_a": acl.Reader}},
+		"writer": {Password: "writerpass", Grants: map[string]acl.Role{"thestream": acl.Writer}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	db := &mockDB{}
+	go func() {
+		Serve(db, l, &Opts{
+			Password: "password",
+			ACL:      a,
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	dial := func(password string) rpc.Client {
+		client, dialErr := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+			Password: password,
+			Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+				return net.DialTimeout("tcp", addr, timeout)
+			},
+		})
+		if !assert.NoError(t, dialErr) {
+			t.FailNow()
+		}
+		return client
+	}
+
+	query := func(client rpc.Client, sqlString string) error {
+		_, iterate, queryErr := client.Query(context.Background(), sqlString, false)
+		if queryErr != nil {
+			return queryErr
+		}
+		_, queryErr = iterate(func(row *core.FlatRow) (bool, error) {
+			return true, nil
+		})
+		return queryErr
+	}
+
+	insert := func(client rpc.Client) error {
+		inserter, insertErr := client.NewInserter(context.Background(), "thestream")
+		if insertErr != nil {
+			return insertErr
+		}
+		insertErr = inserter.Insert(time.Time{}, map[string]interface{}{"dim": "dimval"}, func(cb func(key string, value interface{})) {
+			cb("val", float64(1))
+		})
+		if insertErr != nil {
+			return insertErr
+		}
+		_, insertErr = inserter.Close()
+		return insertErr
+	}
+
+	reader := dial("readerpass")
+	defer reader.Close()
+	assert.NoError(t, query(reader, "SELECT * FROM table_a"))
+	assert.Error(t, query(reader, "SELECT * FROM table_b"), "reader shouldn't be able to query table without grant")
+	assert.Error(t, query(reader, "SELECT * FROM table_a WHERE x IN (SELECT x FROM table_b)"), "reader shouldn't be able to subquery table without grant")
+	assert.Error(t, insert(reader), "reader shouldn't be able to insert")
+	assert.Error(t, reader.CancelQuery(context.Background(), "running"), "reader shouldn't be able to cancel queries")
+	_, err = reader.ClusterStatus(context.Background())
+	assert.NoError(t, err, "any principal should be able to get cluster status")
+
+	writer := dial("writerpass")
+	defer writer.Close()
+	assert.NoError(t, insert(writer))
+	assert.Equal(t, 1, db.NumInserts())
+	assert.Error(t, query(writer, "SELECT * FROM table_a"), "writer shouldn't be able to query table without grant")
+
+	unknown := dial("unknown")
+	defer unknown.Close()
+	assert.Error(t, insert(unknown), "unauthenticated client shouldn't be able to insert")
+
+	root := dial("password")
+	defer root.Close()
+	assert.NoError(t, query(root, "SELECT * FROM table_b"))
+	assert.NoError(t, root.CancelQuery(context.Background(), "running"))
+}
+
+func TestRemoteQueryTracing(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{queryHandlers: make(chan planner.QueryClusterFN, 1)}
+	go func() {
+		Serve(db, l, &Opts{
+			Password: "password",
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+		Password: "password",
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	followerSpan := make(chan trace.SpanContext, 1)
+	go client.ProcessRemoteQuery(context.Background(), 0, "follower", func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
+		followerSpan <- trace.SpanContextFromContext(ctx)
+		return &common.QueryStats{}, onFields(core.Fields{})
+	}, 5*time.Second)
+
+	var handler planner.QueryClusterFN
+	select {
+	case handler = <-db.queryHandlers:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "follower didn't register query handler")
+		return
+	}
+
+	leaderSpan := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	})
+	_, err = handler(trace.ContextWithSpanContext(context.Background(), leaderSpan), "SELECT * FROM table", false, nil, false, func(fields core.Fields) error {
+		return nil
+	}, nil, func(row *core.FlatRow) (bool, error) {
+		return true, nil
+	})
+	assert.NoError(t, err)
+
+	select {
+	case sc := <-followerSpan:
+		assert.True(t, sc.IsRemote(), "follower should continue leader's trace")
+		assert.Equal(t, leaderSpan.TraceID(), sc.TraceID())
+		assert.Equal(t, leaderSpan.SpanID(), sc.SpanID())
+		assert.True(t, sc.IsSampled())
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "follower didn't process query")
+	}
+}
+
 type mockDB struct {
-	numInserts int64
+	numInserts    int64
+	lastAck       *common.FollowAck
+	backup        []byte
+	restored      []byte
+	attached      map[string][]byte
+	cancelled     string
+	deleted       *rpc.DeleteRows
+	promoted      bool
+	prepared      *sql.Prepared
+	lastQuery     string
+	queryHandlers chan planner.QueryClusterFN
+	partitionMap  *common.PartitionMap
+	// followEntries are sent to followers
+	followEntries []*rpc.Point
 }
 
 func (db *mockDB) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
@@ -88,17 +943,267 @@ func (db *mockDB) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, v
 	return nil
 }
 
+func (db *mockDB) DurableOffset(stream string) (wal.Offset, error) {
+	offset := make(wal.Offset, wal.OffsetSize)
+	offset[wal.OffsetSize-1] = byte(atomic.LoadInt64(&db.numInserts))
+	return offset, nil
+}
+
 func (db *mockDB) NumInserts() int {
 	return int(atomic.LoadInt64(&db.numInserts))
 }
 
 func (db *mockDB) Query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (core.FlatRowSource, error) {
-	return nil, nil
+	db.lastQuery = sqlString
+	return &emptySource{}, nil
+}
+
+func (db *mockDB) PrepareQuery(sqlString string) (*common.PreparedQuery, error) {
+	prepared, err := sql.Prepare(sqlString)
+	if err != nil {
+		return nil, err
+	}
+	db.prepared = prepared
+	return &common.PreparedQuery{ID: "prepared", SQL: sqlString, NumParams: prepared.NumParams()}, nil
+}
+
+func (db *mockDB) BindPrepared(id string, params ...interface{}) (string, error) {
+	if id != "prepared" || db.prepared == nil {
+		return "", errors.New("unknown prepared query")
+	}
+	return db.prepared.Bind(params...)
+}
+
+func (db *mockDB) FollowEntries(f *common.Follow, cb func(common.FollowEntry) error) error {
+	for _, point := range db.followEntries {
+		// Give each delivery its own copy, since it's cleared once released
+		entry := newTestFollowEntry(append([]byte(nil), point.Data...), point.Offset)
+		err := cb(entry)
+		entry.Release()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *mockDB) RegisterQueryHandler(partition int, replica string, query planner.QueryClusterFN) {
+	if db.queryHandlers != nil {
+		db.queryHandlers <- query
+	}
+}
+
+func (db *mockDB) ClusterStatus() *metrics.ClusterStatus {
+	return &metrics.ClusterStatus{NumPartitions: 1}
+}
+
+func (db *mockDB) AllTableStats() map[string]common.TableStats {
+	return map[string]common.TableStats{
+		"table_a": {Table: "table_a", InsertedPoints: 5, MemStoreRows: 2, FileStoreBytes: 1024, LastFlushDuration: time.Second},
+	}
+}
+
+func (db *mockDB) AckFollow(ack *common.FollowAck) error {
+	db.lastAck = ack
+	return nil
+}
+
+func (db *mockDB) Snapshot(req *common.SnapshotRequest, cb func(version int, data []byte) error) error {
+	return nil
+}
+
+func (db *mockDB) Backup(ctx context.Context, w io.Writer) error {
+	_, err := w.Write(db.backup)
+	return err
+}
+
+func (db *mockDB) Restore(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	db.restored = b
+	return err
+}
+
+func (db *mockDB) AttachBackup(name string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if db.attached == nil {
+		db.attached = make(map[string][]byte)
+	}
+	db.attached[name] = b
+	return err
+}
+
+func (db *mockDB) DetachBackup(name string) error {
+	if _, found := db.attached[name]; !found {
+		return errors.New("not attached")
+	}
+	delete(db.attached, name)
+	return nil
+}
+
+func (db *mockDB) Delete(table string, where string, asOf time.Time, until time.Time) error {
+	if table != "table_a" {
+		return errors.New("unknown table")
+	}
+	db.deleted = &rpc.DeleteRows{Table: table, Where: where, AsOf: asOf, Until: until}
+	return nil
+}
+
+func (db *mockDB) Promote() error {
+	if db.promoted {
+		return errors.New("not on standby")
+	}
+	db.promoted = true
+	return nil
+}
+
+func (db *mockDB) ExportPartitionMap() *common.PartitionMap {
+	return db.partitionMap
+}
+
+func (db *mockDB) ImportPartitionMap(m *common.PartitionMap) error {
+	if m.NumPartitions != db.partitionMap.NumPartitions {
+		return errors.New("wrong number of partitions")
+	}
+	db.partitionMap = m
+	return nil
+}
+
+func (db *mockDB) Replicate(r *common.Replicate, cb func([]byte, wal.Offset) error) error {
+	return nil
 }
 
-func (db *mockDB) Follow(f *common.Follow, cb func([]byte, wal.Offset) error) {
+func (db *mockDB) CancelQuery(queryID string) error {
+	if queryID != "running" {
+		return errors.New("unknown query")
+	}
+	db.cancelled = queryID
+	return nil
+}
+
+// emptySource is a core.FlatRowSource without any rows
+type emptySource struct{}
+
+func (s *emptySource) GetGroupBy() []core.GroupBy {
+	return nil
+}
+
+func (s *emptySource) GetResolution() time.Duration {
+	return 0
+}
+
+func (s *emptySource) GetAsOf() time.Time {
+	return time.Time{}
+}
+
+func (s *emptySource) GetUntil() time.Time {
+	return time.Time{}
+}
+
+func (s *emptySource) String() string {
+	return "empty"
+}
+
+func (s *emptySource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	return &common.QueryStats{}, onFields(core.Fields{})
 }
 
-func (db *mockDB) RegisterQueryHandler(partition int, query planner.QueryClusterFN) {
+func TestClusterMTLS(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rpctest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ca, err := clustertls.LoadOrCreateCA(filepath.Join(tmpDir, "ca.pem"), filepath.Join(tmpDir, "cakey.pem"), time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	pool, err := clustertls.LoadCertPool(filepath.Join(tmpDir, "ca.pem"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	certPEM, keyPEM, err := ca.Issue("follower1", time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if !assert.NoError(t, err) {
+		return
+	}
+	otherCA, err := clustertls.LoadOrCreateCA(filepath.Join(tmpDir, "otherca.pem"), filepath.Join(tmpDir, "othercakey.pem"), time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	otherCertPEM, otherKeyPEM, err := otherCA.Issue("attacker", time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	otherCert, err := tls.X509KeyPair(otherCertPEM, otherKeyPEM)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	tlsConfig, err := tlsdefaults.BuildListenerConfig(l.Addr().String(), filepath.Join(tmpDir, "pk.pem"), filepath.Join(tmpDir, "cert.pem"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	tlsConfig.ClientCAs = pool
+
+	db := &mockDB{}
+	go func() {
+		Serve(db, tls.NewListener(l, tlsConfig), &Opts{
+			Password:   "password",
+			ClusterCAs: pool,
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	dial := func(certs ...tls.Certificate) rpc.Client {
+		client, dialErr := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+			Password: "password",
+			Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+				conn, connErr := net.DialTimeout("tcp", addr, timeout)
+				if connErr != nil {
+					return nil, connErr
+				}
+				tlsConn := tls.Client(conn, &tls.Config{
+					InsecureSkipVerify: true,
+					Certificates:       certs,
+				})
+				return tlsConn, tlsConn.Handshake()
+			},
+		})
+		if !assert.NoError(t, dialErr) {
+			t.FailNow()
+		}
+		return client
+	}
+	ack := &common.FollowAck{
+		Stream:       "thestream",
+		FollowerName: "f1",
+		Offsets:      map[string]wal.Offset{"thetable": wal.NewOffsetForTS(time.Now())},
+	}
+
+	client := dial()
+	defer client.Close()
+	_, err = client.ClusterStatus(context.Background())
+	assert.NoError(t, err, "non-cluster operations shouldn't require client certificate")
+	assert.Error(t, client.AckFollow(context.Background(), ack), "cluster operations should require client certificate")
+	assert.Nil(t, db.lastAck)
+
+	untrustedClient := dial(otherCert)
+	defer untrustedClient.Close()
+	assert.Error(t, untrustedClient.AckFollow(context.Background(), ack), "cluster operations should require certificate from cluster CA")
+	assert.Nil(t, db.lastAck)
 
+	peerClient := dial(clientCert)
+	defer peerClient.Close()
+	assert.NoError(t, peerClient.AckFollow(context.Background(), ack))
+	assert.NotNil(t, db.lastAck)
 }
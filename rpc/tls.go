@@ -0,0 +1,56 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSStateCredentials returns gRPC TransportCredentials for servers whose
+// listener already terminates TLS beneath snappy compression (see
+// SnappyListener). They don't secure connections themselves, but they complete
+// the TLS handshake and expose the resulting connection state to handlers as a
+// credentials.TLSInfo in the peer's AuthInfo, so that handlers can check client
+// certificates. Connections that aren't using TLS have no AuthInfo.
+func TLSStateCredentials() credentials.TransportCredentials {
+	return &tlsStateCredentials{}
+}
+
+type tlsStateCredentials struct{}
+
+func (c *tlsStateCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, nil, nil
+}
+
+func (c *tlsStateCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	underlying := conn
+	if sc, ok := underlying.(*snappyConn); ok {
+		underlying = sc.Conn
+	}
+	tlsConn, ok := underlying.(*tls.Conn)
+	if !ok {
+		return conn, nil, nil
+	}
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, credentials.TLSInfo{
+		State:          tlsConn.ConnectionState(),
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+	}, nil
+}
+
+func (c *tlsStateCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "tls"}
+}
+
+func (c *tlsStateCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (c *tlsStateCredentials) OverrideServerName(serverNameOverride string) error {
+	return nil
+}
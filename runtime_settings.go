@@ -0,0 +1,257 @@
+package zenodb
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// SettingSourceRuntime marks settings that were changed at runtime with
+	// SetRuntimeSetting
+	SettingSourceRuntime = "runtime"
+
+	settingChangesLogFilename = "setting_changes.log"
+	settingChangesLogMaxBytes = 10 * 1024 * 1024
+
+	// maxSettingChanges is how many setting changes are kept in memory for
+	// SettingChanges
+	maxSettingChanges = 1000
+
+	maxIterationConcurrency = 1024
+)
+
+// SettingChange is an audit record of a setting that was changed at runtime.
+type SettingChange struct {
+	TS time.Time
+	// User identifies who changed the setting, like the name of an
+	// authenticated principal or the address of a client
+	User     string
+	Name     string
+	OldValue string
+	NewValue string
+}
+
+// runtimeSettings are the current values of the settings that can be changed
+// without restarting. They're immutable, changes store a modified copy.
+type runtimeSettings struct {
+	iterationConcurrency int
+	clusterQueryTimeout  time.Duration
+	followQueueDepth     int
+	walSyncInterval      time.Duration
+}
+
+type runtimeSetting struct {
+	get func(s *runtimeSettings) string
+	set func(s *runtimeSettings, value string) error
+}
+
+// settableAtRuntime are the settings that SetRuntimeSetting can change, keyed
+// by the name of the corresponding DBOpts field.
+var settableAtRuntime = map[string]*runtimeSetting{
+	"IterationConcurrency": {
+		get: func(s *runtimeSettings) string { return strconv.Itoa(s.iterationConcurrency) },
+		set: func(s *runtimeSettings, value string) error {
+			concurrency, err := strconv.Atoi(value)
+			if err != nil || concurrency < 1 || concurrency > maxIterationConcurrency {
+				return errors.New("IterationConcurrency must be an integer between 1 and %d", maxIterationConcurrency)
+			}
+			s.iterationConcurrency = concurrency
+			return nil
+		},
+	},
+	"ClusterQueryTimeout": {
+		get: func(s *runtimeSettings) string { return s.clusterQueryTimeout.String() },
+		set: func(s *runtimeSettings, value string) error {
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return errors.New("ClusterQueryTimeout must be a positive duration like 5m")
+			}
+			s.clusterQueryTimeout = timeout
+			return nil
+		},
+	},
+	"FollowQueueDepth": {
+		get: func(s *runtimeSettings) string { return strconv.Itoa(s.followQueueDepth) },
+		set: func(s *runtimeSettings, value string) error {
+			depth, err := strconv.Atoi(value)
+			if err != nil || depth < 1 {
+				return errors.New("FollowQueueDepth must be a positive integer")
+			}
+			s.followQueueDepth = depth
+			return nil
+		},
+	},
+	"WALSyncInterval": {
+		get: func(s *runtimeSettings) string { return s.walSyncInterval.String() },
+		set: func(s *runtimeSettings, value string) error {
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval < 0 {
+				return errors.New("WALSyncInterval must be a duration like 5s, or 0 to sync on every write")
+			}
+			s.walSyncInterval = interval
+			return nil
+		},
+	},
+}
+
+// RuntimeSettings lists the names of the settings that can be changed with
+// SetRuntimeSetting.
+func RuntimeSettings() []string {
+	names := make([]string, 0, len(settableAtRuntime))
+	for name := range settableAtRuntime {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (db *DB) initRuntimeSettings() error {
+	db.stopIterationWorker = make(chan bool)
+	if db.opts.ReadOnly {
+		return nil
+	}
+	changeLog, err := openJSONLog(filepath.Join(db.opts.Dir, settingChangesLogFilename), settingChangesLogMaxBytes)
+	if err != nil {
+		return err
+	}
+	db.settingChangeLog = changeLog
+	return nil
+}
+
+// SetRuntimeSetting changes one of the RuntimeSettings without restarting,
+// recording who changed it in the audit trail returned by SettingChanges and,
+// unless the database is read-only, in setting_changes.log in its directory.
+//
+// Changes aren't persisted, so on restart the database goes back to its
+// configured settings. A new WALSyncInterval applies immediately to all open
+// WALs.
+func (db *DB) SetRuntimeSetting(user string, name string, value string) error {
+	setting := settableAtRuntime[name]
+	if setting == nil {
+		return errors.New("%v can't be changed at runtime, only %v can", name, strings.Join(RuntimeSettings(), ", "))
+	}
+
+	db.settingChangesMx.Lock()
+	defer db.settingChangesMx.Unlock()
+	previous := db.runtimeSettings()
+	updated := *previous
+	err := setting.set(&updated, strings.TrimSpace(value))
+	if err != nil {
+		return err
+	}
+	db.runtime.Store(&updated)
+	if updated.iterationConcurrency != previous.iterationConcurrency {
+		db.resizeIterationWorkers(previous.iterationConcurrency, updated.iterationConcurrency)
+	}
+	if updated.walSyncInterval != previous.walSyncInterval {
+		db.setWALSyncInterval(updated.walSyncInterval)
+	}
+	change := &SettingChange{
+		TS:       db.clock.Now(),
+		User:     user,
+		Name:     name,
+		OldValue: setting.get(previous),
+		NewValue: setting.get(&updated),
+	}
+	log.Debugf("%v changed %v from %v to %v", change.User, change.Name, change.OldValue, change.NewValue)
+	db.settingChanges = append(db.settingChanges, change)
+	if len(db.settingChanges) > maxSettingChanges {
+		db.settingChanges = db.settingChanges[len(db.settingChanges)-maxSettingChanges:]
+	}
+	if db.settingChangeLog != nil {
+		if err := db.settingChangeLog.write(change); err != nil {
+			log.Errorf("Unable to record setting change: %v", err)
+		}
+	}
+	return nil
+}
+
+// SettingChanges returns the most recent changes made with SetRuntimeSetting,
+// oldest first.
+func (db *DB) SettingChanges() []*SettingChange {
+	db.settingChangesMx.Lock()
+	defer db.settingChangesMx.Unlock()
+	return append([]*SettingChange(nil), db.settingChanges...)
+}
+
+// runtimeSettingValue returns the current value of the named setting if it can
+// be changed at runtime.
+func (db *DB) runtimeSettingValue(name string) (string, bool) {
+	setting := settableAtRuntime[name]
+	if setting == nil {
+		return "", false
+	}
+	return setting.get(db.runtimeSettings()), true
+}
+
+// runtimeSettings returns the current runtime settings, which are the
+// configured ones until something is changed with SetRuntimeSetting.
+func (db *DB) runtimeSettings() *runtimeSettings {
+	if s, _ := db.runtime.Load().(*runtimeSettings); s != nil {
+		return s
+	}
+	s := &runtimeSettings{
+		iterationConcurrency: db.opts.IterationConcurrency,
+		clusterQueryTimeout:  db.opts.ClusterQueryTimeout,
+		followQueueDepth:     db.opts.FollowQueueDepth,
+		walSyncInterval:      db.opts.WALSyncInterval,
+	}
+	if s.followQueueDepth <= 0 {
+		s.followQueueDepth = DefaultFollowQueueDepth
+	}
+	return s
+}
+
+func (db *DB) iterationConcurrency() int {
+	return db.runtimeSettings().iterationConcurrency
+}
+
+func (db *DB) clusterQueryTimeout() time.Duration {
+	return db.runtimeSettings().clusterQueryTimeout
+}
+
+func (db *DB) followQueueDepth() int {
+	return db.runtimeSettings().followQueueDepth
+}
+
+func (db *DB) walSyncInterval() time.Duration {
+	return db.runtimeSettings().walSyncInterval
+}
+
+// setWALSyncInterval changes the sync interval of all open WALs.
+func (db *DB) setWALSyncInterval(syncInterval time.Duration) {
+	db.tablesMutex.RLock()
+	defer db.tablesMutex.RUnlock()
+	for _, w := range db.streams {
+		w.SetSyncInterval(syncInterval)
+	}
+}
+
+// resizeIterationWorkers starts or stops iteration workers to go from previous
+// to concurrency running workers. Workers that are stopped finish the
+// iterations that they're currently processing first.
+func (db *DB) resizeIterationWorkers(previous int, concurrency int) {
+	if db.opts.Passthrough {
+		// Passthrough nodes don't iterate
+		return
+	}
+	for i := previous; i < concurrency; i++ {
+		go db.processIterations()
+	}
+	for i := concurrency; i < previous; i++ {
+		go func() {
+			db.stopIterationWorker <- true
+		}()
+	}
+}
+
+func (db *DB) closeSettingChangeLog() {
+	if db.settingChangeLog != nil {
+		db.settingChangeLog.close()
+	}
+}
@@ -0,0 +1,105 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimeSettings(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+		WALSyncInterval:           time.Hour,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Error(t, db.SetRuntimeSetting("admin", "NumPartitions", "5"), "settings that can't change at runtime should be rejected")
+	assert.Error(t, db.SetRuntimeSetting("admin", "IterationConcurrency", "0"))
+	assert.Error(t, db.SetRuntimeSetting("admin", "ClusterQueryTimeout", "forever"))
+	assert.Error(t, db.SetRuntimeSetting("admin", "FollowQueueDepth", "-1"))
+	assert.Error(t, db.SetRuntimeSetting("admin", "WALSyncInterval", "-1s"))
+	assert.Empty(t, db.SettingChanges(), "invalid changes shouldn't be recorded")
+
+	assert.NoError(t, db.SetRuntimeSetting("admin", "ClusterQueryTimeout", "5m"))
+	assert.NoError(t, db.SetRuntimeSetting("admin", "FollowQueueDepth", "1000"))
+	assert.NoError(t, db.SetRuntimeSetting("admin", "WALSyncInterval", "0"))
+	assert.NoError(t, db.SetRuntimeSetting("admin", "IterationConcurrency", "4"))
+	assert.NoError(t, db.SetRuntimeSetting("other", "IterationConcurrency", "1"))
+	assert.Equal(t, 5*time.Minute, db.clusterQueryTimeout())
+	assert.Equal(t, 1000, db.followQueueDepth())
+	assert.Equal(t, time.Duration(0), db.walSyncInterval())
+	assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"dim": "a"}, map[string]float64{"i": 1}))
+	w := db.streams["inbound"]
+	synced := w.SyncedOffset()
+	durable, err := w.Sync()
+	if assert.NoError(t, err) {
+		assert.Equal(t, durable, synced, "open WAL should sync on every write after changing WALSyncInterval to 0")
+	}
+	assert.Equal(t, 1, db.iterationConcurrency())
+
+	changes := db.SettingChanges()
+	if assert.Len(t, changes, 5) {
+		last := changes[4]
+		assert.Equal(t, "other", last.User)
+		assert.Equal(t, "IterationConcurrency", last.Name)
+		assert.Equal(t, "4", last.OldValue)
+		assert.Equal(t, "1", last.NewValue)
+	}
+	logged, err := ioutil.ReadFile(filepath.Join(tmpDir, settingChangesLogFilename))
+	if assert.NoError(t, err) {
+		assert.Len(t, strings.Split(strings.TrimSpace(string(logged)), "\n"), 5, "all changes should have been logged")
+	}
+
+	settings := make(map[string]*Setting)
+	for _, setting := range db.Settings() {
+		settings[setting.Name] = setting
+	}
+	if assert.NotNil(t, settings["ClusterQueryTimeout"]) {
+		assert.Equal(t, "5m0s", settings["ClusterQueryTimeout"].Value)
+		assert.Equal(t, SettingSourceRuntime, settings["ClusterQueryTimeout"].Source)
+	}
+	if assert.NotNil(t, settings["IterationConcurrency"]) {
+		assert.Equal(t, "1", settings["IterationConcurrency"].Value)
+		assert.Equal(t, SettingSourceRuntime, settings["IterationConcurrency"].Source)
+	}
+
+	// Queries still run on the remaining iteration worker
+	assert.NoError(t, db.Insert("inbound", time.Now(), map[string]interface{}{"dim": "a"}, map[string]float64{"i": 1}))
+	time.Sleep(100 * time.Millisecond)
+	source, err := db.Query("SELECT * FROM test_a", false, nil, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = source.Iterate(ctx, core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+		return true, nil
+	})
+	assert.NoError(t, err)
+}
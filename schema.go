@@ -47,7 +47,15 @@ func (db *DB) pollForSchema(filename string) error {
 	return nil
 }
 
+// ApplySchemaFromFile applies the schema in the given file. The outcome is
+// reported by the schema health check.
 func (db *DB) ApplySchemaFromFile(filename string) error {
+	err := db.applySchemaFromFile(filename)
+	db.setSchemaError(err)
+	return err
+}
+
+func (db *DB) applySchemaFromFile(filename string) error {
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return err
@@ -70,6 +78,26 @@ func (db *DB) ApplySchema(_schema Schema) error {
 		schema[opts.Name] = opts
 	}
 
+	normalizers, err := buildNormalizers(schema)
+	if err != nil {
+		return err
+	}
+
+	anonymizers, err := buildAnonymizers(schema)
+	if err != nil {
+		return err
+	}
+
+	validators, err := buildValidators(schema)
+	if err != nil {
+		return err
+	}
+
+	err = validateLateTables(schema)
+	if err != nil {
+		return err
+	}
+
 	// Identify dependencies
 	var tables []*TableOpts
 	for name, opts := range schema {
@@ -117,6 +145,9 @@ func (db *DB) ApplySchema(_schema Schema) error {
 		}
 	}
 
+	db.applyNormalizers(normalizers)
+	db.applyAnonymizers(anonymizers)
+	db.applyValidators(validators)
 	return nil
 }
 
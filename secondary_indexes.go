@@ -0,0 +1,226 @@
+package zenodb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+func validateIndexes(opts *TableOpts) error {
+	if len(opts.Indexes) == 0 {
+		return nil
+	}
+	if strings.ToLower(opts.Layout) != LayoutColumnar {
+		return fmt.Errorf("Indexes require Layout '%v'", LayoutColumnar)
+	}
+	for _, dim := range opts.Indexes {
+		if strings.TrimSpace(dim) == "" {
+			return fmt.Errorf("Please specify a dimension for every index")
+		}
+	}
+	return nil
+}
+
+func (t *table) applyIndexes(indexes []string) {
+	dims := make([]string, 0, len(indexes))
+	for _, dim := range indexes {
+		dims = append(dims, strings.ToLower(strings.TrimSpace(dim)))
+	}
+	t.whereMutex.Lock()
+	t.Indexes = dims
+	t.whereMutex.Unlock()
+}
+
+func (t *table) getIndexes() []string {
+	t.whereMutex.RLock()
+	defer t.whereMutex.RUnlock()
+	return t.Indexes
+}
+
+// columnarRowRef identifies a row within a columnar segment by its row group
+// and its position within that group.
+type columnarRowRef struct {
+	group uint32
+	row   uint32
+}
+
+// columnarIndexBuilder collects the locations of the rows having each value of
+// an indexed dimension while a columnar segment is being written.
+type columnarIndexBuilder struct {
+	dim    string
+	values map[string][]columnarRowRef
+	// unindexed is set if any row has a value other than a string for the
+	// dimension, in which case the segment isn't indexed on the dimension
+	unindexed bool
+}
+
+func newColumnarIndexBuilder(dim string) *columnarIndexBuilder {
+	return &columnarIndexBuilder{dim: dim, values: make(map[string][]columnarRowRef)}
+}
+
+func (b *columnarIndexBuilder) addKey(key bytemap.ByteMap, ref columnarRowRef) {
+	if b.unindexed {
+		return
+	}
+	value := key.Get(b.dim)
+	if value == nil {
+		return
+	}
+	str, ok := value.(string)
+	if !ok {
+		b.unindexed = true
+		b.values = nil
+		return
+	}
+	b.values[str] = append(b.values[str], ref)
+}
+
+// encode encodes the index, sorted by value, as:
+//
+//	numvalues (32 bits)|value1|value2|...
+//
+// value: valuelength (16 bits)|value|numrows (32 bits)|row1group (32 bits)|row1 (32 bits)|...
+func (b *columnarIndexBuilder) encode() []byte {
+	values := make([]string, 0, len(b.values))
+	for value := range b.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	buf := &bytes.Buffer{}
+	binary.Write(buf, encoding.Binary, uint32(len(values)))
+	for _, value := range values {
+		refs := b.values[value]
+		binary.Write(buf, encoding.Binary, uint16(len(value)))
+		buf.WriteString(value)
+		binary.Write(buf, encoding.Binary, uint32(len(refs)))
+		for _, ref := range refs {
+			binary.Write(buf, encoding.Binary, ref.group)
+			binary.Write(buf, encoding.Binary, ref.row)
+		}
+	}
+	return buf.Bytes()
+}
+
+// lookupIndex finds the rows of the segment having the given value for the
+// given dimension. found is false if the segment isn't indexed on that
+// dimension.
+func (cr *columnarReader) lookupIndex(dim string, value string) (refs []columnarRowRef, found bool, err error) {
+	chunk, indexed := cr.footer.indexes[dim]
+	if !indexed {
+		return nil, false, nil
+	}
+	b, err := cr.readChunk(chunk)
+	if err != nil {
+		return nil, false, errors.New("Unable to read index on %v: %v", dim, err)
+	}
+	r := bytes.NewReader(b)
+	var numValues uint32
+	err = binary.Read(r, encoding.Binary, &numValues)
+	if err != nil {
+		return nil, false, errors.New("Unable to read number of indexed values: %v", err)
+	}
+	for i := uint32(0); i < numValues; i++ {
+		var valueLength uint16
+		err = binary.Read(r, encoding.Binary, &valueLength)
+		if err != nil {
+			return nil, false, errors.New("Unable to read indexed value length: %v", err)
+		}
+		candidate := make([]byte, valueLength)
+		_, err = io.ReadFull(r, candidate)
+		if err != nil {
+			return nil, false, errors.New("Unable to read indexed value: %v", err)
+		}
+		var numRefs uint32
+		err = binary.Read(r, encoding.Binary, &numRefs)
+		if err != nil {
+			return nil, false, errors.New("Unable to read number of indexed rows: %v", err)
+		}
+		cmp := strings.Compare(string(candidate), value)
+		if cmp < 0 {
+			// Skip rows
+			_, err = r.Seek(int64(numRefs)*2*encoding.Width32bits, io.SeekCurrent)
+			if err != nil {
+				return nil, false, errors.New("Unable to skip indexed rows: %v", err)
+			}
+			continue
+		}
+		if cmp > 0 {
+			// Values are sorted, so we've passed the one we're looking for
+			break
+		}
+		refs = make([]columnarRowRef, numRefs)
+		for j := range refs {
+			err = binary.Read(r, encoding.Binary, &refs[j].group)
+			if err == nil {
+				err = binary.Read(r, encoding.Binary, &refs[j].row)
+			}
+			if err != nil {
+				return nil, false, errors.New("Unable to read indexed row: %v", err)
+			}
+		}
+		break
+	}
+	return refs, true, nil
+}
+
+// indexedRows uses the segment's indexes to determine which rows the filters
+// need, keyed by row group. It returns nil if any of the filters need rows that
+// can't be located with an index, in which case all rows need to be
+// considered.
+func (filters segmentFilters) indexedRows(cr *columnarReader) (map[int][]int, error) {
+	if len(filters) == 0 || len(cr.footer.indexes) == 0 {
+		return nil, nil
+	}
+	selected := make(map[int]map[int]bool)
+	for _, f := range filters {
+		var best []columnarRowRef
+		usedIndex := false
+		dims := make([]string, 0, len(f.equals))
+		for dim := range f.equals {
+			dims = append(dims, dim)
+		}
+		sort.Strings(dims)
+		for _, dim := range dims {
+			refs, found, err := cr.lookupIndex(dim, f.equals[dim])
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				continue
+			}
+			if !usedIndex || len(refs) < len(best) {
+				best = refs
+			}
+			usedIndex = true
+		}
+		if !usedIndex {
+			return nil, nil
+		}
+		for _, ref := range best {
+			rows := selected[int(ref.group)]
+			if rows == nil {
+				rows = make(map[int]bool)
+				selected[int(ref.group)] = rows
+			}
+			rows[int(ref.row)] = true
+		}
+	}
+
+	result := make(map[int][]int, len(selected))
+	for group, rows := range selected {
+		sortedRows := make([]int, 0, len(rows))
+		for row := range rows {
+			sortedRows = append(sortedRows, row)
+		}
+		sort.Ints(sortedRows)
+		result[group] = sortedRows
+	}
+	return result, nil
+}
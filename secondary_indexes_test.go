@@ -0,0 +1,145 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecondaryIndexes(t *testing.T) {
+	assert.NoError(t, validateIndexes(&TableOpts{}))
+	assert.NoError(t, validateIndexes(&TableOpts{Layout: "Columnar", Indexes: []string{"server"}}))
+	assert.Error(t, validateIndexes(&TableOpts{Indexes: []string{"server"}}), "indexes should require columnar layout")
+	assert.Error(t, validateIndexes(&TableOpts{Layout: LayoutColumnar, Indexes: []string{" "}}))
+
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: vtime.NewVirtualClock(epoch),
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	sqlString := "SELECT SUM(a) AS a FROM inbound GROUP BY server, dc, port, period(1h)"
+	schema := Schema{
+		"test_row": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			SQL:             sqlString,
+		},
+		"test_indexed": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			SQL:             sqlString,
+			Layout:          LayoutColumnar,
+			Indexes:         []string{"Server", "port"},
+		},
+	}
+	if !assert.NoError(t, db.ApplySchema(schema)) {
+		return
+	}
+	assert.Equal(t, []string{"server", "port"}, db.getTable("test_indexed").getIndexes())
+
+	// Enough servers to fill more than one row group
+	numServers := columnarRowGroupSize + 100
+	for i := 0; i < numServers; i++ {
+		err := db.Insert("inbound", epoch.Add(-1*time.Hour), map[string]interface{}{"server": fmt.Sprintf("server%d", i), "dc": fmt.Sprintf("dc%d", i%2), "port": i % 10}, map[string]float64{"a": float64(i)})
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+	// Wait for both tables to process all inserts
+	inserted := func() bool {
+		return db.getTable("test_row").getStats().InsertedPoints == int64(numServers) && db.getTable("test_indexed").getStats().InsertedPoints == int64(numServers)
+	}
+	for i := 0; i < 300 && !inserted(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !assert.True(t, inserted(), "tables should have processed all inserts") {
+		return
+	}
+	db.FlushAll()
+
+	tbl := db.getTable("test_indexed")
+	cr, err := openColumnar(db.keyring, tbl.rowStore.fileStore.filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, cr.footer.groups, 2)
+	assert.Contains(t, cr.footer.indexes, "server")
+	assert.NotContains(t, cr.footer.indexes, "port", "dimension with numeric values shouldn't be indexed")
+	refs, found, err := cr.lookupIndex("server", "server8200")
+	if assert.NoError(t, err) && assert.True(t, found) && assert.Len(t, refs, 1) {
+		keys, err := cr.readKeys(cr.footer.groups[refs[0].group])
+		if assert.NoError(t, err) {
+			assert.Equal(t, "server8200", keys[refs[0].row].Get("server"))
+		}
+	}
+	refs, found, err = cr.lookupIndex("server", "unknown")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Empty(t, refs)
+	_, found, err = cr.lookupIndex("dc", "dc1")
+	assert.NoError(t, err)
+	assert.False(t, found)
+	cr.Close()
+
+	fields := tbl.getFields()
+	iterateFiltered := func(filters ...*segmentFilter) []string {
+		var servers []string
+		_, err := tbl.rowStore.fileStore.iterateFiltered(segmentFilters(filters), fields, nil, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			servers = append(servers, key.Get("server").(string))
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return servers
+	}
+	asOf, until := epoch.Add(-3*time.Hour), epoch
+	server5 := newSegmentFilter(asOf, until, map[string]string{"server": "server5"})
+	server8200 := newSegmentFilter(asOf, until, map[string]string{"server": "server8200", "dc": "dc0"})
+	dc1 := newSegmentFilter(asOf, until, map[string]string{"dc": "dc1"})
+	assert.Equal(t, []string{"server5"}, iterateFiltered(server5), "should only read the indexed row")
+	assert.Equal(t, []string{"server5", "server8200"}, iterateFiltered(server5, server8200), "coalesced iterations should read rows for each of them")
+	assert.Empty(t, iterateFiltered(newSegmentFilter(asOf, until, map[string]string{"server": "unknown"})))
+	assert.Len(t, iterateFiltered(dc1), numServers, "filtering on unindexed dimension should read all rows")
+	assert.Len(t, iterateFiltered(server5, dc1), numServers, "coalesced iterations that can't all use indexes should read all rows")
+
+	query := func(table string, where string) map[string][]float64 {
+		source, err := db.Query("SELECT * FROM "+table+" ASOF '-12h' WHERE "+where+" GROUP BY server, period(1h)", false, nil, false)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		result := make(map[string][]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result[row.Key.Get("server").(string)+" "+time.Unix(0, row.TS).UTC().String()] = append([]float64{}, row.Values...)
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+	for _, where := range []string{"server = 'server8199'", "server = 'server3' AND dc = 'dc1'", "server = 'server3' AND dc = 'dc0'", "dc = 'dc1'"} {
+		expected := query("test_row", where)
+		assert.NotNil(t, expected)
+		assert.Equal(t, expected, query("test_indexed", where), where)
+	}
+	assert.Len(t, query("test_indexed", "server = 'server8199'"), 1)
+
+	schema["test_indexed"].Layout = LayoutRow
+	assert.Error(t, db.ApplySchema(schema), "switching indexed table to row layout should fail")
+}
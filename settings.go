@@ -0,0 +1,218 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+)
+
+const (
+	// SettingSourceOption marks settings that were configured in DBOpts
+	SettingSourceOption = "option"
+	// SettingSourceDefault marks settings that weren't configured, so the
+	// database uses its default
+	SettingSourceDefault = "default"
+	// SettingSourceFlag marks settings that were set with a command-line flag
+	SettingSourceFlag = "flag"
+	// SettingSourceFlagDefault marks command-line flags that weren't set and
+	// use their default
+	SettingSourceFlagDefault = "flag default"
+	// SettingSourceSchema marks the settings of tables, which come from the
+	// schema and change whenever it's reloaded
+	SettingSourceSchema = "schema"
+	// SettingSourceHardcoded marks internal tunables that can't be configured
+	SettingSourceHardcoded = "hardcoded"
+
+	settingNameDim   = "name"
+	settingValueDim  = "value"
+	settingSourceDim = "source"
+
+	redacted = "<redacted>"
+)
+
+// Setting is a configuration value that's in effect on this node, along with
+// where it came from.
+type Setting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+// AddSettings records settings that were configured outside of DBOpts, like
+// command-line flags, so that Settings includes them.
+func (db *DB) AddSettings(settings ...*Setting) {
+	db.settingsMx.Lock()
+	db.extraSettings = append(db.extraSettings, settings...)
+	db.settingsMx.Unlock()
+}
+
+// Settings lists every configuration value that's in effect on this node: the
+// DBOpts (including defaults that the database filled in), any settings added
+// with AddSettings, the options of every table from the current schema and
+// internal tunables that are hardcoded. Sensitive values like passwords and
+// tokens are redacted.
+func (db *DB) Settings() []*Setting {
+	var settings []*Setting
+	configured := reflect.ValueOf(db.configuredOpts)
+	effective := reflect.ValueOf(*db.opts)
+	for i := 0; i < effective.NumField(); i++ {
+		name := effective.Type().Field(i).Name
+		value, ok := settingValue(effective.Field(i))
+		if !ok {
+			continue
+		}
+		source := SettingSourceOption
+		if configuredValue, _ := settingValue(configured.Field(i)); configuredValue != value || isZero(configured.Field(i)) {
+			source = SettingSourceDefault
+		}
+		if current, ok := db.runtimeSettingValue(name); ok && current != value {
+			value = current
+			source = SettingSourceRuntime
+		}
+		settings = append(settings, &Setting{Name: name, Value: value, Source: source})
+	}
+
+	db.settingsMx.RLock()
+	extraSettings := append([]*Setting(nil), db.extraSettings...)
+	db.settingsMx.RUnlock()
+	sort.Slice(extraSettings, func(i, j int) bool {
+		return extraSettings[i].Name < extraSettings[j].Name
+	})
+	settings = append(settings, extraSettings...)
+
+	db.tablesMutex.RLock()
+	tables := make([]*table, 0, len(db.tables))
+	for _, t := range db.tables {
+		tables = append(tables, t)
+	}
+	db.tablesMutex.RUnlock()
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].Name < tables[j].Name
+	})
+	for _, t := range tables {
+		opts := reflect.ValueOf(*t.TableOpts)
+		for i := 0; i < opts.NumField(); i++ {
+			field := opts.Type().Field(i)
+			if field.PkgPath != "" || field.Name == "Name" {
+				// Unexported
+				continue
+			}
+			value, ok := settingValue(opts.Field(i))
+			if ok {
+				settings = append(settings, &Setting{Name: t.Name + "." + field.Name, Value: value, Source: SettingSourceSchema})
+			}
+		}
+	}
+
+	for _, hardcoded := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"IterationBacklog", cap(db.requestedIterations)},
+		{"ClusterQueryResultsBuffer", db.opts.NumPartitions * clusterResultsBufferPerPartition},
+		{"ReplicaRetryInterval", replicaRetryInterval},
+		{"QueryCacheMaxRows", queryCacheMaxRows},
+		{"CoalescedQueryMaxRows", coalescedQueryMaxRows},
+	} {
+		settings = append(settings, &Setting{Name: hardcoded.name, Value: fmt.Sprint(hardcoded.value), Source: SettingSourceHardcoded})
+	}
+
+	for _, setting := range settings {
+		if isSensitive(setting.Name) && setting.Value != "" {
+			setting.Value = redacted
+		}
+	}
+	return settings
+}
+
+// settingValue formats the given value for display. Functions aren't settings,
+// so ok is false for them. Other values that can't be meaningfully printed,
+// like clients and key sources, are shown by type.
+func settingValue(value reflect.Value) (string, bool) {
+	switch value.Kind() {
+	case reflect.Func:
+		return "", false
+	case reflect.Interface, reflect.Ptr:
+		if value.IsNil() {
+			return "", true
+		}
+		return fmt.Sprintf("%T", value.Interface()), true
+	}
+	if d, ok := value.Interface().(time.Duration); ok {
+		return d.String(), true
+	}
+	return fmt.Sprint(value.Interface()), true
+}
+
+func isZero(value reflect.Value) bool {
+	return reflect.DeepEqual(value.Interface(), reflect.Zero(value.Type()).Interface())
+}
+
+func isSensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, sensitive := range []string{"password", "secret", "token", "hashkey", "blockkey"} {
+		if strings.Contains(name, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// settingsSource is a core.FlatRowSource for a SHOW SETTINGS statement. It
+// returns one row per setting, with its name, value and source as dimensions.
+type settingsSource struct {
+	db   *DB
+	like func(name string) bool
+}
+
+func (s *settingsSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	stats := s.db.metaDataStats()
+	err := onFields(core.Fields{})
+	if err != nil {
+		return stats, err
+	}
+	ts := s.GetUntil().UnixNano()
+	for _, setting := range s.db.Settings() {
+		if !s.like(setting.Name) {
+			continue
+		}
+		more, err := onRow(&core.FlatRow{
+			TS: ts,
+			Key: bytemap.New(map[string]interface{}{
+				settingNameDim:   setting.Name,
+				settingValueDim:  setting.Value,
+				settingSourceDim: setting.Source,
+			}),
+		})
+		if !more || err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func (s *settingsSource) GetGroupBy() []core.GroupBy {
+	return nil
+}
+
+func (s *settingsSource) GetResolution() time.Duration {
+	return 0
+}
+
+func (s *settingsSource) GetAsOf() time.Time {
+	return s.GetUntil()
+}
+
+func (s *settingsSource) GetUntil() time.Time {
+	return s.db.clock.Now()
+}
+
+func (s *settingsSource) String() string {
+	return "show settings"
+}
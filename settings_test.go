@@ -0,0 +1,74 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettings(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		QueryCacheSize:            5,
+		FollowerToken:             "shhh",
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	db.AddSettings(&Setting{Name: "-password", Value: "secret", Source: SettingSourceFlag})
+
+	settings := make(map[string]*Setting)
+	for _, setting := range db.Settings() {
+		settings[setting.Name] = setting
+	}
+	assertSetting := func(name string, value string, source string) {
+		setting := settings[name]
+		if assert.NotNil(t, setting, name) {
+			assert.Equal(t, value, setting.Value, name)
+			assert.Equal(t, source, setting.Source, name)
+		}
+	}
+	assertSetting("QueryCacheSize", "5", SettingSourceOption)
+	assertSetting("QueryCacheLag", DefaultQueryCacheLag.String(), SettingSourceDefault)
+	assertSetting("MaxSpillBytes", "0", SettingSourceDefault)
+	assertSetting("FollowerToken", redacted, SettingSourceOption)
+	assertSetting("-password", redacted, SettingSourceFlag)
+	assertSetting("test_a.RetentionPeriod", "1h0m0s", SettingSourceSchema)
+	assertSetting("QueryCacheMaxRows", "100000", SettingSourceHardcoded)
+	assert.Nil(t, settings["Follow"], "functions shouldn't be listed")
+
+	source, err := db.Query("SHOW SETTINGS LIKE 'querycache%'", false, nil, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var names []string
+	_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+		names = append(names, row.Key.Get(settingNameDim).(string))
+		assert.NotEmpty(t, row.Key.Get(settingSourceDim))
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"QueryCacheSize", "QueryCacheLag", "QueryCacheMaxRows"}, names)
+}
@@ -0,0 +1,172 @@
+package zenodb
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// DefaultShutdownTimeout is how long HandleShutdownSignal waits for a
+	// graceful shutdown by default
+	DefaultShutdownTimeout = 1 * time.Minute
+
+	followerDrainCheckInterval = 50 * time.Millisecond
+)
+
+var (
+	// ErrShuttingDown is returned for inserts that arrive once the database has
+	// started shutting down.
+	ErrShuttingDown = errors.New("database is shutting down")
+)
+
+func (db *DB) isShuttingDown() bool {
+	return atomic.LoadInt32(&db.shuttingDown) == 1
+}
+
+// Shutdown gracefully shuts down the database. It stops accepting inserts,
+// waits for connected followers to be sent the entries queued for them, closes
+// the readers of the WAL, flushes all memstores, checkpoints the offsets that
+// followers have applied and then closes the database. Progress is logged per
+// stage. If the given timeout elapses before all stages have finished,
+// Shutdown returns an error without closing the database. That's safe in so
+// far as anything that didn't get flushed is replayed from the WAL on the next
+// start.
+func (db *DB) Shutdown(timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&db.shuttingDown, 0, 1) {
+		return errors.New("Already shutting down")
+	}
+	start := time.Now()
+	deadline := start.Add(timeout)
+	log.Debugf("Shutting down within %v, no longer accepting inserts", timeout)
+
+	stages := []struct {
+		name string
+		run  func(deadline time.Time)
+	}{
+		{"draining followers", db.drainFollowers},
+		{"closing WAL readers", db.closeWALReaders},
+		{"flushing memstores", func(deadline time.Time) { db.FlushAll() }},
+		{"checkpointing follower offsets", db.checkpointFollowerOffsets},
+	}
+	for _, stage := range stages {
+		stage := stage
+		stageStart := time.Now()
+		log.Debugf("Shutdown: %v", stage.name)
+		finished := make(chan bool, 1)
+		go func() {
+			stage.run(deadline)
+			finished <- true
+		}()
+		select {
+		case <-finished:
+			log.Debugf("Shutdown: finished %v in %v", stage.name, time.Since(stageStart))
+		case <-time.After(time.Until(deadline)):
+			return errors.New("Shutdown timed out after %v while %v", timeout, stage.name)
+		}
+	}
+
+	db.close(false)
+	log.Debugf("Shut down in %v", time.Since(start))
+	return nil
+}
+
+// drainFollowers waits until the entries queued for connected followers have
+// been sent, or until the deadline, and then marks the followers as failed so
+// that they aren't sent anything else.
+func (db *DB) drainFollowers(deadline time.Time) {
+	db.followersMx.RLock()
+	var followers []*follower
+	for _, byName := range db.followersByName {
+		for f := range byName {
+			followers = append(followers, f)
+		}
+	}
+	db.followersMx.RUnlock()
+	if len(followers) == 0 {
+		return
+	}
+
+	for {
+		queued := 0
+		for _, f := range followers {
+			if !f.failed() {
+				queued += len(f.entries)
+			}
+		}
+		if queued == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Errorf("Shutdown: %d entries still queued for followers", queued)
+			break
+		}
+		time.Sleep(followerDrainCheckInterval)
+	}
+	for _, f := range followers {
+		f.markFailed()
+	}
+	log.Debugf("Shutdown: drained %d followers", len(followers))
+}
+
+// closeWALReaders closes the readers with which tables and followers read the
+// WAL.
+func (db *DB) closeWALReaders(deadline time.Time) {
+	db.tablesMutex.RLock()
+	tables := make([]*table, 0, len(db.tables))
+	for _, t := range db.tables {
+		tables = append(tables, t)
+	}
+	db.tablesMutex.RUnlock()
+
+	closed := 0
+	for _, t := range tables {
+		if t.wal != nil {
+			t.wal.Close()
+			closed++
+		}
+	}
+
+	db.followerWALReadersMx.Lock()
+	stopReaders := make([]func(), 0, len(db.followerWALReaders))
+	for _, stop := range db.followerWALReaders {
+		stopReaders = append(stopReaders, stop)
+	}
+	db.followerWALReadersMx.Unlock()
+	for _, stop := range stopReaders {
+		stop()
+		closed++
+	}
+	log.Debugf("Shutdown: closed %d WAL readers", closed)
+}
+
+// checkpointFollowerOffsets persists the offsets acknowledged by our followers
+// and, on followers, acknowledges the offsets through which tables have been
+// flushed to the leader.
+func (db *DB) checkpointFollowerOffsets(deadline time.Time) {
+	db.followersMx.Lock()
+	if len(db.followerAcks) > 0 {
+		if err := db.saveFollowerAcks(); err != nil {
+			log.Errorf("Shutdown: %v", err)
+		}
+	}
+	db.followersMx.Unlock()
+
+	if db.opts.AckFollow == nil {
+		return
+	}
+	db.followedStreamsMx.Lock()
+	streams := make(map[string]func() []*table, len(db.followedStreams))
+	for stream, tables := range db.followedStreams {
+		streams[stream] = tables
+	}
+	db.followedStreamsMx.Unlock()
+	for stream, tables := range streams {
+		if _, err := db.ackFollow(stream, tables(), nil); err != nil {
+			log.Errorf("Shutdown: unable to acknowledge offsets for %v: %v", stream, err)
+			continue
+		}
+		log.Debugf("Shutdown: acknowledged offsets for %v", stream)
+	}
+}
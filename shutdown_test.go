@@ -0,0 +1,75 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	schema := Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	}
+	open := func() *DB {
+		db, err := NewDB(&DBOpts{
+			Dir:                       tmpDir,
+			IterationCoalesceInterval: time.Millisecond,
+		})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		if !assert.NoError(t, db.ApplySchema(schema)) {
+			return nil
+		}
+		return db
+	}
+
+	db := open()
+	if db == nil {
+		return
+	}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"dim": i}, map[string]float64{"i": 1}))
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	if !assert.NoError(t, db.Shutdown(time.Minute)) {
+		return
+	}
+	assert.Equal(t, ErrShuttingDown, db.Insert("inbound", now, map[string]interface{}{"dim": 1}, map[string]float64{"i": 1}), "inserts should be rejected once shutting down")
+	assert.Error(t, db.Shutdown(time.Minute), "shutting down twice should fail")
+	assert.NotNil(t, db.getTable("test_a").persistedOffset(), "memstore should have been flushed")
+
+	db = open()
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	time.Sleep(250 * time.Millisecond)
+	source, err := db.Query("SELECT i FROM test_a", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	total := float64(0)
+	_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+		total += row.Values[0]
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 10, total, "data should survive shutdown")
+}
@@ -6,6 +6,9 @@ import (
 	"syscall"
 )
 
+// HandleShutdownSignal gracefully shuts down the database and exits when the
+// process receives a signal to terminate, waiting no longer than
+// ShutdownTimeout.
 func (db *DB) HandleShutdownSignal() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c,
@@ -15,8 +18,16 @@ func (db *DB) HandleShutdownSignal() {
 		syscall.SIGQUIT)
 	go func() {
 		s := <-c
-		log.Debugf("Got signal \"%s\", closing db and exiting...", s)
-		db.Close()
+		timeout := db.opts.ShutdownTimeout
+		if timeout <= 0 {
+			timeout = DefaultShutdownTimeout
+		}
+		log.Debugf("Got signal \"%s\", shutting down db and exiting...", s)
+		err := db.Shutdown(timeout)
+		if err != nil {
+			log.Errorf("Unable to shut down gracefully: %v", err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}()
 }
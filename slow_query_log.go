@@ -0,0 +1,161 @@
+package zenodb
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+)
+
+const (
+	// DefaultSlowQueryLogMaxBytes is the default for DBOpts.SlowQueryLogMaxBytes
+	DefaultSlowQueryLogMaxBytes = 10 * 1024 * 1024
+
+	slowQueryLogFilename = "slow_queries.log"
+
+	// slowQueriesKept is how many of the most recent slow queries are kept in
+	// memory for SlowQueries
+	slowQueriesKept = 100
+)
+
+// SlowQuery is an entry in the slow query log.
+type SlowQuery struct {
+	TS     time.Time
+	SQL    string
+	Caller string `json:",omitempty"`
+	// Principal is the authenticated principal that ran the query, if any
+	Principal string `json:",omitempty"`
+	// RequestID identifies the request that ran the query across nodes
+	RequestID string `json:",omitempty"`
+	// Partitions lists the partitions that answered the query, if it ran on a
+	// cluster
+	Partitions        []int `json:",omitempty"`
+	MissingPartitions []int `json:",omitempty"`
+	RowsScanned       int64
+	EstimatedMemory   int64
+	Duration          time.Duration
+	// WaitTime is how long the query waited for table scans and followers to
+	// become available, ExecutionTime is the rest of Duration
+	WaitTime      time.Duration
+	ExecutionTime time.Duration
+	Error         string `json:",omitempty"`
+}
+
+// slowQueryLog records queries that take longer than a threshold, both in
+// memory and in a jsonLog, unless the database is read-only.
+type slowQueryLog struct {
+	threshold time.Duration
+	file      *jsonLog
+	recent    []*SlowQuery
+	mx        sync.Mutex
+}
+
+func (db *DB) initSlowQueryLog() error {
+	if db.opts.SlowQueryThreshold <= 0 {
+		return nil
+	}
+	if db.opts.SlowQueryLogMaxBytes <= 0 {
+		db.opts.SlowQueryLogMaxBytes = DefaultSlowQueryLogMaxBytes
+	}
+	l := &slowQueryLog{threshold: db.opts.SlowQueryThreshold}
+	if !db.opts.ReadOnly {
+		file, err := openJSONLog(filepath.Join(db.opts.Dir, slowQueryLogFilename), db.opts.SlowQueryLogMaxBytes)
+		if err != nil {
+			return err
+		}
+		l.file = file
+	}
+	db.slowQueryLog = l
+	return nil
+}
+
+// logIfSlow records the given query if it took at least as long as the
+// threshold.
+func (db *DB) logIfSlow(ctx context.Context, sqlString string, start time.Time, u *queryUsage, stats *common.QueryStats, err error) {
+	l := db.slowQueryLog
+	if l == nil {
+		return
+	}
+	duration := time.Since(start)
+	if duration < l.threshold {
+		return
+	}
+
+	wait := u.waitTime()
+	if wait > duration {
+		wait = duration
+	}
+	entry := &SlowQuery{
+		TS:                start,
+		SQL:               sqlString,
+		Caller:            common.CallerFor(ctx),
+		Principal:         common.PrincipalFor(ctx),
+		RequestID:         common.RequestIDFor(ctx),
+		MissingPartitions: stats.MissingPartitions,
+		RowsScanned:       stats.RowsScanned,
+		EstimatedMemory:   stats.EstimatedMemory,
+		Duration:          duration,
+		WaitTime:          wait,
+		ExecutionTime:     duration - wait,
+	}
+	if db.opts.Passthrough {
+		missing := make(map[int]bool, len(stats.MissingPartitions))
+		for _, partition := range stats.MissingPartitions {
+			missing[partition] = true
+		}
+		for partition := 0; partition < stats.NumPartitions; partition++ {
+			if !missing[partition] {
+				entry.Partitions = append(entry.Partitions, partition)
+			}
+		}
+	} else if db.opts.Follow != nil {
+		entry.Partitions = []int{db.opts.Partition}
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	log.Debugf("Slow query took %v (waited %v): %v", duration, wait, sqlString)
+	l.record(entry)
+}
+
+func (l *slowQueryLog) record(entry *SlowQuery) {
+	l.mx.Lock()
+	l.recent = append(l.recent, entry)
+	if len(l.recent) > slowQueriesKept {
+		l.recent = l.recent[len(l.recent)-slowQueriesKept:]
+	}
+	l.mx.Unlock()
+
+	if l.file == nil {
+		return
+	}
+	err := l.file.write(entry)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (l *slowQueryLog) close() {
+	if l.file != nil {
+		l.file.close()
+	}
+}
+
+// SlowQueries returns up to the n most recent entries in the slow query log,
+// oldest first. At most the last 100 entries are kept in memory, older ones
+// can be found in the log file. Returns nothing if the slow query log is
+// disabled.
+func (db *DB) SlowQueries(n int) []*SlowQuery {
+	l := db.slowQueryLog
+	if l == nil {
+		return nil
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if n <= 0 || n > len(l.recent) {
+		n = len(l.recent)
+	}
+	return append([]*SlowQuery(nil), l.recent[len(l.recent)-n:]...)
+}
@@ -0,0 +1,94 @@
+package zenodb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowQueryLog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                tmpDir,
+		SlowQueryThreshold: 50 * time.Millisecond,
+		// Makes table scans wait long enough to be slow
+		IterationCoalesceInterval: 100 * time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"dim": i}, map[string]float64{"i": 1}))
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	query := func(sqlString string) {
+		source, err := db.Query(sqlString, false, nil, true)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = source.Iterate(common.WithPrincipal(common.WithCaller(context.Background(), "tester"), "alice"), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			return true, nil
+		})
+		assert.NoError(t, err)
+	}
+
+	query("SELECT i FROM test_a GROUP BY dim")
+	query("SHOW SETTINGS")
+	query("SELECT i FROM test_a")
+
+	slowQueries := db.SlowQueries(0)
+	if !assert.Len(t, slowQueries, 2, "only the table scans should have been slow") {
+		return
+	}
+	assert.Equal(t, slowQueries[1:], db.SlowQueries(1))
+	entry := slowQueries[0]
+	assert.Equal(t, "SELECT i FROM test_a GROUP BY dim", entry.SQL)
+	assert.Equal(t, "tester", entry.Caller)
+	assert.Equal(t, "alice", entry.Principal)
+	assert.EqualValues(t, 10, entry.RowsScanned)
+	assert.True(t, entry.WaitTime >= 100*time.Millisecond, "should have waited for the table scan")
+	assert.Equal(t, entry.Duration, entry.WaitTime+entry.ExecutionTime)
+	assert.Empty(t, entry.Error)
+
+	file, err := os.Open(filepath.Join(tmpDir, slowQueryLogFilename))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer file.Close()
+	var logged []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		loggedEntry := &SlowQuery{}
+		if assert.NoError(t, json.Unmarshal(scanner.Bytes(), loggedEntry)) {
+			logged = append(logged, loggedEntry.SQL)
+		}
+	}
+	assert.Equal(t, []string{slowQueries[0].SQL, slowQueries[1].SQL}, logged)
+}
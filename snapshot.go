@@ -0,0 +1,190 @@
+package zenodb
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/common"
+)
+
+const (
+	snapshotChunkSize = 65536
+)
+
+// Snapshot sends a copy of the named table's current filestore to cb in chunks,
+// along with the filestore's file version. The copy is decrypted so that the
+// recipient can encrypt it with its own keys. It includes the WAL offset
+// through which the filestore is current, from which the recipient can
+// continue following. Only followers can supply snapshots, and only to
+// followers of the same partition. cb must not retain data.
+func (db *DB) Snapshot(req *common.SnapshotRequest, cb func(version int, data []byte) error) error {
+	if db.opts.Follow == nil {
+		return errors.New("Only followers can supply snapshots")
+	}
+	if req.Partition != db.opts.Partition || req.NumPartitions != db.opts.NumPartitions || req.ConsistentPartitioning != db.opts.ConsistentPartitioning {
+		return errors.New("Snapshot requested for partition %d of %d (consistent: %v) but this is partition %d of %d (consistent: %v)",
+			req.Partition, req.NumPartitions, req.ConsistentPartitioning, db.opts.Partition, db.opts.NumPartitions, db.opts.ConsistentPartitioning)
+	}
+	t := db.getTable(req.Table)
+	if t == nil || t.rowStore == nil {
+		return errors.New("Table %v not found", req.Table)
+	}
+	if rb := t.rebalance; rb != nil && !t.persistedOffset().After(rb.Until) {
+		return errors.New("Table %v is still rebalancing, not supplying snapshot", t.Name)
+	}
+
+	if t.InMemory {
+		return errors.New("Table %v is in-memory only, not supplying snapshot", t.Name)
+	}
+
+	t.rowStore.mx.RLock()
+	filename := t.rowStore.fileStore.filename
+	t.rowStore.mx.RUnlock()
+	if filename == "" {
+		return errors.New("Table %v hasn't flushed any data yet", t.Name)
+	}
+
+	if isColumnar(filename) {
+		// Columnar segments are encrypted chunk by chunk, so supply a row-oriented
+		// copy instead
+		rowFile, err := t.rowOrientedCopy(filename)
+		if err != nil {
+			return errors.New("Unable to convert columnar filestore for snapshot: %v", err)
+		}
+		defer os.RemoveAll(filepath.Dir(rowFile))
+		filename = rowFile
+	}
+
+	// Filestores are immutable once written, and an open file remains readable
+	// even if the rowStore removes it in the meantime.
+	file, err := os.Open(filename)
+	if err != nil {
+		return errors.New("Unable to open filestore for snapshot: %v", err)
+	}
+	defer file.Close()
+	r, err := t.keyring().NewReader(file)
+	if err != nil {
+		return errors.New("Unable to decrypt filestore for snapshot: %v", err)
+	}
+
+	version := versionFor(filename)
+	t.log.Debugf("Supplying snapshot from %v to follower %d (%v)", filename, req.Partition, req.FollowerName)
+	buf := make([]byte, snapshotChunkSize)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			if err := cb(version, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return errors.New("Unable to read filestore for snapshot: %v", readErr)
+		}
+	}
+}
+
+// rowOrientedCopy copies the given columnar segment into a temporary
+// row-oriented filestore named like one at CurrentFileVersion.
+func (t *table) rowOrientedCopy(filename string) (string, error) {
+	offset, _, err := readWALOffset(t.keyring(), filename)
+	if err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		return "", err
+	}
+	rowFile := filepath.Join(dir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), CurrentFileVersion))
+	err = t.writeFiltered(nil, false, offset, rowFile, []string{filename})
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return rowFile, nil
+}
+
+// bootstrap populates a brand-new follower table from a snapshot supplied by an
+// existing replica of its partition, so that it only needs to follow the WAL
+// from where the snapshot left off instead of replaying all of it. If the
+// table already has data or no snapshot is available, this does nothing.
+func (t *table) bootstrap(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		t.log.Errorf("Unable to read contents of directory, not bootstrapping: %v", err)
+		return
+	}
+	if len(files) > 0 {
+		// Already have data
+		return
+	}
+
+	start := time.Now()
+	out, err := ioutil.TempFile("", "snapshot")
+	if err != nil {
+		t.log.Errorf("Unable to create file for snapshot: %v", err)
+		return
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	eout, err := t.keyring().NewWriter(out)
+	if err != nil {
+		t.log.Errorf("Unable to create encrypting writer for snapshot: %v", err)
+		return
+	}
+	version := -1
+	size := 0
+	err = t.db.opts.Snapshot(&common.SnapshotRequest{
+		Table:                  t.Name,
+		Partition:              t.db.opts.Partition,
+		NumPartitions:          t.db.opts.NumPartitions,
+		ConsistentPartitioning: t.db.opts.ConsistentPartitioning,
+		FollowerName:           t.db.opts.FollowerName,
+		FollowerToken:          t.db.opts.FollowerToken,
+	}, func(v int, data []byte) error {
+		version = v
+		size += len(data)
+		_, writeErr := eout.Write(data)
+		return writeErr
+	})
+	if err == nil {
+		err = eout.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil && version < 0 {
+		err = errors.New("snapshot was empty")
+	}
+	if err != nil {
+		t.log.Debugf("Unable to bootstrap from snapshot, will follow from scratch: %v", err)
+		return
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil && !os.IsExist(err) {
+		t.log.Errorf("Unable to create folder for snapshot: %v", err)
+		return
+	}
+	filename := filepath.Join(dir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), version))
+	err = os.Rename(out.Name(), filename)
+	if err != nil {
+		t.log.Errorf("Unable to move snapshot into place: %v", err)
+		return
+	}
+	offset, _, err := readWALOffset(t.keyring(), filename)
+	if err != nil {
+		t.log.Errorf("Snapshot appears to be corrupt, removing: %v", err)
+		os.Remove(filename)
+		return
+	}
+	t.log.Debugf("Bootstrapped %d bytes from snapshot in %v, will follow from %v", size, time.Now().Sub(start), offset)
+}
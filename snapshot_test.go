@@ -0,0 +1,95 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	follow := func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error) {}
+
+	// Set up an existing replica with a flushed filestore
+	source := &DB{
+		opts:   &DBOpts{Follow: follow, Partition: 1, NumPartitions: 2},
+		tables: make(map[string]*table),
+	}
+	sourceTable := &table{TableOpts: &TableOpts{Name: "tbl"}, db: source, log: golog.LoggerFor("snapshottest")}
+	sourceTable.rowStore = &rowStore{t: sourceTable, fileStore: &fileStore{t: sourceTable}}
+	source.tables["tbl"] = sourceTable
+
+	req := &common.SnapshotRequest{Table: "tbl", Partition: 1, NumPartitions: 2}
+	assert.Error(t, source.Snapshot(req, nil), "Shouldn't supply snapshot before anything has been flushed")
+
+	offset := wal.NewOffsetForTS(time.Now())
+	sourceFile := filepath.Join(tmpDir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), CurrentFileVersion))
+	out, err := os.Create(sourceFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cout, err := sourceTable.rowStore.fileStore.createOutWriter(out, core.Fields{}, offset, newDimensionDictionary(), false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = cout.Write([]byte("some row data"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, cout.Close())
+	assert.NoError(t, out.Close())
+	sourceTable.rowStore.fileStore.filename = sourceFile
+
+	// Set up a brand-new follower that bootstraps from the replica
+	newFollowerTable := func(partition int) *table {
+		db := &DB{
+			opts: &DBOpts{
+				Follow:        follow,
+				Partition:     partition,
+				NumPartitions: 2,
+				Snapshot:      source.Snapshot,
+			},
+		}
+		return &table{TableOpts: &TableOpts{Name: "tbl"}, db: db, log: golog.LoggerFor("snapshottest")}
+	}
+
+	wrongPartitionDir := filepath.Join(tmpDir, "wrongpartition")
+	newFollowerTable(0).bootstrap(wrongPartitionDir)
+	_, err = os.Stat(wrongPartitionDir)
+	assert.True(t, os.IsNotExist(err), "Shouldn't bootstrap from replica of different partition")
+
+	dir := filepath.Join(tmpDir, "follower")
+	newFollowerTable(1).bootstrap(dir)
+	files, err := ioutil.ReadDir(dir)
+	if assert.NoError(t, err) && assert.Len(t, files, 1) {
+		bootstrapped := filepath.Join(dir, files[0].Name())
+		assert.Equal(t, CurrentFileVersion, versionFor(bootstrapped))
+		bootstrappedOffset, _, err := readWALOffset(nil, bootstrapped)
+		if assert.NoError(t, err) {
+			assert.Equal(t, offset, bootstrappedOffset, "Should follow from where snapshot left off")
+		}
+		expected, _ := ioutil.ReadFile(sourceFile)
+		actual, _ := ioutil.ReadFile(bootstrapped)
+		assert.Equal(t, expected, actual)
+	}
+
+	newFollowerTable(1).bootstrap(dir)
+	files, err = ioutil.ReadDir(dir)
+	if assert.NoError(t, err) {
+		assert.Len(t, files, 1, "Shouldn't bootstrap table that already has data")
+	}
+}
@@ -0,0 +1,194 @@
+// Package spill manages the temporary files to which queries spill data once
+// it exceeds their memory budget, enforcing both per-query and global limits on
+// how much disk space they use.
+package spill
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb/metrics"
+)
+
+const (
+	filePrefix = "spill_"
+)
+
+var (
+	log = golog.LoggerFor("zenodb.spill")
+
+	// ErrQuotaExceeded indicates that spilling would exceed the disk quota for
+	// the query or for the whole process.
+	ErrQuotaExceeded = errors.New("spill disk quota exceeded")
+
+	defaultManager     *Manager
+	defaultManagerOnce sync.Once
+)
+
+// Opts configures a Manager
+type Opts struct {
+	// Dir is the directory in which to place spill files. Any spill files left
+	// in here (for example after a crash) are removed by New.
+	Dir string
+	// MaxBytes caps the disk space used for spilling by all queries. 0 means
+	// unlimited.
+	MaxBytes int64
+	// MaxBytesPerQuery caps the disk space used for spilling by a single query.
+	// 0 means unlimited.
+	MaxBytesPerQuery int64
+}
+
+// Manager manages spill files in a single directory.
+type Manager struct {
+	opts Opts
+	used int64
+}
+
+// New creates a Manager, creating the spill directory if necessary and cleaning
+// up any orphaned spill files.
+func New(opts *Opts) (*Manager, error) {
+	err := os.MkdirAll(opts.Dir, 0755)
+	if err != nil {
+		return nil, errors.New("Unable to create spill dir %v: %v", opts.Dir, err)
+	}
+	m := &Manager{opts: *opts}
+	m.removeOrphans()
+	return m, nil
+}
+
+// Default returns a Manager that spills to the system's temp directory without
+// any limits.
+func Default() *Manager {
+	defaultManagerOnce.Do(func() {
+		defaultManager = &Manager{opts: Opts{Dir: os.TempDir()}}
+	})
+	return defaultManager
+}
+
+func (m *Manager) removeOrphans() {
+	files, err := ioutil.ReadDir(m.opts.Dir)
+	if err != nil {
+		log.Errorf("Unable to list spill dir %v: %v", m.opts.Dir, err)
+		return
+	}
+	removed := 0
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), filePrefix) {
+			continue
+		}
+		rmErr := os.Remove(filepath.Join(m.opts.Dir, file.Name()))
+		if rmErr != nil {
+			log.Errorf("Unable to remove orphaned spill file %v: %v", file.Name(), rmErr)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Debugf("Removed %d orphaned spill files from %v", removed, m.opts.Dir)
+	}
+}
+
+// Used returns the number of bytes currently spilled to disk.
+func (m *Manager) Used() int64 {
+	return atomic.LoadInt64(&m.used)
+}
+
+// NewQuota creates a Quota for a single query. A nil *Manager creates quotas
+// using the Default Manager.
+func (m *Manager) NewQuota() *Quota {
+	if m == nil {
+		m = Default()
+	}
+	return &Quota{m: m}
+}
+
+// Quota tracks the disk space used by the spill files of a single query. A nil
+// *Quota uses the Default Manager without limits.
+type Quota struct {
+	m    *Manager
+	used int64
+}
+
+// Used returns the number of bytes that this query currently has spilled to
+// disk.
+func (q *Quota) Used() int64 {
+	return atomic.LoadInt64(&q.used)
+}
+
+// Create creates a new spill file. The caller must Remove it when done.
+func (q *Quota) Create() (*File, error) {
+	if q == nil {
+		q = Default().NewQuota()
+	}
+	f, err := ioutil.TempFile(q.m.opts.Dir, filePrefix)
+	if err != nil {
+		return nil, errors.New("Unable to create spill file: %v", err)
+	}
+	metrics.SpillChanged(0, 1)
+	return &File{q: q, file: f}, nil
+}
+
+func (q *Quota) reserve(n int64) error {
+	used := atomic.AddInt64(&q.used, n)
+	total := atomic.AddInt64(&q.m.used, n)
+	if (q.m.opts.MaxBytesPerQuery > 0 && used > q.m.opts.MaxBytesPerQuery) || (q.m.opts.MaxBytes > 0 && total > q.m.opts.MaxBytes) {
+		atomic.AddInt64(&q.used, -n)
+		atomic.AddInt64(&q.m.used, -n)
+		metrics.SpillQuotaExceeded()
+		return ErrQuotaExceeded
+	}
+	metrics.SpillChanged(n, 0)
+	return nil
+}
+
+func (q *Quota) release(n int64) {
+	atomic.AddInt64(&q.used, -n)
+	atomic.AddInt64(&q.m.used, -n)
+	metrics.SpillChanged(-n, 0)
+}
+
+// File is a spill file whose writes count against a Quota.
+type File struct {
+	q    *Quota
+	file *os.File
+	size int64
+}
+
+// Write implements io.Writer, failing with ErrQuotaExceeded if writing would
+// exceed the quota.
+func (f *File) Write(b []byte) (int, error) {
+	err := f.q.reserve(int64(len(b)))
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	if n < len(b) {
+		f.q.release(int64(len(b) - n))
+	}
+	return n, err
+}
+
+// NewReader returns a buffered reader over everything written to the file so
+// far.
+func (f *File) NewReader(bufferSize int) io.Reader {
+	return bufio.NewReaderSize(io.NewSectionReader(f.file, 0, f.size), bufferSize)
+}
+
+// Remove closes and deletes the file, releasing its space from the quota.
+func (f *File) Remove() error {
+	f.file.Close()
+	err := os.Remove(f.file.Name())
+	f.q.release(f.size)
+	f.size = 0
+	metrics.SpillChanged(0, -1)
+	return err
+}
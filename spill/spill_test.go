@@ -0,0 +1,67 @@
+package spill
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotas(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "spilltest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Leave some orphaned files around
+	orphan := filepath.Join(tmpDir, filePrefix+"orphan")
+	other := filepath.Join(tmpDir, "other")
+	assert.NoError(t, ioutil.WriteFile(orphan, []byte("orphan"), 0644))
+	assert.NoError(t, ioutil.WriteFile(other, []byte("other"), 0644))
+
+	m, err := New(&Opts{Dir: tmpDir, MaxBytes: 10, MaxBytesPerQuery: 6})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = os.Stat(orphan)
+	assert.True(t, os.IsNotExist(err), "Orphaned spill file should have been removed")
+	_, err = os.Stat(other)
+	assert.NoError(t, err, "Unrelated file should have been left alone")
+
+	q1 := m.NewQuota()
+	f1, err := q1.Create()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f1.Write([]byte("12345"))
+	assert.NoError(t, err)
+	_, err = f1.Write([]byte("67"))
+	assert.Equal(t, ErrQuotaExceeded, err, "Should have exceeded per-query quota")
+	assert.EqualValues(t, 5, q1.Used())
+
+	q2 := m.NewQuota()
+	f2, err := q2.Create()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f2.Write([]byte("abcde"))
+	assert.NoError(t, err)
+	_, err = f2.Write([]byte("f"))
+	assert.Equal(t, ErrQuotaExceeded, err, "Should have exceeded global quota")
+	assert.EqualValues(t, 10, m.Used())
+
+	b, err := ioutil.ReadAll(f1.NewReader(4096))
+	assert.NoError(t, err)
+	assert.Equal(t, "12345", string(b))
+
+	assert.NoError(t, f1.Remove())
+	assert.NoError(t, f2.Remove())
+	assert.EqualValues(t, 0, q1.Used())
+	assert.EqualValues(t, 0, m.Used())
+
+	files, _ := ioutil.ReadDir(tmpDir)
+	assert.Len(t, files, 1, "Only unrelated file should remain")
+}
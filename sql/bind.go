@@ -0,0 +1,173 @@
+package sql
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bind replaces the ? placeholders in the given SQL with the given params,
+// formatted as SQL literals. Placeholders inside of string literals, quoted
+// identifiers and comments are left alone.
+//
+// Strings are quoted and escaped, times become RFC3339 strings and durations
+// become strings like '-1h0m0s' that work with ASOF and UNTIL. Slices and
+// arrays expand into comma separated lists for use with IN (?). nil becomes
+// NULL.
+func Bind(sqlString string, params ...interface{}) (string, error) {
+	p, err := Prepare(sqlString)
+	if err != nil {
+		return "", err
+	}
+	return p.Bind(params...)
+}
+
+// Prepared is a SQL statement whose ? placeholders have already been located,
+// so that it can be bound to different params without scanning it again.
+type Prepared struct {
+	// SQL is the statement with its placeholders
+	SQL string
+	// segments are the parts of SQL before, between and after the placeholders
+	segments []string
+}
+
+// Prepare locates the ? placeholders in the given SQL (see Bind).
+func Prepare(sqlString string) (*Prepared, error) {
+	var segments []string
+	segmentStart := 0
+	for i := 0; i < len(sqlString); i++ {
+		c := sqlString[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := endOfQuoted(sqlString, i)
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated %c at position %d", c, i)
+			}
+			i = end - 1
+		case c == '-' && strings.HasPrefix(sqlString[i:], "--"):
+			end := strings.IndexByte(sqlString[i:], '\n')
+			if end < 0 {
+				end = len(sqlString) - i
+			}
+			i += end - 1
+		case c == '/' && strings.HasPrefix(sqlString[i:], "/*"):
+			end := strings.Index(sqlString[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated comment at position %d", i)
+			}
+			i += end + 3
+		case c == '?':
+			segments = append(segments, sqlString[segmentStart:i])
+			segmentStart = i + 1
+		}
+	}
+	segments = append(segments, sqlString[segmentStart:])
+	return &Prepared{SQL: sqlString, segments: segments}, nil
+}
+
+// NumParams returns the number of placeholders in the statement.
+func (p *Prepared) NumParams() int {
+	return len(p.segments) - 1
+}
+
+// Bind replaces the statement's placeholders with the given params (see Bind).
+func (p *Prepared) Bind(params ...interface{}) (string, error) {
+	numParams := p.NumParams()
+	if len(params) < numParams {
+		return "", fmt.Errorf("Not enough parameters, have %d but need %d", len(params), numParams)
+	}
+	if len(params) > numParams {
+		return "", fmt.Errorf("Too many parameters, have %d but only used %d", len(params), numParams)
+	}
+	if numParams == 0 {
+		return p.SQL, nil
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(p.SQL) + numParams*8)
+	for i, param := range params {
+		literal, err := literalFor(param)
+		if err != nil {
+			return "", fmt.Errorf("Unable to bind parameter %d: %v", i+1, err)
+		}
+		out.WriteString(p.segments[i])
+		out.WriteString(literal)
+	}
+	out.WriteString(p.segments[numParams])
+	return out.String(), nil
+}
+
+// endOfQuoted returns the index just past the closing quote of the quoted
+// string starting at start, or -1 if it's not terminated.
+func endOfQuoted(sqlString string, start int) int {
+	delim := sqlString[start]
+	for i := start + 1; i < len(sqlString); i++ {
+		switch sqlString[i] {
+		case '\\':
+			// skip escaped character
+			i++
+		case delim:
+			if i+1 < len(sqlString) && sqlString[i+1] == delim {
+				// doubled delimiter is an escaped delimiter
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func literalFor(param interface{}) (string, error) {
+	switch p := param.(type) {
+	case nil:
+		return "NULL", nil
+	case string:
+		return quote(p), nil
+	case []byte:
+		return quote(string(p)), nil
+	case bool:
+		return strconv.FormatBool(p), nil
+	case time.Time:
+		return quote(p.Format(time.RFC3339Nano)), nil
+	case time.Duration:
+		return quote(p.String()), nil
+	case float32:
+		return strconv.FormatFloat(float64(p), 'g', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(p, 'g', -1, 64), nil
+	case fmt.Stringer:
+		return quote(p.String()), nil
+	}
+
+	v := reflect.ValueOf(param)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Slice, reflect.Array:
+		if v.Len() == 0 {
+			return "", fmt.Errorf("Empty list")
+		}
+		literals := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			literal, err := literalFor(v.Index(i).Interface())
+			if err != nil {
+				return "", err
+			}
+			literals = append(literals, literal)
+		}
+		return strings.Join(literals, ", "), nil
+	default:
+		return "", fmt.Errorf("Unsupported type %v", reflect.TypeOf(param))
+	}
+}
+
+func quote(str string) string {
+	str = strings.Replace(str, `\`, `\\`, -1)
+	return "'" + strings.Replace(str, "'", "''", -1) + "'"
+}
@@ -0,0 +1,94 @@
+package sql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/getlantern/goexpr"
+)
+
+// BUCKET rounds numeric dimension values down to a multiple of width, like
+// BUCKET(latency_ms, 100), so that they can be grouped into ranges. Values that
+// aren't numeric, as well as non-positive widths, evaluate to nil.
+func BUCKET(value goexpr.Expr, width goexpr.Expr) goexpr.Expr {
+	return &bucket{value, width}
+}
+
+type bucket struct {
+	Value goexpr.Expr
+	Width goexpr.Expr
+}
+
+func (e *bucket) Eval(params goexpr.Params) interface{} {
+	value, valueIsInt, ok := toNumber(e.Value.Eval(params))
+	if !ok {
+		return nil
+	}
+	width, widthIsInt, ok := toNumber(e.Width.Eval(params))
+	if !ok || width <= 0 {
+		return nil
+	}
+	result := math.Floor(value/width) * width
+	if valueIsInt && widthIsInt {
+		return int(result)
+	}
+	return result
+}
+
+func (e *bucket) WalkParams(cb func(string)) {
+	e.Value.WalkParams(cb)
+	e.Width.WalkParams(cb)
+}
+
+func (e *bucket) WalkOneToOneParams(cb func(string)) {
+	// BUCKET is many-to-one
+}
+
+func (e *bucket) WalkLists(cb func(goexpr.List)) {
+	e.Value.WalkLists(cb)
+	e.Width.WalkLists(cb)
+}
+
+func (e *bucket) String() string {
+	return fmt.Sprintf("BUCKET(%v, %v)", e.Value, e.Width)
+}
+
+// toNumber converts dimension values to float64, indicating whether they were
+// integers and whether they were numeric at all.
+func toNumber(val interface{}) (float64, bool, bool) {
+	switch t := val.(type) {
+	case int:
+		return float64(t), true, true
+	case int8:
+		return float64(t), true, true
+	case int16:
+		return float64(t), true, true
+	case int32:
+		return float64(t), true, true
+	case int64:
+		return float64(t), true, true
+	case uint:
+		return float64(t), true, true
+	case uint8:
+		return float64(t), true, true
+	case uint16:
+		return float64(t), true, true
+	case uint32:
+		return float64(t), true, true
+	case uint64:
+		return float64(t), true, true
+	case float32:
+		return float64(t), false, true
+	case float64:
+		return t, false, true
+	case string:
+		if i, err := strconv.Atoi(t); err == nil {
+			return float64(i), true, true
+		}
+		f, err := strconv.ParseFloat(t, 64)
+		return f, false, err == nil
+	default:
+		return 0, false, false
+	}
+}
@@ -0,0 +1,12 @@
+package sql
+
+// Explain returns the given statement without its EXPLAIN prefix, if any, and
+// whether or not it had one.
+func Explain(sql string) (string, bool) {
+	s := &scanner{sql: sql}
+	s.skipSpace()
+	if !s.keyword("explain") {
+		return sql, false
+	}
+	return sql[s.pos:], true
+}
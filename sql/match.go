@@ -0,0 +1,78 @@
+package sql
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/getlantern/goexpr"
+)
+
+// MATCHES evaluates to true if the string representation of value matches the
+// given regular expression, as in WHERE path =~ '^/api/'. Nil values never
+// match.
+func MATCHES(value goexpr.Expr, pattern string) (goexpr.Expr, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid regular expression %v: %v", pattern, err)
+	}
+	return &matches{Value: value, Pattern: pattern, re: re}, nil
+}
+
+type matches struct {
+	Value   goexpr.Expr
+	Pattern string
+	re      *regexp.Regexp
+}
+
+func (e *matches) Eval(params goexpr.Params) interface{} {
+	switch v := e.Value.Eval(params).(type) {
+	case nil:
+		return false
+	case string:
+		return e.re.MatchString(v)
+	default:
+		return e.re.MatchString(fmt.Sprint(v))
+	}
+}
+
+func (e *matches) WalkParams(cb func(string)) {
+	e.Value.WalkParams(cb)
+}
+
+func (e *matches) WalkOneToOneParams(cb func(string)) {
+	// MATCHES is many-to-one
+}
+
+func (e *matches) WalkLists(cb func(goexpr.List)) {
+	e.Value.WalkLists(cb)
+}
+
+func (e *matches) String() string {
+	return fmt.Sprintf("%v =~ '%v'", e.Value, e.Pattern)
+}
+
+// inStrings is like goexpr.In for lists of string constants, except that it
+// looks up string values in a set rather than comparing them to every
+// candidate, which matters for long lists. Other values are compared like
+// goexpr.In does.
+type inStrings struct {
+	goexpr.Expr
+	val        goexpr.Expr
+	candidates map[string]bool
+}
+
+func newInStrings(val goexpr.Expr, list goexpr.ArrayList, values []string) goexpr.Expr {
+	candidates := make(map[string]bool, len(values))
+	for _, value := range values {
+		candidates[value] = true
+	}
+	return &inStrings{Expr: goexpr.In(val, list), val: val, candidates: candidates}
+}
+
+func (e *inStrings) Eval(params goexpr.Params) interface{} {
+	v := e.val.Eval(params)
+	if str, ok := v.(string); ok {
+		return e.candidates[str]
+	}
+	return e.Expr.Eval(params)
+}
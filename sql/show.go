@@ -0,0 +1,87 @@
+package sql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ShowSettings parses a statement like SHOW SETTINGS [LIKE 'pattern'] and
+// reports whether sql is such a statement. like matches the names of settings
+// against the pattern, in which % matches any sequence of characters and _
+// matches any single character. Without a LIKE clause, it matches every name.
+func ShowSettings(sql string) (like func(name string) bool, ok bool, err error) {
+	s := &scanner{sql: sql}
+	s.skipSpace()
+	if !s.keyword("show") {
+		return nil, false, nil
+	}
+	s.skipSpace()
+	if !s.keyword("settings") {
+		return nil, false, nil
+	}
+	like = func(name string) bool { return true }
+	s.skipSpace()
+	if s.keyword("like") {
+		s.skipSpace()
+		if s.pos >= len(sql) || (sql[s.pos] != '\'' && sql[s.pos] != '"') {
+			return nil, true, fmt.Errorf("Expected quoted pattern after LIKE in %v", sql)
+		}
+		quote := sql[s.pos]
+		end := strings.IndexByte(sql[s.pos+1:], quote)
+		if end < 0 {
+			return nil, true, fmt.Errorf("Unterminated pattern after LIKE in %v", sql)
+		}
+		pattern := sql[s.pos+1 : s.pos+1+end]
+		s.pos += end + 2
+		re := regexp.MustCompile("(?is)^" + strings.NewReplacer("%", ".*", "_", ".").Replace(regexp.QuoteMeta(pattern)) + "$")
+		like = re.MatchString
+		s.skipSpace()
+	}
+	return like, true, s.end("SHOW SETTINGS")
+}
+
+// ShowTables reports whether sql is a SHOW TABLES statement.
+func ShowTables(sql string) (ok bool, err error) {
+	s := &scanner{sql: sql}
+	s.skipSpace()
+	if !s.keyword("show") {
+		return false, nil
+	}
+	s.skipSpace()
+	if !s.keyword("tables") {
+		return false, nil
+	}
+	s.skipSpace()
+	return true, s.end("SHOW TABLES")
+}
+
+// Describe parses a statement like DESCRIBE table and reports whether sql is
+// such a statement. The name of the table is lowercased like in queries.
+func Describe(sql string) (table string, ok bool, err error) {
+	s := &scanner{sql: sql}
+	s.skipSpace()
+	if !s.keyword("describe") {
+		return "", false, nil
+	}
+	s.skipSpace()
+	table = strings.ToLower(s.identifier())
+	if table == "" {
+		return "", true, fmt.Errorf("Expected table name after DESCRIBE in %v", sql)
+	}
+	s.skipSpace()
+	return table, true, s.end("DESCRIBE")
+}
+
+// end consumes an optional trailing semicolon and returns an error if anything
+// but whitespace and comments remains of the given statement.
+func (s *scanner) end(statement string) error {
+	if s.pos < len(s.sql) && s.sql[s.pos] == ';' {
+		s.pos++
+		s.skipSpace()
+	}
+	if s.pos < len(s.sql) {
+		return fmt.Errorf("Unexpected %v at end of %v", s.sql[s.pos:], statement)
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -29,10 +30,15 @@ var (
 var (
 	ErrSelectNoName                  = errors.New("All expressions in SELECT must either reference a column name or include an AS alias")
 	ErrIfArity                       = errors.New("IF requires two parameters, like IF(dim = 1, SUM(b))")
-	ErrBoundedArity                  = errors.New("BOUNDED requires three parameters, like BOUNDED(b, 0, 100)")
+	ErrBoundedArity                  = errors.New("BOUNDED requires three parameters and an optional out of range policy, like BOUNDED(b, 0, 100) or BOUNDED(b, 0, 100, 'clamp')")
+	ErrClampArity                    = errors.New("CLAMP requires three parameters, like CLAMP(b, 0, 100)")
 	ErrPercentileArity               = errors.New("PERCENTILE requires either two or five parameters, like PERCENTILE(b, 99.9, 0, 1000, 3)")
 	ErrPercentileOptWrap             = errors.New("PERCENTILE with two parameters may only wrap an existing PERCENTILE expression")
 	ErrShiftArity                    = errors.New("SHIFT requires two parameters, like SHIFT(SUM(b), '-1h')")
+	ErrEMAArity                      = errors.New("EMA requires two parameters, like EMA(b, 0.3)")
+	ErrHistogramArity                = errors.New("HISTOGRAM requires a value and at least one bucket bound, like HISTOGRAM(b, 10, 100, 1000)")
+	ErrCoalesceArity                 = errors.New("COALESCE requires at least one parameter, like COALESCE(b, 0)")
+	ErrHistogramBucketsArity         = errors.New("HISTOGRAM_BUCKETS requires one parameter, like HISTOGRAM_BUCKETS(b) or HISTOGRAM_BUCKETS(HISTOGRAM(b, 10, 100, 1000))")
 	ErrCrosshiftArity                = errors.New("CROSSHIFT requires three parameters, like CROSSHIFT(SUM(b), '1h', '-1d')")
 	ErrCrosshiftZeroCutoffOrInterval = errors.New("CROSSHIFT cutoff and interval must be non-zero")
 	ErrCROSSTABArity                 = errors.New("CROSSTAB requires at least one argument")
@@ -40,16 +46,52 @@ var (
 	ErrAggregateArity                = errors.New("Aggregate functions take only one parameter, like SUM(b)")
 	ErrWildcardNotAllowed            = errors.New("Wildcard * is not supported")
 	ErrNestedFunctionCall            = errors.New("Nested function calls are not currently supported in SELECT")
-	ErrInvalidPeriod                 = errors.New("Please specify a period in the form period(5s) where 5s can be any valid Go duration expression")
+	ErrInvalidPeriod                 = errors.New("Please specify a period in the form period(5s) where 5s can be any valid Go duration expression, optionally followed by a time zone like period(1d, 'America/New_York')")
 	ErrInvalidStride                 = errors.New("Please specify a stride in the form stride(5s) where 5s can be any valid Go duration expression")
 )
 
+// annotationsHint is a comment like -- annotations(deploy, incident) that
+// requests overlaying annotations onto the results.
+var annotationsHint = regexp.MustCompile(`(?i)\bannotations\b(?:\s*\(([^)]*)\))?`)
+
+// limitHint is a comment like -- max_rows_scanned(1000000) max_duration(30s)
+// that limits the resources the query may use.
+var limitHint = regexp.MustCompile(`(?i)\bmax_(rows_scanned|memory|duration)\s*\(([^)]*)\)`)
+
+// partitionFailureHint is a comment like -- on_partition_failure(retry) that
+// specifies how a clustered query handles partitions that fail or time out.
+var partitionFailureHint = regexp.MustCompile(`(?i)\bon_partition_failure\s*\(([^)]*)\)`)
+
+// crosstabHint is a comment like -- crosstab_order(total) crosstab_limit(10)
+// that controls the columns of a crosstab.
+var crosstabHint = regexp.MustCompile(`(?i)\bcrosstab_(order|limit)\s*\(([^)]*)\)`)
+
+const (
+	// PartitionFailurePartial returns partial results, listing the partitions
+	// that failed in the query's stats. This is the default.
+	PartitionFailurePartial = "partial"
+	// PartitionFailureRetry retries failed partitions, on another replica if
+	// possible, until the query's deadline.
+	PartitionFailureRetry = "retry"
+	// PartitionFailureWait waits for slow partitions until the query's own
+	// deadline rather than the cluster query timeout.
+	PartitionFailureWait = "wait"
+)
+
 var aggregateFuncs = map[string]func(interface{}) expr.Expr{
-	"SUM":   expr.SUM,
-	"MIN":   expr.MIN,
-	"MAX":   expr.MAX,
-	"COUNT": expr.COUNT,
-	"AVG":   expr.AVG,
+	"SUM":    expr.SUM,
+	"MIN":    expr.MIN,
+	"MAX":    expr.MAX,
+	"COUNT":  expr.COUNT,
+	"AVG":    expr.AVG,
+	"ISUM":   expr.ISUM,
+	"ICOUNT": expr.ICOUNT,
+}
+
+var condAggregateFuncs = map[string]func(interface{}, goexpr.Expr) expr.Expr{
+	"SUMIF":   expr.SUMIF,
+	"COUNTIF": expr.COUNTIF,
+	"AVGIF":   expr.AVGIF,
 }
 
 var binaryAggregateFuncs = map[string]func(interface{}, interface{}) expr.Expr{
@@ -92,6 +134,7 @@ var unaryGoExpr = map[string]func(goexpr.Expr) goexpr.Expr{
 var binaryGoExpr = map[string]func(goexpr.Expr, goexpr.Expr) goexpr.Expr{
 	"HGET":      redis.HGet,
 	"SISMEMBER": redis.SIsMember,
+	"BUCKET":    BUCKET,
 }
 
 var ternaryGoExpr = map[string]func(goexpr.Expr, goexpr.Expr, goexpr.Expr) goexpr.Expr{
@@ -172,13 +215,23 @@ type Query struct {
 	FromSubQuery *Query
 	FromSQL      string
 	Resolution   time.Duration
+	Location     *time.Location
 	Where        goexpr.Expr
 	WhereSQL     string
-	AsOf         time.Time
-	AsOfOffset   time.Duration
-	Until        time.Time
-	UntilOffset  time.Duration
-	Stride       time.Duration
+	// WhereEquals maps dimensions to the strings that they have to equal for
+	// rows to pass the WHERE clause, based on the comparisons that are ANDed
+	// together at its top level.
+	WhereEquals map[string]string
+	AsOf        time.Time
+	AsOfOffset  time.Duration
+	Until       time.Time
+	UntilOffset time.Duration
+	Stride      time.Duration
+	// DimColumns are the dimension expressions from the SELECT clause, like
+	// SUBSTR(path, 0, 4) AS prefix, in the order they appear. Their string
+	// values are computed from the dimensions of each result row and added to
+	// those dimensions.
+	DimColumns []core.GroupBy
 	// GroupBy are the GroupBy expressions ordered alphabetically by name.
 	GroupBy    []core.GroupBy
 	GroupByAll bool
@@ -191,25 +244,176 @@ type Query struct {
 	Offset                int
 	Limit                 int
 	ForceFresh            bool
+	// IncludeWALTail indicates that the query should also include data that's
+	// been written to the WAL but not yet applied to the table, at the cost of
+	// reading the WAL while querying. It implies ForceFresh.
+	IncludeWALTail bool
+	// CrosstabOrder and CrosstabLimit control how crosstab columns are ordered
+	// and how many there may be, see core.GroupOpts.
+	CrosstabOrder string
+	CrosstabLimit int
+	// Explain indicates that the statement was prefixed with EXPLAIN, meaning
+	// that the query plan should be returned rather than the query's results.
+	Explain bool
+	// Materialize indicates that the results of this query should only be
+	// computed once within a statement, for example because it's a common table
+	// expression from a WITH clause that's referenced more than once.
+	Materialize bool
+	// Annotate indicates that annotations should be overlaid onto the results,
+	// limited to AnnotationCategories if any were specified.
+	Annotate             bool
+	AnnotationCategories []string
+	// MaxRowsScanned, MaxMemory and MaxDuration limit the rows that the query
+	// may scan, the memory (in bytes) that it may use and how long it may run.
+	// Zero means no limit.
+	MaxRowsScanned int64
+	MaxMemory      int64
+	MaxDuration    time.Duration
+	// OnPartitionFailure is how a clustered query handles partitions that fail
+	// or time out, one of the PartitionFailure policies. Empty means
+	// PartitionFailurePartial.
+	OnPartitionFailure string
 }
 
 // TableFor returns the table in the FROM clause of this query
 func TableFor(sql string) (string, error) {
-	parsed, err := sqlparser.Parse(sql)
+	stmt, err := parseSelect(sql)
 	if err != nil {
 		return "", err
 	}
-	stmt := parsed.(*sqlparser.Select)
 	return strings.ToLower(nodeToString(stmt.From[0])), nil
 }
 
+// WithAsOf returns the given query with its ASOF set to asOf, keeping any
+// UNTIL.
+func WithAsOf(sql string, asOf time.Time) (string, error) {
+	stmt, err := parseSelect(sql)
+	if err != nil {
+		return "", err
+	}
+	if stmt.TimeRange == nil {
+		stmt.TimeRange = &sqlparser.TimeRange{}
+	}
+	stmt.TimeRange.From = asOf.UTC().Format(time.RFC3339Nano)
+	return nodeToString(stmt), nil
+}
+
+// WithTimeRange returns the given query with its ASOF and UNTIL set to asOf and
+// until. If resolution is non-zero and the query doesn't group by a period of
+// its own, the query is also grouped by period(resolution).
+func WithTimeRange(sql string, asOf time.Time, until time.Time, resolution time.Duration) (string, error) {
+	stmt, err := parseSelect(sql)
+	if err != nil {
+		return "", err
+	}
+	stmt.TimeRange = &sqlparser.TimeRange{
+		From: asOf.UTC().Format(time.RFC3339Nano),
+		To:   until.UTC().Format(time.RFC3339Nano),
+	}
+	if resolution <= 0 {
+		return nodeToString(stmt), nil
+	}
+	for _, e := range stmt.GroupBy {
+		if nse, ok := e.(*sqlparser.NonStarExpr); ok {
+			if fn, ok := nse.Expr.(*sqlparser.FuncExpr); ok && strings.EqualFold("PERIOD", string(fn.Name)) {
+				return nodeToString(stmt), nil
+			}
+		}
+	}
+	groupBy := "period('" + resolution.String() + "')"
+	if len(stmt.GroupBy) == 0 {
+		// Without a GROUP BY, queries group by all dimensions, so keep doing that
+		groupBy = "*, " + groupBy
+	}
+	periodStmt, err := parseSelectOnly("SELECT * FROM t GROUP BY " + groupBy)
+	if err != nil {
+		return "", err
+	}
+	stmt.GroupBy = append(stmt.GroupBy, periodStmt.GroupBy...)
+	return nodeToString(stmt), nil
+}
+
 // Parse parses a SQL statement and returns a corresponding *Query object.
 func Parse(sql string) (*Query, error) {
-	parsed, err := sqlparser.Parse(sql)
+	stmt, err := parseSelect(sql)
 	if err != nil {
 		return nil, fmt.Errorf("Error parsing %v: %v", sql, err)
 	}
-	return parse(parsed.(*sqlparser.Select))
+	q, err := parse(stmt)
+	if err != nil {
+		return nil, err
+	}
+	_, q.Explain = Explain(sql)
+	return q, nil
+}
+
+// Clone returns a copy of the query, including its FROM subquery, that can be
+// modified without affecting the original. Expressions are shared with the
+// original.
+func (q *Query) Clone() *Query {
+	clone := &Query{}
+	*clone = *q
+	if q.FromSubQuery != nil {
+		clone.FromSubQuery = q.FromSubQuery.Clone()
+	}
+	return clone
+}
+
+// HasSubQueries indicates whether the query or its FROM subquery have
+// subqueries in their WHERE clauses. The results of those subqueries are
+// recorded in the query's expressions, so such queries can't be run more than
+// once, even when cloned.
+func (q *Query) HasSubQueries() bool {
+	hasSubQuery := false
+	if q.Where != nil {
+		q.Where.WalkLists(func(list goexpr.List) {
+			if _, ok := list.(*SubQuery); ok {
+				hasSubQuery = true
+			}
+		})
+	}
+	if !hasSubQuery && q.FromSubQuery != nil {
+		return q.FromSubQuery.HasSubQueries()
+	}
+	return hasSubQuery
+}
+
+// Tables returns the distinct tables that the query reads, including the tables
+// read by its FROM subquery and by the subqueries in its WHERE clause.
+func (q *Query) Tables() ([]string, error) {
+	var tables []string
+	seen := make(map[string]bool)
+	var addTables func(q *Query) error
+	addTables = func(q *Query) error {
+		if q.FromSubQuery != nil {
+			if err := addTables(q.FromSubQuery); err != nil {
+				return err
+			}
+		} else if !seen[q.From] {
+			seen[q.From] = true
+			tables = append(tables, q.From)
+		}
+		var subQueries []*SubQuery
+		if q.Where != nil {
+			q.Where.WalkLists(func(list goexpr.List) {
+				if sq, ok := list.(*SubQuery); ok {
+					subQueries = append(subQueries, sq)
+				}
+			})
+		}
+		for _, sq := range subQueries {
+			subQuery, err := Parse(sq.SQL)
+			if err != nil {
+				return err
+			}
+			if err := addTables(subQuery); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := addTables(q)
+	return tables, err
 }
 
 func parse(stmt *sqlparser.Select) (*Query, error) {
@@ -221,6 +425,10 @@ func parse(stmt *sqlparser.Select) (*Query, error) {
 		return nil, err
 	}
 	q.checkForFields(stmt)
+	err = q.applyDimColumns(stmt)
+	if err != nil {
+		return nil, err
+	}
 	q.HasHaving = stmt.Having != nil
 	if q.HasHaving {
 		q.HavingSQL = fmt.Sprintf("%v AS %v", nodeToString(stmt.Having.Expr), core.HavingFieldName)
@@ -279,10 +487,85 @@ func parse(stmt *sqlparser.Select) (*Query, error) {
 		if strings.Contains(string(comment), "force_fresh") {
 			q.ForceFresh = true
 		}
+		if strings.Contains(string(comment), "include_wal_tail") {
+			q.IncludeWALTail = true
+			q.ForceFresh = true
+		}
+		if string(comment) == materializeHint {
+			q.Materialize = true
+		}
+		if match := annotationsHint.FindStringSubmatch(string(comment)); match != nil {
+			q.Annotate = true
+			for _, category := range strings.Split(match[1], ",") {
+				category = strings.ToLower(strings.TrimSpace(category))
+				if category != "" {
+					q.AnnotationCategories = append(q.AnnotationCategories, category)
+				}
+			}
+		}
+		for _, match := range limitHint.FindAllStringSubmatch(string(comment), -1) {
+			err = q.applyLimitHint(strings.ToLower(match[1]), strings.TrimSpace(match[2]))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if match := partitionFailureHint.FindStringSubmatch(string(comment)); match != nil {
+			policy := strings.ToLower(strings.TrimSpace(match[1]))
+			switch policy {
+			case PartitionFailurePartial, PartitionFailureRetry, PartitionFailureWait:
+				q.OnPartitionFailure = policy
+			default:
+				return nil, fmt.Errorf("Please specify one of on_partition_failure(partial), on_partition_failure(retry) or on_partition_failure(wait), not %v", match[1])
+			}
+		}
+		for _, match := range crosstabHint.FindAllStringSubmatch(string(comment), -1) {
+			err = q.applyCrosstabHint(strings.ToLower(match[1]), strings.TrimSpace(match[2]))
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 	return q, nil
 }
 
+func (q *Query) applyCrosstabHint(hint string, value string) error {
+	if hint == "order" {
+		order := strings.ToLower(value)
+		if order != core.CrosstabOrderAlphabetical && order != core.CrosstabOrderTotal {
+			return fmt.Errorf("Please specify crosstab_order(%v) or crosstab_order(%v), not %v", core.CrosstabOrderAlphabetical, core.CrosstabOrderTotal, value)
+		}
+		q.CrosstabOrder = order
+		return nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return fmt.Errorf("Please specify a positive number like crosstab_limit(10), not %v", value)
+	}
+	q.CrosstabLimit = limit
+	return nil
+}
+
+func (q *Query) applyLimitHint(limit string, value string) error {
+	if limit == "duration" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("Please specify a positive duration like max_duration(30s), not %v", value)
+		}
+		q.MaxDuration = d
+		return nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("Please specify a positive number like max_%v(1000000), not %v", limit, value)
+	}
+	if limit == "memory" {
+		q.MaxMemory = n
+	} else {
+		q.MaxRowsScanned = n
+	}
+	return nil
+}
+
 func (q *Query) checkForFields(stmt *sqlparser.Select) {
 	for _, _e := range stmt.SelectExprs {
 		if nodeToString(_e) == "_" {
@@ -298,6 +581,45 @@ func (q *Query) checkForFields(stmt *sqlparser.Select) {
 	}
 }
 
+func (q *Query) applyDimColumns(stmt *sqlparser.Select) error {
+	for _, _e := range stmt.SelectExprs {
+		e, ok := _e.(*sqlparser.NonStarExpr)
+		if !ok || !isDimColumn(e) {
+			continue
+		}
+		if len(e.As) == 0 {
+			return fmt.Errorf("%v needs a name, like %v AS name", nodeToString(e.Expr), nodeToString(e.Expr))
+		}
+		ge, err := goExprFor(e.Expr)
+		if err != nil {
+			return err
+		}
+		q.DimColumns = append(q.DimColumns, core.NewGroupBy(strings.ToLower(string(e.As)), ge))
+	}
+	return nil
+}
+
+// isDimColumn indicates whether the given SELECT expression applies a function
+// to dimensions (like SUBSTR or CONCAT) rather than to fields.
+func isDimColumn(e *sqlparser.NonStarExpr) bool {
+	fe, ok := e.Expr.(*sqlparser.FuncExpr)
+	if !ok {
+		return false
+	}
+	fname := strings.ToUpper(string(fe.Name))
+	if fname == "CROSSTAB" || fname == "CROSSTABT" {
+		// only meaningful in GROUP BY
+		return false
+	}
+	_, isAlias := aliases[fname]
+	_, isNullary := nullaryGoExpr[fname]
+	_, isUnary := unaryGoExpr[fname]
+	_, isBinary := binaryGoExpr[fname]
+	_, isTernary := ternaryGoExpr[fname]
+	_, isVar := varGoExpr[fname]
+	return isAlias || isNullary || isUnary || isBinary || isTernary || isVar
+}
+
 type fielded struct {
 	fieldsMap map[string]core.Field
 	sql       string
@@ -334,11 +656,18 @@ func (s *selectClause) Get(known core.Fields) (core.Fields, error) {
 				fields = s.addField(fields, field)
 			}
 		case *sqlparser.NonStarExpr:
+			if isDimColumn(e) {
+				// Dimension columns aren't fields, see Query.DimColumns
+				continue
+			}
 			var err error
 			fe, ok := e.Expr.(*sqlparser.FuncExpr)
 			if ok && strings.ToUpper(string(fe.Name)) == "CROSSHIFT" {
 				// Special handling for CROSSHIFT
 				fields, err = s.addCrosshiftExpr(fields, fe, e.As, true)
+			} else if ok && strings.ToUpper(string(fe.Name)) == "HISTOGRAM_BUCKETS" {
+				// Special handling for HISTOGRAM_BUCKETS
+				fields, err = s.addHistogramBucketsExpr(fields, fe, e.As)
 			} else {
 				as, asErr := asOrColName(e.As, e.Expr)
 				if asErr != nil {
@@ -420,6 +749,42 @@ func (s *selectClause) addCrosshiftExpr(fields core.Fields, e *sqlparser.FuncExp
 	return fields, nil
 }
 
+// addHistogramBucketsExpr adds a column for each of the buckets of a
+// HISTOGRAM, named like crosstab columns after the buckets' labels (e.g.
+// le_100_latency).
+func (s *selectClause) addHistogramBucketsExpr(fields core.Fields, e *sqlparser.FuncExpr, asBytes []byte) (core.Fields, error) {
+	if len(e.Exprs) != 1 {
+		return nil, ErrHistogramBucketsArity
+	}
+	_valueEx, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	valueEx, valueErr := s.exprFor(_valueEx.Expr, true)
+	if valueErr != nil {
+		return nil, valueErr
+	}
+	as, asErr := asOrColName(asBytes, _valueEx.Expr)
+	if asErr != nil {
+		return nil, asErr
+	}
+	histogram, ok := valueEx.(expr.Expr)
+	if !ok || !expr.IsHistogram(histogram) {
+		return nil, fmt.Errorf("HISTOGRAM_BUCKETS requires a HISTOGRAM, not %v", valueEx)
+	}
+	labels, buckets, err := expr.HistogramBuckets(histogram)
+	if err != nil {
+		return nil, err
+	}
+	for i, bucket := range buckets {
+		fields, err = s.addExpr(fields, bucket, fmt.Sprintf("%v_%v", labels[i], as))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
+
 func asOrColName(as []byte, e sqlparser.Expr) (string, error) {
 	if len(as) > 0 {
 		return string(as), nil
@@ -490,9 +855,42 @@ func (q *Query) applyWhere(stmt *sqlparser.Select) error {
 	log.Tracef("Applying where: %v", where)
 	q.Where = where
 	q.WhereSQL = strings.TrimSpace(nodeToString(stmt.Where))
+	q.WhereEquals = make(map[string]string)
+	addWhereEquals(stmt.Where.Expr, q.WhereEquals)
 	return err
 }
 
+// addWhereEquals adds the dimension = 'string' comparisons that must all hold
+// for the given expression to be true to equals.
+func addWhereEquals(_e sqlparser.BoolExpr, equals map[string]string) {
+	switch e := _e.(type) {
+	case *sqlparser.AndExpr:
+		addWhereEquals(e.Left, equals)
+		addWhereEquals(e.Right, equals)
+	case *sqlparser.ParenBoolExpr:
+		addWhereEquals(e.Expr, equals)
+	case *sqlparser.ComparisonExpr:
+		if e.Operator != sqlparser.AST_EQ {
+			return
+		}
+		col, isCol := e.Left.(*sqlparser.ColName)
+		val, isVal := e.Right.(sqlparser.StrVal)
+		if !isCol || !isVal {
+			col, isCol = e.Right.(*sqlparser.ColName)
+			val, isVal = e.Left.(sqlparser.StrVal)
+		}
+		if !isCol || !isVal {
+			return
+		}
+		colName := strings.TrimSpace(strings.ToLower(string(col.Name)))
+		if _, err := strconv.ParseBool(colName); err == nil {
+			// not actually a column
+			return
+		}
+		equals[colName] = string(val)
+	}
+}
+
 func (q *Query) applyTimeRange(stmt *sqlparser.Select) error {
 	if stmt.TimeRange.From != "" {
 		t, d, err := stringToTimeOrDuration(stmt.TimeRange.From)
@@ -539,7 +937,7 @@ func (q *Query) applyGroupBy(stmt *sqlparser.Select) error {
 		fn, ok := nse.Expr.(*sqlparser.FuncExpr)
 		if ok && strings.EqualFold("PERIOD", string(fn.Name)) {
 			log.Trace("Detected period in group by")
-			if len(fn.Exprs) != 1 {
+			if len(fn.Exprs) < 1 || len(fn.Exprs) > 2 {
 				return ErrInvalidPeriod
 			}
 			res, err := nodeToDuration(fn.Exprs[0])
@@ -547,6 +945,13 @@ func (q *Query) applyGroupBy(stmt *sqlparser.Select) error {
 				return err
 			}
 			q.Resolution = res
+			if len(fn.Exprs) == 2 {
+				loc, err := nodeToLocation(fn.Exprs[1])
+				if err != nil {
+					return err
+				}
+				q.Location = loc
+			}
 		} else if ok && strings.EqualFold("STRIDE", string(fn.Name)) {
 			log.Trace("Detected stride in group by")
 			if len(fn.Exprs) != 1 {
@@ -671,7 +1076,10 @@ func (f *fielded) exprFor(_e sqlparser.Expr, defaultToSum bool) (interface{}, er
 		if fname == "IF" {
 			return f.ifExprFor(e, fname, defaultToSum)
 		}
-		if fname == "BOUNDED" {
+		if condAggregate, found := condAggregateFuncs[fname]; found {
+			return f.condAggregateExprFor(e, fname, condAggregate)
+		}
+		if fname == "BOUNDED" || fname == "CLAMP" {
 			return f.boundedExprFor(e, fname, defaultToSum)
 		}
 		if fname == "PERCENTILE" {
@@ -680,6 +1088,18 @@ func (f *fielded) exprFor(_e sqlparser.Expr, defaultToSum bool) (interface{}, er
 		if fname == "SHIFT" {
 			return f.shiftExprFor(e, fname, defaultToSum)
 		}
+		if fname == "EMA" {
+			return f.emaExprFor(e, fname)
+		}
+		if fname == "HISTOGRAM" {
+			return f.histogramExprFor(e, fname)
+		}
+		if fname == "COALESCE" {
+			return f.coalesceExprFor(e, defaultToSum)
+		}
+		if arity, isAggregate, found := expr.UDFArity(fname); found {
+			return f.udfExprFor(e, fname, arity, isAggregate)
+		}
 		switch len(e.Exprs) {
 		case 1:
 			return f.unaryFuncExprFor(e, fname, defaultToSum)
@@ -702,6 +1122,8 @@ func (f *fielded) exprFor(_e sqlparser.Expr, defaultToSum bool) (interface{}, er
 		return f.andExprFor(e, defaultToSum)
 	case *sqlparser.OrExpr:
 		return f.orExprFor(e, defaultToSum)
+	case *sqlparser.NullCheck:
+		return f.nullCheckExprFor(e, defaultToSum)
 	case *sqlparser.ParenBoolExpr:
 		// TODO: make sure that we don't need to worry about parens in our
 		// expression tree
@@ -759,8 +1181,41 @@ func (f *fielded) ifExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bo
 	return expr.IF(boolEx, valueEx), nil
 }
 
+// condAggregateExprFor builds conditional aggregates like SUMIF(bytes, status
+// >= 500), whose conditions can refer to fields as well as dimensions.
+func (f *fielded) condAggregateExprFor(e *sqlparser.FuncExpr, fname string, fn func(interface{}, goexpr.Expr) expr.Expr) (interface{}, error) {
+	if len(e.Exprs) != 2 {
+		return nil, fmt.Errorf("%v requires two parameters, like %v(b, status >= 500)", fname, fname)
+	}
+	_valueEx, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	condEx, ok := e.Exprs[1].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	valueEx, valueErr := f.exprFor(_valueEx.Expr, false)
+	if valueErr != nil {
+		return nil, valueErr
+	}
+	boolEx, boolErr := goExprFor(condEx.Expr)
+	if boolErr != nil {
+		return nil, boolErr
+	}
+	return fn(valueEx, boolEx), nil
+}
+
 func (f *fielded) boundedExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
-	if len(e.Exprs) != 3 {
+	policy := expr.OutOfRangeDrop
+	if fname == "CLAMP" {
+		if len(e.Exprs) != 3 {
+			return nil, ErrClampArity
+		}
+		policy = expr.OutOfRangeClamp
+	} else if len(e.Exprs) == 4 {
+		policy = strings.Trim(nodeToString(e.Exprs[3]), "'")
+	} else if len(e.Exprs) != 3 {
 		return nil, ErrBoundedArity
 	}
 	param0, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
@@ -781,13 +1236,13 @@ func (f *fielded) boundedExprFor(e *sqlparser.FuncExpr, fname string, defaultToS
 	}
 	min, err := strconv.ParseFloat(nodeToString(param1.Expr), 64)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse min parameter to BOUNDED: %v", err)
+		return nil, fmt.Errorf("Unable to parse min parameter to %v: %v", fname, err)
 	}
 	max, err := strconv.ParseFloat(nodeToString(param2.Expr), 64)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse max parameter to BOUNDED: %v", err)
+		return nil, fmt.Errorf("Unable to parse max parameter to %v: %v", fname, err)
 	}
-	return expr.BOUNDED(wrapped, min, max), nil
+	return expr.BoundedWithPolicy(wrapped, min, max, policy)
 }
 
 func (f *fielded) percentileExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
@@ -869,6 +1324,112 @@ func (f *fielded) shiftExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum
 	return expr.SHIFT(valueEx, offset), nil
 }
 
+func (f *fielded) emaExprFor(e *sqlparser.FuncExpr, fname string) (interface{}, error) {
+	if len(e.Exprs) != 2 {
+		return nil, ErrEMAArity
+	}
+	_valueEx, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	valueEx, valueErr := f.exprFor(_valueEx.Expr, false)
+	if valueErr != nil {
+		return nil, valueErr
+	}
+	alpha, err := nodeToFloat(e.Exprs[1])
+	if err != nil {
+		return nil, err
+	}
+	ex := expr.EMA(valueEx, alpha)
+	err = ex.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return ex, nil
+}
+
+func (f *fielded) histogramExprFor(e *sqlparser.FuncExpr, fname string) (interface{}, error) {
+	if len(e.Exprs) < 2 {
+		return nil, ErrHistogramArity
+	}
+	_valueEx, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	valueEx, valueErr := f.exprFor(_valueEx.Expr, false)
+	if valueErr != nil {
+		return nil, valueErr
+	}
+	bounds := make([]float64, 0, len(e.Exprs)-1)
+	for _, boundEx := range e.Exprs[1:] {
+		bound, err := nodeToFloat(boundEx)
+		if err != nil {
+			return nil, err
+		}
+		bounds = append(bounds, bound)
+	}
+	ex := expr.HISTOGRAM(valueEx, bounds...)
+	err := ex.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return ex, nil
+}
+
+// udfExprFor builds a user-defined function registered with the expr package.
+// The arguments to aggregates are fields, while the arguments to scalar
+// functions default to sums like the operands of arithmetic do.
+func (f *fielded) coalesceExprFor(e *sqlparser.FuncExpr, defaultToSum bool) (interface{}, error) {
+	if len(e.Exprs) == 0 {
+		return nil, ErrCoalesceArity
+	}
+	args := make([]interface{}, 0, len(e.Exprs))
+	for _, _param := range e.Exprs {
+		param, ok := _param.(*sqlparser.NonStarExpr)
+		if !ok {
+			return nil, ErrWildcardNotAllowed
+		}
+		arg, err := f.exprFor(param.Expr, defaultToSum)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return expr.COALESCE(args...), nil
+}
+
+// nullCheckExprFor builds IS NULL and IS NOT NULL checks on fields, which tell
+// apart periods for which a field has no value from ones where it's 0.
+func (f *fielded) nullCheckExprFor(e *sqlparser.NullCheck, defaultToSum bool) (interface{}, error) {
+	wrapped, err := f.exprFor(e.Expr, defaultToSum)
+	if err != nil {
+		return nil, err
+	}
+	if e.Operator == sqlparser.AST_IS_NOT_NULL {
+		return expr.ISNOTNULL(wrapped), nil
+	}
+	return expr.ISNULL(wrapped), nil
+}
+
+func (f *fielded) udfExprFor(e *sqlparser.FuncExpr, fname string, arity int, isAggregate bool) (interface{}, error) {
+	if len(e.Exprs) != arity {
+		return nil, fmt.Errorf("%v requires %d parameters", fname, arity)
+	}
+	args := make([]interface{}, 0, arity)
+	for _, _param := range e.Exprs {
+		param, ok := _param.(*sqlparser.NonStarExpr)
+		if !ok {
+			return nil, ErrWildcardNotAllowed
+		}
+		arg, err := f.exprFor(param.Expr, !isAggregate)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return expr.UDF(fname, args...)
+}
+
 func (f *fielded) unaryFuncExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
 	var fn func(interface{}) (expr.Expr, error)
 	_fn, ok := aggregateFuncs[fname]
@@ -1028,12 +1589,19 @@ func goExprFor(_e sqlparser.Expr) (goexpr.Expr, error) {
 			switch _right := e.Right.(type) {
 			case sqlparser.ValTuple:
 				list := make(goexpr.ArrayList, 0, len(_right))
+				strs := make([]string, 0, len(_right))
 				for _, ve := range _right {
 					valE, valErr := goExprFor(ve)
 					if valErr != nil {
 						return nil, valErr
 					}
 					list = append(list, valE)
+					if str, isStr := ve.(sqlparser.StrVal); isStr {
+						strs = append(strs, string(str))
+					}
+				}
+				if len(strs) == len(list) {
+					return newInStrings(left, list, strs), nil
 				}
 				right = list
 			case *sqlparser.Subquery:
@@ -1066,6 +1634,19 @@ func goExprFor(_e sqlparser.Expr) (goexpr.Expr, error) {
 			}
 			return goexpr.In(left, right), nil
 		}
+		if pattern, isRegex := regexFor(e.Right); isRegex {
+			// dim =~ 'regex' parses as dim = ~'regex'
+			switch op {
+			case "=":
+				return MATCHES(left, pattern)
+			case "<>", "!=":
+				matchesEx, matchesErr := MATCHES(left, pattern)
+				if matchesErr != nil {
+					return nil, matchesErr
+				}
+				return goexpr.Not(matchesEx), nil
+			}
+		}
 		right, err := goExprFor(e.Right)
 		if err != nil {
 			return nil, err
@@ -1117,6 +1698,16 @@ func goExprFor(_e sqlparser.Expr) (goexpr.Expr, error) {
 	}
 }
 
+// regexFor returns the pattern of a regular expression like ~'^/api/'.
+func regexFor(e sqlparser.ValExpr) (string, bool) {
+	unary, ok := e.(*sqlparser.UnaryExpr)
+	if !ok || unary.Operator != sqlparser.AST_TILDA {
+		return "", false
+	}
+	pattern, ok := unary.Expr.(sqlparser.StrVal)
+	return string(pattern), ok
+}
+
 func goFnExprFor(e *sqlparser.FuncExpr, fname string) (goexpr.Expr, error) {
 	alias, foundAlias := aliases[fname]
 	if foundAlias {
@@ -1233,6 +1824,15 @@ func nodeToDuration(node sqlparser.SQLNode) (time.Duration, error) {
 	return dur, err
 }
 
+func nodeToLocation(node sqlparser.SQLNode) (*time.Location, error) {
+	str := nodeToString(node)
+	loc, err := time.LoadLocation(strings.Trim(str, "'"))
+	if err != nil {
+		err = fmt.Errorf("Unable to load time zone %v: %v", str, err)
+	}
+	return loc, err
+}
+
 func nodeToFloat(node sqlparser.SQLNode) (float64, error) {
 	str := nodeToString(node)
 	val, err := strconv.ParseFloat(str, 64)
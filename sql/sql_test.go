@@ -2,9 +2,11 @@ package sql
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/getlantern/bytemap"
 	"github.com/getlantern/goexpr"
 	"github.com/getlantern/goexpr/geo"
 	"github.com/getlantern/goexpr/isp"
@@ -353,6 +355,15 @@ LIMIT 100, 10
 	assert.Equal(t, 10, q.Limit)
 	assert.Equal(t, 100, q.Offset)
 	assert.True(t, q.ForceFresh)
+	assert.Empty(t, q.WhereEquals, "equality comparisons under an OR shouldn't be required")
+}
+
+func TestWhereEquals(t *testing.T) {
+	q, err := Parse("SELECT * FROM the_table WHERE a = 'x' AND ('y' = B AND c = 5) AND (d = 'z' OR e = 'w') AND f != 'v'")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]string{"a": "x", "b": "y"}, q.WhereEquals)
 }
 
 func TestFromSubQuery(t *testing.T) {
@@ -406,6 +417,131 @@ GROUP BY A, period('10s')
 	assert.False(t, q.ForceFresh)
 }
 
+func TestWith(t *testing.T) {
+	q, err := Parse(`
+WITH base AS (SELECT * FROM the_table WHERE x = 'a)b' GROUP BY y),
+	-- comment with (parens
+	errors AS (SELECT SUM(errors) AS errors FROM Base GROUP BY y)
+SELECT errors FROM errors
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.NotNil(t, q.FromSubQuery) && assert.NotNil(t, q.FromSubQuery.FromSubQuery) {
+		assert.Equal(t, "the_table", q.FromSubQuery.FromSubQuery.From)
+		assert.False(t, q.FromSubQuery.Materialize)
+		assert.False(t, q.FromSubQuery.FromSubQuery.Materialize)
+	}
+	assert.False(t, q.Materialize)
+
+	q, err = Parse(`
+WITH ids AS (SELECT _points FROM the_table WHERE x = 'a' GROUP BY id)
+SELECT * FROM the_table WHERE id IN (SELECT id FROM ids) OR parent_id IN (SELECT id FROM ids)
+`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "the_table", q.From)
+		assert.Equal(t, 2, strings.Count(q.SQL, "(select /* materialize */ _points from the_table where x = 'a' group by id)"), "Common table expression referenced twice should be inlined and materialized")
+	}
+
+	_, err = Parse("WITH a AS (SELECT * FROM t), a AS (SELECT * FROM t) SELECT * FROM a")
+	assert.Error(t, err, "Duplicate common table expression should fail")
+	_, err = Parse("WITH a (SELECT * FROM t) SELECT * FROM a")
+	assert.Error(t, err, "Missing AS should fail")
+	_, err = Parse("WITH a AS (SELECT * FROM t SELECT * FROM a")
+	assert.Error(t, err, "Unbalanced parentheses should fail")
+}
+
+func TestTables(t *testing.T) {
+	q, err := Parse(`
+WITH base AS (SELECT * FROM Table_A WHERE x IN (SELECT x FROM table_b))
+SELECT * FROM (SELECT * FROM base) WHERE y IN (SELECT y FROM table_c WHERE z IN (SELECT z FROM table_a))
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tables, err := q.Tables()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"table_a", "table_b", "table_c"}, tables)
+	}
+}
+
+func TestShowSettings(t *testing.T) {
+	like, ok, err := ShowSettings(" show SETTINGS;")
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.True(t, like("anything"))
+	}
+
+	like, ok, err = ShowSettings("SHOW SETTINGS LIKE 'max%_size'")
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.True(t, like("MaxWALSize"))
+		assert.False(t, like("MaxWALSizes"))
+		assert.False(t, like("WALCompressionSize"))
+	}
+
+	_, ok, _ = ShowSettings("SELECT * FROM settings")
+	assert.False(t, ok)
+	_, ok, _ = ShowSettings("SHOW TABLES")
+	assert.False(t, ok)
+	_, ok, err = ShowSettings("SHOW SETTINGS LIKE max")
+	assert.True(t, ok)
+	assert.Error(t, err, "Unquoted pattern should fail")
+	_, ok, err = ShowSettings("SHOW SETTINGS extra")
+	assert.True(t, ok)
+	assert.Error(t, err, "Trailing text should fail")
+}
+
+func TestShowTables(t *testing.T) {
+	ok, err := ShowTables(" show TABLES;")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, _ = ShowTables("SHOW SETTINGS")
+	assert.False(t, ok)
+	ok, err = ShowTables("SHOW TABLES extra")
+	assert.True(t, ok)
+	assert.Error(t, err, "Trailing text should fail")
+}
+
+func TestDescribe(t *testing.T) {
+	table, ok, err := Describe("describe Table_A;")
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, "table_a", table)
+	}
+	table, ok, err = Describe("DESCRIBE `table_a@before-incident`")
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, "table_a@before-incident", table)
+	}
+
+	_, ok, _ = Describe("SELECT * FROM describe")
+	assert.False(t, ok)
+	_, ok, err = Describe("DESCRIBE")
+	assert.True(t, ok)
+	assert.Error(t, err, "Missing table should fail")
+	_, ok, err = Describe("DESCRIBE table_a table_b")
+	assert.True(t, ok)
+	assert.Error(t, err, "Trailing text should fail")
+}
+
+func TestExplain(t *testing.T) {
+	q, err := Parse(`
+  explain SELECT SUM(a) AS a FROM Table_A`)
+	if assert.NoError(t, err) {
+		assert.True(t, q.Explain)
+		assert.Equal(t, "table_a", q.From)
+		assert.NotContains(t, q.SQL, "explain")
+	}
+
+	q, err = Parse("SELECT SUM(explained) AS explained FROM Table_A")
+	if assert.NoError(t, err) {
+		assert.False(t, q.Explain)
+	}
+
+	table, err := TableFor("EXPLAIN SELECT * FROM Table_A")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "table_a", table)
+	}
+}
+
 func TestSQLDefaults(t *testing.T) {
 	q, err := Parse(`
 SELECT _
@@ -422,6 +558,247 @@ FROM Table_A
 	assert.True(t, q.GroupByAll)
 }
 
+func TestAnnotations(t *testing.T) {
+	q, err := Parse(`
+SELECT -- annotations
+	SUM(a) AS a
+FROM Table_A
+`)
+	if assert.NoError(t, err) {
+		assert.True(t, q.Annotate)
+		assert.Empty(t, q.AnnotationCategories)
+	}
+
+	q, err = Parse(`
+SELECT -- force_fresh annotations(Deploy, incident)
+	SUM(a) AS a
+FROM Table_A
+`)
+	if assert.NoError(t, err) {
+		assert.True(t, q.ForceFresh)
+		assert.True(t, q.Annotate)
+		assert.Equal(t, []string{"deploy", "incident"}, q.AnnotationCategories)
+	}
+
+	q, err = Parse(`SELECT SUM(a) AS a FROM Table_A`)
+	if assert.NoError(t, err) {
+		assert.False(t, q.Annotate)
+	}
+}
+
+func TestIncludeWALTail(t *testing.T) {
+	q, err := Parse(`
+SELECT -- include_wal_tail
+	SUM(a) AS a
+FROM Table_A
+`)
+	if assert.NoError(t, err) {
+		assert.True(t, q.IncludeWALTail)
+		assert.True(t, q.ForceFresh, "including the WAL tail should imply force_fresh")
+	}
+
+	q, err = Parse(`SELECT SUM(a) AS a FROM Table_A`)
+	if assert.NoError(t, err) {
+		assert.False(t, q.IncludeWALTail)
+	}
+}
+
+func TestLimitHints(t *testing.T) {
+	q, err := Parse(`
+SELECT -- max_rows_scanned(1000) MAX_MEMORY(2048) max_duration(30s)
+	SUM(a) AS a
+FROM Table_A
+`)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1000, q.MaxRowsScanned)
+		assert.EqualValues(t, 2048, q.MaxMemory)
+		assert.Equal(t, 30*time.Second, q.MaxDuration)
+	}
+
+	q, err = Parse(`SELECT SUM(a) AS a FROM Table_A`)
+	if assert.NoError(t, err) {
+		assert.Zero(t, q.MaxRowsScanned)
+		assert.Zero(t, q.MaxMemory)
+		assert.Zero(t, q.MaxDuration)
+	}
+
+	_, err = Parse(`SELECT /* max_rows_scanned(lots) */ SUM(a) AS a FROM Table_A`)
+	assert.Error(t, err)
+	_, err = Parse(`SELECT /* max_duration(-5s) */ SUM(a) AS a FROM Table_A`)
+	assert.Error(t, err)
+}
+
+func TestCrosstabHints(t *testing.T) {
+	q, err := Parse(`SELECT -- crosstab_order(TOTAL) crosstab_limit(10)
+	SUM(a) AS a
+FROM Table_A
+GROUP BY CROSSTAB(b, c)`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "total", q.CrosstabOrder)
+		assert.Equal(t, 10, q.CrosstabLimit)
+		assert.NotNil(t, q.Crosstab)
+	}
+
+	_, err = Parse(`SELECT /* crosstab_order(random) */ SUM(a) AS a FROM Table_A GROUP BY CROSSTAB(b)`)
+	assert.Error(t, err)
+	_, err = Parse(`SELECT /* crosstab_limit(0) */ SUM(a) AS a FROM Table_A GROUP BY CROSSTAB(b)`)
+	assert.Error(t, err)
+}
+
+func TestGroupByExpressions(t *testing.T) {
+	q, err := Parse(`SELECT SUM(a) AS a
+FROM Table_A
+GROUP BY SUBSTR(path, 0, 4) AS prefix, CONCAT('-', dc, rack) AS location, BUCKET(latency, 100) AS latency_bucket`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, q.GroupBy, 3) {
+		dims := bytemap.New(map[string]interface{}{"path": "/api/users", "dc": "us", "rack": 3, "latency": 257})
+		assert.Equal(t, 200, q.GroupBy[0].Expr.Eval(dims))
+		assert.Equal(t, "us-3", q.GroupBy[1].Expr.Eval(dims))
+		assert.Equal(t, "/api", q.GroupBy[2].Expr.Eval(dims))
+	}
+
+	assert.Equal(t, 2.5, BUCKET(goexpr.Param("a"), goexpr.Constant(0.5)).Eval(bytemap.New(map[string]interface{}{"a": 2.7})))
+	assert.Equal(t, 100, BUCKET(goexpr.Param("a"), goexpr.Constant(50)).Eval(bytemap.New(map[string]interface{}{"a": "120"})))
+	assert.Nil(t, BUCKET(goexpr.Param("a"), goexpr.Constant(50)).Eval(bytemap.New(map[string]interface{}{"a": "abc"})))
+	assert.Nil(t, BUCKET(goexpr.Param("a"), goexpr.Constant(0)).Eval(bytemap.New(map[string]interface{}{"a": 5})))
+
+	_, err = Parse("SELECT SUM(a) AS a FROM Table_A GROUP BY BUCKET(latency, 100)")
+	assert.Error(t, err, "computed grouping keys need to be named")
+}
+
+func TestWhereInAndRegex(t *testing.T) {
+	q, err := Parse(`SELECT * FROM Table_A WHERE a IN ('x', 'y', 'z') AND b =~ '^/api/' AND c != ~'(?i)test' AND d IN (1, 2)`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	check := func(dims map[string]interface{}) bool {
+		return q.Where.Eval(bytemap.New(dims)).(bool)
+	}
+	assert.True(t, check(map[string]interface{}{"a": "y", "b": "/api/users", "c": "prod", "d": 2}))
+	assert.False(t, check(map[string]interface{}{"a": "w", "b": "/api/users", "c": "prod", "d": 2}), "a not in list")
+	assert.False(t, check(map[string]interface{}{"a": "y", "b": "/web/users", "c": "prod", "d": 2}), "b doesn't match")
+	assert.False(t, check(map[string]interface{}{"a": "y", "b": "/api/users", "c": "MyTest", "d": 2}), "c matches")
+	assert.False(t, check(map[string]interface{}{"a": "y", "c": "prod", "d": 2}), "missing b doesn't match")
+	assert.False(t, check(map[string]interface{}{"a": "y", "b": "/api/users", "c": "prod", "d": 3}), "d not in list")
+	assert.Empty(t, q.WhereEquals)
+
+	_, err = Parse(`SELECT * FROM Table_A WHERE b =~ '(unclosed'`)
+	assert.Error(t, err)
+}
+
+func TestWithAsOf(t *testing.T) {
+	asOf := time.Date(2020, 1, 1, 0, 0, 0, 500, time.UTC)
+	for _, sqlString := range []string{
+		"SELECT a FROM table_a WHERE b = 1",
+		"SELECT a FROM table_a ASOF '-1h' UNTIL '-5m' WHERE b = 1",
+	} {
+		withAsOf, err := WithAsOf(sqlString, asOf)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		q, err := Parse(withAsOf)
+		if assert.NoError(t, err) {
+			assert.Equal(t, asOf, q.AsOf)
+			assert.Contains(t, q.WhereSQL, "b = 1", "Should keep WHERE")
+		}
+	}
+	q, _ := Parse("SELECT a FROM table_a ASOF '-1h' UNTIL '-5m'")
+	withAsOf, _ := WithAsOf(q.SQL, asOf)
+	q, _ = Parse(withAsOf)
+	assert.Equal(t, -5*time.Minute, q.UntilOffset, "Should keep UNTIL")
+}
+
+func TestWithTimeRange(t *testing.T) {
+	asOf := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := asOf.Add(time.Hour)
+	for _, sqlString := range []string{
+		"SELECT a FROM table_a WHERE b = 1",
+		"SELECT a FROM table_a ASOF '-1h' UNTIL '-5m' WHERE b = 1 GROUP BY c",
+		"SELECT a FROM table_a GROUP BY c, period(1m)",
+	} {
+		withTimeRange, err := WithTimeRange(sqlString, asOf, until, 5*time.Minute)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		q, err := Parse(withTimeRange)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, asOf, q.AsOf)
+		assert.Equal(t, until, q.Until)
+		if strings.Contains(sqlString, "period") {
+			assert.Equal(t, time.Minute, q.Resolution, "Should keep explicit period")
+		} else {
+			assert.Equal(t, 5*time.Minute, q.Resolution)
+		}
+		if strings.Contains(sqlString, "GROUP BY") {
+			assert.False(t, q.GroupByAll)
+			assert.Len(t, q.GroupBy, 1)
+		} else {
+			assert.True(t, q.GroupByAll, "Should keep grouping by all dimensions")
+		}
+	}
+}
+
+func TestPeriodLocation(t *testing.T) {
+	q, err := Parse("SELECT a FROM table_a GROUP BY c, period('1d', 'America/New_York')")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 24*time.Hour, q.Resolution)
+		if assert.NotNil(t, q.Location) {
+			assert.Equal(t, "America/New_York", q.Location.String())
+		}
+	}
+	q, err = Parse("SELECT a FROM table_a GROUP BY c, period('1d')")
+	if assert.NoError(t, err) {
+		assert.Nil(t, q.Location, "Period without time zone should use UTC")
+	}
+	_, err = Parse("SELECT a FROM table_a GROUP BY c, period('1d', 'Nowhere/Special')")
+	assert.Error(t, err, "Unknown time zone should fail")
+	_, err = Parse("SELECT a FROM table_a GROUP BY c, period('1d', 'UTC', 'extra')")
+	assert.Equal(t, ErrInvalidPeriod, err)
+}
+
+func TestBind(t *testing.T) {
+	ts := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	bound, err := Bind(`SELECT -- limit(?)
+ x FROM t ASOF ? UNTIL ? WHERE a = ? AND b = '?' AND c IN (?) AND d <> ? AND e = ? AND g IS ?`,
+		-1*time.Hour, ts, `it's a \ test`, []int{1, 2}, 2.5, true, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `SELECT -- limit(?)
+ x FROM t ASOF '-1h0m0s' UNTIL '2017-06-01T12:00:00Z' WHERE a = 'it''s a \\ test' AND b = '?' AND c IN (1, 2) AND d <> 2.5 AND e = true AND g IS NULL`, bound)
+		q, err := Parse(bound)
+		if assert.NoError(t, err) {
+			assert.Equal(t, -1*time.Hour, q.AsOfOffset)
+			assert.Equal(t, ts, q.Until.UTC())
+			assert.Contains(t, q.Where.String(), `it's a \ test`)
+		}
+	}
+
+	_, err = Bind("SELECT x FROM t WHERE a = ?")
+	assert.Error(t, err, "missing parameter")
+	_, err = Bind("SELECT x FROM t", 1)
+	assert.Error(t, err, "extra parameter")
+	_, err = Bind("SELECT x FROM t WHERE a = 'oops")
+	assert.Error(t, err, "unterminated string")
+	_, err = Bind("SELECT x FROM t WHERE a = ?", struct{}{})
+	assert.Error(t, err, "unsupported type")
+
+	prepared, err := Prepare("SELECT x FROM t WHERE a = ? AND b = '?' AND c IN (?)")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, prepared.NumParams())
+		bound, err = prepared.Bind(1, []string{"a", "b"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "SELECT x FROM t WHERE a = 1 AND b = '?' AND c IN ('a', 'b')", bound)
+		}
+		bound, err = prepared.Bind(2, "c")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "SELECT x FROM t WHERE a = 2 AND b = '?' AND c IN ('c')", bound)
+		}
+	}
+}
+
 func TestParseIt(t *testing.T) {
 	_, err := Parse(`select * from TableA  group by concat('_', ct1, concat('|', ct2)) as _crosstab`)
 	assert.NoError(t, err)
@@ -451,3 +828,196 @@ func (e *testexpr) WalkLists(cb func(goexpr.List)) {
 func (e *testexpr) String() string {
 	return fmt.Sprintf("TEST(%v)", e.val.String())
 }
+
+func TestPartitionFailureHint(t *testing.T) {
+	q, err := Parse(`SELECT -- on_partition_failure(Retry)
+	SUM(a) AS a FROM Table_A`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, PartitionFailureRetry, q.OnPartitionFailure)
+	}
+
+	q, err = Parse(`SELECT SUM(a) AS a FROM Table_A`)
+	if assert.NoError(t, err) {
+		assert.Empty(t, q.OnPartitionFailure)
+	}
+
+	_, err = Parse(`SELECT /* on_partition_failure(panic) */ SUM(a) AS a FROM Table_A`)
+	assert.Error(t, err)
+}
+
+func TestUDF(t *testing.T) {
+	RegisterScalarUDF(&ScalarUDF{
+		Name:  "SCORE",
+		Arity: 2,
+		Calc: func(args []float64) float64 {
+			return args[0]*10 + args[1]
+		},
+	})
+	RegisterAggregateUDF(&AggregateUDF{
+		Name:      "SUMSQ",
+		Arity:     1,
+		StateSize: 1,
+		Update:    func(state []float64, args []float64) { state[0] += args[0] * args[0] },
+		Merge:     func(state []float64, other []float64) { state[0] += other[0] },
+		Get:       func(state []float64) float64 { return state[0] },
+	})
+
+	q, err := Parse(`SELECT score(a, sumsq(b)) AS s, SUMSQ(b) AS sq FROM Table_A`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, fields, 2) {
+		assert.Equal(t, "SCORE(SUM(a), SUMSQ(b))", fields[0].Expr.String())
+		assert.Equal(t, "SUMSQ(b)", fields[1].Expr.String())
+	}
+
+	q, err = Parse(`SELECT score(a) AS s FROM Table_A`)
+	if assert.NoError(t, err) {
+		_, err = q.Fields.Get(nil)
+		assert.Error(t, err, "wrong number of parameters")
+	}
+}
+
+func TestConditionalAggregates(t *testing.T) {
+	q, err := Parse(`SELECT SUMIF(bytes, status >= 500 AND server = 'a') AS error_bytes, COUNTIF(bytes, status >= 500) AS errors, AVGIF(bytes, status < 500) AS avg_ok_bytes FROM Table_A`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, fields, 3) {
+		assert.Equal(t, "IF(((status >= 500) AND (server == a)), SUM(bytes))", fields[0].Expr.String())
+		assert.Equal(t, "IF((status >= 500), COUNT(bytes))", fields[1].Expr.String())
+		assert.Equal(t, "IF((status < 500), AVG(bytes))", fields[2].Expr.String())
+	}
+
+	q, err = Parse(`SELECT SUMIF(bytes) AS b FROM Table_A`)
+	if assert.NoError(t, err) {
+		_, err = q.Fields.Get(nil)
+		assert.Error(t, err, "missing condition")
+	}
+}
+
+func TestBoundedPolicies(t *testing.T) {
+	q, err := Parse(`SELECT AVG(CLAMP(duration, 0, 3600)) AS clamped, AVG(BOUNDED(duration, 0, 3600, 'clamp')) AS clamped2, AVG(BOUNDED(duration, 0, 3600, 'drop')) AS dropped FROM Table_A`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, fields, 3) {
+		assert.Equal(t, AVG(CLAMP("duration", 0, 3600)).String(), fields[0].Expr.String())
+		assert.Equal(t, AVG(CLAMP("duration", 0, 3600)).String(), fields[1].Expr.String())
+		assert.Equal(t, AVG(BOUNDED("duration", 0, 3600)).String(), fields[2].Expr.String())
+	}
+
+	for _, invalid := range []string{
+		`SELECT BOUNDED(duration, 0, 3600, 'wrap') AS d FROM Table_A`,
+		`SELECT CLAMP(duration, 0, 3600, 'clamp') AS d FROM Table_A`,
+	} {
+		q, err = Parse(invalid)
+		if assert.NoError(t, err) {
+			_, err = q.Fields.Get(nil)
+			assert.Error(t, err, invalid)
+		}
+	}
+}
+
+func TestEMA(t *testing.T) {
+	q, err := Parse(`SELECT EMA(load, 0.3) AS smoothed_load FROM Table_A`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if assert.NoError(t, err) && assert.Len(t, fields, 1) {
+		assert.Equal(t, EMA("load", 0.3).String(), fields[0].Expr.String())
+	}
+
+	for _, invalid := range []string{
+		`SELECT EMA(load) AS smoothed_load FROM Table_A`,
+		`SELECT EMA(load, 0) AS smoothed_load FROM Table_A`,
+		`SELECT EMA(load, 'x') AS smoothed_load FROM Table_A`,
+	} {
+		q, err = Parse(invalid)
+		if assert.NoError(t, err) {
+			_, err = q.Fields.Get(nil)
+			assert.Error(t, err, invalid)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	q, err := Parse(`SELECT HISTOGRAM(latency, 10, 100, 1000) AS latency_hist FROM Table_A`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	known, err := q.Fields.Get(nil)
+	if !assert.NoError(t, err) || !assert.Len(t, known, 1) {
+		return
+	}
+	assert.Equal(t, HISTOGRAM("latency", 10, 100, 1000).String(), known[0].Expr.String())
+
+	q, err = Parse(`SELECT HISTOGRAM_BUCKETS(latency_hist), HISTOGRAM_BUCKETS(HISTOGRAM(size, 1)) AS size FROM Table_A`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(known)
+	if assert.NoError(t, err) {
+		var names []string
+		for _, field := range fields {
+			names = append(names, field.Name)
+		}
+		assert.Equal(t, []string{"le_10_latency_hist", "le_100_latency_hist", "le_1000_latency_hist", "gt_1000_latency_hist", "le_1_size", "gt_1_size"}, names)
+	}
+
+	for _, invalid := range []string{
+		`SELECT HISTOGRAM(latency) AS h FROM Table_A`,
+		`SELECT HISTOGRAM(latency, 100, 10) AS h FROM Table_A`,
+		`SELECT HISTOGRAM_BUCKETS(latency) FROM Table_A`,
+	} {
+		q, err = Parse(invalid)
+		if assert.NoError(t, err) {
+			_, err = q.Fields.Get(known)
+			assert.Error(t, err, invalid)
+		}
+	}
+}
+
+func TestNulls(t *testing.T) {
+	q, err := Parse(`SELECT COALESCE(SUM(b) / SUM(c), 0) AS ratio FROM Table_A HAVING b IS NULL OR c IS NOT NULL`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if assert.NoError(t, err) && assert.Len(t, fields, 2) {
+		assert.Equal(t, COALESCE(DIV(SUM("b"), SUM("c")), 0).String(), fields[0].Expr.String())
+		assert.Equal(t, OR(ISNULL(SUM("b")), ISNOTNULL(SUM("c"))).String(), fields[1].Expr.String())
+	}
+}
+
+func TestDimColumns(t *testing.T) {
+	q, err := Parse(`SELECT SUBSTR(path, 0, 4) AS Prefix, ISUM(bytes) AS bytes, ICOUNT(bytes) AS requests FROM Table_A GROUP BY path`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, q.DimColumns, 1) {
+		assert.Equal(t, "prefix", q.DimColumns[0].Name)
+		assert.Equal(t, goexpr.Substr(goexpr.Param("path"), goexpr.Constant(0), goexpr.Constant(4)).String(), q.DimColumns[0].Expr.String())
+	}
+	fields, err := q.Fields.Get(nil)
+	if assert.NoError(t, err) && assert.Len(t, fields, 2) {
+		assert.Equal(t, ISUM("bytes").String(), fields[0].Expr.String())
+		assert.Equal(t, ICOUNT("bytes").String(), fields[1].Expr.String())
+	}
+
+	_, err = Parse(`SELECT SUBSTR(path, 0, 4), SUM(bytes) AS bytes FROM Table_A GROUP BY path`)
+	assert.Error(t, err, "Dimension columns without a name should be rejected")
+}
@@ -0,0 +1,261 @@
+package sql
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/getlantern/sqlparser"
+)
+
+const (
+	materializeHint = "/* materialize */"
+)
+
+// cte is a common table expression from a WITH clause
+type cte struct {
+	name       string
+	stmt       *sqlparser.Select
+	references int
+}
+
+// parseSelect parses a SELECT statement, ignoring any EXPLAIN prefix and
+// expanding any WITH clause by inlining its common table expressions as
+// subqueries wherever they're referenced in a FROM clause. Common table
+// expressions that are referenced more than once are marked with a materialize
+// hint so that the planner only evaluates them once.
+func parseSelect(sql string) (*sqlparser.Select, error) {
+	sql, _ = Explain(sql)
+	ctes, rest, err := splitWith(sql)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := parseSelectOnly(rest)
+	if err != nil || len(ctes) == 0 {
+		return stmt, err
+	}
+
+	byName := make(map[string]*cte, len(ctes))
+	for _, c := range ctes {
+		inlineCTEs(c.stmt, byName)
+		byName[c.name] = c
+	}
+	inlineCTEs(stmt, byName)
+	for _, c := range ctes {
+		if c.references > 1 {
+			c.stmt.Comments = append(sqlparser.Comments{[]byte(materializeHint)}, c.stmt.Comments...)
+		}
+	}
+
+	// Reparse the expanded statement so that inlined subqueries don't share
+	// nodes
+	return parseSelectOnly(nodeToString(stmt))
+}
+
+func parseSelectOnly(sql string) (*sqlparser.Select, error) {
+	parsed, err := sqlparser.Parse(sql)
+	if err != nil {
+		return nil, err
+	}
+	stmt, ok := parsed.(*sqlparser.Select)
+	if !ok {
+		return nil, fmt.Errorf("Only SELECT statements are supported, not %v", sql)
+	}
+	return stmt, nil
+}
+
+// splitWith splits the common table expressions in a leading WITH clause like
+// "WITH a AS (SELECT ...), b AS (SELECT ...)" from the rest of the statement.
+func splitWith(sql string) ([]*cte, string, error) {
+	s := &scanner{sql: sql}
+	s.skipSpace()
+	if !s.keyword("with") {
+		return nil, sql, nil
+	}
+
+	var ctes []*cte
+	names := make(map[string]bool)
+	for {
+		s.skipSpace()
+		name := strings.ToLower(s.identifier())
+		if name == "" {
+			return nil, "", fmt.Errorf("Expected name of common table expression at position %d of WITH clause", s.pos)
+		}
+		if names[name] {
+			return nil, "", fmt.Errorf("Common table expression %v defined more than once", name)
+		}
+		names[name] = true
+		s.skipSpace()
+		if !s.keyword("as") {
+			return nil, "", fmt.Errorf("Expected AS after %v in WITH clause", name)
+		}
+		s.skipSpace()
+		body, err := s.parenthesized()
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid definition of %v in WITH clause: %v", name, err)
+		}
+		stmt, err := parseSelectOnly(body)
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable to parse %v in WITH clause: %v", name, err)
+		}
+		ctes = append(ctes, &cte{name: name, stmt: stmt})
+		s.skipSpace()
+		if s.pos >= len(sql) || sql[s.pos] != ',' {
+			break
+		}
+		s.pos++
+	}
+	return ctes, sql[s.pos:], nil
+}
+
+// inlineCTEs replaces references to the given common table expressions in
+// the FROM clauses of node and any of its subqueries with the corresponding
+// subqueries.
+func inlineCTEs(node sqlparser.SQLNode, ctes map[string]*cte) {
+	walkNodes(reflect.ValueOf(node), func(node interface{}) {
+		te, ok := node.(*sqlparser.AliasedTableExpr)
+		if !ok {
+			return
+		}
+		table, ok := te.Expr.(*sqlparser.TableName)
+		if !ok || table.Qualifier != nil {
+			return
+		}
+		c := ctes[strings.ToLower(string(table.Name))]
+		if c != nil {
+			c.references++
+			te.Expr = &sqlparser.Subquery{Select: c.stmt}
+		}
+	})
+}
+
+func walkNodes(val reflect.Value, cb func(node interface{})) {
+	if !val.IsValid() {
+		return
+	}
+	switch val.Kind() {
+	case reflect.Interface:
+		walkNodes(val.Elem(), cb)
+	case reflect.Ptr:
+		if val.IsNil() {
+			return
+		}
+		cb(val.Interface())
+		walkNodes(val.Elem(), cb)
+	case reflect.Slice:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			// Raw bytes like names and values
+			return
+		}
+		for i := 0; i < val.Len(); i++ {
+			walkNodes(val.Index(i), cb)
+		}
+	case reflect.Struct:
+		for i := 0; i < val.NumField(); i++ {
+			walkNodes(val.Field(i), cb)
+		}
+	}
+}
+
+// scanner scans the parts of a WITH clause, skipping over comments and quoted
+// strings.
+type scanner struct {
+	sql string
+	pos int
+}
+
+func (s *scanner) skipSpace() {
+	for s.pos < len(s.sql) {
+		switch {
+		case strings.HasPrefix(s.sql[s.pos:], "--"):
+			s.skipPast("\n")
+		case strings.HasPrefix(s.sql[s.pos:], "/*"):
+			s.skipPast("*/")
+		case strings.ContainsRune(" \t\r\n", rune(s.sql[s.pos])):
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (s *scanner) skipPast(end string) {
+	idx := strings.Index(s.sql[s.pos:], end)
+	if idx < 0 {
+		s.pos = len(s.sql)
+		return
+	}
+	s.pos += idx + len(end)
+}
+
+// keyword consumes the given keyword if it's next
+func (s *scanner) keyword(keyword string) bool {
+	end := s.pos + len(keyword)
+	if end > len(s.sql) || !strings.EqualFold(s.sql[s.pos:end], keyword) {
+		return false
+	}
+	if end < len(s.sql) && isIdentifierChar(s.sql[end]) {
+		return false
+	}
+	s.pos = end
+	return true
+}
+
+func (s *scanner) identifier() string {
+	if s.pos < len(s.sql) && s.sql[s.pos] == '`' {
+		end := strings.IndexByte(s.sql[s.pos+1:], '`')
+		if end < 0 {
+			return ""
+		}
+		identifier := s.sql[s.pos+1 : s.pos+1+end]
+		s.pos += end + 2
+		return identifier
+	}
+	start := s.pos
+	for s.pos < len(s.sql) && isIdentifierChar(s.sql[s.pos]) {
+		s.pos++
+	}
+	return s.sql[start:s.pos]
+}
+
+// parenthesized consumes a parenthesized expression and returns what's inside
+// of the parentheses.
+func (s *scanner) parenthesized() (string, error) {
+	if s.pos >= len(s.sql) || s.sql[s.pos] != '(' {
+		return "", fmt.Errorf("expected ( at position %d", s.pos)
+	}
+	start := s.pos + 1
+	depth := 0
+	for s.pos < len(s.sql) {
+		c := s.sql[s.pos]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := strings.IndexByte(s.sql[s.pos+1:], c)
+			if end < 0 {
+				return "", fmt.Errorf("unterminated %c at position %d", c, s.pos)
+			}
+			s.pos += end + 2
+			continue
+		case strings.HasPrefix(s.sql[s.pos:], "--"):
+			s.skipPast("\n")
+			continue
+		case strings.HasPrefix(s.sql[s.pos:], "/*"):
+			s.skipPast("*/")
+			continue
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				s.pos++
+				return s.sql[start : s.pos-1], nil
+			}
+		}
+		s.pos++
+	}
+	return "", fmt.Errorf("missing ) for ( at position %d", start-1)
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
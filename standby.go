@@ -0,0 +1,33 @@
+package zenodb
+
+import (
+	"sync/atomic"
+
+	"github.com/getlantern/errors"
+)
+
+// Standby indicates whether this follower is a hot standby that follows its
+// partition's data but doesn't handle queries until it's promoted.
+func (db *DB) Standby() bool {
+	return atomic.LoadInt32(&db.standby) == 1
+}
+
+// Promote makes a hot standby follower start handling queries for its
+// partition, including it in query routing from then on.
+func (db *DB) Promote() error {
+	if db.opts.Follow == nil {
+		return errors.New("Only followers can be promoted")
+	}
+	if !atomic.CompareAndSwapInt32(&db.standby, 1, 0) {
+		return errors.New("Follower %d (%v) is not on standby", db.opts.Partition, db.opts.FollowerName)
+	}
+	log.Debugf("Promoted follower %d (%v), handling queries", db.opts.Partition, db.opts.FollowerName)
+	db.registerRemoteQueryHandler()
+	return nil
+}
+
+func (db *DB) registerRemoteQueryHandler() {
+	if db.opts.RegisterRemoteQueryHandler != nil {
+		go db.opts.RegisterRemoteQueryHandler(db.opts.Partition, db.queryForRemote)
+	}
+}
@@ -0,0 +1,51 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStandby(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var registered int32
+	db, err := NewDB(&DBOpts{
+		Dir:          tmpDir,
+		Partition:    1,
+		FollowerName: "standby",
+		Standby:      true,
+		Follow:       func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error) {},
+		RegisterRemoteQueryHandler: func(partition int, query planner.QueryClusterFN) {
+			assert.Equal(t, 1, partition)
+			atomic.AddInt32(&registered, 1)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, db.Standby())
+	assert.EqualValues(t, 0, atomic.LoadInt32(&registered), "standby shouldn't handle queries")
+
+	if !assert.NoError(t, db.Promote()) {
+		return
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, db.Standby())
+	assert.EqualValues(t, 1, atomic.LoadInt32(&registered), "promoted follower should handle queries")
+	assert.Error(t, db.Promote(), "promoting twice should fail")
+}
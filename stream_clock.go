@@ -0,0 +1,39 @@
+package zenodb
+
+import (
+	"time"
+
+	"github.com/getlantern/vtime"
+)
+
+// clockFor returns the clock that governs the tables of the given stream.
+// Unless PerStreamClocks is enabled, that's the database's clock.
+func (db *DB) clockFor(stream string) vtime.Clock {
+	if !db.opts.PerStreamClocks {
+		return db.clock
+	}
+	db.streamClocksMx.RLock()
+	clock := db.streamClocks[stream]
+	db.streamClocksMx.RUnlock()
+	if clock != nil {
+		return clock
+	}
+
+	db.streamClocksMx.Lock()
+	defer db.streamClocksMx.Unlock()
+	clock = db.streamClocks[stream]
+	if clock == nil {
+		clock = vtime.NewVirtualClock(time.Time{})
+		db.streamClocks[stream] = clock
+	}
+	return clock
+}
+
+// advanceClock advances the clock of the given stream, as well as the
+// database's clock, to ts.
+func (db *DB) advanceClock(stream string, ts time.Time) {
+	if db.opts.PerStreamClocks {
+		db.clockFor(stream).Advance(ts)
+	}
+	db.clock.Advance(ts)
+}
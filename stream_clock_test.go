@@ -0,0 +1,80 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPerStreamClocks(t *testing.T) {
+	_, err := NewDB(&DBOpts{PerStreamClocks: true})
+	assert.Error(t, err, "per stream clocks should require virtual time")
+
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:             tmpDir,
+		VirtualTime:     true,
+		PerStreamClocks: true,
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_old": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM old_stream GROUP BY period(1m)",
+		},
+		"test_new": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM new_stream GROUP BY period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	oldEpoch := time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+	newEpoch := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	dims := map[string]interface{}{"dim": "a"}
+	assert.NoError(t, db.Insert("new_stream", newEpoch, dims, map[string]float64{"i": 1}))
+	time.Sleep(250 * time.Millisecond)
+	// Without per stream clocks, these points would be older than the retention
+	// period of test_old
+	assert.NoError(t, db.Insert("old_stream", oldEpoch, dims, map[string]float64{"i": 1}))
+	assert.NoError(t, db.Insert("old_stream", oldEpoch.Add(time.Minute), dims, map[string]float64{"i": 2}))
+	time.Sleep(250 * time.Millisecond)
+
+	assert.True(t, newEpoch.Equal(db.clock.Now()), "database clock should follow the latest stream")
+	assert.True(t, oldEpoch.Add(time.Minute).Equal(db.getTable("test_old").now()))
+	assert.True(t, newEpoch.Equal(db.getTable("test_new").now()))
+
+	query := func(table string) float64 {
+		source, err := db.Query("SELECT i FROM "+table+" ASOF '-1h'", false, nil, true)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		total := float64(0)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			total += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return total
+	}
+	assert.EqualValues(t, 3, query("test_old"))
+	assert.EqualValues(t, 1, query("test_new"))
+	assert.Zero(t, db.TableStats("test_old").DroppedPoints)
+}
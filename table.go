@@ -14,21 +14,17 @@ import (
 	"github.com/getlantern/errors"
 	"github.com/getlantern/goexpr"
 	"github.com/getlantern/golog"
-	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/compress"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
 	"github.com/getlantern/zenodb/sql"
+	"github.com/getlantern/zenodb/wal"
 )
 
-// TableStats presents statistics for a given table (currently only since the
-// last time the database process was started).
-type TableStats struct {
-	FilteredPoints int64
-	QueuedPoints   int64
-	InsertedPoints int64
-	DroppedPoints  int64
-	ExpiredValues  int64
-}
+// TableStats presents statistics for a given table.
+type TableStats = common.TableStats
 
 // TableOpts configures a table.
 type TableOpts struct {
@@ -58,16 +54,128 @@ type TableOpts struct {
 	// Virtual, if true, means that the table's data isn't actually stored or
 	// queryable. Virtual tables are useful for defining a base set of fields
 	// from which other tables can select.
-	Virtual      bool
-	dependencyOf []*TableOpts
+	Virtual bool
+	// RoutingMode controls how points from the stream are routed to this table.
+	// RoutingAll (the default) means the table receives every point that matches
+	// its WHERE clause. RoutingFirst means that the table only receives points
+	// that don't match the WHERE clause of any other RoutingFirst table on the
+	// same stream with a higher priority (first match wins).
+	RoutingMode string
+	// RoutingPriority orders RoutingFirst tables on the same stream. Tables with
+	// lower values are evaluated first, ties are broken by table name.
+	RoutingPriority int
+	// Codec controls how sequences are encoded in the table's filestore.
+	// CodecRaw (the default) stores them uncompressed. CodecGorilla compresses
+	// them, which works best for smooth, gauge-like fields. Changing the codec
+	// only affects data as it gets rewritten by subsequent flushes.
+	Codec string
+	// Compression is the algorithm with which the table's filestore is
+	// compressed (see package compress), snappy by default. Like Codec,
+	// changing it only affects data as it gets rewritten by subsequent flushes.
+	Compression string
+	// Layout controls how the table's filestore is laid out on disk. LayoutRow
+	// (the default) stores rows one after the other. LayoutColumnar stores each
+	// field separately, so that queries only read the fields that they need,
+	// and keeps zone maps with which queries skip groups of rows outside of
+	// their time range or WHERE equalities. Filestores with LayoutRow have no
+	// zone maps, so queries only skip their rows by WHERE equalities, never by
+	// time. Like Codec, changing it only affects data as it gets rewritten by
+	// subsequent flushes.
+	Layout string
+	// Indexes lists dimensions, such as ids of clients, by whose values queries
+	// commonly look up a small number of rows. For each of them, flushes write
+	// an index that maps every value of the dimension to the rows having it, so
+	// that queries requiring the dimension to equal some value only read those
+	// rows. Indexes require LayoutColumnar. Like Layout, changing them only
+	// affects data as it gets rewritten by subsequent flushes.
+	Indexes []string
+	// Normalize maps dimension names to rules for normalizing their values
+	// before they're written to the WAL. Since normalization happens per stream,
+	// all tables on a stream that normalize the same dimension must do so the
+	// same way. Views can't normalize.
+	Normalize map[string]*DimNormalization
+	// Anonymize maps dimension names to rules for hashing or truncating their
+	// values before they're written to the WAL, so that sensitive identifiers
+	// are never persisted. Anonymization happens after normalization and, like
+	// it, per stream, so all tables on a stream that anonymize the same
+	// dimension must do so the same way. Views can't anonymize.
+	Anonymize map[string]*DimAnonymization
+	// Units maps the names of fields to the units in which they're measured,
+	// like ms or bytes, which are reported in the metadata of query results.
+	// Names may refer to fields of the table or of the underlying stream.
+	Units map[string]string
+	// InMemory, if true, keeps the table's data only in memory. The table never
+	// flushes to disk, instead its MaxFlushLatency (which defaults to its
+	// resolution) determines how often data that's fallen out of its retention
+	// period is dropped. This suits short-retention, high-rate tables for which
+	// writing to disk would be wasted I/O. When the database restarts, the table
+	// is rebuilt from the WAL. Since they have nothing on disk, in-memory tables
+	// are left out of backups, snapshots and follower acknowledgements. InMemory
+	// only takes effect when the table is created.
+	InMemory bool
+	// DedupWindow, if positive, makes the table drop points whose dimensions and
+	// timestamp are identical to those of a point that it inserted within this
+	// long, so that inserts retried by at-least-once pipelines aren't counted
+	// twice. The table remembers a hash of every point that it inserts within
+	// the window, so memory usage grows with the window and the insert rate.
+	DedupWindow time.Duration
+	// MaxLateness, if positive, is how far behind the latest point that the
+	// table received a point can be before it's considered late. LatePolicy
+	// determines what happens to late points.
+	MaxLateness time.Duration
+	// LatePolicy controls what happens to points that are later than
+	// MaxLateness. LatePolicyDrop (the default) drops them. LatePolicyRoute
+	// inserts them into LateTable instead, which must read from the same stream
+	// and then only receives late points. LatePolicyApply inserts them anyway.
+	LatePolicy string
+	// LateTable is the table to which LatePolicyRoute routes late points.
+	LateTable string
+	// Validate, if specified, validates points inserted into the table's stream
+	// before they're written to the WAL. Since validation happens per stream,
+	// points that fail it don't reach any of the stream's tables. Views can't
+	// validate.
+	Validate *Validation
+	// FollowFilter, if specified on a follower, is an additional WHERE
+	// condition like "server = 'a'" that the leader evaluates before sending
+	// the table's entries to the follower, so that followers that only need a
+	// subset of the table's data don't receive the rest. The follower applies
+	// it too. Changes reach the leader the next time the follower connects.
+	FollowFilter string
+	// RollupAfter, if positive, is how long the table keeps data at its own
+	// resolution. Older data is periodically rolled up to RollupResolution and
+	// removed from the table, which reclaims disk space while keeping long-term
+	// trends queryable for the rest of the RetentionPeriod. Queries whose time
+	// range reaches into rolled up data read all data at RollupResolution.
+	// Points for times that have already been rolled up are dropped. Rollups
+	// are kept outside of the table's directory and aren't included in backups.
+	// RollupAfter only takes effect when the table is created.
+	RollupAfter time.Duration
+	// RollupResolution is the resolution to which data older than RollupAfter
+	// is rolled up. It must be a multiple of the table's resolution.
+	RollupResolution time.Duration
+	// PrepareWorkers, if greater than 1, is the number of workers that prepare
+	// the table's points in parallel, i.e. decode them from the WAL, evaluate
+	// the table's WHERE clause and determine their keys. Points are sharded
+	// among the workers by a hash of their dimensions. Only preparation is
+	// parallel; the prepared points are still checked for lateness and
+	// duplicates and applied to the memstore one at a time in the order of the
+	// WAL, so the table's WAL offset never skips ahead of points that haven't
+	// been applied yet. PrepareWorkers only takes effect when the table starts
+	// reading the WAL.
+	PrepareWorkers int
+	dependencyOf   []*TableOpts
+	viewOf         string
 }
 
 type table struct {
 	*TableOpts
 	sql.Query
 	fields              core.Fields
+	boundedFields       core.Fields
 	db                  *DB
 	rowStore            *rowStore
+	rebalance           *rebalance
+	recovery            *recovery
 	log                 golog.Logger
 	fieldsMutex         sync.RWMutex
 	whereMutex          sync.RWMutex
@@ -79,6 +187,20 @@ type table struct {
 	highWaterMarkDisk   int64
 	highWaterMarkMemory int64
 	highWaterMarkMx     sync.RWMutex
+	// frozenAt is set for tables of attached backups to the time at which the
+	// backup was created
+	frozenAt  time.Time
+	dedup     *dedupWindow
+	watermark watermark
+	// sourceWatermarks tracks the watermarks of tables that route late points
+	// to this table
+	sourceWatermarks map[string]*watermark
+	rollup           *rollup
+	rollupMx         sync.RWMutex
+	// rollingUp serializes writing rollups
+	rollingUp    sync.Mutex
+	tombstones   tombstones
+	tombstonesMx sync.RWMutex
 }
 
 type iteration struct {
@@ -86,10 +208,13 @@ type iteration struct {
 	ctx             context.Context
 	outFields       core.Fields
 	includeMemStore bool
+	includeWALTail  bool
+	filter          *segmentFilter
 	onValue         func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)
 	fieldMappings   map[int]int
 	highWaterMarkCh chan time.Time
 	errCh           chan error
+	requestedAt     time.Time
 }
 
 // CreateTable creates a table based on the given opts.
@@ -104,6 +229,50 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 		opts.Virtual = true
 	}
 
+	routingErr := validateRoutingMode(opts.RoutingMode)
+	if routingErr != nil {
+		return routingErr
+	}
+
+	codecErr := validateCodec(opts.Codec)
+	if codecErr != nil {
+		return codecErr
+	}
+
+	compressionErr := compress.Validate(opts.Compression)
+	if compressionErr != nil {
+		return compressionErr
+	}
+
+	layoutErr := validateLayout(opts.Layout)
+	if layoutErr != nil {
+		return layoutErr
+	}
+
+	indexesErr := validateIndexes(opts)
+	if indexesErr != nil {
+		return indexesErr
+	}
+
+	lateErr := validateLatePolicy(opts)
+	if lateErr != nil {
+		return lateErr
+	}
+
+	followFilterErr := validateFollowFilter(opts)
+	if followFilterErr != nil {
+		return followFilterErr
+	}
+	where, followFilterErr := db.withFollowFilter(q.Where, opts)
+	if followFilterErr != nil {
+		return followFilterErr
+	}
+
+	rollupErr := validateRollup(opts, q.Resolution)
+	if rollupErr != nil {
+		return rollupErr
+	}
+
 	if !opts.Virtual {
 		if opts.RetentionPeriod <= 0 {
 			return errors.New("Please specify a positive RetentionPeriod")
@@ -111,7 +280,10 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 		if opts.MinFlushLatency <= 0 {
 			log.Debug("MinFlushLatency disabled")
 		}
-		if opts.MaxFlushLatency <= 0 {
+		if opts.MaxFlushLatency <= 0 && opts.InMemory && q.Resolution > 0 {
+			opts.MaxFlushLatency = q.Resolution
+			log.Debugf("MaxFlushLatency defaulted to resolution %v for in-memory table", q.Resolution)
+		} else if opts.MaxFlushLatency <= 0 {
 			opts.MaxFlushLatency = time.Duration(math.MaxInt64)
 			log.Debug("MaxFlushLatency disabled")
 		}
@@ -119,23 +291,48 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 	opts.Name = strings.ToLower(opts.Name)
 
 	t := &table{
-		TableOpts: opts,
-		Query:     *q,
-		fields:    fields,
-		db:        db,
-		log:       golog.LoggerFor("zenodb." + opts.Name),
+		TableOpts:     opts,
+		Query:         *q,
+		fields:        fields,
+		boundedFields: boundedFieldsOf(fields),
+		db:            db,
+		log:           golog.LoggerFor("zenodb." + opts.Name),
 	}
 
 	t.log.Debugf("Fields will be: %v", fields)
-	t.applyWhere(q.Where)
+	t.applyWhere(where)
+	t.applyIndexes(opts.Indexes)
+	t.dedup = newDedupWindow(opts.DedupWindow)
+	t.applyLatePolicy(opts.MaxLateness, opts.LatePolicy, opts.LateTable)
 
 	var rsErr error
 	var walOffset wal.Offset
 	if !t.Virtual {
+		dir := filepath.Join(db.opts.Dir, t.Name)
+		if db.opts.Follow != nil && db.opts.Snapshot != nil && !db.opts.ReadOnly && !t.InMemory {
+			t.bootstrap(dir)
+		}
+		if db.archive != nil && db.opts.Archive.HydrateEmptyTables && !db.opts.ReadOnly && !t.InMemory {
+			t.hydrate(dir)
+		}
+		if t.RollupAfter > 0 {
+			rsErr = t.openRollup()
+			if rsErr != nil {
+				return rsErr
+			}
+		}
+		if !t.InMemory {
+			rsErr = t.openTombstones()
+			if rsErr != nil {
+				return rsErr
+			}
+		}
 		t.rowStore, walOffset, rsErr = t.openRowStore(&rowStoreOptions{
-			dir:             filepath.Join(db.opts.Dir, t.Name),
-			minFlushLatency: t.MinFlushLatency,
-			maxFlushLatency: t.MaxFlushLatency,
+			dir:                dir,
+			minFlushLatency:    t.MinFlushLatency,
+			maxFlushLatency:    t.MaxFlushLatency,
+			targetApplyLatency: db.opts.TargetApplyLatency,
+			inMemory:           t.InMemory,
 		})
 		if rsErr != nil {
 			return rsErr
@@ -164,10 +361,22 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 	}
 	db.tables[t.Name] = t
 	db.orderedTables = append(db.orderedTables, t)
+	db.updateRouting()
 
 	if !t.Virtual {
 		if !t.db.opts.Passthrough {
 			go t.logHighWaterMark()
+			if t.RollupAfter > 0 {
+				go t.rollUpPeriodically()
+			}
+		}
+		if len(t.tombstones) > 0 {
+			go func() {
+				err := t.completeDeletions()
+				if err != nil {
+					t.log.Errorf("Unable to complete pending deletions: %v", err)
+				}
+			}()
 		}
 
 		if t.db.opts.Follow != nil {
@@ -185,7 +394,47 @@ func (t *table) Alter(opts *TableOpts) error {
 	if err != nil {
 		return err
 	}
-	t.applyWhere(q.Where)
+	err = validateRoutingMode(opts.RoutingMode)
+	if err != nil {
+		return err
+	}
+	err = validateCodec(opts.Codec)
+	if err != nil {
+		return err
+	}
+	err = compress.Validate(opts.Compression)
+	if err != nil {
+		return err
+	}
+	err = validateLayout(opts.Layout)
+	if err != nil {
+		return err
+	}
+	err = validateIndexes(opts)
+	if err != nil {
+		return err
+	}
+	err = validateLatePolicy(opts)
+	if err != nil {
+		return err
+	}
+	err = validateFollowFilter(opts)
+	if err != nil {
+		return err
+	}
+	where, err := t.db.withFollowFilter(q.Where, opts)
+	if err != nil {
+		return err
+	}
+	t.applyWhere(where)
+	t.applyRouting(opts.RoutingMode, opts.RoutingPriority)
+	t.applyCodec(opts.Codec)
+	t.applyCompression(opts.Compression)
+	t.applyLayout(opts.Layout)
+	t.applyIndexes(opts.Indexes)
+	t.dedup.setWindow(opts.DedupWindow)
+	t.applyLatePolicy(opts.MaxLateness, opts.LatePolicy, opts.LateTable)
+	t.applyFollowFilter(opts.FollowFilter)
 	t.applyFields(fields)
 	return nil
 }
@@ -224,6 +473,13 @@ func (db *DB) queryAndFields(opts *TableOpts) (q *sql.Query, fields core.Fields,
 			opts.PartitionBy = t.PartitionBy
 		}
 
+		// Views are routed along with the table they're based on
+		if opts.RoutingMode == "" {
+			opts.RoutingMode = t.RoutingMode
+			opts.RoutingPriority = t.RoutingPriority
+		}
+		opts.viewOf = t.Name
+
 		// Combine where clauses
 		if t.Where != nil {
 			if q.Where == nil {
@@ -285,12 +541,18 @@ func (t *table) startWALProcessing(walOffset wal.Offset) error {
 		if dirErr != nil && !os.IsExist(dirErr) {
 			return dirErr
 		}
-		w, walErr = wal.Open(walDir, t.db.opts.WALSyncInterval)
+		// Opening the WAL starts a new segment, so note where the existing data
+		// ends first
+		head, _ := t.db.walHead(t.From)
+		w, walErr = wal.Open(walDir, t.db.walSyncInterval())
 		if walErr != nil {
 			return walErr
 		}
-		go t.db.capWALAge(w)
+		t.db.recoverAtomicBatches(t.From, w, head)
+		go t.db.capWALAge(t.From, w)
 		t.db.streams[t.From] = w
+		t.db.startReplication(t.From)
+		t.db.campaignFor(t.From)
 	}
 
 	if t.db.opts.Passthrough {
@@ -304,6 +566,7 @@ func (t *table) startWALProcessing(walOffset wal.Offset) error {
 		return fmt.Errorf("Unable to obtain WAL reader: %v", walErr)
 	}
 
+	t.startRecovery(w, walOffset)
 	go t.processWALInserts()
 	return nil
 }
@@ -314,6 +577,7 @@ func (t *table) applyFields(fields core.Fields) {
 	fieldsChanged = !fields.Equals(t.fields)
 	if fieldsChanged {
 		t.fields = fields
+		t.boundedFields = boundedFieldsOf(fields)
 	}
 	t.fieldsMutex.Unlock()
 	if fieldsChanged {
@@ -334,12 +598,53 @@ func (t *table) getFields() core.Fields {
 	return fields
 }
 
+// boundedFieldsOf returns the fields that bound the values of individual
+// points, for which we count the values that are out of range.
+func boundedFieldsOf(fields core.Fields) core.Fields {
+	var result core.Fields
+	for _, field := range fields {
+		if expr.HasPointBounds(field.Expr) {
+			result = append(result, field)
+		}
+	}
+	return result
+}
+
+// countOutOfRange counts the values of the given point that fall outside of
+// the range of the BOUNDED and CLAMP expressions in our fields.
+func (t *table) countOutOfRange(params expr.Params, dims goexpr.Params) {
+	t.fieldsMutex.RLock()
+	boundedFields := t.boundedFields
+	t.fieldsMutex.RUnlock()
+	for _, field := range boundedFields {
+		clamped, dropped := expr.OutOfRange(field.Expr, params, dims)
+		if clamped == 0 && dropped == 0 {
+			continue
+		}
+		t.statsMutex.Lock()
+		if clamped > 0 {
+			if t.stats.ClampedValues == nil {
+				t.stats.ClampedValues = make(map[string]int64)
+			}
+			t.stats.ClampedValues[field.Name] += int64(clamped)
+		}
+		if dropped > 0 {
+			if t.stats.DroppedValues == nil {
+				t.stats.DroppedValues = make(map[string]int64)
+			}
+			t.stats.DroppedValues[field.Name] += int64(dropped)
+		}
+		t.statsMutex.Unlock()
+	}
+}
+
 func (t *table) applyWhere(where goexpr.Expr) {
 	var whereChanged bool
 	t.whereMutex.Lock()
 	whereChanged = t.Where != where
 	t.Where = where
 	t.whereMutex.Unlock()
+	t.db.refreshRouting()
 	if whereChanged {
 		t.log.Debugf("Updated where to %v", where)
 	} else {
@@ -355,25 +660,44 @@ func (t *table) getWhere() goexpr.Expr {
 }
 
 func (t *table) truncateBefore() time.Time {
-	return t.db.clock.Now().Add(-1 * t.RetentionPeriod)
+	truncateBefore := t.now().Add(-1 * t.RetentionPeriod)
+	if r := t.getRollup(); r != nil && r.until.After(truncateBefore) {
+		// data that's been rolled up is read from the rollup
+		truncateBefore = r.until
+	}
+	return truncateBefore
+}
+
+// now returns the current time as seen by this table, which for tables of
+// attached backups is the time at which the backup was created.
+func (t *table) now() time.Time {
+	if !t.frozenAt.IsZero() {
+		return t.frozenAt
+	}
+	return t.db.clockFor(t.From).Now()
 }
 
 func (t *table) backfillTo() time.Time {
 	if t.Backfill == 0 {
 		return time.Time{}
 	}
-	return t.db.clock.Now().Add(-1 * t.Backfill)
+	return t.db.clockFor(t.From).Now().Add(-1 * t.Backfill)
 }
 
-func (t *table) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) (time.Time, error) {
+// iterate iterates over the table's data. If filter is non-nil, data that it
+// excludes may be skipped, but doesn't have to be.
+func (t *table) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, includeWALTail bool, filter *segmentFilter, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) (time.Time, error) {
 	it := &iteration{
 		t:               t,
 		ctx:             ctx,
 		outFields:       outFields,
 		includeMemStore: includeMemStore,
+		includeWALTail:  includeWALTail,
+		filter:          filter,
 		onValue:         onValue,
 		highWaterMarkCh: make(chan time.Time, 1),
 		errCh:           make(chan error, 1),
+		requestedAt:     time.Now(),
 	}
 	t.db.requestedIterations <- it
 	return <-it.highWaterMarkCh, <-it.errCh
@@ -416,14 +740,23 @@ coalesceLoop:
 }
 
 func (db *DB) processIterations() {
-	for iterations := range db.coalescedIterations {
-		db.doProcessIterations(iterations)
+	for {
+		select {
+		case iterations, ok := <-db.coalescedIterations:
+			if !ok {
+				return
+			}
+			db.doProcessIterations(iterations)
+		case <-db.stopIterationWorker:
+			return
+		}
 	}
 }
 
 func (db *DB) doProcessIterations(iterations []*iteration) {
 	var maxDeadline time.Time
 	includeMemStore := false
+	includeWALTail := false
 	allOutFields := make(core.Fields, 0)
 	hasOutField := func(field core.Field) bool {
 		for _, existingField := range allOutFields {
@@ -435,7 +768,12 @@ func (db *DB) doProcessIterations(iterations []*iteration) {
 	}
 
 	for _, it := range iterations {
+		if usage := queryUsageFrom(it.ctx); usage != nil {
+			// Time spent coalescing and waiting for a free iterator
+			usage.waited(time.Since(it.requestedAt))
+		}
 		includeMemStore = includeMemStore || it.includeMemStore
+		includeWALTail = includeWALTail || it.includeWALTail
 		deadline, hasDeadline := it.ctx.Deadline()
 		if hasDeadline && deadline.After(maxDeadline) {
 			maxDeadline = deadline
@@ -465,9 +803,17 @@ func (db *DB) doProcessIterations(iterations []*iteration) {
 		remainingIterations[i] = it
 	}
 
+	cancelled := make(map[int]bool)
 	combinedOnValue := func(dims bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
 		more := false
 		for i, it := range remainingIterations {
+			if it.ctx.Err() == context.Canceled {
+				// The query was cancelled, stop feeding it without affecting the
+				// other iterations
+				delete(remainingIterations, i)
+				cancelled[i] = true
+				continue
+			}
 			itVals := make([]encoding.Sequence, len(it.outFields))
 			for i, val := range vals {
 				itI := it.fieldMappings[i]
@@ -496,13 +842,17 @@ func (db *DB) doProcessIterations(iterations []*iteration) {
 		newCtx, cancel = context.WithDeadline(newCtx, maxDeadline)
 		defer cancel()
 	}
-	highWaterMark, err := iterations[0].t.rowStore.iterate(newCtx, allOutFields, includeMemStore, combinedOnValue)
+	highWaterMark, err := iterations[0].t.rowStore.iterate(newCtx, segmentFiltersFor(iterations), allOutFields, includeMemStore, includeWALTail, combinedOnValue)
 	if err != nil {
 		log.Errorf("Got error while iterating: %v", err)
 	}
-	for _, it := range iterations {
+	for i, it := range iterations {
 		it.highWaterMarkCh <- highWaterMark
-		it.errCh <- err
+		if cancelled[i] {
+			it.errCh <- ErrQueryCancelled
+		} else {
+			it.errCh <- err
+		}
 	}
 }
 
@@ -542,6 +892,30 @@ func (t *table) stopSorting() {
 	t.db.tablesMutex.RUnlock()
 }
 
+func (t *table) getStats() TableStats {
+	t.statsMutex.RLock()
+	stats := t.stats
+	stats.ClampedValues = copyCounts(t.stats.ClampedValues)
+	stats.DroppedValues = copyCounts(t.stats.DroppedValues)
+	t.statsMutex.RUnlock()
+	stats.Table = t.Name
+	if t.rowStore != nil {
+		t.rowStore.storageStats(&stats)
+	}
+	return stats
+}
+
+func copyCounts(counts map[string]int64) map[string]int64 {
+	if counts == nil {
+		return nil
+	}
+	result := make(map[string]int64, len(counts))
+	for name, count := range counts {
+		result[name] = count
+	}
+	return result
+}
+
 func (t *table) memStoreSize() int {
 	return t.rowStore.memStoreSize()
 }
@@ -552,6 +926,13 @@ func (t *table) forceFlush() {
 	}
 }
 
+func (t *table) persistedOffset() wal.Offset {
+	if t.rowStore == nil {
+		return nil
+	}
+	return t.rowStore.persistedOffset()
+}
+
 func (t *table) logHighWaterMark() {
 	for {
 		time.Sleep(15 * time.Second)
@@ -0,0 +1,55 @@
+package zenodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// planTiming records when a query was planned. Queries are planned before
+// they're iterated, so their planning span is only recorded once iteration
+// starts and there's a context to which it belongs.
+type planTiming struct {
+	start time.Time
+	end   time.Time
+}
+
+// startQuerySpan starts the span for a query on this node, including a child
+// span for its planning.
+func (db *DB) startQuerySpan(ctx context.Context, sqlString string, planning planTiming) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("zenodb.sql", sqlString),
+		attribute.String("zenodb.caller", common.CallerFor(ctx)),
+	}
+	if id := common.RequestIDFor(ctx); id != "" {
+		attrs = append(attrs, attribute.String("zenodb.request_id", id))
+	}
+	if db.opts.Passthrough {
+		attrs = append(attrs, attribute.Int("zenodb.num_partitions", db.opts.NumPartitions))
+	} else if db.opts.Follow != nil {
+		attrs = append(attrs, attribute.Int("zenodb.partition", db.opts.Partition))
+	}
+	ctx, span := common.StartSpan(ctx, "zenodb.query", trace.WithTimestamp(planning.start), trace.WithAttributes(attrs...))
+	_, planSpan := common.StartSpan(ctx, "zenodb.plan", trace.WithTimestamp(planning.start))
+	planSpan.End(trace.WithTimestamp(planning.end))
+	return ctx, span
+}
+
+// endQuerySpan ends the span for a query, recording what it used.
+func endQuerySpan(span trace.Span, wait time.Duration, stats *common.QueryStats, err error) {
+	span.SetAttributes(
+		attribute.Int64("zenodb.rows_scanned", stats.RowsScanned),
+		attribute.Int64("zenodb.estimated_memory", stats.EstimatedMemory),
+		attribute.Int64("zenodb.wait_ms", int64(wait/time.Millisecond)),
+	)
+	if len(stats.MissingPartitions) > 0 {
+		span.SetAttributes(attribute.IntSlice("zenodb.missing_partitions", stats.MissingPartitions))
+	}
+	if stats.LimitExceeded != "" {
+		span.SetAttributes(attribute.String("zenodb.limit_exceeded", stats.LimitExceeded))
+	}
+	common.EndSpan(span, err)
+}
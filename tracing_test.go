@@ -0,0 +1,97 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	follower, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer follower.Close()
+	err = follower.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, follower.Insert("inbound", now, map[string]interface{}{"dim": i}, map[string]float64{"i": 1}))
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	leader := &DB{
+		opts: &DBOpts{
+			NumPartitions:           1,
+			ReplicationFactor:       1,
+			ClusterQueryConcurrency: 1,
+			ClusterQueryTimeout:     DefaultClusterQueryTimeout,
+		},
+		remoteQueryHandlers: make(map[int]chan *remoteQueryHandler),
+	}
+	leader.RegisterQueryHandler(0, "a", follower.queryForRemote)
+
+	ctx, rootSpan := common.StartSpan(context.Background(), "test")
+	rows := 0
+	_, err = leader.queryCluster(ctx, "SELECT i FROM test_a GROUP BY dim", false, nil, true, false, core.FieldsIgnored, nil, func(row *core.FlatRow) (bool, error) {
+		rows++
+		return true, nil
+	})
+	rootSpan.End()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, rows)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	remoteQuery := spans["zenodb.remoteQuery"]
+	query := spans["zenodb.query"]
+	plan := spans["zenodb.plan"]
+	if !assert.NotNil(t, remoteQuery) || !assert.NotNil(t, query) || !assert.NotNil(t, plan) {
+		return
+	}
+	traceID := rootSpan.SpanContext().TraceID()
+	for _, span := range []sdktrace.ReadOnlySpan{remoteQuery, query, plan} {
+		assert.Equal(t, traceID, span.SpanContext().TraceID(), "%v should belong to the query's trace", span.Name())
+	}
+	assert.Equal(t, rootSpan.SpanContext().SpanID(), remoteQuery.Parent().SpanID())
+	assert.Equal(t, remoteQuery.SpanContext().SpanID(), query.Parent().SpanID(), "follower's query should be part of leader's remote query")
+	assert.Equal(t, query.SpanContext().SpanID(), plan.Parent().SpanID())
+	assert.False(t, plan.EndTime().After(query.EndTime()), "planning should end before the query does")
+	assert.Contains(t, remoteQuery.Attributes(), attribute.Int("zenodb.partition", 0))
+	assert.Contains(t, remoteQuery.Attributes(), attribute.String("zenodb.replica", "a"))
+	assert.Contains(t, query.Attributes(), attribute.Int64("zenodb.rows_scanned", 10))
+	assert.Contains(t, query.Attributes(), attribute.String("zenodb.caller", "leader"))
+}
@@ -0,0 +1,83 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueTypes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	err = db.ApplySchema(Schema{
+		"transfers": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT ISUM(bytes) AS bytes, ICOUNT(bytes) AS transfers FROM inbound GROUP BY path, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now().Truncate(time.Minute)
+	assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"path": "/api/users"}, map[string]float64{"bytes": 1 << 53}))
+	assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"path": "/api/users"}, map[string]float64{"bytes": 1}))
+	time.Sleep(250 * time.Millisecond)
+
+	sqlString := "SELECT SUBSTR(path, 0, 4) AS prefix, bytes, transfers, transfers > 1 AS repeated FROM transfers GROUP BY path"
+	source, err := db.Query(sqlString, false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var fields core.Fields
+	var rows []*core.FlatRow
+	_, err = source.Iterate(context.Background(), func(fs core.Fields) error {
+		fields = fs
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		rows = append(rows, row)
+		return true, nil
+	})
+	if !assert.NoError(t, err) || !assert.Len(t, rows, 1) {
+		return
+	}
+	row := rows[0]
+	assert.Equal(t, "/api", row.Key.Get("prefix"))
+	assert.Equal(t, "/api/users", row.Key.Get("path"))
+	if assert.Len(t, row.Ints, 3) {
+		assert.EqualValues(t, 1<<53+1, row.Ints[0], "ISUM should be exact beyond 2^53")
+		assert.EqualValues(t, 2, row.Ints[1])
+	}
+	assert.EqualValues(t, 1, row.Values[2])
+
+	var groupBy []string
+	for _, gb := range source.GetGroupBy() {
+		groupBy = append(groupBy, gb.Name)
+	}
+	assert.Equal(t, []string{"path", "prefix"}, groupBy)
+
+	var types []string
+	for _, md := range db.FieldMetaData(sqlString, fields) {
+		types = append(types, md.Type)
+	}
+	assert.Equal(t, []string{"int64", "int64", "bool"}, types)
+}
@@ -0,0 +1,294 @@
+package zenodb
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	// ValidationReject rejects invalid points, failing the insert
+	ValidationReject = "reject"
+	// ValidationCoerce converts the values of dimensions that have the wrong
+	// type to the right one, rejecting points that can't be fixed that way
+	ValidationCoerce = "coerce"
+	// ValidationDivert writes invalid points to a dead-letter stream instead of
+	// the stream into which they were inserted
+	ValidationDivert = "divert"
+
+	DimTypeString = "string"
+	DimTypeInt    = "int"
+	DimTypeFloat  = "float"
+	DimTypeBool   = "bool"
+
+	// Diverted points are tagged with these dimensions to explain where they
+	// came from and why they were diverted
+	deadLetterStreamDim = "_invalid_stream"
+	deadLetterTableDim  = "_invalid_table"
+	deadLetterReasonDim = "_invalid_reason"
+)
+
+// Validation describes how points inserted into a table's stream are validated
+// before they're written to the WAL.
+type Validation struct {
+	// RequiredDims lists dimensions that every point has to have.
+	RequiredDims []string
+	// DimTypes maps dimension names to the type that their values have to be,
+	// one of DimTypeString, DimTypeInt, DimTypeFloat or DimTypeBool. Points
+	// without the dimension are valid unless it's required.
+	DimTypes map[string]string
+	// MaxDimsBytes, if positive, limits the encoded size of a point's
+	// dimensions.
+	MaxDimsBytes int
+	// Policy determines what happens to invalid points, ValidationReject by
+	// default.
+	Policy string
+	// DeadLetterStream is the stream to which ValidationDivert writes invalid
+	// points, tagged with the _invalid_stream, _invalid_table and
+	// _invalid_reason dimensions. Some table has to read from it.
+	DeadLetterStream string
+}
+
+// InvalidPointError is returned when inserting a point that a table's
+// validation rejects.
+type InvalidPointError struct {
+	Table  string
+	Reason string
+}
+
+func (err *InvalidPointError) Error() string {
+	return fmt.Sprintf("Invalid point for table %v: %v", err.Table, err.Reason)
+}
+
+// pointValidator is a compiled Validation
+type pointValidator struct {
+	table        string
+	required     []string
+	types        map[string]string
+	maxDimsBytes int
+	policy       string
+	deadLetter   string
+}
+
+// buildValidators compiles the validations defined by the tables in the given
+// schema, keyed by stream. Validators for the same stream are ordered by
+// table name.
+func buildValidators(schema Schema) (map[string][]*pointValidator, error) {
+	validators := make(map[string][]*pointValidator)
+	for name, opts := range schema {
+		if opts.Validate == nil {
+			continue
+		}
+		if opts.View {
+			return nil, errors.New("View %v can't validate, validate the table on which it's based instead", name)
+		}
+		stream, err := sql.TableFor(opts.SQL)
+		if err != nil {
+			return nil, errors.New("Unable to determine stream for table %v: %v", name, err)
+		}
+		v, err := opts.Validate.compile(name, stream, schema)
+		if err != nil {
+			return nil, errors.New("Invalid validation for table %v: %v", name, err)
+		}
+		validators[stream] = append(validators[stream], v)
+	}
+	for _, byStream := range validators {
+		sort.Slice(byStream, func(i, j int) bool {
+			return byStream[i].table < byStream[j].table
+		})
+	}
+	return validators, nil
+}
+
+func (vd *Validation) compile(table string, stream string, schema Schema) (*pointValidator, error) {
+	v := &pointValidator{
+		table:        table,
+		required:     vd.RequiredDims,
+		types:        make(map[string]string, len(vd.DimTypes)),
+		maxDimsBytes: vd.MaxDimsBytes,
+		policy:       strings.ToLower(strings.TrimSpace(vd.Policy)),
+		deadLetter:   strings.ToLower(strings.TrimSpace(vd.DeadLetterStream)),
+	}
+	for dim, dimType := range vd.DimTypes {
+		dimType = strings.ToLower(strings.TrimSpace(dimType))
+		switch dimType {
+		case DimTypeString, DimTypeInt, DimTypeFloat, DimTypeBool:
+			v.types[dim] = dimType
+		default:
+			return nil, errors.New("Unknown type %v for dimension %v", dimType, dim)
+		}
+	}
+
+	switch v.policy {
+	case "":
+		v.policy = ValidationReject
+	case ValidationReject, ValidationCoerce:
+		// okay
+	case ValidationDivert:
+		if v.deadLetter == "" {
+			return nil, errors.New("%v requires a DeadLetterStream", ValidationDivert)
+		}
+		if v.deadLetter == stream {
+			return nil, errors.New("DeadLetterStream can't be the validated stream %v", stream)
+		}
+		if !streamHasTables(schema, v.deadLetter) {
+			return nil, errors.New("No table reads from DeadLetterStream %v", v.deadLetter)
+		}
+	default:
+		return nil, errors.New("Unknown policy %v", vd.Policy)
+	}
+	return v, nil
+}
+
+func streamHasTables(schema Schema, stream string) bool {
+	for _, opts := range schema {
+		if opts.View {
+			continue
+		}
+		from, err := sql.TableFor(opts.SQL)
+		if err == nil && from == stream {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns the reason why the given dims are invalid, or "" if they're
+// valid.
+func (v *pointValidator) check(dims bytemap.ByteMap) string {
+	for _, dim := range v.required {
+		if dims.Get(dim) == nil {
+			return fmt.Sprintf("missing required dimension %v", dim)
+		}
+	}
+	for dim, dimType := range v.types {
+		value := dims.Get(dim)
+		if value != nil && !hasDimType(value, dimType) {
+			return fmt.Sprintf("dimension %v is %T, not %v", dim, value, dimType)
+		}
+	}
+	if v.maxDimsBytes > 0 && len(dims) > v.maxDimsBytes {
+		return fmt.Sprintf("dimensions are %d bytes, more than %d", len(dims), v.maxDimsBytes)
+	}
+	return ""
+}
+
+// coerce converts the values of dimensions to their required types. If the
+// result still isn't valid, ok is false.
+func (v *pointValidator) coerce(dims bytemap.ByteMap) (bytemap.ByteMap, bool) {
+	var coerced map[string]interface{}
+	for dim, dimType := range v.types {
+		value := dims.Get(dim)
+		if value == nil || hasDimType(value, dimType) {
+			continue
+		}
+		coercedValue, ok := coerceDim(value, dimType)
+		if !ok {
+			return nil, false
+		}
+		if coerced == nil {
+			coerced = dims.AsMap()
+		}
+		coerced[dim] = coercedValue
+	}
+	if coerced != nil {
+		dims = bytemap.New(coerced)
+	}
+	return dims, v.check(dims) == ""
+}
+
+func hasDimType(value interface{}, dimType string) bool {
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.String:
+		return dimType == DimTypeString
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return dimType == DimTypeInt
+	case reflect.Float32, reflect.Float64:
+		return dimType == DimTypeFloat
+	case reflect.Bool:
+		return dimType == DimTypeBool
+	}
+	return false
+}
+
+func coerceDim(value interface{}, dimType string) (interface{}, bool) {
+	s, isString := value.(string)
+	switch dimType {
+	case DimTypeString:
+		return fmt.Sprint(value), true
+	case DimTypeInt:
+		if isString {
+			i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			return i, err == nil
+		}
+		if hasDimType(value, DimTypeFloat) {
+			f := reflect.ValueOf(value).Float()
+			return int64(f), f == float64(int64(f))
+		}
+	case DimTypeFloat:
+		if isString {
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			return f, err == nil
+		}
+		if hasDimType(value, DimTypeInt) {
+			f, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+			return f, err == nil
+		}
+	case DimTypeBool:
+		if isString {
+			b, err := strconv.ParseBool(strings.TrimSpace(s))
+			return b, err == nil
+		}
+	}
+	return nil, false
+}
+
+func (db *DB) applyValidators(validators map[string][]*pointValidator) {
+	db.validatorsMx.Lock()
+	db.validators = validators
+	db.validatorsMx.Unlock()
+}
+
+// validate applies the validations configured for the given stream to the
+// given dims. It returns the dims to insert, which may have been coerced, and
+// the stream into which to insert them, which is the dead-letter stream for
+// diverted points. Rejected points return an error.
+func (db *DB) validate(stream string, dims bytemap.ByteMap) (bytemap.ByteMap, string, error) {
+	db.validatorsMx.RLock()
+	validators := db.validators[stream]
+	db.validatorsMx.RUnlock()
+
+	for _, v := range validators {
+		reason := v.check(dims)
+		if reason == "" {
+			continue
+		}
+		switch v.policy {
+		case ValidationCoerce:
+			coerced, ok := v.coerce(dims)
+			if ok {
+				metrics.TableInvalid(v.table, false, true, false)
+				dims = coerced
+				continue
+			}
+		case ValidationDivert:
+			metrics.TableInvalid(v.table, false, false, true)
+			diverted := dims.AsMap()
+			diverted[deadLetterStreamDim] = stream
+			diverted[deadLetterTableDim] = v.table
+			diverted[deadLetterReasonDim] = reason
+			return bytemap.New(diverted), v.deadLetter, nil
+		}
+		metrics.TableInvalid(v.table, true, false, false)
+		return nil, "", &InvalidPointError{Table: v.table, Reason: reason}
+	}
+	return dims, stream, nil
+}
@@ -0,0 +1,137 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidation(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var schema Schema
+	err = yaml.Unmarshal([]byte(`
+test_a:
+  retentionperiod: 1h
+  sql: SELECT i FROM inbound GROUP BY *, period(1m)
+  validate:
+    requireddims: [server]
+    dimtypes:
+      server: string
+    maxdimsbytes: 200
+test_b:
+  retentionperiod: 1h
+  sql: SELECT i FROM coerced GROUP BY *, period(1m)
+  validate:
+    dimtypes:
+      port: int
+    policy: coerce
+test_c:
+  retentionperiod: 1h
+  sql: SELECT i FROM diverted GROUP BY *, period(1m)
+  validate:
+    requireddims: [server]
+    policy: divert
+    deadletterstream: dead_letters
+dead_letters:
+  retentionperiod: 1h
+  sql: SELECT i FROM dead_letters GROUP BY *, period(1m)
+`), &schema)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	if !assert.NoError(t, db.ApplySchema(schema)) {
+		return
+	}
+
+	now := time.Now()
+	vals := map[string]float64{"i": 1}
+	assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"server": "a"}, vals))
+	err = db.Insert("inbound", now, map[string]interface{}{"other": "a"}, vals)
+	if assert.Error(t, err, "missing required dimension should be rejected") {
+		assert.IsType(t, &InvalidPointError{}, err)
+		assert.Contains(t, err.Error(), "missing required dimension server")
+	}
+	assert.Error(t, db.Insert("inbound", now, map[string]interface{}{"server": 5}, vals), "wrong type should be rejected")
+	assert.Error(t, db.Insert("inbound", now, map[string]interface{}{"server": strings.Repeat("a", 300)}, vals), "oversized dims should be rejected")
+	assert.Error(t, db.InsertAtomically([]*StreamPoint{NewStreamPoint("inbound", now, map[string]interface{}{"other": "a"}, vals)}), "atomic batches with invalid points should be rejected")
+
+	assert.NoError(t, db.Insert("coerced", now, map[string]interface{}{"port": "80"}, vals))
+	assert.NoError(t, db.Insert("coerced", now, map[string]interface{}{"port": 443.0}, vals))
+	assert.Error(t, db.Insert("coerced", now, map[string]interface{}{"port": "http"}, vals), "values that can't be coerced should be rejected")
+
+	assert.NoError(t, db.Insert("diverted", now, map[string]interface{}{"server": "a"}, vals))
+	assert.NoError(t, db.Insert("diverted", now, map[string]interface{}{"other": "b"}, vals), "invalid points should be diverted, not rejected")
+	time.Sleep(250 * time.Millisecond)
+
+	query := func(sqlString string, dim string) map[interface{}]float64 {
+		source, err := db.Query(sqlString, false, nil, true)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		totals := make(map[interface{}]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			totals[row.Key.Get(dim)] += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return totals
+	}
+	assert.Equal(t, map[interface{}]float64{"a": 1}, query("SELECT i FROM test_a GROUP BY server", "server"))
+	assert.Equal(t, map[interface{}]float64{int64(80): 1, int64(443): 1}, query("SELECT i FROM test_b GROUP BY port", "port"))
+	assert.Equal(t, map[interface{}]float64{"a": 1}, query("SELECT i FROM test_c GROUP BY server", "server"))
+	assert.Equal(t, map[interface{}]float64{"missing required dimension server": 1}, query("SELECT i FROM dead_letters WHERE _invalid_stream = 'diverted' AND _invalid_table = 'test_c' GROUP BY _invalid_reason", "_invalid_reason"))
+
+	invalid := make(map[string]*metrics.TableStats)
+	for _, ts := range metrics.GetStats().Tables {
+		invalid[ts.Table] = ts
+	}
+	if assert.NotNil(t, invalid["test_a"]) {
+		assert.EqualValues(t, 4, invalid["test_a"].InvalidRejected)
+	}
+	if assert.NotNil(t, invalid["test_b"]) {
+		assert.EqualValues(t, 2, invalid["test_b"].InvalidCoerced)
+		assert.EqualValues(t, 1, invalid["test_b"].InvalidRejected)
+	}
+	if assert.NotNil(t, invalid["test_c"]) {
+		assert.EqualValues(t, 1, invalid["test_c"].InvalidDiverted)
+	}
+
+	for _, validation := range []*Validation{
+		{Policy: "ignore"},
+		{DimTypes: map[string]string{"server": "uuid"}},
+		{Policy: ValidationDivert},
+		{Policy: ValidationDivert, DeadLetterStream: "nowhere"},
+		{Policy: ValidationDivert, DeadLetterStream: "inbound"},
+	} {
+		err := db.ApplySchema(Schema{
+			"test_a": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+				Validate:        validation,
+			},
+		})
+		assert.Error(t, err, "%+v should be invalid", validation)
+	}
+}
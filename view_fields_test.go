@@ -0,0 +1,85 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryFieldsFromViews(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: vtime.NewVirtualClock(epoch),
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT requests FROM inbound GROUP BY server, period(1m)",
+		},
+		"view_a": &TableOpts{
+			View:            true,
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT MAX(load) AS peak_load FROM test_a GROUP BY server, period(10m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	insert := func(ts time.Time, server string, requests float64, load float64) {
+		assert.NoError(t, db.Insert("inbound", ts, map[string]interface{}{"server": server}, map[string]float64{"requests": requests, "load": load}))
+	}
+	insert(epoch.Add(-25*time.Minute), "a", 1, 2)
+	insert(epoch.Add(-23*time.Minute), "a", 2, 8)
+	insert(epoch.Add(-15*time.Minute), "a", 4, 3)
+	insert(epoch.Add(-5*time.Minute), "b", 8, 5)
+	time.Sleep(250 * time.Millisecond)
+
+	source, err := db.Query("SELECT requests, peak_load, requests / peak_load AS ratio FROM test_a ASOF '-30m' GROUP BY server, period(10m)", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	type result struct {
+		requests float64
+		peakLoad float64
+		ratio    float64
+	}
+	results := make(map[string]result)
+	_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+		if row.Values[0] != 0 {
+			key := row.Key.Get("server").(string) + " " + time.Unix(0, row.TS).UTC().Format("15:04")
+			results[key] = result{row.Values[0], row.Values[1], row.Values[2]}
+		}
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]result{
+		"a 11:40": {3, 8, 3.0 / 8},
+		"a 11:50": {4, 3, 4.0 / 3},
+		"b 12:00": {8, 5, 8.0 / 5},
+	}, results)
+
+	_, err = db.Query("SELECT requests, peak_load FROM test_a ASOF '-30m' GROUP BY server, period(5m)", false, nil, true)
+	assert.Error(t, err, "querying at a finer resolution than the view shouldn't be allowed")
+}
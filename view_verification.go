@@ -0,0 +1,236 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	// defaultViewVerificationWindow is how far back VerifyView samples by
+	// default
+	defaultViewVerificationWindow = time.Hour
+
+	// viewVerificationTolerance is the relative difference below which values
+	// from the view and its base table are considered equal
+	viewVerificationTolerance = 1e-9
+
+	// maxViewDrifts caps how many individual drifts are reported
+	maxViewDrifts = 100
+)
+
+// ViewDrift is a single difference between the data of a view and the result
+// of the equivalent query against the table on which it's based.
+type ViewDrift struct {
+	TS    time.Time
+	Dims  map[string]interface{}
+	Field string
+	// View is the value in the view, nil if the view is missing the row
+	View *float64
+	// Table is the value from the base table, nil if the base table is missing
+	// the row
+	Table *float64
+}
+
+// ViewVerification reports how the data of a view compares to that of the
+// table on which it's based over a sampled window.
+type ViewVerification struct {
+	View  string
+	Table string
+	AsOf  time.Time
+	Until time.Time
+	// ViewSQL and TableSQL are the queries that were compared
+	ViewSQL  string
+	TableSQL string
+	// Fields are the fields that were compared
+	Fields []string
+	// Rows is the number of distinct rows (by period and dimensions) seen in
+	// either result
+	Rows int
+	// MissingFromView counts rows that only the base table had
+	MissingFromView int
+	// MissingFromTable counts rows that only the view had
+	MissingFromTable int
+	// Mismatched counts values that differed by more than a negligible amount
+	Mismatched int
+	// MaxRelativeDiff is the largest relative difference among mismatched
+	// values
+	MaxRelativeDiff float64
+	// Drifts lists up to 100 individual differences
+	Drifts []*ViewDrift
+}
+
+// OK indicates that no drift was found.
+func (v *ViewVerification) OK() bool {
+	return v.MissingFromView == 0 && v.MissingFromTable == 0 && v.Mismatched == 0
+}
+
+func (v *ViewVerification) String() string {
+	if v.OK() {
+		return fmt.Sprintf("View %v matches %v across %d rows from %v to %v", v.View, v.Table, v.Rows, v.AsOf, v.Until)
+	}
+	return fmt.Sprintf("View %v drifted from %v across %d rows from %v to %v: %d missing from view, %d missing from table, %d mismatched values (max relative diff %f)",
+		v.View, v.Table, v.Rows, v.AsOf, v.Until, v.MissingFromView, v.MissingFromTable, v.Mismatched, v.MaxRelativeDiff)
+}
+
+// VerifyView checks that the given view holds the same data as the table on
+// which it's based. It runs the view's own SQL against the base table over the
+// most recent window (an hour if window isn't positive, and never more than
+// the view's retention period) and compares the result, period by period and
+// dimension by dimension, to what's stored in the view. This catches WHERE
+// clauses and aggregates in the view that don't do what was intended. The
+// current, still incomplete period is left out of the comparison, but data
+// that's still on its way to either table can show up as drift, so it's best
+// to verify views whose inputs aren't lagging.
+func (db *DB) VerifyView(ctx context.Context, view string, window time.Duration) (*ViewVerification, error) {
+	t := db.getTable(view)
+	if t == nil {
+		return nil, fmt.Errorf("Table %v not found", view)
+	}
+	if !t.View {
+		return nil, fmt.Errorf("Table %v is not a view", view)
+	}
+	if window <= 0 {
+		window = defaultViewVerificationWindow
+	}
+	if t.RetentionPeriod > 0 && window > t.RetentionPeriod {
+		window = t.RetentionPeriod
+	}
+
+	until := encoding.RoundTimeDown(t.now(), t.Resolution)
+	asOf := encoding.RoundTimeDown(until.Add(-1*window), t.Resolution)
+	result := &ViewVerification{
+		View:  t.Name,
+		Table: t.viewOf,
+		AsOf:  asOf,
+		Until: until,
+	}
+
+	var err error
+	result.TableSQL, err = sql.WithTimeRange(t.TableOpts.SQL, asOf, until, t.Resolution)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate query against base table: %v", err)
+	}
+	result.ViewSQL, err = sql.WithTimeRange(fmt.Sprintf("SELECT * FROM %v", t.Name), asOf, until, t.Resolution)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate query against view: %v", err)
+	}
+
+	viewRows, viewFields, err := db.verificationRows(ctx, result.ViewSQL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query view: %v", err)
+	}
+	tableRows, tableFields, err := db.verificationRows(ctx, result.TableSQL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query base table: %v", err)
+	}
+
+	// Compare only the fields that both results have, which excludes things
+	// like the _points of views that don't select them explicitly
+	type fieldIdxs struct {
+		view  int
+		table int
+	}
+	var compared []fieldIdxs
+	for i, field := range viewFields {
+		for j, tableField := range tableFields {
+			if field.Name == tableField.Name {
+				compared = append(compared, fieldIdxs{i, j})
+				result.Fields = append(result.Fields, field.Name)
+				break
+			}
+		}
+	}
+
+	addDrift := func(drift *ViewDrift) {
+		if len(result.Drifts) < maxViewDrifts {
+			result.Drifts = append(result.Drifts, drift)
+		}
+	}
+
+	keys := make([]string, 0, len(viewRows))
+	for key := range viewRows {
+		keys = append(keys, key)
+	}
+	for key := range tableRows {
+		if _, found := viewRows[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	result.Rows = len(keys)
+
+	for _, key := range keys {
+		viewRow, inView := viewRows[key]
+		tableRow, inTable := tableRows[key]
+		switch {
+		case !inView:
+			result.MissingFromView++
+			for _, idxs := range compared {
+				val := tableRow.Values[idxs.table]
+				addDrift(&ViewDrift{TS: encoding.TimeFromInt(tableRow.TS), Dims: tableRow.Key.AsMap(), Field: tableFields[idxs.table].Name, Table: &val})
+			}
+		case !inTable:
+			result.MissingFromTable++
+			for _, idxs := range compared {
+				val := viewRow.Values[idxs.view]
+				addDrift(&ViewDrift{TS: encoding.TimeFromInt(viewRow.TS), Dims: viewRow.Key.AsMap(), Field: viewFields[idxs.view].Name, View: &val})
+			}
+		default:
+			for _, idxs := range compared {
+				viewVal, tableVal := viewRow.Values[idxs.view], tableRow.Values[idxs.table]
+				diff := relativeDiff(viewVal, tableVal)
+				if diff <= viewVerificationTolerance {
+					continue
+				}
+				result.Mismatched++
+				if diff > result.MaxRelativeDiff {
+					result.MaxRelativeDiff = diff
+				}
+				addDrift(&ViewDrift{TS: encoding.TimeFromInt(viewRow.TS), Dims: viewRow.Key.AsMap(), Field: viewFields[idxs.view].Name, View: &viewVal, Table: &tableVal})
+			}
+		}
+	}
+
+	if !result.OK() {
+		log.Error(result)
+	} else {
+		log.Debug(result)
+	}
+	return result, nil
+}
+
+// verificationRows runs the given query (including the memstore) and returns
+// its rows keyed to their period and dimensions.
+func (db *DB) verificationRows(ctx context.Context, sqlString string) (map[string]*core.FlatRow, core.Fields, error) {
+	source, err := db.Query(sqlString, false, nil, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	var fields core.Fields
+	rows := make(map[string]*core.FlatRow)
+	_, err = source.Iterate(ctx, func(_fields core.Fields) error {
+		fields = _fields
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		rows[fmt.Sprintf("%d|%v", row.TS, string(row.Key))] = row
+		return true, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return rows, fields, nil
+}
+
+func relativeDiff(a float64, b float64) float64 {
+	if a == b {
+		return 0
+	}
+	return math.Abs(a-b) / math.Max(math.Abs(a), math.Abs(b))
+}
@@ -0,0 +1,90 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/vtime"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyView(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2020, 1, 1, 0, 10, 0, 0, time.UTC)
+	clock := vtime.NewVirtualClock(epoch)
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		// Don't wait to coalesce iterations
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+		"view_a": &TableOpts{
+			View:            true,
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM test_a WHERE dim = 'a' GROUP BY dim, period(5m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	insert := func(ts time.Time, dim string, i float64) {
+		assert.NoError(t, db.Insert("inbound", ts, map[string]interface{}{"dim": dim, "other": "x"}, map[string]float64{"i": i}))
+	}
+	insert(epoch.Add(-8*time.Minute), "a", 1)
+	insert(epoch.Add(-7*time.Minute), "a", 2)
+	insert(epoch.Add(-6*time.Minute), "b", 4)
+	time.Sleep(250 * time.Millisecond)
+
+	_, err = db.VerifyView(context.Background(), "test_a", 0)
+	assert.Error(t, err, "verifying something other than a view should fail")
+
+	verification, err := db.VerifyView(context.Background(), "view_a", 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, verification.OK(), verification.String())
+	assert.Equal(t, "test_a", verification.Table)
+	assert.Equal(t, 1, verification.Rows)
+	assert.Contains(t, verification.Fields, "i")
+
+	// Break the view's WHERE clause so that it takes in points that its SQL says
+	// it shouldn't
+	db.getTable("view_a").applyWhere(nil)
+	insert(epoch.Add(-3*time.Minute), "b", 8)
+	time.Sleep(250 * time.Millisecond)
+
+	verification, err = db.VerifyView(context.Background(), "view_a", 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, verification.OK())
+	assert.Equal(t, 2, verification.Rows)
+	assert.Equal(t, 1, verification.MissingFromTable)
+	assert.Equal(t, 0, verification.MissingFromView)
+	if assert.NotEmpty(t, verification.Drifts) {
+		drift := verification.Drifts[0]
+		assert.Equal(t, "b", drift.Dims["dim"])
+		assert.Nil(t, drift.Table)
+		if assert.NotNil(t, drift.View) {
+			assert.EqualValues(t, 8, *drift.View)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oxtoacart/bpool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileNaming(t *testing.T) {
+	seq := newFileSequence()
+	filename := filepath.Join("folder", sequenceToFilename(seq))
+	assert.Equal(t, seq, filenameToSequence(filename))
+	filename = filename + compressedSuffix
+	assert.Equal(t, seq, filenameToSequence(filename))
+}
+
+func TestOffsetAfter(t *testing.T) {
+	assert.True(t, newOffset(0, 1).After(nil))
+	assert.False(t, Offset(nil).After(newOffset(0, 1)))
+
+	assert.True(t, newOffset(1, 0).After(nil))
+	assert.False(t, Offset(nil).After(newOffset(1, 0)))
+
+	assert.True(t, newOffset(1, 50).After(newOffset(1, 0)))
+	assert.False(t, newOffset(1, 0).After(newOffset(1, 50)))
+
+	assert.True(t, newOffset(2, 0).After(newOffset(1, 50)))
+	assert.False(t, newOffset(1, 50).After(newOffset(2, 0)))
+
+	assert.False(t, Offset(nil).After(Offset(nil)))
+	assert.False(t, newOffset(1, 50).After(newOffset(1, 50)))
+}
+
+func TestReopenAndTruncate(t *testing.T) {
+	origMaxSegmentSize := maxSegmentSize
+	defer func() {
+		maxSegmentSize = origMaxSegmentSize
+	}()
+	maxSegmentSize = 5
+
+	dir, err := ioutil.TempDir("", "waltest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := Open(dir, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		wal.Close()
+	}()
+
+	bufferPool := bpool.NewBytePool(1, 65536)
+	r, err := wal.NewReader("test", nil, bufferPool.Get)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, val := range []string{"1", "2"} {
+		_, err = wal.Write([]byte(val))
+		if !assert.NoError(t, err) {
+			return
+		}
+		if !assertReads(t, r, val) {
+			return
+		}
+	}
+	readThrough := r.Offset()
+	r.Close()
+
+	// Reopen WAL
+	wal.Close()
+	wal, err = Open(dir, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	latest, latestOffset, err := wal.Latest()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "2", string(latest))
+	assert.EqualValues(t, 9, latestOffset.Position())
+
+	// A reader opened at the prior offset only gets new entries
+	r2, err := wal.NewReader("test", readThrough, bufferPool.Get)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r2.Close()
+	_, err = wal.Write([]byte("3"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assertReads(t, r2, "3") {
+		return
+	}
+
+	// Compressed segments can still be read
+	err = wal.CompressBefore(r2.Offset())
+	if !assert.NoError(t, err) {
+		return
+	}
+	r3, err := wal.NewReader("test", nil, bufferPool.Get)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r3.Close()
+	if !assertReads(t, r3, "1", "2", "3") {
+		return
+	}
+
+	_, err = wal.Write([]byte("data to force new segment"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	segments := countSegments(t, dir)
+
+	// Truncating before the first entry shouldn't delete anything
+	assert.NoError(t, wal.TruncateBefore(newOffset(0, 0)))
+	assert.Equal(t, segments, countSegments(t, dir))
+
+	// Truncating as of now removes all but the current segment and the one
+	// holding the latest entry
+	assert.NoError(t, wal.TruncateBeforeTime(time.Now()))
+	assert.Equal(t, 2, countSegments(t, dir))
+	latest, _, err = wal.Latest()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "data to force new segment", string(latest))
+	}
+
+	// Truncating to size 1 removes everything but the current (empty) segment,
+	// which can still be written to
+	assert.NoError(t, wal.TruncateToSize(1))
+	assert.Equal(t, 1, countSegments(t, dir))
+	_, err = wal.Write([]byte("4"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	latest, _, err = wal.Latest()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "4", string(latest))
+	}
+}
+
+func TestWriteTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waltest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := Open(dir, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer wal.Close()
+
+	_, err = wal.Write([]byte("1"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	n, err := wal.Write(make([]byte, maxEntrySize/2), make([]byte, maxEntrySize/2+1))
+	assert.Error(t, err, "Writing an entry exceeding the maximum size should fail")
+	assert.Equal(t, 0, n)
+	latest, _, err := wal.Latest()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1", string(latest), "Entry exceeding the maximum size shouldn't have been written")
+	}
+}
+
+// assertReads asserts that the next entries read from r are the expected ones,
+// failing rather than blocking if they don't arrive.
+func assertReads(t *testing.T, r *Reader, expected ...string) bool {
+	for _, val := range expected {
+		read := make(chan string, 1)
+		errs := make(chan error, 1)
+		go func() {
+			b, err := r.Read()
+			if err != nil {
+				errs <- err
+				return
+			}
+			read <- string(b)
+		}()
+		select {
+		case actual := <-read:
+			if !assert.Equal(t, val, actual) {
+				return false
+			}
+		case err := <-errs:
+			assert.NoError(t, err)
+			return false
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "Timed out reading entry", "expected %v", val)
+			return false
+		}
+	}
+	return true
+}
+
+func countSegments(t *testing.T, dir string) int {
+	segments, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err, "Should be able to list segments")
+	return len(segments)
+}
+
+func TestSync(t *testing.T) {
+	origMaxSegmentSize := maxSegmentSize
+	defer func() {
+		maxSegmentSize = origMaxSegmentSize
+	}()
+	maxSegmentSize = 20
+
+	dir, err := ioutil.TempDir("", "waltest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Never sync on its own
+	wal, err := Open(dir, time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer wal.Close()
+
+	assert.EqualValues(t, 0, wal.SyncedOffset().Position())
+	_, err = wal.Write([]byte("1"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 0, wal.SyncedOffset().Position(), "Shouldn't have synced yet")
+	synced, err := wal.Sync()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 9, synced.Position())
+	assert.Equal(t, synced, wal.SyncedOffset())
+	fi, err := os.Stat(filepath.Join(dir, sequenceToFilename(synced.FileSequence())))
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 9, fi.Size(), "Synced data should be on disk")
+	}
+
+	// Filling up the segment syncs it before advancing
+	_, err = wal.Write([]byte("0123456789abc"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	rolledOver := wal.SyncedOffset()
+	assert.Equal(t, synced.FileSequence(), rolledOver.FileSequence())
+	assert.EqualValues(t, 30, rolledOver.Position())
+	synced, err = wal.Sync()
+	if assert.NoError(t, err) {
+		assert.True(t, synced.After(rolledOver), "Should have synced new segment")
+		assert.EqualValues(t, 0, synced.Position())
+	}
+
+	// Entries written before and after a sync can be read back
+	r, err := wal.NewReader("test", nil, bpool.NewBytePool(1, 65536).Get)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	for _, expected := range []string{"1", "0123456789abc"} {
+		b, readErr := r.Read()
+		if assert.NoError(t, readErr) {
+			assert.Equal(t, expected, string(b))
+		}
+	}
+}
+
+func TestSetSyncInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waltest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := Open(dir, time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer wal.Close()
+
+	_, err = wal.Write([]byte("1"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 0, wal.SyncedOffset().Position(), "Shouldn't have synced yet")
+
+	wal.SetSyncInterval(10 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, 9, wal.SyncedOffset().Position(), "Should have synced at new interval")
+
+	wal.SetSyncInterval(time.Hour)
+	_, err = wal.Write([]byte("2"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	wal.SetSyncInterval(0)
+	assert.EqualValues(t, 18, wal.SyncedOffset().Position(), "Switching to syncing on every write should have synced pending writes")
+	_, err = wal.Write([]byte("3"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 27, wal.SyncedOffset().Position(), "Should have synced on write")
+}
@@ -0,0 +1,139 @@
+package zenodb
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/getlantern/zenodb/wal"
+)
+
+type walSegment struct {
+	sequence  int64
+	filenames []string
+	size      int64
+}
+
+// truncateWAL removes the oldest segments of the given stream's WAL while it
+// exceeds MaxWALSize, keeping segments that are younger than MinWALAge and, if
+// RetainWALForFollowers is set, segments that followers haven't acknowledged
+// yet.
+func (db *DB) truncateWAL(stream string, w *wal.WAL) error {
+	limit := int64(db.opts.MaxWALSize)
+	if db.opts.MinWALAge <= 0 && !db.opts.RetainWALForFollowers {
+		return w.TruncateToSize(limit)
+	}
+
+	walDir := filepath.Join(db.opts.Dir, "_wal", stream)
+	segments, total, err := listWALSegments(walDir)
+	if err != nil {
+		return err
+	}
+
+	var acked wal.Offset
+	var laggingFollower string
+	if db.opts.RetainWALForFollowers {
+		acked, laggingFollower = db.minAckedOffset(stream)
+	}
+
+	retained := int64(0)
+	blockedBy := ""
+	// Never remove the latest segment, it's the one being written to
+	for i := 0; i < len(segments)-1 && total > limit; i++ {
+		segment := segments[i]
+		// The segment holds everything written up to the start of the next one
+		end := segmentOffset(segments[i+1].sequence)
+		if db.opts.MinWALAge > 0 && time.Since(end.TS()) < db.opts.MinWALAge {
+			retained = total - limit
+			break
+		}
+		if acked != nil && end.After(acked) {
+			retained = total - limit
+			blockedBy = laggingFollower
+			log.Debugf("Follower %v hasn't acknowledged %v in WAL for %v, retaining %d bytes beyond limit", laggingFollower, acked, stream, retained)
+			break
+		}
+		for _, filename := range segment.filenames {
+			fullname := filepath.Join(walDir, filename)
+			rmErr := os.Remove(fullname)
+			if rmErr != nil && !os.IsNotExist(rmErr) {
+				return errors.New("Unable to remove WAL segment %v: %v", fullname, rmErr)
+			}
+			log.Debugf("Removed WAL file %v", fullname)
+		}
+		total -= segment.size
+	}
+	metrics.WALRetained(stream, retained, blockedBy)
+	return nil
+}
+
+// minAckedOffset returns the earliest offset in the given stream that's been
+// acknowledged by all followers that aren't revoked, along with the name of
+// the follower that acknowledged it. Followers that have never acknowledged
+// anything don't hold back truncation.
+func (db *DB) minAckedOffset(stream string) (wal.Offset, string) {
+	db.followersMx.RLock()
+	defer db.followersMx.RUnlock()
+
+	var min wal.Offset
+	var follower string
+	for key, ack := range db.followerAcks {
+		parts := strings.Split(key, "|")
+		if len(parts) < 3 || parts[len(parts)-2] != stream {
+			continue
+		}
+		name := ack.FollowerName
+		if name == "" {
+			name = strings.Join(parts[:len(parts)-2], "|")
+		}
+		if db.revokedFollowers[name] {
+			continue
+		}
+		for _, offset := range ack.Tables {
+			if min == nil || min.After(offset) {
+				min = offset
+				follower = name
+			}
+		}
+	}
+	return min, follower
+}
+
+// listWALSegments lists the segments in the given WAL directory, oldest first,
+// along with their total size.
+func listWALSegments(walDir string) ([]*walSegment, int64, error) {
+	files, err := ioutil.ReadDir(walDir)
+	if err != nil {
+		return nil, 0, errors.New("Unable to list WAL segments in %v: %v", walDir, err)
+	}
+	var segments []*walSegment
+	total := int64(0)
+	for _, file := range files {
+		sequence, parseErr := strconv.ParseInt(strings.TrimSuffix(file.Name(), walCompressedSuffix), 10, 64)
+		if parseErr != nil {
+			continue
+		}
+		total += file.Size()
+		if len(segments) > 0 && segments[len(segments)-1].sequence == sequence {
+			// Segment is in the middle of being compressed
+			segment := segments[len(segments)-1]
+			segment.filenames = append(segment.filenames, file.Name())
+			segment.size += file.Size()
+			continue
+		}
+		segments = append(segments, &walSegment{sequence, []string{file.Name()}, file.Size()})
+	}
+	return segments, total, nil
+}
+
+func segmentOffset(sequence int64) wal.Offset {
+	offset := make(wal.Offset, wal.OffsetSize)
+	binary.BigEndian.PutUint64(offset, uint64(sequence))
+	return offset
+}
@@ -0,0 +1,87 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/getlantern/zenodb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWALRetention(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:        tmpDir,
+		MaxWALSize: 100,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	// Writes 4 segments of 60 bytes each, started 4, 3, 2 and 1 hours ago
+	writeSegments := func(stream string) []int64 {
+		walDir := filepath.Join(tmpDir, "_wal", stream)
+		if !assert.NoError(t, os.MkdirAll(walDir, 0755)) {
+			return nil
+		}
+		var sequences []int64
+		for i := 4; i > 0; i-- {
+			offset := wal.NewOffsetForTS(time.Now().Add(-1 * time.Duration(i) * time.Hour))
+			sequences = append(sequences, offset.FileSequence())
+			assert.NoError(t, ioutil.WriteFile(filepath.Join(walDir, fmt.Sprintf("%019d", offset.FileSequence())), make([]byte, 60), 0644))
+		}
+		return sequences
+	}
+	remaining := func(stream string) int {
+		segments, _, listErr := listWALSegments(filepath.Join(tmpDir, "_wal", stream))
+		assert.NoError(t, listErr)
+		return len(segments)
+	}
+	streamStats := func(stream string) *metrics.StreamStats {
+		for _, ss := range metrics.GetStats().Streams {
+			if ss.Stream == stream {
+				return ss
+			}
+		}
+		return &metrics.StreamStats{}
+	}
+
+	db.opts.MinWALAge = 150 * time.Minute
+	writeSegments("aged")
+	assert.NoError(t, db.truncateWAL("aged", nil))
+	assert.Equal(t, 3, remaining("aged"), "only segment older than MinWALAge should have been removed")
+	assert.EqualValues(t, 80, streamStats("aged").RetainedWALBytes)
+	assert.Empty(t, streamStats("aged").LaggingFollower)
+
+	db.opts.MinWALAge = 0
+	db.opts.RetainWALForFollowers = true
+	sequences := writeSegments("followed")
+	acked := segmentOffset(sequences[1])
+	acked[15] = 10
+	db.followersMx.Lock()
+	db.followerAcks[followerAckKey("", "follower_a", "followed", 0)] = &followerAck{FollowerName: "follower_a", Tables: map[string]wal.Offset{"table_a": acked}}
+	db.followerAcks[followerAckKey("", "follower_b", "other", 0)] = &followerAck{FollowerName: "follower_b", Tables: map[string]wal.Offset{"table_b": segmentOffset(sequences[0])}}
+	db.followersMx.Unlock()
+	assert.NoError(t, db.truncateWAL("followed", nil))
+	assert.Equal(t, 3, remaining("followed"), "segments that follower hasn't acknowledged should have been retained")
+	assert.EqualValues(t, 80, streamStats("followed").RetainedWALBytes)
+	assert.Equal(t, "follower_a", streamStats("followed").LaggingFollower)
+	assert.Equal(t, 1, streamStats("followed").BlockedWALTruncations)
+
+	assert.NoError(t, db.RevokeFollower("follower_a"))
+	assert.NoError(t, db.truncateWAL("followed", nil))
+	assert.Equal(t, 1, remaining("followed"), "revoked follower shouldn't hold back truncation")
+	assert.Zero(t, streamStats("followed").RetainedWALBytes)
+	assert.Empty(t, streamStats("followed").LaggingFollower)
+}
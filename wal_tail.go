@@ -0,0 +1,118 @@
+package zenodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/compress"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/encryption"
+	"github.com/getlantern/zenodb/wal"
+)
+
+// applyWALTail applies the entries in the table's stream WAL after the given
+// offset, up to the current end of the WAL, to ms. This lets queries include
+// data that's been inserted but not yet applied to the table, for example
+// because inserts are waiting on a flush. The table itself is unaffected, so
+// ms must not share data with the table's memstore (see memstore.deepCopy).
+//
+// Only data that's been synced to disk is visible in the WAL, and followers
+// don't have a local WAL for their tables, so on followers this does nothing.
+func (t *table) applyWALTail(ctx context.Context, ms *memstore, applied wal.Offset) {
+	if t.db.opts.Follow != nil {
+		return
+	}
+	t.db.tablesMutex.RLock()
+	w := t.db.streams[t.From]
+	t.db.tablesMutex.RUnlock()
+	if w == nil {
+		return
+	}
+
+	start := time.Now()
+	head, err := t.db.walHead(t.From)
+	if err != nil {
+		t.log.Errorf("Unable to determine end of WAL, not including WAL tail: %v", err)
+		return
+	}
+	if applied != nil && !head.After(applied) {
+		// Nothing that hasn't been applied yet
+		return
+	}
+
+	r, err := w.NewReader(t.Name+"_tail", applied, func() []byte { return nil })
+	if err != nil {
+		t.log.Errorf("Unable to obtain WAL reader, not including WAL tail: %v", err)
+		return
+	}
+	done := make(chan interface{})
+	defer close(done)
+	go func() {
+		// Closing the reader unblocks any pending Read
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		r.Close()
+	}()
+
+	truncateBefore := t.truncateBefore()
+	where := t.getWhere()
+	included := 0
+	for head.After(r.Offset()) {
+		data, readErr := r.Read()
+		if readErr != nil {
+			if ctx.Err() == nil {
+				t.log.Errorf("Unable to read WAL tail: %v", readErr)
+			}
+			break
+		}
+		if data == nil {
+			continue
+		}
+		if encryption.IsEncrypted(data) || compress.IsCompressed(data) {
+			data, readErr = t.db.openWALEntry(data)
+			if readErr != nil {
+				t.log.Errorf("Unable to open WAL entry in tail, skipping: %v", readErr)
+				continue
+			}
+		}
+		if t.applyWALTailEntry(ms, data, truncateBefore, where) {
+			included++
+		}
+	}
+	t.log.Debugf("Included %d points from WAL tail from %v to %v in %v", included, applied, head, time.Since(start))
+}
+
+// applyWALTailEntry applies a single WAL entry to ms the same way that insert
+// would apply it to the table, returning true if the entry was included.
+func (t *table) applyWALTailEntry(ms *memstore, data []byte, truncateBefore time.Time, where goexpr.Expr) (included bool) {
+	defer func() {
+		p := recover()
+		if p != nil {
+			t.log.Errorf("Panic in applying WAL tail entry: %v", p)
+			included = false
+		}
+	}()
+
+	tsd, remain := encoding.Read(data, encoding.Width64bits)
+	ts := encoding.TimeFromBytes(tsd)
+	if ts.Before(truncateBefore) {
+		return false
+	}
+	dimsLen, remain := encoding.ReadInt32(remain)
+	dims, remain := encoding.Read(remain, dimsLen)
+	valsLen, remain := encoding.ReadInt32(remain)
+	vals, _ := encoding.Read(remain, valsLen)
+	dimsBM := bytemap.ByteMap(dims)
+	if where != nil && !where.Eval(dimsBM).(bool) {
+		return false
+	}
+	if t.routedElsewhere(dimsBM) {
+		return false
+	}
+	ms.tree.Update(t.keyFor(dimsBM), nil, encoding.NewTSParams(ts, bytemap.ByteMap(vals)), dimsBM)
+	return true
+}
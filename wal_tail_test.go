@@ -0,0 +1,81 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryWALTail(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir: tmpDir,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(Schema{
+		"test_a": &TableOpts{
+			RetentionPeriod: time.Hour,
+			MaxFlushLatency: time.Hour,
+			SQL:             "SELECT i FROM inbound WHERE dim != 'skip' GROUP BY period(1h)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	insert := func(dim string) {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"dim": dim}, map[string]float64{"i": 1}))
+	}
+	query := func(hints string) float64 {
+		source, err := db.Query("SELECT "+hints+" i FROM test_a", false, nil, true)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		total := float64(0)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			total += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return total
+	}
+
+	for i := 0; i < 3; i++ {
+		insert("a")
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	// Hold up applying inserts by not acknowledging a forced flush
+	rs := db.getTable("test_a").rowStore
+	rs.forceFlushes <- true
+	insert("b")
+	insert("skip")
+	insert("b")
+	time.Sleep(250 * time.Millisecond)
+
+	assert.EqualValues(t, 3, query(""), "without WAL tail, un-applied inserts shouldn't show up")
+	assert.EqualValues(t, 5, query("-- include_wal_tail\n"), "WAL tail should include un-applied inserts")
+	assert.EqualValues(t, 3, query(""), "including WAL tail shouldn't affect the table")
+
+	db.opts.IncludeWALTail = true
+	assert.EqualValues(t, 5, query("-- force_fresh\n"), "IncludeWALTail should apply to fresh queries")
+
+	// Let inserts be applied
+	<-rs.forceFlushCompletes
+	time.Sleep(250 * time.Millisecond)
+	assert.EqualValues(t, 5, query("-- include_wal_tail\n"), "applied inserts shouldn't be counted twice")
+}
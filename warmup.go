@@ -0,0 +1,88 @@
+package zenodb
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+)
+
+const (
+	warmupQueryTimeout  = 10 * time.Minute
+	warmupCheckInterval = 1 * time.Second
+)
+
+// RegisterWarmupHandler registers a handler that runs each of the warm-up
+// queries instead of the database simply running them and discarding the
+// results, for example in order to populate a cache of query results. Handlers
+// only apply to warm-up queries that haven't started yet.
+func (db *DB) RegisterWarmupHandler(handler func(sqlString string) error) {
+	db.warmupMx.Lock()
+	db.warmupHandlers = append(db.warmupHandlers, handler)
+	db.warmupMx.Unlock()
+	db.warmupHandlerOnce.Do(func() {
+		if db.warmupHandlerReady != nil {
+			close(db.warmupHandlerReady)
+		}
+	})
+}
+
+// WarmedUp indicates whether the database has finished running the configured
+// WarmupQueries. It's always true if there aren't any.
+func (db *DB) WarmedUp() bool {
+	return atomic.LoadInt32(&db.warmedUp) == 1
+}
+
+// warmup runs the configured WarmupQueries once all tables have recovered, so
+// that the data they touch is in the OS page cache by the time that users
+// start querying.
+func (db *DB) warmup() {
+	if db.opts.WaitForWarmupHandler {
+		log.Debug("Waiting for warm-up handler to register")
+		<-db.warmupHandlerReady
+	}
+	for !db.Recovered() {
+		time.Sleep(warmupCheckInterval)
+	}
+
+	start := time.Now()
+	log.Debugf("Running %d warm-up queries", len(db.opts.WarmupQueries))
+	for _, sqlString := range db.opts.WarmupQueries {
+		queryStart := time.Now()
+		err := db.runWarmupQuery(sqlString)
+		if err != nil {
+			log.Errorf("Error running warm-up query %v: %v", sqlString, err)
+			continue
+		}
+		log.Debugf("Ran warm-up query in %v: %v", time.Now().Sub(queryStart), sqlString)
+	}
+	atomic.StoreInt32(&db.warmedUp, 1)
+	log.Debugf("Finished warming up in %v", time.Now().Sub(start))
+}
+
+func (db *DB) runWarmupQuery(sqlString string) error {
+	db.warmupMx.RLock()
+	handlers := db.warmupHandlers
+	db.warmupMx.RUnlock()
+	if len(handlers) > 0 {
+		for _, handler := range handlers {
+			if err := handler(sqlString); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	source, err := db.Query(sqlString, false, nil, false)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), warmupQueryTimeout)
+	defer cancel()
+	_, err = source.Iterate(ctx, core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+		// Discard results
+		return true, nil
+	})
+	return err
+}
@@ -0,0 +1,45 @@
+package zenodb
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmup(t *testing.T) {
+	db, err := NewDB(&DBOpts{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	assert.True(t, db.WarmedUp(), "Database without warm-up queries should be warmed up immediately")
+
+	db, err = NewDB(&DBOpts{WarmupQueries: []string{"SELECT * FROM test_a", "SELECT * FROM test_b"}, WaitForWarmupHandler: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	time.Sleep(250 * time.Millisecond)
+	assert.False(t, db.WarmedUp(), "Database shouldn't warm up before the warm-up handler registers")
+
+	var mx sync.Mutex
+	var ran []string
+	db.RegisterWarmupHandler(func(sqlString string) error {
+		mx.Lock()
+		ran = append(ran, sqlString)
+		mx.Unlock()
+		return nil
+	})
+
+	for i := 0; i < 50 && !db.WarmedUp(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if assert.True(t, db.WarmedUp(), "Database should have warmed up") {
+		mx.Lock()
+		assert.Equal(t, []string{"SELECT * FROM test_a", "SELECT * FROM test_b"}, ran)
+		mx.Unlock()
+	}
+}
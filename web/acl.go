@@ -0,0 +1,37 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/getlantern/zenodb/acl"
+)
+
+// acl lists the roles granted to each principal in the ACL on GET and reloads
+// the ACL from its file on POST. Both require the admin role.
+func (h *handler) acl(resp http.ResponseWriter, req *http.Request) {
+	if h.ACL == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	if _, ok := h.authorize(resp, req, acl.Admin, acl.AllTables); !ok {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		resp.Header().Set(ContentType, ContentTypeJSON)
+		json.NewEncoder(resp).Encode(h.ACL.Describe())
+	case http.MethodPost:
+		err := h.ACL.Reload()
+		if err != nil {
+			internalServerError(resp, "Unable to reload ACL: %v", err)
+			return
+		}
+		resp.WriteHeader(http.StatusOK)
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(resp, "Method %v not allowed\n", req.Method)
+	}
+}
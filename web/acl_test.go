@@ -0,0 +1,120 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/acl"
+	"github.com/getlantern/zenodb/common"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACL(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := zenodb.NewDB(&zenodb.DBOpts{
+		Dir: tmpDir,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(zenodb.Schema{
+		"table_a": &zenodb.TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+		"table_b": &zenodb.TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	a, err := acl.New(acl.Config{
+		"reader": {Password: "readerpass", Grants: map[string]acl.Role{"table_a": acl.Reader}},
+		"admin":  {Password: "adminpass", Role: acl.Admin},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := &handler{db: db, Opts: Opts{QueryTimeout: time.Minute, MaxResponseBytes: 1024 * 1024, ACL: a}}
+
+	request := func(method string, target string, password string, body string) *http.Request {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		if password != "" {
+			req.Header.Set(authheader, password)
+		}
+		return req
+	}
+
+	resp := httptest.NewRecorder()
+	h.sqlQuery(resp, request(http.MethodGet, "/async?SELECT%20*%20FROM%20table_a", "", ""), shortTimeout, false)
+	assert.Equal(t, http.StatusForbidden, resp.Code, "unauthenticated query should be forbidden")
+
+	resp = httptest.NewRecorder()
+	h.sqlQuery(resp, request(http.MethodGet, "/async?SELECT%20*%20FROM%20table_b", "readerpass", ""), shortTimeout, false)
+	assert.Equal(t, http.StatusForbidden, resp.Code, "query of table without grant should be forbidden")
+
+	resp = httptest.NewRecorder()
+	h.grafanaSearch(resp, request(http.MethodPost, "/grafana/search", "readerpass", `{"target": "table"}`))
+	assert.Equal(t, "[\"table_a\"]\n", resp.Body.String(), "search should only list readable tables")
+
+	resp = httptest.NewRecorder()
+	h.grafanaSearch(resp, request(http.MethodPost, "/grafana/search", "adminpass", `{"target": "table"}`))
+	assert.Equal(t, "[\"table_a\",\"table_b\"]\n", resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	h.settings(resp, request(http.MethodGet, "/settings", "readerpass", ""))
+	assert.Equal(t, http.StatusForbidden, resp.Code, "settings should require admin")
+
+	resp = httptest.NewRecorder()
+	h.settings(resp, request(http.MethodGet, "/settings", "adminpass", ""))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	insert := func(password string) int {
+		req := request(http.MethodPost, "/insert/inbound", password, `{"dims": {"a": 1}, "vals": {"i": 1}}`)
+		req.Header.Set(ContentType, ContentTypeJSON)
+		resp := httptest.NewRecorder()
+		h.insert(resp, mux.SetURLVars(req, map[string]string{"stream": "inbound"}))
+		return resp.Code
+	}
+	assert.Equal(t, http.StatusForbidden, insert("readerpass"), "insert should require writer")
+	assert.Equal(t, http.StatusCreated, insert("adminpass"))
+
+	prepare := func(password string, sqlString string) (int, string) {
+		resp := httptest.NewRecorder()
+		h.prepare(resp, request(http.MethodGet, "/prepare?sql="+url.QueryEscape(sqlString), password, ""))
+		prepared := &common.PreparedQuery{}
+		json.Unmarshal(resp.Body.Bytes(), prepared)
+		return resp.Code, prepared.ID
+	}
+	code, _ := prepare("readerpass", "SELECT * FROM table_b WHERE a = ?")
+	assert.Equal(t, http.StatusForbidden, code, "preparing query of table without grant should be forbidden")
+	code, _ = prepare("readerpass", "SELECT * FROM table_a WHERE a = ? LIMIT ?")
+	assert.Equal(t, http.StatusOK, code)
+	code, id := prepare("adminpass", "SELECT * FROM table_b WHERE a = ?")
+	assert.Equal(t, http.StatusOK, code)
+	resp = httptest.NewRecorder()
+	h.preparedQuery(resp, mux.SetURLVars(request(http.MethodGet, "/async/prepared/"+id+"?param=1", "readerpass", ""), map[string]string{"id": id, "mode": "async"}))
+	assert.Equal(t, http.StatusForbidden, resp.Code, "running query prepared by someone else for table without grant should be forbidden")
+
+	resp = httptest.NewRecorder()
+	h.acl(resp, request(http.MethodGet, "/acl", "adminpass", ""))
+	assert.Equal(t, "{\"admin\":{\"*\":\"admin\"},\"reader\":{\"table_a\":\"reader\"}}\n", resp.Body.String())
+}
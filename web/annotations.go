@@ -0,0 +1,118 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/acl"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// ResultAnnotation is an annotation overlaid onto query results. TS is the
+// timestamp of the period containing the annotation, Time is when the
+// annotation actually happened.
+type ResultAnnotation struct {
+	TS       int64
+	Time     int64
+	Category string
+	Text     string
+	Tags     map[string]string
+}
+
+func (h *handler) annotations(resp http.ResponseWriter, req *http.Request) {
+	principal, ok := h.principal(resp, req)
+	if !ok {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		asOf, err := millisParam(req, "from")
+		if err != nil {
+			badRequest(resp, "Invalid from: %v", err)
+			return
+		}
+		until, err := millisParam(req, "to")
+		if err != nil {
+			badRequest(resp, "Invalid to: %v", err)
+			return
+		}
+		annotations := h.db.Annotations(asOf, until, req.URL.Query()["category"]...)
+		if annotations == nil {
+			annotations = []*zenodb.Annotation{}
+		}
+		resp.Header().Set(ContentType, ContentTypeJSON)
+		json.NewEncoder(resp).Encode(annotations)
+	case http.MethodPost:
+		// Annotations are overlaid onto queries of any table
+		if err := principal.Check(acl.Writer, acl.AllTables); err != nil {
+			forbidden(resp, "%v", err)
+			return
+		}
+		contentType := req.Header.Get(ContentType)
+		if contentType != ContentTypeJSON {
+			resp.WriteHeader(http.StatusUnsupportedMediaType)
+			fmt.Fprintf(resp, "Media type %v unsupported\n", contentType)
+			return
+		}
+		annotation := &zenodb.Annotation{}
+		err := json.NewDecoder(req.Body).Decode(annotation)
+		if err != nil {
+			badRequest(resp, "Error decoding JSON: %v", err)
+			return
+		}
+		if annotation.Category == "" {
+			badRequest(resp, "Need a category")
+			return
+		}
+		err = h.db.Annotate(annotation)
+		if err != nil {
+			internalServerError(resp, "Error recording annotation: %v", err)
+			return
+		}
+		resp.WriteHeader(http.StatusCreated)
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(resp, "Method %v not allowed\n", req.Method)
+	}
+}
+
+// millisParam parses the named query parameter as a unix timestamp in
+// milliseconds, returning the zero time if it's absent.
+func millisParam(req *http.Request, name string) (time.Time, error) {
+	value := req.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return encoding.TimeFromMillis(millis), nil
+}
+
+// overlayAnnotations keys the given annotations to the periods of query
+// results with the given resolution that end at until.
+func overlayAnnotations(annotations []*zenodb.Annotation, resolution time.Duration, until time.Time) []*ResultAnnotation {
+	result := make([]*ResultAnnotation, 0, len(annotations))
+	for _, annotation := range annotations {
+		period := annotation.TS
+		if resolution > 0 {
+			period = encoding.RoundTimeUntilUp(period, resolution, until)
+		}
+		result = append(result, &ResultAnnotation{
+			TS:       common.TimeToMillis(period),
+			Time:     common.TimeToMillis(annotation.TS),
+			Category: annotation.Category,
+			Text:     annotation.Text,
+			Tags:     annotation.Tags,
+		})
+	}
+	return result
+}
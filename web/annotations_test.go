@@ -0,0 +1,26 @@
+package web
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverlayAnnotations(t *testing.T) {
+	until := time.Date(2020, 1, 1, 1, 0, 0, 0, time.UTC)
+	annotations := []*zenodb.Annotation{
+		{TS: until.Add(-50 * time.Minute), Category: "deploy", Text: "v1"},
+		{TS: until.Add(-10 * time.Minute), Category: "incident", Text: "outage"},
+	}
+	overlaid := overlayAnnotations(annotations, 15*time.Minute, until)
+	if assert.Len(t, overlaid, 2) {
+		assert.Equal(t, common.TimeToMillis(until.Add(-45*time.Minute)), overlaid[0].TS, "Should be keyed to the period containing the annotation")
+		assert.Equal(t, common.TimeToMillis(until.Add(-50*time.Minute)), overlaid[0].Time)
+		assert.Equal(t, "deploy", overlaid[0].Category)
+		assert.Equal(t, common.TimeToMillis(until), overlaid[1].TS)
+		assert.Equal(t, "outage", overlaid[1].Text)
+	}
+}
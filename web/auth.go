@@ -1,11 +1,15 @@
 package web
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"time"
+
+	"github.com/getlantern/zenodb/acl"
+	"github.com/gorilla/mux"
 )
 
 const (
@@ -21,40 +25,87 @@ var (
 )
 
 type AuthData struct {
+	// Provider is the provider with which the user logged in, either github
+	// (or empty for sessions from before OIDC support) or oidc.
+	Provider    string
 	AccessToken string
-	Expiration  time.Time
+	// Subject and Email identify users that logged in with OIDC
+	Subject    string
+	Email      string
+	Expiration time.Time
 }
 
 func (h *handler) authenticate(resp http.ResponseWriter, req *http.Request) bool {
-	if h.Opts.OAuthClientID == "" || h.Opts.OAuthClientSecret == "" {
-		log.Debug("OAuth not configured, not authenticating!")
-		return true
+	_, ok := h.principal(resp, req)
+	return ok
+}
+
+// principal authenticates the request and returns its principal. Requests that
+// present the shared password in the auth header authenticate as acl.Root,
+// requests that present the password of a principal in the ACL authenticate as
+// that principal and requests that present an API token as a Bearer token
+// authenticate as that token's principal. Members of the GitHub org, users allowed by the OIDC
+// provider and, if neither OAuth, OIDC nor an ACL is configured, everyone, may
+// do anything and get a nil principal.
+func (h *handler) principal(resp http.ResponseWriter, req *http.Request) (*acl.Principal, bool) {
+	if token := bearerToken(req); token != "" {
+		if h.APITokens != nil {
+			principal, err := h.APITokens.Authenticate(token)
+			if err == nil {
+				return principal, true
+			}
+		}
+		// Don't send API clients to log in
+		return nil, false
 	}
 
 	// First check for static auth token
-	if h.Opts.Password != "" {
-		password := req.Header.Get(authheader)
-		if password != "" {
-			result := password == h.Opts.Password
-			return result
+	password := req.Header.Get(authheader)
+	if password != "" {
+		if h.Opts.Password != "" && subtle.ConstantTimeCompare([]byte(password), []byte(h.Opts.Password)) == 1 {
+			return acl.Root, true
+		}
+		if h.ACL != nil {
+			principal, err := h.ACL.Authenticate(password)
+			if err == nil {
+				return principal, true
+			}
 		}
 	}
 
-	// Then check for GitHub credentials
+	if !h.githubConfigured() && !h.oidcConfigured() {
+		if h.ACL != nil {
+			// With an ACL, everyone needs to authenticate
+			return nil, false
+		}
+		log.Debug("OAuth not configured, not authenticating!")
+		return nil, true
+	}
+
+	if password != "" && (h.Opts.Password != "" || h.ACL != nil) {
+		// Wrong auth token
+		return nil, false
+	}
+
+	// Then check for GitHub or OIDC credentials
 	cookie, err := req.Cookie(authcookie)
 	if err == nil {
 		ad := &AuthData{}
 		err = h.sc.Decode(authcookie, cookie.Value, ad)
-		if err == nil {
+		if err == nil && ad.Provider == providerOIDC {
+			if h.oidcConfigured() && ad.Expiration.After(time.Now()) {
+				return nil, true
+			}
+		} else if err == nil && h.githubConfigured() {
 			if ad.Expiration.Before(time.Now()) {
-				return true
+				return nil, true
 			}
 			inOrg, err := h.userInOrg(ad.AccessToken)
 			if err != nil {
 				log.Errorf("Unable to check if user is in org: %v", err)
 			} else if inOrg {
 				ad.Expiration = time.Now().Add(sessionTimeout)
-				return true
+				return nil, true
 			}
 		}
 	}
@@ -62,10 +113,77 @@ func (h *handler) authenticate(resp http.ResponseWriter, req *http.Request) bool
 	// User not logged in, request authorization from OAuth provider
 	h.requestAuthorization(resp, req)
 
-	return false
+	return nil, false
 }
 
+// authorize authenticates the request and checks that its principal has the
+// given role on all of the given tables. If not, it responds with 403
+// Forbidden and returns false.
+func (h *handler) authorize(resp http.ResponseWriter, req *http.Request, role acl.Role, tables ...string) (*acl.Principal, bool) {
+	principal, ok := h.principal(resp, req)
+	if !ok {
+		resp.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+	err := principal.Check(role, tables...)
+	if err != nil {
+		forbidden(resp, "%v", err)
+		return nil, false
+	}
+	return principal, true
+}
+
+// requestAuthorization sends the user to log in with the configured provider,
+// letting them choose if both GitHub and OIDC are configured.
 func (h *handler) requestAuthorization(resp http.ResponseWriter, req *http.Request) {
+	switch {
+	case h.githubConfigured() && h.oidcConfigured():
+		resp.Header().Set("Location", "/login")
+		resp.WriteHeader(http.StatusTemporaryRedirect)
+	case h.oidcConfigured():
+		h.requestOIDCAuthorization(resp, req)
+	default:
+		h.requestGitHubAuthorization(resp, req)
+	}
+}
+
+// login lets the user choose the provider with which to log in.
+func (h *handler) login(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/html")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(loginHTML)
+}
+
+func (h *handler) loginWith(resp http.ResponseWriter, req *http.Request) {
+	switch provider := mux.Vars(req)["provider"]; {
+	case provider == providerGitHub && h.githubConfigured():
+		h.requestGitHubAuthorization(resp, req)
+	case provider == providerOIDC && h.oidcConfigured():
+		h.requestOIDCAuthorization(resp, req)
+	default:
+		resp.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(resp, "Unknown login provider %v\n", provider)
+	}
+}
+
+var loginHTML = []byte(`
+<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>ZenoDB - Log in</title>
+</head>
+<body>
+  <h3>Log in to ZenoDB with</h3>
+  <ul>
+    <li><a href="/login/github">GitHub</a></li>
+    <li><a href="/login/oidc">Single sign-on</a></li>
+  </ul>
+</body>
+</html>
+`)
+
+func (h *handler) requestGitHubAuthorization(resp http.ResponseWriter, req *http.Request) {
 	xsrfExpiration := time.Now().Add(1 * time.Minute)
 	state, err := h.sc.Encode(xsrftoken, xsrfExpiration)
 	if err != nil {
@@ -96,11 +214,11 @@ func (h *handler) oauthCode(resp http.ResponseWriter, req *http.Request) {
 	err := h.sc.Decode(xsrftoken, state, &xsrfExpiration)
 	if err != nil {
 		log.Errorf("Unable to decode xsrf token, may indicate attempted attack, re-authorizing: %v", err)
-		h.requestAuthorization(resp, req)
+		h.requestGitHubAuthorization(resp, req)
 	}
 	if time.Now().After(xsrfExpiration) {
 		log.Error("XSRF Token expired, re-authorizing")
-		h.requestAuthorization(resp, req)
+		h.requestGitHubAuthorization(resp, req)
 		return
 	}
 
@@ -119,7 +237,7 @@ func (h *handler) oauthCode(resp http.ResponseWriter, req *http.Request) {
 	tokenResp, err := h.client.Do(post)
 	if err != nil {
 		log.Errorf("Error requesting access token, re-authorizing: %v", err)
-		h.requestAuthorization(resp, req)
+		h.requestGitHubAuthorization(resp, req)
 		return
 	}
 
@@ -127,7 +245,7 @@ func (h *handler) oauthCode(resp http.ResponseWriter, req *http.Request) {
 	body, err := ioutil.ReadAll(tokenResp.Body)
 	if err != nil {
 		log.Errorf("Error reading access token, re-authorizing: %v", err)
-		h.requestAuthorization(resp, req)
+		h.requestGitHubAuthorization(resp, req)
 		return
 	}
 
@@ -135,7 +253,7 @@ func (h *handler) oauthCode(resp http.ResponseWriter, req *http.Request) {
 	err = json.Unmarshal(body, &tokenData)
 	if err != nil {
 		log.Errorf("Error unmarshalling access token, re-authorizing: %v", err)
-		h.requestAuthorization(resp, req)
+		h.requestGitHubAuthorization(resp, req)
 		return
 	}
 
@@ -150,6 +268,7 @@ func (h *handler) oauthCode(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	ad := &AuthData{
+		Provider:    providerGitHub,
 		AccessToken: accessToken,
 		Expiration:  time.Now().Add(sessionTimeout),
 	}
@@ -0,0 +1,71 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/getlantern/zenodb/acl"
+	"github.com/getlantern/zenodb/metrics"
+	"github.com/gorilla/mux"
+)
+
+type followersResponse struct {
+	Followers []*metrics.FollowerStats
+	Revoked   []string
+	// Weights are the query routing weights of followers that have been
+	// assigned one
+	Weights map[string]float64
+}
+
+func (h *handler) followers(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := h.authorize(resp, req, acl.Admin, acl.AllTables); !ok {
+		return
+	}
+
+	json.NewEncoder(resp).Encode(&followersResponse{
+		Followers: metrics.GetStats().Followers,
+		Revoked:   h.db.RevokedFollowers(),
+		Weights:   h.db.ReplicaWeights(),
+	})
+}
+
+func (h *handler) revokeFollower(resp http.ResponseWriter, req *http.Request) {
+	h.updateFollower(resp, req, h.db.RevokeFollower)
+}
+
+func (h *handler) reinstateFollower(resp http.ResponseWriter, req *http.Request) {
+	h.updateFollower(resp, req, h.db.ReinstateFollower)
+}
+
+// setFollowerWeight sets the query routing weight of a follower to the value
+// of the weight parameter.
+func (h *handler) setFollowerWeight(resp http.ResponseWriter, req *http.Request) {
+	h.updateFollower(resp, req, func(name string) error {
+		weight, err := strconv.ParseFloat(req.URL.Query().Get("weight"), 64)
+		if err != nil {
+			return fmt.Errorf("Please specify a numeric weight: %v", err)
+		}
+		return h.db.SetReplicaWeight(name, weight)
+	})
+}
+
+func (h *handler) updateFollower(resp http.ResponseWriter, req *http.Request, update func(name string) error) {
+	if _, ok := h.authorize(resp, req, acl.Admin, acl.AllTables); !ok {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(resp, "Method %v not allowed\n", req.Method)
+		return
+	}
+
+	err := update(mux.Vars(req)["name"])
+	if err != nil {
+		internalServerError(resp, "Unable to update follower: %v", err)
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,319 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/zenodb/acl"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// The handlers in this file implement the protocol of Grafana's SimpleJSON
+// datasource, so that Grafana can query zenodb directly. Grafana's time range
+// becomes the ASOF and UNTIL of each query, and its interval becomes the
+// period by which the query is grouped.
+
+var errForbidden = errors.New("forbidden")
+
+type grafanaQueryRequest struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs    int64            `json:"intervalMs"`
+	MaxDataPoints int64            `json:"maxDataPoints"`
+	Targets       []*grafanaTarget `json:"targets"`
+}
+
+type grafanaTarget struct {
+	// Target is either the name of a table or a SELECT statement
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	// Type is "timeserie" (the default) or "table"
+	Type string `json:"type"`
+	Hide bool   `json:"hide"`
+}
+
+type grafanaTimeSeries struct {
+	Target string `json:"target"`
+	// Datapoints are pairs of value and timestamp in milliseconds
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type grafanaTable struct {
+	Type    string           `json:"type"`
+	Columns []*grafanaColumn `json:"columns"`
+	Rows    [][]interface{}  `json:"rows"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type grafanaSearchRequest struct {
+	Target string `json:"target"`
+}
+
+// grafanaTestConnection lets Grafana check that the datasource is reachable.
+func (h *handler) grafanaTestConnection(resp http.ResponseWriter, req *http.Request) {
+	if !h.authenticate(resp, req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+// grafanaSearch lists the readable tables whose names contain the requested
+// target, for use as targets in Grafana's query editor.
+func (h *handler) grafanaSearch(resp http.ResponseWriter, req *http.Request) {
+	principal, ok := h.principal(resp, req)
+	if !ok {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	search := &grafanaSearchRequest{}
+	if req.ContentLength != 0 {
+		err := json.NewDecoder(req.Body).Decode(search)
+		if err != nil {
+			badRequest(resp, "Error decoding JSON: %v", err)
+			return
+		}
+	}
+	target := strings.ToLower(search.Target)
+	names := make([]string, 0)
+	for _, table := range h.db.Tables() {
+		if strings.Contains(table.Name, target) && principal.Can(acl.Reader, table.Name) {
+			names = append(names, table.Name)
+		}
+	}
+	resp.Header().Set(ContentType, ContentTypeJSON)
+	json.NewEncoder(resp).Encode(names)
+}
+
+// grafanaQuery runs the requested targets and responds with a time series per
+// field and group or, for targets of type "table", with a table per target.
+func (h *handler) grafanaQuery(resp http.ResponseWriter, req *http.Request) {
+	principal, ok := h.principal(resp, req)
+	if !ok {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	gq := &grafanaQueryRequest{}
+	err := json.NewDecoder(req.Body).Decode(gq)
+	if err != nil {
+		badRequest(resp, "Error decoding JSON: %v", err)
+		return
+	}
+	if !gq.Range.To.After(gq.Range.From) {
+		badRequest(resp, "Please specify a time range")
+		return
+	}
+
+	ctx := common.WithPrincipal(common.WithCaller(req.Context(), "grafana:"+req.RemoteAddr), principal.String())
+	ctx, cancel := context.WithTimeout(ctx, h.QueryTimeout)
+	defer cancel()
+	results := make([]interface{}, 0, len(gq.Targets))
+	for _, target := range gq.Targets {
+		if target.Hide || strings.TrimSpace(target.Target) == "" {
+			continue
+		}
+		targetResults, err := h.grafanaTarget(ctx, principal, gq, target)
+		if err == errForbidden {
+			forbidden(resp, "Not authorized to query %v", target.RefID)
+			return
+		}
+		if err != nil {
+			err = common.ErrorWithRequestID(ctx, err)
+			log.Errorf("Unable to query target %v: %v", target.Target, err)
+			resp.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(resp, "Unable to query %v: %v", target.RefID, err)
+			return
+		}
+		results = append(results, targetResults...)
+	}
+
+	resultBytes, err := json.Marshal(results)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(resp, "Unable to marshal result: %v", err)
+		return
+	}
+	if len(resultBytes) > h.MaxResponseBytes {
+		resp.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(resp, "Query result size %v exceeded limit of %v", len(resultBytes), h.MaxResponseBytes)
+		return
+	}
+	resp.Header().Set(ContentType, ContentTypeJSON)
+	resp.Write(resultBytes)
+}
+
+func (h *handler) grafanaTarget(ctx context.Context, principal *acl.Principal, gq *grafanaQueryRequest, target *grafanaTarget) ([]interface{}, error) {
+	sqlString, err := h.grafanaSQL(gq, target.Target)
+	if err != nil {
+		return nil, err
+	}
+	if err := principal.CheckQuery(sqlString); err != nil {
+		log.Error(err)
+		return nil, errForbidden
+	}
+	log.Debugf("Running Grafana query: %v", sqlString)
+	rs, err := h.db.Query(sqlString, false, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []string
+	var rows []*core.FlatRow
+	_, err = rs.Iterate(ctx, func(inFields core.Fields) error {
+		fields = inFields.Names()
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		rows = append(rows, row)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].TS < rows[j].TS
+	})
+
+	if target.Type == "table" {
+		return []interface{}{grafanaTableFor(fields, rows)}, nil
+	}
+	return grafanaTimeSeriesFor(fields, rows), nil
+}
+
+// grafanaSQL builds the SQL for the given target, limited to the requested time
+// range and grouped by a period that corresponds to the requested interval.
+func (h *handler) grafanaSQL(gq *grafanaQueryRequest, target string) (string, error) {
+	sqlString := strings.TrimSpace(target)
+	if !strings.ContainsAny(sqlString, " \t\r\n") {
+		// Just a table name
+		sqlString = "SELECT * FROM " + sqlString
+	}
+
+	interval := time.Duration(gq.IntervalMs) * time.Millisecond
+	if gq.MaxDataPoints > 0 {
+		minInterval := gq.Range.To.Sub(gq.Range.From) / time.Duration(gq.MaxDataPoints)
+		if minInterval > interval {
+			interval = minInterval
+		}
+	}
+	var resolution time.Duration
+	tableName, err := sql.TableFor(sqlString)
+	if err != nil {
+		return "", err
+	}
+	for _, table := range h.db.Tables() {
+		if table.Name == tableName {
+			resolution = resolutionFor(interval, table.Resolution)
+			break
+		}
+	}
+	return sql.WithTimeRange(sqlString, gq.Range.From, gq.Range.To, resolution)
+}
+
+// resolutionFor returns the smallest multiple of the table's resolution that
+// covers the given interval.
+func resolutionFor(interval time.Duration, tableResolution time.Duration) time.Duration {
+	if tableResolution <= 0 || interval <= tableResolution {
+		return tableResolution
+	}
+	multiple := interval / tableResolution
+	if interval%tableResolution != 0 {
+		multiple++
+	}
+	return multiple * tableResolution
+}
+
+func grafanaTimeSeriesFor(fields []string, rows []*core.FlatRow) []interface{} {
+	var result []interface{}
+	seriesByName := make(map[string]*grafanaTimeSeries)
+	for _, row := range rows {
+		key := grafanaKey(row)
+		ts := float64(common.NanosToMillis(row.TS))
+		for i, value := range row.Values {
+			if i >= len(fields) {
+				break
+			}
+			name := fields[i] + key
+			series := seriesByName[name]
+			if series == nil {
+				series = &grafanaTimeSeries{Target: name}
+				seriesByName[name] = series
+				result = append(result, series)
+			}
+			series.Datapoints = append(series.Datapoints, [2]float64{value, ts})
+		}
+	}
+	return result
+}
+
+// grafanaKey formats the dimensions of a row like {dim1=a, dim2=b}, or returns
+// "" if the row has no dimensions.
+func grafanaKey(row *core.FlatRow) string {
+	var dims []string
+	row.Key.Iterate(true, true, func(dim string, value interface{}, valueBytes []byte) bool {
+		dims = append(dims, fmt.Sprintf("%v=%v", dim, value))
+		return true
+	})
+	if len(dims) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(dims, ", ") + "}"
+}
+
+func grafanaTableFor(fields []string, rows []*core.FlatRow) *grafanaTable {
+	dimsSeen := make(map[string]bool)
+	var dims []string
+	for _, row := range rows {
+		row.Key.Iterate(true, false, func(dim string, value interface{}, valueBytes []byte) bool {
+			if !dimsSeen[dim] {
+				dimsSeen[dim] = true
+				dims = append(dims, dim)
+			}
+			return true
+		})
+	}
+	sort.Strings(dims)
+
+	table := &grafanaTable{
+		Type:    "table",
+		Columns: []*grafanaColumn{{Text: "Time", Type: "time"}},
+		Rows:    make([][]interface{}, 0, len(rows)),
+	}
+	for _, dim := range dims {
+		table.Columns = append(table.Columns, &grafanaColumn{Text: dim, Type: "string"})
+	}
+	for _, field := range fields {
+		table.Columns = append(table.Columns, &grafanaColumn{Text: field, Type: "number"})
+	}
+	for _, row := range rows {
+		tableRow := make([]interface{}, 0, len(table.Columns))
+		tableRow = append(tableRow, common.NanosToMillis(row.TS))
+		for _, dim := range dims {
+			tableRow = append(tableRow, row.Key.Get(dim))
+		}
+		for i := range fields {
+			if i < len(row.Values) {
+				tableRow = append(tableRow, row.Values[i])
+			} else {
+				tableRow = append(tableRow, nil)
+			}
+		}
+		table.Rows = append(table.Rows, tableRow)
+	}
+	return table
+}
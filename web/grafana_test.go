@@ -0,0 +1,125 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolutionFor(t *testing.T) {
+	assert.Equal(t, time.Minute, resolutionFor(10*time.Second, time.Minute))
+	assert.Equal(t, time.Minute, resolutionFor(time.Minute, time.Minute))
+	assert.Equal(t, 2*time.Minute, resolutionFor(61*time.Second, time.Minute))
+	assert.Equal(t, 5*time.Minute, resolutionFor(5*time.Minute, time.Minute))
+}
+
+func TestGrafanaResults(t *testing.T) {
+	ts := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows := []*core.FlatRow{
+		{TS: ts.UnixNano(), Key: bytemap.New(map[string]interface{}{"dim": "a"}), Values: []float64{1, 2}},
+		{TS: ts.Add(time.Minute).UnixNano(), Key: bytemap.New(map[string]interface{}{"dim": "a"}), Values: []float64{3, 4}},
+		{TS: ts.UnixNano(), Key: bytemap.New(map[string]interface{}{"dim": "b", "other": 5}), Values: []float64{5, 6}},
+	}
+	millis := float64(ts.UnixNano() / int64(time.Millisecond))
+
+	series := grafanaTimeSeriesFor([]string{"x", "y"}, rows)
+	if assert.Len(t, series, 4) {
+		assert.Equal(t, &grafanaTimeSeries{Target: "x{dim=a}", Datapoints: [][2]float64{{1, millis}, {3, millis + 60000}}}, series[0])
+		assert.Equal(t, &grafanaTimeSeries{Target: "y{dim=a}", Datapoints: [][2]float64{{2, millis}, {4, millis + 60000}}}, series[1])
+		assert.Equal(t, "x{dim=b, other=5}", series[2].(*grafanaTimeSeries).Target)
+	}
+
+	table := grafanaTableFor([]string{"x", "y"}, rows)
+	var columns []string
+	for _, column := range table.Columns {
+		columns = append(columns, column.Text)
+	}
+	assert.Equal(t, []string{"Time", "dim", "other", "x", "y"}, columns)
+	if assert.Len(t, table.Rows, 3) {
+		assert.Equal(t, []interface{}{int64(millis), "b", 5, float64(5), float64(6)}, table.Rows[2])
+		assert.Nil(t, table.Rows[0][2], "missing dimension should be null")
+	}
+}
+
+func TestGrafanaQuery(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := zenodb.NewDB(&zenodb.DBOpts{
+		Dir:                       tmpDir,
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(zenodb.Schema{
+		"test_a": &zenodb.TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"dim": i % 2}, map[string]float64{"i": float64(i)}))
+	}
+	time.Sleep(250 * time.Millisecond)
+	db.FlushAll()
+
+	h := &handler{db: db, Opts: Opts{QueryTimeout: time.Minute, MaxResponseBytes: 1024 * 1024}}
+
+	resp := httptest.NewRecorder()
+	h.grafanaSearch(resp, httptest.NewRequest(http.MethodPost, "/grafana/search", bytes.NewBufferString(`{"target": "test"}`)))
+	assert.Equal(t, "[\"test_a\"]\n", resp.Body.String())
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"range": map[string]interface{}{
+			"from": now.Add(-30 * time.Minute),
+			"to":   now.Add(time.Minute),
+		},
+		"intervalMs":    90000,
+		"maxDataPoints": 100,
+		"targets": []map[string]interface{}{
+			{"target": "test_a", "refId": "A"},
+			{"target": "SELECT i FROM test_a GROUP BY dim", "refId": "B", "type": "table"},
+		},
+	})
+	resp = httptest.NewRecorder()
+	h.grafanaQuery(resp, httptest.NewRequest(http.MethodPost, "/grafana/query", bytes.NewReader(body)))
+	if !assert.Equal(t, http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+	var results []map[string]interface{}
+	if !assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &results)) {
+		return
+	}
+	if assert.Len(t, results, 5, "should have a series per field and dim plus a table") {
+		assert.Equal(t, "_points{dim=0}", results[0]["target"])
+		assert.Equal(t, "i{dim=0}", results[1]["target"])
+		assert.Equal(t, "_points{dim=1}", results[2]["target"])
+		assert.Equal(t, "i{dim=1}", results[3]["target"])
+		assert.Equal(t, "table", results[4]["type"])
+		assert.Len(t, results[4]["rows"], 2)
+		total := float64(0)
+		for _, datapoint := range results[1]["datapoints"].([]interface{}) {
+			total += datapoint.([]interface{})[0].(float64)
+		}
+		assert.EqualValues(t, 2, total)
+	}
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/acl"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 )
 
@@ -29,6 +31,43 @@ type Opts struct {
 	QueryTimeout          time.Duration
 	QueryConcurrencyLimit int
 	MaxResponseBytes      int
+	// SoftMaxResponseBytes, if specified, adds a warning to the stats of query
+	// results that are estimated to exceed this size, rather than failing them
+	// like MaxResponseBytes.
+	SoftMaxResponseBytes int
+	// ACL, if specified, authenticates principals by the auth token header and
+	// restricts what they may do by their roles. With an ACL, requests have to
+	// authenticate even if OAuth isn't configured, and inserts require the
+	// writer role on the stream.
+	ACL *acl.ACL
+	// APITokens, if specified, authenticates requests that present one of its
+	// tokens as a Bearer token in the Authorization header, and lets admins
+	// create and revoke tokens at /tokens.
+	APITokens *acl.TokenStore
+	// OIDCIssuerURL, if specified along with OIDCClientID, authenticates web
+	// users with the OpenID Connect provider at this URL (e.g.
+	// https://accounts.google.com), in addition to or instead of GitHub.
+	OIDCIssuerURL    string
+	OIDCClientID     string
+	OIDCClientSecret string
+	// OIDCRedirectURL is the URL to which the OIDC provider redirects users
+	// after they log in. Defaults to /oidc/code on the host that the user
+	// requested.
+	OIDCRedirectURL string
+	// OIDCScopes are scopes to request in addition to openid, email and
+	// profile, for example groups.
+	OIDCScopes []string
+	// OIDCAllowedGroups, if specified, only allows users that are members of at
+	// least one of these groups, as listed in the OIDCGroupsClaim of their ID
+	// token.
+	OIDCAllowedGroups []string
+	// OIDCGroupsClaim is the ID token claim that lists a user's groups. Defaults
+	// to groups.
+	OIDCGroupsClaim string
+	// OIDCRequiredClaims, if specified, only allows users whose ID tokens have
+	// the given values for the given claims, for example hd for the domain of a
+	// Google Workspace.
+	OIDCRequiredClaims map[string]string
 }
 
 type handler struct {
@@ -40,11 +79,13 @@ type handler struct {
 	cache            *cache
 	queries          chan *query
 	coalescedQueries chan []*query
+	oidc             *oidcProvider
+	oidcMx           sync.Mutex
 }
 
 func Configure(db *zenodb.DB, router *mux.Router, opts *Opts) error {
-	if opts.OAuthClientID == "" || opts.OAuthClientSecret == "" || opts.GitHubOrg == "" {
-		log.Errorf("WARNING - Missing OAuthClientID, OAuthClientSecret and/or GitHubOrg, web API will not authenticate!")
+	if (opts.OAuthClientID == "" || opts.OAuthClientSecret == "" || opts.GitHubOrg == "") && (opts.OIDCIssuerURL == "" || opts.OIDCClientID == "") {
+		log.Errorf("WARNING - Missing OAuthClientID, OAuthClientSecret and/or GitHubOrg and no OIDC provider configured, web API will not authenticate users!")
 	}
 
 	if opts.CacheDir == "" {
@@ -103,6 +144,8 @@ func Configure(db *zenodb.DB, router *mux.Router, opts *Opts) error {
 		coalescedQueries: make(chan []*query, opts.QueryConcurrencyLimit),
 	}
 
+	db.RegisterWarmupHandler(h.warmup)
+
 	log.Debugf("Starting %d goroutines to process queries", opts.QueryConcurrencyLimit)
 	go h.coalesceQueries()
 	for i := 0; i < opts.QueryConcurrencyLimit; i++ {
@@ -110,15 +153,44 @@ func Configure(db *zenodb.DB, router *mux.Router, opts *Opts) error {
 	}
 
 	router.StrictSlash(true)
+	router.Use(withRequestID, traced)
 	router.HandleFunc("/insert/{stream}", h.insert)
+	router.HandleFunc("/annotations", h.annotations)
 	router.HandleFunc("/oauth/code", h.oauthCode)
+	router.HandleFunc("/oidc/code", h.oidcCode)
+	router.HandleFunc("/login", h.login)
+	router.HandleFunc("/login/{provider}", h.loginWith)
+	router.HandleFunc("/prepare", h.prepare)
+	router.HandleFunc("/grafana/", h.grafanaTestConnection)
+	router.HandleFunc("/grafana/search", h.grafanaSearch)
+	router.HandleFunc("/grafana/query", h.grafanaQuery)
+	router.HandleFunc("/{mode:async|immediate|run}/prepared/{id}", h.preparedQuery)
 	router.PathPrefix("/async").HandlerFunc(h.asyncQuery)
 	router.PathPrefix("/immediate").HandlerFunc(h.immediateQuery)
 	router.PathPrefix("/run").HandlerFunc(h.runQuery)
 	router.PathPrefix("/cached/{permalink}").HandlerFunc(h.cachedQuery)
 	router.PathPrefix("/favicon").Handler(http.NotFoundHandler())
 	router.PathPrefix("/report/{permalink}").HandlerFunc(h.index)
+	router.HandleFunc("/metrics/prometheus", h.prometheusMetrics)
 	router.PathPrefix("/metrics").HandlerFunc(h.metrics)
+	router.HandleFunc("/followers/{name}/revoke", h.revokeFollower)
+	router.HandleFunc("/followers/{name}/reinstate", h.reinstateFollower)
+	router.HandleFunc("/followers/{name}/weight", h.setFollowerWeight)
+	router.HandleFunc("/followers", h.followers)
+	router.HandleFunc("/cluster", h.cluster)
+	router.HandleFunc("/tables/{table}/verify", h.verifyView)
+	router.HandleFunc("/tables/{table}", h.table)
+	router.HandleFunc("/tables", h.tables)
+	router.HandleFunc("/settings/changes", h.settingChanges)
+	router.HandleFunc("/settings/{name}", h.setSetting)
+	router.HandleFunc("/settings", h.settings)
+	router.HandleFunc("/slowqueries", h.slowQueries)
+	router.HandleFunc("/acl", h.acl)
+	router.HandleFunc("/tokens/{id}/revoke", h.revokeToken)
+	router.HandleFunc("/tokens", h.tokens)
+	router.HandleFunc("/health", h.health)
+	router.HandleFunc("/healthz", h.healthz)
+	router.HandleFunc("/readyz", h.readyz)
 	router.PathPrefix("/").HandlerFunc(h.index)
 
 	return nil
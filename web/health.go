@@ -0,0 +1,76 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/getlantern/zenodb"
+)
+
+type healthResponse struct {
+	// Status is "recovering" until all tables have recovered, then "warmingup"
+	// until warm-up queries have finished, then "ok"
+	Status string
+	Tables []*zenodb.RecoveryStats
+}
+
+// health reports whether the database is up and how far along each table is
+// in replaying the WAL. It doesn't require authentication so that it can be
+// used by load balancers and monitoring.
+func (h *handler) health(resp http.ResponseWriter, req *http.Request) {
+	health := &healthResponse{Status: "ok", Tables: h.db.RecoveryStats()}
+	for _, stats := range health.Tables {
+		if !stats.Recovered {
+			health.Status = "recovering"
+			break
+		}
+	}
+	if health.Status == "ok" && !h.db.WarmedUp() {
+		health.Status = "warmingup"
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(health)
+}
+
+type probeResponse struct {
+	OK     bool
+	Checks []*zenodb.HealthCheck
+}
+
+// healthz is a liveness probe. It fails if the WAL isn't writable or the
+// schema didn't load, in which case the node should be restarted. Like health,
+// it doesn't require authentication.
+func (h *handler) healthz(resp http.ResponseWriter, req *http.Request) {
+	var checks []*zenodb.HealthCheck
+	for _, check := range h.db.HealthChecks() {
+		if check.Liveness {
+			checks = append(checks, check)
+		}
+	}
+	h.probe(resp, checks)
+}
+
+// readyz is a readiness probe. On top of the liveness checks, it fails while
+// tables are recovering or warming up, while a leader has partitions without
+// followers and while a follower isn't connected to its leader, in which case
+// the node shouldn't receive traffic. Like health, it doesn't require
+// authentication.
+func (h *handler) readyz(resp http.ResponseWriter, req *http.Request) {
+	h.probe(resp, h.db.HealthChecks())
+}
+
+func (h *handler) probe(resp http.ResponseWriter, checks []*zenodb.HealthCheck) {
+	result := &probeResponse{OK: true, Checks: checks}
+	for _, check := range checks {
+		if !check.OK {
+			result.OK = false
+		}
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	if !result.OK {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(resp).Encode(result)
+}
@@ -0,0 +1,74 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := zenodb.NewDB(&zenodb.DBOpts{
+		Dir: tmpDir,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(zenodb.Schema{
+		"table_a": &zenodb.TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := &handler{db: db}
+
+	probe := func(handle http.HandlerFunc, target string) (int, *probeResponse) {
+		resp := httptest.NewRecorder()
+		handle(resp, httptest.NewRequest(http.MethodGet, target, nil))
+		result := &probeResponse{}
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), result))
+		return resp.Code, result
+	}
+
+	code, result := probe(h.healthz, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, result.OK)
+	for _, check := range result.Checks {
+		assert.True(t, check.Liveness, "healthz should only include liveness checks")
+	}
+
+	// Wait for warm-up to complete
+	time.Sleep(1500 * time.Millisecond)
+	code, result = probe(h.readyz, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, result.OK)
+	assert.True(t, len(result.Checks) > 2, "readyz should include readiness checks")
+
+	schemaFile := filepath.Join(tmpDir, "schema.yaml")
+	if !assert.NoError(t, ioutil.WriteFile(schemaFile, []byte("table_a: [broken"), 0644)) {
+		return
+	}
+	assert.Error(t, db.ApplySchemaFromFile(schemaFile))
+	code, result = probe(h.healthz, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, result.OK)
+	code, _ = probe(h.readyz, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
@@ -7,6 +7,9 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/acl"
+	"github.com/getlantern/zenodb/common"
 	"github.com/gorilla/mux"
 )
 
@@ -39,6 +42,12 @@ func (h *handler) insert(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	stream := mux.Vars(req)["stream"]
+	if h.ACL != nil {
+		// Without an ACL, anyone can insert
+		if _, ok := h.authorize(resp, req, acl.Writer, stream); !ok {
+			return
+		}
+	}
 	dec := json.NewDecoder(req.Body)
 	for {
 		point := &Point{}
@@ -65,8 +74,10 @@ func (h *handler) insert(resp http.ResponseWriter, req *http.Request) {
 		}
 
 		insertErr := h.db.Insert(stream, point.Ts, point.Dims, point.Vals)
-		if insertErr != nil {
-			internalServerError(resp, "Error submitting point: %v", insertErr)
+		if _, invalid := insertErr.(*zenodb.InvalidPointError); invalid {
+			badRequest(resp, "Error submitting point: %v", common.ErrorWithRequestID(req.Context(), insertErr))
+		} else if insertErr != nil {
+			internalServerError(resp, "Error submitting point: %v", common.ErrorWithRequestID(req.Context(), insertErr))
 		}
 	}
 }
@@ -77,6 +88,12 @@ func badRequest(resp http.ResponseWriter, msg string, args ...interface{}) {
 	fmt.Fprintf(resp, msg+"\n", args...)
 }
 
+func forbidden(resp http.ResponseWriter, msg string, args ...interface{}) {
+	resp.WriteHeader(http.StatusForbidden)
+	log.Errorf(msg, args...)
+	fmt.Fprintf(resp, msg+"\n", args...)
+}
+
 func internalServerError(resp http.ResponseWriter, msg string, args ...interface{}) {
 	resp.WriteHeader(http.StatusInternalServerError)
 	log.Errorf(msg, args...)
@@ -15,3 +15,17 @@ func (h *handler) metrics(resp http.ResponseWriter, req *http.Request) {
 
 	json.NewEncoder(resp).Encode(metrics.GetStats())
 }
+
+// prometheusMetrics exposes ingestion metrics in the Prometheus text format.
+func (h *handler) prometheusMetrics(resp http.ResponseWriter, req *http.Request) {
+	if !h.authenticate(resp, req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := metrics.WritePrometheus(resp)
+	if err != nil {
+		log.Errorf("Unable to write Prometheus metrics: %v", err)
+	}
+}
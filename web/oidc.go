@@ -0,0 +1,562 @@
+package web
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	providerGitHub = "github"
+	providerOIDC   = "oidc"
+
+	oidcNonce = "oidcnonce"
+
+	// defaultOIDCGroupsClaim is the claim that lists the groups of a user
+	// unless Opts.OIDCGroupsClaim says otherwise
+	defaultOIDCGroupsClaim = "groups"
+
+	// maxIDTokenClockSkew is how far the clock of the OIDC provider may be
+	// ahead of ours
+	maxIDTokenClockSkew = 1 * time.Minute
+)
+
+// oidcProvider is an OpenID Connect provider, configured from its discovery
+// document.
+type oidcProvider struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+
+	keys   map[string]crypto.PublicKey
+	keysMx sync.RWMutex
+}
+
+type oidcState struct {
+	Expiration time.Time
+	Nonce      string
+}
+
+func (h *handler) githubConfigured() bool {
+	return h.OAuthClientID != "" && h.OAuthClientSecret != ""
+}
+
+func (h *handler) oidcConfigured() bool {
+	return h.OIDCIssuerURL != "" && h.OIDCClientID != ""
+}
+
+// provider discovers the OIDC provider at Opts.OIDCIssuerURL the first time
+// it's needed, trying again on subsequent calls if discovery fails.
+func (h *handler) provider() (*oidcProvider, error) {
+	h.oidcMx.Lock()
+	defer h.oidcMx.Unlock()
+	if h.oidc != nil {
+		return h.oidc, nil
+	}
+
+	issuer := strings.TrimSuffix(h.OIDCIssuerURL, "/")
+	p := &oidcProvider{}
+	err := h.getJSON(issuer+"/.well-known/openid-configuration", p)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to discover OIDC provider at %v: %v", issuer, err)
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("OIDC provider at %v claims to be issuer %v", issuer, p.Issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC provider at %v is missing authorization, token or JWKS endpoint", issuer)
+	}
+	h.oidc = p
+	return p, nil
+}
+
+func (h *handler) requestOIDCAuthorization(resp http.ResponseWriter, req *http.Request) {
+	p, err := h.provider()
+	if err != nil {
+		internalServerError(resp, "%v", err)
+		return
+	}
+
+	nonce, err := randomString()
+	if err != nil {
+		internalServerError(resp, "Unable to generate nonce: %v", err)
+		return
+	}
+	state, err := h.sc.Encode(xsrftoken, time.Now().Add(5*time.Minute))
+	if err != nil {
+		internalServerError(resp, "Unable to encode xsrf token: %v", err)
+		return
+	}
+	// Bind the nonce to this browser so that ID tokens obtained elsewhere can't
+	// be replayed through our callback
+	nonceCookie, err := h.sc.Encode(oidcNonce, &oidcState{Expiration: time.Now().Add(5 * time.Minute), Nonce: nonce})
+	if err != nil {
+		internalServerError(resp, "Unable to encode nonce: %v", err)
+		return
+	}
+	http.SetCookie(resp, &http.Cookie{
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		Name:     oidcNonce,
+		Value:    nonceCookie,
+		Expires:  time.Now().Add(5 * time.Minute),
+	})
+
+	scopes := append([]string{"openid", "email", "profile"}, h.OIDCScopes...)
+	u, err := buildURL(p.AuthorizationEndpoint, map[string]string{
+		"response_type": "code",
+		"client_id":     h.OIDCClientID,
+		"redirect_uri":  h.oidcRedirectURL(req),
+		"scope":         strings.Join(scopes, " "),
+		"state":         state,
+		"nonce":         nonce,
+	})
+	if err != nil {
+		internalServerError(resp, "Unable to build authorization URL: %v", err)
+		return
+	}
+
+	log.Debugf("Redirecting to: %v", u.String())
+	resp.Header().Set("Location", u.String())
+	resp.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+func (h *handler) oidcRedirectURL(req *http.Request) string {
+	if h.OIDCRedirectURL != "" {
+		return h.OIDCRedirectURL
+	}
+	return "https://" + req.Host + "/oidc/code"
+}
+
+// oidcCode handles the redirect back from the OIDC provider, exchanging the
+// authorization code for an ID token and logging the user in if the token's
+// claims allow it.
+func (h *handler) oidcCode(resp http.ResponseWriter, req *http.Request) {
+	if !h.oidcConfigured() {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if errCode := req.URL.Query().Get("error"); errCode != "" {
+		forbidden(resp, "OIDC provider refused authorization: %v %v", errCode, req.URL.Query().Get("error_description"))
+		return
+	}
+
+	var xsrfExpiration time.Time
+	err := h.sc.Decode(xsrftoken, req.URL.Query().Get("state"), &xsrfExpiration)
+	if err != nil || time.Now().After(xsrfExpiration) {
+		log.Errorf("Invalid or expired xsrf token, re-authorizing: %v", err)
+		h.requestOIDCAuthorization(resp, req)
+		return
+	}
+	state := &oidcState{}
+	nonceCookie, err := req.Cookie(oidcNonce)
+	if err == nil {
+		err = h.sc.Decode(oidcNonce, nonceCookie.Value, state)
+	}
+	if err != nil || time.Now().After(state.Expiration) {
+		log.Errorf("Missing or expired nonce, re-authorizing: %v", err)
+		h.requestOIDCAuthorization(resp, req)
+		return
+	}
+
+	p, err := h.provider()
+	if err != nil {
+		internalServerError(resp, "%v", err)
+		return
+	}
+	claims, err := h.exchangeOIDCCode(p, req.URL.Query().Get("code"), h.oidcRedirectURL(req), state.Nonce)
+	if err != nil {
+		forbidden(resp, "Unable to log in with OIDC: %v", err)
+		return
+	}
+	err = h.checkOIDCClaims(claims)
+	if err != nil {
+		forbidden(resp, "%v", err)
+		return
+	}
+
+	subject, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	ad := &AuthData{
+		Provider:   providerOIDC,
+		Subject:    subject,
+		Email:      email,
+		Expiration: time.Now().Add(sessionTimeout),
+	}
+	cookieData, err := h.sc.Encode(authcookie, ad)
+	if err != nil {
+		internalServerError(resp, "Unable to encode authcookie: %v", err)
+		return
+	}
+	http.SetCookie(resp, &http.Cookie{
+		Path:    "/",
+		Secure:  true,
+		Name:    authcookie,
+		Value:   cookieData,
+		Expires: time.Now().Add(365 * 24 * time.Hour),
+	})
+	http.SetCookie(resp, &http.Cookie{
+		Path:    "/",
+		Secure:  true,
+		Name:    oidcNonce,
+		Value:   "",
+		Expires: time.Unix(0, 0),
+		MaxAge:  -1,
+	})
+
+	log.Debugf("User %v logged in with OIDC", email)
+	resp.Header().Set("Location", "/")
+	resp.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+// exchangeOIDCCode exchanges an authorization code for an ID token and returns
+// the token's verified claims.
+func (h *handler) exchangeOIDCCode(p *oidcProvider, code string, redirectURL string, nonce string) (map[string]interface{}, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURL},
+	}
+	// client_secret_basic is the default per the OIDC spec, only use
+	// client_secret_post if that's all the provider supports
+	basicAuth := len(p.TokenEndpointAuthMethodsSupported) == 0
+	for _, method := range p.TokenEndpointAuthMethodsSupported {
+		if method == "client_secret_basic" {
+			basicAuth = true
+		}
+	}
+	if !basicAuth {
+		form.Set("client_id", h.OIDCClientID)
+		form.Set("client_secret", h.OIDCClientSecret)
+	}
+
+	post, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to build token request: %v", err)
+	}
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	post.Header.Set("Accept", "application/json")
+	if basicAuth {
+		post.SetBasicAuth(url.QueryEscape(h.OIDCClientID), url.QueryEscape(h.OIDCClientSecret))
+	}
+	tokenResp, err := h.client.Do(post)
+	if err != nil {
+		return nil, fmt.Errorf("Error requesting ID token: %v", err)
+	}
+	defer tokenResp.Body.Close()
+	body, err := ioutil.ReadAll(tokenResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading ID token: %v", err)
+	}
+	if tokenResp.StatusCode > 299 {
+		return nil, fmt.Errorf("Got response status %d requesting ID token: %v", tokenResp.StatusCode, string(body))
+	}
+	tokenData := make(map[string]interface{})
+	err = json.Unmarshal(body, &tokenData)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling ID token: %v", err)
+	}
+	idToken, _ := tokenData["id_token"].(string)
+	if idToken == "" {
+		return nil, fmt.Errorf("No ID token in response from OIDC provider")
+	}
+	return h.verifyIDToken(p, idToken, nonce)
+}
+
+// verifyIDToken verifies the signature and standard claims of the given ID
+// token and returns its claims.
+func (h *handler) verifyIDToken(p *oidcProvider, idToken string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed ID token")
+	}
+	header := &struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	err := decodeSegment(parts[0], header)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode ID token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode ID token signature: %v", err)
+	}
+	key, err := h.signingKey(p, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode ID token claims: %v", err)
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != strings.TrimSuffix(p.Issuer, "/") {
+		return nil, fmt.Errorf("ID token issued by unexpected issuer %v", iss)
+	}
+	if !claimIncludes(claims["aud"], h.OIDCClientID) {
+		return nil, fmt.Errorf("ID token not intended for this client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("ID token expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(time.Now().Add(maxIDTokenClockSkew)) {
+		return nil, fmt.Errorf("ID token issued in the future")
+	}
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, fmt.Errorf("ID token has wrong nonce")
+	}
+	return claims, nil
+}
+
+// checkOIDCClaims checks that the user identified by the given claims is a
+// member of one of Opts.OIDCAllowedGroups and has the values given in
+// Opts.OIDCRequiredClaims.
+func (h *handler) checkOIDCClaims(claims map[string]interface{}) error {
+	for name, value := range h.OIDCRequiredClaims {
+		if !claimIncludes(claims[name], value) {
+			return fmt.Errorf("User's %v is not %v", name, value)
+		}
+	}
+	if len(h.OIDCAllowedGroups) == 0 {
+		return nil
+	}
+	groupsClaim := h.OIDCGroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = defaultOIDCGroupsClaim
+	}
+	for _, group := range h.OIDCAllowedGroups {
+		if claimIncludes(claims[groupsClaim], group) {
+			return nil
+		}
+	}
+	return fmt.Errorf("User not in any of the allowed groups")
+}
+
+// claimIncludes indicates whether the given claim, which may be a single value
+// or a list of values, includes the expected value.
+func claimIncludes(claim interface{}, expected string) bool {
+	switch c := claim.(type) {
+	case []interface{}:
+		for _, v := range c {
+			if fmt.Sprint(v) == expected {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	default:
+		return fmt.Sprint(c) == expected
+	}
+}
+
+// signingKey returns the provider's public key with the given key id, fetching
+// the provider's keys again if it's not known yet, which happens when the
+// provider rotates its keys.
+func (h *handler) signingKey(p *oidcProvider, kid string) (crypto.PublicKey, error) {
+	p.keysMx.RLock()
+	key, found := p.keys[kid]
+	p.keysMx.RUnlock()
+	if found {
+		return key, nil
+	}
+
+	jwks := &struct {
+		Keys []*jwk `json:"keys"`
+	}{}
+	err := h.getJSON(p.JWKSURI, jwks)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch OIDC provider's keys: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, parseErr := k.publicKey()
+		if parseErr != nil {
+			log.Debugf("Ignoring OIDC provider key %v: %v", k.Kid, parseErr)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	p.keysMx.Lock()
+	p.keys = keys
+	p.keysMx.Unlock()
+
+	key, found = keys[kid]
+	if !found {
+		if kid == "" && len(keys) == 1 {
+			// Providers with a single key may leave out the key id
+			for _, key = range keys {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("Unknown signing key %v", kid)
+	}
+	return key, nil
+}
+
+// jwk is a JSON Web Key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %v", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("Point not on curve %v", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported key type %v", k.Kty)
+	}
+}
+
+// verifySignature verifies a JWS signature. Only asymmetric algorithms are
+// supported, so that tokens can't be signed with the (public) client id.
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("Unsupported ID token signing algorithm %v", alg)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("Algorithm %v doesn't match RSA key", alg)
+		}
+		err := rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		if err != nil {
+			return fmt.Errorf("Invalid ID token signature: %v", err)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("Algorithm %v doesn't match EC key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("Invalid ID token signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("Invalid ID token signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unsupported key type %T", key)
+	}
+}
+
+func (h *handler) getJSON(u string, result interface{}) error {
+	resp, err := h.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("Got response status %d: %v", resp.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, result)
+}
+
+func decodeSegment(segment string, result interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, result)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, randomKeyLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
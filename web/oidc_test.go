@@ -0,0 +1,171 @@
+package web
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDC(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		return
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// claims for the next ID token issued by the fake provider
+	var claims map[string]interface{}
+	signingKey := key
+	sign := func(claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key1"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, signingKey, crypto.SHA256, digest[:])
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	var issuer string
+	routes := http.NewServeMux()
+	routes.HandleFunc("/.well-known/openid-configuration", func(resp http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(resp).Encode(map[string]interface{}{
+			"issuer":                 issuer,
+			"authorization_endpoint": issuer + "/authorize",
+			"token_endpoint":         issuer + "/token",
+			"jwks_uri":               issuer + "/jwks",
+		})
+	})
+	routes.HandleFunc("/jwks", func(resp http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(resp).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	routes.HandleFunc("/token", func(resp http.ResponseWriter, req *http.Request) {
+		clientID, clientSecret, _ := req.BasicAuth()
+		if clientID != "zeno" || clientSecret != "secret" || req.FormValue("code") != "thecode" {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(resp).Encode(map[string]interface{}{"id_token": sign(claims)})
+	})
+	provider := httptest.NewServer(routes)
+	defer provider.Close()
+	issuer = provider.URL
+
+	hashKey := make([]byte, 64)
+	blockKey := make([]byte, 32)
+	rand.Read(hashKey)
+	rand.Read(blockKey)
+	h := &handler{
+		Opts: Opts{
+			OIDCIssuerURL:      issuer,
+			OIDCClientID:       "zeno",
+			OIDCClientSecret:   "secret",
+			OIDCAllowedGroups:  []string{"analysts", "ops"},
+			OIDCRequiredClaims: map[string]string{"hd": "example.com"},
+		},
+		sc:     securecookie.New(hashKey, blockKey),
+		client: provider.Client(),
+	}
+
+	// Unauthenticated users get sent to the provider
+	rec := httptest.NewRecorder()
+	assert.False(t, h.authenticate(rec, httptest.NewRequest(http.MethodGet, "https://zeno/", nil)))
+	if !assert.Equal(t, http.StatusTemporaryRedirect, rec.Code) {
+		return
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, issuer+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+	params := location.Query()
+	assert.Equal(t, "zeno", params.Get("client_id"))
+	assert.Equal(t, "https://zeno/oidc/code", params.Get("redirect_uri"))
+	assert.Equal(t, "openid email profile", params.Get("scope"))
+	nonceCookies := rec.Result().Cookies()
+
+	login := func(tokenClaims map[string]interface{}) *httptest.ResponseRecorder {
+		claims = map[string]interface{}{
+			"iss":   issuer,
+			"aud":   "zeno",
+			"sub":   "12345",
+			"email": "alice@example.com",
+			"hd":    "example.com",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": params.Get("nonce"),
+		}
+		for name, value := range tokenClaims {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		req := httptest.NewRequest(http.MethodGet, "https://zeno/oidc/code?code=thecode&state="+url.QueryEscape(params.Get("state")), nil)
+		for _, cookie := range nonceCookies {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		h.oidcCode(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusForbidden, login(map[string]interface{}{"groups": []string{"sales"}}).Code, "user outside of allowed groups shouldn't be allowed")
+	assert.Equal(t, http.StatusForbidden, login(map[string]interface{}{"groups": []string{"ops"}, "hd": "other.com"}).Code, "user without required claim shouldn't be allowed")
+	assert.Equal(t, http.StatusForbidden, login(map[string]interface{}{"groups": []string{"ops"}, "aud": "otherclient"}).Code, "ID token for other client shouldn't be accepted")
+	assert.Equal(t, http.StatusForbidden, login(map[string]interface{}{"groups": []string{"ops"}, "nonce": "wrong"}).Code, "ID token with wrong nonce shouldn't be accepted")
+	assert.Equal(t, http.StatusForbidden, login(map[string]interface{}{"groups": []string{"ops"}, "exp": time.Now().Add(-1 * time.Minute).Unix()}).Code, "expired ID token shouldn't be accepted")
+	signingKey = otherKey
+	assert.Equal(t, http.StatusForbidden, login(map[string]interface{}{"groups": []string{"ops"}}).Code, "ID token signed with unknown key shouldn't be accepted")
+	signingKey = key
+
+	rec = login(map[string]interface{}{"groups": []string{"sales", "ops"}})
+	if !assert.Equal(t, http.StatusTemporaryRedirect, rec.Code) {
+		return
+	}
+	var authCookie *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == authcookie {
+			authCookie = cookie
+		}
+	}
+	if !assert.NotNil(t, authCookie, "should have set auth cookie") {
+		return
+	}
+	req := httptest.NewRequest(http.MethodGet, "https://zeno/", nil)
+	req.AddCookie(authCookie)
+	assert.True(t, h.authenticate(httptest.NewRecorder(), req), "logged in user should be authenticated")
+
+	// With GitHub configured too, users get to choose
+	h.OAuthClientID = "githubclient"
+	h.OAuthClientSecret = "githubsecret"
+	rec = httptest.NewRecorder()
+	assert.False(t, h.authenticate(rec, httptest.NewRequest(http.MethodGet, "https://zeno/", nil)))
+	assert.Equal(t, "/login", rec.Header().Get("Location"))
+	req = httptest.NewRequest(http.MethodGet, "https://zeno/", nil)
+	req.AddCookie(authCookie)
+	assert.True(t, h.authenticate(httptest.NewRecorder(), req), "OIDC session should still be valid")
+}
@@ -0,0 +1,100 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// prepare prepares the query with ? placeholders given by the sql parameter and
+// responds with the resulting common.PreparedQuery, whose ID can be used to run
+// the query at /run/prepared/{id}, /async/prepared/{id} or
+// /immediate/prepared/{id}.
+func (h *handler) prepare(resp http.ResponseWriter, req *http.Request) {
+	principal, ok := h.principal(resp, req)
+	if !ok {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	sqlString := req.FormValue("sql")
+	if sqlString == "" {
+		badRequest(resp, "Please specify sql")
+		return
+	}
+	prepared, err := h.db.PrepareQuery(sqlString)
+	if err != nil {
+		badRequest(resp, "Unable to prepare query: %v", err)
+		return
+	}
+	// Placeholders only stand for values, so binding them to anything reveals
+	// which tables the query reads
+	placeholders := make([]interface{}, prepared.NumParams)
+	for i := range placeholders {
+		placeholders[i] = 0
+	}
+	boundSQL, err := h.db.BindPrepared(prepared.ID, placeholders...)
+	if err != nil {
+		badRequest(resp, "Unable to prepare query: %v", err)
+		return
+	}
+	if err := principal.CheckQuery(boundSQL); err != nil {
+		forbidden(resp, "%v", err)
+		return
+	}
+	resp.Header().Set(ContentType, ContentTypeJSON)
+	json.NewEncoder(resp).Encode(prepared)
+}
+
+// preparedQuery runs a prepared query, binding its placeholders to the values
+// of the repeated param parameter in order (see paramValue). Results are cached
+// like the results of any other query with the same SQL.
+func (h *handler) preparedQuery(resp http.ResponseWriter, req *http.Request) {
+	principal, ok := h.principal(resp, req)
+	if !ok {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	log.Debug(req.URL)
+	vars := mux.Vars(req)
+	var params []interface{}
+	for _, param := range req.URL.Query()["param"] {
+		params = append(params, paramValue(param))
+	}
+	sqlString, err := h.db.BindPrepared(vars["id"], params...)
+	if err != nil {
+		badRequest(resp, "%v", err)
+		return
+	}
+	if err := principal.CheckQuery(sqlString); err != nil {
+		forbidden(resp, "%v", err)
+		return
+	}
+
+	timeout, immediate := shortTimeout, false
+	switch vars["mode"] {
+	case "run":
+		timeout = longTimeout
+	case "immediate":
+		immediate = true
+	}
+	ce, err := h.query(req, principal, sqlString, immediate)
+	h.respondWithCacheEntry(resp, req, ce, err, timeout)
+}
+
+// paramValue interprets a query parameter as JSON if possible, so that 5 is a
+// number, true is a boolean and [1, 2] is a list, and as a string otherwise.
+func paramValue(param string) interface{} {
+	if i, err := strconv.ParseInt(param, 10, 64); err == nil {
+		// keep integers precise
+		return i
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(param), &value); err == nil {
+		return value
+	}
+	return param
+}
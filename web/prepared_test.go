@@ -0,0 +1,17 @@
+package web
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParamValue(t *testing.T) {
+	assert.Equal(t, int64(5), paramValue("5"))
+	assert.Equal(t, 5.5, paramValue("5.5"))
+	assert.Equal(t, true, paramValue("true"))
+	assert.Equal(t, "us", paramValue("us"))
+	assert.Equal(t, "5", paramValue(`"5"`))
+	assert.Equal(t, []interface{}{"a", float64(1)}, paramValue(`["a", 1]`))
+	assert.Nil(t, paramValue("null"))
+}
@@ -14,12 +14,14 @@ import (
 	"time"
 
 	"github.com/dustin/go-humanize"
+	"github.com/getlantern/zenodb/acl"
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/sql"
 	"github.com/gorilla/mux"
 	"github.com/retailnext/hllpp"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -34,17 +36,22 @@ type QueryResult struct {
 	TS                 int64
 	TSCardinality      uint64
 	Fields             []string
+	FieldMetaData      []*common.FieldMetaData
 	FieldCardinalities []uint64
 	Dims               []string
 	DimCardinalities   []uint64
 	Rows               []*ResultRow
+	Annotations        []*ResultAnnotation
 	Stats              *common.QueryStats
 }
 
 type ResultRow struct {
-	TS   int64
-	Key  map[string]interface{}
-	Vals []float64
+	TS  int64
+	Key map[string]interface{}
+	// Vals are float64s, int64s or bools depending on the Type of the
+	// corresponding field in FieldMetaData. Before fields had types, they were
+	// all float64s, so clients that assume numbers break on bool fields.
+	Vals []interface{}
 }
 
 type query struct {
@@ -52,6 +59,12 @@ type query struct {
 	parsed    *sql.Query
 	immediate bool
 	ce        cacheEntry
+	caller    string
+	principal string
+	requestID string
+	// spanContext identifies the span of the web request that asked for the
+	// query
+	spanContext trace.SpanContext
 }
 
 func (h *handler) runQuery(resp http.ResponseWriter, req *http.Request) {
@@ -83,15 +96,20 @@ func (h *handler) cachedQuery(resp http.ResponseWriter, req *http.Request) {
 }
 
 func (h *handler) sqlQuery(resp http.ResponseWriter, req *http.Request, timeout time.Duration, immediate bool) {
-	if !h.authenticate(resp, req) {
+	principal, ok := h.principal(resp, req)
+	if !ok {
 		resp.WriteHeader(http.StatusForbidden)
 		return
 	}
 
 	log.Debug(req.URL)
 	sqlString, _ := url.QueryUnescape(req.URL.RawQuery)
+	if err := principal.CheckQuery(sqlString); err != nil {
+		forbidden(resp, "%v", err)
+		return
+	}
 
-	ce, err := h.query(req, sqlString, immediate)
+	ce, err := h.query(req, principal, sqlString, immediate)
 	h.respondWithCacheEntry(resp, req, ce, err, timeout)
 }
 
@@ -99,6 +117,7 @@ func (h *handler) respondWithCacheEntry(resp http.ResponseWriter, req *http.Requ
 	limit := int(timeout / pauseTime)
 	for i := 0; i < limit; i++ {
 		if err != nil {
+			err = common.ErrorWithRequestID(req.Context(), err)
 			log.Error(err)
 			resp.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprint(resp, err.Error())
@@ -136,7 +155,10 @@ func (h *handler) respondError(resp http.ResponseWriter, req *http.Request, ce c
 	resp.Write(ce.error())
 }
 
-func (h *handler) query(req *http.Request, sqlString string, immediate bool) (ce cacheEntry, err error) {
+// query runs the given query in the background on behalf of the given principal,
+// which must already have been authorized to run it, unless its results are
+// already cached.
+func (h *handler) query(req *http.Request, principal *acl.Principal, sqlString string, immediate bool) (ce cacheEntry, err error) {
 	parsed, parseErr := sql.Parse(sqlString)
 	if parseErr != nil {
 		return nil, parseErr
@@ -160,11 +182,28 @@ func (h *handler) query(req *http.Request, sqlString string, immediate bool) (ce
 	}
 
 	// Request query to run in background
-	h.queries <- &query{sqlString, parsed, immediate, ce}
+	h.queries <- &query{sqlString, parsed, immediate, ce, "web:" + req.RemoteAddr, principal.String(), common.RequestIDFor(req.Context()), trace.SpanContextFromContext(req.Context())}
 
 	return
 }
 
+// warmup runs a warm-up query and caches its results, replacing any
+// previously cached results.
+func (h *handler) warmup(sqlString string) error {
+	parsed, err := sql.Parse(sqlString)
+	if err != nil {
+		return err
+	}
+	ce, err := h.cache.begin(sqlString)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.execQuery(&wg, &query{sqlString, parsed, true, ce, "warmup", "", common.NewRequestID(), trace.SpanContext{}})
+	return nil
+}
+
 func (h *handler) coalesceQueries() {
 	for q := range h.queries {
 		coalescedQueries := append([]*query(nil), q)
@@ -213,9 +252,11 @@ func (h *handler) execQuery(wg *sync.WaitGroup, query *query) {
 	defer wg.Done()
 	sqlString := query.sqlString
 	ce := query.ce
-	result, err := h.doQuery(sqlString, ce.permalink())
+	ctx := common.WithPrincipal(common.WithCaller(context.Background(), query.caller), query.principal)
+	ctx = common.WithRequestID(trace.ContextWithSpanContext(ctx, query.spanContext), query.requestID)
+	result, err := h.doQuery(ctx, sqlString, query.parsed, ce.permalink())
 	if err != nil {
-		err = fmt.Errorf("Unable to query: %v", err)
+		err = common.ErrorWithRequestID(ctx, fmt.Errorf("Unable to query: %v", err))
 		log.Error(err)
 		ce = ce.fail(err)
 	} else {
@@ -258,7 +299,7 @@ func compress(resultBytes []byte, err error) ([]byte, error) {
 	return compressed, nil
 }
 
-func (h *handler) doQuery(sqlString string, permalink string) (*QueryResult, error) {
+func (h *handler) doQuery(ctx context.Context, sqlString string, parsed *sql.Query, permalink string) (*QueryResult, error) {
 	rs, err := h.db.Query(sqlString, false, nil, false)
 	if err != nil {
 		log.Errorf("Error running query: %v", err)
@@ -296,6 +337,7 @@ func (h *handler) doQuery(sqlString string, permalink string) (*QueryResult, err
 	}
 
 	var fields core.Fields
+	var fieldTypes []string
 	var fieldCardinalities []*hllpp.HLLPP
 	dimCardinalities := make(map[string]*hllpp.HLLPP)
 	tsCardinality := hllpp.New()
@@ -303,7 +345,7 @@ func (h *handler) doQuery(sqlString string, permalink string) (*QueryResult, err
 
 	estimatedResultBytes := 0
 	var mx sync.Mutex
-	ctx, cancel := context.WithTimeout(context.Background(), h.QueryTimeout)
+	ctx, cancel := context.WithTimeout(ctx, h.QueryTimeout)
 	defer cancel()
 	stats, _ := rs.Iterate(ctx, func(inFields core.Fields) error {
 		fields = inFields
@@ -311,6 +353,10 @@ func (h *handler) doQuery(sqlString string, permalink string) (*QueryResult, err
 			result.Fields = append(result.Fields, field.Name)
 			fieldCardinalities = append(fieldCardinalities, hllpp.New())
 		}
+		result.FieldMetaData = h.db.FieldMetaData(sqlString, fields)
+		for _, md := range result.FieldMetaData {
+			fieldTypes = append(fieldTypes, md.Type)
+		}
 		return nil
 	}, func(row *core.FlatRow) (bool, error) {
 		mx.Lock()
@@ -344,11 +390,11 @@ func (h *handler) doQuery(sqlString string, permalink string) (*QueryResult, err
 		resultRow := &ResultRow{
 			TS:   common.NanosToMillis(row.TS),
 			Key:  key,
-			Vals: make([]float64, 0, len(row.Values)),
+			Vals: make([]interface{}, 0, len(row.Values)),
 		}
 
 		for i, value := range row.Values {
-			resultRow.Vals = append(resultRow.Vals, value)
+			resultRow.Vals = append(resultRow.Vals, row.TypedValue(i, fieldTypes[i]))
 			encoding.Binary.PutUint64(cbytes, math.Float64bits(value))
 			fieldCardinalities[i].Add(cbytes)
 		}
@@ -372,9 +418,23 @@ func (h *handler) doQuery(sqlString string, permalink string) (*QueryResult, err
 		result.FieldCardinalities = append(result.FieldCardinalities, fieldCardinality.Count())
 	}
 
+	if parsed.Annotate {
+		// Include annotations that fall into the first period
+		resolution := rs.GetResolution()
+		until := rs.GetUntil()
+		annotations := h.db.Annotations(rs.GetAsOf().Add(-1*resolution+1), until, parsed.AnnotationCategories...)
+		result.Annotations = overlayAnnotations(annotations, resolution, until)
+	}
+
 	if stats != nil {
 		result.Stats = stats.(*common.QueryStats)
 	}
+	if h.SoftMaxResponseBytes > 0 && estimatedResultBytes > h.SoftMaxResponseBytes {
+		if result.Stats == nil {
+			result.Stats = &common.QueryStats{}
+		}
+		result.Stats.Warnings = append(result.Stats.Warnings, fmt.Sprintf("Estimated query result size %v exceeded soft limit of %v", humanize.Bytes(uint64(estimatedResultBytes)), humanize.Bytes(uint64(h.SoftMaxResponseBytes))))
+	}
 
 	return result, nil
 }
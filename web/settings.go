@@ -0,0 +1,59 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/getlantern/zenodb/acl"
+	"github.com/gorilla/mux"
+)
+
+// settings lists every configuration value that's in effect on this node and
+// where it came from.
+func (h *handler) settings(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := h.authorize(resp, req, acl.Admin, acl.AllTables); !ok {
+		return
+	}
+
+	json.NewEncoder(resp).Encode(h.db.Settings())
+}
+
+// setSetting changes the named setting to the value of the value parameter
+// without restarting, see zenodb.RuntimeSettings for which settings can be
+// changed. It requires the admin role.
+func (h *handler) setSetting(resp http.ResponseWriter, req *http.Request) {
+	principal, ok := h.authorize(resp, req, acl.Admin, acl.AllTables)
+	if !ok {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(resp, "Method %v not allowed\n", req.Method)
+		return
+	}
+
+	// Record who made the change, falling back to the client's address when
+	// authentication is disabled
+	user := principal.String()
+	if user == "" {
+		user = req.RemoteAddr
+	}
+	err := h.db.SetRuntimeSetting(user, mux.Vars(req)["name"], req.URL.Query().Get("value"))
+	if err != nil {
+		badRequest(resp, "Unable to change setting: %v", err)
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+// settingChanges lists the settings that were recently changed at runtime,
+// who changed them and when.
+func (h *handler) settingChanges(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := h.authorize(resp, req, acl.Admin, acl.AllTables); !ok {
+		return
+	}
+
+	json.NewEncoder(resp).Encode(h.db.SettingChanges())
+}
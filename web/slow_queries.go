@@ -0,0 +1,20 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/getlantern/zenodb/acl"
+)
+
+// slowQueries lists the most recent entries in the slow query log, limited to
+// the number given by the n parameter if specified.
+func (h *handler) slowQueries(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := h.authorize(resp, req, acl.Admin, acl.AllTables); !ok {
+		return
+	}
+
+	n, _ := strconv.Atoi(req.URL.Query().Get("n"))
+	json.NewEncoder(resp).Encode(h.db.SlowQueries(n))
+}
@@ -0,0 +1,71 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/acl"
+	"github.com/gorilla/mux"
+)
+
+// tables reports the stats of every table that the principal may read, keyed
+// to the table names, including how much memory and disk space each one uses.
+func (h *handler) tables(resp http.ResponseWriter, req *http.Request) {
+	principal, ok := h.authorize(resp, req, acl.Reader)
+	if !ok {
+		return
+	}
+
+	result := make(map[string]zenodb.TableStats)
+	for name, stats := range h.db.AllTableStats() {
+		if principal.Can(acl.Reader, name) {
+			result[name] = stats
+		}
+	}
+	json.NewEncoder(resp).Encode(result)
+}
+
+// table reports the stats of a single table.
+func (h *handler) table(resp http.ResponseWriter, req *http.Request) {
+	name := strings.ToLower(mux.Vars(req)["table"])
+	if _, ok := h.authorize(resp, req, acl.Reader, name); !ok {
+		return
+	}
+
+	stats := h.db.TableStats(name)
+	if stats.Table == "" {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(resp).Encode(stats)
+}
+
+// verifyView compares the data of a view to the equivalent query against the
+// table on which it's based (see zenodb.DB.VerifyView). The optional window
+// parameter (e.g. 30m) controls how far back to compare.
+func (h *handler) verifyView(resp http.ResponseWriter, req *http.Request) {
+	name := strings.ToLower(mux.Vars(req)["table"])
+	if _, ok := h.authorize(resp, req, acl.Reader, name); !ok {
+		return
+	}
+
+	var window time.Duration
+	if windowString := req.URL.Query().Get("window"); windowString != "" {
+		var err error
+		window, err = time.ParseDuration(windowString)
+		if err != nil {
+			badRequest(resp, "Invalid window %v: %v", windowString, err)
+			return
+		}
+	}
+
+	verification, err := h.db.VerifyView(req.Context(), name, window)
+	if err != nil {
+		badRequest(resp, "Unable to verify view %v: %v", name, err)
+		return
+	}
+	json.NewEncoder(resp).Encode(verification)
+}
@@ -0,0 +1,116 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/acl"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTables(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := zenodb.NewDB(&zenodb.DBOpts{
+		Dir: tmpDir,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(zenodb.Schema{
+		"table_a": &zenodb.TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+		"table_b": &zenodb.TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"dim": i}, map[string]float64{"i": 1}))
+	}
+	time.Sleep(250 * time.Millisecond)
+	db.FlushAll()
+
+	a, err := acl.New(acl.Config{
+		"admin":  {Password: "adminpass", Role: acl.Admin},
+		"reader": {Password: "readpass", Grants: map[string]acl.Role{"table_a": acl.Reader}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := &handler{db: db, Opts: Opts{ACL: a}}
+
+	request := func(target string, password string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if password != "" {
+			req.Header.Set(authheader, password)
+		}
+		return req
+	}
+	list := func(password string) (*httptest.ResponseRecorder, map[string]*zenodb.TableStats) {
+		resp := httptest.NewRecorder()
+		h.tables(resp, request("/tables", password))
+		var result map[string]*zenodb.TableStats
+		if resp.Code == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		}
+		return resp, result
+	}
+	get := func(table string, password string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		h.table(resp, mux.SetURLVars(request("/tables/"+table, password), map[string]string{"table": table}))
+		return resp
+	}
+
+	resp, _ := list("")
+	assert.Equal(t, http.StatusForbidden, resp.Code, "listing tables should require authentication")
+
+	resp, all := list("adminpass")
+	if assert.Equal(t, http.StatusOK, resp.Code) && assert.Len(t, all, 2) {
+		stats := all["table_a"]
+		if assert.NotNil(t, stats) {
+			assert.Equal(t, "table_a", stats.Table)
+			assert.EqualValues(t, 10, stats.InsertedPoints)
+			assert.EqualValues(t, 10, stats.FileStoreRows)
+			assert.True(t, stats.FileStoreBytes > 0, "should report bytes on disk")
+			assert.Zero(t, stats.MemStoreRows, "memstore should be empty after flush")
+			assert.False(t, stats.LastFlush.IsZero(), "should report last flush")
+			assert.True(t, stats.LastFlushDuration > 0, "should report flush duration")
+		}
+	}
+
+	resp, readable := list("readpass")
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		assert.Len(t, readable, 1, "should only list tables that principal can read")
+		assert.NotNil(t, readable["table_a"])
+	}
+
+	resp = get("table_a", "readpass")
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		stats := &zenodb.TableStats{}
+		if assert.NoError(t, json.NewDecoder(resp.Body).Decode(stats)) {
+			assert.Equal(t, "table_a", stats.Table)
+		}
+	}
+	assert.Equal(t, http.StatusForbidden, get("table_b", "readpass").Code, "reader shouldn't see stats for tables it can't read")
+	assert.Equal(t, http.StatusNotFound, get("unknown", "adminpass").Code)
+}
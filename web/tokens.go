@@ -0,0 +1,101 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/zenodb/acl"
+	"github.com/gorilla/mux"
+)
+
+const bearerPrefix = "Bearer "
+
+type createdToken struct {
+	*acl.Token
+	// Secret is what clients present as a Bearer token. It's only returned
+	// when the token is created.
+	Secret string
+}
+
+// bearerToken returns the Bearer token from the request's Authorization
+// header, if any.
+func bearerToken(req *http.Request) string {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) <= len(bearerPrefix) || !strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) {
+		return ""
+	}
+	return strings.TrimSpace(authorization[len(bearerPrefix):])
+}
+
+// tokens lists API tokens on GET and creates a token on POST, with the name,
+// role (defaults to reader) and comma-separated tables (defaults to all
+// tables) given as parameters. Both require the admin role.
+func (h *handler) tokens(resp http.ResponseWriter, req *http.Request) {
+	if h.APITokens == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	if _, ok := h.authorize(resp, req, acl.Admin, acl.AllTables); !ok {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		resp.Header().Set(ContentType, ContentTypeJSON)
+		json.NewEncoder(resp).Encode(h.APITokens.List())
+	case http.MethodPost:
+		role := acl.Role(req.FormValue("role"))
+		if role == "" {
+			role = acl.Reader
+		}
+		secret, token, err := h.APITokens.Create(req.FormValue("name"), role, splitTables(req.FormValue("tables"))...)
+		if err != nil {
+			badRequest(resp, "Unable to create API token: %v", err)
+			return
+		}
+		resp.Header().Set(ContentType, ContentTypeJSON)
+		resp.WriteHeader(http.StatusCreated)
+		json.NewEncoder(resp).Encode(&createdToken{Token: token, Secret: secret})
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(resp, "Method %v not allowed\n", req.Method)
+	}
+}
+
+// revokeToken revokes the API token with the given id. It requires the admin
+// role.
+func (h *handler) revokeToken(resp http.ResponseWriter, req *http.Request) {
+	if h.APITokens == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	if _, ok := h.authorize(resp, req, acl.Admin, acl.AllTables); !ok {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(resp, "Method %v not allowed\n", req.Method)
+		return
+	}
+
+	err := h.APITokens.Revoke(mux.Vars(req)["id"])
+	if err != nil {
+		badRequest(resp, "Unable to revoke API token: %v", err)
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+func splitTables(tables string) []string {
+	var result []string
+	for _, table := range strings.Split(tables, ",") {
+		table = strings.TrimSpace(table)
+		if table != "" {
+			result = append(result, table)
+		}
+	}
+	return result
+}
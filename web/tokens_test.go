@@ -0,0 +1,110 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/acl"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPITokens(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := zenodb.NewDB(&zenodb.DBOpts{
+		Dir: tmpDir,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	err = db.ApplySchema(zenodb.Schema{
+		"table_a": &zenodb.TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+		"table_b": &zenodb.TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT i FROM inbound GROUP BY *, period(1m)",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tokens, err := acl.OpenTokenStore(filepath.Join(tmpDir, "api_tokens"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	// With an ACL, requests have to authenticate
+	a, err := acl.New(acl.Config{"admin": {Password: "adminpass", Role: acl.Admin}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := &handler{db: db, Opts: Opts{QueryTimeout: time.Minute, MaxResponseBytes: 1024 * 1024, ACL: a, APITokens: tokens}}
+
+	request := func(method string, target string, password string, token string) *http.Request {
+		req := httptest.NewRequest(method, target, nil)
+		if password != "" {
+			req.Header.Set(authheader, password)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return req
+	}
+	create := func(password string, token string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		h.tokens(resp, request(http.MethodPost, "/tokens?name=dashboards&tables=table_a", password, token))
+		return resp
+	}
+	search := func(token string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		h.grafanaSearch(resp, request(http.MethodPost, "/grafana/search", "", token))
+		return resp
+	}
+
+	assert.Equal(t, http.StatusForbidden, create("", "").Code, "creating tokens should require authentication")
+	resp := create("adminpass", "")
+	if !assert.Equal(t, http.StatusCreated, resp.Code) {
+		return
+	}
+	created := &createdToken{}
+	if !assert.NoError(t, json.NewDecoder(resp.Body).Decode(created)) {
+		return
+	}
+	assert.Equal(t, "dashboards", created.Name)
+	assert.Equal(t, acl.Reader, created.Role)
+	assert.NotEmpty(t, created.Secret)
+
+	resp = search(created.Secret)
+	assert.Equal(t, http.StatusOK, resp.Code, "request with token should be allowed")
+	assert.Equal(t, "[\"table_a\"]\n", resp.Body.String(), "token should only grant access to its tables")
+	assert.Equal(t, http.StatusForbidden, search(created.ID+".bad").Code, "request with wrong token should be forbidden")
+	assert.Equal(t, http.StatusForbidden, create("", created.Secret).Code, "reader token shouldn't be able to create tokens")
+
+	resp = httptest.NewRecorder()
+	h.tokens(resp, request(http.MethodGet, "/tokens", "adminpass", ""))
+	var listed []*acl.Token
+	if assert.NoError(t, json.NewDecoder(resp.Body).Decode(&listed)) && assert.Len(t, listed, 1) {
+		assert.Equal(t, created.ID, listed[0].ID)
+		assert.Empty(t, listed[0].Hash)
+	}
+
+	resp = httptest.NewRecorder()
+	h.revokeToken(resp, mux.SetURLVars(request(http.MethodPost, "/tokens/"+created.ID+"/revoke", "adminpass", ""), map[string]string{"id": created.ID}))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, http.StatusForbidden, search(created.Secret).Code, "request with revoked token should be forbidden")
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// withRequestID assigns each request an ID that identifies it in logs, traces
+// and errors, using the one supplied in the X-Request-Id header if it's
+// usable. The ID is echoed back in the response's X-Request-Id header.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		id := common.SanitizeRequestID(req.Header.Get(common.RequestIDHeader))
+		resp.Header().Set(common.RequestIDHeader, id)
+		next.ServeHTTP(resp, req.WithContext(common.WithRequestID(req.Context(), id)))
+	})
+}
+
+// traced wraps each request in a span, continuing the caller's trace if the
+// request includes a W3C traceparent header. Queries that run in the
+// background belong to the span of the request that started them.
+func traced(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		ctx := propagation.TraceContext{}.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		route := req.URL.Path
+		if current := mux.CurrentRoute(req); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		ctx, span := common.StartSpan(ctx, "zenodb.web "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.route", route),
+			attribute.String("http.target", req.URL.RequestURI()),
+			attribute.String("zenodb.request_id", common.RequestIDFor(ctx)),
+		))
+		defer span.End()
+		sr := &statusRecorder{ResponseWriter: resp, status: http.StatusOK}
+		next.ServeHTTP(sr, req.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.status_code", sr.status))
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
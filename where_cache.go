@@ -0,0 +1,109 @@
+package zenodb
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
+)
+
+const (
+	// whereCacheSize caps the number of results held by a whereCache, beyond
+	// which it starts over.
+	whereCacheSize = 100000
+)
+
+// nonDeterministicFunctions are functions whose results can change between
+// evaluations for the same dimension values, making WHERE clauses that use
+// them uncacheable. They're matched against the lowercased clause, so a dimension
+// whose name contains one of them just makes the clause uncacheable too.
+var nonDeterministicFunctions = []string{"rand", "hget(", "sismember(", "lua("}
+
+// whereCache remembers the results of evaluating tables' WHERE clauses when
+// mapping WAL entries to followers. Results are keyed by the clause and a
+// fingerprint of the dimensions that the clause references, so entries that
+// share the values of those dimensions, which consecutive entries frequently
+// do, don't need to evaluate the clause again. A whereCache is only used by a
+// single goroutine.
+type whereCache struct {
+	// params holds the sorted dimensions referenced by each WHERE clause, or nil
+	// for clauses that can't be cached.
+	params  map[string][]string
+	results map[string]bool
+}
+
+func newWhereCache() *whereCache {
+	return &whereCache{
+		params:  make(map[string][]string),
+		results: make(map[string]bool),
+	}
+}
+
+// wherePassed evaluates the given table's WHERE clause against dims, using
+// entryResults to share results between tables within the same entry and the
+// cache to share them between entries.
+func (c *whereCache) wherePassed(table *tableSpec, dims bytemap.ByteMap, entryResults map[string]bool) bool {
+	return c.passed(table.where, table.whereString, dims, entryResults)
+}
+
+// passed is like wherePassed for an arbitrary condition, identified by its
+// lowercased string.
+func (c *whereCache) passed(where goexpr.Expr, whereString string, dims bytemap.ByteMap, entryResults map[string]bool) bool {
+	if where == nil {
+		return true
+	}
+	passed, found := entryResults[whereString]
+	if found {
+		return passed
+	}
+
+	params, cacheable := c.paramsFor(where, whereString)
+	if !cacheable {
+		passed = where.Eval(dims).(bool)
+		entryResults[whereString] = passed
+		return passed
+	}
+
+	key := whereString + "|" + string(dims.Slice(params...))
+	passed, found = c.results[key]
+	if !found {
+		passed = where.Eval(dims).(bool)
+		if len(c.results) >= whereCacheSize {
+			c.results = make(map[string]bool)
+		}
+		c.results[key] = passed
+	}
+	entryResults[whereString] = passed
+	return passed
+}
+
+func (c *whereCache) paramsFor(where goexpr.Expr, whereString string) ([]string, bool) {
+	params, found := c.params[whereString]
+	if found {
+		return params, params != nil
+	}
+	for _, fn := range nonDeterministicFunctions {
+		if strings.Contains(whereString, fn) {
+			c.params[whereString] = nil
+			return nil, false
+		}
+	}
+	params = whereParams(where)
+	c.params[whereString] = params
+	return params, true
+}
+
+// whereParams returns the distinct dimensions referenced by where, sorted.
+func whereParams(where goexpr.Expr) []string {
+	seen := make(map[string]bool)
+	params := make([]string, 0)
+	where.WalkParams(func(param string) {
+		if !seen[param] {
+			seen[param] = true
+			params = append(params, param)
+		}
+	})
+	sort.Strings(params)
+	return params
+}
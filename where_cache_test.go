@@ -0,0 +1,75 @@
+package zenodb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingExpr struct {
+	goexpr.Expr
+	evals int
+}
+
+func (e *countingExpr) Eval(params goexpr.Params) interface{} {
+	e.evals++
+	return e.Expr.Eval(params)
+}
+
+func TestWhereCache(t *testing.T) {
+	eq, err := goexpr.Binary("==", goexpr.Param("a"), goexpr.Constant("x"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	where := &countingExpr{Expr: eq}
+	table := &tableSpec{where: where, whereString: strings.ToLower(where.String())}
+
+	wc := newWhereCache()
+	check := func(dims map[string]interface{}) bool {
+		return wc.wherePassed(table, bytemap.New(dims), make(map[string]bool))
+	}
+
+	assert.True(t, check(map[string]interface{}{"a": "x", "b": 1}))
+	assert.True(t, check(map[string]interface{}{"a": "x", "b": 2}), "unreferenced dimension shouldn't matter")
+	assert.Equal(t, 1, where.evals, "should have reused result for same value of a")
+	assert.False(t, check(map[string]interface{}{"a": "y", "b": 1}))
+	assert.False(t, check(map[string]interface{}{"b": 1}))
+	assert.Equal(t, 3, where.evals)
+
+	entryResults := make(map[string]bool)
+	otherTable := &tableSpec{where: where, whereString: table.whereString}
+	assert.False(t, wc.wherePassed(table, bytemap.New(map[string]interface{}{"a": "z"}), entryResults))
+	assert.False(t, wc.wherePassed(otherTable, bytemap.New(map[string]interface{}{"a": "z"}), entryResults))
+	assert.Equal(t, 4, where.evals, "tables with same WHERE should share result within entry")
+
+	random := &countingExpr{Expr: goexpr.Rand()}
+	lt, _ := goexpr.Binary("<", random, goexpr.Constant(2.0))
+	randomTable := &tableSpec{where: lt, whereString: strings.ToLower(lt.String())}
+	for i := 0; i < 3; i++ {
+		assert.True(t, wc.wherePassed(randomTable, bytemap.New(map[string]interface{}{"a": "x"}), make(map[string]bool)))
+	}
+	assert.Equal(t, 3, random.evals, "non-deterministic WHERE shouldn't be cached")
+
+	assert.True(t, wc.wherePassed(&tableSpec{}, bytemap.New(map[string]interface{}{"a": "x"}), make(map[string]bool)), "no WHERE should always pass")
+}
+
+func TestWhereCacheInAndRegex(t *testing.T) {
+	where, err := whereFor("a IN ('x', 'y') AND b =~ '^1[0-9]$'")
+	if !assert.NoError(t, err) {
+		return
+	}
+	table := &tableSpec{where: where, whereString: strings.ToLower(where.String())}
+
+	wc := newWhereCache()
+	check := func(dims map[string]interface{}) bool {
+		return wc.wherePassed(table, bytemap.New(dims), make(map[string]bool))
+	}
+	assert.True(t, check(map[string]interface{}{"a": "x", "b": 12}))
+	assert.True(t, check(map[string]interface{}{"a": "y", "b": "19"}))
+	assert.False(t, check(map[string]interface{}{"a": "z", "b": 12}))
+	assert.False(t, check(map[string]interface{}{"a": "x", "b": 120}))
+	assert.Equal(t, []string{"a", "b"}, whereParams(where))
+}
@@ -1,6 +1,7 @@
 package zenodb
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -19,11 +20,16 @@ import (
 	geredis "github.com/getlantern/goexpr/redis"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/vtime"
-	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/archive"
 	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/compress"
+	"github.com/getlantern/zenodb/election"
+	"github.com/getlantern/zenodb/encryption"
 	"github.com/getlantern/zenodb/metrics"
 	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/spill"
 	"github.com/getlantern/zenodb/sql"
+	"github.com/getlantern/zenodb/wal"
 	"github.com/oxtoacart/bpool"
 	"github.com/rickar/props"
 	"github.com/shirou/gopsutil/process"
@@ -33,11 +39,16 @@ import (
 const (
 	defaultMaxBackupWait = 1 * time.Hour
 
+	spillDir = "_spill"
+
 	DefaultIterationCoalesceInterval = 3 * time.Second
 	DefaultIterationConcurrency      = 2
 
 	DefaultClusterQueryConcurrency = 25
 	DefaultClusterQueryTimeout     = 1 * time.Hour
+	DefaultReplicaStallTimeout     = 30 * time.Second
+
+	DefaultFollowQueueDepth = 1000000
 )
 
 var (
@@ -83,16 +94,140 @@ type DBOpts struct {
 	// VirtualTime, if true, tells zenodb to use a virtual clock that advances
 	// based on the timestamps of Points received via inserts.
 	VirtualTime bool
+	// Clock, if specified, is the source of time for the database. It takes
+	// precedence over VirtualTime.
+	Clock vtime.Clock
+	// PerStreamClocks, if true, gives each stream its own virtual clock that
+	// only advances based on the timestamps of that stream's points, so that
+	// a table's retention is governed by the time of its own stream. The
+	// database's clock still advances with every stream. Requires VirtualTime
+	// or a Clock.
+	PerStreamClocks bool
 	// WALSyncInterval governs how frequently to sync the WAL to disk. 0 means
 	// it syncs after every write (which is not great for performance).
 	WALSyncInterval time.Duration
+	// TargetApplyLatency, if specified, enables automatic tuning of how often
+	// tables flush their memstores. Flushes hold up the application of new data
+	// from the WAL, so tables flush more often when data waits longer than this
+	// to be applied, and less often when it's applied well within this, staying
+	// within each table's MinFlushLatency and MaxFlushLatency. This is most
+	// useful on followers, whose tables are busy applying data from the leader.
+	TargetApplyLatency time.Duration
 	// MaxWALSize limits how much WAL data to keep (in bytes)
 	MaxWALSize int
 	// WALCompressionSize specifies the size beyond which to compress WAL segments
 	WALCompressionSize int
+	// WALCompression, if specified, compresses individual WAL entries with the
+	// given algorithm (see package compress) as they're written. WAL segments
+	// beyond WALCompressionSize are then no longer compressed with snappy.
+	// Entries written with any algorithm remain readable after changing this.
+	WALCompression string
+	// MinWALAge, if specified, keeps WAL segments for at least this long, even
+	// if that means exceeding MaxWALSize.
+	MinWALAge time.Duration
+	// RetainWALForFollowers, if true, keeps WAL segments beyond MaxWALSize
+	// until every follower that has acknowledged offsets for the stream has
+	// acknowledged past them, so that followers which are briefly offline can
+	// resume without losing data. Revoking a follower stops retaining data for
+	// it.
+	RetainWALForFollowers bool
 	// MaxMemoryRatio caps the maximum memory of this process. When the system
 	// comes under memory pressure, it will start flushing table memstores.
 	MaxMemoryRatio float64
+	// FlushMemoryRatio is the fraction of the memory allowed by MaxMemoryRatio
+	// beyond which the largest memstores are proactively flushed in the
+	// background, before inserts have to force flushes at the cap. Defaults to
+	// DefaultFlushMemoryRatio.
+	FlushMemoryRatio float64
+	// ThrottleMemoryRatio is the fraction of the memory allowed by
+	// MaxMemoryRatio beyond which inserts into tables are briefly delayed while
+	// memstores are flushed to relieve memory pressure. Defaults to
+	// DefaultThrottleMemoryRatio.
+	ThrottleMemoryRatio float64
+	// SpillMemory caps the memory (in bytes) that each sort, grouping and
+	// materialized subquery of a query uses. Beyond this, they spill to temp
+	// files. Defaults to MaxSortMemory, or else to 10% of the memory allowed by
+	// MaxMemoryRatio. If none of these are set, queries run entirely in memory.
+	SpillMemory int
+	// MaxSortMemory is the old name of SpillMemory, which takes precedence.
+	//
+	// Deprecated: use SpillMemory.
+	MaxSortMemory int
+	// SpillDir is where queries spill data that doesn't fit in SpillMemory.
+	// Defaults to _spill within Dir. Spill files left over from prior runs are
+	// removed at startup.
+	SpillDir string
+	// MaxSpillBytes caps the disk space that all queries combined may use for
+	// spilling. 0 means unlimited.
+	MaxSpillBytes int64
+	// MaxSpillBytesPerQuery caps the disk space that a single query may use for
+	// spilling. 0 means unlimited.
+	MaxSpillBytesPerQuery int64
+	// QueryCacheSize is the number of queries whose results are cached in order
+	// to speed up repeated queries, like the ones behind dashboards. 0 disables
+	// the query cache.
+	QueryCacheSize int
+	// QueryCacheLag is how long to wait after a period ends before considering
+	// its results final and caching them. Defaults to DefaultQueryCacheLag.
+	QueryCacheLag time.Duration
+	// CoalesceQueries, if true, makes identical queries (same SQL and time
+	// range) that are issued while one of them is already running wait for and
+	// share its results instead of running again, as happens when many
+	// dashboards show the same data.
+	CoalesceQueries bool
+	// PreparedQueryCacheSize is the number of queries prepared with PrepareQuery
+	// that are remembered, as well as the number of recently run queries that
+	// are kept around in parsed form so that running them again doesn't require
+	// parsing them again. Defaults to DefaultPreparedQueryCacheSize.
+	PreparedQueryCacheSize int
+	// MaxQueryRowsScanned, MaxQueryMemory and MaxQueryDuration cap the rows
+	// that a single query may scan, the memory (in bytes) taken up by what it
+	// scans and how long it may run. Queries that hit a limit stop early with
+	// a *QueryLimitError. Queries can tighten these limits with hints like
+	// max_rows_scanned(1000), but can't loosen them. 0 means unlimited.
+	MaxQueryRowsScanned int64
+	MaxQueryMemory      int64
+	MaxQueryDuration    time.Duration
+	// SoftMaxQueryRowsScanned, SoftMaxQueryMemory and SoftMaxQueryDuration are
+	// soft versions of the above limits. Queries that exceed them run to
+	// completion, but their stats include a warning. SoftMaxQueryGroups warns
+	// about queries that return more than this many groups (rows) and
+	// SoftMaxQueryResultBytes about queries whose results are estimated to be
+	// larger than this many bytes, neither of which has a hard limit. 0
+	// disables a soft limit.
+	SoftMaxQueryRowsScanned int64
+	SoftMaxQueryMemory      int64
+	SoftMaxQueryDuration    time.Duration
+	SoftMaxQueryGroups      int64
+	SoftMaxQueryResultBytes int64
+	// SlowQueryThreshold, if specified, records queries that run for at least
+	// this long in the slow query log, which is written as JSON to
+	// slow_queries.log within Dir. See SlowQueries for the most recent ones.
+	SlowQueryThreshold time.Duration
+	// SlowQueryLogMaxBytes is the size at which the slow query log is rotated.
+	// Defaults to DefaultSlowQueryLogMaxBytes.
+	SlowQueryLogMaxBytes int64
+	// QueryAuditPercent is the percentage of queries that are sampled for
+	// auditing to QueryAuditStream and QueryAuditSink.
+	QueryAuditPercent float64
+	// QueryAuditLog, if true, writes an audit record for every query as JSON to
+	// query_audit.log within Dir, regardless of QueryAuditPercent. Queries fail
+	// if their audit record can't be written.
+	QueryAuditLog bool
+	// QueryAuditLogMaxBytes is the size at which the audit log is rotated.
+	// Defaults to DefaultQueryAuditLogMaxBytes. If negative, the audit log is
+	// never rotated, making it append-only.
+	QueryAuditLogMaxBytes int64
+	// QueryAuditStream, if specified, inserts audit records into this stream,
+	// so that they can be queried through a table on that stream.
+	QueryAuditStream string
+	// QueryAuditSink, if specified, is called with every audit record, for
+	// example to publish it to a message queue.
+	QueryAuditSink func(audit *QueryAudit) error
+	// ColumnUsageStream, if specified, inserts a record into this stream for
+	// every dimension and field that a query references, so that usage can be
+	// queried through a table on that stream.
+	ColumnUsageStream string
 	// IterationCoalesceInterval specifies how long we wait between iteration
 	// requests in order to coalesce multiple related ones.
 	IterationCoalesceInterval time.Duration
@@ -109,21 +244,137 @@ type DBOpts struct {
 	// NumPartitions identifies how many partitions to split data from
 	// passthrough nodes.
 	NumPartitions int
+	// ConsistentPartitioning, if true, uses consistent hashing to assign points
+	// to partitions, which minimizes the data that moves when NumPartitions
+	// changes. All nodes in a cluster must use the same setting.
+	ConsistentPartitioning bool
 	// Partition identies the partition owned by this follower
 	Partition int
+	// ReplicationFactor specifies how many followers serve each partition. Every
+	// follower of a partition receives all WAL entries for that partition. If
+	// greater than 1, clustered queries buffer the results from each partition so
+	// that they can fail over to another replica if one fails mid-query.
+	ReplicationFactor int
+	// PerPartitionWALReaders, if true, gives followers of each partition their
+	// own WAL reader on the leader rather than sharing one per stream. This
+	// re-reads the WAL once per partition, but keeps a slow partition from
+	// stalling the followers of all other partitions.
+	PerPartitionWALReaders bool
 	// ClusterQueryConcurrency specifies the maximum concurrency for clustered
 	// query handlers.
 	ClusterQueryConcurrency int
 	// ClusterQueryTimeout specifies the maximum amount of time leader will wait
 	// for followers to answer a query
 	ClusterQueryTimeout time.Duration
+	// ReplicaStallTimeout is how long a replica may go without sending any
+	// results for a clustered query before the leader considers it stalled and
+	// fails over to another replica. Defaults to DefaultReplicaStallTimeout.
+	ReplicaStallTimeout time.Duration
+	// ReplicaWeights assigns weights to replicas (followers) by name, with which
+	// the leader chooses among the replicas of a partition when dispatching
+	// queries. Replicas without a weight get DefaultReplicaWeight. See
+	// SetReplicaWeight.
+	ReplicaWeights map[string]float64
 	// MaxFollowAge limits how far back to go when follower pulls data from
 	// leader
 	MaxFollowAge time.Duration
+	// MaxClockSkew is how far the clocks of followers may differ from the
+	// leader's before the leader logs a warning. Defaults to
+	// DefaultMaxClockSkew.
+	MaxClockSkew time.Duration
+	// MissingTablesPolicy controls what happens when a follower requests tables
+	// that the leader doesn't have. MissingTablesSkip (the default) follows the
+	// remaining tables and reports the skipped ones in the follower's stats,
+	// MissingTablesFail refuses the Follow with a MissingTablesError.
+	MissingTablesPolicy string
+	// EncryptionKeys, if specified, supplies keys for encrypting the WAL and
+	// filestores at rest. See encryption.FileKeySource for reading keys from a
+	// file. Plug in a custom KeySource to obtain keys from a KMS.
+	EncryptionKeys encryption.KeySource
+	// EncryptionKeyReloadInterval controls how frequently to reload
+	// EncryptionKeys in order to pick up rotated keys.
+	EncryptionKeyReloadInterval time.Duration
+	// FollowerName identifies this follower to the leader.
+	FollowerName string
+	// FollowerToken authenticates this follower to the leader.
+	FollowerToken string
+	// FollowBatchSize, if positive, asks the leader to send entries to this
+	// follower in batches of about this many bytes (at most 1 MB), which cuts
+	// syscall and network overhead at high ingest rates.
+	FollowBatchSize int
+	// FollowBatchInterval caps how long the leader holds on to entries before
+	// sending an incomplete batch. Defaults to 100ms.
+	FollowBatchInterval time.Duration
+	// FollowBatchCompression is the algorithm with which the leader compresses
+	// batches, see package compress. Defaults to snappy.
+	FollowBatchCompression string
+	// FollowCredits, if positive, enables credit-based flow control, limiting
+	// the leader to sending this many entries that this follower hasn't yet
+	// applied. A leader that would have to buffer more than this many entries
+	// disconnects the follower, which then resumes from the WAL.
+	FollowCredits int
+	// FollowQueueDepth is how many entries the leader buffers for each follower
+	// that doesn't use credit-based flow control. Defaults to
+	// DefaultFollowQueueDepth.
+	FollowQueueDepth int
+	// RejectQueriesDuringRecovery, if true, makes queries against tables that
+	// are still replaying the WAL at startup fail rather than return incomplete
+	// results.
+	RejectQueriesDuringRecovery bool
+	// IncludeWALTail, if true, makes all queries that include the memstore
+	// also include data that's been written to the WAL but not yet applied to
+	// the table, as if they had the include_wal_tail hint.
+	IncludeWALTail bool
+	// WarmupQueries are queries to run once all tables have recovered in order
+	// to warm up caches. The database doesn't report itself as WarmedUp until
+	// they've finished. See RegisterWarmupHandler for caching their results.
+	WarmupQueries []string
+	// WaitForWarmupHandler, if true, holds off running the WarmupQueries until
+	// a handler has been registered with RegisterWarmupHandler, so that callers
+	// that register one after NewDB returns don't miss any of the queries.
+	WaitForWarmupHandler bool
 	// Follow is a function that allows a follower to request following a stream
-	// from a passthrough node.
+	// from a passthrough node. It should call f to get the Follow with which to
+	// (re)connect, and stop once f returns nil. The data passed to cb only needs
+	// to remain valid until cb returns, so it's fine to pass along data from a
+	// leader's DB.Follow as is.
 	Follow                     func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error)
 	RegisterRemoteQueryHandler func(partition int, query planner.QueryClusterFN)
+	// Standby, if true, makes a follower a hot standby that follows its
+	// partition's data but doesn't register to handle queries (and hence isn't
+	// included in query routing) until it's promoted with Promote. This allows
+	// warming up a replacement without serving from a cold, lagging follower.
+	Standby bool
+	// AckFollow, if specified, lets a follower acknowledge to the leader the
+	// offsets through which it has durably applied entries, so that the leader
+	// doesn't send them again after a reconnect or restart.
+	AckFollow func(ack *common.FollowAck) error
+	// Snapshot, if specified, lets a follower bootstrap brand-new tables from a
+	// snapshot supplied by an existing replica of its partition rather than
+	// replaying the whole WAL from the leader.
+	Snapshot func(req *common.SnapshotRequest, cb func(version int, data []byte) error) error
+	// NodeID identifies this node to replication peers and followers.
+	NodeID string
+	// Coordinator, if specified, elects a single active leader for each stream
+	// among the passthrough nodes that share it. Only the elected leader of a
+	// stream accepts followers for it. Requires Passthrough and NodeID, which
+	// should be the address at which followers reach this node.
+	Coordinator election.Coordinator
+	// ReplicationPeers lists the NodeIDs of other passthrough nodes whose WALs
+	// this node replicates into its own. Requires that Replicate be specified.
+	ReplicationPeers []string
+	// ReplicationRewind controls how far back to rewind when translating the
+	// offsets of a follower that fails over to us from one of our peers.
+	ReplicationRewind time.Duration
+	// Replicate is a function that allows a passthrough node to pull locally
+	// originated WAL entries for a stream from a peer passthrough node.
+	Replicate func(peer string, r func() *common.Replicate, cb func(data []byte, peerOffset wal.Offset) error)
+	// Archive, if specified, periodically uploads filestores and sealed WAL
+	// segments to an object store for disaster recovery.
+	Archive *archive.Opts
+	// ShutdownTimeout limits how long HandleShutdownSignal waits for a graceful
+	// Shutdown. Defaults to DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration
 }
 
 type memoryInfo struct {
@@ -135,8 +386,11 @@ type memoryInfo struct {
 type DB struct {
 	opts                  *DBOpts
 	clock                 vtime.Clock
+	streamClocks          map[string]vtime.Clock
+	streamClocksMx        sync.RWMutex
 	tables                map[string]*table
 	orderedTables         []*table
+	routing               atomic.Value
 	walBuffers            *bpool.BytePool
 	streams               map[string]*wal.WAL
 	newStreamSubscriber   map[string]chan *tableWithOffset
@@ -145,40 +399,147 @@ type DB struct {
 	isSorting             bool
 	nextTableToSort       int
 	memory                uint64
+	// memoryPressure is 1 while proactively flushing memstores
+	memoryPressure        int32
 	logMemStatsCh         chan *memoryInfo
 	flushMutex            sync.Mutex
 	followerJoined        chan *follower
 	processFollowersOnce  sync.Once
-	remoteQueryHandlers   map[int]chan planner.QueryClusterFN
+	partitionJoined       map[int]chan *follower
+	partitionJoinedMx     sync.Mutex
+	lastFollowerID        int32
+	followerIDs           map[string]int
+	followerIDsMx         sync.Mutex
+	lastCreditsReaderID   int32
+	remoteQueryHandlers   map[int]chan *remoteQueryHandler
+	replicaWeights        map[string]float64
+	replicaWeightsMx      sync.RWMutex
 	requestedIterations   chan *iteration
 	coalescedIterations   chan []*iteration
+	replicationStates     map[string]*replicationState
+	replicatingStreams    map[string]bool
+	replicationMx         sync.Mutex
+	followersByName       map[string]map[*follower]bool
+	revokedFollowers      map[string]bool
+	followerAcks          map[string]*followerAck
+	leaderAliases         map[string]bool
+	followerClockSkews    map[string]time.Duration
+	followerPartitionKeys map[string]map[string][]string
+	incarnation           string
+	followerID            string
+	followersMx           sync.RWMutex
+	keyring               *encryption.Keyring
+	spill                 *spill.Manager
+	queryCache            *queryCache
+	queryCoalescer        *queryCoalescer
+	preparedQueries       *lruCache
+	parsedQueries         *lruCache
+	archive               archive.Store
+	archivedKeysByPrefix  map[string]map[string]bool
+	archiveMx             sync.Mutex
+	warmupHandlers        []func(sqlString string) error
+	warmupMx              sync.RWMutex
+	warmupHandlerReady    chan struct{}
+	warmupHandlerOnce     sync.Once
+	warmedUp              int32
+	annotations           []*Annotation
+	annotationsMx         sync.RWMutex
+	runningQueries        map[string]context.CancelFunc
+	runningQueriesMx      sync.Mutex
+	configuredOpts        DBOpts
+	extraSettings         []*Setting
+	settingsMx            sync.RWMutex
+	slowQueryLog          *slowQueryLog
+	queryAuditor          *queryAuditor
+	columnUsage           *columnUsageRecorder
+	routesLate            int32
+	previousPartitioning  *partitioning
+	recoveryTargets       map[string]wal.Offset
+	normalizers           map[string]map[string]*dimNormalizer
+	normalizersMx         sync.RWMutex
+	anonymizers           map[string]map[string]*dimAnonymizer
+	anonymizersMx         sync.RWMutex
+	validators            map[string][]*pointValidator
+	validatorsMx          sync.RWMutex
+	loggingRecovery       int32
+	pendingBatches        []*atomicBatch
+	pendingBatchesMx      sync.Mutex
+	attachedBackups       map[string]*attachedBackup
+	attachedBackupsMx     sync.Mutex
 	closed                bool
+	leading               map[string]bool
+	leadingMx             sync.RWMutex
+	stopCampaigns         context.CancelFunc
+	campaignCtx           context.Context
+	runtime               atomic.Value
+	stopIterationWorker   chan bool
+	settingChanges        []*SettingChange
+	settingChangesMx      sync.Mutex
+	settingChangeLog      *jsonLog
+	schemaErr             error
+	schemaMx              sync.RWMutex
+	leaderConnections     map[string]*leaderConnection
+	leaderConnectionsMx   sync.Mutex
+	shuttingDown          int32
+	followedStreams       map[string]func() []*table
+	followedStreamsMx     sync.Mutex
+	followerWALReaders    map[string]func()
+	followerWALReadersMx  sync.Mutex
+	standby               int32
 }
 
 // NewDB creates a database using the given options.
 func NewDB(opts *DBOpts) (*DB, error) {
+	// Remember what was configured, as opposed to defaulted, for Settings
+	configuredOpts := *opts
 	if opts.IterationConcurrency <= 0 {
 		opts.IterationConcurrency = DefaultIterationConcurrency
 	}
 
+	if opts.ReplicationFactor <= 0 {
+		opts.ReplicationFactor = 1
+	}
+
 	metrics.SetNumPartitions(opts.NumPartitions)
+	metrics.SetReplicationFactor(opts.ReplicationFactor)
 
 	var err error
 	db := &DB{
-		opts:                opts,
-		clock:               vtime.RealClock,
-		tables:              make(map[string]*table),
-		walBuffers:          bpool.NewBytePool(1000, 1024),
-		streams:             make(map[string]*wal.WAL),
-		newStreamSubscriber: make(map[string]chan *tableWithOffset),
-		logMemStatsCh:       make(chan *memoryInfo),
-		followerJoined:      make(chan *follower, opts.NumPartitions),
-		remoteQueryHandlers: make(map[int]chan planner.QueryClusterFN),
-		requestedIterations: make(chan *iteration, 1000), // TODO, make the iteration backlog tunable
-		coalescedIterations: make(chan []*iteration, opts.IterationConcurrency),
-	}
-	if opts.VirtualTime {
+		opts:                  opts,
+		clock:                 vtime.RealClock,
+		streamClocks:          make(map[string]vtime.Clock),
+		tables:                make(map[string]*table),
+		walBuffers:            bpool.NewBytePool(1000, 1024),
+		streams:               make(map[string]*wal.WAL),
+		newStreamSubscriber:   make(map[string]chan *tableWithOffset),
+		leaderConnections:     make(map[string]*leaderConnection),
+		followedStreams:       make(map[string]func() []*table),
+		followerWALReaders:    make(map[string]func()),
+		logMemStatsCh:         make(chan *memoryInfo),
+		followerJoined:        make(chan *follower, opts.NumPartitions),
+		partitionJoined:       make(map[int]chan *follower),
+		remoteQueryHandlers:   make(map[int]chan *remoteQueryHandler),
+		replicaWeights:        make(map[string]float64, len(opts.ReplicaWeights)),
+		requestedIterations:   make(chan *iteration, 1000), // TODO, make the iteration backlog tunable
+		coalescedIterations:   make(chan []*iteration, opts.IterationConcurrency),
+		replicationStates:     make(map[string]*replicationState),
+		replicatingStreams:    make(map[string]bool),
+		followersByName:       make(map[string]map[*follower]bool),
+		revokedFollowers:      make(map[string]bool),
+		followerAcks:          make(map[string]*followerAck),
+		leaderAliases:         make(map[string]bool),
+		followerClockSkews:    make(map[string]time.Duration),
+		followerPartitionKeys: make(map[string]map[string][]string),
+		recoveryTargets:       make(map[string]wal.Offset),
+		runningQueries:        make(map[string]context.CancelFunc),
+		configuredOpts:        configuredOpts,
+	}
+	if opts.Clock != nil {
+		db.clock = opts.Clock
+	} else if opts.VirtualTime {
 		db.clock = vtime.NewVirtualClock(time.Time{})
+	} else if opts.PerStreamClocks {
+		return nil, fmt.Errorf("PerStreamClocks requires VirtualTime or a Clock")
 	}
 	if opts.MaxWALSize <= 0 {
 		opts.MaxWALSize = 10 * 1024768 // 10 MB
@@ -186,6 +547,10 @@ func NewDB(opts *DBOpts) (*DB, error) {
 	if opts.WALCompressionSize <= 0 {
 		opts.WALCompressionSize = opts.MaxWALSize / 10
 	}
+	opts.WALCompression = strings.ToLower(strings.TrimSpace(opts.WALCompression))
+	if opts.WALCompression == "" {
+		opts.WALCompression = compress.None
+	}
 	if opts.IterationCoalesceInterval <= 0 {
 		opts.IterationCoalesceInterval = DefaultIterationCoalesceInterval
 	}
@@ -198,6 +563,50 @@ func NewDB(opts *DBOpts) (*DB, error) {
 	if opts.ClusterQueryTimeout <= 0 {
 		opts.ClusterQueryTimeout = DefaultClusterQueryTimeout
 	}
+	if opts.ReplicaStallTimeout <= 0 {
+		opts.ReplicaStallTimeout = DefaultReplicaStallTimeout
+	}
+	if opts.ReplicationRewind <= 0 {
+		opts.ReplicationRewind = DefaultReplicationRewind
+	}
+	if opts.MaxClockSkew <= 0 {
+		opts.MaxClockSkew = DefaultMaxClockSkew
+	}
+	opts.MissingTablesPolicy = strings.ToLower(strings.TrimSpace(opts.MissingTablesPolicy))
+	if opts.MissingTablesPolicy == "" {
+		opts.MissingTablesPolicy = MissingTablesSkip
+	}
+	if opts.EncryptionKeyReloadInterval <= 0 {
+		opts.EncryptionKeyReloadInterval = DefaultEncryptionKeyReloadInterval
+	}
+	if opts.FlushMemoryRatio <= 0 {
+		opts.FlushMemoryRatio = DefaultFlushMemoryRatio
+	}
+	if opts.ThrottleMemoryRatio <= 0 {
+		opts.ThrottleMemoryRatio = DefaultThrottleMemoryRatio
+	}
+	err = compress.Validate(opts.WALCompression)
+	if err != nil {
+		return nil, err
+	}
+	err = compress.Validate(opts.FollowBatchCompression)
+	if err != nil {
+		return nil, err
+	}
+	err = validateMissingTablesPolicy(opts.MissingTablesPolicy)
+	if err != nil {
+		return nil, err
+	}
+	err = db.initLeaderElection()
+	if err != nil {
+		return nil, err
+	}
+	for name, weight := range opts.ReplicaWeights {
+		err = db.SetReplicaWeight(name, weight)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	go db.logMemStats()
 	db.opts.ReadOnly = opts.Dir == ""
@@ -211,6 +620,79 @@ func NewDB(opts *DBOpts) (*DB, error) {
 		}
 	}
 
+	if !db.opts.ReadOnly {
+		err = db.applyRestore()
+		if err != nil {
+			return nil, err
+		}
+		db.loadRevokedFollowers()
+		db.loadFollowerAcks()
+		db.loadLeaderAliases()
+		db.loadAttachedBackups()
+		if db.opts.Follow != nil {
+			db.loadIncarnation()
+			db.loadFollowerID()
+		}
+	}
+	db.loadAnnotations()
+
+	err = db.initEncryption()
+	if err != nil {
+		return nil, err
+	}
+	if !db.opts.ReadOnly {
+		db.loadAtomicBatches()
+	}
+
+	err = db.initSpill()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.initArchive()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.initSlowQueryLog()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.initQueryAudit()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.FollowQueueDepth <= 0 {
+		opts.FollowQueueDepth = DefaultFollowQueueDepth
+	}
+	err = db.initRuntimeSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	db.initColumnUsage()
+
+	if opts.QueryCacheSize > 0 {
+		if opts.QueryCacheLag <= 0 {
+			opts.QueryCacheLag = DefaultQueryCacheLag
+		}
+		db.queryCache = newQueryCache(opts.QueryCacheSize, opts.QueryCacheLag)
+	}
+
+	if opts.CoalesceQueries {
+		db.queryCoalescer = newQueryCoalescer()
+	}
+
+	if opts.PreparedQueryCacheSize <= 0 {
+		opts.PreparedQueryCacheSize = DefaultPreparedQueryCacheSize
+	}
+	db.preparedQueries = newLRUCache(opts.PreparedQueryCacheSize)
+	db.parsedQueries = newLRUCache(opts.PreparedQueryCacheSize)
+
+	db.detectPartitioningChange()
+
 	if opts.EnableGeo {
 		log.Debug("Enabling geolocation functions")
 		err = geo.Init(filepath.Join(opts.Dir, "geoip.dat"), opts.IPCacheSize)
@@ -244,9 +726,13 @@ func NewDB(opts *DBOpts) (*DB, error) {
 		}
 	}
 	log.Debugf("Dir: %v    SchemaFile: %v", opts.Dir, opts.SchemaFile)
+	db.savePartitioning()
 
-	if db.opts.RegisterRemoteQueryHandler != nil {
-		go db.opts.RegisterRemoteQueryHandler(db.opts.Partition, db.queryForRemote)
+	if db.opts.Standby && db.opts.Follow != nil {
+		log.Debugf("Following on standby, not handling queries until promoted")
+		db.standby = 1
+	} else {
+		db.registerRemoteQueryHandler()
 	}
 
 	if !db.opts.ReadOnly {
@@ -254,11 +740,24 @@ func NewDB(opts *DBOpts) (*DB, error) {
 			log.Debugf("Limiting maximum memory to %v", humanize.Bytes(db.maxMemoryBytes()))
 		}
 		go db.trackMemStats()
+		if db.keyring != nil {
+			go db.reloadEncryptionKeysPeriodically()
+		}
+		if db.archive != nil {
+			go db.archivePeriodically()
+		}
+	}
+
+	if len(db.opts.WarmupQueries) > 0 {
+		db.warmupHandlerReady = make(chan struct{})
+		go db.warmup()
+	} else {
+		db.warmedUp = 1
 	}
 
 	if !db.opts.Passthrough {
 		go db.coalesceIterations()
-		for i := 0; i < db.opts.IterationConcurrency; i++ {
+		for i := 0; i < db.iterationConcurrency(); i++ {
 			go db.processIterations()
 		}
 	}
@@ -278,7 +777,17 @@ func (db *DB) FlushAll() {
 }
 
 func (db *DB) Close() {
+	db.close(true)
+}
+
+// close closes the database, flushing all tables first unless flush is false
+// because Shutdown already flushed them.
+func (db *DB) close(flush bool) {
 	log.Debug("Closing")
+	db.resignLeadership()
+	if db.columnUsage != nil {
+		db.columnUsage.close()
+	}
 	db.tablesMutex.Lock()
 	for name, stream := range db.streams {
 		log.Debugf("Closing stream %v", name)
@@ -286,7 +795,16 @@ func (db *DB) Close() {
 		delete(db.streams, name)
 	}
 	db.tablesMutex.Unlock()
-	db.FlushAll()
+	if flush {
+		db.FlushAll()
+	}
+	if db.slowQueryLog != nil {
+		db.slowQueryLog.close()
+	}
+	if db.queryAuditor != nil {
+		db.queryAuditor.close()
+	}
+	db.closeSettingChangeLog()
 }
 
 func registerAliases(aliasesFile string) {
@@ -319,9 +837,7 @@ func (db *DB) TableStats(table string) TableStats {
 	if t == nil {
 		return TableStats{}
 	}
-	t.statsMutex.RLock()
-	defer t.statsMutex.RUnlock()
-	return t.stats
+	return t.getStats()
 }
 
 // AllTableStats returns all TableStats for all tables, keyed to the table
@@ -335,25 +851,59 @@ func (db *DB) AllTableStats() map[string]TableStats {
 	}
 	db.tablesMutex.RUnlock()
 	for name, t := range tables {
-		t.statsMutex.RLock()
-		m[name] = t.stats
-		t.statsMutex.RUnlock()
+		m[name] = t.getStats()
 	}
 	return m
 }
 
+// TableInfo describes a table that can be queried.
+type TableInfo struct {
+	Name            string
+	Resolution      time.Duration
+	RetentionPeriod time.Duration
+	Fields          []string
+}
+
+// Tables describes the tables that can be queried, ordered by name.
+func (db *DB) Tables() []*TableInfo {
+	db.tablesMutex.RLock()
+	tables := make([]*table, 0, len(db.tables))
+	for _, t := range db.tables {
+		if !t.Virtual {
+			tables = append(tables, t)
+		}
+	}
+	db.tablesMutex.RUnlock()
+
+	infos := make([]*TableInfo, 0, len(tables))
+	for _, t := range tables {
+		infos = append(infos, &TableInfo{
+			Name:            t.Name,
+			Resolution:      t.Resolution,
+			RetentionPeriod: t.RetentionPeriod,
+			Fields:          t.getFields().Names(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
 // PrintTableStats prints the stats for the named table to a string.
 func (db *DB) PrintTableStats(table string) string {
 	stats := db.TableStats(table)
-	now := db.clock.Now()
-	return fmt.Sprintf("%v (%v)\tFiltered: %v    Queued: %v    Inserted: %v    Dropped: %v    Expired: %v",
+	now := db.now(table)
+	return fmt.Sprintf("%v (%v)\tFiltered: %v    Queued: %v    Inserted: %v    Dropped: %v    Expired: %v    MemStore: %v    FileStore: %v",
 		table,
 		now.In(time.UTC),
 		humanize.Comma(stats.FilteredPoints),
 		humanize.Comma(stats.QueuedPoints),
 		humanize.Comma(stats.InsertedPoints),
 		humanize.Comma(stats.DroppedPoints),
-		humanize.Comma(stats.ExpiredValues))
+		humanize.Comma(stats.ExpiredValues),
+		humanize.Bytes(uint64(stats.MemStoreBytes)),
+		humanize.Bytes(uint64(stats.FileStoreBytes)))
 }
 
 func (db *DB) getTable(table string) *table {
@@ -363,18 +913,44 @@ func (db *DB) getTable(table string) *table {
 	return t
 }
 
+// viewsOf returns the names of the views of the given table.
+func (db *DB) viewsOf(table string) []string {
+	var views []string
+	db.tablesMutex.RLock()
+	for _, t := range db.tables {
+		if t.View && !t.Virtual && strings.EqualFold(t.viewOf, table) {
+			views = append(views, t.Name)
+		}
+	}
+	db.tablesMutex.RUnlock()
+	return views
+}
+
 func (db *DB) now(table string) time.Time {
+	if isAttachedTable(table) {
+		t, err := db.getAttachedTable(table)
+		if err == nil {
+			return t.now()
+		}
+	}
+	if t := db.getTable(table); t != nil {
+		return t.now()
+	}
 	return db.clock.Now()
 }
 
-func (db *DB) capWALAge(wal *wal.WAL) {
+func (db *DB) capWALAge(stream string, wal *wal.WAL) {
 	for {
 		time.Sleep(1 * time.Minute)
 		db.waitForBackupToFinish()
-		err := wal.TruncateToSize(int64(db.opts.MaxWALSize))
+		err := db.truncateWAL(stream, wal)
 		if err != nil {
 			log.Errorf("Error truncating WAL: %v", err)
 		}
+		if db.opts.WALCompression != compress.None {
+			// entries are already compressed
+			continue
+		}
 		err = wal.CompressBeforeSize(int64(db.opts.WALCompressionSize))
 		if err != nil {
 			log.Errorf("Error compressing WAL: %v", err)
@@ -385,7 +961,12 @@ func (db *DB) capWALAge(wal *wal.WAL) {
 func (db *DB) trackMemStats() {
 	for {
 		db.updateMemStats()
-		time.Sleep(2 * time.Second)
+		interval := memStatsInterval
+		if db.relieveMemoryPressure() {
+			// keep a closer eye on memory while under pressure
+			interval = memoryPressureInterval
+		}
+		time.Sleep(interval)
 	}
 }
 
@@ -457,22 +1038,15 @@ func (db *DB) capMemorySize(allowFlush bool) bool {
 	}
 
 	if !db.opts.Passthrough && allowFlush {
-		db.tablesMutex.RLock()
-		sizes := make(byCurrentSize, 0, len(db.tables))
-		for _, table := range db.tables {
-			if !table.Virtual {
-				sizes = append(sizes, &memStoreSize{table, table.memStoreSize()})
-			}
-		}
-		db.tablesMutex.RUnlock()
+		sizes := db.memStoreSizes()
 
 		db.flushMutex.Lock()
 		actual = atomic.LoadUint64(&db.memory)
-		if actual > allowed {
+		if actual > allowed && len(sizes) > 0 {
 			// Force flushing on the table with the largest memstore
-			sort.Sort(sizes)
 			log.Debugf("Memory usage of %v exceeds allowed %v even after GC, forcing flush on %v", humanize.Bytes(actual), humanize.Bytes(allowed), sizes[0].t.Name)
 			sizes[0].t.forceFlush()
+			metrics.MemoryPressureFlush(sizes[0].t.Name, true)
 			db.updateMemStats()
 			log.Debugf("Done forcing flush on %v", sizes[0].t.Name)
 		}
@@ -487,6 +1061,35 @@ func (db *DB) maxMemoryBytes() uint64 {
 	return uint64(systemRAM * db.opts.MaxMemoryRatio)
 }
 
+func (db *DB) initSpill() error {
+	dir := db.opts.SpillDir
+	if dir == "" {
+		if db.opts.ReadOnly {
+			// No dir of our own, spill to temp dir without limits
+			db.spill = spill.Default()
+			return nil
+		}
+		dir = filepath.Join(db.opts.Dir, spillDir)
+	}
+	var err error
+	db.spill, err = spill.New(&spill.Opts{
+		Dir:              dir,
+		MaxBytes:         db.opts.MaxSpillBytes,
+		MaxBytesPerQuery: db.opts.MaxSpillBytesPerQuery,
+	})
+	return err
+}
+
+func (db *DB) spillMemory() int {
+	if db.opts.SpillMemory > 0 {
+		return db.opts.SpillMemory
+	}
+	if db.opts.MaxSortMemory > 0 {
+		return db.opts.MaxSortMemory
+	}
+	return int(db.maxMemoryBytes() / 10)
+}
+
 type memStoreSize struct {
 	t    *table
 	size int
@@ -500,7 +1103,7 @@ func (a byCurrentSize) Less(i, j int) bool { return a[i].size > a[j].size }
 
 // waitForBackupToFinish waits until there's no .backup_lock file in the dbdir
 func (db *DB) waitForBackupToFinish() {
-	lockFile := filepath.Join(db.opts.Dir, ".backup_lock")
+	lockFile := filepath.Join(db.opts.Dir, backupLockFilename)
 	start := time.Now()
 	for {
 		fi, err := os.Stat(lockFile)
@@ -15,13 +15,13 @@ import (
 	"github.com/davecgh/go-spew/spew"
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/errors"
-	"github.com/getlantern/wal"
 	"github.com/getlantern/withtimeout"
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
 	. "github.com/getlantern/zenodb/expr"
 	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/wal"
 
 	"testing"
 
@@ -60,6 +60,30 @@ func TestSingleDB(t *testing.T) {
 	})
 }
 
+func TestSingleDBEncrypted(t *testing.T) {
+	doTest(t, false, nil, func(tmpDir string, tmpFile string) (*DB, func(time.Time), func(), func(string, func(*table, bool))) {
+		db, err := NewDB(&DBOpts{
+			Dir:                     filepath.Join(tmpDir, "leader"),
+			SchemaFile:              tmpFile,
+			VirtualTime:             true,
+			ClusterQueryConcurrency: clusterQueryConcurrency,
+			EncryptionKeys: func() (map[uint32][]byte, error) {
+				return map[uint32][]byte{1: make([]byte, 32)}, nil
+			},
+		})
+		if !assert.NoError(t, err, "Unable to create leader DB") {
+			t.Fatal()
+		}
+		return db, func(t time.Time) {
+				db.clock.Advance(t)
+			}, func() {
+				db.FlushAll()
+			}, func(tableName string, cb func(tbl *table, isFollower bool)) {
+				cb(db.getTable(tableName), false)
+			}
+	})
+}
+
 func TestClusterPushdownSinglePartition(t *testing.T) {
 	doTestCluster(t, 1, []string{"r", "u"})
 }
@@ -99,12 +123,14 @@ func doTestCluster(t *testing.T, numPartitions int, partitionBy []string) {
 				NumPartitions: numPartitions,
 				Partition:     part,
 				Follow: func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error) {
-					leader.Follow(f(), cb)
+					if follow := f(); follow != nil {
+						leader.Follow(follow, cb)
+					}
 				},
 				RegisterRemoteQueryHandler: func(partition int, query planner.QueryClusterFN) {
 					var register func()
 					register = func() {
-						leader.RegisterQueryHandler(partition, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
+						leader.RegisterQueryHandler(partition, "", func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
 							// Re-register immediately
 							go register()
 							result, err := query(common.WithIncludeMemStore(ctx, true), sqlString, isSubQuery, subQueryResults, unflat, onFields, func(key bytemap.ByteMap, vals core.Vals) (bool, error) {
@@ -398,7 +424,7 @@ view_a:
 	if !isClustered {
 		table := db.getTable("test_a")
 		fields := table.getFields()
-		table.iterate(context.Background(), fields, true, func(dims bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		table.iterate(context.Background(), fields, true, false, nil, func(dims bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
 			log.Debugf("Dims: %v")
 			for i, val := range vals {
 				field := fields[i]
@@ -420,6 +446,8 @@ view_a:
 		go testShiftQuery(&wg, t, db, includeMemStore, epoch, resolution)
 		wg.Add(1)
 		go testSubQuery(&wg, t, db, includeMemStore, epoch, resolution)
+		wg.Add(1)
+		go testExplain(&wg, t, db, isClustered, includeMemStore)
 		if false {
 			wg.Add(1)
 			go testAggregateQuery(&wg, t, db, includeMemStore, now, epoch, resolution, asOf, until, scalingFactor)
@@ -670,6 +698,49 @@ FROM (SELECT *
 	}.assert(t, db, sqlString, includeMemStore)
 }
 
+func testExplain(wg *sync.WaitGroup, t *testing.T, db *DB, isClustered bool, includeMemStore bool) {
+	defer wg.Done()
+
+	source, err := db.Query("EXPLAIN SELECT * FROM test_a GROUP BY _", false, nil, includeMemStore)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var fields core.Fields
+	var plan []string
+	var partitions []int
+	var estimatedRows float64
+	_, err = source.Iterate(context.Background(), func(inFields core.Fields) error {
+		fields = inFields
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		text := row.Key.Get(explainPlanDim).(string)
+		plan = append(plan, text)
+		if len(plan) == 1 {
+			estimatedRows = row.Values[0]
+		}
+		if strings.HasPrefix(strings.TrimSpace(text), "<- partition ") {
+			partitions = append(partitions, row.Key.Get(explainPartitionDim).(int))
+		}
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	log.Debugf("Explained plan:\n%v", strings.Join(plan, "\n"))
+	assert.Equal(t, []string{explainRowsField}, fields.Names())
+	if !assert.NotEmpty(t, plan) {
+		return
+	}
+	assert.True(t, strings.HasPrefix(plan[0], "<- "), "Plan should start with top level step")
+	assert.True(t, estimatedRows > 0, "Should have estimated scanned rows")
+	if isClustered {
+		assert.Len(t, partitions, db.opts.NumPartitions, "Plan should include every partition")
+		assert.Contains(t, strings.Join(plan, "\n"), fmt.Sprintf("partitions queried: %d of %d", db.opts.NumPartitions, db.opts.NumPartitions))
+	} else {
+		assert.Empty(t, partitions)
+	}
+}
+
 func testAggregateQuery(wg *sync.WaitGroup, t *testing.T, db *DB, includeMemStore bool, now time.Time, epoch time.Time, resolution time.Duration, asOf time.Time, until time.Time, scalingFactor int) {
 	defer wg.Done()
 
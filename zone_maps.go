@@ -0,0 +1,309 @@
+package zenodb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	// bloomBitsPerValue sizes the bloom filters of zone maps, which with
+	// bloomHashes gives a false positive rate of roughly 1%
+	bloomBitsPerValue = 10
+	bloomHashes       = 7
+
+	// maxBloomWords caps the size of a single bloom filter at 8 KB
+	maxBloomWords = 1024
+)
+
+// bloomFilter is a simple bloom filter of strings.
+type bloomFilter struct {
+	hashes uint8
+	words  []uint64
+}
+
+func newBloomFilter(numValues int) *bloomFilter {
+	numWords := (numValues*bloomBitsPerValue + 63) / 64
+	if numWords < 1 {
+		numWords = 1
+	}
+	if numWords > maxBloomWords {
+		numWords = maxBloomWords
+	}
+	return &bloomFilter{hashes: bloomHashes, words: make([]uint64, numWords)}
+}
+
+// positions calls cb with the bits for the given value, using double hashing.
+func (b *bloomFilter) positions(value string, cb func(word int, bit uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	sum := h.Sum64()
+	h1, h2 := sum&0xFFFFFFFF, (sum>>32)|1
+	numBits := uint64(len(b.words)) * 64
+	for i := uint64(0); i < uint64(b.hashes); i++ {
+		pos := (h1 + i*h2) % numBits
+		cb(int(pos/64), 1<<(pos%64))
+	}
+}
+
+func (b *bloomFilter) add(value string) {
+	b.positions(value, func(word int, bit uint64) {
+		b.words[word] |= bit
+	})
+}
+
+func (b *bloomFilter) mayContain(value string) bool {
+	result := true
+	b.positions(value, func(word int, bit uint64) {
+		if b.words[word]&bit == 0 {
+			result = false
+		}
+	})
+	return result
+}
+
+// zoneMap summarizes the dimension values of the rows in a row group of a
+// columnar segment, so that queries can skip row groups that can't contain any
+// rows matching their WHERE clause. Each dimension whose values are all
+// strings gets a bloom filter. Dimensions that don't appear in any row of the
+// group have an empty bloom filter.
+type zoneMap struct {
+	blooms map[string]*bloomFilter
+	// unindexed are dimensions with values other than strings, which could
+	// still compare equal to strings in a WHERE clause and so can't be used to
+	// skip row groups
+	unindexed map[string]bool
+}
+
+// zoneMapBuilder collects the dimension values of a row group.
+type zoneMapBuilder struct {
+	values    map[string]map[string]bool
+	unindexed map[string]bool
+}
+
+func newZoneMapBuilder() *zoneMapBuilder {
+	return &zoneMapBuilder{
+		values:    make(map[string]map[string]bool),
+		unindexed: make(map[string]bool),
+	}
+}
+
+func (b *zoneMapBuilder) addKey(key bytemap.ByteMap) {
+	key.IterateValues(func(dim string, value interface{}) bool {
+		str, ok := value.(string)
+		if !ok {
+			b.unindexed[dim] = true
+			return true
+		}
+		values := b.values[dim]
+		if values == nil {
+			values = make(map[string]bool)
+			b.values[dim] = values
+		}
+		values[str] = true
+		return true
+	})
+}
+
+func (b *zoneMapBuilder) build() *zoneMap {
+	zm := &zoneMap{
+		blooms:    make(map[string]*bloomFilter, len(b.values)),
+		unindexed: b.unindexed,
+	}
+	for dim, values := range b.values {
+		if b.unindexed[dim] {
+			continue
+		}
+		bloom := newBloomFilter(len(values))
+		for value := range values {
+			bloom.add(value)
+		}
+		zm.blooms[dim] = bloom
+	}
+	return zm
+}
+
+// excludes indicates that no row in the row group can have the given value
+// for the given dimension.
+func (zm *zoneMap) excludes(dim string, value string) bool {
+	if zm == nil || zm.unindexed[dim] {
+		return false
+	}
+	bloom := zm.blooms[dim]
+	if bloom == nil {
+		// none of the rows have this dimension
+		return true
+	}
+	return !bloom.mayContain(value)
+}
+
+// zoneMap encoding: numdims (16 bits)|dim1|dim2|...
+// dim: namelength (16 bits)|name|hashes (8 bits, 0 if unindexed)|numwords (16 bits)|words (64 bits each)
+func (zm *zoneMap) write(buf *bytes.Buffer) {
+	dims := make([]string, 0, len(zm.blooms)+len(zm.unindexed))
+	for dim := range zm.blooms {
+		dims = append(dims, dim)
+	}
+	for dim := range zm.unindexed {
+		dims = append(dims, dim)
+	}
+	sort.Strings(dims)
+	binary.Write(buf, encoding.Binary, uint16(len(dims)))
+	for _, dim := range dims {
+		binary.Write(buf, encoding.Binary, uint16(len(dim)))
+		buf.WriteString(dim)
+		bloom := zm.blooms[dim]
+		if bloom == nil {
+			buf.WriteByte(0)
+			continue
+		}
+		buf.WriteByte(bloom.hashes)
+		binary.Write(buf, encoding.Binary, uint16(len(bloom.words)))
+		binary.Write(buf, encoding.Binary, bloom.words)
+	}
+}
+
+func readZoneMap(r io.Reader) (*zoneMap, error) {
+	zm := &zoneMap{
+		blooms:    make(map[string]*bloomFilter),
+		unindexed: make(map[string]bool),
+	}
+	var numDims uint16
+	err := binary.Read(r, encoding.Binary, &numDims)
+	if err != nil {
+		return nil, errors.New("Unable to read number of zone map dimensions: %v", err)
+	}
+	for i := uint16(0); i < numDims; i++ {
+		var nameLength uint16
+		err = binary.Read(r, encoding.Binary, &nameLength)
+		if err != nil {
+			return nil, errors.New("Unable to read zone map dimension length: %v", err)
+		}
+		name := make([]byte, nameLength)
+		_, err = io.ReadFull(r, name)
+		if err != nil {
+			return nil, errors.New("Unable to read zone map dimension: %v", err)
+		}
+		var hashes uint8
+		err = binary.Read(r, encoding.Binary, &hashes)
+		if err != nil {
+			return nil, errors.New("Unable to read bloom filter hashes: %v", err)
+		}
+		if hashes == 0 {
+			zm.unindexed[string(name)] = true
+			continue
+		}
+		var numWords uint16
+		err = binary.Read(r, encoding.Binary, &numWords)
+		if err != nil {
+			return nil, errors.New("Unable to read bloom filter length: %v", err)
+		}
+		bloom := &bloomFilter{hashes: hashes, words: make([]uint64, numWords)}
+		err = binary.Read(r, encoding.Binary, bloom.words)
+		if err != nil {
+			return nil, errors.New("Unable to read bloom filter: %v", err)
+		}
+		zm.blooms[string(name)] = bloom
+	}
+	return zm, nil
+}
+
+// segmentFilter describes the data that a query can use in terms of time range
+// and required dimension values, so that iterating over columnar segments can
+// skip the row groups and columns that it can't use.
+type segmentFilter struct {
+	asOf   int64
+	until  int64
+	equals map[string]string
+}
+
+func newSegmentFilter(asOf time.Time, until time.Time, equals map[string]string) *segmentFilter {
+	f := &segmentFilter{asOf: asOf.UnixNano(), until: until.UnixNano(), equals: equals}
+	if until.IsZero() {
+		f.until = 0
+	}
+	return f
+}
+
+// excludesTime indicates that data with periods between minTS and maxTS (in
+// unix nanos) falls outside of the time range.
+func (f *segmentFilter) excludesTime(minTS int64, maxTS int64) bool {
+	return maxTS < f.asOf || (f.until > 0 && minTS > f.until)
+}
+
+// excludesDims indicates that none of the rows summarized by zm can have the
+// required dimension values.
+func (f *segmentFilter) excludesDims(zm *zoneMap) bool {
+	for dim, value := range f.equals {
+		if zm.excludes(dim, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentFilters combine the segmentFilters of coalesced iterations. Data is
+// only skipped if every filter excludes it. Nil segmentFilters don't exclude
+// anything.
+type segmentFilters []*segmentFilter
+
+// segmentFiltersFor returns the segmentFilters for the given iterations, or nil
+// if any of them aren't filtered.
+func segmentFiltersFor(iterations []*iteration) segmentFilters {
+	filters := make(segmentFilters, 0, len(iterations))
+	for _, it := range iterations {
+		if it.filter == nil {
+			return nil
+		}
+		filters = append(filters, it.filter)
+	}
+	return filters
+}
+
+func (filters segmentFilters) excludesTime(minTS int64, maxTS int64) bool {
+	if len(filters) == 0 {
+		return false
+	}
+	for _, f := range filters {
+		if !f.excludesTime(minTS, maxTS) {
+			return false
+		}
+	}
+	return true
+}
+
+// excludesGroup indicates that none of the filters can use any of the rows in
+// the given row group.
+func (filters segmentFilters) excludesGroup(group *columnarGroup) bool {
+	if len(filters) == 0 {
+		return false
+	}
+	minTS, maxTS := group.timeRange()
+	for _, f := range filters {
+		if !f.excludesTime(minTS, maxTS) && !f.excludesDims(group.zoneMap) {
+			return false
+		}
+	}
+	return true
+}
+
+// excludesEncodedKey indicates that none of the filters can use the row with
+// the given key, which was encoded with dict.
+func (filters segmentFilters) excludesEncodedKey(dict *dimensionDictionary, encodedKey []byte) bool {
+	if len(filters) == 0 {
+		return false
+	}
+	for _, f := range filters {
+		if !dict.excludes(encodedKey, f.equals) {
+			return false
+		}
+	}
+	return true
+}
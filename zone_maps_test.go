@@ -0,0 +1,145 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZoneMap(t *testing.T) {
+	b := newZoneMapBuilder()
+	for i := 0; i < 1000; i++ {
+		b.addKey(bytemap.New(map[string]interface{}{"server": fmt.Sprintf("server%d", i), "port": i}))
+	}
+	buf := &bytes.Buffer{}
+	b.build().write(buf)
+	zm, err := readZoneMap(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for i := 0; i < 1000; i++ {
+		assert.False(t, zm.excludes("server", fmt.Sprintf("server%d", i)), "bloom filter should never have false negatives")
+	}
+	falsePositives := 0
+	for i := 1000; i < 2000; i++ {
+		if !zm.excludes("server", fmt.Sprintf("server%d", i)) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 50, "too many false positives: %d", falsePositives)
+	assert.False(t, zm.excludes("port", "5"), "dimensions with values other than strings can't exclude anything")
+	assert.True(t, zm.excludes("dc", "dc1"), "dimension that's absent from all rows should exclude everything")
+	assert.False(t, (*zoneMap)(nil).excludes("server", "x"), "missing zone map shouldn't exclude anything")
+
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	group := &columnarGroup{
+		columns: []columnarColumn{
+			{minTS: epoch.UnixNano(), maxTS: epoch.Add(time.Hour).UnixNano()},
+			{minTS: epoch.Add(time.Hour).UnixNano(), maxTS: epoch.Add(2 * time.Hour).UnixNano()},
+		},
+		zoneMap: zm,
+	}
+	inRange := newSegmentFilter(epoch.Add(90*time.Minute), epoch.Add(3*time.Hour), nil)
+	outOfRange := newSegmentFilter(epoch.Add(3*time.Hour), time.Time{}, nil)
+	otherServer := newSegmentFilter(epoch, epoch.Add(3*time.Hour), map[string]string{"server": "server10000"})
+	assert.False(t, segmentFilters(nil).excludesGroup(group))
+	assert.False(t, segmentFilters{inRange}.excludesGroup(group))
+	assert.True(t, segmentFilters{outOfRange}.excludesGroup(group))
+	assert.True(t, segmentFilters{otherServer}.excludesGroup(group))
+	assert.True(t, segmentFilters{outOfRange, otherServer}.excludesGroup(group))
+	assert.False(t, segmentFilters{outOfRange, inRange}.excludesGroup(group), "coalesced iterations should only skip what all of them exclude")
+	assert.True(t, segmentFilters{inRange}.excludesTime(group.columns[0].minTS, group.columns[0].maxTS))
+	assert.False(t, segmentFilters{inRange}.excludesTime(group.columns[1].minTS, group.columns[1].maxTS))
+}
+
+func TestSegmentFilterRowLayout(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	db, err := NewDB(&DBOpts{
+		Dir:                       tmpDir,
+		Clock:                     vtime.NewVirtualClock(epoch),
+		IterationCoalesceInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	if !assert.NoError(t, db.ApplySchema(Schema{
+		"test_row": &TableOpts{
+			RetentionPeriod: 24 * time.Hour,
+			SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY server, dc, period(1h)",
+		},
+	})) {
+		return
+	}
+
+	insert := func(ts time.Time) {
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, db.Insert("inbound", ts, map[string]interface{}{"server": fmt.Sprintf("server%d", i), "dc": "dc1"}, map[string]float64{"a": float64(i)}))
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	insert(epoch.Add(-3 * time.Hour))
+	insert(epoch.Add(-2 * time.Hour))
+	db.FlushAll()
+	// Leave the latest data in the memstore
+	insert(epoch.Add(-1 * time.Hour))
+
+	tbl := db.getTable("test_row")
+	assert.Equal(t, CurrentFileVersion, versionFor(tbl.rowStore.fileStore.filename))
+
+	// Row filestores have no zone maps, so they only skip rows whose dimensions
+	// don't match, never by time
+	iterateFiltered := func(filter *segmentFilter) int {
+		rows := 0
+		_, err := tbl.rowStore.fileStore.iterateFiltered(segmentFilters{filter}, tbl.getFields(), nil, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			rows++
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return rows
+	}
+	assert.Equal(t, 10, iterateFiltered(newSegmentFilter(epoch.Add(time.Hour), epoch.Add(2*time.Hour), nil)), "row filestore shouldn't skip rows by time")
+	assert.Equal(t, 1, iterateFiltered(newSegmentFilter(epoch.Add(time.Hour), epoch.Add(2*time.Hour), map[string]string{"server": "server5"})))
+	assert.Zero(t, iterateFiltered(newSegmentFilter(time.Time{}, time.Time{}, map[string]string{"server": "nonexistent"})))
+
+	query := func(sqlString string) map[string]float64 {
+		source, err := db.Query(sqlString, false, nil, true)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		result := make(map[string]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result[fmt.Sprintf("%v %v", row.Key.Get("server"), time.Unix(0, row.TS).UTC().Format("15:04"))] = row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	assert.Equal(t, map[string]float64{
+		"server5 09:00": 5,
+		"server5 10:00": 5,
+		"server5 11:00": 5,
+	}, query("SELECT a FROM test_row ASOF '-12h' WHERE server = 'server5' AND dc = 'dc1' GROUP BY server, period(1h)"))
+	assert.Equal(t, map[string]float64{
+		"server7 11:00": 7,
+	}, query("SELECT a FROM test_row ASOF '-150m' WHERE server = 'server7' GROUP BY server, period(1h)"))
+	assert.Empty(t, query("SELECT a FROM test_row ASOF '-12h' WHERE server = 'server5' AND dc = 'dc2' GROUP BY server, period(1h)"))
+}